@@ -4,11 +4,11 @@
 // library for all cryptographic primitives.
 // Basically, you first need to setup a config file for the server by using:
 //
-//  ./conode setup
+//	./conode setup
 //
 // Then you can launch the daemon with:
 //
-//  ./conode
+//	./conode
 //
 // Services need to be imported to be available when the conode is
 // running.
@@ -17,25 +17,28 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"reflect"
 
-	cli "github.com/urfave/cli"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
-	_ "github.com/calypso-demo/filesharing/pkg/protocols/status"
-	_ "github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
 	_ "github.com/calypso-demo/filesharing/pkg/byzcoin/contracts"
-	_ "github.com/calypso-demo/filesharing/pkg/calypso"
+	"github.com/calypso-demo/filesharing/pkg/calypso"
+	"github.com/calypso-demo/filesharing/pkg/deploy"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	_ "github.com/calypso-demo/filesharing/pkg/protocols/contracts"
 	_ "github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	_ "github.com/calypso-demo/filesharing/pkg/protocols/status"
+	cli "github.com/urfave/cli"
 	"go.dedis.ch/kyber/v3/util/encoding"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/cfgpath"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
 )
 
 const (
@@ -88,6 +91,71 @@ func main() {
 			Usage:  "Start cothority server",
 			Action: runServer,
 		},
+		{
+			Name:      "deploy",
+			Usage:     "Generate the configuration and manifests of a whole cothority",
+			ArgsUsage: "output-directory",
+			Action:    deployCothority,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "nodes, n",
+					Usage: "number of conodes",
+					Value: 4,
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "prefix of the names of the conodes",
+					Value: "conode",
+				},
+				cli.IntFlag{
+					Name:  "port",
+					Usage: "port the conodes listen on inside their container",
+					Value: 7770,
+				},
+				cli.StringFlag{
+					Name:  "public-host",
+					Usage: "host where the websocket ports of the conodes are published",
+					Value: "localhost",
+				},
+				cli.IntFlag{
+					Name:  "public-port",
+					Usage: "first published port, every conode using two ports",
+					Value: 7770,
+				},
+				cli.StringFlag{
+					Name:  "image",
+					Usage: "docker image of the conodes",
+					Value: "filesharing/byzcoin:latest",
+				},
+				cli.IntFlag{
+					Name:  "debug-level",
+					Usage: "debug-level of the conodes",
+					Value: 2,
+				},
+				cli.BoolFlag{
+					Name:  "insecure-admin",
+					Usage: "allow admin requests from outside the containers - for tests only",
+				},
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "Move the calypso storage of the conode to another machine",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "write a snapshot of the storage, the shares encrypted under the operator key",
+					ArgsUsage: "operator-public-key output-file record-file...",
+					Action:    snapshotExport,
+				},
+				{
+					Name:      "import",
+					Usage:     "restore a snapshot on the conode, which must use the same private.toml",
+					ArgsUsage: "operator-private-key input-file",
+					Action:    snapshotImport,
+				},
+			},
+		},
 	}
 	cliApp.Flags = []cli.Flag{
 		cli.IntFlag{
@@ -121,9 +189,9 @@ func main() {
 }
 
 // raiseFdLimit is a callback that is only set in the context where it is needed:
-//  * when conode.go is used alone by ../libtest.sh, not needed
-//  * when conode is build on windows, not needed
-//  * when conode is build on unix, fd_unix.go sets it
+//   - when conode.go is used alone by ../libtest.sh, not needed
+//   - when conode is build on windows, not needed
+//   - when conode is build on unix, fd_unix.go sets it
 var raiseFdLimit func()
 
 func runServer(ctx *cli.Context) error {
@@ -132,10 +200,141 @@ func runServer(ctx *cli.Context) error {
 	if raiseFdLimit != nil {
 		raiseFdLimit()
 	}
-	app.RunServer(config)
+	if _, err := os.Stat(config); os.IsNotExist(err) {
+		return fmt.Errorf("configuration file %s does not exist", config)
+	}
+	_, srv, err := app.ParseCothority(config)
+	if err != nil {
+		return fmt.Errorf("couldn't parse config: %v", err)
+	}
+	// The calypso service needs the client certificates if the
+	// configuration requires them.
+	if srv.WebSocket.TLSConfig != nil {
+		calypso.RequestClientCertificates(srv.WebSocket.TLSConfig)
+	}
+	srv.Start()
+	return nil
+}
+
+func deployCothority(c *cli.Context) error {
+	dir := c.Args().First()
+	if dir == "" {
+		return errors.New("please give the output directory")
+	}
+	conf := deploy.Config{
+		Nodes:         c.Int("nodes"),
+		Name:          c.String("name"),
+		Port:          c.Int("port"),
+		PublicHost:    c.String("public-host"),
+		PublicPort:    c.Int("public-port"),
+		Image:         c.String("image"),
+		Debug:         c.Int("debug-level"),
+		InsecureAdmin: c.Bool("insecure-admin"),
+	}
+	if err := deploy.Generate(conf, dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote configuration of %d conodes to %v\n", conf.Nodes, dir)
 	return nil
 }
 
+// snapshotExport asks the running conode for a snapshot of its calypso
+// storage and writes it to a file. The conode is reached with the
+// configuration given by --config. The record files hold the proofs of the
+// LTS instances recording the export to the operator key, one for every LTS
+// of the conode.
+func snapshotExport(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return errors.New("please give the operator public key and the output file")
+	}
+	si, err := loadServerIdentity(c)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	operator, err := calypso.ParsePublicKey(buf)
+	if err != nil {
+		return err
+	}
+	var records []byzcoin.Proof
+	for _, name := range c.Args()[2:] {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var record byzcoin.Proof
+		err = protobuf.DecodeWithConstructors(buf, &record,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	sn, err := calypso.NewClient(nil).ExportSnapshot(si, operator, records)
+	if err != nil {
+		return err
+	}
+	buf, err = protobuf.Encode(sn)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.Args().Get(1), buf, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote snapshot to %v\n", c.Args().Get(1))
+	return nil
+}
+
+// snapshotImport reads a snapshot, seals its shares to the running conode
+// and restores it there.
+func snapshotImport(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return errors.New("please give the operator private key and the input file")
+	}
+	si, err := loadServerIdentity(c)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	operator, err := calypso.ParseSigner(buf)
+	if err != nil {
+		return err
+	}
+	buf, err = ioutil.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	sn := &calypso.Snapshot{}
+	err = protobuf.DecodeWithConstructors(buf, sn,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return err
+	}
+	if err := sn.Seal(operator.Ed25519.Secret, si); err != nil {
+		return err
+	}
+	ltss, err := calypso.NewClient(nil).ImportSnapshot(si, sn)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d LTSs on %v\n", ltss, si.Address)
+	return nil
+}
+
+func loadServerIdentity(c *cli.Context) (*network.ServerIdentity, error) {
+	ccfg, err := app.LoadCothority(c.GlobalString("config"))
+	if err != nil {
+		return nil, err
+	}
+	return ccfg.GetServerIdentity()
+}
+
 func setup(c *cli.Context) error {
 	if c.Bool("non-interactive") {
 		host := c.String("host")
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"strconv"
 	"time"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/darc"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/calypso-demo/filesharing/pkg/protocols/status"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
@@ -164,6 +166,14 @@ func (c *Client) AddTransaction(tx ClientTransaction) (*AddTxResponse, error) {
 // any feedback on the transaction. The Client's Roster and ID should be
 // initialized before calling this method (see NewClientFromConfig).
 func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxResponse, error) {
+	return c.AddTransactionWithProof(tx, wait, nil)
+}
+
+// AddTransactionWithProof works like AddTransactionAndWait, but the proof of
+// the reply is for the instance with the given key, so that the caller can
+// check what the transaction stored without asking for a proof again. The
+// proof is only returned if wait is above 0.
+func (c *Client) AddTransactionWithProof(tx ClientTransaction, wait int, key []byte) (*AddTxResponse, error) {
 	if c.Genesis == nil {
 		if err := c.fetchGenesis(); err != nil {
 			return nil, xerrors.Errorf("fetching genesis: %v", err)
@@ -189,6 +199,7 @@ func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxRe
 		Transaction:   tx,
 		InclusionWait: wait,
 		ProofFrom:     latest.Hash,
+		ProofKey:      key,
 	}, reply, c.options)
 	if err != nil {
 		return nil, xerrors.Errorf("sending: %v", err)
@@ -211,6 +222,37 @@ func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxRe
 	return reply, nil
 }
 
+// TxQueueDepth returns the highest number of transactions of this chain
+// waiting to be included in a block on the nodes of the roster, together
+// with the size of the buffer, as reported by the status service. Nodes that
+// don't answer are ignored, but at least one must answer.
+func (c *Client) TxQueueDepth() (depth, size int, err error) {
+	cl := status.NewClient()
+	answered := false
+	for _, si := range c.Roster.List {
+		resp, err := cl.Request(si)
+		if err != nil {
+			log.Lvl2("couldn't get status of", si, err)
+			continue
+		}
+		st, ok := resp.Status[ServiceName]
+		if !ok {
+			continue
+		}
+		answered = true
+		if d, err := strconv.Atoi(st.Field[txQueueField(c.ID)]); err == nil && d > depth {
+			depth = d
+		}
+		if m, err := strconv.Atoi(st.Field["TxQueueMax"]); err == nil && m > size {
+			size = m
+		}
+	}
+	if !answered {
+		return 0, 0, xerrors.New("no node reported its transaction queue")
+	}
+	return depth, size, nil
+}
+
 // GetProof returns a proof for the key stored in the skipchain starting from
 // the genesis block. The proof can prove the existence or the absence of the
 // key. Note that the integrity of the proof is verified.
@@ -260,10 +302,9 @@ func (c *Client) GetProofFrom(key []byte, from *skipchain.SkipBlock) (*GetProofR
 // starting from the latest known block by this client. The proof will always
 // be newer than the barrier or it will return an error.
 //
-// 	key - Instance ID to be included in the proof.
+//	key - Instance ID to be included in the proof.
 //	full - When true, the proof returned will start from the genesis block.
 //	block - The latest block won't be older than the barrier.
-//
 func (c *Client) GetProofAfter(key []byte, full bool, block *skipchain.SkipBlock) (rep *GetProofResponse, err error) {
 	if full {
 		rep, err = c.getProofRaw(key, c.Genesis, block)
@@ -280,7 +321,7 @@ func (c *Client) GetProofAfter(key []byte, full bool, block *skipchain.SkipBlock
 // changed.
 //
 // The available flag(s) are:
-//   - 	GUFSendVersion0 - always send version0 instances
+//   - GUFSendVersion0 - always send version0 instances
 func (c *Client) GetUpdates(keyVer []IDVersion, flags GetUpdatesFlags,
 	latest skipchain.SkipBlockID) (rep *GetUpdatesReply,
 	err error) {
@@ -5,10 +5,10 @@ import (
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/require"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
@@ -165,6 +165,59 @@ func TestClient_GetProof(t *testing.T) {
 	require.Equal(t, 1, len(p.Proof.Links))
 }
 
+func TestClient_Batch(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(t, servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity())
+	require.NoError(t, err)
+	msg.BlockInterval = 100 * time.Millisecond
+	d := msg.GenesisDarc
+
+	c, _, err := NewLedger(msg, false)
+	require.NoError(t, err)
+
+	_, err = c.NewBatch(signer).Send(10)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the batch is empty")
+
+	// Both instructions are in the same transaction, with the counters 1
+	// and 2.
+	values := [][]byte{{1, 2, 3}, {4, 5, 6}}
+	batch := c.NewBatch(signer).
+		Add(createSpawnInstr(d.GetBaseID(), dummyContract, "data", values[0])).
+		Add(createSpawnInstr(d.GetBaseID(), dummyContract, "data", values[1]))
+	require.Equal(t, 2, batch.Len())
+	reply, err := batch.Send(10)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, reply.Transaction.Instructions[0].SignerCounter)
+	require.Equal(t, []uint64{2}, reply.Transaction.Instructions[1].SignerCounter)
+	for i, value := range values {
+		key := reply.Transaction.Instructions[i].Hash()
+		p, err := c.GetProof(key)
+		require.NoError(t, err)
+		require.True(t, p.Proof.InclusionProof.Match(key))
+		_, v, _, _, err := p.Proof.KeyValue()
+		require.NoError(t, err)
+		require.Equal(t, value, v)
+	}
+	id, err := reply.InstanceID(1)
+	require.NoError(t, err)
+	require.Equal(t, reply.Transaction.Instructions[1].DeriveID(""), id)
+	_, err = reply.InstanceID(2)
+	require.Error(t, err)
+
+	// The next batch starts after the counters of the previous one.
+	reply, err = c.NewBatch(signer).
+		Add(createSpawnInstr(d.GetBaseID(), dummyContract, "data", []byte{7})).
+		Send(10)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, reply.Transaction.Instructions[0].SignerCounter)
+}
+
 func TestClient_GetProofCorrupted(t *testing.T) {
 	l := onet.NewTCPTest(cothority.Suite)
 	servers, roster, _ := l.GenTree(1, true)
@@ -0,0 +1,110 @@
+package byzcoin
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"golang.org/x/xerrors"
+)
+
+// A Batch collects instructions, e.g. a coin transfer together with the
+// value update it pays for, and sends them in a single transaction, so that
+// either all of them are applied, or none. The counters of the signers are
+// fetched once when the batch is sent, and every instruction gets the next
+// counter of every signer, in the order the instructions were added.
+//
+// As the IDs of the instances spawned by the batch depend on the signatures,
+// they are only known once the batch is signed, and are returned by
+// BatchReply.InstanceID.
+
+// Batch is a list of instructions signed by the same signers.
+type Batch struct {
+	client  *Client
+	signers []darc.Signer
+	instrs  Instructions
+}
+
+// BatchReply is returned by Batch.Send.
+type BatchReply struct {
+	*AddTxResponse
+	// Transaction is the signed transaction sent to the ledger.
+	Transaction ClientTransaction
+}
+
+// NewBatch returns an empty batch of instructions signed by all the
+// signers.
+func (c *Client) NewBatch(signers ...darc.Signer) *Batch {
+	return &Batch{client: c, signers: signers}
+}
+
+// Add appends the instructions to the batch. Their SignerCounter and
+// SignerIdentities are overwritten when the batch is signed. It returns the
+// batch, so that calls can be chained.
+func (b *Batch) Add(instrs ...Instruction) *Batch {
+	b.instrs = append(b.instrs, instrs...)
+	return b
+}
+
+// Len returns the number of instructions in the batch.
+func (b *Batch) Len() int {
+	return len(b.instrs)
+}
+
+// Sign fetches the counters of the signers and returns the signed
+// transaction of the batch, without sending it.
+func (b *Batch) Sign() (ClientTransaction, error) {
+	if len(b.instrs) == 0 {
+		return ClientTransaction{}, xerrors.New("the batch is empty")
+	}
+	if len(b.signers) == 0 {
+		return ClientTransaction{}, xerrors.New("the batch has no signers")
+	}
+	var ids []string
+	for _, signer := range b.signers {
+		ids = append(ids, signer.Identity().String())
+	}
+	ctrs, err := b.client.GetSignerCounters(ids...)
+	if err != nil {
+		return ClientTransaction{}, xerrors.Errorf("getting signer counters: %v", err)
+	}
+	if len(ctrs.Counters) != len(b.signers) {
+		return ClientTransaction{}, xerrors.New("wrong number of signer counters")
+	}
+
+	instrs := make(Instructions, len(b.instrs))
+	copy(instrs, b.instrs)
+	for i := range instrs {
+		instrs[i].SignerCounter = make([]uint64, len(ctrs.Counters))
+		for j, ctr := range ctrs.Counters {
+			instrs[i].SignerCounter[j] = ctr + 1 + uint64(i)
+		}
+	}
+	ctx := NewClientTransaction(CurrentVersion, instrs...)
+	if err := ctx.FillSignersAndSignWith(b.signers...); err != nil {
+		return ClientTransaction{}, xerrors.Errorf("signing: %v", err)
+	}
+	return ctx, nil
+}
+
+// Send signs the batch and adds its transaction to the ledger, waiting up to
+// wait block intervals for it to be included.
+func (b *Batch) Send(wait int) (*BatchReply, error) {
+	ctx, err := b.Sign()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding transaction: %v", err)
+	}
+	return &BatchReply{AddTxResponse: resp, Transaction: ctx}, nil
+}
+
+// InstanceID returns the ID derived by the i-th instruction of the batch,
+// which is the ID of the instance it spawned, for most contracts. It returns
+// an error if the batch has no i-th instruction.
+func (br *BatchReply) InstanceID(i int) (InstanceID, error) {
+	if i < 0 || i >= len(br.Transaction.Instructions) {
+		return InstanceID{}, xerrors.Errorf("no instruction %d in a batch of %d",
+			i, len(br.Transaction.Instructions))
+	}
+	return br.Transaction.Instructions[i].DeriveID(""), nil
+}
@@ -10,11 +10,11 @@ import (
 	"sync"
 	"time"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
-	"github.com/calypso-demo/filesharing/pkg/protocols/blscosi/protocol"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/viewchange"
 	"github.com/calypso-demo/filesharing/pkg/darc"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/blscosi/protocol"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/network"
@@ -195,7 +195,7 @@ func GetContractRegistry() ReadOnlyContractRegistry {
 // InstanceID's to be used in the implementation of a contract's `Spawn()`
 // method, using the following formula:
 //
-//     instanceID = sha256(prefix | seed)
+//	instanceID = sha256(prefix | seed)
 //
 // `prefix` and `seed` are arbitrary values provided by the caller.
 // Synthetic Spawn instructions generated by an EVM contract will receive a
@@ -236,9 +236,10 @@ func (b BasicContract) VerifyDeferredInstruction(rst ReadOnlyStateTrie, inst Ins
 	return notImpl("VerifyDeferredInstruction")
 }
 
-// MakeAttrInterpreters provides one default attribute verification which check
-// whether the transaction is sent after a certain block index and before
-// another block index.
+// MakeAttrInterpreters provides two default attribute verifications. The
+// "block" attribute checks whether the transaction is sent after a certain
+// block index and before another block index. The "time" attribute checks
+// whether the timestamp of the block is in a TimeWindow.
 func (b BasicContract) MakeAttrInterpreters(rst ReadOnlyStateTrie, inst Instruction) darc.AttrInterpreters {
 	cb := func(attr string) error {
 		vals, err := url.ParseQuery(attr)
@@ -277,7 +278,7 @@ func (b BasicContract) MakeAttrInterpreters(rst ReadOnlyStateTrie, inst Instruct
 		}
 		return xerrors.Errorf("the current block index is %d which does not fit in the interval (%d, %d)", rst.GetIndex(), after, before)
 	}
-	return darc.AttrInterpreters{"block": cb}
+	return darc.AttrInterpreters{"block": cb, "time": evalTimeAttr(rst)}
 }
 
 // Spawn is not implmented in a BasicContract. Types which embed BasicContract
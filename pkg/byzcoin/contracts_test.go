@@ -2,6 +2,7 @@ package byzcoin
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -36,3 +37,44 @@ func TestContracts_Registry(t *testing.T) {
 	require.Error(t, r.register("c", testContractFn, false))
 	require.NoError(t, r.register("c", testContractFn, true))
 }
+
+// Test the parsing and the evaluation of the "time" attribute.
+func TestContracts_TimeWindow(t *testing.T) {
+	// Monday, 6 January 2020, 10:30 UTC.
+	monday := time.Date(2020, 1, 6, 10, 30, 0, 0, time.UTC)
+	tw := TimeWindow{
+		After:    monday.Add(-time.Hour),
+		Before:   monday.Add(24 * time.Hour),
+		Weekdays: []time.Weekday{time.Monday, time.Tuesday},
+		FromHour: 9,
+		ToHour:   17,
+		Offset:   60 * time.Minute,
+	}
+	attr := tw.Attr()
+	require.Equal(t, "attr:time:after=1578303000&before=1578393000&"+
+		"weekdays=mon,tue&hours=9-17&offset=60", attr)
+	parsed, err := ParseTimeWindow(attr[len("attr:time:"):])
+	require.NoError(t, err)
+	require.Equal(t, tw.Attr(), parsed.Attr())
+
+	require.NoError(t, parsed.Contains(monday))
+	require.Error(t, parsed.Contains(monday.Add(-2*time.Hour)))
+	require.Error(t, parsed.Contains(monday.Add(24*time.Hour)))
+	// 16:30 UTC is 17:30 with the offset.
+	require.Error(t, parsed.Contains(monday.Add(6*time.Hour)))
+
+	// Sunday is refused, and the hours can wrap over midnight.
+	tw = TimeWindow{Weekdays: []time.Weekday{time.Monday}, FromHour: 22,
+		ToHour: 2}
+	require.NoError(t, tw.Contains(time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC)))
+	require.NoError(t, tw.Contains(time.Date(2020, 1, 6, 1, 0, 0, 0, time.UTC)))
+	require.Error(t, tw.Contains(time.Date(2020, 1, 6, 12, 0, 0, 0, time.UTC)))
+	require.Error(t, tw.Contains(time.Date(2020, 1, 5, 23, 0, 0, 0, time.UTC)))
+	require.Equal(t, "attr:time:", TimeWindow{}.Attr())
+
+	for _, bad := range []string{"after=x", "weekdays=mon,sunday", "hours=9",
+		"hours=9-25", "offset=1440"} {
+		_, err := ParseTimeWindow(bad)
+		require.Error(t, err, bad)
+	}
+}
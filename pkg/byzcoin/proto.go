@@ -79,6 +79,13 @@ type CreateGenesisBlock struct {
 	// DarcContracts is the set of contracts that can be parsed as a DARC.
 	// At least one contract must be given.
 	DarcContractIDs []string
+	// BaseHeight is the base of the skiplinks of the chain. A higher base
+	// gives fewer skiplinks. Zero means use the default, 4.
+	BaseHeight int `protobuf:"opt"`
+	// MaximumHeight is the maximum number of skiplinks of a block. Higher
+	// blocks give shorter proofs on long chains. Zero means use the
+	// default, 32.
+	MaximumHeight int `protobuf:"opt"`
 }
 
 // CreateGenesisBlockResponse holds the genesis-block of the new skipchain.
@@ -104,6 +111,9 @@ type AddTxRequest struct {
 	// is empty, the proof will start from the genesis block. The proof is
 	// returned only when InclusionWait is above 0.
 	ProofFrom skipchain.SkipBlockID `protobuf:"opt"`
+	// ProofKey is the key of the instance the proof is for. If this field
+	// is empty, the proof only shows the block.
+	ProofKey []byte `protobuf:"opt"`
 }
 
 // AddTxResponse is the reply after an AddTxRequest is finished.
@@ -112,7 +122,8 @@ type AddTxResponse struct {
 	Version Version
 	// Error message describes why the transaction failed.
 	Error string `protobuf:"opt"`
-	// Proof of the block with the transaction.
+	// Proof of the block with the transaction, for the key given in
+	// AddTxRequest.ProofKey.
 	Proof *Proof `protobuf:"opt"`
 }
 
@@ -171,11 +182,11 @@ type ChainConfig struct {
 
 // Proof represents everything necessary to verify a given
 // key/value pair is stored in a skipchain. The proof is in three parts:
-//   1. InclusionProof proves the presence or absence of the key. In case of
-//   the key being present, the value is included in the proof.
-//   2. Latest is used to verify the Merkle tree root used in the proof is
-//   stored in the latest skipblock.
-//   3. Links proves that the latest skipblock is part of the skipchain.
+//  1. InclusionProof proves the presence or absence of the key. In case of
+//     the key being present, the value is included in the proof.
+//  2. Latest is used to verify the Merkle tree root used in the proof is
+//     stored in the latest skipblock.
+//  3. Links proves that the latest skipblock is part of the skipchain.
 //
 // This Structure could later be moved to cothority/skipchain.
 type Proof struct {
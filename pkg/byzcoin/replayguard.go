@@ -80,6 +80,13 @@ func verifySignerCounters(st ReadOnlyStateTrie, counters []uint64, ids []darc.Id
 	return nil
 }
 
+// VerifySignerCounters verifies whether the given counters are valid with
+// respect to the current counters. It is exported for contracts that
+// implement their own VerifyInstruction.
+func VerifySignerCounters(st ReadOnlyStateTrie, counters []uint64, ids []darc.Identity) error {
+	return verifySignerCounters(st, counters, ids)
+}
+
 func publicVersionKey(id string) []byte {
 	h := sha256.New()
 	h.Write([]byte("signercounter_"))
@@ -17,11 +17,11 @@ import (
 
 	uuid "gopkg.in/satori/go.uuid.v1"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
-	"github.com/calypso-demo/filesharing/pkg/protocols/blscosi/protocol"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/trie"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/viewchange"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/blscosi/protocol"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
@@ -171,6 +171,10 @@ type Service struct {
 	// ByzCoin chains.
 	defaultVersion     Version
 	defaultVersionLock sync.Mutex
+
+	// txCallback is called with the transactions sent by the clients, see
+	// RegisterTransactionCallback.
+	txCallback func(*http.Request, ClientTransaction) error
 }
 
 type downloadState struct {
@@ -192,6 +196,13 @@ const defaultInterval = 5 * time.Second
 // defaultMaxBlockSize is used when the config cannot be loaded.
 const defaultMaxBlockSize = 4 * 1e6
 
+// defaultBaseHeight and defaultMaximumHeight are used if the genesis
+// request doesn't set the heights of the chain.
+const (
+	defaultBaseHeight    = 4
+	defaultMaximumHeight = 32
+)
+
 // bcStorage is used to save our data locally.
 type bcStorage struct {
 	// PropTimeout is used when sending the request to integrate a new block
@@ -269,6 +280,19 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 	bsBuf := make([]byte, 8)
 	binary.PutVarint(bsBuf, int64(req.MaxBlockSize))
 
+	if req.BaseHeight == 0 {
+		req.BaseHeight = defaultBaseHeight
+	}
+	if req.MaximumHeight == 0 {
+		req.MaximumHeight = defaultMaximumHeight
+	}
+	if req.BaseHeight < 0 || req.MaximumHeight < 0 {
+		return nil, xerrors.New("heights must not be negative")
+	}
+	if req.BaseHeight == 1 && req.MaximumHeight > 1 {
+		return nil, xerrors.New("maximum height must be 1 if the base height is 1")
+	}
+
 	rosterBuf, err := protobuf.Encode(&req.Roster)
 	if err != nil {
 		return nil, xerrors.Errorf("encoding roster: %v", err)
@@ -320,7 +344,8 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 		},
 	}
 
-	sb, err := s.createNewBlock(nil, &req.Roster, NewTxResults(ctx))
+	sb, err := s.createNewBlockWithHeights(nil, &req.Roster, NewTxResults(ctx),
+		req.BaseHeight, req.MaximumHeight)
 	if err != nil {
 		return nil, xerrors.Errorf("creating block: %v", err)
 	}
@@ -362,7 +387,7 @@ func (s *Service) prepareTxResponse(req *AddTxRequest, tx *TxResult) (*AddTxResp
 		from = req.ProofFrom
 	}
 
-	pr, err := NewProof(st, s.db(), from, nil)
+	pr, err := NewProof(st, s.db(), from, req.ProofKey)
 	if err != nil {
 		resp.Error = fmt.Sprintf("Couldn't return the proof of the transaction: %v", err)
 		log.Error(resp.Error)
@@ -744,6 +769,12 @@ func (s *Service) GetLastInstanceVersion(req *GetLastInstanceVersion) (*GetInsta
 	return entryToResponse(&sce, ok, err)
 }
 
+// TxQueueDepth returns the number of transactions of the chain waiting to be
+// included in a block on this node.
+func (s *Service) TxQueueDepth(scID skipchain.SkipBlockID) int {
+	return s.txBuffer.depth(string(scID))
+}
+
 // GetAllInstanceVersion looks for all the state changes of an instance
 // and responds with both the state change and the block index for
 // each version
@@ -853,11 +884,30 @@ func (s *Service) ProcessClientRequest(req *http.Request, path string, buf []byt
 			return nil, nil, xerrors.New("the 'debug'-endpoint is only allowed on loopback")
 		}
 	}
+	if path == "AddTxRequest" && s.txCallback != nil {
+		var atr AddTxRequest
+		err := protobuf.DecodeWithConstructors(buf, &atr,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("decoding transaction: %v", err)
+		}
+		if err := s.txCallback(req, atr.Transaction); err != nil {
+			return nil, nil, cothority.ErrorOrNil(err, "refusing transaction")
+		}
+	}
 
 	buf, stream, err := s.ServiceProcessor.ProcessClientRequest(req, path, buf)
 	return buf, stream, cothority.ErrorOrNil(err, "processing request")
 }
 
+// RegisterTransactionCallback sets a callback function, which is called with
+// the request of the client before a transaction sent with AddTransaction is
+// handled. The transaction is refused if it returns an error. The callback
+// is only called on the node the client sent the transaction to.
+func (s *Service) RegisterTransactionCallback(f func(*http.Request, ClientTransaction) error) {
+	s.txCallback = f
+}
+
 // Debug can be used to dump things from a byzcoin service. If byzcoinID is nil, it will return all
 // existing byzcoin instances. If byzcoinID is given, it will return all instances for that ID.
 func (s *Service) Debug(req *DebugRequest) (resp *DebugResponse, err error) {
@@ -989,6 +1039,15 @@ func (s *Service) SetPropagationTimeout(p time.Duration) {
 // inform all nodes to update their internal trie
 // to include the new transactions.
 func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx []TxResult) (*skipchain.SkipBlock, error) {
+	return s.createNewBlockWithHeights(scID, r, tx, defaultBaseHeight,
+		defaultMaximumHeight)
+}
+
+// createNewBlockWithHeights works like createNewBlock, and uses the given
+// heights if a genesis block is created. The blocks of an existing chain
+// keep the heights of its genesis block.
+func (s *Service) createNewBlockWithHeights(scID skipchain.SkipBlockID, r *onet.Roster, tx []TxResult,
+	baseHeight, maximumHeight int) (*skipchain.SkipBlock, error) {
 	var sb *skipchain.SkipBlock
 	var mr []byte
 	var sst *stagingStateTrie
@@ -1002,8 +1061,8 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx
 			return nil, xerrors.New("need roster for genesis block")
 		}
 		sb = skipchain.NewSkipBlock()
-		sb.MaximumHeight = 32
-		sb.BaseHeight = 4
+		sb.MaximumHeight = maximumHeight
+		sb.BaseHeight = baseHeight
 		// We have to register the verification functions in the genesis block
 		sb.VerifierIDs = []skipchain.VerifierID{skipchain.VerifyBase, Verify}
 
@@ -3010,6 +3069,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 		return nil, xerrors.Errorf("registering handlers: %v", err)
 	}
 	s.RegisterProcessorFunc(viewChangeMsgID, s.handleViewChangeReq)
+	s.RegisterStatusReporter("ByzCoin", &s.txBuffer)
 
 	if err := skipchain.RegisterVerification(c, Verify, s.verifySkipBlock); err != nil {
 		log.ErrFatal(err)
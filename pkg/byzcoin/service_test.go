@@ -14,13 +14,13 @@ import (
 	"go.etcd.io/bbolt"
 	"golang.org/x/xerrors"
 
-	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/require"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/trie"
 	"github.com/calypso-demo/filesharing/pkg/darc"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3/sign/eddsa"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/kyber/v3/util/random"
@@ -133,6 +133,20 @@ func TestService_CreateGenesisBlock(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, interval, genesisMsg.BlockInterval)
 	require.Equal(t, maxsz, genesisMsg.MaxBlockSize)
+	require.Equal(t, defaultBaseHeight, resp.Skipblock.BaseHeight)
+	require.Equal(t, defaultMaximumHeight, resp.Skipblock.MaximumHeight)
+
+	// The heights of the skiplinks can be chosen.
+	genesisMsg.BaseHeight = 1
+	genesisMsg.MaximumHeight = 2
+	_, err = service.CreateGenesisBlock(genesisMsg)
+	require.Error(t, err)
+	genesisMsg.BaseHeight = 2
+	genesisMsg.MaximumHeight = 10
+	resp, err = service.CreateGenesisBlock(genesisMsg)
+	require.NoError(t, err)
+	require.Equal(t, 2, resp.Skipblock.BaseHeight)
+	require.Equal(t, 10, resp.Skipblock.MaximumHeight)
 }
 
 func TestService_AddTransaction(t *testing.T) {
@@ -2118,8 +2132,8 @@ func TestService_DownloadState(t *testing.T) {
 // while a full running byzcoin is in place.
 //
 // Two things are not tested here:
-//   1. what if a leader fails and wants to catch up
-//   2. if the catchupFetchDBEntries = 1, it fails
+//  1. what if a leader fails and wants to catch up
+//  2. if the catchupFetchDBEntries = 1, it fails
 func TestService_DownloadStateRunning(t *testing.T) {
 
 	// Disabled because it is flaky. See issue.
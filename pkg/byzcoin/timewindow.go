@@ -0,0 +1,183 @@
+package byzcoin
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// A time window restricts a rule of a darc to some times of the block
+// holding the instruction, e.g. to office hours, with the "time" attribute:
+//
+//	attr:time:after=1577836800&before=1609459200&weekdays=mon,tue&hours=9-17&offset=60
+//
+// All parameters are optional. After and before are Unix times in seconds,
+// the instruction is accepted from after, included, until before, excluded.
+// Weekdays and hours are evaluated at the time of the block shifted by
+// offset, in minutes east of UTC. A fixed offset is used instead of a time
+// zone, so that every node evaluates the rule the same way, whatever time
+// zone database it has.
+
+// TimeWindow is the window of block times in which a "time" attribute
+// holds.
+type TimeWindow struct {
+	// After and Before bound the window, if they are not zero.
+	After  time.Time
+	Before time.Time
+	// Weekdays are the days of the week allowed. If it is empty, every day
+	// is allowed.
+	Weekdays []time.Weekday
+	// FromHour and ToHour are the hours of the day allowed, from FromHour
+	// until ToHour, which can be smaller than FromHour for a window over
+	// midnight. If they are equal, every hour is allowed.
+	FromHour int
+	ToHour   int
+	// Offset is the offset from UTC of the weekdays and hours.
+	Offset time.Duration
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Attr returns the "time" attribute of the window, to be used in a darc
+// expression.
+func (tw TimeWindow) Attr() string {
+	var params []string
+	if !tw.After.IsZero() {
+		params = append(params, "after="+strconv.FormatInt(tw.After.Unix(), 10))
+	}
+	if !tw.Before.IsZero() {
+		params = append(params, "before="+strconv.FormatInt(tw.Before.Unix(), 10))
+	}
+	if len(tw.Weekdays) > 0 {
+		var days []string
+		for _, d := range tw.Weekdays {
+			days = append(days, weekdayNames[d])
+		}
+		params = append(params, "weekdays="+strings.Join(days, ","))
+	}
+	if tw.FromHour != tw.ToHour {
+		params = append(params, "hours="+strconv.Itoa(tw.FromHour)+"-"+
+			strconv.Itoa(tw.ToHour))
+	}
+	if tw.Offset != 0 {
+		params = append(params, "offset="+
+			strconv.FormatInt(int64(tw.Offset/time.Minute), 10))
+	}
+	return "attr:time:" + strings.Join(params, "&")
+}
+
+// ParseTimeWindow returns the window of the parameters of a "time"
+// attribute, without the "attr:time:" prefix.
+func ParseTimeWindow(attr string) (*TimeWindow, error) {
+	vals, err := url.ParseQuery(attr)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing query: %v", err)
+	}
+	tw := &TimeWindow{}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"after", &tw.After}, {"before", &tw.Before}} {
+		if s := vals.Get(bound.name); s != "" {
+			sec, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid %s: %v", bound.name, err)
+			}
+			*bound.t = time.Unix(sec, 0)
+		}
+	}
+	if s := vals.Get("weekdays"); s != "" {
+		for _, name := range strings.Split(s, ",") {
+			day := -1
+			for i, n := range weekdayNames {
+				if n == strings.ToLower(name) {
+					day = i
+				}
+			}
+			if day < 0 {
+				return nil, xerrors.Errorf("invalid weekday %s", name)
+			}
+			tw.Weekdays = append(tw.Weekdays, time.Weekday(day))
+		}
+	}
+	if s := vals.Get("hours"); s != "" {
+		hours := strings.SplitN(s, "-", 2)
+		if len(hours) != 2 {
+			return nil, xerrors.New("hours must be of the form from-to")
+		}
+		if tw.FromHour, err = strconv.Atoi(hours[0]); err != nil {
+			return nil, xerrors.Errorf("invalid hours: %v", err)
+		}
+		if tw.ToHour, err = strconv.Atoi(hours[1]); err != nil {
+			return nil, xerrors.Errorf("invalid hours: %v", err)
+		}
+		if tw.FromHour < 0 || tw.FromHour > 24 || tw.ToHour < 0 || tw.ToHour > 24 {
+			return nil, xerrors.New("hours must be between 0 and 24")
+		}
+	}
+	if s := vals.Get("offset"); s != "" {
+		minutes, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid offset: %v", err)
+		}
+		if minutes <= -24*60 || minutes >= 24*60 {
+			return nil, xerrors.New("offset must be less than a day")
+		}
+		tw.Offset = time.Duration(minutes) * time.Minute
+	}
+	return tw, nil
+}
+
+// Contains returns an error if t is outside of the window.
+func (tw TimeWindow) Contains(t time.Time) error {
+	if !tw.After.IsZero() && t.Before(tw.After) {
+		return xerrors.Errorf("time %d is before %d", t.Unix(), tw.After.Unix())
+	}
+	if !tw.Before.IsZero() && !t.Before(tw.Before) {
+		return xerrors.Errorf("time %d is not before %d", t.Unix(), tw.Before.Unix())
+	}
+	local := t.UTC().Add(tw.Offset)
+	if len(tw.Weekdays) > 0 {
+		found := false
+		for _, d := range tw.Weekdays {
+			if local.Weekday() == d {
+				found = true
+			}
+		}
+		if !found {
+			return xerrors.Errorf("%s is not allowed", local.Weekday())
+		}
+	}
+	if tw.FromHour != tw.ToHour {
+		h := local.Hour()
+		in := h >= tw.FromHour && h < tw.ToHour
+		if tw.FromHour > tw.ToHour {
+			in = h >= tw.FromHour || h < tw.ToHour
+		}
+		if !in {
+			return xerrors.Errorf("hour %d is outside of %d-%d", h,
+				tw.FromHour, tw.ToHour)
+		}
+	}
+	return nil
+}
+
+// evalTimeAttr returns the interpreter of the "time" attribute, which
+// checks that the timestamp of the block holding the instruction is in the
+// window.
+func evalTimeAttr(rst ReadOnlyStateTrie) func(string) error {
+	return func(attr string) error {
+		tr, ok := rst.(TimeReader)
+		if !ok {
+			return xerrors.New("the time of the block is not available")
+		}
+		tw, err := ParseTimeWindow(attr)
+		if err != nil {
+			return xerrors.Errorf("parsing time window: %v", err)
+		}
+		return tw.Contains(time.Unix(0, tr.GetCurrentBlockTimestamp()))
+	}
+}
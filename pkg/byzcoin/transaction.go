@@ -8,12 +8,15 @@ import (
 	"fmt"
 	"hash"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/trie"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
@@ -121,7 +124,8 @@ func (ctx *ClientTransaction) SignWith(signers ...darc.Signer) error {
 // NewClientTransaction creates a transaction compatible with the version passed
 // in arguments. Depending on the version, the hash will have a different value.
 // Most common usage is:
-//   byzcoin.NewClientTransaction(byzcoin.CurrentVersion, instr...)
+//
+//	byzcoin.NewClientTransaction(byzcoin.CurrentVersion, instr...)
 func NewClientTransaction(v Version, instrs ...Instruction) ClientTransaction {
 	ctx := ClientTransaction{Instructions: instrs}
 	ctx.Instructions.SetVersion(v)
@@ -775,3 +779,35 @@ func (r *txBuffer) add(key string, newTx ClientTransaction) {
 		r.txsMap[key] = txs
 	}
 }
+
+// depth returns the number of transactions of the chain waiting to be
+// included in a block.
+func (r *txBuffer) depth(key string) int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.txsMap[key])
+}
+
+// GetStatus reports the number of transactions waiting to be included in a
+// block, in total and for every chain, so that clients can slow down before
+// the buffer is full.
+func (r *txBuffer) GetStatus() *onet.Status {
+	r.Lock()
+	defer r.Unlock()
+
+	out := map[string]string{
+		"TxQueueMax": strconv.Itoa(defaultMaxBufferSize),
+	}
+	total := 0
+	for key, txs := range r.txsMap {
+		out[txQueueField(skipchain.SkipBlockID(key))] = strconv.Itoa(len(txs))
+		total += len(txs)
+	}
+	out["TxQueue"] = strconv.Itoa(total)
+	return &onet.Status{Field: out}
+}
+
+// txQueueField is the status field holding the queue depth of a chain.
+func txQueueField(id skipchain.SkipBlockID) string {
+	return "TxQueue_" + hex.EncodeToString(id)
+}
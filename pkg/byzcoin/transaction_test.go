@@ -2,11 +2,13 @@ package byzcoin
 
 import (
 	"encoding/binary"
+	"strconv"
 	"testing"
 
-	"github.com/stretchr/testify/require"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin/trie"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/protobuf"
 )
 
@@ -124,6 +126,29 @@ func TestTransactionBuffer_TakeDisabled(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestTransactionBuffer_GetStatus(t *testing.T) {
+	b := newTxBuffer()
+	id1 := skipchain.SkipBlockID("abc")
+	id2 := skipchain.SkipBlockID("abcd")
+
+	for i := 0; i < 10; i++ {
+		b.add(string(id1), ClientTransaction{})
+	}
+	b.add(string(id2), ClientTransaction{})
+
+	st := b.GetStatus()
+	require.Equal(t, "11", st.Field["TxQueue"])
+	require.Equal(t, "10", st.Field[txQueueField(id1)])
+	require.Equal(t, "1", st.Field[txQueueField(id2)])
+	require.Equal(t, strconv.Itoa(defaultMaxBufferSize), st.Field["TxQueueMax"])
+
+	b.take(string(id1), -1)
+	st = b.GetStatus()
+	require.Equal(t, "1", st.Field["TxQueue"])
+	_, ok := st.Field[txQueueField(id1)]
+	require.False(t, ok)
+}
+
 func TestInstruction_DeriveIDArg(t *testing.T) {
 	inst := Instruction{
 		InstanceID: NewInstanceID([]byte("new instance")),
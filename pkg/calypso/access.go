@@ -0,0 +1,227 @@
+package calypso
+
+import (
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// QueryAccessAt returns who was allowed to spawn read-instances for a given
+// write-instance at a given point in the history of the chain. The point is
+// given either as a block index, or as a timestamp, in which case the last
+// block created before that time is used.
+//
+// The answer is computed from the versions of the darcs stored by ByzCoin,
+// so it is only available as long as the node keeps these versions.
+func (s *Service) QueryAccessAt(req *QueryAccessAt) (*QueryAccessAtReply, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	s.storage.RLock()
+	_, authorised := s.storage.AuthorisedByzCoinIDs[string(req.ByzCoinID)]
+	s.storage.RUnlock()
+	if !authorised {
+		return nil, xerrors.New("this ByzCoin ID is not authorised")
+	}
+	if err := s.checkNamespace(req.ByzCoinID, req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+
+	index := req.BlockIndex
+	if req.Timestamp != 0 {
+		var err error
+		index, err = s.blockIndexAt(req.ByzCoinID, req.Timestamp)
+		if err != nil {
+			return nil, xerrors.Errorf("getting block at timestamp: %v", err)
+		}
+	}
+
+	versions, err := bc.GetAllInstanceVersion(&byzcoin.GetAllInstanceVersion{
+		SkipChainID: req.ByzCoinID,
+		InstanceID:  req.WriteID,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting write versions: %v", err)
+	}
+	if len(versions.StateChanges) == 0 {
+		return nil, xerrors.New("unknown write instance")
+	}
+	created := versions.StateChanges[0]
+	if created.StateChange.ContractID != ContractWriteID {
+		return nil, xerrors.New("instance is not a write instance")
+	}
+	reply := &QueryAccessAtReply{BlockIndex: index}
+	if created.BlockIndex > index {
+		return reply, nil
+	}
+	reply.Exists = true
+
+	getDarc := func(id string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(id, "darc:") {
+			return nil
+		}
+		darcID, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := darcAt(bc, req.ByzCoinID, darcID, index)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+	d, err := darcAt(bc, req.ByzCoinID, created.StateChange.DarcID, index)
+	if err != nil {
+		return nil, xerrors.Errorf("getting darc of write: %v", err)
+	}
+	reply.Darc = *d
+	expr := d.Rules.Get(darc.Action("spawn:" + ContractReadID))
+	if expr == nil {
+		return reply, nil
+	}
+	reply.Rule = string(expr)
+	reply.Readers, err = collectIdentities(expr, getDarc, map[string]bool{})
+	if err != nil {
+		return nil, xerrors.Errorf("resolving readers: %v", err)
+	}
+	if req.Identity != "" {
+		reply.Allowed = darc.EvalExpr(expr, getDarc, req.Identity) == nil
+	}
+	return reply, nil
+}
+
+// darcAt returns the version of the darc that was valid at the given block
+// index.
+func darcAt(bc *byzcoin.Service, bcID skipchain.SkipBlockID, darcID darc.ID,
+	index int) (*darc.Darc, error) {
+	versions, err := bc.GetAllInstanceVersion(&byzcoin.GetAllInstanceVersion{
+		SkipChainID: bcID,
+		InstanceID:  byzcoin.NewInstanceID(darcID),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting darc versions: %v", err)
+	}
+	var found *byzcoin.StateChange
+	for i, v := range versions.StateChanges {
+		if v.BlockIndex > index {
+			break
+		}
+		found = &versions.StateChanges[i].StateChange
+	}
+	if found == nil {
+		return nil, xerrors.New("darc didn't exist at that time")
+	}
+	d, err := darc.NewFromProtobuf(found.Value)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding darc: %v", err)
+	}
+	return d, nil
+}
+
+// collectIdentities returns all identities found in the expression. Darcs
+// are replaced by the identities of their sign rule.
+func collectIdentities(expr expression.Expr, getDarc darc.GetDarc,
+	visited map[string]bool) ([]string, error) {
+	var ids []string
+	var issue error
+	Y := expression.InitParser(func(s string) bool {
+		if !strings.HasPrefix(s, "darc:") {
+			ids = append(ids, s)
+			return true
+		}
+		if visited[s] {
+			return true
+		}
+		visited[s] = true
+		d := getDarc(s, false)
+		if d == nil {
+			issue = xerrors.Errorf("unable to get the darc %s", s)
+			return false
+		}
+		sub, err := collectIdentities(d.Rules.GetSignExpr(), getDarc, visited)
+		if err != nil {
+			issue = err
+			return false
+		}
+		ids = append(ids, sub...)
+		return true
+	})
+	if _, err := expression.Evaluate(Y, expr); err != nil {
+		return nil, xerrors.Errorf("evaluating expression: %v", err)
+	}
+	if issue != nil {
+		return nil, issue
+	}
+	sort.Strings(ids)
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+// blockIndexAt returns the index of the last block of the chain created at
+// or before the given timestamp, in nanoseconds.
+func (s *Service) blockIndexAt(bcID skipchain.SkipBlockID, ts int64) (int, error) {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return 0, xerrors.New("couldn't get the skipchain service")
+	}
+	latest, err := sc.GetDB().GetLatestByID(bcID)
+	if err != nil {
+		return 0, xerrors.Errorf("getting latest block: %v", err)
+	}
+	first, err := s.blockTimestamp(bcID, 0)
+	if err != nil {
+		return 0, err
+	}
+	if ts < first {
+		return 0, xerrors.New("timestamp is before the genesis block")
+	}
+	// Binary search for the last block with a timestamp <= ts.
+	low, high := 0, latest.Index
+	for low < high {
+		mid := (low + high + 1) / 2
+		t, err := s.blockTimestamp(bcID, mid)
+		if err != nil {
+			return 0, err
+		}
+		if t <= ts {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low, nil
+}
+
+// blockTimestamp returns the timestamp, in nanoseconds, of the block of the
+// chain at the given index.
+func (s *Service) blockTimestamp(bcID skipchain.SkipBlockID, index int) (int64, error) {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return 0, xerrors.New("couldn't get the skipchain service")
+	}
+	reply, err := sc.GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+		Genesis: bcID,
+		Index:   index,
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("getting block %d: %v", index, err)
+	}
+	var header byzcoin.DataHeader
+	if err := protobuf.Decode(reply.SkipBlock.Data, &header); err != nil {
+		return 0, xerrors.Errorf("decoding header: %v", err)
+	}
+	return header.Timestamp, nil
+}
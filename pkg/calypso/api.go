@@ -1,18 +1,23 @@
 package calypso
 
 import (
-	"encoding/binary"
+	"crypto/sha256"
+	"math"
 	"time"
 
+	"go.dedis.ch/kyber/v3/sign/anon"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"golang.org/x/xerrors"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
 	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
 )
@@ -22,12 +27,45 @@ type Client struct {
 	bcClient *byzcoin.Client
 	c        *onet.Client
 	ltsReply *CreateLTSReply
+	// namespace is sent with all requests to the calypso service.
+	namespace string
+	// maxQueueDepth is the depth of the transaction queue above which
+	// AddWrites waits. If it is 0, half of the queue size is used.
+	maxQueueDepth int
+	// strategy is sent with the decryption requests.
+	strategy string
+	// blocks holds the verified blocks, if the client has a cache.
+	blocks *BlockCache
 }
 
+// maxPacingWait is how long AddWrites waits for the transaction queue to
+// drain before giving up.
+const maxPacingWait = 2 * time.Minute
+
 // WriteReply is returned upon successfully spawning a Write instance.
 type WriteReply struct {
 	*byzcoin.AddTxResponse
 	byzcoin.InstanceID
+	// Duplicate is true if AddWriteWithToken found an existing write
+	// instance for the token. AddTxResponse then only holds the proof of
+	// the existing instance.
+	Duplicate bool
+	// Inclusion is set by AddWrite if it waited for the write to be
+	// included. The proof of AddTxResponse is then for the write-instance.
+	Inclusion *WriteInclusion
+}
+
+// WriteInclusion shows where a write has been included in the chain. It is
+// taken from the proof of the write, once the proof has been verified.
+type WriteInclusion struct {
+	// BlockIndex is the index of the block the proof ends at. The write
+	// has been included in this block or in an earlier one.
+	BlockIndex int
+	// BackLinks are the IDs of the blocks this block points back to.
+	BackLinks []skipchain.SkipBlockID
+	// Signature is the collective signature of the last forward link of
+	// the proof, which leads to the block.
+	Signature []byte
 }
 
 // ReadReply is is returned upon successfully spawning a Read instance.
@@ -36,6 +74,14 @@ type ReadReply struct {
 	byzcoin.InstanceID
 }
 
+// LabelMatch is a write returned by FindByLabel, with the proof it has been
+// checked against.
+type LabelMatch struct {
+	WriteID byzcoin.InstanceID
+	Write   *Write
+	Proof   *byzcoin.Proof
+}
+
 // NewClient instantiates a new Client.
 // It takes as input an "initialized" byzcoin client
 // with an already created ledger
@@ -44,12 +90,176 @@ func NewClient(byzcoin *byzcoin.Client) *Client {
 		cothority.Suite, ServiceName)}
 }
 
+// SetNamespace sets the namespace used in all following requests to the
+// calypso service. The default is the empty namespace.
+func (c *Client) SetNamespace(ns string) {
+	c.namespace = ns
+}
+
+// SetMaxQueueDepth sets the number of transactions waiting on a node above
+// which AddWrites doesn't send any new write. The default of 0 uses half of
+// the transaction buffer of the nodes.
+func (c *Client) SetMaxQueueDepth(depth int) {
+	c.maxQueueDepth = depth
+}
+
+// SetTreeStrategy sets the name of the TreeStrategy the nodes use to choose
+// the nodes of the following decryptions. The default is the strategy
+// configured on the nodes.
+func (c *Client) SetTreeStrategy(name string) {
+	c.strategy = name
+}
+
 // CreateLTS creates a random LTSID that can be used to reference the LTS group
 // created. It first sends a transaction to ByzCoin to spawn a LTS instance,
 // then it asks the Calypso cothority to start the DKG.
 func (c *Client) CreateLTS(ltsRoster *onet.Roster, darcID darc.ID, signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
+	info, err := NewLtsInstanceInfo(ltsRoster)
+	if err != nil {
+		return nil, err
+	}
+	return c.createLTS(info, darcID, signers, counters)
+}
+
+// CreateWeightedLTS works like CreateLTS, but the node i of the roster gets
+// weights[i] shares of the LTS, so that a decryption needs the nodes
+// holding a threshold of the shares.
+func (c *Client) CreateWeightedLTS(ltsRoster *onet.Roster, weights []int, darcID darc.ID, signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
+	info, err := NewWeightedLtsInstanceInfo(ltsRoster, weights)
+	if err != nil {
+		return nil, err
+	}
+	return c.createLTS(info, darcID, signers, counters)
+}
+
+// CreateLTSWithEscrow works like CreateLTS, but allows the nodes to export
+// their shares to a recovery key once the export has been recorded with
+// RecordExport.
+func (c *Client) CreateLTSWithEscrow(ltsRoster *onet.Roster, darcID darc.ID, signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
+	info, err := NewLtsInstanceInfo(ltsRoster)
+	if err != nil {
+		return nil, err
+	}
+	info.EscrowExport = true
+	return c.createLTS(info, darcID, signers, counters)
+}
+
+// CreateLTSWithRSAWrapping works like CreateLTS, but allows the writes
+// using the LTS to wrap their key for readers with RSA keys.
+func (c *Client) CreateLTSWithRSAWrapping(ltsRoster *onet.Roster, darcID darc.ID, signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
+	info, err := NewLtsInstanceInfo(ltsRoster)
+	if err != nil {
+		return nil, err
+	}
+	info.RSAWrapping = true
+	return c.createLTS(info, darcID, signers, counters)
+}
+
+// RotateLTS starts a new epoch of the LTS: the "rotate" command creates a
+// new LTS instance with the given roster and records it as the successor of
+// ltsID, then the nodes run a new DKG for it. Afterwards, new writes must
+// use the returned LTS, see CurrentLTS, while the writes of the earlier
+// epochs can still be decrypted, as the nodes keep their shares.
+func (c *Client) RotateLTS(ltsID byzcoin.InstanceID, ltsRoster *onet.Roster,
+	signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
+	resp, err := c.bcClient.GetProofFromLatest(ltsID.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	var cur LtsInstanceInfo
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID, &cur)
+	if err != nil {
+		return nil, xerrors.Errorf("didn't get an LTS instance: %v", err)
+	}
+	if cur.Next != nil {
+		return nil, xerrors.Errorf("LTS has already been rotated to %x", cur.Next[:])
+	}
+	info, err := NewLtsInstanceInfo(ltsRoster)
+	if err != nil {
+		return nil, err
+	}
+	info.EscrowExport = cur.EscrowExport
+	info.RSAWrapping = cur.RSAWrapping
+	buf, err := protobuf.Encode(info)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding roster: %v", err)
+	}
+	return c.addLTS(byzcoin.Instruction{
+		InstanceID: ltsID,
+		Invoke: &byzcoin.Invoke{
+			ContractID: ContractLongTermSecretID,
+			Command:    "rotate",
+			Args:       byzcoin.Arguments{{Name: "lts_instance_info", Value: buf}},
+		},
+		SignerCounter: counters,
+	}, ltsRoster, signers)
+}
+
+// ReshareLTS moves the shares of the LTS to a new roster, which must hold a
+// threshold of the nodes of the current one: the "reshare" command stores
+// the new roster in the LTS instance and adds the current one to its
+// Reshares, then the nodes run the resharing DKG. The public key of the LTS
+// doesn't change. The signers need the invoke:longTermSecret.reshare rule.
+func (c *Client) ReshareLTS(ltsID byzcoin.InstanceID, ltsRoster *onet.Roster,
+	signers []darc.Signer, counters []uint64) error {
+	cur, _, err := c.GetLTS(ltsID)
+	if err != nil {
+		return err
+	}
+	return c.reshareLTS(ltsID, cur, ltsRoster, signers, counters)
+}
+
+// GetLTS returns the information stored in the LTS instance, together with
+// its proof from the genesis block of the chain, which proves the creation
+// of the LTS and its current roster. The rosters of the earlier reshares are
+// in the Reshares of the information.
+func (c *Client) GetLTS(ltsID byzcoin.InstanceID) (*LtsInstanceInfo, *byzcoin.Proof, error) {
+	resp, err := c.bcClient.GetProof(ltsID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(ltsID.Slice()) {
+		return nil, nil, xerrors.New("LTS instance doesn't exist")
+	}
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := resp.Proof.VerifyFromBlock(genesis); err != nil {
+		return nil, nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	var info LtsInstanceInfo
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID, &info)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("didn't get an LTS instance: %v", err)
+	}
+	return &info, &resp.Proof, nil
+}
+
+// CurrentLTS follows the rotations of the LTS and returns the ID and the
+// information of its latest epoch, whose key must be used for new writes.
+func (c *Client) CurrentLTS(ltsID byzcoin.InstanceID) (byzcoin.InstanceID, *LtsInstanceInfo, error) {
+	for i := 0; i < maxVersions; i++ {
+		resp, err := c.bcClient.GetProofFromLatest(ltsID.Slice())
+		if err != nil {
+			return ltsID, nil, xerrors.Errorf("getting proof: %v", err)
+		}
+		var info LtsInstanceInfo
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID, &info)
+		if err != nil {
+			return ltsID, nil, xerrors.Errorf("didn't get an LTS instance: %v", err)
+		}
+		if info.Next == nil {
+			return ltsID, &info, nil
+		}
+		ltsID = *info.Next
+	}
+	return ltsID, nil, xerrors.New("too many epochs")
+}
+
+func (c *Client) createLTS(info *LtsInstanceInfo, darcID darc.ID, signers []darc.Signer, counters []uint64) (reply *CreateLTSReply, err error) {
 	// Make the transaction and get its proof
-	buf, err := protobuf.Encode(&LtsInstanceInfo{*ltsRoster})
+	buf, err := protobuf.Encode(info)
 	if err != nil {
 		return nil, xerrors.Errorf("encoding roster: %v", err)
 	}
@@ -66,6 +276,13 @@ func (c *Client) CreateLTS(ltsRoster *onet.Roster, darcID darc.ID, signers []dar
 		},
 		SignerCounter: counters,
 	}
+	return c.addLTS(inst, &info.Roster, signers)
+}
+
+// addLTS sends the instruction creating an LTS instance, then asks the
+// nodes of the roster to run the DKG of the new LTS.
+func (c *Client) addLTS(inst byzcoin.Instruction, roster *onet.Roster,
+	signers []darc.Signer) (reply *CreateLTSReply, err error) {
 	tx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion, inst)
 	if err := tx.FillSignersAndSignWith(signers...); err != nil {
 		return nil, xerrors.Errorf("signing txn: %v", err)
@@ -82,10 +299,15 @@ func (c *Client) CreateLTS(ltsRoster *onet.Roster, darcID darc.ID, signers []dar
 		return nil, xerrors.Errorf("getting txn proof: %v", err)
 	}
 
-	// Start the DKG
+	// Start the DKG on one of the trustees, which don't need to be part
+	// of the ByzCoin roster.
 	reply = &CreateLTSReply{}
-	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &CreateLTS{
-		Proof: resp.Proof,
+	traceID := cothority.NewTraceID()
+	cothority.LogTrace(traceID, nil, "client_create_lts", nil)
+	err = c.c.SendProtobuf(roster.List[0], &CreateLTS{
+		Proof:     resp.Proof,
+		Namespace: c.namespace,
+		TraceID:   traceID,
 	}, reply)
 	if err != nil {
 		return nil, xerrors.Errorf("send CreateLTS message: %v", err)
@@ -93,6 +315,36 @@ func (c *Client) CreateLTS(ltsRoster *onet.Roster, darcID darc.ID, signers []dar
 	return reply, nil
 }
 
+// LTSRoster returns the roster of the trustees holding the shares of the
+// given LTS, as stored in ByzCoin. It can be different from the roster of
+// the ByzCoin nodes.
+func (c *Client) LTSRoster(ltsID byzcoin.InstanceID) (*onet.Roster, error) {
+	info, err := c.LTSInfo(ltsID)
+	if err != nil {
+		return nil, err
+	}
+	return &info.Roster, nil
+}
+
+// LTSInfo returns the information of the given LTS, as stored in ByzCoin:
+// the roster of its trustees and the number of shares every trustee
+// holds.
+func (c *Client) LTSInfo(ltsID byzcoin.InstanceID) (*LtsInstanceInfo, error) {
+	resp, err := c.bcClient.GetProofFromLatest(ltsID.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	var info LtsInstanceInfo
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID, &info)
+	if err != nil {
+		return nil, xerrors.Errorf("didn't get an LTS instance: %v", err)
+	}
+	if len(info.Roster.List) == 0 {
+		return nil, xerrors.New("LTS roster is empty")
+	}
+	return &info, nil
+}
+
 // Authorise adds a ByzCoinID to the list of authorized IDs. It can only be called
 // from localhost, except if the COTHORITY_ALLOW_INSECURE_ADMIN is set to 'true'.
 // Deprecated: please use Authorize.
@@ -106,18 +358,28 @@ func (c *Client) Authorise(who *network.ServerIdentity, what skipchain.SkipBlock
 // Authorize adds a ByzCoinID to the list of authorized IDs in the server. To
 // be accepted, the request must be signed by the private key stored in
 // private.toml. For testing purposes, the environment variable can be set:
-//   COTHORITY_ALLOW_INSECURE_ADMIN=true
+//
+//	COTHORITY_ALLOW_INSECURE_ADMIN=true
+//
 // this disables the signature check.
 //
 // It should be called by the administrator at the beginning, before any other
 // API calls are made. A ByzCoinID that is not authorised will not be allowed to
 // call the other APIs.
 func (c *Client) Authorize(who *network.ServerIdentity, what skipchain.SkipBlockID) error {
+	return c.AuthorizeExternal(who, what, nil)
+}
+
+// AuthorizeExternal works like Authorize, for a chain hosted by the
+// cothority of the given roster, which the server doesn't belong to (light
+// mode). The server then fetches the blocks of the chain from this roster.
+// If roster is nil, it is the same as Authorize.
+func (c *Client) AuthorizeExternal(who *network.ServerIdentity, what skipchain.SkipBlockID,
+	roster *onet.Roster) error {
 	reply := &AuthorizeReply{}
 	ts := time.Now().Unix()
-	msg := append(what, make([]byte, 8)...)
-	binary.LittleEndian.PutUint64(msg[32:], uint64(ts))
-	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(), msg)
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		authorizeMessage(what, roster, c.namespace, ts))
 	if err != nil {
 		return xerrors.Errorf("creating schnorr signature: %v", err)
 	}
@@ -125,6 +387,8 @@ func (c *Client) Authorize(who *network.ServerIdentity, what skipchain.SkipBlock
 		ByzCoinID: what,
 		Timestamp: ts,
 		Signature: sig,
+		Namespace: c.namespace,
+		Roster:    roster,
 	}, reply)
 	if err != nil {
 		return xerrors.Errorf("sending Authorize message: %v", err)
@@ -132,13 +396,582 @@ func (c *Client) Authorize(who *network.ServerIdentity, what skipchain.SkipBlock
 	return nil
 }
 
+// ConfigureNamespace creates or updates the namespace ns on the server. If
+// roster is not nil, only its nodes can be used in an LTS of this
+// namespace. Like Authorize, the request must be signed by the private key
+// stored in private.toml.
+func (c *Client) ConfigureNamespace(who *network.ServerIdentity, ns string,
+	roster *onet.Roster) error {
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		namespaceMessage(ns, ts))
+	if err != nil {
+		return xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	err = c.c.SendProtobuf(who, &ConfigureNamespace{
+		Namespace: ns,
+		Roster:    roster,
+		Timestamp: ts,
+		Signature: sig,
+	}, &ConfigureNamespaceReply{})
+	return cothority.ErrorOrNil(err, "sending ConfigureNamespace message")
+}
+
+// ConfigureEscrow sets the admins that must sign the requests to export the
+// shares of the server. Like Authorize, the request must be signed by the
+// private key stored in private.toml.
+func (c *Client) ConfigureEscrow(who *network.ServerIdentity, admins []kyber.Point,
+	threshold int) error {
+	ts := time.Now().Unix()
+	msg, err := escrowMessage(admins, threshold, ts)
+	if err != nil {
+		return xerrors.Errorf("creating message: %v", err)
+	}
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(), msg)
+	if err != nil {
+		return xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	err = c.c.SendProtobuf(who, &ConfigureEscrow{
+		Admins:    admins,
+		Threshold: threshold,
+		Timestamp: ts,
+		Signature: sig,
+	}, &ConfigureEscrowReply{})
+	return cothority.ErrorOrNil(err, "sending ConfigureEscrow message")
+}
+
+// ExportShares asks the server for its share of an LTS. The request must
+// have been signed by enough escrow admins using ExportShares.Sign.
+func (c *Client) ExportShares(who *network.ServerIdentity, req *ExportShares) (
+	reply *ExportSharesReply, err error) {
+	reply = &ExportSharesReply{}
+	err = c.c.SendProtobuf(who, req, reply)
+	err = cothority.ErrorOrNil(err, "sending ExportShares message")
+	return
+}
+
+// RecordExport records in the LTS instance that its shares will be exported
+// to the recovery key. The signers need the invoke:longTermSecret.export
+// rule of the darc of the LTS. The returned proof is to be set as
+// ExportShares.Record.
+func (c *Client) RecordExport(ltsID byzcoin.InstanceID, recovery kyber.Point,
+	signers []darc.Signer, counters []uint64) (*byzcoin.Proof, error) {
+	buf, err := recovery.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling recovery key: %v", err)
+	}
+	tx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: ltsID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractLongTermSecretID,
+				Command:    "export",
+				Args:       byzcoin.Arguments{{Name: "recovery_key", Value: buf}},
+			},
+			SignerCounter: counters,
+		})
+	if err := tx.FillSignersAndSignWith(signers...); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+	atr, err := c.bcClient.AddTransactionAndWait(tx, 10)
+	if err != nil {
+		return nil, xerrors.Errorf("adding transaction: %v", err)
+	}
+	resp, err := c.bcClient.GetProofAfter(ltsID.Slice(), true, &atr.Proof.Latest)
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	return &resp.Proof, nil
+}
+
+// ReloadConfig asks the server to read its configuration file again and
+// returns the configuration now in use. Like Authorize, the request must be
+// signed by the private key stored in private.toml.
+func (c *Client) ReloadConfig(who *network.ServerIdentity) (*ServiceConfig, error) {
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(), reloadMessage(ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &ReloadConfigReply{}
+	err = c.c.SendProtobuf(who, &ReloadConfig{Timestamp: ts, Signature: sig}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending ReloadConfig message: %v", err)
+	}
+	return &reply.Config, nil
+}
+
+// CheckConsistency returns the last report of the comparison of the state of
+// the conode with the other nodes. If run is true, the conode does a new
+// comparison first. The request is signed using the private key of the
+// conode, so it must be available in who.
+func (c *Client) CheckConsistency(who *network.ServerIdentity, run bool) (*ConsistencyReport, error) {
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		consistencyMessage(run, ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &CheckConsistencyReply{}
+	err = c.c.SendProtobuf(who, &CheckConsistency{Run: run, Timestamp: ts,
+		Signature: sig}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending CheckConsistency message: %v", err)
+	}
+	return reply.Report, nil
+}
+
+// ExportSnapshot asks the node for a snapshot of its storage. The shares of
+// the LTSs in the snapshot are encrypted under the operator key, and must be
+// sealed to the node importing them with Snapshot.Seal. The records are the
+// proofs returned by RecordExport for the operator key, one for every LTS
+// of the node.
+func (c *Client) ExportSnapshot(who *network.ServerIdentity, operator kyber.Point,
+	records []byzcoin.Proof) (*Snapshot, error) {
+	key, err := operator.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling operator key: %v", err)
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		snapshotMessage("export", key, ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &ExportSnapshotReply{}
+	err = c.c.SendProtobuf(who, &ExportSnapshot{OperatorKey: operator,
+		Timestamp: ts, Signature: sig, Records: records}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending ExportSnapshot message: %v", err)
+	}
+	return &reply.Snapshot, nil
+}
+
+// ImportSnapshot restores a snapshot on the node, which must have the same
+// key as the node it was exported from. It returns the number of LTSs
+// restored.
+func (c *Client) ImportSnapshot(who *network.ServerIdentity, sn *Snapshot) (int, error) {
+	digest, err := sn.Hash()
+	if err != nil {
+		return 0, xerrors.Errorf("hashing snapshot: %v", err)
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		snapshotMessage("import", digest, ts))
+	if err != nil {
+		return 0, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &ImportSnapshotReply{}
+	err = c.c.SendProtobuf(who, &ImportSnapshot{Snapshot: *sn, Timestamp: ts,
+		Signature: sig}, reply)
+	if err != nil {
+		return 0, xerrors.Errorf("sending ImportSnapshot message: %v", err)
+	}
+	return reply.LTSs, nil
+}
+
+// RevokeIdentity revokes a compromised reader key on the node. It must be
+// sent to enough nodes of every LTS for the key to be unable to decrypt,
+// and the LTSs of the reply should then be reshared.
+func (c *Client) RevokeIdentity(who *network.ServerIdentity, key kyber.Point) (*RevokeIdentityReply, error) {
+	buf, err := key.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling key: %v", err)
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		revokeMessage(buf, ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &RevokeIdentityReply{}
+	err = c.c.SendProtobuf(who, &RevokeIdentity{Key: key, Timestamp: ts,
+		Signature: sig}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending RevokeIdentity message: %v", err)
+	}
+	return reply, nil
+}
+
+// ErrorPartial is returned together with the replies if the nodes couldn't
+// collect enough shares for a request with Partial set.
+var ErrorPartial = xerrors.New("not enough shares for the threshold")
+
 // DecryptKey takes as input Read- and Write- Proofs. It verifies that
 // the read/write requests match and then re-encrypts the secret
 // given the public key information of the reader.
+// If dkr.TraceID is empty, a new one is created, so that the request can be
+// followed in the logs of all nodes.
+// The failures an end user can fix are returned as a UserError. If
+// dkr.Partial is set and not enough shares could be collected, the reply is
+// returned with an error wrapping ErrorPartial. If the reply holds wrong
+// shares, the error wraps a MisbehaviorError with the evidence.
 func (c *Client) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error) {
 	reply = &DecryptKeyReply{}
-	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], dkr, reply)
-	return reply, cothority.ErrorOrNil(err, "sending DecryptKey message")
+	if dkr.Namespace == "" {
+		dkr.Namespace = c.namespace
+	}
+	if dkr.TraceID == "" {
+		dkr.TraceID = cothority.NewTraceID()
+	}
+	if dkr.Strategy == "" {
+		dkr.Strategy = c.strategy
+	}
+	cothority.LogTrace(dkr.TraceID, nil, "client_decrypt", nil)
+	wk, err := decryptKeyWrite(dkr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addGroupProof(dkr); err != nil {
+		return nil, err
+	}
+	// Only the trustees of the LTS hold a share of the key.
+	info, err := c.LTSInfo(wk.LTSID)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("getting LTS roster: %v", err))
+	}
+	roster := &info.Roster
+	err = c.c.SendProtobuf(roster.List[0], dkr, reply)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("sending DecryptKey message: %v", err))
+	}
+	err = verifyDecryptKeyReply(dkr, wk, reply, roster.List[0].Public,
+		info.Threshold())
+	if err != nil {
+		return nil, xerrors.Errorf("verifying reply: %w",
+			replyError(dkr, reply, roster.List[0], err))
+	}
+	if reply.Partial {
+		return reply, partialError(reply)
+	}
+	return reply, nil
+}
+
+// partialError returns the error for a partial reply.
+func partialError(reply *DecryptKeyReply) error {
+	return xerrors.Errorf("got %d shares, need %d: %w", len(reply.Uis),
+		len(reply.Commits), ErrorPartial)
+}
+
+// DecryptKeysBatch works like DecryptKey for several pairs of Read- and
+// Write-proofs, but all keys are re-encrypted in one round. All writes must
+// use the same LTS. The replies are in the same order as the requests.
+// Partial replies are asked for if the first request has Partial set.
+func (c *Client) DecryptKeysBatch(dkrs []DecryptKey) (replies []DecryptKeyReply, err error) {
+	if len(dkrs) == 0 {
+		return nil, xerrors.New("no requests given")
+	}
+	if len(dkrs) > MaxDecryptBatch {
+		return nil, xerrors.Errorf("cannot decrypt more than %d keys at once",
+			MaxDecryptBatch)
+	}
+	keys := make([]*WriteKey, len(dkrs))
+	for i := range dkrs {
+		if dkrs[i].Namespace == "" {
+			dkrs[i].Namespace = c.namespace
+		}
+		keys[i], err = decryptKeyWrite(&dkrs[i])
+		if err != nil {
+			return nil, xerrors.Errorf("request %d: %v", i, err)
+		}
+		if err := c.addGroupProof(&dkrs[i]); err != nil {
+			return nil, xerrors.Errorf("request %d: %v", i, err)
+		}
+	}
+	info, err := c.LTSInfo(keys[0].LTSID)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("getting LTS roster: %v", err))
+	}
+	roster := &info.Roster
+	reply := &DecryptKeysReply{}
+	traceID := cothority.NewTraceID()
+	cothority.LogTrace(traceID, nil, "client_decrypt", nil)
+	err = c.c.SendProtobuf(roster.List[0], &DecryptKeys{Requests: dkrs,
+		TraceID: traceID, Strategy: c.strategy, Partial: dkrs[0].Partial},
+		reply)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("sending DecryptKeys message: %v", err))
+	}
+	if len(reply.Replies) != len(dkrs) {
+		return nil, xerrors.Errorf("got %d replies for %d requests",
+			len(reply.Replies), len(dkrs))
+	}
+	for i := range dkrs {
+		err := verifyDecryptKeyReply(&dkrs[i], keys[i], &reply.Replies[i],
+			roster.List[0].Public, info.Threshold())
+		if err != nil {
+			return nil, xerrors.Errorf("verifying reply %d: %w", i,
+				replyError(&dkrs[i], &reply.Replies[i], roster.List[0], err))
+		}
+	}
+	for i := range reply.Replies {
+		if reply.Replies[i].Partial {
+			return reply.Replies, partialError(&reply.Replies[i])
+		}
+	}
+	return reply.Replies, nil
+}
+
+// decryptKeyWrite returns the encryption of the key of the write of the
+// request for the LTS chosen by the request.
+func decryptKeyWrite(dkr *DecryptKey) (*WriteKey, error) {
+	var write Write
+	if err := dkr.Write.VerifyAndDecode(cothority.Suite, ContractWriteID, &write); err != nil {
+		return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+	}
+	if _, err := write.GetSuite(); err != nil {
+		return nil, xerrors.Errorf("checking suite of write: %v", err)
+	}
+	if dkr.LTSID != nil {
+		return write.Key(*dkr.LTSID)
+	}
+	return write.Key(write.LTSID)
+}
+
+// verifyDecryptKeyReply makes sure the reply has been signed by the node
+// with the given public key, and that it re-encrypts the secret of the write
+// to the reader of the request. The shares are checked against the key of
+// the LTS recorded in the write, and threshold is the threshold of the LTS
+// stored in the chain.
+func verifyDecryptKeyReply(dkr *DecryptKey, wk *WriteKey, reply *DecryptKeyReply,
+	root kyber.Point, threshold int) error {
+	if err := reply.VerifySignature(dkr, root); err != nil {
+		return err
+	}
+	var read Read
+	if err := dkr.Read.VerifyAndDecode(cothority.Suite, ContractReadID, &read); err != nil {
+		return xerrors.Errorf("didn't get a read instance: %v", err)
+	}
+	if err := read.open(dkr.Opening); err != nil {
+		return xerrors.Errorf("opening blinded read: %v", err)
+	}
+	readID := byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key())
+	if _, err := read.delegate(readID); err != nil {
+		return xerrors.Errorf("delegating read: %v", err)
+	}
+	if reply.C == nil || !reply.C.Equal(wk.C) {
+		return xerrors.New("reply holds a different secret than the write")
+	}
+	if wk.X == nil {
+		return xerrors.New("the write doesn't record the key of its LTS")
+	}
+	if reply.Partial {
+		return reply.verifyShares(wk.X, threshold, wk.U, read.Xc)
+	}
+	return reply.Verify(wk.X, threshold, wk.U, read.Xc)
+}
+
+// GetDocumentStats returns the read and decrypt statistics of the given
+// write instance.
+func (c *Client) GetDocumentStats(writeID byzcoin.InstanceID) (reply *GetDocumentStatsReply, err error) {
+	reply = &GetDocumentStatsReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0],
+		&GetDocumentStats{WriteID: writeID, Namespace: c.namespace}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending GetDocumentStats message")
+}
+
+// ListDocuments returns a page of the writes of the ByzCoin chain of the
+// client, as seen by the first node of the roster. The ByzCoinID of the
+// request is set by the client.
+func (c *Client) ListDocuments(req ListDocuments) (reply *ListDocumentsReply, err error) {
+	req.ByzCoinID = c.bcClient.ID
+	reply = &ListDocumentsReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &req, reply)
+	return reply, cothority.ErrorOrNil(err, "sending ListDocuments message")
+}
+
+// FindDocuments returns the writes of the ByzCoin chain of the client whose
+// label contains the given text, ignoring the case.
+func (c *Client) FindDocuments(label string, offset, limit int) (*ListDocumentsReply, error) {
+	return c.ListDocuments(ListDocuments{Label: label, Offset: offset,
+		Limit: limit})
+}
+
+// FindByLabel returns the writes of the ByzCoin chain of the client whose
+// label holds all the words of the given label, ignoring the case. The node
+// returns a proof of every write, which is verified from the genesis block of
+// the client, so a node can leave out writes, but cannot return a write that
+// doesn't exist or whose label doesn't match.
+func (c *Client) FindByLabel(label string, limit int) ([]LabelMatch, error) {
+	words := labelWords(label)
+	reply := &FindByLabelReply{}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], &FindByLabel{
+		ByzCoinID: c.bcClient.ID,
+		Label:     label,
+		Limit:     limit,
+	}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending FindByLabel message: %v", err)
+	}
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]LabelMatch, len(reply.Proofs))
+	for i := range reply.Proofs {
+		pr := &reply.Proofs[i]
+		write, err := VerifyWriteProof(genesis, pr)
+		if err != nil {
+			return nil, xerrors.Errorf("verifying proof %d: %v", i, err)
+		}
+		if !labelMatches(write.Label, words) {
+			return nil, xerrors.Errorf("label of write %d doesn't match", i)
+		}
+		key, _, _, _, err := pr.KeyValue()
+		if err != nil {
+			return nil, xerrors.Errorf("reading proof %d: %v", i, err)
+		}
+		matches[i] = LabelMatch{WriteID: byzcoin.NewInstanceID(key),
+			Write: write, Proof: pr}
+	}
+	return matches, nil
+}
+
+// GetDocumentMetadata returns the decrypted metadata of the write, using the
+// symmetric key recovered with DecryptKey.
+func (c *Client) GetDocumentMetadata(writeID byzcoin.InstanceID, key []byte) (*DocumentMetadata, error) {
+	write, _, err := c.GetWrite(writeID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting write: %v", err)
+	}
+	return write.GetMetadata(key)
+}
+
+// GetChainStats returns the daily statistics of the ByzCoin chain of the
+// client, as seen by the first node of the roster.
+func (c *Client) GetChainStats() (reply *GetChainStatsReply, err error) {
+	reply = &GetChainStatsReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0],
+		&GetChainStats{ByzCoinID: c.bcClient.ID}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending GetChainStats message")
+}
+
+// GetEvents returns up to limit events from the event log of the first
+// node of the roster, starting at cursor. If writeID is not nil, only the
+// events of this write are returned. The Next field of the reply is the
+// cursor for the following page.
+func (c *Client) GetEvents(cursor uint64, limit int,
+	writeID *byzcoin.InstanceID) (reply *GetEventsReply, err error) {
+	reply = &GetEventsReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &GetEvents{
+		Cursor:    cursor,
+		Limit:     limit,
+		WriteID:   writeID,
+		Namespace: c.namespace,
+	}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending GetEvents message")
+}
+
+// GetIdentityEvents is like GetEvents, but only returns the events of the
+// given identity, e.g. the decryptions for the public key of a reader. As
+// the identities are only given to the operator of the node, the request
+// is signed by the private key of who.
+func (c *Client) GetIdentityEvents(who *network.ServerIdentity, cursor uint64,
+	limit int, identity string) (reply *GetEventsReply, err error) {
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		eventsMessage(ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply = &GetEventsReply{}
+	err = c.c.SendProtobuf(who, &GetEvents{
+		Cursor:    cursor,
+		Limit:     limit,
+		Identity:  identity,
+		Namespace: c.namespace,
+		Timestamp: ts,
+		Signature: sig,
+	}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending GetEvents message")
+}
+
+// GetVerifiedEvents is like GetEvents, but only returns the events of the
+// chain of the client, and verifies the proofs of all write and read events
+// against the genesis block. This means the node doesn't have to be trusted
+// for the writes and reads it returns.
+func (c *Client) GetVerifiedEvents(cursor uint64, limit int,
+	writeID *byzcoin.InstanceID) (reply *GetEventsReply, err error) {
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, err
+	}
+	reply = &GetEventsReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &GetEvents{
+		Cursor:    cursor,
+		Limit:     limit,
+		WriteID:   writeID,
+		ByzCoinID: c.bcClient.ID,
+		Proofs:    true,
+		Namespace: c.namespace,
+	}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending GetEvents message: %v", err)
+	}
+	if err := reply.Verify(genesis); err != nil {
+		return nil, xerrors.Errorf("verifying events: %v", err)
+	}
+	return reply, nil
+}
+
+// QueryAccessAt returns the identities that were allowed to read the given
+// write instance when the block with the given index was created. If
+// identity is not empty, the reply also tells whether it was allowed.
+func (c *Client) QueryAccessAt(writeID byzcoin.InstanceID, blockIndex int,
+	identity string) (reply *QueryAccessAtReply, err error) {
+	return c.queryAccessAt(&QueryAccessAt{
+		ByzCoinID:  c.bcClient.ID,
+		WriteID:    writeID,
+		BlockIndex: blockIndex,
+		Identity:   identity,
+	})
+}
+
+// QueryAccessAtTime is like QueryAccessAt, but uses the last block created
+// before the given time.
+func (c *Client) QueryAccessAtTime(writeID byzcoin.InstanceID, at time.Time,
+	identity string) (reply *QueryAccessAtReply, err error) {
+	return c.queryAccessAt(&QueryAccessAt{
+		ByzCoinID: c.bcClient.ID,
+		WriteID:   writeID,
+		Timestamp: at.UnixNano(),
+		Identity:  identity,
+	})
+}
+
+func (c *Client) queryAccessAt(req *QueryAccessAt) (reply *QueryAccessAtReply, err error) {
+	reply = &QueryAccessAtReply{}
+	req.Namespace = c.namespace
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	return reply, cothority.ErrorOrNil(err, "sending QueryAccessAt message")
+}
+
+// GetWriteStatus returns the state of the write instance in its lifecycle,
+// as computed by the first node of the roster.
+func (c *Client) GetWriteStatus(writeID byzcoin.InstanceID) (reply *GetWriteStatusReply, err error) {
+	reply = &GetWriteStatusReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &GetWriteStatus{
+		ByzCoinID: c.bcClient.ID,
+		WriteID:   writeID,
+		Namespace: c.namespace,
+	}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending GetWriteStatus message")
+}
+
+// EstimateDecrypt returns what a decryption of the write for the given
+// reader would take, as estimated by the first node of the roster. The
+// reader can be nil if the quota is not needed.
+func (c *Client) EstimateDecrypt(writeID byzcoin.InstanceID,
+	reader kyber.Point) (reply *EstimateDecryptReply, err error) {
+	reply = &EstimateDecryptReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &EstimateDecrypt{
+		ByzCoinID: c.bcClient.ID,
+		WriteID:   writeID,
+		Reader:    reader,
+		Strategy:  c.strategy,
+		Namespace: c.namespace,
+	}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending EstimateDecrypt message")
 }
 
 // WaitProof calls the byzcoin client's wait proof
@@ -182,15 +1015,375 @@ func (c *Client) AddWrite(write *Write, signer darc.Signer, signerCtr uint64,
 		return nil, xerrors.Errorf("signing txn: %v", err)
 	}
 	reply.InstanceID = ctx.Instructions[0].DeriveID("")
-	//Delegate the work to the byzcoin client
-	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	//Delegate the work to the byzcoin client, which verifies the proof from
+	//the latest block it knows.
+	reply.AddTxResponse, err = c.bcClient.AddTransactionWithProof(ctx, wait,
+		reply.InstanceID.Slice())
 	if err != nil {
 		return nil, xerrors.Errorf("adding txn: %v", err)
 	}
+	if reply.Proof != nil {
+		reply.Inclusion, err = reply.inclusion()
+		if err != nil {
+			return nil, xerrors.Errorf("checking inclusion: %v", err)
+		}
+	}
 	return reply, err
 }
 
-// AddRead creates a Read Instance by adding a transaction on the byzcoin client.
+// VerifyInclusion verifies the proof of the reply from the given block, and
+// returns where the write has been included. The proof starts at the latest
+// block known to the byzcoin client when the write was added, which is the
+// genesis block for a new client.
+func (r *WriteReply) VerifyInclusion(from *skipchain.SkipBlock) (*WriteInclusion, error) {
+	if r.AddTxResponse == nil || r.Proof == nil {
+		return nil, xerrors.New("reply has no proof")
+	}
+	if err := r.Proof.VerifyFromBlock(from); err != nil {
+		return nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	return r.inclusion()
+}
+
+// inclusion checks that the proof of the reply holds the write-instance, and
+// returns where it has been included.
+func (r *WriteReply) inclusion() (*WriteInclusion, error) {
+	if !r.Proof.InclusionProof.Match(r.InstanceID.Slice()) {
+		return nil, xerrors.New("proof doesn't hold the write-instance")
+	}
+	_, _, contractID, _, err := r.Proof.KeyValue()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid proof: %v", err)
+	}
+	if contractID != ContractWriteID {
+		return nil, xerrors.New("proof doesn't point to a write-instance")
+	}
+	inc := &WriteInclusion{
+		BlockIndex: r.Proof.Latest.Index,
+		BackLinks:  r.Proof.Latest.BackLinkIDs,
+	}
+	if n := len(r.Proof.Links); n > 1 {
+		inc.Signature = r.Proof.Links[n-1].Signature.Sig
+	}
+	return inc, nil
+}
+
+// AddWrites adds all writes with consecutive signer counters starting at
+// signerCtr. It asks the nodes how many transactions are waiting to be
+// included, and waits while the queue is too long. The nodes are only asked
+// again once the writes have filled the room left in the queue. This keeps
+// large uploads from filling the buffer of the nodes, which silently drops
+// transactions when it is full.
+//
+// The wait argument is used for every write, so 0 gives the highest
+// throughput. The replies of the writes added before an error are returned
+// with it.
+func (c *Client) AddWrites(writes []*Write, signer darc.Signer,
+	signerCtr uint64, darc darc.Darc, wait int) (replies []*WriteReply, err error) {
+	room := 0
+	for i, write := range writes {
+		if room == 0 {
+			if room, err = c.waitTxQueue(); err != nil {
+				return replies, xerrors.Errorf("write %d: %v", i, err)
+			}
+		}
+		room--
+		reply, err := c.AddWrite(write, signer, signerCtr+uint64(i), darc, wait)
+		if err != nil {
+			return replies, xerrors.Errorf("write %d: %v", i, err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// waitTxQueue returns once the transaction queue of the chain is below
+// maxQueueDepth on all nodes, backing off while it isn't. It returns the
+// number of transactions that can be sent before the queue is full again.
+func (c *Client) waitTxQueue() (int, error) {
+	start := time.Now()
+	delay := 100 * time.Millisecond
+	for {
+		depth, size, err := c.bcClient.TxQueueDepth()
+		if err != nil {
+			return 0, xerrors.Errorf("getting queue depth: %v", err)
+		}
+		limit := c.maxQueueDepth
+		if limit <= 0 {
+			limit = size / 2
+		}
+		if limit <= 0 {
+			return math.MaxInt32, nil
+		}
+		if depth < limit {
+			return limit - depth, nil
+		}
+		if time.Since(start) > maxPacingWait {
+			return 0, xerrors.Errorf("transaction queue still has %d entries "+
+				"after %v", depth, maxPacingWait)
+		}
+		log.Lvlf2("transaction queue has %d entries, waiting %v", depth, delay)
+		time.Sleep(delay)
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// AddWriteWithToken works like AddWrite, but uses a client-chosen
+// idempotency token to derive the instance ID of the write. If the same
+// token is used again by the same signer, for example after a timeout, no
+// second write instance is created. Instead, the reply points to the
+// existing instance, with its proof, and has Duplicate set to true.
+//
+// The transaction is sent to the first node of the chain, which only adds
+// it if the write-instance doesn't exist yet. ByzCoin refuses to create an
+// instance that already exists, so a duplicate is rejected even if two
+// calls race through different nodes.
+func (c *Client) AddWriteWithToken(write *Write, signer darc.Signer,
+	signerCtr uint64, darc darc.Darc, wait int, token []byte) (reply *WriteReply, err error) {
+	if len(token) == 0 {
+		return nil, xerrors.New("empty idempotency token")
+	}
+	writeBuf, err := protobuf.Encode(write)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Write message: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(darc.GetBaseID()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractWriteID,
+				Args: byzcoin.Arguments{
+					{Name: "write", Value: writeBuf},
+					{Name: "preID", Value: PreIDFromToken(signer.Identity(), token)},
+				},
+			},
+			SignerCounter: []uint64{signerCtr},
+		},
+	)
+	reply = &WriteReply{}
+	reply.InstanceID, err = ctx.Instructions[0].DeriveIDArg("", "preID")
+	if err != nil {
+		return nil, xerrors.Errorf("deriving instance ID: %v", err)
+	}
+	err = ctx.FillSignersAndSignWith(signer)
+	if err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+
+	from := c.bcClient.Latest
+	if from == nil {
+		if from, err = c.genesis(); err != nil {
+			return nil, err
+		}
+	}
+	tokenReply := &AddTokenWriteReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &AddTokenWrite{
+		Request: byzcoin.AddTxRequest{
+			Version:       byzcoin.CurrentVersion,
+			SkipchainID:   c.bcClient.ID,
+			Transaction:   ctx,
+			InclusionWait: wait,
+			ProofFrom:     from.Hash,
+		},
+		Namespace: c.namespace,
+	}, tokenReply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending AddTokenWrite message: %v", err)
+	}
+	if !tokenReply.WriteID.Equal(reply.InstanceID) {
+		return nil, xerrors.New("node added another write-instance")
+	}
+	reply.AddTxResponse = &tokenReply.Response
+	reply.Duplicate = tokenReply.Duplicate
+	if reply.Error != "" {
+		return nil, xerrors.Errorf("adding txn: %v", reply.Error)
+	}
+	if reply.Proof == nil {
+		if reply.Duplicate {
+			return nil, xerrors.New("duplicate without a proof")
+		}
+		return reply, nil
+	}
+	if reply.Inclusion, err = reply.VerifyInclusion(from); err != nil {
+		return nil, xerrors.Errorf("checking inclusion: %v", err)
+	}
+	return reply, nil
+}
+
+// PreIDFromToken returns the "preID" argument used by AddWriteWithToken
+// for the given signer and token. The ID of the write-instance is derived
+// from it with DeriveIDArg. The signer is included so that two signers using
+// the same token don't collide.
+func PreIDFromToken(signer darc.Identity, token []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("calypso-idempotency"))
+	h.Write([]byte(signer.String()))
+	h.Write(token)
+	return h.Sum(nil)
+}
+
+// UpdateWrite creates a new version of the document stored in the write
+// instance prevID. The new write instance holds the new ciphertext and
+// points to prevID, which in turn gets a pointer to the new version.
+// Input:
+//   - prevID - The latest version of the write instance
+//   - write - A Write structure for the new version
+//   - signer - The data owner who will sign the transaction
+//   - signerCtr - A monotonically increasing counter for every signer
+//   - wait - The number of blocks to wait -- 0 means no wait
+//
+// Output:
+//   - reply - WriteReply containing the transaction response and the
+//     instance id of the new version
+//   - err - Error if any, nil otherwise.
+func (c *Client) UpdateWrite(prevID byzcoin.InstanceID, write *Write,
+	signer darc.Signer, signerCtr uint64, wait int) (reply *WriteReply, err error) {
+	write.Previous = &prevID
+	writeBuf, err := protobuf.Encode(write)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Write message: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: prevID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractWriteID,
+				Command:    "update",
+				Args: byzcoin.Arguments{{
+					Name: "write", Value: writeBuf}},
+			},
+			SignerCounter: []uint64{signerCtr},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signer); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+	reply = &WriteReply{InstanceID: ctx.Instructions[0].DeriveID("")}
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding txn: %v", err)
+	}
+	return reply, nil
+}
+
+// FreezeWrite suspends all reads and decryptions of the write-instance until
+// it is unfrozen. The reason is stored in the write and shown by
+// GetWriteStatus. The signers need the invoke:calypsoWrite.freeze rule of
+// the darc of the write.
+func (c *Client) FreezeWrite(writeID byzcoin.InstanceID, reason string,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeWrite(writeID, "freeze", byzcoin.Arguments{{Name: "reason",
+		Value: []byte(reason)}}, signers, counters, wait)
+}
+
+// UnfreezeWrite restores the reads and decryptions of a frozen
+// write-instance. The signers need the invoke:calypsoWrite.unfreeze rule of
+// the darc of the write.
+func (c *Client) UnfreezeWrite(writeID byzcoin.InstanceID,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeWrite(writeID, "unfreeze", nil, signers, counters, wait)
+}
+
+func (c *Client) invokeWrite(writeID byzcoin.InstanceID, cmd string,
+	args byzcoin.Arguments, signers []darc.Signer, counters []uint64, wait int) error {
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: writeID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractWriteID,
+				Command:    cmd,
+				Args:       args,
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err := c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
+
+// maxVersions is the maximum number of versions followed by
+// GetLatestVersion.
+const maxVersions = 1000
+
+// GetLatestVersion follows the version links starting at writeID and
+// returns the proof of the latest version of the document.
+func (c *Client) GetLatestVersion(writeID byzcoin.InstanceID) (*byzcoin.Proof, error) {
+	id := writeID
+	for i := 0; i < maxVersions; i++ {
+		resp, err := c.bcClient.GetProofFromLatest(id.Slice())
+		if err != nil {
+			return nil, xerrors.Errorf("getting proof: %v", err)
+		}
+		var write Write
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+		if err != nil {
+			return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+		}
+		if write.Next == nil {
+			return &resp.Proof, nil
+		}
+		id = *write.Next
+	}
+	return nil, xerrors.New("too many versions")
+}
+
+// GetWrite returns the write-instance with the given ID, together with a
+// proof that starts at the genesis block of the chain. The proof can be
+// passed to a client that doesn't trust the conodes, which checks it with
+// VerifyWriteProof.
+func (c *Client) GetWrite(writeID byzcoin.InstanceID) (*Write, *byzcoin.Proof, error) {
+	resp, err := c.bcClient.GetProof(writeID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(writeID.Slice()) {
+		return nil, nil, xerrors.New("write instance doesn't exist")
+	}
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, nil, err
+	}
+	write, err := VerifyWriteProof(genesis, &resp.Proof)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	return write, &resp.Proof, nil
+}
+
+// VerifyWriteProof checks that the proof holds a write-instance stored in
+// the chain starting at genesis, and returns the write. The forward links of
+// the proof are followed from the genesis block to the block holding the
+// write, so only the genesis block needs to be trusted, e.g. because its ID
+// is known.
+func VerifyWriteProof(genesis *skipchain.SkipBlock, proof *byzcoin.Proof) (*Write, error) {
+	if genesis == nil || genesis.Index != 0 ||
+		!genesis.CalculateHash().Equal(genesis.Hash) {
+		return nil, xerrors.New("invalid genesis block")
+	}
+	if len(proof.Links) == 0 || proof.Links[0].NewRoster == nil ||
+		!proof.Links[0].To.Equal(genesis.Hash) {
+		return nil, xerrors.New("proof doesn't start at the genesis block")
+	}
+	ok, err := proof.Links[0].NewRoster.Equal(genesis.Roster)
+	if err != nil || !ok {
+		return nil, xerrors.New("proof doesn't start with the roster of the genesis block")
+	}
+	if err := proof.Verify(genesis.Hash); err != nil {
+		return nil, xerrors.Errorf("following forward links: %v", err)
+	}
+	var write Write
+	if err := proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write); err != nil {
+		return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+	}
+	return &write, nil
+}
+
+// AddRead creates a Read Instance by adding a transaction on the byzcoin client.
 //
 // Input:
 //   - proof - A ByzCoin proof of the Write Operation.
@@ -200,7 +1393,8 @@ func (c *Client) AddWrite(write *Write, signer darc.Signer, signerCtr uint64,
 //
 // Output:
 //   - reply - ReadReply containing the transaction response and instance id
-//   - err - Error if any, nil otherwise.
+//   - err - Error if any, nil otherwise. A refused read is returned as a
+//     UserError.
 func (c *Client) AddRead(proof *byzcoin.Proof, signer darc.Signer, signerCtr uint64, wait int) (
 	reply *ReadReply, err error) {
 	var readBuf []byte
@@ -231,12 +1425,358 @@ func (c *Client) AddRead(proof *byzcoin.Proof, signer darc.Signer, signerCtr uin
 
 	reply.InstanceID = ctx.Instructions[0].DeriveID("")
 	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("adding txn: %v", err))
+	}
+	return reply, nil
+}
+
+// AddReadApproved creates a Read Instance signed by several readers, for a
+// write whose policy requires the approval of more than one of them, see
+// ApprovalPolicy. The secret is re-encrypted to xc.
+func (c *Client) AddReadApproved(proof *byzcoin.Proof, xc kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) (reply *ReadReply, err error) {
+	writeID := byzcoin.NewInstanceID(proof.InclusionProof.Key())
+	readBuf, err := protobuf.Encode(&Read{Write: writeID, Xc: xc})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Read message: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: writeID,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+
+	reply = &ReadReply{InstanceID: ctx.Instructions[0].DeriveID("")}
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("adding txn: %v", err))
+	}
+	return reply, nil
+}
+
+// AddReadAnonymous creates a Read Instance without revealing which reader
+// asked for it. The reader proves with a ring signature that it holds the
+// private key of one of the members of ring, each of which must be allowed
+// to read on its own. The transaction is signed by a one-time key.
+// Input:
+//   - proof - A ByzCoin proof of the Write Operation.
+//   - ring - The public keys to hide among
+//   - mine - The index of the public key of the reader in ring
+//   - secret - The private key of the reader
+//   - xc - The public key the secret will be re-encrypted to
+//   - wait - The number of blocks to wait -- 0 means no wait
+//
+// Output:
+//   - reply - ReadReply containing the transaction response and instance id
+//   - err - Error if any, nil otherwise.
+func (c *Client) AddReadAnonymous(proof *byzcoin.Proof, ring []kyber.Point,
+	mine int, secret kyber.Scalar, xc kyber.Point, wait int) (reply *ReadReply, err error) {
+	writeID := byzcoin.NewInstanceID(proof.InclusionProof.Key())
+	return c.addReadRing(&Read{Write: writeID, Xc: xc}, ring, mine, secret, wait)
+}
+
+// AddReadBlinded works like AddReadAnonymous, but the read only holds a
+// commitment to the public key of xc, so that the chain doesn't show which
+// key the secret is re-encrypted to. The returned opening must be given in
+// the DecryptKey request.
+func (c *Client) AddReadBlinded(proof *byzcoin.Proof, ring []kyber.Point,
+	mine int, secret kyber.Scalar, xc kyber.Scalar, wait int) (*ReadReply, *ReadOpening, error) {
+	read, op, err := NewBlindedRead(byzcoin.NewInstanceID(proof.InclusionProof.Key()), xc)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := c.addReadRing(read, ring, mine, secret, wait)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, op, nil
+}
+
+// addReadRing spawns the read with a ring signature of the reader, signed
+// by a one-time key.
+func (c *Client) addReadRing(read *Read, ring []kyber.Point, mine int,
+	secret kyber.Scalar, wait int) (reply *ReadReply, err error) {
+	if mine < 0 || mine >= len(ring) {
+		return nil, xerrors.New("index of the reader is outside of the ring")
+	}
+	writeID := read.Write
+	readBuf, err := protobuf.Encode(read)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Read message: %v", err)
+	}
+	oneTime := darc.NewSignerEd25519(nil, nil)
+	ringBuf, err := protobuf.Encode(&RingProof{
+		Ring: ring,
+		Signature: anon.Sign(cothority.Suite,
+			RingMessage(writeID, readBuf, oneTime.Identity()),
+			anon.Set(ring), nil, mine, secret),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding ring proof: %v", err)
+	}
+
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: writeID,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args: byzcoin.Arguments{
+					{Name: "read", Value: readBuf},
+					{Name: "ring", Value: ringBuf},
+				},
+			},
+			SignerCounter: []uint64{1},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(oneTime); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+
+	reply = &ReadReply{InstanceID: ctx.Instructions[0].DeriveID("")}
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding txn: %v", err)
+	}
+	return reply, nil
+}
+
+// AddReadWithDevice creates a Read Instance signed by a device of the
+// reader instead of its primary key. The device must be enrolled in the
+// credential, and the secret is re-encrypted to the key of the device.
+func (c *Client) AddReadWithDevice(proof *byzcoin.Proof, credID byzcoin.InstanceID,
+	device darc.Signer, deviceCtr uint64, wait int) (reply *ReadReply, err error) {
+	writeID := byzcoin.NewInstanceID(proof.InclusionProof.Key())
+	readBuf, err := protobuf.Encode(&Read{Write: writeID, Xc: device.Ed25519.Point})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Read message: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: writeID,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args: byzcoin.Arguments{
+					{Name: "read", Value: readBuf},
+					{Name: "credential", Value: credID.Slice()},
+				},
+			},
+			SignerCounter: []uint64{deviceCtr},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(device); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+
+	reply = &ReadReply{InstanceID: ctx.Instructions[0].DeriveID("")}
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
 	if err != nil {
 		return nil, xerrors.Errorf("adding txn: %v", err)
 	}
 	return reply, nil
 }
 
+// DelegateRead records in the read the delegation to the key of the
+// delegate, so that the secret is re-encrypted to it from then on. The
+// holder is the reader, or the last delegate of the read, and signs both
+// the delegation and the transaction.
+func (c *Client) DelegateRead(readID byzcoin.InstanceID, holder darc.Signer,
+	holderCtr uint64, delegate kyber.Point, wait int) error {
+	d, err := NewDelegation(readID, holder.Ed25519.Secret, delegate)
+	if err != nil {
+		return err
+	}
+	buf, err := protobuf.Encode(&d)
+	if err != nil {
+		return xerrors.Errorf("encoding delegation: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: readID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractReadID,
+				Command:    "delegate",
+				Args:       byzcoin.Arguments{{Name: "delegation", Value: buf}},
+			},
+			SignerCounter: []uint64{holderCtr},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(holder); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
+
+// SpawnCredential creates a credential instance holding the devices of a
+// reader, with the ID CredentialID(preID). The primary signer holds the
+// primary key of the credential, and the devices must be signed by it for
+// this ID, see NewDevice. The signers need the spawn:calypsoCredential rule
+// of the darc, which also controls the enrollment and revocation of devices.
+func (c *Client) SpawnCredential(darcID darc.ID, preID []byte, cred *Credential,
+	primary darc.Signer, signers []darc.Signer, counters []uint64,
+	wait int) (byzcoin.InstanceID, error) {
+	buf, err := protobuf.Encode(cred)
+	if err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("encoding credential: %v", err)
+	}
+	credID := CredentialID(preID)
+	msg, err := CredentialMessage(credID, cred.Primary)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, primary.Ed25519.Secret, msg)
+	if err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("signing credential: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(darcID),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractCredentialID,
+				Args: byzcoin.Arguments{
+					{Name: "credential", Value: buf},
+					{Name: "preID", Value: preID},
+					{Name: "signature", Value: sig},
+				},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("signing txn: %v", err)
+	}
+	if _, err := c.bcClient.AddTransactionAndWait(ctx, wait); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("adding txn: %v", err)
+	}
+	return credID, nil
+}
+
+// EnrollDevice adds a device to the credential. The signers must hold the
+// primary key of the credential, and need the
+// invoke:calypsoCredential.enroll rule of the darc of the credential.
+func (c *Client) EnrollDevice(credID byzcoin.InstanceID, device Device,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	buf, err := protobuf.Encode(&device)
+	if err != nil {
+		return xerrors.Errorf("encoding device: %v", err)
+	}
+	return c.invokeCredential(credID, "enroll", byzcoin.Arguments{{Name: "device",
+		Value: buf}}, signers, counters, wait)
+}
+
+// RevokeDevice removes the device with the given key from the credential.
+// Reads signed by this device are refused from then on, and the device
+// cannot be enrolled again. The signers must hold the primary key of the
+// credential, and need the invoke:calypsoCredential.revoke rule of the darc
+// of the credential.
+func (c *Client) RevokeDevice(credID byzcoin.InstanceID, key kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	buf, err := key.MarshalBinary()
+	if err != nil {
+		return xerrors.Errorf("marshalling key: %v", err)
+	}
+	return c.invokeCredential(credID, "revoke", byzcoin.Arguments{{Name: "key",
+		Value: buf}}, signers, counters, wait)
+}
+
+func (c *Client) invokeCredential(credID byzcoin.InstanceID, cmd string,
+	args byzcoin.Arguments, signers []darc.Signer, counters []uint64, wait int) error {
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: credID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractCredentialID,
+				Command:    cmd,
+				Args:       args,
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err := c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
+
+// SpawnGroup creates a reader group with the given members. Writes listing
+// the group in their Groups field can be read by the members. The signers
+// need the spawn:calypsoGroup rule of the darc, which also controls who can
+// add and remove members.
+func (c *Client) SpawnGroup(darcID darc.ID, members []kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) (byzcoin.InstanceID, error) {
+	buf, err := protobuf.Encode(&Group{Members: members})
+	if err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("encoding group: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(darcID),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractGroupID,
+				Args:       byzcoin.Arguments{{Name: "group", Value: buf}},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("signing txn: %v", err)
+	}
+	if _, err := c.bcClient.AddTransactionAndWait(ctx, wait); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("adding txn: %v", err)
+	}
+	return ctx.Instructions[0].DeriveID(""), nil
+}
+
+// AddGroupMember adds a member to the reader group, which gives it access to
+// all documents shared with the group. The signers need the
+// invoke:calypsoGroup.add rule of the darc of the group.
+func (c *Client) AddGroupMember(groupID byzcoin.InstanceID, member kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeGroup(groupID, "add", member, signers, counters, wait)
+}
+
+// RemoveGroupMember removes a member from the reader group. Its reads of the
+// documents shared with the group are refused from then on. The signers need
+// the invoke:calypsoGroup.remove rule of the darc of the group.
+func (c *Client) RemoveGroupMember(groupID byzcoin.InstanceID, member kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeGroup(groupID, "remove", member, signers, counters, wait)
+}
+
+func (c *Client) invokeGroup(groupID byzcoin.InstanceID, cmd string,
+	member kyber.Point, signers []darc.Signer, counters []uint64, wait int) error {
+	buf, err := member.MarshalBinary()
+	if err != nil {
+		return xerrors.Errorf("marshalling key: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: groupID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractGroupID,
+				Command:    cmd,
+				Args:       byzcoin.Arguments{{Name: "key", Value: buf}},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
+
 // SpawnDarc spawns a Darc Instance by adding a transaction on the byzcoin client.
 // Input:
 //   - signer - The signer authorizing the spawn of this darc (calypso "admin")
@@ -278,6 +1818,113 @@ func (c *Client) SpawnDarc(signer darc.Signer, signerCtr uint64,
 	return reply, cothority.ErrorOrNil(err, "adding txn")
 }
 
+// MaxShares is the maximum number of shares and commits accepted in a
+// DecryptKeyReply. It bounds the work done by Verify for a reply crafted by a
+// malicious node.
+const MaxShares = 1024
+
+// Verify checks the proofs of the re-encrypted shares in the reply against
+// the public polynomial of the LTS, and that XhatEnc has been recovered from
+// enough valid shares. X is the public key of the LTS and threshold the
+// number of shares needed to recover the key: both must come from a source
+// trusted by the client, like the write and the LTS instance, as the reply
+// is assembled by a single node. U is the point of the write instance and Xc
+// the public key of the reader.
+func (r *DecryptKeyReply) Verify(X kyber.Point, threshold int, U, Xc kyber.Point) error {
+	if err := r.verifyShares(X, threshold, U, Xc); err != nil {
+		return err
+	}
+	if r.Partial {
+		return xerrors.New("reply only holds part of the shares")
+	}
+	if len(r.Uis) < threshold {
+		return xerrors.Errorf("got %d valid shares, need %d", len(r.Uis),
+			threshold)
+	}
+	XhatEnc, err := share.RecoverCommit(cothority.Suite, r.Uis, threshold,
+		len(r.Uis))
+	if err != nil {
+		return xerrors.Errorf("recovering commit: %v", err)
+	}
+	if !XhatEnc.Equal(r.XhatEnc) {
+		return xerrors.New("XhatEnc doesn't match the shares")
+	}
+	return nil
+}
+
+// decryptKeyReplyMessage returns the message signed by the node for the
+// reply to the request. It holds the hash of the request and the reply
+// without its signature.
+func decryptKeyReplyMessage(dkr *DecryptKey, reply *DecryptKeyReply) ([]byte, error) {
+	reqBuf, err := protobuf.Encode(dkr)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding request: %v", err)
+	}
+	unsigned := *reply
+	unsigned.Signature = nil
+	replyBuf, err := protobuf.Encode(&unsigned)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding reply: %v", err)
+	}
+	reqHash := sha256.Sum256(reqBuf)
+	h := sha256.New()
+	h.Write([]byte("calypso-decrypt-reply"))
+	h.Write(reqHash[:])
+	h.Write(replyBuf)
+	return h.Sum(nil), nil
+}
+
+// VerifySignature checks that the reply to the request has been signed by
+// the node with the given public key, so that the shares cannot be replaced
+// on the way to the client.
+func (r *DecryptKeyReply) VerifySignature(dkr *DecryptKey, public kyber.Point) error {
+	if len(r.Signature) == 0 {
+		return xerrors.New("reply is not signed")
+	}
+	msg, err := decryptKeyReplyMessage(dkr, r)
+	if err != nil {
+		return err
+	}
+	return cothority.ErrorOrNil(schnorr.Verify(cothority.Suite, public, msg,
+		r.Signature), "verifying signature of reply")
+}
+
+// verifyShares checks the proofs of the re-encrypted shares in the reply,
+// and that its polynomial is the one of the LTS with the key X and the given
+// threshold.
+func (r *DecryptKeyReply) verifyShares(X kyber.Point, threshold int, U, Xc kyber.Point) error {
+	if len(r.Uis) > MaxShares || len(r.Commits) > MaxShares {
+		return xerrors.Errorf("more than %d shares or commits", MaxShares)
+	}
+	if r.X == nil || !r.X.Equal(X) {
+		return xerrors.New("reply doesn't hold the public key of the LTS")
+	}
+	if len(r.Commits) != threshold {
+		return xerrors.Errorf("got %d commits for a threshold of %d",
+			len(r.Commits), threshold)
+	}
+	if len(r.Commits) == 0 || !r.Commits[0].Equal(X) {
+		return xerrors.New("commits don't match the public key of the LTS")
+	}
+	if len(r.Uis) != len(r.Proofs) {
+		return xerrors.New("need exactly one proof per share")
+	}
+	poly := share.NewPubPoly(cothority.Suite, cothority.Suite.Point().Base(),
+		r.Commits)
+	seen := make(map[int]bool)
+	for i, ui := range r.Uis {
+		err := protocol.VerifyReencryption(poly, U, Xc, ui, &r.Proofs[i])
+		if err != nil {
+			return xerrors.Errorf("share %d: %v", i, err)
+		}
+		if seen[ui.I] {
+			return xerrors.Errorf("got share %d twice", ui.I)
+		}
+		seen[ui.I] = true
+	}
+	return nil
+}
+
 // RecoverKey is used to recover the secret key once it has been
 // re-encrypted to a given public key by the DecryptKey method
 // in the Calypso service. The resulting secret key can be used
@@ -291,16 +1938,98 @@ func (c *Client) SpawnDarc(signer darc.Signer, signerCtr uint64,
 //   - key - the re-assembled key
 //   - err - a possible error when trying to recover the data from the point
 func (r *DecryptKeyReply) RecoverKey(xc kyber.Scalar) (key []byte, err error) {
-	xcInv := xc.Clone().Neg(xc)
-	XhatDec := r.X.Clone().Mul(xcInv, r.X)
-	Xhat := XhatDec.Clone().Add(r.XhatEnc, XhatDec)
-	XhatInv := Xhat.Clone().Neg(Xhat)
-
-	// Decrypt r.C to keyPointHat
-	XhatInv.Add(r.C, XhatInv)
-	key, err = XhatInv.Data()
+	// The key point is C - (XhatEnc - xc * X), computed in a single point
+	// without negating xc.
+	keyPointHat := r.X.Clone().Mul(xc, r.X)
+	keyPointHat.Add(keyPointHat, r.C).Sub(keyPointHat, r.XhatEnc)
+	key, err = keyPointHat.Data()
 	if err != nil {
 		err = xerrors.Errorf("extracting data from point: %v", err)
 	}
 	return
 }
+
+// ShareReport lists the shares of a reply that have been left out by
+// RecoverKeyVerified. The index of a share is the index of its node in the
+// roster of the LTS.
+type ShareReport struct {
+	// Invalid are the indexes of the shares with a wrong proof.
+	Invalid []int
+	// Duplicate are the indexes of the shares that have been sent more
+	// than once.
+	Duplicate []int
+}
+
+// Trustees returns the nodes of the roster of the LTS that sent an invalid
+// or a duplicate share.
+func (sr *ShareReport) Trustees(roster *onet.Roster) []*network.ServerIdentity {
+	var nodes []*network.ServerIdentity
+	for _, i := range append(append([]int{}, sr.Invalid...), sr.Duplicate...) {
+		if i >= 0 && i < len(roster.List) {
+			nodes = append(nodes, roster.List[i])
+		}
+	}
+	return nodes
+}
+
+// RecoverKeyVerified works like RecoverKey, but verifies every share of the
+// reply first. The shares that fail verification are left out, and XhatEnc
+// is recovered again from the valid shares, so that the key can be recovered
+// as long as enough shares are valid. X and threshold are the public key and
+// the threshold of the LTS, as for Verify, and U is the point of the write
+// instance. The report names the shares that have been left out, also if
+// the key couldn't be recovered.
+func (r *DecryptKeyReply) RecoverKeyVerified(X kyber.Point, threshold int,
+	U kyber.Point, xc kyber.Scalar) ([]byte, *ShareReport, error) {
+	report := &ShareReport{}
+	if len(r.Uis) > MaxShares || len(r.Commits) > MaxShares {
+		return nil, report, xerrors.Errorf("more than %d shares or commits",
+			MaxShares)
+	}
+	if r.X == nil || !r.X.Equal(X) {
+		return nil, report,
+			xerrors.New("reply doesn't hold the public key of the LTS")
+	}
+	if len(r.Commits) != threshold {
+		return nil, report, xerrors.Errorf("got %d commits for a threshold of %d",
+			len(r.Commits), threshold)
+	}
+	if len(r.Commits) == 0 || !r.Commits[0].Equal(X) {
+		return nil, report,
+			xerrors.New("commits don't match the public key of the LTS")
+	}
+	poly := share.NewPubPoly(cothority.Suite, cothority.Suite.Point().Base(),
+		r.Commits)
+	Xc := cothority.Suite.Point().Mul(xc, nil)
+	var valid []*share.PubShare
+	seen := make(map[int]bool)
+	for i, ui := range r.Uis {
+		if ui == nil {
+			continue
+		}
+		if i >= len(r.Proofs) || protocol.VerifyReencryption(poly, U, Xc, ui,
+			&r.Proofs[i]) != nil {
+			report.Invalid = append(report.Invalid, ui.I)
+			continue
+		}
+		if seen[ui.I] {
+			report.Duplicate = append(report.Duplicate, ui.I)
+			continue
+		}
+		seen[ui.I] = true
+		valid = append(valid, ui)
+	}
+	if len(valid) < threshold {
+		return nil, report, xerrors.Errorf("got %d valid shares, need %d",
+			len(valid), threshold)
+	}
+	XhatEnc, err := share.RecoverCommit(cothority.Suite, valid, threshold,
+		len(valid))
+	if err != nil {
+		return nil, report, xerrors.Errorf("recovering commit: %v", err)
+	}
+	verified := *r
+	verified.XhatEnc = XhatEnc
+	key, err := verified.RecoverKey(xc)
+	return key, report, err
+}
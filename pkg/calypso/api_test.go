@@ -1,18 +1,31 @@
 package calypso
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 
-	"github.com/stretchr/testify/require"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/byzcoin/contracts"
 	"github.com/calypso-demo/filesharing/pkg/darc"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3"
+	"golang.org/x/xerrors"
 )
 
 // Tests the client function CreateLTS
@@ -202,13 +215,13 @@ func TestClient_Calypso(t *testing.T) {
 	require.True(t, prRe2.InclusionProof.Match(re2.InstanceID.Slice()))
 
 	// Make sure you can't decrypt with non-matching proofs
-	_, err = calypsoClient.DecryptKey(&DecryptKey{Read: *prRe1, Write: *prWr2})
+	_, err = calypsoClient.DecryptKey(signed(t, prRe1, prWr2, reader1.Ed25519.Secret))
 	require.NotNil(t, err)
-	_, err = calypsoClient.DecryptKey(&DecryptKey{Read: *prRe2, Write: *prWr1})
+	_, err = calypsoClient.DecryptKey(signed(t, prRe2, prWr1, reader2.Ed25519.Secret))
 	require.NotNil(t, err)
 
 	// Make sure you can actually decrypt
-	dk1, err := calypsoClient.DecryptKey(&DecryptKey{Read: *prRe1, Write: *prWr1})
+	dk1, err := calypsoClient.DecryptKey(signed(t, prRe1, prWr1, reader1.Ed25519.Secret))
 	require.NoError(t, err)
 	require.True(t, dk1.X.Equal(calypsoClient.ltsReply.X))
 	keyCopy1, err := dk1.RecoverKey(reader1.Ed25519.Secret)
@@ -217,3 +230,1777 @@ func TestClient_Calypso(t *testing.T) {
 
 	// use keyCopy to unlock the stuff in writeInstance.Data
 }
+
+// Tests that re-using an idempotency token doesn't create a second write.
+func TestClient_AddWriteWithToken(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	token := []byte("upload-1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	wr1, err := calypsoClient.AddWriteWithToken(write, s.signer,
+		ctr.Counters[0]+1, *s.gDarc, 10, token)
+	require.NoError(t, err)
+	require.False(t, wr1.Duplicate)
+
+	wr2, err := calypsoClient.AddWriteWithToken(write, s.signer,
+		ctr.Counters[0]+2, *s.gDarc, 10, token)
+	require.NoError(t, err)
+	require.True(t, wr2.Duplicate)
+	require.True(t, wr1.InstanceID.Equal(wr2.InstanceID))
+	require.NotNil(t, wr2.Inclusion)
+	require.True(t, wr2.Inclusion.BlockIndex >= wr1.Inclusion.BlockIndex)
+
+	// The node doesn't add a repeated token again, even if the client
+	// doesn't check it first.
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractWriteID,
+				Args: byzcoin.Arguments{
+					{Name: "write", Value: []byte{}},
+					{Name: "preID", Value: PreIDFromToken(s.signer.Identity(), token)},
+				},
+			},
+			SignerCounter: []uint64{ctr.Counters[0] + 2},
+		},
+	)
+	require.NoError(t, ctx.FillSignersAndSignWith(s.signer))
+	tr, err := s.services[0].AddTokenWrite(&AddTokenWrite{
+		Request: byzcoin.AddTxRequest{Version: byzcoin.CurrentVersion,
+			SkipchainID: s.gbReply.Skipblock.Hash, Transaction: ctx}})
+	require.NoError(t, err)
+	require.True(t, tr.Duplicate)
+	require.True(t, wr1.InstanceID.Equal(tr.WriteID))
+
+	// Another token gives another instance.
+	wr3, err := calypsoClient.AddWriteWithToken(write, s.signer,
+		ctr.Counters[0]+2, *s.gDarc, 10, []byte("upload-2"))
+	require.NoError(t, err)
+	require.False(t, wr3.Duplicate)
+	require.False(t, wr1.InstanceID.Equal(wr3.InstanceID))
+}
+
+// TestClient_AddWriteInclusion checks that the reply of a write proves where
+// it has been included.
+func TestClient_AddWriteInclusion(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	// A new client asks for a proof starting at the genesis block.
+	calypsoClient := NewClient(byzcoin.NewClient(s.cl.ID, *s.byzRoster))
+
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+1,
+		*s.gDarc, 10)
+	require.NoError(t, err)
+	require.NotNil(t, wr.Inclusion)
+	require.True(t, wr.Inclusion.BlockIndex > 0)
+	require.NotEmpty(t, wr.Inclusion.BackLinks)
+	require.NotEmpty(t, wr.Inclusion.Signature)
+
+	inc, err := wr.VerifyInclusion(s.gbReply.Skipblock)
+	require.NoError(t, err)
+	require.Equal(t, wr.Inclusion.BlockIndex, inc.BlockIndex)
+	other := *wr
+	other.InstanceID = byzcoin.NewInstanceID([]byte("other"))
+	_, err = other.VerifyInclusion(s.gbReply.Skipblock)
+	require.Error(t, err)
+
+	// Without waiting, there is no proof.
+	wr, err = calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2,
+		*s.gDarc, 0)
+	require.NoError(t, err)
+	require.Nil(t, wr.Inclusion)
+	_, err = wr.VerifyInclusion(s.gbReply.Skipblock)
+	require.Error(t, err)
+}
+
+// Tests that a batch of writes is added even if the client has to wait for
+// the transaction queue.
+func TestClient_AddWrites(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+	calypsoClient.SetMaxQueueDepth(2)
+
+	var writes []*Write
+	for i := 0; i < 5; i++ {
+		writes = append(writes, NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+			s.gDarc.GetBaseID(), s.ltsReply.X, []byte{byte(i)}))
+	}
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	replies, err := calypsoClient.AddWrites(writes, s.signer,
+		ctr.Counters[0]+1, *s.gDarc, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(writes), len(replies))
+
+	for _, wr := range replies {
+		_, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+		require.NoError(t, err)
+	}
+	depth, size, err := s.cl.TxQueueDepth()
+	require.NoError(t, err)
+	require.Equal(t, 0, depth)
+	require.True(t, size > 0)
+}
+
+// TestClient_GetWrite checks that the proof of a write can be verified
+// starting from the genesis block only.
+func TestClient_GetWrite(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	write, proof, err := calypsoClient.GetWrite(writeID)
+	require.NoError(t, err)
+	require.True(t, write.LTSID.Equal(s.ltsReply.InstanceID))
+
+	genesis := s.gbReply.Skipblock
+	_, err = VerifyWriteProof(genesis, proof)
+	require.NoError(t, err)
+
+	corrupted := genesis.Copy()
+	corrupted.Index = 1
+	_, err = VerifyWriteProof(corrupted, proof)
+	require.Error(t, err)
+
+	truncated := *proof
+	truncated.Links = proof.Links[1:]
+	_, err = VerifyWriteProof(genesis, &truncated)
+	require.Error(t, err)
+
+	_, _, err = calypsoClient.GetWrite(byzcoin.NewInstanceID([]byte("unknown")))
+	require.Error(t, err)
+}
+
+func TestClient_AddReadAnonymous(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	var readers []darc.Signer
+	var ring []kyber.Point
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r := darc.NewSignerEd25519(nil, nil)
+		readers = append(readers, r)
+		ring = append(ring, r.Ed25519.Point)
+		ids = append(ids, r.Identity().String())
+	}
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("ring readers"))
+	d.Rules.AddRule(darc.Action("spawn:"+ContractWriteID),
+		expression.InitOrExpr(id.String()))
+	d.Rules.AddRule(darc.Action("spawn:"+ContractReadID),
+		expression.InitOrExpr(ids...))
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	_, err = calypsoClient.SpawnDarc(s.signer, ctr.Counters[0]+1, *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, key1)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2, *d, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	// The reader must use its own key.
+	_, err = calypsoClient.AddReadAnonymous(prWr, ring, 0,
+		readers[1].Ed25519.Secret, readers[1].Ed25519.Point, 10)
+	require.Error(t, err)
+	// Somebody not allowed to read can't hide in the ring.
+	outsider := darc.NewSignerEd25519(nil, nil)
+	_, err = calypsoClient.AddReadAnonymous(prWr,
+		append([]kyber.Point{outsider.Ed25519.Point}, ring...), 0,
+		outsider.Ed25519.Secret, outsider.Ed25519.Point, 10)
+	require.Error(t, err)
+
+	re, err := calypsoClient.AddReadAnonymous(prWr, ring, 1,
+		readers[1].Ed25519.Secret, readers[1].Ed25519.Point, 10)
+	require.NoError(t, err)
+	prRe, err := calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, readers[1].Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(readers[1].Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+
+	// A blinded read doesn't show the key in the chain, and can only be
+	// decrypted with its opening.
+	xc := darc.NewSignerEd25519(nil, nil)
+	re, op, err := calypsoClient.AddReadBlinded(prWr, ring, 2,
+		readers[2].Ed25519.Secret, xc.Ed25519.Secret, 10)
+	require.NoError(t, err)
+	prRe, err = calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	read, err := decodeReadProof(prRe)
+	require.NoError(t, err)
+	require.Nil(t, read.Xc)
+	_, err = calypsoClient.DecryptKey(signed(t, prRe, prWr, xc.Ed25519.Secret))
+	require.Error(t, err)
+	wrong := *op
+	wrong.Xc = readers[2].Ed25519.Point
+	dkr := signed(t, prRe, prWr, xc.Ed25519.Secret)
+	dkr.Opening = &wrong
+	_, err = calypsoClient.DecryptKey(dkr)
+	require.Error(t, err)
+	dkr = signed(t, prRe, prWr, xc.Ed25519.Secret)
+	dkr.Opening = op
+	dk, err = calypsoClient.DecryptKey(dkr)
+	require.NoError(t, err)
+	keyCopy, err = dk.RecoverKey(xc.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+}
+
+// TestClient_AddReadWithDevice checks that a device enrolled by a reader can
+// read in its place, until it is revoked.
+func TestClient_AddReadWithDevice(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	reader := darc.NewSignerEd25519(nil, nil)
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("device readers"))
+	for _, rule := range []string{"spawn:" + ContractWriteID,
+		"spawn:" + ContractCredentialID,
+		"invoke:" + ContractCredentialID + ".enroll",
+		"invoke:" + ContractCredentialID + ".revoke"} {
+		d.Rules.AddRule(darc.Action(rule), expression.InitOrExpr(id.String()))
+	}
+	d.Rules.AddRule(darc.Action("spawn:"+ContractReadID),
+		expression.InitOrExpr(reader.Identity().String()))
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() []uint64 {
+		next++
+		return []uint64{next}
+	}
+	_, err = calypsoClient.SpawnDarc(s.signer, counter()[0], *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, key1)
+	wr, err := calypsoClient.AddWrite(write, s.signer, counter()[0], *d, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	laptop := darc.NewSignerEd25519(nil, nil)
+	phone := darc.NewSignerEd25519(nil, nil)
+	preID := []byte("credential of the reader")
+	credID := CredentialID(preID)
+	dLaptop, err := NewDevice(reader, credID, "laptop", laptop.Ed25519.Point)
+	require.NoError(t, err)
+	dPhone, err := NewDevice(reader, credID, "phone", phone.Ed25519.Point)
+	require.NoError(t, err)
+	// A device must be signed by the primary key.
+	forged, err := NewDevice(phone, credID, "forged", phone.Ed25519.Point)
+	require.NoError(t, err)
+	_, err = calypsoClient.SpawnCredential(d.GetBaseID(), preID,
+		&Credential{Primary: reader.Ed25519.Point, Devices: []Device{forged}},
+		reader, []darc.Signer{s.signer}, counter(), 10)
+	require.Error(t, err)
+	next--
+	// And so must the credential.
+	_, err = calypsoClient.SpawnCredential(d.GetBaseID(), preID,
+		&Credential{Primary: reader.Ed25519.Point, Devices: []Device{dLaptop}},
+		phone, []darc.Signer{s.signer}, counter(), 10)
+	require.Error(t, err)
+	next--
+
+	spawnedID, err := calypsoClient.SpawnCredential(d.GetBaseID(), preID,
+		&Credential{Primary: reader.Ed25519.Point, Devices: []Device{dLaptop}},
+		reader, []darc.Signer{s.signer}, counter(), 10)
+	require.NoError(t, err)
+	require.True(t, spawnedID.Equal(credID))
+
+	// The phone isn't enrolled yet, and only the primary key can enroll it.
+	_, err = calypsoClient.AddReadWithDevice(prWr, credID, phone, 1, 10)
+	require.Error(t, err)
+	err = calypsoClient.EnrollDevice(credID, dPhone, []darc.Signer{s.signer},
+		counter(), 10)
+	require.Error(t, err)
+	next--
+	readerCtr := uint64(0)
+	primary := func() []uint64 {
+		next++
+		readerCtr++
+		return []uint64{next, readerCtr}
+	}
+	require.NoError(t, calypsoClient.EnrollDevice(credID, dPhone,
+		[]darc.Signer{s.signer, reader}, primary(), 10))
+
+	for _, dev := range []darc.Signer{laptop, phone} {
+		re, err := calypsoClient.AddReadWithDevice(prWr, credID, dev, 1, 10)
+		require.NoError(t, err)
+		prRe, err := calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+		require.NoError(t, err)
+		dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, dev.Ed25519.Secret))
+		require.NoError(t, err)
+		keyCopy, err := dk.RecoverKey(dev.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, key1, keyCopy)
+	}
+
+	// Revoking the laptop leaves the darc as it is.
+	require.NoError(t, calypsoClient.RevokeDevice(credID, laptop.Ed25519.Point,
+		[]darc.Signer{s.signer, reader}, primary(), 10))
+	_, err = calypsoClient.AddReadWithDevice(prWr, credID, laptop, 2, 10)
+	require.Error(t, err)
+	err = calypsoClient.EnrollDevice(credID, dLaptop,
+		[]darc.Signer{s.signer, reader}, primary(), 10)
+	require.Error(t, err)
+	next--
+	readerCtr--
+	_, err = calypsoClient.AddReadWithDevice(prWr, credID, phone, 2, 10)
+	require.NoError(t, err)
+
+	// The revoked laptop cannot come back through a fresh credential: its
+	// signature is for the first credential only.
+	freshPreID := []byte("fresh credential of the reader")
+	_, err = calypsoClient.SpawnCredential(d.GetBaseID(), freshPreID,
+		&Credential{Primary: reader.Ed25519.Point, Devices: []Device{dLaptop}},
+		reader, []darc.Signer{s.signer}, counter(), 10)
+	require.Error(t, err)
+	next--
+	freshID, err := calypsoClient.SpawnCredential(d.GetBaseID(), freshPreID,
+		&Credential{Primary: reader.Ed25519.Point}, reader,
+		[]darc.Signer{s.signer}, counter(), 10)
+	require.NoError(t, err)
+	err = calypsoClient.EnrollDevice(freshID, dLaptop,
+		[]darc.Signer{s.signer, reader}, primary(), 10)
+	require.Error(t, err)
+	_, err = calypsoClient.AddReadWithDevice(prWr, freshID, laptop, 2, 10)
+	require.Error(t, err)
+}
+
+func TestClient_UpdateWrite(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	nextCtr := ctr.Counters[0] + 1
+	newWrite := func(key string) *Write {
+		return NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+			s.gDarc.GetBaseID(), s.ltsReply.X, []byte(key))
+	}
+
+	wr1, err := calypsoClient.AddWrite(newWrite("version 1"), s.signer,
+		nextCtr, *s.gDarc, 10)
+	require.NoError(t, err)
+	nextCtr++
+	wr2, err := calypsoClient.UpdateWrite(wr1.InstanceID, newWrite("version 2"),
+		s.signer, nextCtr, 10)
+	require.NoError(t, err)
+	nextCtr++
+
+	// Only the latest version can be updated.
+	_, err = calypsoClient.UpdateWrite(wr1.InstanceID, newWrite("version 2b"),
+		s.signer, nextCtr, 10)
+	require.Error(t, err)
+
+	wr3, err := calypsoClient.UpdateWrite(wr2.InstanceID, newWrite("version 3"),
+		s.signer, nextCtr, 10)
+	require.NoError(t, err)
+
+	for _, id := range []byzcoin.InstanceID{wr1.InstanceID, wr2.InstanceID, wr3.InstanceID} {
+		latest, err := calypsoClient.GetLatestVersion(id)
+		require.NoError(t, err)
+		require.True(t, latest.InclusionProof.Match(wr3.InstanceID.Slice()))
+	}
+
+	// Older versions can still be read and decrypted.
+	prWr1, err := calypsoClient.WaitProof(wr1.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	prRe1 := s.addReadAndWait(t, prWr1, s.signer.Ed25519.Point)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe1, prWr1, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	key, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, []byte("version 1"), key)
+
+	var w Write
+	prWr3, err := calypsoClient.WaitProof(wr3.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	require.NoError(t, prWr3.VerifyAndDecode(cothority.Suite, ContractWriteID, &w))
+	require.True(t, w.Previous.Equal(wr2.InstanceID))
+}
+
+func TestClient_FreezeWrite(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() []uint64 {
+		next++
+		return []uint64{next}
+	}
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, key1)
+	wr, err := calypsoClient.AddWrite(write, s.signer, counter()[0], *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	next++
+
+	require.NoError(t, calypsoClient.FreezeWrite(wr.InstanceID, "investigation",
+		[]darc.Signer{s.signer}, counter(), 10))
+	status, err := calypsoClient.GetWriteStatus(wr.InstanceID)
+	require.NoError(t, err)
+	require.True(t, status.Frozen)
+	require.Equal(t, "investigation", status.FreezeReason)
+
+	// The proof of the write given with the read predates the freeze, but
+	// the decryption is still refused.
+	_, err = calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+	prWr, err = calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	_, err = calypsoClient.AddRead(prWr, s.signer, counter()[0], 10)
+	require.Error(t, err)
+	next--
+	_, err = calypsoClient.UpdateWrite(wr.InstanceID, write, s.signer,
+		counter()[0], 10)
+	require.Error(t, err)
+	next--
+
+	require.NoError(t, calypsoClient.UnfreezeWrite(wr.InstanceID,
+		[]darc.Signer{s.signer}, counter(), 10))
+	status, err = calypsoClient.GetWriteStatus(wr.InstanceID)
+	require.NoError(t, err)
+	require.False(t, status.Frozen)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+}
+
+// TestClient_LegalHold makes sure a write cannot be deleted during its
+// retention or while it is under legal hold.
+func TestClient_LegalHold(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() []uint64 {
+		next++
+		return []uint64{next}
+	}
+	signers := []darc.Signer{s.signer}
+
+	retained := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key 1"))
+	until := time.Now().Add(time.Hour)
+	retained.RetainUntil = until.Unix()
+	wr1, err := calypsoClient.AddWrite(retained, s.signer, counter()[0], *s.gDarc, 10)
+	require.NoError(t, err)
+	require.Error(t, calypsoClient.DeleteWrite(wr1.InstanceID, signers, counter(), 10))
+	next--
+	require.Error(t, calypsoClient.RetainWrite(wr1.InstanceID,
+		until.Add(-time.Minute), signers, counter(), 10))
+	next--
+	require.NoError(t, calypsoClient.RetainWrite(wr1.InstanceID,
+		until.Add(time.Hour), signers, counter(), 10))
+
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key 2"))
+	wr2, err := calypsoClient.AddWrite(write, s.signer, counter()[0], *s.gDarc, 10)
+	require.NoError(t, err)
+	require.NoError(t, calypsoClient.HoldWrite(wr2.InstanceID, "litigation",
+		signers, counter(), 10))
+	status, err := calypsoClient.GetWriteStatus(wr2.InstanceID)
+	require.NoError(t, err)
+	require.True(t, status.Hold)
+	require.Equal(t, "litigation", status.HoldReason)
+	require.Error(t, calypsoClient.DeleteWrite(wr2.InstanceID, signers, counter(), 10))
+	next--
+
+	// The held write can still be read.
+	prWr, err := calypsoClient.WaitProof(wr2.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	_, err = calypsoClient.AddRead(prWr, s.signer, counter()[0], 10)
+	require.NoError(t, err)
+
+	require.NoError(t, calypsoClient.ReleaseWrite(wr2.InstanceID, signers,
+		counter(), 10))
+	require.NoError(t, calypsoClient.DeleteWrite(wr2.InstanceID, signers,
+		counter(), 10))
+	status, err = calypsoClient.GetWriteStatus(wr2.InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, WriteDeleted, status.State)
+}
+
+func TestClient_DocumentMetadata(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	key1 := []byte("secret key 1")
+	md := &DocumentMetadata{Filename: "report.pdf", MIMEType: "application/pdf",
+		Tags: []string{"finance"}, Fields: map[string]string{"year": "2020"}}
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, key1)
+	write.Label = "Quarterly Report"
+	require.NoError(t, write.SetMetadata(key1, md))
+
+	long := *write
+	long.Label = strings.Repeat("x", maxLabelLength+1)
+	_, err = calypsoClient.AddWrite(&long, s.signer, ctr.Counters[0]+1, *s.gDarc, 10)
+	require.Error(t, err)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+1, *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	s.waitForBlocks(t, s.services[0])
+	docs, err := calypsoClient.FindDocuments("quarterly", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, docs.Total)
+	require.True(t, docs.Documents[0].WriteID.Equal(wr.InstanceID))
+	require.Equal(t, "Quarterly Report", docs.Documents[0].Label)
+	docs, err = calypsoClient.FindDocuments("annual", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, docs.Total)
+
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	mdCopy, err := calypsoClient.GetDocumentMetadata(wr.InstanceID, keyCopy)
+	require.NoError(t, err)
+	require.Equal(t, md, mdCopy)
+	_, err = calypsoClient.GetDocumentMetadata(wr.InstanceID, []byte("wrong key"))
+	require.Error(t, err)
+}
+
+func TestClient_FindByLabel(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	var ids []byzcoin.InstanceID
+	for i, label := range []string{"Quarterly Report", "Annual report"} {
+		write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+			s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+		write.Label = label
+		wr, err := calypsoClient.AddWrite(write, s.signer,
+			ctr.Counters[0]+1+uint64(i), *s.gDarc, 10)
+		require.NoError(t, err)
+		ids = append(ids, wr.InstanceID)
+	}
+
+	s.waitForBlocks(t, s.services[0])
+	matches, err := calypsoClient.FindByLabel("report", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(matches))
+	require.True(t, matches[0].WriteID.Equal(ids[0]))
+	require.True(t, matches[1].WriteID.Equal(ids[1]))
+	require.Equal(t, "Annual report", matches[1].Write.Label)
+	_, err = VerifyWriteProof(s.gbReply.Skipblock, matches[1].Proof)
+	require.NoError(t, err)
+
+	matches, err = calypsoClient.FindByLabel("REPORT quarterly", 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(matches))
+	require.True(t, matches[0].WriteID.Equal(ids[0]))
+	matches, err = calypsoClient.FindByLabel("report", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(matches))
+	matches, err = calypsoClient.FindByLabel("budget", 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(matches))
+	_, err = calypsoClient.FindByLabel(" ", 0)
+	require.Error(t, err)
+}
+
+func TestClient_EncryptFile(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	// Three full chunks and a partial one.
+	doc := make([]byte, 3*fileChunkSize+100)
+	for i := range doc {
+		doc[i] = byte(i)
+	}
+	var enc bytes.Buffer
+	write, key, err := EncryptFile(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, bytes.NewReader(doc), &enc)
+	require.NoError(t, err)
+	require.Equal(t, 32, len(write.DataRoot))
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+1, *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
+
+	writeCopy, _, err := calypsoClient.GetWrite(wr.InstanceID)
+	require.NoError(t, err)
+	var dec bytes.Buffer
+	require.NoError(t, DecryptFile(writeCopy, keyCopy, bytes.NewReader(enc.Bytes()), &dec))
+	require.Equal(t, doc, dec.Bytes())
+
+	// Truncated, reordered or modified copies are refused.
+	chunk := fileChunkSize + 16
+	truncated := enc.Bytes()[:3*chunk]
+	require.Error(t, DecryptFile(writeCopy, keyCopy, bytes.NewReader(truncated), &dec))
+	reordered := append(append([]byte{}, enc.Bytes()[chunk:2*chunk]...),
+		enc.Bytes()[:chunk]...)
+	reordered = append(reordered, enc.Bytes()[2*chunk:]...)
+	require.Error(t, DecryptFile(writeCopy, keyCopy, bytes.NewReader(reordered), &dec))
+	modified := append([]byte{}, enc.Bytes()...)
+	modified[10] ^= 1
+	require.Error(t, DecryptFile(writeCopy, keyCopy, bytes.NewReader(modified), &dec))
+	require.Error(t, DecryptFile(writeCopy, []byte("wrong key"),
+		bytes.NewReader(enc.Bytes()), &dec))
+
+	// An empty document is one empty chunk.
+	enc.Reset()
+	write, key, err = EncryptFile(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, bytes.NewReader(nil), &enc)
+	require.NoError(t, err)
+	dec.Reset()
+	require.NoError(t, DecryptFile(write, key, bytes.NewReader(enc.Bytes()), &dec))
+	require.Equal(t, 0, dec.Len())
+}
+
+// TestReadChunk verifies and decrypts single chunks of an encrypted
+// document against the Merkle root of the write.
+func TestReadChunk(t *testing.T) {
+	X := cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	ltsid := byzcoin.NewInstanceID([]byte("lts"))
+
+	// Four full chunks and a partial one.
+	doc := make([]byte, 4*fileChunkSize+100)
+	for i := range doc {
+		doc[i] = byte(i)
+	}
+	var enc bytes.Buffer
+	write, key, err := EncryptFile(cothority.Suite, ltsid, nil, X,
+		bytes.NewReader(doc), &enc)
+	require.NoError(t, err)
+	size := int64(enc.Len())
+
+	for i := 0; i < 5; i++ {
+		chunk, proof, err := ReadChunk(bytes.NewReader(enc.Bytes()), size, i)
+		require.NoError(t, err)
+		require.Equal(t, 5, proof.Count)
+		require.NoError(t, write.VerifyChunk(chunk, proof))
+		pt, err := DecryptChunk(key, chunk, proof)
+		require.NoError(t, err)
+		end := (i + 1) * fileChunkSize
+		if end > len(doc) {
+			end = len(doc)
+		}
+		require.Equal(t, doc[i*fileChunkSize:end], pt)
+
+		chunk[0] ^= 1
+		require.Error(t, write.VerifyChunk(chunk, proof))
+		chunk[0] ^= 1
+		if i < 3 {
+			proof.Index++
+			require.Error(t, write.VerifyChunk(chunk, proof))
+		}
+	}
+	_, _, err = ReadChunk(bytes.NewReader(enc.Bytes()), size, 5)
+	require.Error(t, err)
+}
+
+// TestEncryptFileDedup makes sure identical chunks of documents are stored
+// once, while every document keeps its own key.
+func TestEncryptFileDedup(t *testing.T) {
+	secret, err := NewConvergentSecret()
+	require.NoError(t, err)
+	X := cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	ltsid := byzcoin.NewInstanceID([]byte("lts"))
+	store := NewMemoryBlobStore()
+
+	doc := make([]byte, 3*fileChunkSize+100)
+	for i := range doc {
+		doc[i] = byte(i)
+	}
+	var enc1, enc2 bytes.Buffer
+	write1, key1, err := EncryptFileDedup(cothority.Suite, ltsid, nil, X,
+		secret, bytes.NewReader(doc), store, &enc1)
+	require.NoError(t, err)
+	require.Equal(t, 4, store.Len())
+	write2, key2, err := EncryptFileDedup(cothority.Suite, ltsid, nil, X,
+		secret, bytes.NewReader(doc), store, &enc2)
+	require.NoError(t, err)
+	require.Equal(t, 4, store.Len())
+	require.NotEqual(t, key1, key2)
+
+	// Changing the last chunk only adds one chunk.
+	changed := append([]byte{}, doc...)
+	changed[len(changed)-1] ^= 1
+	var enc3 bytes.Buffer
+	_, _, err = EncryptFileDedup(cothority.Suite, ltsid, nil, X, secret,
+		bytes.NewReader(changed), store, &enc3)
+	require.NoError(t, err)
+	require.Equal(t, 5, store.Len())
+
+	var dec bytes.Buffer
+	require.NoError(t, DecryptFileDedup(write1, key1, store,
+		bytes.NewReader(enc1.Bytes()), &dec))
+	require.Equal(t, doc, dec.Bytes())
+	dec.Reset()
+	require.NoError(t, DecryptFileDedup(write2, key2, store,
+		bytes.NewReader(enc2.Bytes()), &dec))
+	require.Equal(t, doc, dec.Bytes())
+	require.Error(t, DecryptFileDedup(write2, key1, store,
+		bytes.NewReader(enc2.Bytes()), &dec))
+
+	// Another secret gives other chunks, and missing chunks are an error.
+	other, err := NewConvergentSecret()
+	require.NoError(t, err)
+	_, _, err = EncryptFileDedup(cothority.Suite, ltsid, nil, X, other,
+		bytes.NewReader(doc), store, &bytes.Buffer{})
+	require.NoError(t, err)
+	require.Equal(t, 9, store.Len())
+	require.Error(t, DecryptFileDedup(write1, key1, NewMemoryBlobStore(),
+		bytes.NewReader(enc1.Bytes()), &dec))
+}
+
+func TestClient_RotateLTS(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	key1 := []byte("secret key 1")
+	prOld := s.addWriteAndWait(t, key1)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	rotated, err := calypsoClient.RotateLTS(s.ltsReply.InstanceID, s.ltsRoster,
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	require.False(t, rotated.X.Equal(s.ltsReply.X))
+	_, err = calypsoClient.RotateLTS(s.ltsReply.InstanceID, s.ltsRoster,
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 2})
+	require.Error(t, err)
+
+	id, info, err := calypsoClient.CurrentLTS(s.ltsReply.InstanceID)
+	require.NoError(t, err)
+	require.True(t, id.Equal(rotated.InstanceID))
+	require.Equal(t, 1, info.Epoch)
+	require.True(t, info.Previous.Equal(s.ltsReply.InstanceID))
+
+	// New writes must use the new epoch.
+	old := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key 2"))
+	_, err = calypsoClient.AddWrite(old, s.signer, ctr.Counters[0]+2, *s.gDarc, 10)
+	require.Error(t, err)
+	key3 := []byte("secret key 3")
+	write := NewWrite(cothority.Suite, rotated.InstanceID,
+		s.gDarc.GetBaseID(), rotated.X, key3)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2, *s.gDarc, 10)
+	require.NoError(t, err)
+	prNew, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	// Both the writes of the old and of the new epoch can be decrypted.
+	for _, c := range []struct {
+		write *byzcoin.Proof
+		key   []byte
+	}{{prOld, key1}, {prNew, key3}} {
+		prRe := s.addReadAndWait(t, c.write, s.signer.Ed25519.Point)
+		dk, err := calypsoClient.DecryptKey(signed(t, prRe, c.write,
+			s.signer.Ed25519.Secret))
+		require.NoError(t, err)
+		keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, c.key, keyCopy)
+	}
+}
+
+func TestClient_UserError(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	stranger := darc.NewSignerEd25519(nil, nil)
+	_, err := calypsoClient.AddRead(prWr, stranger, 1, 10)
+	require.Error(t, err)
+	require.True(t, xerrors.Is(err, ErrNotAuthorized))
+	var ue *UserError
+	require.True(t, xerrors.As(err, &ue))
+	require.Equal(t, "not_authorized", ue.Code)
+	require.NotEmpty(t, ue.Hint)
+
+	err = ToUserError(xerrors.New("this ByzCoin ID is not authorised"))
+	require.True(t, xerrors.Is(err, ErrChainUnknown))
+	require.False(t, xerrors.Is(err, ErrNotAuthorized))
+	err = ToUserError(xerrors.New("reencryption got refused: 2 nodes down"))
+	require.True(t, xerrors.Is(err, ErrThresholdNotMet))
+	require.Equal(t, err, ToUserError(err))
+	other := xerrors.New("something else")
+	require.Equal(t, other, ToUserError(other))
+	require.NoError(t, ToUserError(nil))
+}
+
+// TestClient_SeparateRosters uses trustees that are not part of the ByzCoin
+// roster, so that the ByzCoin nodes don't hold any share.
+// TestClient_AddReadApproved makes sure a write with an ApprovalPolicy
+// needs reads signed by enough distinct readers.
+func TestClient_AddReadApproved(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	alice := darc.NewSignerEd25519(nil, nil)
+	bob := darc.NewSignerEd25519(nil, nil)
+	eve := darc.NewSignerEd25519(nil, nil)
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("two-person rule"))
+	d.Rules.AddRule(darc.Action("spawn:"+ContractWriteID),
+		expression.InitOrExpr(id.String()))
+	d.Rules.AddRule(darc.Action("spawn:"+ContractReadID),
+		expression.InitOrExpr(alice.Identity().String(),
+			bob.Identity().String(), eve.Identity().String()))
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	_, err = calypsoClient.SpawnDarc(s.signer, ctr.Counters[0]+1, *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, key1)
+	write.Policy = ApprovalPolicy(2)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2, *d, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	_, err = calypsoClient.AddRead(prWr, alice, 1, 10)
+	require.Error(t, err)
+	// The signer of the genesis darc is not a reader of the write.
+	outsider := []darc.Signer{alice, s.signer}
+	_, err = calypsoClient.AddReadApproved(prWr, alice.Ed25519.Point, outsider,
+		[]uint64{1, ctr.Counters[0] + 3}, 10)
+	require.Error(t, err)
+
+	re, err := calypsoClient.AddReadApproved(prWr, alice.Ed25519.Point,
+		[]darc.Signer{alice, bob}, []uint64{1, 1}, 10)
+	require.NoError(t, err)
+	prRe, err := calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, alice.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(alice.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+}
+
+// TestClient_Auditor makes sure the reads of a write with an auditor must be
+// co-signed by the auditor.
+func TestClient_Auditor(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	auditor := darc.NewSignerEd25519(nil, nil)
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, key1)
+	write.Auditor = auditor.Ed25519.Point
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	wr, err := calypsoClient.AddWrite(write, s.signer, next+1, *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	_, err = calypsoClient.AddRead(prWr, s.signer, next+2, 10)
+	require.Error(t, err)
+	re, err := calypsoClient.AddReadApproved(prWr, s.signer.Ed25519.Point,
+		[]darc.Signer{s.signer, auditor}, []uint64{next + 2, 1}, 10)
+	require.NoError(t, err)
+	prRe, err := calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+
+	// An update cannot drop the auditor.
+	update := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key 2"))
+	_, err = calypsoClient.UpdateWrite(wr.InstanceID, update, s.signer,
+		next+3, 10)
+	require.Error(t, err)
+}
+
+// TestClient_ReaderGroup shares a document with a reader group and makes
+// sure that the members added later can read it, and the removed ones can't.
+func TestClient_ReaderGroup(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("group readers"))
+	for _, rule := range []string{"spawn:" + ContractWriteID,
+		"spawn:" + ContractGroupID, "spawn:" + ContractReadID,
+		"invoke:" + ContractGroupID + ".add",
+		"invoke:" + ContractGroupID + ".remove"} {
+		d.Rules.AddRule(darc.Action(rule), expression.InitOrExpr(id.String()))
+	}
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() []uint64 {
+		next++
+		return []uint64{next}
+	}
+	_, err = calypsoClient.SpawnDarc(s.signer, counter()[0], *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	alice := darc.NewSignerEd25519(nil, nil)
+	bob := darc.NewSignerEd25519(nil, nil)
+	groupID, err := calypsoClient.SpawnGroup(d.GetBaseID(),
+		[]kyber.Point{alice.Ed25519.Point}, []darc.Signer{s.signer}, counter(), 10)
+	require.NoError(t, err)
+
+	// A write can only list existing groups.
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, key1)
+	write.Groups = []byzcoin.InstanceID{byzcoin.NewInstanceID([]byte("none"))}
+	_, err = calypsoClient.AddWrite(write, s.signer, counter()[0], *d, 10)
+	require.Error(t, err)
+	next--
+	write.Groups = []byzcoin.InstanceID{groupID}
+	wr, err := calypsoClient.AddWrite(write, s.signer, counter()[0], *d, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	_, err = calypsoClient.AddRead(prWr, bob, 1, 10)
+	require.Error(t, err)
+	require.NoError(t, calypsoClient.AddGroupMember(groupID, bob.Ed25519.Point,
+		[]darc.Signer{s.signer}, counter(), 10))
+
+	prReads := make([]*byzcoin.Proof, 2)
+	for i, member := range []darc.Signer{alice, bob} {
+		re, err := calypsoClient.AddRead(prWr, member, 1, 10)
+		require.NoError(t, err)
+		prReads[i], err = calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+		require.NoError(t, err)
+		read, err := decodeReadProof(prReads[i])
+		require.NoError(t, err)
+		require.True(t, read.Group.Equal(groupID))
+		require.True(t, read.Member.Equal(member.Ed25519.Point))
+		dk, err := calypsoClient.DecryptKey(signed(t, prReads[i], prWr,
+			member.Ed25519.Secret))
+		require.NoError(t, err)
+		keyCopy, err := dk.RecoverKey(member.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, key1, keyCopy)
+	}
+
+	// The read needs the proof of its group.
+	_, err = s.services[0].DecryptKey(signed(t, prReads[0], prWr, alice.Ed25519.Secret))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "proof of its reader group")
+
+	require.NoError(t, calypsoClient.RemoveGroupMember(groupID,
+		alice.Ed25519.Point, []darc.Signer{s.signer}, counter(), 10))
+	_, err = calypsoClient.AddRead(prWr, alice, 2, 10)
+	require.Error(t, err)
+	_, err = calypsoClient.AddRead(prWr, bob, 2, 10)
+	require.NoError(t, err)
+
+	// The earlier read of alice cannot be decrypted anymore.
+	_, err = calypsoClient.DecryptKey(signed(t, prReads[0], prWr, alice.Ed25519.Secret))
+	require.Error(t, err)
+	_, err = calypsoClient.DecryptKey(signed(t, prReads[1], prWr, bob.Ed25519.Secret))
+	require.NoError(t, err)
+}
+
+// TestClient_IdentityRegistry binds an email address to a key and shares a
+// document with it.
+func TestClient_IdentityRegistry(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("identity registry"))
+	for _, rule := range []string{"spawn:" + ContractRegistryID,
+		"invoke:" + ContractRegistryID + ".bind",
+		"invoke:" + ContractRegistryID + ".unbind"} {
+		d.Rules.AddRule(darc.Action(rule), expression.InitOrExpr(id.String()))
+	}
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() []uint64 {
+		next++
+		return []uint64{next}
+	}
+	_, err = calypsoClient.SpawnDarc(s.signer, counter()[0], *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	authority := darc.NewSignerEd25519(nil, nil)
+	regID, err := calypsoClient.SpawnRegistry(d.GetBaseID(),
+		authority.Ed25519.Point, []darc.Signer{s.signer}, counter(), 10)
+	require.NoError(t, err)
+
+	// Only the bindings signed by the authority are accepted.
+	bob := darc.NewSignerEd25519(nil, nil)
+	eve := darc.NewSignerEd25519(nil, nil)
+	forged, err := NewIdentityBinding(eve, "mailto:bob@example.com",
+		eve.Ed25519.Point)
+	require.NoError(t, err)
+	err = calypsoClient.BindIdentity(regID, forged, []darc.Signer{s.signer},
+		counter(), 10)
+	require.Error(t, err)
+	next--
+	binding, err := NewIdentityBinding(authority, "mailto:bob@example.com",
+		eve.Ed25519.Point)
+	require.NoError(t, err)
+	require.NoError(t, calypsoClient.BindIdentity(regID, binding,
+		[]darc.Signer{s.signer}, counter(), 10))
+	key, err := calypsoClient.LookupIdentity(regID, "mailto:bob@example.com")
+	require.NoError(t, err)
+	require.True(t, key.Equal(eve.Ed25519.Point))
+
+	// Binding the identifier again replaces its key.
+	binding, err = NewIdentityBinding(authority, "mailto:bob@example.com",
+		bob.Ed25519.Point)
+	require.NoError(t, err)
+	require.NoError(t, calypsoClient.BindIdentity(regID, binding,
+		[]darc.Signer{s.signer}, counter(), 10))
+	key, err = calypsoClient.LookupIdentity(regID, "mailto:bob@example.com")
+	require.NoError(t, err)
+	require.True(t, key.Equal(bob.Ed25519.Point))
+	_, err = calypsoClient.LookupIdentity(regID, "mailto:eve@example.com")
+	require.Error(t, err)
+	reg, err := calypsoClient.GetRegistry(regID)
+	require.NoError(t, err)
+	require.True(t, reg.Authority.Equal(authority.Ed25519.Point))
+	require.Equal(t, 1, len(reg.Bindings))
+
+	content := []byte("document for bob")
+	doc := calypsoClient.NewDocument(bytes.NewReader(content))
+	var encrypted bytes.Buffer
+	require.NoError(t, doc.Upload(s.ltsReply, *s.gDarc, s.signer, &encrypted))
+	require.Error(t, doc.ShareWithIdentity(s.signer, regID,
+		"mailto:eve@example.com"))
+	require.NoError(t, doc.ShareWithIdentity(s.signer, regID,
+		"mailto:bob@example.com"))
+	var out bytes.Buffer
+	_, err = doc.Fetch(bob, bytes.NewReader(encrypted.Bytes()), &out)
+	require.NoError(t, err)
+	require.Equal(t, content, out.Bytes())
+
+	next, err = calypsoClient.nextCounter(s.signer)
+	require.NoError(t, err)
+	next--
+	require.NoError(t, calypsoClient.UnbindIdentity(regID,
+		"mailto:bob@example.com", []darc.Signer{s.signer}, counter(), 10))
+	_, err = calypsoClient.LookupIdentity(regID, "mailto:bob@example.com")
+	require.Error(t, err)
+}
+
+// TestClient_PaidRead makes sure that a read of a write with a cost is only
+// accepted if it is paid, and that the payee gets the coins.
+func TestClient_PaidRead(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("paid reads"))
+	for _, rule := range []string{"spawn:" + ContractWriteID,
+		"spawn:" + ContractReadID, "spawn:" + contracts.ContractCoinID,
+		"invoke:" + contracts.ContractCoinID + ".mint",
+		"invoke:" + contracts.ContractCoinID + ".fetch"} {
+		d.Rules.AddRule(darc.Action(rule), expression.InitOrExpr(id.String()))
+	}
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	counter := func() uint64 {
+		next++
+		return next
+	}
+	_, err = calypsoClient.SpawnDarc(s.signer, counter(), *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	coinInstr := func(inst byzcoin.Instruction) {
+		inst.SignerCounter = []uint64{counter()}
+		ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion, inst)
+		require.NoError(t, ctx.FillSignersAndSignWith(s.signer))
+		_, err := s.cl.AddTransactionAndWait(ctx, 10)
+		require.NoError(t, err)
+	}
+	balance := func(account byzcoin.InstanceID) uint64 {
+		resp, err := s.cl.GetProofFromLatest(account.Slice())
+		require.NoError(t, err)
+		var coin byzcoin.Coin
+		require.NoError(t, resp.Proof.VerifyAndDecode(cothority.Suite,
+			contracts.ContractCoinID, &coin))
+		return coin.Value
+	}
+	var accounts []byzcoin.InstanceID
+	for _, name := range []string{"reader", "writer"} {
+		coinInstr(byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(d.GetBaseID()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: contracts.ContractCoinID,
+				Args:       byzcoin.Arguments{{Name: "coinID", Value: []byte(name)}},
+			},
+		})
+		h := sha256.New()
+		h.Write([]byte(contracts.ContractCoinID))
+		h.Write([]byte(name))
+		accounts = append(accounts, byzcoin.NewInstanceID(h.Sum(nil)))
+	}
+	reader, payee := accounts[0], accounts[1]
+	coins := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coins, 15)
+	coinInstr(byzcoin.Instruction{
+		InstanceID: reader,
+		Invoke: &byzcoin.Invoke{
+			ContractID: contracts.ContractCoinID,
+			Command:    "mint",
+			Args:       byzcoin.Arguments{{Name: "coins", Value: coins}},
+		},
+	})
+
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, []byte("secret key"))
+	write.Cost = byzcoin.Coin{Name: contracts.CoinName, Value: 10}
+	notCoin := byzcoin.NewInstanceID(d.GetBaseID())
+	write.Payee = &notCoin
+	_, err = calypsoClient.AddWrite(write, s.signer, counter(), *d, 10)
+	require.Error(t, err)
+	next--
+	write.Payee = &payee
+	wr, err := calypsoClient.AddWrite(write, s.signer, counter(), *d, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+
+	_, err = calypsoClient.AddRead(prWr, s.signer, counter(), 10)
+	require.Error(t, err)
+	next--
+	re, err := calypsoClient.AddPaidRead(prWr, s.signer, counter(), reader, 10)
+	require.NoError(t, err)
+	counter()
+	prRe, err := calypsoClient.WaitProof(re.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	_, err = calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), balance(reader))
+	require.Equal(t, uint64(10), balance(payee))
+
+	// The reader cannot pay a second read.
+	_, err = calypsoClient.AddPaidRead(prWr, s.signer, counter(), reader, 10)
+	require.Error(t, err)
+	require.Equal(t, uint64(10), balance(payee))
+}
+
+// TestClient_WriteValue publishes a write and its new version in a value
+// instance.
+func TestClient_WriteValue(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	id := s.signer.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("published writes"))
+	for _, rule := range []string{"spawn:" + ContractWriteID,
+		"invoke:" + ContractWriteID + ".update",
+		"spawn:" + contracts.ContractValueID,
+		"invoke:" + contracts.ContractValueID + ".update"} {
+		d.Rules.AddRule(darc.Action(rule), expression.InitOrExpr(id.String()))
+	}
+	ctr, err := s.cl.GetSignerCounters(id.String())
+	require.NoError(t, err)
+	next := ctr.Counters[0] + 1
+	_, err = calypsoClient.SpawnDarc(s.signer, next, *s.gDarc, *d, 10)
+	require.NoError(t, err)
+
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, []byte("secret key"))
+	write.Label = "contract"
+	wr, valueID, err := calypsoClient.AddWriteWithValue(write, s.signer,
+		next+1, *d, 10)
+	require.NoError(t, err)
+	ref, proof, err := calypsoClient.GetWriteReference(valueID)
+	require.NoError(t, err)
+	require.True(t, ref.WriteID.Equal(wr.InstanceID))
+	require.Equal(t, "contract", ref.Label)
+	require.NoError(t, proof.VerifyFromBlock(s.gbReply.Skipblock))
+	_, _, err = calypsoClient.GetWrite(ref.WriteID)
+	require.NoError(t, err)
+
+	update := NewWrite(cothority.Suite, s.ltsReply.InstanceID, d.GetBaseID(),
+		s.ltsReply.X, []byte("secret key 2"))
+	update.Label = "contract v2"
+	wr2, err := calypsoClient.UpdateWriteWithValue(wr.InstanceID, update,
+		valueID, s.signer, next+3, 10)
+	require.NoError(t, err)
+	ref, _, err = calypsoClient.GetWriteReference(valueID)
+	require.NoError(t, err)
+	require.True(t, ref.WriteID.Equal(wr2.InstanceID))
+	require.True(t, ref.Previous.Equal(wr.InstanceID))
+	require.Equal(t, "contract v2", ref.Label)
+
+	_, _, err = calypsoClient.GetWriteReference(wr.InstanceID)
+	require.Error(t, err)
+}
+
+// TestClient_Document uploads, shares, revokes and fetches a document.
+func TestClient_Document(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	bob := darc.NewSignerEd25519(nil, nil)
+	eve := darc.NewSignerEd25519(nil, nil)
+	content := bytes.Repeat([]byte("document"), 10000)
+	doc := calypsoClient.NewDocument(bytes.NewReader(content), bob.Identity())
+	doc.Label = "report"
+	doc.Metadata = &DocumentMetadata{Filename: "report.txt"}
+	var encrypted bytes.Buffer
+	require.NoError(t, doc.Upload(s.ltsReply, *s.gDarc, s.signer, &encrypted))
+	require.Error(t, doc.Upload(s.ltsReply, *s.gDarc, s.signer, &encrypted))
+
+	fetch := func(reader darc.Signer) ([]byte, *DocumentMetadata, error) {
+		var out bytes.Buffer
+		md, err := doc.Fetch(reader, bytes.NewReader(encrypted.Bytes()), &out)
+		return out.Bytes(), md, err
+	}
+	plain, md, err := fetch(bob)
+	require.NoError(t, err)
+	require.Equal(t, content, plain)
+	require.Equal(t, "report.txt", md.Filename)
+	_, _, err = fetch(eve)
+	require.Error(t, err)
+
+	require.NoError(t, doc.Share(s.signer, eve.Identity()))
+	require.Error(t, doc.Share(s.signer, eve.Identity()))
+	_, _, err = fetch(eve)
+	require.NoError(t, err)
+	require.NoError(t, doc.Revoke(s.signer, bob.Identity()))
+	_, _, err = fetch(bob)
+	require.Error(t, err)
+
+	versions, err := doc.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []byzcoin.InstanceID{doc.ID}, versions)
+}
+
+// TestClient_DocumentReadWindow makes sure that the readers of a document
+// can only read it in its read window.
+func TestClient_DocumentReadWindow(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	bob := darc.NewSignerEd25519(nil, nil)
+	content := []byte("office hours only")
+	upload := func(tw byzcoin.TimeWindow) (*Document, []byte) {
+		doc := calypsoClient.NewDocument(bytes.NewReader(content), bob.Identity())
+		doc.ReadWindow = &tw
+		var encrypted bytes.Buffer
+		require.NoError(t, doc.Upload(s.ltsReply, *s.gDarc, s.signer, &encrypted))
+		return doc, encrypted.Bytes()
+	}
+	fetch := func(doc *Document, encrypted []byte, reader darc.Signer) error {
+		var out bytes.Buffer
+		_, err := doc.Fetch(reader, bytes.NewReader(encrypted), &out)
+		return err
+	}
+
+	later, encrypted := upload(byzcoin.TimeWindow{After: time.Now().Add(time.Hour)})
+	require.Error(t, fetch(later, encrypted, bob))
+	require.NoError(t, fetch(later, encrypted, s.signer))
+
+	now, encrypted := upload(byzcoin.TimeWindow{Before: time.Now().Add(time.Hour)})
+	require.NoError(t, fetch(now, encrypted, bob))
+}
+
+// TestClient_ShareLink creates a share link with a bearer key and makes sure
+// only the recipient can get the key back.
+func TestClient_ShareLink(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	bcID := skipchain.SkipBlockID(bytes.Repeat([]byte{1}, 32))
+	c := NewClient(byzcoin.NewClient(bcID, *roster))
+	writeID := byzcoin.NewInstanceID([]byte("write"))
+	bearer := darc.NewSignerEd25519(nil, nil)
+	recipient := darc.NewSignerEd25519(nil, nil)
+
+	link, err := c.CreateShareLink(writeID, &bearer,
+		recipient.Ed25519.Point)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(link, ShareLinkPrefix))
+	sl, err := c.ParseShareLink(link)
+	require.NoError(t, err)
+	require.Equal(t, roster.List[0].Address, sl.Address)
+	require.True(t, sl.ByzCoinID.Equal(bcID))
+	require.Equal(t, writeID, sl.WriteID)
+
+	signer, err := sl.Signer(recipient.Ed25519.Secret)
+	require.NoError(t, err)
+	id := bearer.Identity()
+	require.True(t, signer.Identity().Equal(&id))
+	_, err = sl.Signer(cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream()))
+	require.Error(t, err)
+
+	cl, err := sl.NewClient()
+	require.Error(t, err, "the chain doesn't exist")
+	require.Nil(t, cl)
+
+	link, err = c.CreateShareLink(writeID, nil, nil)
+	require.NoError(t, err)
+	sl, err = ParseShareLink(link)
+	require.NoError(t, err)
+	_, err = sl.Signer(recipient.Ed25519.Secret)
+	require.Error(t, err)
+
+	other := NewClient(byzcoin.NewClient(skipchain.SkipBlockID("other"), *roster))
+	_, err = other.ParseShareLink(link)
+	require.Error(t, err)
+	_, err = ParseShareLink("calypso:!!")
+	require.Error(t, err)
+	_, err = ParseShareLink(link[len(ShareLinkPrefix):])
+	require.Error(t, err)
+}
+
+func TestClient_SeparateRosters(t *testing.T) {
+	s := newTSWithExtras(t, 4, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	trustees := onet.NewRoster(s.allRoster.List[4:])
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	ltsReply, err := calypsoClient.CreateLTS(trustees, s.gDarc.GetBaseID(),
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	for _, svc := range s.services[:4] {
+		require.Nil(t, svc.storage.Shared[ltsReply.InstanceID])
+	}
+	roster, err := calypsoClient.LTSRoster(ltsReply.InstanceID)
+	require.NoError(t, err)
+	require.True(t, roster.List[0].Equal(trustees.List[0]))
+
+	key1 := []byte("secret key 1")
+	write := NewWrite(cothority.Suite, ltsReply.InstanceID, s.gDarc.GetBaseID(),
+		ltsReply.X, key1)
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2, *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+}
+
+// TestClient_TwoLTS encrypts the key of a write for two LTSs, and decrypts it
+// with each of them.
+func TestClient_TwoLTS(t *testing.T) {
+	s := newTSWithExtras(t, 4, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	trustees := onet.NewRoster(s.allRoster.List[4:])
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	ltsReply, err := calypsoClient.CreateLTS(trustees, s.gDarc.GetBaseID(),
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+
+	key := []byte("secret key")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, key)
+	require.NoError(t, write.AddLTS(cothority.Suite, ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), ltsReply.X, key))
+	require.Error(t, write.AddLTS(cothority.Suite, ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), ltsReply.X, key))
+	require.NoError(t, write.CheckProof(cothority.Suite, s.gDarc.GetBaseID()))
+	require.Equal(t, []byzcoin.InstanceID{s.ltsReply.InstanceID,
+		ltsReply.InstanceID}, write.LTSIDs())
+
+	// A wrong alternative is refused.
+	wrong := *write
+	wrong.Alternatives = []WriteKey{write.Alternatives[0]}
+	wrong.Alternatives[0].C = cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	require.Error(t, wrong.CheckProof(cothority.Suite, s.gDarc.GetBaseID()))
+
+	wr, err := calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+2, *s.gDarc, 10)
+	require.NoError(t, err)
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	// Without LTSID, the first LTS is used.
+	for _, lts := range []struct {
+		id *byzcoin.InstanceID
+		X  kyber.Point
+	}{{nil, s.ltsReply.X}, {&ltsReply.InstanceID, ltsReply.X}} {
+		dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+		dkr.LTSID = lts.id
+		dk, err := calypsoClient.DecryptKey(dkr)
+		require.NoError(t, err)
+		require.True(t, dk.X.Equal(lts.X))
+		keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, key, keyCopy)
+	}
+}
+
+// TestClient_RSAReader wraps the key of a write for an RSA reader, which is
+// only accepted for an LTS allowing it.
+func TestClient_RSAReader(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	sk, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	require.NoError(t, err)
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+
+	key := []byte("secret key")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, key)
+	require.NoError(t, write.AddRSAReader(&sk.PublicKey, key))
+	require.Error(t, write.AddRSAReader(&sk.PublicKey, key))
+	_, err = calypsoClient.AddWrite(write, s.signer, next+1, *s.gDarc, 10)
+	require.Error(t, err)
+
+	ltsReply, err := calypsoClient.CreateLTSWithRSAWrapping(s.ltsRoster,
+		s.gDarc.GetBaseID(), []darc.Signer{s.signer}, []uint64{next + 1})
+	require.NoError(t, err)
+	write = NewWrite(cothority.Suite, ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), ltsReply.X, key)
+	require.NoError(t, write.AddRSAReader(&sk.PublicKey, key))
+	wr, err := calypsoClient.AddWrite(write, s.signer, next+2, *s.gDarc, 10)
+	require.NoError(t, err)
+
+	prWr, err := calypsoClient.WaitProof(wr.InstanceID, time.Second, nil)
+	require.NoError(t, err)
+	var stored Write
+	require.NoError(t, prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &stored))
+	keyCopy, err := stored.RecoverKeyRSA(sk)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
+
+	other, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	require.NoError(t, err)
+	_, err = stored.RecoverKeyRSA(other)
+	require.Error(t, err)
+}
+
+// TestExportChain exports the chain and verifies the export offline.
+func TestExportChain(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+	_, err = calypsoClient.AddWrite(write, s.signer, ctr.Counters[0]+1, *s.gDarc, 10)
+	require.NoError(t, err)
+
+	export, err := ExportChain(s.byzRoster, s.cl.ID)
+	require.NoError(t, err)
+	require.True(t, len(export.Blocks) > 1)
+	buf, err := export.Marshal()
+	require.NoError(t, err)
+	again, err := export.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, buf, again)
+
+	_, blocks, err := VerifyChainExport(buf, s.cl.ID)
+	require.NoError(t, err)
+	require.Equal(t, len(export.Blocks), len(blocks))
+	_, _, err = VerifyChainExport(buf, skipchain.SkipBlockID(s.gDarc.GetBaseID()))
+	require.Error(t, err)
+
+	// Changing the transactions of a block must be detected.
+	last := &export.Blocks[len(export.Blocks)-1]
+	last.Payload = last.Payload[:len(last.Payload)-2]
+	buf, err = export.Marshal()
+	require.NoError(t, err)
+	_, _, err = VerifyChainExport(buf, s.cl.ID)
+	require.Error(t, err)
+}
+
+// TestClient_RemoveNode removes a node from the chain after resharing its
+// LTS to the other nodes.
+func TestClient_RemoveNode(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	key := []byte("secret key")
+	prWr := s.addWriteAndWait(t, key)
+	sec := s.reconstructKey(t)
+
+	leaving := s.services[3].ServerIdentity()
+	// A resharing refused by the chain keeps the node in the roster of the
+	// chain.
+	stranger := darc.NewSignerEd25519(nil, nil)
+	reshared, err := calypsoClient.RemoveNode(leaving,
+		[]darc.Signer{stranger}, []uint64{1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is kept in the roster of the chain")
+	require.Empty(t, reshared)
+	config, err := s.cl.GetChainConfig()
+	require.NoError(t, err)
+	require.Equal(t, 4, len(config.Roster.List))
+	ltsRoster, err := calypsoClient.LTSRoster(s.ltsReply.InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(ltsRoster.List))
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Add(3)
+	s.afterReshare(func() { wg.Done() })
+	reshared, err = calypsoClient.RemoveNode(leaving, []darc.Signer{s.signer},
+		[]uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	require.Equal(t, []byzcoin.InstanceID{s.ltsReply.InstanceID}, reshared)
+	wg.Wait()
+
+	s.ltsRoster, err = calypsoClient.LTSRoster(s.ltsReply.InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(s.ltsRoster.List))
+	require.True(t, s.reconstructKey(t).Equal(sec))
+	config, err = s.cl.GetChainConfig()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(config.Roster.List))
+	i, _ := config.Roster.Search(leaving.ID)
+	require.Equal(t, -1, i)
+
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dk, err := calypsoClient.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
+
+	// Another node would leave the LTS below its threshold.
+	ctr, err = s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	_, err = calypsoClient.RemoveNode(s.services[2].ServerIdentity(),
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "its threshold is 3")
+	config, err = s.cl.GetChainConfig()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(config.Roster.List))
+}
+
+// TestClient_ReshareLTS reshares the LTS to fewer nodes and back, and checks
+// the history of the reshares stored in the LTS instance.
+func TestClient_ReshareLTS(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	sec := s.reconstructKey(t)
+	full := s.ltsRoster
+	info, proof, err := calypsoClient.GetLTS(s.ltsReply.InstanceID)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(info.Reshares))
+	require.NoError(t, proof.VerifyFromBlock(s.gbReply.Skipblock))
+
+	for i, roster := range []*onet.Roster{onet.NewRoster(full.List[:3]), full} {
+		ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		wg.Add(len(roster.List))
+		s.afterReshare(func() { wg.Done() })
+		require.NoError(t, calypsoClient.ReshareLTS(s.ltsReply.InstanceID,
+			roster, []darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1}))
+		wg.Wait()
+
+		info, _, err = calypsoClient.GetLTS(s.ltsReply.InstanceID)
+		require.NoError(t, err)
+		require.Equal(t, len(roster.List), len(info.Roster.List))
+		require.Equal(t, i+1, len(info.Reshares))
+		require.True(t, info.Reshares[i].BlockIndex > 0)
+		s.ltsRoster = roster
+		require.True(t, s.reconstructKey(t).Equal(sec))
+	}
+	require.Equal(t, 4, len(info.Reshares[0].Roster.List))
+	require.Equal(t, 3, len(info.Reshares[1].Roster.List))
+}
+
+// TestClient_BlockCache checks that the blocks are fetched once and kept on
+// disk, and that the latest block is refreshed from the cache.
+func TestClient_BlockCache(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	dir, err := ioutil.TempDir("", "blockcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache, err := NewBlockCache(dir)
+	require.NoError(t, err)
+	calypsoClient := NewClient(byzcoin.NewClient(s.cl.ID, s.cl.Roster))
+	calypsoClient.SetBlockCache(cache)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	_, _, err = calypsoClient.GetWrite(writeID)
+	require.NoError(t, err)
+	require.NotNil(t, cache.Get(s.cl.ID))
+
+	latest, err := calypsoClient.LatestBlock()
+	require.NoError(t, err)
+	require.True(t, latest.Index > 0)
+	require.True(t, cache.Latest(s.cl.ID).Hash.Equal(latest.Hash))
+
+	// A new cache on the same directory starts at the latest block.
+	cache, err = NewBlockCache(dir)
+	require.NoError(t, err)
+	require.True(t, cache.Latest(s.cl.ID).Hash.Equal(latest.Hash))
+	calypsoClient.SetBlockCache(cache)
+	s.addWriteAndWait(t, []byte("secret key 2"))
+	newer, err := calypsoClient.LatestBlock()
+	require.NoError(t, err)
+	require.True(t, newer.Index > latest.Index)
+
+	// A corrupted block is dropped.
+	cache, err = NewBlockCache(dir)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cache.path("block", s.cl.ID),
+		[]byte("corrupted"), 0600))
+	require.Nil(t, cache.Get(s.cl.ID))
+	bad := latest.Copy()
+	bad.Index++
+	require.Error(t, cache.Add(bad))
+}
+
+// newTestReply encrypts key for a random LTS and returns the reply that the
+// LTS would send to the reader xc, without running the OCS protocol.
+func newTestReply(key []byte, xc kyber.Scalar) (*WriteKey, *DecryptKeyReply) {
+	suite := cothority.Suite
+	x := suite.Scalar().Pick(suite.RandomStream())
+	X := suite.Point().Mul(x, nil)
+	wk := newWriteKey(suite, byzcoin.NewInstanceID([]byte("lts")),
+		darc.ID("darc"), X, key)
+	Xc := suite.Point().Mul(xc, nil)
+	XhatEnc := suite.Point().Mul(x, suite.Point().Add(wk.U, Xc))
+	return wk, &DecryptKeyReply{C: wk.C, XhatEnc: XhatEnc, X: X}
+}
+
+func TestDecryptKeyReply_RecoverKey(t *testing.T) {
+	xc := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	key := []byte("secret key")
+	wk, reply := newTestReply(key, xc)
+	require.NoError(t, wk.CheckProof(cothority.Suite, darc.ID("darc")))
+	X := reply.X.Clone()
+	keyCopy, err := reply.RecoverKey(xc)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
+	require.True(t, X.Equal(reply.X))
+
+	require.Nil(t, newWriteKey(cothority.Suite, byzcoin.InstanceID{},
+		darc.ID("darc"), X, make([]byte, X.EmbedLen()+1)))
+}
+
+// benchKeyLengths returns the key lengths used by the benchmarks. A write
+// embeds its key in the single point C, so they go up to the EmbedLen of the
+// suite.
+func benchKeyLengths() []int {
+	return []int{1, 8, 16, cothority.Suite.Point().EmbedLen()}
+}
+
+func BenchmarkNewWriteKey(b *testing.B) {
+	X := cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	ltsID := byzcoin.NewInstanceID([]byte("lts"))
+	for _, l := range benchKeyLengths() {
+		key := make([]byte, l)
+		b.Run(fmt.Sprintf("key=%dB", l), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newWriteKey(cothority.Suite, ltsID, darc.ID("darc"), X, key)
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptKeyReply_RecoverKey(b *testing.B) {
+	xc := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	for _, l := range benchKeyLengths() {
+		_, reply := newTestReply(make([]byte, l), xc)
+		b.Run(fmt.Sprintf("key=%dB", l), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := reply.RecoverKey(xc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package calypso
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+	uuid "gopkg.in/satori/go.uuid.v1"
+)
+
+// A chain can be exported as JSON for auditors who don't run a conode. The
+// export holds every block from the genesis block to the latest one, with
+// all the fields covered by the hash of the block, its payload and its
+// forward links with their signatures. All binary values are hex encoded
+// and the fields are always written in the same order, so that exporting
+// the same blocks twice gives the same bytes.
+//
+// VerifyChainExport only needs the export and the ID of the chain: it
+// recomputes the hash of every block, checks that every block links back to
+// the previous one and is linked to by a forward link signed by the roster
+// of the previous one, and that the transactions of every block match its
+// header.
+
+// ChainExport is the JSON representation of a chain.
+type ChainExport struct {
+	ChainID string        `json:"chain_id"`
+	Blocks  []ExportBlock `json:"blocks"`
+}
+
+// ExportBlock is the JSON representation of a block.
+type ExportBlock struct {
+	Hash            string       `json:"hash"`
+	Index           int          `json:"index"`
+	Height          int          `json:"height"`
+	MaximumHeight   int          `json:"maximum_height"`
+	BaseHeight      int          `json:"base_height"`
+	BackLinks       []string     `json:"back_links"`
+	Verifiers       []string     `json:"verifiers"`
+	GenesisID       string       `json:"genesis_id"`
+	Data            string       `json:"data"`
+	Roster          ExportRoster `json:"roster"`
+	SignatureScheme uint32       `json:"signature_scheme"`
+	Payload         string       `json:"payload"`
+	ForwardLinks    []ExportLink `json:"forward_links"`
+}
+
+// ExportRoster is the JSON representation of a roster. Public is the key
+// the hash of the block is computed with, SkipchainPublic the key the
+// forward links are signed with.
+type ExportRoster struct {
+	ID    string       `json:"id"`
+	Nodes []ExportNode `json:"nodes"`
+}
+
+// ExportNode is a node of an ExportRoster.
+type ExportNode struct {
+	Address         string `json:"address"`
+	Public          string `json:"public"`
+	SkipchainPublic string `json:"skipchain_public"`
+}
+
+// ExportLink is the JSON representation of a forward link. From and To are
+// empty for the placeholders of the higher forward links.
+type ExportLink struct {
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	NewRoster *ExportRoster `json:"new_roster,omitempty"`
+	Message   string        `json:"message"`
+	Signature string        `json:"signature"`
+}
+
+// ExportChain fetches all blocks of the chain from the roster, which can be
+// any node holding the chain, following the forward links from the genesis
+// block, and returns their export. The
+// blocks are checked with VerifyChainExport before they are returned.
+func ExportChain(roster *onet.Roster, chainID skipchain.SkipBlockID) (*ChainExport, error) {
+	cl := skipchain.NewClient()
+	var blocks []*skipchain.SkipBlock
+	id := chainID
+	for {
+		sb, err := cl.GetSingleBlock(roster, id)
+		if err != nil {
+			return nil, xerrors.Errorf("getting block %x: %v", id, err)
+		}
+		blocks = append(blocks, sb)
+		if len(sb.ForwardLink) == 0 {
+			break
+		}
+		id = sb.ForwardLink[0].To
+	}
+	export, err := NewChainExport(blocks)
+	if err != nil {
+		return nil, err
+	}
+	if err := export.verify(chainID); err != nil {
+		return nil, xerrors.Errorf("verifying blocks: %v", err)
+	}
+	return export, nil
+}
+
+// NewChainExport returns the export of the blocks, which must start with
+// the genesis block.
+func NewChainExport(blocks []*skipchain.SkipBlock) (*ChainExport, error) {
+	if len(blocks) == 0 || blocks[0].Index != 0 {
+		return nil, xerrors.New("blocks must start with the genesis block")
+	}
+	export := &ChainExport{ChainID: hex.EncodeToString(blocks[0].Hash)}
+	for _, sb := range blocks {
+		eb, err := newExportBlock(sb)
+		if err != nil {
+			return nil, xerrors.Errorf("exporting block %d: %v", sb.Index, err)
+		}
+		export.Blocks = append(export.Blocks, *eb)
+	}
+	return export, nil
+}
+
+// Marshal returns the canonical JSON of the export.
+func (e *ChainExport) Marshal() ([]byte, error) {
+	buf, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, xerrors.Errorf("encoding export: %v", err)
+	}
+	return append(buf, '\n'), nil
+}
+
+// VerifyChainExport decodes the JSON export and verifies it against the ID
+// of the chain, without contacting any node. It returns the export and the
+// blocks it holds.
+func VerifyChainExport(buf []byte, chainID skipchain.SkipBlockID) (*ChainExport,
+	[]*skipchain.SkipBlock, error) {
+	var export ChainExport
+	if err := json.Unmarshal(buf, &export); err != nil {
+		return nil, nil, xerrors.Errorf("decoding export: %v", err)
+	}
+	if err := export.verify(chainID); err != nil {
+		return nil, nil, err
+	}
+	blocks, err := export.SkipBlocks()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &export, blocks, nil
+}
+
+// SkipBlocks returns the blocks of the export. They are not verified.
+func (e *ChainExport) SkipBlocks() ([]*skipchain.SkipBlock, error) {
+	blocks := make([]*skipchain.SkipBlock, len(e.Blocks))
+	for i := range e.Blocks {
+		sb, err := e.Blocks[i].skipBlock()
+		if err != nil {
+			return nil, xerrors.Errorf("decoding block %d: %v", i, err)
+		}
+		blocks[i] = sb
+	}
+	return blocks, nil
+}
+
+// verify checks the hashes, the back links, the forward links and the
+// transactions of the blocks of the export.
+func (e *ChainExport) verify(chainID skipchain.SkipBlockID) error {
+	if e.ChainID != hex.EncodeToString(chainID) {
+		return xerrors.New("export is for another chain")
+	}
+	blocks, err := e.SkipBlocks()
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return xerrors.New("export has no blocks")
+	}
+	byHash := make(map[string]*skipchain.SkipBlock)
+	for i, sb := range blocks {
+		if sb.Index != i {
+			return xerrors.Errorf("block %d has index %d", i, sb.Index)
+		}
+		if !sb.CalculateHash().Equal(sb.Hash) {
+			return xerrors.Errorf("block %d doesn't match its hash", i)
+		}
+		if i == 0 {
+			if !sb.Hash.Equal(chainID) {
+				return xerrors.New("first block is not the genesis block of the chain")
+			}
+		} else {
+			if !sb.GenesisID.Equal(chainID) {
+				return xerrors.Errorf("block %d is from another chain", i)
+			}
+			if len(sb.BackLinkIDs) == 0 ||
+				!sb.BackLinkIDs[0].Equal(blocks[i-1].Hash) {
+				return xerrors.Errorf("block %d doesn't link back to block %d", i, i-1)
+			}
+		}
+		if err := verifyBlockPayload(sb); err != nil {
+			return xerrors.Errorf("block %d: %v", i, err)
+		}
+		byHash[string(sb.Hash)] = sb
+	}
+
+	suite := pairing.NewSuiteBn256()
+	for i, sb := range blocks {
+		if sb.Roster == nil {
+			return xerrors.Errorf("block %d has no roster", i)
+		}
+		publics := sb.Roster.ServicePublics(skipchain.ServiceName)
+		for level, fl := range sb.ForwardLink {
+			if fl.IsEmpty() {
+				continue
+			}
+			if !fl.From.Equal(sb.Hash) {
+				return xerrors.Errorf("forward link %d of block %d starts at another block",
+					level, i)
+			}
+			err := fl.VerifyWithScheme(suite, publics, sb.SignatureScheme)
+			if err != nil {
+				return xerrors.Errorf("forward link %d of block %d: %v", level, i, err)
+			}
+			// A link can point past the latest block if it has been added
+			// while the chain was exported.
+			to := byHash[string(fl.To)]
+			if to != nil && fl.NewRoster != nil && !samePublics(fl.NewRoster, to.Roster) {
+				return xerrors.Errorf("forward link %d of block %d has another roster than its target",
+					level, i)
+			}
+		}
+		if i < len(blocks)-1 {
+			if len(sb.ForwardLink) == 0 || !sb.ForwardLink[0].To.Equal(blocks[i+1].Hash) {
+				return xerrors.Errorf("block %d is not linked to block %d", i, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyBlockPayload checks that the transactions in the payload of a
+// ByzCoin block match the hash in its header.
+func verifyBlockPayload(sb *skipchain.SkipBlock) error {
+	if len(sb.Payload) == 0 {
+		return nil
+	}
+	var header byzcoin.DataHeader
+	if err := protobuf.Decode(sb.Data, &header); err != nil {
+		return xerrors.Errorf("decoding header: %v", err)
+	}
+	var body byzcoin.DataBody
+	if err := protobuf.Decode(sb.Payload, &body); err != nil {
+		return xerrors.Errorf("decoding payload: %v", err)
+	}
+	body.TxResults.SetVersion(header.Version)
+	if !bytes.Equal(header.ClientTransactionHash, body.TxResults.Hash()) {
+		return xerrors.New("transactions don't match the header")
+	}
+	return nil
+}
+
+// samePublics returns true if both rosters have the same keys, in the same
+// order.
+func samePublics(a, b *onet.Roster) bool {
+	if a == nil || b == nil || len(a.List) != len(b.List) {
+		return false
+	}
+	for i := range a.List {
+		if !a.List[i].Public.Equal(b.List[i].Public) {
+			return false
+		}
+	}
+	return true
+}
+
+func newExportBlock(sb *skipchain.SkipBlock) (*ExportBlock, error) {
+	if sb.Roster == nil {
+		return nil, xerrors.New("block has no roster")
+	}
+	roster, err := newExportRoster(sb.Roster)
+	if err != nil {
+		return nil, err
+	}
+	eb := &ExportBlock{
+		Hash:            hex.EncodeToString(sb.Hash),
+		Index:           sb.Index,
+		Height:          sb.Height,
+		MaximumHeight:   sb.MaximumHeight,
+		BaseHeight:      sb.BaseHeight,
+		BackLinks:       []string{},
+		Verifiers:       []string{},
+		GenesisID:       hex.EncodeToString(sb.GenesisID),
+		Data:            hex.EncodeToString(sb.Data),
+		Roster:          *roster,
+		SignatureScheme: sb.SignatureScheme,
+		Payload:         hex.EncodeToString(sb.Payload),
+		ForwardLinks:    []ExportLink{},
+	}
+	for _, bl := range sb.BackLinkIDs {
+		eb.BackLinks = append(eb.BackLinks, hex.EncodeToString(bl))
+	}
+	for _, v := range sb.VerifierIDs {
+		eb.Verifiers = append(eb.Verifiers, v.String())
+	}
+	for _, fl := range sb.ForwardLink {
+		el := ExportLink{
+			From:      hex.EncodeToString(fl.From),
+			To:        hex.EncodeToString(fl.To),
+			Message:   hex.EncodeToString(fl.Signature.Msg),
+			Signature: hex.EncodeToString(fl.Signature.Sig),
+		}
+		if fl.NewRoster != nil {
+			el.NewRoster, err = newExportRoster(fl.NewRoster)
+			if err != nil {
+				return nil, err
+			}
+		}
+		eb.ForwardLinks = append(eb.ForwardLinks, el)
+	}
+	return eb, nil
+}
+
+func (eb *ExportBlock) skipBlock() (*skipchain.SkipBlock, error) {
+	sb := skipchain.NewSkipBlock()
+	sb.Index = eb.Index
+	sb.Height = eb.Height
+	sb.MaximumHeight = eb.MaximumHeight
+	sb.BaseHeight = eb.BaseHeight
+	sb.SignatureScheme = eb.SignatureScheme
+	var err error
+	if sb.Hash, err = hex.DecodeString(eb.Hash); err != nil {
+		return nil, xerrors.Errorf("decoding hash: %v", err)
+	}
+	if sb.GenesisID, err = hex.DecodeString(eb.GenesisID); err != nil {
+		return nil, xerrors.Errorf("decoding genesis ID: %v", err)
+	}
+	if sb.Data, err = hex.DecodeString(eb.Data); err != nil {
+		return nil, xerrors.Errorf("decoding data: %v", err)
+	}
+	if sb.Payload, err = hex.DecodeString(eb.Payload); err != nil {
+		return nil, xerrors.Errorf("decoding payload: %v", err)
+	}
+	if len(sb.GenesisID) == 0 {
+		sb.GenesisID = nil
+	}
+	if len(sb.Payload) == 0 {
+		sb.Payload = nil
+	}
+	for _, bl := range eb.BackLinks {
+		id, err := hex.DecodeString(bl)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding back link: %v", err)
+		}
+		sb.BackLinkIDs = append(sb.BackLinkIDs, id)
+	}
+	for _, v := range eb.Verifiers {
+		id, err := uuid.FromString(v)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding verifier: %v", err)
+		}
+		sb.VerifierIDs = append(sb.VerifierIDs, skipchain.VerifierID(id))
+	}
+	if sb.Roster, err = eb.Roster.roster(); err != nil {
+		return nil, err
+	}
+	for _, el := range eb.ForwardLinks {
+		fl := &skipchain.ForwardLink{}
+		if fl.From, err = hex.DecodeString(el.From); err != nil {
+			return nil, xerrors.Errorf("decoding forward link: %v", err)
+		}
+		if fl.To, err = hex.DecodeString(el.To); err != nil {
+			return nil, xerrors.Errorf("decoding forward link: %v", err)
+		}
+		if fl.Signature.Msg, err = hex.DecodeString(el.Message); err != nil {
+			return nil, xerrors.Errorf("decoding forward link: %v", err)
+		}
+		if fl.Signature.Sig, err = hex.DecodeString(el.Signature); err != nil {
+			return nil, xerrors.Errorf("decoding forward link: %v", err)
+		}
+		if el.NewRoster != nil {
+			if fl.NewRoster, err = el.NewRoster.roster(); err != nil {
+				return nil, err
+			}
+		}
+		sb.ForwardLink = append(sb.ForwardLink, fl)
+	}
+	return sb, nil
+}
+
+func newExportRoster(ro *onet.Roster) (*ExportRoster, error) {
+	er := &ExportRoster{ID: uuid.UUID(ro.ID).String(), Nodes: []ExportNode{}}
+	for _, si := range ro.List {
+		pub, err := si.Public.MarshalBinary()
+		if err != nil {
+			return nil, xerrors.Errorf("encoding key: %v", err)
+		}
+		scPub, err := si.ServicePublic(skipchain.ServiceName).MarshalBinary()
+		if err != nil {
+			return nil, xerrors.Errorf("encoding key: %v", err)
+		}
+		er.Nodes = append(er.Nodes, ExportNode{
+			Address:         string(si.Address),
+			Public:          hex.EncodeToString(pub),
+			SkipchainPublic: hex.EncodeToString(scPub),
+		})
+	}
+	return er, nil
+}
+
+func (er *ExportRoster) roster() (*onet.Roster, error) {
+	id, err := uuid.FromString(er.ID)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding roster ID: %v", err)
+	}
+	if len(er.Nodes) == 0 {
+		return nil, xerrors.New("empty roster")
+	}
+	suite := pairing.NewSuiteBn256()
+	var list []*network.ServerIdentity
+	for _, n := range er.Nodes {
+		pub, err := decodeExportPoint(cothority.Suite.Point(), n.Public)
+		if err != nil {
+			return nil, err
+		}
+		scPub, err := decodeExportPoint(suite.G2().Point(), n.SkipchainPublic)
+		if err != nil {
+			return nil, err
+		}
+		si := network.NewServerIdentity(pub, network.Address(n.Address))
+		si.ServiceIdentities = []network.ServiceIdentity{{
+			Name:   skipchain.ServiceName,
+			Public: scPub,
+		}}
+		list = append(list, si)
+	}
+	ro := onet.NewRoster(list)
+	if ro == nil {
+		return nil, xerrors.New("invalid roster")
+	}
+	ro.ID = onet.RosterID(id)
+	return ro, nil
+}
+
+func decodeExportPoint(p kyber.Point, s string) (kyber.Point, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding key: %v", err)
+	}
+	if err := p.UnmarshalBinary(buf); err != nil {
+		return nil, xerrors.Errorf("decoding key: %v", err)
+	}
+	return p, nil
+}
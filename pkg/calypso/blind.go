@@ -0,0 +1,97 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"golang.org/x/xerrors"
+)
+
+// The key a secret is re-encrypted to is stored in clear in the read, so
+// anyone with a copy of the chain can see who read which document, even if
+// the read is signed anonymously. A blinded read only holds a commitment to
+// the key. The reader opens it in the DecryptKey request, which is only
+// seen by the trustees of the LTS: the opening holds the key, the blinding
+// factor of the commitment, and a schnorr signature on the commitment,
+// which proves that the reader holds the private key.
+
+// blindingLength is the length of the blinding factor of a commitment.
+const blindingLength = 32
+
+// readCommitment returns the commitment to the key xc.
+func readCommitment(xc kyber.Point, blinding []byte) ([]byte, error) {
+	buf, err := xc.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling key: %v", err)
+	}
+	h := sha256.New()
+	h.Write([]byte("calypso-blinded-read"))
+	h.Write(buf)
+	h.Write(blinding)
+	return h.Sum(nil), nil
+}
+
+// NewBlindedRead returns a read of the write with a commitment to the public
+// key of xc, and the opening to send with the DecryptKey request.
+func NewBlindedRead(writeID byzcoin.InstanceID, xc kyber.Scalar) (*Read, *ReadOpening, error) {
+	op := &ReadOpening{
+		Xc:       cothority.Suite.Point().Mul(xc, nil),
+		Blinding: make([]byte, blindingLength),
+	}
+	if _, err := rand.Read(op.Blinding); err != nil {
+		return nil, nil, xerrors.Errorf("creating blinding: %v", err)
+	}
+	commitment, err := readCommitment(op.Xc, op.Blinding)
+	if err != nil {
+		return nil, nil, err
+	}
+	op.Signature, err = schnorr.Sign(cothority.Suite, xc, commitment)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("signing commitment: %v", err)
+	}
+	return &Read{Write: writeID, Commitment: commitment}, op, nil
+}
+
+// blinded returns true if the read holds a commitment instead of the key.
+func (rd *Read) blinded() bool {
+	return len(rd.Commitment) > 0
+}
+
+// open checks the opening of a blinded read and sets the key of the read.
+// Reads that are not blinded are left as they are.
+func (rd *Read) open(op *ReadOpening) error {
+	if !rd.blinded() {
+		return nil
+	}
+	if op == nil || op.Xc == nil {
+		return xerrors.New("blinded read needs an opening")
+	}
+	commitment, err := readCommitment(op.Xc, op.Blinding)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(commitment, rd.Commitment) {
+		return xerrors.New("opening doesn't match the commitment")
+	}
+	err = schnorr.Verify(cothority.Suite, op.Xc, rd.Commitment, op.Signature)
+	if err != nil {
+		return xerrors.Errorf("verifying opening: %v", err)
+	}
+	rd.Xc = op.Xc
+	return nil
+}
+
+// identity returns the identity of the reader recorded in the events. For a
+// blinded read, it is the commitment, so the key isn't leaked.
+func (rd *Read) identity() string {
+	if rd.blinded() {
+		return "blinded:" + hex.EncodeToString(rd.Commitment)
+	}
+	return rd.Xc.String()
+}
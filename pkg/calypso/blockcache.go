@@ -0,0 +1,249 @@
+package calypso
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A client verifying proofs needs the genesis block of the chain, and the
+// latest block to follow the chain. Instead of fetching them for every
+// call, the client can keep the blocks in a BlockCache, in memory and
+// optionally on disk. A block is only added to the cache after checking its
+// hash, so a cached block is always the block with its ID. The latest block
+// of a chain is refreshed with LatestBlock, which only checks the forward
+// links after the latest cached block.
+
+// BlockCache holds the blocks verified by the clients using it, indexed by
+// their hash, and the latest verified block of every chain.
+type BlockCache struct {
+	sync.Mutex
+	blocks map[string]*skipchain.SkipBlock
+	latest map[string]skipchain.SkipBlockID
+	// dir is the directory the blocks are stored in. If it is empty, the
+	// blocks are only kept in memory.
+	dir string
+}
+
+// NewBlockCache returns a block cache storing its blocks in dir, which is
+// created if needed. If dir is empty, the blocks are only kept in memory.
+func NewBlockCache(dir string) (*BlockCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, xerrors.Errorf("creating cache directory: %v", err)
+		}
+	}
+	return &BlockCache{
+		blocks: make(map[string]*skipchain.SkipBlock),
+		latest: make(map[string]skipchain.SkipBlockID),
+		dir:    dir,
+	}, nil
+}
+
+// Get returns the block with the given ID, or nil if it is not in the
+// cache.
+func (bc *BlockCache) Get(id skipchain.SkipBlockID) *skipchain.SkipBlock {
+	bc.Lock()
+	defer bc.Unlock()
+	if sb := bc.blocks[string(id)]; sb != nil {
+		return sb
+	}
+	if bc.dir == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(bc.path("block", id))
+	if err != nil {
+		return nil
+	}
+	sb := &skipchain.SkipBlock{}
+	err = protobuf.DecodeWithConstructors(buf, sb,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil || !sb.CalculateHash().Equal(id) {
+		log.Warnf("dropping corrupted cached block %x", []byte(id))
+		os.Remove(bc.path("block", id))
+		return nil
+	}
+	bc.blocks[string(id)] = sb
+	return sb
+}
+
+// Add checks the hash of the block and adds it to the cache.
+func (bc *BlockCache) Add(sb *skipchain.SkipBlock) error {
+	if !sb.CalculateHash().Equal(sb.Hash) {
+		return xerrors.New("block doesn't match its hash")
+	}
+	bc.Lock()
+	defer bc.Unlock()
+	bc.blocks[string(sb.Hash)] = sb
+	if bc.dir == "" {
+		return nil
+	}
+	buf, err := protobuf.Encode(sb)
+	if err != nil {
+		return xerrors.Errorf("encoding block: %v", err)
+	}
+	if err := ioutil.WriteFile(bc.path("block", sb.Hash), buf, 0600); err != nil {
+		return xerrors.Errorf("writing block: %v", err)
+	}
+	return nil
+}
+
+// Latest returns the latest verified block of the chain, or nil if none
+// has been verified yet.
+func (bc *BlockCache) Latest(bcID skipchain.SkipBlockID) *skipchain.SkipBlock {
+	bc.Lock()
+	id, ok := bc.latest[string(bcID)]
+	if !ok && bc.dir != "" {
+		if buf, err := ioutil.ReadFile(bc.path("latest", bcID)); err == nil {
+			id, ok = skipchain.SkipBlockID(buf), true
+		}
+	}
+	bc.Unlock()
+	if !ok {
+		return nil
+	}
+	return bc.Get(id)
+}
+
+// setLatest records the latest verified block of its chain.
+func (bc *BlockCache) setLatest(sb *skipchain.SkipBlock) error {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.latest[string(sb.SkipChainID())] = sb.Hash
+	if bc.dir == "" {
+		return nil
+	}
+	err := ioutil.WriteFile(bc.path("latest", sb.SkipChainID()), sb.Hash, 0600)
+	return cothority.ErrorOrNil(err, "writing latest block")
+}
+
+func (bc *BlockCache) path(kind string, id skipchain.SkipBlockID) string {
+	return filepath.Join(bc.dir, kind+"-"+hex.EncodeToString(id))
+}
+
+// SetBlockCache makes the client keep the blocks it fetches in the cache,
+// which can be shared by several clients.
+func (c *Client) SetBlockCache(cache *BlockCache) {
+	c.blocks = cache
+}
+
+// getBlock returns the block with the given ID from the cache of the
+// client, or fetches it from the roster of the chain.
+func (c *Client) getBlock(id skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
+	if c.blocks != nil {
+		if sb := c.blocks.Get(id); sb != nil {
+			return sb, nil
+		}
+	}
+	sb, err := skipchain.NewClient().GetSingleBlock(&c.bcClient.Roster, id)
+	if err != nil {
+		return nil, xerrors.Errorf("getting block: %v", err)
+	}
+	if !sb.CalculateHash().Equal(id) {
+		return nil, xerrors.New("returned block doesn't match its ID")
+	}
+	if c.blocks != nil {
+		if err := c.blocks.Add(sb); err != nil {
+			return nil, xerrors.Errorf("caching block: %v", err)
+		}
+	}
+	return sb, nil
+}
+
+// genesis returns the genesis block of the chain of the client.
+func (c *Client) genesis() (*skipchain.SkipBlock, error) {
+	if c.bcClient.Genesis != nil {
+		return c.bcClient.Genesis, nil
+	}
+	genesis, err := c.getBlock(c.bcClient.ID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting genesis block: %v", err)
+	}
+	if genesis.Index != 0 {
+		return nil, xerrors.New("returned block is not a genesis block")
+	}
+	return genesis, nil
+}
+
+// LatestBlock returns the latest block of the chain of the client. The
+// forward links are followed and checked from the latest block in the cache
+// of the client, or from the genesis block, so that a refresh only checks
+// the new blocks.
+func (c *Client) LatestBlock() (*skipchain.SkipBlock, error) {
+	var latest *skipchain.SkipBlock
+	if c.blocks != nil {
+		latest = c.blocks.Latest(c.bcClient.ID)
+	}
+	if latest == nil {
+		genesis, err := c.genesis()
+		if err != nil {
+			return nil, err
+		}
+		latest = genesis
+	}
+	roster := latest.Roster
+	if roster == nil {
+		roster = &c.bcClient.Roster
+	}
+	reply, err := skipchain.NewClient().GetUpdateChain(roster, latest.Hash)
+	if err != nil {
+		return nil, xerrors.Errorf("getting update chain: %v", err)
+	}
+	for _, sb := range reply.Update {
+		// The first block is the latest block with its new forward links,
+		// which are checked with the next block.
+		if sb.Hash.Equal(latest.Hash) {
+			if !sb.CalculateHash().Equal(sb.Hash) {
+				return nil, xerrors.New("latest block doesn't match its hash")
+			}
+			latest = sb
+			continue
+		}
+		if err := verifyNextBlock(latest, sb); err != nil {
+			return nil, xerrors.Errorf("block %d: %v", sb.Index, err)
+		}
+		if c.blocks != nil {
+			if err := c.blocks.Add(sb); err != nil {
+				return nil, xerrors.Errorf("caching block: %v", err)
+			}
+		}
+		latest = sb
+	}
+	if c.blocks != nil {
+		if err := c.blocks.setLatest(latest); err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// verifyNextBlock checks that a forward link of the verified block prev,
+// signed by its roster, leads to sb.
+func verifyNextBlock(prev, sb *skipchain.SkipBlock) error {
+	if !sb.CalculateHash().Equal(sb.Hash) {
+		return xerrors.New("block doesn't match its hash")
+	}
+	if sb.Index <= prev.Index {
+		return xerrors.New("block is not after the latest block")
+	}
+	publics := prev.Roster.ServicePublics(skipchain.ServiceName)
+	for _, fl := range prev.ForwardLink {
+		if fl.IsEmpty() || !fl.To.Equal(sb.Hash) {
+			continue
+		}
+		err := fl.VerifyWithScheme(pairing.NewSuiteBn256(), publics,
+			prev.SignatureScheme)
+		return cothority.ErrorOrNil(err, "verifying forward link")
+	}
+	return xerrors.New("no forward link leads to the block")
+}
@@ -0,0 +1,162 @@
+package calypso
+
+import (
+	"crypto/rand"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/byzcoin/contracts"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// Applications built on byzcoin don't know the calypso contracts, but they
+// can read value instances. A write can be published in a value instance
+// holding a WriteReference: AddWriteWithValue spawns the value instance in
+// the same transaction as the write, and UpdateWriteWithValue points it to
+// every new version of the document, once the version is stored. The
+// application then refers to the document by the ID of the value instance,
+// which doesn't change, and checks it with the usual proofs of byzcoin.
+
+// NewWriteReference returns the reference to the write stored in the value
+// instance. The metadata stays encrypted.
+func NewWriteReference(writeID byzcoin.InstanceID, write *Write) *WriteReference {
+	return &WriteReference{
+		WriteID:  writeID,
+		Previous: write.Previous,
+		Label:    write.Label,
+		DataHash: write.DataHash,
+		DataRoot: write.DataRoot,
+		Metadata: write.Metadata,
+	}
+}
+
+// AddWriteWithValue creates a write-instance, like AddWrite, and a value
+// instance holding its WriteReference in the same transaction. The ID of the
+// write is derived from a random "preID" argument, as the reference must be
+// known before the transaction is signed. The write is spawned with
+// signerCtr, and the value with signerCtr+1. The darc needs the
+// spawn:calypsoWrite and spawn:value rules. It returns the ID of the value
+// instance.
+func (c *Client) AddWriteWithValue(write *Write, signer darc.Signer, signerCtr uint64,
+	d darc.Darc, wait int) (*WriteReply, byzcoin.InstanceID, error) {
+	writeBuf, err := protobuf.Encode(write)
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("encoding Write message: %v", err)
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("creating preID: %v", err)
+	}
+	spawnWrite := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(d.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractWriteID,
+			Args: byzcoin.Arguments{
+				{Name: "write", Value: writeBuf},
+				{Name: "preID", Value: PreIDFromToken(signer.Identity(), token)},
+			},
+		},
+		SignerCounter: []uint64{signerCtr},
+	}
+	reply := &WriteReply{}
+	reply.InstanceID, err = spawnWrite.DeriveIDArg("", "preID")
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("deriving instance ID: %v", err)
+	}
+	refBuf, err := protobuf.Encode(NewWriteReference(reply.InstanceID, write))
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("encoding reference: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion, spawnWrite,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(d.GetBaseID()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: contracts.ContractValueID,
+				Args:       byzcoin.Arguments{{Name: "value", Value: refBuf}},
+			},
+			SignerCounter: []uint64{signerCtr + 1},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signer); err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("signing txn: %v", err)
+	}
+	valueID := ctx.Instructions[1].DeriveID("")
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("adding txn: %v", err)
+	}
+	return reply, valueID, nil
+}
+
+// UpdateWriteWithValue creates a new version of the write with UpdateWrite,
+// then points the value instance to it. The ID of the new version depends on
+// the signature of the update, so the value is updated in a second
+// transaction, once the new version is stored: wait must be positive. The
+// write is updated with signerCtr, and the value with signerCtr+1. The
+// signer needs the invoke:value.update rule of the darc of the value
+// instance.
+func (c *Client) UpdateWriteWithValue(prevID byzcoin.InstanceID, write *Write,
+	valueID byzcoin.InstanceID, signer darc.Signer, signerCtr uint64,
+	wait int) (*WriteReply, error) {
+	if wait <= 0 {
+		return nil, xerrors.New("the update must be waited for")
+	}
+	reply, err := c.UpdateWrite(prevID, write, signer, signerCtr, wait)
+	if err != nil {
+		return nil, err
+	}
+	refBuf, err := protobuf.Encode(NewWriteReference(reply.InstanceID, write))
+	if err != nil {
+		return nil, xerrors.Errorf("encoding reference: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: valueID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: contracts.ContractValueID,
+				Command:    "update",
+				Args:       byzcoin.Arguments{{Name: "value", Value: refBuf}},
+			},
+			SignerCounter: []uint64{signerCtr + 1},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signer); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+	if _, err := c.bcClient.AddTransactionAndWait(ctx, wait); err != nil {
+		return nil, xerrors.Errorf("updating value: %v", err)
+	}
+	return reply, nil
+}
+
+// GetWriteReference returns the reference stored in the value instance,
+// together with its proof from the genesis block of the chain.
+func (c *Client) GetWriteReference(valueID byzcoin.InstanceID) (*WriteReference, *byzcoin.Proof, error) {
+	resp, err := c.bcClient.GetProof(valueID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(valueID.Slice()) {
+		return nil, nil, xerrors.New("value instance doesn't exist")
+	}
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := resp.Proof.VerifyFromBlock(genesis); err != nil {
+		return nil, nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	_, buf, contractID, _, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid proof: %v", err)
+	}
+	if contractID != contracts.ContractValueID {
+		return nil, nil, xerrors.New("not a value instance")
+	}
+	var ref WriteReference
+	if err := protobuf.Decode(buf, &ref); err != nil {
+		return nil, nil, xerrors.Errorf("decoding reference: %v", err)
+	}
+	return &ref, &resp.Proof, nil
+}
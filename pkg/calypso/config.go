@@ -0,0 +1,299 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// ConfigEnv is the environment variable holding the path of the TOML file
+// with the ServiceConfig of the node. If it is set, the file is read at
+// startup, and read again when the conode receives a SIGHUP or a
+// ReloadConfig request.
+const ConfigEnv = "CALYPSO_CONFIG"
+
+// DefaultMaxBatchRequestSize is the maximum size of a marshalled DecryptKeys
+// request.
+const DefaultMaxBatchRequestSize = 16 << 20
+
+// ServiceConfig holds the settings of the service that can be changed while
+// the conode is running. Policies of the writes are enforced by the
+// contracts, and must be the same on all nodes, so they cannot be configured
+// here.
+type ServiceConfig struct {
+	// PropagationTimeout is how long, in seconds, the service waits for a
+	// DKG or a resharing to finish.
+	PropagationTimeout int
+	// DecryptTimeout is how long, in seconds, the service waits for enough
+	// shares of a decryption request.
+	DecryptTimeout int
+	// MaxRequestSize is the maximum size, in bytes, of a client request.
+	MaxRequestSize int
+	// MaxBatchRequestSize is the maximum size, in bytes, of a DecryptKeys
+	// request.
+	MaxBatchRequestSize int
+	// RateLimitPerIP limits the decryption requests, and the writes and
+	// reads spawned by the transactions sent to this node, per IP address
+	// of the client.
+	RateLimitPerIP RateLimit
+	// RateLimitPerKey limits the decryption requests per public key of the
+	// reader, and the writes and reads spawned per key of their signers.
+	RateLimitPerKey RateLimit
+	// RepairInterval is how often, in seconds, the node asks the other
+	// nodes for blocks it missed. 0 disables the repair.
+	RepairInterval int
+	// ConsistencyInterval is how often, in seconds, the node compares its
+	// state with the other nodes. 0 disables the check.
+	ConsistencyInterval int
+	// ExternalPollInterval is how often, in seconds, the node fetches the
+	// new blocks of the chains hosted by another cothority. 0 disables the
+	// polling.
+	ExternalPollInterval int
+	// ShareCheckInterval is how often, in seconds, the node tells the other
+	// nodes of its LTSs to recover the shares they miss. 0 disables the
+	// check.
+	ShareCheckInterval int
+	// TreeStrategy is the name of the TreeStrategy used for the decryption
+	// requests that don't name one. If it is empty, all nodes are asked.
+	TreeStrategy string
+	// TreeFanout is the number of children of every node of the decryption
+	// trees. Interior nodes aggregate the shares of their subtree, so the
+	// root of a big roster doesn't have to talk to all nodes. 0 means the
+	// root asks all nodes directly.
+	TreeFanout int
+	// DecryptRequestAge is how long, in seconds, a signed decryption
+	// request is accepted after its timestamp.
+	DecryptRequestAge int
+	// AllowUnsignedDecrypt accepts the decryption requests that have not
+	// been signed by the reader, see DecryptKey.Sign, for the clients that
+	// don't sign them yet. Unsigned requests can be replayed by anyone who
+	// sees them, so it should only be set until all clients sign their
+	// requests.
+	AllowUnsignedDecrypt bool
+	// RequireClientTLS refuses the client requests that are not sent over
+	// TLS with an Ed25519 client certificate. A decryption request must
+	// use the key of the certificate. The websocket of the conode must ask
+	// for the certificates, see RequestClientCertificates. The writes and
+	// reads sent to ByzCoin are not checked.
+	RequireClientTLS bool
+	// Webhooks are the URLs notified of the reads and decryptions of the
+	// documents.
+	Webhooks []Webhook
+	// ReadTTL is how long, in seconds, a read-instance can be decrypted
+	// after the time of the block it has been spawned in. 0 disables the
+	// limit.
+	ReadTTL int
+	// ReadTTLBlocks is the number of blocks after the block of a
+	// read-instance during which it can be decrypted. 0 disables the limit.
+	ReadTTLBlocks int
+}
+
+// DefaultServiceConfig returns the configuration used if no file is given.
+func DefaultServiceConfig() ServiceConfig {
+	return ServiceConfig{
+		PropagationTimeout:   20,
+		DecryptTimeout:       60,
+		MaxRequestSize:       DefaultMaxRequestSize,
+		MaxBatchRequestSize:  DefaultMaxBatchRequestSize,
+		RepairInterval:       300,
+		ConsistencyInterval:  600,
+		ExternalPollInterval: 10,
+		ShareCheckInterval:   600,
+		DecryptRequestAge:    60,
+	}
+}
+
+// LoadServiceConfig reads the configuration from a TOML file. Missing
+// fields keep their default value.
+func LoadServiceConfig(file string) (ServiceConfig, error) {
+	conf := DefaultServiceConfig()
+	if _, err := toml.DecodeFile(file, &conf); err != nil {
+		return conf, xerrors.Errorf("decoding %s: %v", file, err)
+	}
+	return conf, conf.verify()
+}
+
+func (c ServiceConfig) verify() error {
+	if c.PropagationTimeout <= 0 {
+		return xerrors.New("propagation timeout must be positive")
+	}
+	if c.DecryptTimeout <= 0 {
+		return xerrors.New("decrypt timeout must be positive")
+	}
+	if c.DecryptRequestAge <= 0 {
+		return xerrors.New("decrypt request age must be positive")
+	}
+	if c.MaxRequestSize <= 0 || c.MaxBatchRequestSize <= 0 {
+		return xerrors.New("request sizes must be positive")
+	}
+	if c.RepairInterval < 0 || c.ConsistencyInterval < 0 ||
+		c.ExternalPollInterval < 0 || c.ShareCheckInterval < 0 {
+		return xerrors.New("intervals must not be negative")
+	}
+	if c.ReadTTL < 0 || c.ReadTTLBlocks < 0 {
+		return xerrors.New("read TTLs must not be negative")
+	}
+	if c.TreeFanout < 0 || c.TreeFanout == 1 {
+		return xerrors.New("tree fanout must be 0 or at least 2")
+	}
+	if c.TreeStrategy != "" {
+		if _, err := getTreeStrategy(c.TreeStrategy); err != nil {
+			return xerrors.Errorf("tree strategy: %v", err)
+		}
+	}
+	for i, wh := range c.Webhooks {
+		if err := wh.verify(); err != nil {
+			return xerrors.Errorf("webhook %d: %v", i, err)
+		}
+	}
+	for _, rl := range []RateLimit{c.RateLimitPerIP, c.RateLimitPerKey} {
+		if rl.Rate < 0 || rl.Burst < 0 || (rl.Rate > 0 && rl.Burst == 0) {
+			return xerrors.New("rate limits need a positive rate and burst")
+		}
+	}
+	return nil
+}
+
+func (c ServiceConfig) propagationTimeout() time.Duration {
+	return time.Duration(c.PropagationTimeout) * time.Second
+}
+
+func (c ServiceConfig) decryptTimeout() time.Duration {
+	return time.Duration(c.DecryptTimeout) * time.Second
+}
+
+func (c ServiceConfig) decryptRequestAge() time.Duration {
+	return time.Duration(c.DecryptRequestAge) * time.Second
+}
+
+func (c ServiceConfig) readTTL() time.Duration {
+	return time.Duration(c.ReadTTL) * time.Second
+}
+
+func (c ServiceConfig) repairInterval() time.Duration {
+	return time.Duration(c.RepairInterval) * time.Second
+}
+
+func (c ServiceConfig) consistencyInterval() time.Duration {
+	return time.Duration(c.ConsistencyInterval) * time.Second
+}
+
+func (c ServiceConfig) externalPollInterval() time.Duration {
+	return time.Duration(c.ExternalPollInterval) * time.Second
+}
+
+func (c ServiceConfig) shareCheckInterval() time.Duration {
+	return time.Duration(c.ShareCheckInterval) * time.Second
+}
+
+// treeFanout returns the number of children of the nodes of a decryption
+// tree of n nodes.
+func (c ServiceConfig) treeFanout(n int) int {
+	if c.TreeFanout == 0 || c.TreeFanout > n {
+		return n
+	}
+	return c.TreeFanout
+}
+
+// maxRequestSize returns the maximum size of a request to the given path.
+func (c ServiceConfig) maxRequestSize(path string) int {
+	if path == "DecryptKeys" {
+		return c.MaxBatchRequestSize
+	}
+	return c.MaxRequestSize
+}
+
+// SetConfig replaces the configuration of the service. It is not stored and
+// is lost after a restart, except if it comes from the file in ConfigEnv.
+func (s *Service) SetConfig(conf ServiceConfig) error {
+	if err := conf.verify(); err != nil {
+		return xerrors.Errorf("invalid configuration: %v", err)
+	}
+	s.configLock.Lock()
+	old := s.config
+	s.config = conf
+	s.configLock.Unlock()
+
+	// Setting a limit empties the buckets, so only do it if it changed.
+	if old.RateLimitPerIP != conf.RateLimitPerIP {
+		s.ipLimiter.setLimit(conf.RateLimitPerIP)
+	}
+	if old.RateLimitPerKey != conf.RateLimitPerKey {
+		s.keyLimiter.setLimit(conf.RateLimitPerKey)
+	}
+	return nil
+}
+
+func (s *Service) getConfig() ServiceConfig {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	return s.config
+}
+
+// ReloadConfig reads the configuration file given in ConfigEnv again. Like
+// Authorize, the request must be signed using the private key of the
+// conode.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) ReloadConfig(req *ReloadConfig) (*ReloadConfigReply, error) {
+	err := s.verifyAdminSignature(reloadMessage(req.Timestamp), req.Timestamp,
+		req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+	if err := s.reloadConfig(); err != nil {
+		return nil, xerrors.Errorf("reloading configuration: %v", err)
+	}
+	return &ReloadConfigReply{Config: s.getConfig()}, nil
+}
+
+func (s *Service) reloadConfig() error {
+	if s.configFile == "" {
+		return xerrors.Errorf("%s is not set", ConfigEnv)
+	}
+	conf, err := LoadServiceConfig(s.configFile)
+	if err != nil {
+		return xerrors.Errorf("loading configuration: %v", err)
+	}
+	if err := s.SetConfig(conf); err != nil {
+		return xerrors.Errorf("setting configuration: %v", err)
+	}
+	log.Lvl1(s.ServerIdentity(), "loaded configuration from", s.configFile)
+	return nil
+}
+
+// watchConfig reloads the configuration every time the process receives a
+// SIGHUP, until the service is closed. An invalid file is logged and the old
+// configuration is kept.
+func (s *Service) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := s.reloadConfig(); err != nil {
+					log.Error(s.ServerIdentity(), err)
+				}
+			case <-s.closing:
+				return
+			}
+		}
+	}()
+}
+
+// reloadMessage returns the message to be signed for a ReloadConfig
+// request.
+func reloadMessage(ts int64) []byte {
+	msg := append([]byte("reload:"), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
@@ -0,0 +1,292 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// The blocks and the public parts of the LTSs are propagated on a best
+// effort basis, so the state of the nodes can drift apart without anybody
+// noticing. To catch this, every node regularly asks the other nodes of its
+// chains and LTSs for a digest of their state, and reports the entries that
+// differ from its own. The last report can be read by the admin of the node
+// with CheckConsistency.
+
+// Prefixes of the keys of the digest leaves.
+const (
+	digestChain = "chain:"
+	digestLTS   = "lts:"
+)
+
+// GetDigest returns the digest of the chains and LTSs held by this node. It
+// only holds public information, so no signature is needed.
+func (s *Service) GetDigest(req *GetDigest) (*GetDigestReply, error) {
+	leaves := s.digestLeaves()
+	return &GetDigestReply{Root: digestRoot(leaves), Leaves: leaves}, nil
+}
+
+// digestLeaves returns one leaf for every authorised chain held by this
+// node, with its latest block, and one for every LTS, with its public key,
+// polynomial and roster. The leaves are sorted by key.
+func (s *Service) digestLeaves() []DigestLeaf {
+	var leaves []DigestLeaf
+	sc, _ := s.Service(skipchain.ServiceName).(*skipchain.Service)
+
+	s.storage.RLock()
+	for id := range s.storage.AuthorisedByzCoinIDs {
+		if sc == nil {
+			break
+		}
+		latest, err := sc.GetDB().GetLatestByID(skipchain.SkipBlockID(id))
+		if err != nil {
+			continue
+		}
+		leaves = append(leaves, DigestLeaf{
+			Key:   digestChain + hex.EncodeToString([]byte(id)),
+			Index: latest.Index,
+			Hash:  latest.Hash,
+		})
+	}
+	for id, shared := range s.storage.Shared {
+		h := sha256.New()
+		shared.X.MarshalTo(h)
+		if pp := s.storage.Polys[id]; pp != nil {
+			pp.B.MarshalTo(h)
+			for _, c := range pp.Commits {
+				c.MarshalTo(h)
+			}
+		}
+		if roster := s.storage.Rosters[id]; roster != nil {
+			h.Write(roster.ID[:])
+		}
+		leaves = append(leaves, DigestLeaf{
+			Key:  digestLTS + hex.EncodeToString(id[:]),
+			Hash: h.Sum(nil),
+		})
+	}
+	s.storage.RUnlock()
+
+	sort.Slice(leaves, func(i, j int) bool {
+		return leaves[i].Key < leaves[j].Key
+	})
+	return leaves
+}
+
+// digestRoot returns the root of the Merkle tree of the leaves. Two nodes
+// with the same root hold the same state.
+func digestRoot(leaves []DigestLeaf) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(leaves))
+	for i, l := range leaves {
+		index := make([]byte, 8)
+		binary.LittleEndian.PutUint64(index, uint64(l.Index))
+		h := sha256.New()
+		h.Write([]byte(l.Key))
+		h.Write(index)
+		h.Write(l.Hash)
+		level[i] = h.Sum(nil)
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// consistencyPeers returns all other nodes of the LTSs and of the latest
+// blocks of the chains held by this node.
+func (s *Service) consistencyPeers() []*network.ServerIdentity {
+	var rosters []*onet.Roster
+	sc, _ := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	s.storage.RLock()
+	for _, roster := range s.storage.Rosters {
+		rosters = append(rosters, roster)
+	}
+	for id := range s.storage.AuthorisedByzCoinIDs {
+		if sc == nil {
+			break
+		}
+		if latest, err := sc.GetDB().GetLatestByID(skipchain.SkipBlockID(id)); err == nil {
+			rosters = append(rosters, latest.Roster)
+		}
+	}
+	s.storage.RUnlock()
+
+	seen := map[network.ServerIdentityID]bool{s.ServerIdentity().ID: true}
+	var peers []*network.ServerIdentity
+	for _, roster := range rosters {
+		for _, si := range roster.List {
+			if !seen[si.ID] {
+				seen[si.ID] = true
+				peers = append(peers, si)
+			}
+		}
+	}
+	return peers
+}
+
+// checkConsistency compares the digest of this node with the digests of
+// all its peers and returns the report.
+func (s *Service) checkConsistency() *ConsistencyReport {
+	report := &ConsistencyReport{Timestamp: time.Now().UnixNano()}
+	local := s.digestLeaves()
+	root := digestRoot(local)
+	cl := onet.NewClient(cothority.Suite, ServiceName)
+	for _, si := range s.consistencyPeers() {
+		remote := &GetDigestReply{}
+		if err := cl.SendProtobuf(si, &GetDigest{}, remote); err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't get digest of", si, err)
+			report.Unreachable = append(report.Unreachable, si)
+			continue
+		}
+		report.Checked++
+		if bytes.Equal(root, remote.Root) {
+			continue
+		}
+		report.Divergences = append(report.Divergences,
+			s.compareDigests(si, local, remote.Leaves)...)
+	}
+	for _, d := range report.Divergences {
+		log.Warnf("%v state differs from %v for %s", s.ServerIdentity(),
+			d.Node, d.Key)
+	}
+	return report
+}
+
+// compareDigests returns the leaves that both nodes hold and that differ.
+// As a chain can be at a different height on the other node, its block is
+// compared with the local block at the same index, if this node has it.
+func (s *Service) compareDigests(si *network.ServerIdentity, local,
+	remote []DigestLeaf) []Divergence {
+	byKey := make(map[string]DigestLeaf)
+	for _, l := range local {
+		byKey[l.Key] = l
+	}
+	var divs []Divergence
+	for _, r := range remote {
+		l, ok := byKey[r.Key]
+		if !ok {
+			continue
+		}
+		localHash := l.Hash
+		if strings.HasPrefix(r.Key, digestChain) {
+			if r.Index > l.Index {
+				// The other node is ahead, it checks our block.
+				continue
+			}
+			if r.Index < l.Index {
+				localHash = s.localBlockHash(r.Key, r.Index)
+				if localHash == nil {
+					continue
+				}
+			}
+		}
+		if !bytes.Equal(localHash, r.Hash) {
+			divs = append(divs, Divergence{Node: si, Key: r.Key,
+				Index: r.Index, Local: localHash, Remote: r.Hash})
+		}
+	}
+	return divs
+}
+
+// localBlockHash returns the hash of the local block at the given index of
+// the chain of the digest key, or nil if this node doesn't have it.
+func (s *Service) localBlockHash(key string, index int) []byte {
+	id, err := hex.DecodeString(strings.TrimPrefix(key, digestChain))
+	if err != nil {
+		return nil
+	}
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return nil
+	}
+	reply, err := sc.GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+		Genesis: id,
+		Index:   index,
+	})
+	if err != nil || reply.SkipBlock.Index != index {
+		return nil
+	}
+	return reply.SkipBlock.Hash
+}
+
+// scheduleConsistencyCheck runs checkConsistency every ConsistencyInterval
+// and keeps the last report.
+func (s *Service) scheduleConsistencyCheck() {
+	interval := s.getConfig().consistencyInterval()
+	if interval == 0 {
+		// Check again later whether the check has been enabled.
+		interval = time.Minute
+	}
+	s.schedule("consistency", interval, func() {
+		if s.getConfig().ConsistencyInterval > 0 {
+			s.setConsistencyReport(s.checkConsistency())
+		}
+		s.scheduleConsistencyCheck()
+	})
+}
+
+func (s *Service) setConsistencyReport(r *ConsistencyReport) {
+	s.consistencyLock.Lock()
+	defer s.consistencyLock.Unlock()
+	s.consistency = r
+}
+
+// CheckConsistency returns the last report of the consistency check, or
+// runs a new check if req.Run is set, together with the latest repairs of
+// corrupted blocks. Like ReloadConfig, the request must be signed using the
+// private key of the conode.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) CheckConsistency(req *CheckConsistency) (*CheckConsistencyReply, error) {
+	err := s.verifyAdminSignature(consistencyMessage(req.Run, req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+	if req.Run {
+		s.setConsistencyReport(s.checkConsistency())
+	}
+	reply := &CheckConsistencyReply{Repairs: s.blockRepairs()}
+	s.consistencyLock.Lock()
+	defer s.consistencyLock.Unlock()
+	reply.Report = s.consistency
+	return reply, nil
+}
+
+// consistencyMessage returns the message to be signed for a
+// CheckConsistency request.
+func consistencyMessage(run bool, ts int64) []byte {
+	msg := append([]byte("consistency:"), 0)
+	if run {
+		msg[len(msg)-1] = 1
+	}
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
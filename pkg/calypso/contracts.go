@@ -1,12 +1,17 @@
 package calypso
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"strings"
+	"time"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/policy"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
@@ -36,6 +41,31 @@ func (w Write) String() string {
 	fmt.Fprintf(out, "-- ExtraData: %s\n", w.ExtraData)
 	fmt.Fprintf(out, "-- LTSID: %s\n", w.LTSID)
 	fmt.Fprintf(out, "-- Cost: %x\n", w.Cost)
+	if w.Payee != nil {
+		fmt.Fprintf(out, "-- Payee: %x\n", w.Payee[:])
+	}
+	fmt.Fprintf(out, "-- Policy: %s\n", w.Policy)
+	if w.Label != "" {
+		fmt.Fprintf(out, "-- Label: %s\n", w.Label)
+	}
+	if w.Suite != "" {
+		fmt.Fprintf(out, "-- Suite: %s\n", w.Suite)
+	}
+	if w.Auditor != nil {
+		fmt.Fprintf(out, "-- Auditor: %s\n", w.Auditor)
+	}
+	if w.Previous != nil {
+		fmt.Fprintf(out, "-- Previous: %x\n", w.Previous[:])
+	}
+	if w.Next != nil {
+		fmt.Fprintf(out, "-- Next: %x\n", w.Next[:])
+	}
+	for _, wk := range w.Alternatives {
+		fmt.Fprintf(out, "-- Alternative LTSID: %s\n", wk.LTSID)
+	}
+	for _, rk := range w.RSAKeys {
+		fmt.Fprintf(out, "-- RSA reader: %x\n", rk.KeyID)
+	}
 
 	return out.String()
 }
@@ -75,8 +105,20 @@ func (c ContractWrite) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		if d := inst.Spawn.Args.Search("darcID"); d != nil {
 			darcID = d
 		}
-		if err = c.Write.CheckProof(cothority.Suite, darcID); err != nil {
-			err = xerrors.Errorf("proof of write failed: %v", err)
+		if err = c.Write.verifyNew(darcID); err != nil {
+			return
+		}
+		if err = c.Write.verifyLTSs(rst); err != nil {
+			return
+		}
+		if err = c.Write.verifyGroups(rst); err != nil {
+			return
+		}
+		if err = c.Write.verifyPayee(rst); err != nil {
+			return
+		}
+		if c.Write.Previous != nil {
+			err = xerrors.New("only an update can create a new version")
 			return
 		}
 		instID, err := inst.DeriveIDArg("", "preID")
@@ -87,54 +129,315 @@ func (c ContractWrite) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		log.Lvlf3("Successfully verified write request and will store in %x", instID)
 		sc = append(sc, byzcoin.NewStateChange(byzcoin.Create, instID, ContractWriteID, w, darcID))
 	case ContractReadID:
-		var rd Read
 		r := inst.Spawn.Args.Search("read")
 		if r == nil || len(r) == 0 {
 			return nil, nil, xerrors.New("need a read argument")
 		}
-		err = protobuf.DecodeWithConstructors(r, &rd, network.DefaultConstructors(cothority.Suite))
+		rd, err := decodeRead(r)
 		if err != nil {
 			return nil, nil, xerrors.Errorf("passed read argument is invalid: %v", err)
 		}
 		if !rd.Write.Equal(inst.InstanceID) {
 			return nil, nil, xerrors.New("the read request doesn't reference this write-instance")
 		}
-		if c.Cost.Value > 0 {
-			for i, coin := range cout {
-				if coin.Name.Equal(c.Cost.Name) {
-					err := coin.SafeSub(c.Cost.Value)
-					if err != nil {
-						return nil, nil, xerrors.Errorf("couldn't pay for read request: %v", err)
-					}
-					cout[i] = coin
-					break
-				}
+		if len(rd.Delegations) > 0 {
+			return nil, nil, xerrors.New("delegations can only be added with the delegate invoke")
+		}
+		if c.Frozen {
+			return nil, nil, xerrors.New("the write is frozen")
+		}
+		if c.Auditor != nil {
+			if !signedBy(inst, c.Auditor) {
+				return nil, nil, xerrors.New("the read needs the approval of the auditor")
 			}
+			log.Warnf("AUDIT: auditor %s approved a read of write %x",
+				c.Auditor, inst.InstanceID[:])
+		}
+		if c.Policy != "" {
+			vars, err := ReadPolicyVars(rst, inst, *rd)
+			if err != nil {
+				return nil, nil, err
+			}
+			ok, err := policy.Evaluate(c.Policy, vars)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("evaluating policy: %v", err)
+			}
+			if !ok {
+				return nil, nil, xerrors.New("the policy of the write refuses this read")
+			}
+		}
+		if err := c.Write.setGroup(rst, inst, rd); err != nil {
+			return nil, nil, err
+		}
+		rd.setBlock(rst)
+		rd.setSigners(inst)
+		if r, err = protobuf.Encode(rd); err != nil {
+			return nil, nil, xerrors.Errorf("encoding read: %v", err)
+		}
+		var payment []byzcoin.StateChange
+		payment, cout, err = c.Write.payRead(rst, cout)
+		if err != nil {
+			return nil, nil, err
 		}
 		instID, err := inst.DeriveIDArg("", "preID")
 		if err != nil {
 			return nil, nil, xerrors.Errorf(
 				"couldn't get ID for instance: %v", err)
 		}
-		sc = byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create,
-			instID, ContractReadID, r, darcID)}
+		sc = append(byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create,
+			instID, ContractReadID, r, darcID)}, payment...)
 	default:
 		err = xerrors.New("can only spawn writes and reads")
 	}
 	return
 }
 
+// ReadPolicyVars returns the variables available to the policy of a write
+// when the given read is spawned:
+//   - time: the timestamp of the block, in Unix seconds
+//   - block: the index of the block
+//   - reader: the identity of the first signer of the read, or the primary
+//     identity of the credential if the read is signed by a device
+//   - counter: the signer counter of the reader for this read
+//   - xc: the public key the secret will be re-encrypted to, unset for a
+//     blinded read
+//   - approvals: the number of distinct signers of the read that are each
+//     allowed to read on their own by the spawn:calypsoRead rule of the
+//     write, see ApprovalPolicy
+//
+// It returns an error if the read has no key and isn't blinded.
+func ReadPolicyVars(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, rd Read) (policy.Vars, error) {
+	vars := policy.Vars{
+		"block": int64(rst.GetIndex()),
+	}
+	if rd.Xc != nil {
+		vars["xc"] = rd.Xc.String()
+	} else if !rd.blinded() {
+		return nil, xerrors.New("read without reader key")
+	}
+	if tr, ok := rst.(byzcoin.TimeReader); ok {
+		vars["time"] = tr.GetCurrentBlockTimestamp() / int64(time.Second)
+	}
+	if len(inst.SignerIdentities) > 0 {
+		vars["reader"] = inst.SignerIdentities[0].String()
+	}
+	if cred, _, err := readCredential(rst, inst); err == nil && cred != nil {
+		vars["reader"] = darc.NewIdentityEd25519(cred.Primary).String()
+	}
+	if len(inst.SignerCounter) > 0 {
+		vars["counter"] = int64(inst.SignerCounter[0])
+	}
+	if n, err := readApprovals(rst, inst); err == nil {
+		vars["approvals"] = n
+	} else {
+		log.Lvl3("couldn't count approvals:", err)
+	}
+	return vars, nil
+}
+
+// ApprovalPolicy returns the policy accepting only the reads signed by at
+// least m distinct readers, for example m = 2 for a two-person rule. Every
+// one of them must be allowed to read by the darc of the write.
+func ApprovalPolicy(m int) string {
+	return fmt.Sprintf("approvals >= %d", m)
+}
+
+// readApprovals counts the distinct signers of the read that satisfy the
+// spawn:calypsoRead rule of the write on their own. The signatures have
+// already been verified with the instruction.
+func readApprovals(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) (int64, error) {
+	expr, getDarc, err := readRule(rst, inst.InstanceID)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	seen := make(map[string]bool)
+	for _, id := range inst.SignerIdentities {
+		s := id.String()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if darc.EvalExpr(expr, getDarc, s) == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Invoke is used to update a write-instance with a new version of the
+// document. The "update" command takes the new version in the "write"
+// argument, which must point to the current write-instance in its Previous
+// field. A new write-instance is created for the new version, and the Next
+// field of the current one is set, so that the latest version can be found
+// from any earlier one. Only the latest version can be updated.
+//
+// The "freeze" command suspends all reads and decryptions of the write,
+// for example during an investigation, with an optional "reason" argument.
+// The "unfreeze" command restores them. A frozen write cannot be updated.
+//
+// The "hold", "release" and "retain" commands manage the retention of the
+// write, see invokeRetention.
+func (c ContractWrite) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	switch inst.Invoke.Command {
+	case "update":
+	case "freeze", "unfreeze":
+		return c.invokeFreeze(inst, darcID, coins)
+	case "hold", "release", "retain":
+		return c.invokeRetention(inst, darcID, coins)
+	default:
+		return nil, nil, xerrors.New("can only update, freeze, unfreeze, hold, release or retain writes")
+	}
+	if c.Write.Next != nil {
+		return nil, nil, xerrors.New("this write has already been superseded")
+	}
+	if c.Write.Frozen {
+		return nil, nil, xerrors.New("a frozen write cannot be updated")
+	}
+
+	w := inst.Invoke.Args.Search("write")
+	if len(w) == 0 {
+		return nil, nil, xerrors.New("need a write request in 'write' argument")
+	}
+	var next Write
+	err = protobuf.DecodeWithConstructors(w, &next, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("couldn't unmarshal write: %v", err)
+	}
+	if next.Previous == nil || !next.Previous.Equal(inst.InstanceID) {
+		return nil, nil, xerrors.New("the new version must point to the write it updates")
+	}
+	if c.Write.Auditor != nil && !samePoint(c.Write.Auditor, next.Auditor) {
+		return nil, nil, xerrors.New("the auditor of a write cannot be changed")
+	}
+	if err := next.verifyNew(darcID); err != nil {
+		return nil, nil, err
+	}
+	if err := next.verifyLTSs(rst); err != nil {
+		return nil, nil, err
+	}
+	if err := next.verifyGroups(rst); err != nil {
+		return nil, nil, err
+	}
+	if err := next.verifyPayee(rst); err != nil {
+		return nil, nil, err
+	}
+
+	nextID := inst.DeriveID("")
+	c.Write.Next = &nextID
+	buf, err := protobuf.Encode(&c.Write)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding write: %v", err)
+	}
+	log.Lvlf3("Updating write %x with new version %x", inst.InstanceID[:], nextID[:])
+	return byzcoin.StateChanges{
+		byzcoin.NewStateChange(byzcoin.Create, nextID, ContractWriteID, w, darcID),
+		byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractWriteID, buf, darcID),
+	}, coins, nil
+}
+
+// invokeFreeze freezes or unfreezes the write.
+func (c ContractWrite) invokeFreeze(inst byzcoin.Instruction, darcID darc.ID,
+	coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	freeze := inst.Invoke.Command == "freeze"
+	if freeze && c.Write.Frozen {
+		return nil, nil, xerrors.New("write is already frozen")
+	}
+	if !freeze && !c.Write.Frozen {
+		return nil, nil, xerrors.New("write is not frozen")
+	}
+	c.Write.Frozen = freeze
+	c.Write.FreezeReason = ""
+	if freeze {
+		c.Write.FreezeReason = string(inst.Invoke.Args.Search("reason"))
+	}
+	buf, err := protobuf.Encode(&c.Write)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding write: %v", err)
+	}
+	log.Warnf("AUDIT: %s of write %x: %s", inst.Invoke.Command,
+		inst.InstanceID[:], c.Write.FreezeReason)
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractWriteID, buf, darcID)}, coins, nil
+}
+
+// verifyNew checks a write that is about to be stored in a new instance.
+func (wr *Write) verifyNew(darcID darc.ID) error {
+	suite, err := wr.GetSuite()
+	if err != nil {
+		return xerrors.Errorf("checking suite: %v", err)
+	}
+	if err := wr.CheckProof(suite, darcID); err != nil {
+		return xerrors.Errorf("proof of write failed: %v", err)
+	}
+	if wr.Next != nil {
+		return xerrors.New("a new write cannot be superseded")
+	}
+	if wr.Frozen {
+		return xerrors.New("a new write cannot be frozen")
+	}
+	if wr.Hold {
+		return xerrors.New("a new write cannot be under legal hold")
+	}
+	if wr.Policy != "" {
+		if _, err := policy.Parse(wr.Policy); err != nil {
+			return xerrors.Errorf("invalid policy: %v", err)
+		}
+	}
+	if len(wr.Label) > maxLabelLength {
+		return xerrors.Errorf("label is longer than %d bytes", maxLabelLength)
+	}
+	if len(wr.DataHash) != 0 && len(wr.DataHash) != sha256.Size {
+		return xerrors.New("hash of the data has a wrong length")
+	}
+	if len(wr.DataRoot) != 0 && len(wr.DataRoot) != sha256.Size {
+		return xerrors.New("Merkle root of the data has a wrong length")
+	}
+	if err := wr.verifyRSAKeys(); err != nil {
+		return xerrors.Errorf("invalid RSA keys: %v", err)
+	}
+	return nil
+}
+
+// verifyLTSs checks that the key of a new write is only encrypted for LTS
+// instances of this chain, so that it cannot be encrypted for nodes outside
+// of their rosters, that none of them has been rotated to a new epoch, and
+// that they all allow RSA wrapping if the write holds RSA keys.
+func (wr *Write) verifyLTSs(rst byzcoin.ReadOnlyStateTrie) error {
+	for _, id := range wr.LTSIDs() {
+		info, err := getLTSInfo(rst, id)
+		if err != nil {
+			return xerrors.Errorf("LTS %x: %v", id[:], err)
+		}
+		if info.Next != nil {
+			return xerrors.Errorf("LTS %x has been rotated, new writes must use %x",
+				id[:], info.Next[:])
+		}
+		if len(wr.RSAKeys) > 0 && !info.RSAWrapping {
+			return xerrors.Errorf("LTS %x doesn't allow RSA wrapping", id[:])
+		}
+	}
+	return nil
+}
+
 // ContractReadID references a read contract system-wide.
 const ContractReadID = "calypsoRead"
 
-// ContractRead represents one read contract.
+// ContractRead represents one read contract. Reads are spawned by the write
+// contract, and can only be invoked to delegate them, see Delegation.
 type ContractRead struct {
 	byzcoin.BasicContract
 	Read
 }
 
 func contractReadFromBytes(in []byte) (byzcoin.Contract, error) {
-	return nil, xerrors.New("calypso read instances are never instantiated")
+	c := &ContractRead{}
+	err := protobuf.DecodeWithConstructors(in, &c.Read, network.DefaultConstructors(cothority.Suite))
+	return c, cothority.ErrorOrNil(err, "couldn't unmarshal read")
 }
 
 // ContractLongTermSecretID is the contract ID for updating the LTS roster.
@@ -171,9 +474,115 @@ func (c *contractLTS) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruct
 	if err != nil {
 		return nil, nil, xerrors.Errorf("passed lts_instance_info argument is invalid: %v", err)
 	}
+	if info.Epoch != 0 || info.Previous != nil || info.Next != nil {
+		return nil, nil, xerrors.New("a new epoch can only be created by a rotation")
+	}
+	if len(info.Reshares) > 0 {
+		return nil, nil, xerrors.New("the reshares are recorded by the contract")
+	}
+	if err := info.verifyRoster(); err != nil {
+		return nil, nil, err
+	}
 	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), ContractLongTermSecretID, infoBuf, darcID)}, coins, nil
 }
 
+// getLTSInfo returns the information stored in the LTS instance.
+func getLTSInfo(rst byzcoin.ReadOnlyStateTrie, id byzcoin.InstanceID) (*LtsInstanceInfo, error) {
+	buf, _, cid, _, err := rst.GetValues(id.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting values: %v", err)
+	}
+	if cid != ContractLongTermSecretID {
+		return nil, xerrors.New("not an LTS instance")
+	}
+	var info LtsInstanceInfo
+	err = protobuf.DecodeWithConstructors(buf, &info, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding LTS instance: %v", err)
+	}
+	return &info, nil
+}
+
+// LTSThreshold returns the number of shares needed to decrypt with an LTS
+// held by n nodes: more than two thirds of them.
+func LTSThreshold(n int) int {
+	return n - (n-1)/3
+}
+
+// NewLtsInstanceInfo returns the information of a new LTS held by the nodes
+// of the roster, after checking that they can run the DKG together.
+func NewLtsInstanceInfo(roster *onet.Roster) (*LtsInstanceInfo, error) {
+	return NewWeightedLtsInstanceInfo(roster, nil)
+}
+
+// NewWeightedLtsInstanceInfo works like NewLtsInstanceInfo, but the node i
+// of the roster gets weights[i] shares. If weights is nil, every node gets
+// one share.
+func NewWeightedLtsInstanceInfo(roster *onet.Roster, weights []int) (*LtsInstanceInfo, error) {
+	if roster == nil {
+		return nil, xerrors.New("missing roster")
+	}
+	info := &LtsInstanceInfo{Roster: *roster, Weights: weights}
+	if err := info.verifyRoster(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Shares returns the number of shares of the LTS.
+func (info *LtsInstanceInfo) Shares() int {
+	if len(info.Weights) == 0 {
+		return len(info.Roster.List)
+	}
+	shares := 0
+	for _, w := range info.Weights {
+		shares += w
+	}
+	return shares
+}
+
+// Threshold returns the number of shares needed to decrypt with the LTS.
+func (info *LtsInstanceInfo) Threshold() int {
+	return LTSThreshold(info.Shares())
+}
+
+// verifyRoster checks that the roster is not empty, and that every node has
+// a public key and appears only once, as every node gets its own shares. If
+// the LTS has weights, every node must have at least one share.
+func (info *LtsInstanceInfo) verifyRoster() error {
+	if len(info.Roster.List) == 0 {
+		return xerrors.New("the LTS needs a roster")
+	}
+	ids := make(map[network.ServerIdentityID]bool)
+	keys := make(map[string]bool)
+	for i, si := range info.Roster.List {
+		if si == nil || si.Public == nil {
+			return xerrors.Errorf("node %d has no public key", i)
+		}
+		key := si.Public.String()
+		if ids[si.ID] || keys[key] {
+			return xerrors.Errorf("node %s appears twice", si)
+		}
+		ids[si.ID] = true
+		keys[key] = true
+	}
+	if len(info.Weights) == 0 {
+		return nil
+	}
+	if len(info.Weights) != len(info.Roster.List) {
+		return xerrors.New("need one weight per node")
+	}
+	for i, w := range info.Weights {
+		if w < 1 || w > MaxShares {
+			return xerrors.Errorf("node %d has weight %d", i, w)
+		}
+	}
+	if info.Shares() > MaxShares {
+		return xerrors.Errorf("cannot have more than %d shares", MaxShares)
+	}
+	return nil
+}
+
 func (c *contractLTS) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
 	var darcID darc.ID
 	curBuf, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
@@ -181,8 +590,14 @@ func (c *contractLTS) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		return nil, nil, xerrors.Errorf("getting values: %v", err)
 	}
 
-	if inst.Invoke.Command != "reshare" {
-		return nil, nil, xerrors.New("can only reshare long-term secrets")
+	switch inst.Invoke.Command {
+	case "reshare":
+	case "export":
+		return c.invokeExport(inst, curBuf, darcID, coins)
+	case "rotate":
+		return c.invokeRotate(inst, curBuf, darcID, coins)
+	default:
+		return nil, nil, xerrors.New("can only reshare or rotate long-term secrets or record exports")
 	}
 	infoBuf := inst.Invoke.Args.Search("lts_instance_info")
 	if infoBuf == nil || len(infoBuf) == 0 {
@@ -198,19 +613,136 @@ func (c *contractLTS) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 	if err != nil {
 		return nil, nil, xerrors.Errorf("current info is invalid: %v", err)
 	}
+	if err := newInfo.verifyRoster(); err != nil {
+		return nil, nil, err
+	}
+	if len(curInfo.Weights) > 0 || len(newInfo.Weights) > 0 {
+		return nil, nil, xerrors.New("LTSs with weights can only be rotated")
+	}
 
 	// Verify the intersection between new roster and the old one. There must be
 	// at least a threshold of nodes in the intersection.
 	n := len(curInfo.Roster.List)
 	overlap := intersectRosters(&curInfo.Roster, &newInfo.Roster)
-	thr := n - (n-1)/3
-	if overlap < thr {
+	if overlap < LTSThreshold(n) {
 		return nil, nil, xerrors.New("new roster does not overlap enough with current roster")
 	}
+	if curInfo.EscrowExport != newInfo.EscrowExport {
+		return nil, nil, xerrors.New("escrow exports cannot be changed")
+	}
+	if curInfo.RSAWrapping != newInfo.RSAWrapping {
+		return nil, nil, xerrors.New("RSA wrapping cannot be changed")
+	}
+	// The recorded exports and the epoch are kept, whatever the reshare
+	// holds.
+	newInfo.Exports = curInfo.Exports
+	newInfo.Epoch = curInfo.Epoch
+	newInfo.Previous = curInfo.Previous
+	newInfo.Next = curInfo.Next
+	reshare := LtsReshare{Roster: curInfo.Roster, BlockIndex: rst.GetIndex()}
+	if tr, ok := rst.(byzcoin.TimeReader); ok {
+		reshare.Timestamp = tr.GetCurrentBlockTimestamp()
+	}
+	newInfo.Reshares = append(curInfo.Reshares, reshare)
+	infoBuf, err = protobuf.Encode(&newInfo)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding info: %v", err)
+	}
 
 	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractLongTermSecretID, infoBuf, darcID)}, coins, nil
 }
 
+// invokeExport records the recovery key of the argument in the exports of
+// the LTS, if the LTS allows escrow exports.
+func (c *contractLTS) invokeExport(inst byzcoin.Instruction, curBuf []byte,
+	darcID darc.ID, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	var info LtsInstanceInfo
+	err := protobuf.DecodeWithConstructors(curBuf, &info, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("current info is invalid: %v", err)
+	}
+	if !info.EscrowExport {
+		return nil, nil, xerrors.New("this LTS doesn't allow escrow exports")
+	}
+	keyBuf := inst.Invoke.Args.Search("recovery_key")
+	if len(keyBuf) == 0 {
+		return nil, nil, xerrors.New("need a recovery_key argument")
+	}
+	recovery := cothority.Suite.Point()
+	if err := recovery.UnmarshalBinary(keyBuf); err != nil {
+		return nil, nil, xerrors.Errorf("invalid recovery key: %v", err)
+	}
+	for _, k := range info.Exports {
+		if k.Equal(recovery) {
+			return nil, nil, xerrors.New("export is already recorded")
+		}
+	}
+	info.Exports = append(info.Exports, recovery)
+	buf, err := protobuf.Encode(&info)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding info: %v", err)
+	}
+	log.Warnf("AUDIT: export of the shares of LTS %x to %s recorded",
+		inst.InstanceID[:], recovery)
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractLongTermSecretID, buf, darcID)}, coins, nil
+}
+
+// invokeRotate starts a new epoch of the LTS: it creates a new LTS instance
+// from the "lts_instance_info" argument, whose key is created by a new DKG,
+// and records it as the Next of this one. Once rotated, no new write can use
+// this LTS, but the existing writes can still be decrypted.
+func (c *contractLTS) invokeRotate(inst byzcoin.Instruction, curBuf []byte,
+	darcID darc.ID, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	var curInfo, newInfo LtsInstanceInfo
+	err := protobuf.DecodeWithConstructors(curBuf, &curInfo, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("current info is invalid: %v", err)
+	}
+	if curInfo.Next != nil {
+		return nil, nil, xerrors.New("this LTS has already been rotated")
+	}
+	infoBuf := inst.Invoke.Args.Search("lts_instance_info")
+	if len(infoBuf) == 0 {
+		return nil, nil, xerrors.New("need a lts_instance_info argument")
+	}
+	err = protobuf.DecodeWithConstructors(infoBuf, &newInfo, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("passed lts_instance_info argument is invalid: %v", err)
+	}
+	if err := newInfo.verifyRoster(); err != nil {
+		return nil, nil, xerrors.Errorf("the new epoch needs a valid roster: %v", err)
+	}
+	if curInfo.EscrowExport != newInfo.EscrowExport {
+		return nil, nil, xerrors.New("escrow exports cannot be changed")
+	}
+	if curInfo.RSAWrapping != newInfo.RSAWrapping {
+		return nil, nil, xerrors.New("RSA wrapping cannot be changed")
+	}
+	// The shares of the new epoch have not been exported yet, nor reshared.
+	nextID := inst.DeriveID("")
+	newInfo.Exports = nil
+	newInfo.Reshares = nil
+	newInfo.Epoch = curInfo.Epoch + 1
+	newInfo.Previous = &inst.InstanceID
+	newInfo.Next = nil
+	curInfo.Next = &nextID
+	newBuf, err := protobuf.Encode(&newInfo)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding info: %v", err)
+	}
+	curBuf, err = protobuf.Encode(&curInfo)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding info: %v", err)
+	}
+	log.Lvlf2("LTS %x rotated to %x in epoch %d", inst.InstanceID[:],
+		nextID[:], newInfo.Epoch)
+	return byzcoin.StateChanges{
+		byzcoin.NewStateChange(byzcoin.Create, nextID, ContractLongTermSecretID, newBuf, darcID),
+		byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractLongTermSecretID, curBuf, darcID),
+	}, coins, nil
+}
+
 func intersectRosters(r1, r2 *onet.Roster) int {
 	res := 0
 	for _, x := range r2.List {
@@ -226,12 +758,114 @@ func intersectRosters(r1, r2 *onet.Roster) int {
 // registered in the service and apply them.
 func (c ContractWrite) VerifyInstruction(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
 	if inst.GetType() == byzcoin.SpawnType && inst.Spawn.ContractID == ContractReadID {
+		if inst.Spawn.Args.Search("ring") != nil {
+			return c.verifyRingRead(rst, inst, ctxHash)
+		}
+		if inst.Spawn.Args.Search("credential") != nil {
+			return c.verifyDeviceRead(rst, inst, ctxHash)
+		}
 
 		evalAttr := darc.AttrInterpreters{}
 		for _, makeAttrInterpreterWrapper := range readMakeAttrInterpreter {
 			evalAttr[makeAttrInterpreterWrapper.name] = makeAttrInterpreterWrapper.interpreter(c, rst, inst)
 		}
-		return inst.VerifyWithOption(rst, ctxHash, &byzcoin.VerificationOptions{EvalAttr: evalAttr})
+		err := inst.VerifyWithOption(rst, ctxHash, &byzcoin.VerificationOptions{EvalAttr: evalAttr})
+		if err == nil {
+			return nil
+		}
+		if len(c.Write.Groups) > 0 {
+			errGroup := c.verifyGroupRead(rst, inst, ctxHash)
+			if errGroup == nil {
+				return nil
+			}
+			log.Lvl3("not a group read:", errGroup)
+		}
+		agents, errAgent := verifyRecoveryRead(rst, inst, ctxHash)
+		if errAgent != nil {
+			log.Lvl3("not a recovery read:", errAgent)
+			return err
+		}
+		log.Warnf("AUDIT: recovery agents %v spawn a read for write %x",
+			agents, inst.InstanceID[:])
+		return nil
 	}
 	return inst.VerifyWithOption(rst, ctxHash, nil)
 }
+
+// RuleRecovery is the rule of the genesis darc naming the recovery agents
+// of the chain. The identities satisfying it can spawn read-instances for
+// all write-instances of the chain, even if they are not part of their
+// darcs, so that the documents of departed users can be recovered. The rule
+// is usually set at genesis, see AddRecoveryRule, and can only be changed by
+// evolving the genesis darc. Every use is logged by the nodes.
+const RuleRecovery = darc.Action("_calypso_recovery")
+
+// AddRecoveryRule adds the RuleRecovery rule to the darc, usually the
+// genesis darc of a new chain, so that any of the agents can read all
+// documents of the chain.
+func AddRecoveryRule(d *darc.Darc, agents ...darc.Identity) error {
+	if len(agents) == 0 {
+		return xerrors.New("need at least one recovery agent")
+	}
+	var ids []string
+	for _, a := range agents {
+		ids = append(ids, a.String())
+	}
+	return d.Rules.AddRule(RuleRecovery, expression.InitOrExpr(ids...))
+}
+
+// verifyRecoveryRead checks whether the signers of the instruction satisfy
+// the RuleRecovery rule of the genesis darc. It returns the signers if this
+// is the case.
+func verifyRecoveryRead(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) ([]string, error) {
+	_, _, _, darcID, err := rst.GetValues(byzcoin.ConfigInstanceID.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting config instance: %v", err)
+	}
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return nil, xerrors.Errorf("loading genesis darc: %v", err)
+	}
+	expr := d.Rules.Get(RuleRecovery)
+	if expr == nil {
+		return nil, xerrors.New("the genesis darc has no recovery rule")
+	}
+	if len(inst.Signatures) == 0 || len(inst.Signatures) != len(inst.SignerIdentities) {
+		return nil, xerrors.New("need one signature per signer")
+	}
+	err = byzcoin.VerifySignerCounters(rst, inst.SignerCounter, inst.SignerIdentities)
+	if err != nil {
+		return nil, xerrors.Errorf("signer counter: %v", err)
+	}
+	var ids []string
+	for i, id := range inst.SignerIdentities {
+		if err := id.Verify(ctxHash, inst.Signatures[i]); err != nil {
+			return nil, xerrors.Errorf("wrong signature of %s: %v", id, err)
+		}
+		ids = append(ids, id.String())
+	}
+	if err := darc.EvalExpr(expr, trieGetDarc(rst), ids...); err != nil {
+		return nil, xerrors.Errorf("evaluating recovery rule: %v", err)
+	}
+	return ids, nil
+}
+
+// signedBy returns true if the key is one of the signers of the
+// instruction. The signatures have been verified by VerifyInstruction.
+func signedBy(inst byzcoin.Instruction, key kyber.Point) bool {
+	id := darc.NewIdentityEd25519(key)
+	for _, signer := range inst.SignerIdentities {
+		if signer.Equal(&id) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePoint returns true if both points are nil, or if both are equal.
+func samePoint(a, b kyber.Point) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
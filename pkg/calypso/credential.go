@@ -0,0 +1,331 @@
+package calypso
+
+import (
+	"crypto/sha256"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A reader can use more than one device without sharing its primary key
+// between them: every device gets its own key, signed by the primary key and
+// enrolled in a credential instance. The reader lists of the documents only
+// hold the primary key, so enrolling or revoking a device doesn't change
+// them. The signatures of the devices are bound to the ID of the credential,
+// and only the primary key can spawn a credential or change its devices, so
+// that a revoked device cannot come back through another credential.
+
+// ContractCredentialID references a credential contract system-wide.
+const ContractCredentialID = "calypsoCredential"
+
+// contractCredential holds the devices of a reader. It is spawned with the
+// "credential" argument, the "preID" argument its ID is derived from, and
+// the "signature" argument of the primary key on CredentialMessage. It is
+// invoked with "enroll", taking a new device in the "device" argument, or
+// "revoke", taking the key of a device in the "key" argument. The invokes
+// must be signed by the primary key.
+type contractCredential struct {
+	byzcoin.BasicContract
+	Credential
+}
+
+func contractCredentialFromBytes(in []byte) (byzcoin.Contract, error) {
+	c := &contractCredential{}
+	err := protobuf.DecodeWithConstructors(in, &c.Credential,
+		network.DefaultConstructors(cothority.Suite))
+	return c, cothority.ErrorOrNil(err, "couldn't unmarshal credential")
+}
+
+func (c *contractCredential) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	buf := inst.Spawn.Args.Search("credential")
+	if len(buf) == 0 {
+		return nil, nil, xerrors.New("need a credential argument")
+	}
+	var cred Credential
+	err = protobuf.DecodeWithConstructors(buf, &cred,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("passed credential argument is invalid: %v", err)
+	}
+	if cred.Primary == nil {
+		return nil, nil, xerrors.New("credential without primary key")
+	}
+	if len(cred.Revoked) > 0 {
+		return nil, nil, xerrors.New("a new credential cannot have revoked devices")
+	}
+	if inst.Spawn.Args.Search("preID") == nil {
+		return nil, nil, xerrors.New("need a preID argument")
+	}
+	credID, err := inst.DeriveIDArg("", "preID")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("couldn't get ID for instance: %v", err)
+	}
+	msg, err := CredentialMessage(credID, cred.Primary)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = schnorr.Verify(cothority.Suite, cred.Primary, msg,
+		inst.Spawn.Args.Search("signature"))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("wrong signature of primary key: %v", err)
+	}
+	devices := cred.Devices
+	cred.Devices = nil
+	for _, d := range devices {
+		if err := cred.enroll(credID, d); err != nil {
+			return nil, nil, xerrors.Errorf("device %s: %v", d.Name, err)
+		}
+	}
+	buf, err = protobuf.Encode(&cred)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding credential: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create,
+		credID, ContractCredentialID, buf, darcID)}, coins, nil
+}
+
+// VerifyInstruction checks the darc of the credential, and that the invoke
+// is signed by the primary key of the credential.
+func (c *contractCredential) VerifyInstruction(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	if err := c.BasicContract.VerifyInstruction(rst, inst, ctxHash); err != nil {
+		return err
+	}
+	if inst.GetType() != byzcoin.InvokeType {
+		return nil
+	}
+	primary := darc.NewIdentityEd25519(c.Primary)
+	for i, signer := range inst.SignerIdentities {
+		if signer.Equal(&primary) {
+			if err := signer.Verify(ctxHash, inst.Signatures[i]); err != nil {
+				return xerrors.Errorf("wrong signature of primary key: %v", err)
+			}
+			return nil
+		}
+	}
+	return xerrors.New("the primary key didn't sign the instruction")
+}
+
+func (c *contractCredential) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	switch inst.Invoke.Command {
+	case "enroll":
+		var d Device
+		err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("device"),
+			&d, network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("passed device argument is invalid: %v", err)
+		}
+		if err := c.Credential.enroll(inst.InstanceID, d); err != nil {
+			return nil, nil, xerrors.Errorf("enrolling device: %v", err)
+		}
+	case "revoke":
+		key := cothority.Suite.Point()
+		if err := key.UnmarshalBinary(inst.Invoke.Args.Search("key")); err != nil {
+			return nil, nil, xerrors.Errorf("invalid key argument: %v", err)
+		}
+		if err := c.Credential.revoke(key); err != nil {
+			return nil, nil, xerrors.Errorf("revoking device: %v", err)
+		}
+		log.Lvlf2("Revoked device %s of %x", key, inst.InstanceID[:])
+	default:
+		return nil, nil, xerrors.New("can only enroll or revoke devices")
+	}
+	buf, err := protobuf.Encode(&c.Credential)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding credential: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractCredentialID, buf, darcID)}, coins, nil
+}
+
+// enroll adds the device after checking that it has been signed by the
+// primary key for the credential and that it is neither enrolled nor
+// revoked.
+func (cred *Credential) enroll(credID byzcoin.InstanceID, d Device) error {
+	if d.Key == nil {
+		return xerrors.New("device without key")
+	}
+	if cred.device(d.Key) != nil {
+		return xerrors.New("device is already enrolled")
+	}
+	for _, k := range cred.Revoked {
+		if k.Equal(d.Key) {
+			return xerrors.New("device has been revoked")
+		}
+	}
+	if err := cred.verifyDevice(credID, &d); err != nil {
+		return err
+	}
+	cred.Devices = append(cred.Devices, d)
+	return nil
+}
+
+// verifyDevice checks that the device has been signed by the primary key
+// for the credential with the given ID.
+func (cred *Credential) verifyDevice(credID byzcoin.InstanceID, d *Device) error {
+	msg, err := DeviceMessage(credID, cred.Primary, d.Name, d.Key)
+	if err != nil {
+		return err
+	}
+	if err := schnorr.Verify(cothority.Suite, cred.Primary, msg, d.Signature); err != nil {
+		return xerrors.Errorf("wrong signature of primary key: %v", err)
+	}
+	return nil
+}
+
+// revoke removes the device with the given key.
+func (cred *Credential) revoke(key kyber.Point) error {
+	for i, d := range cred.Devices {
+		if d.Key.Equal(key) {
+			cred.Devices = append(cred.Devices[:i], cred.Devices[i+1:]...)
+			cred.Revoked = append(cred.Revoked, key)
+			return nil
+		}
+	}
+	return xerrors.New("device is not enrolled")
+}
+
+// device returns the enrolled device with the given key, or nil.
+func (cred *Credential) device(key kyber.Point) *Device {
+	for i := range cred.Devices {
+		if cred.Devices[i].Key.Equal(key) {
+			return &cred.Devices[i]
+		}
+	}
+	return nil
+}
+
+// CredentialMessage returns the message the primary key signs to spawn the
+// credential with the given ID.
+func CredentialMessage(credID byzcoin.InstanceID, primary kyber.Point) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("calypso-credential"))
+	h.Write(credID[:])
+	if _, err := primary.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling primary key: %v", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// CredentialID returns the ID of the credential spawned with the given
+// "preID" argument, for which the devices are signed.
+func CredentialID(preID []byte) byzcoin.InstanceID {
+	inst := byzcoin.Instruction{Spawn: &byzcoin.Spawn{
+		ContractID: ContractCredentialID,
+		Args:       byzcoin.Arguments{{Name: "preID", Value: preID}},
+	}}
+	id, _ := inst.DeriveIDArg("", "preID")
+	return id
+}
+
+// DeviceMessage returns the message the primary key signs to enroll a
+// device in the credential with the given ID.
+func DeviceMessage(credID byzcoin.InstanceID, primary kyber.Point, name string,
+	key kyber.Point) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("calypso-device"))
+	h.Write(credID[:])
+	if _, err := primary.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling primary key: %v", err)
+	}
+	if _, err := key.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling device key: %v", err)
+	}
+	h.Write([]byte(name))
+	return h.Sum(nil), nil
+}
+
+// NewDevice returns a device with the given name and key, signed by the
+// primary key for the credential with the given ID.
+func NewDevice(primary darc.Signer, credID byzcoin.InstanceID, name string,
+	key kyber.Point) (Device, error) {
+	msg, err := DeviceMessage(credID, primary.Ed25519.Point, name, key)
+	if err != nil {
+		return Device{}, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, primary.Ed25519.Secret, msg)
+	if err != nil {
+		return Device{}, xerrors.Errorf("signing device: %v", err)
+	}
+	return Device{Name: name, Key: key, Signature: sig}, nil
+}
+
+// readCredential returns the credential a read refers to in its
+// "credential" argument and its ID, or nil if the read has none.
+func readCredential(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) (*Credential, byzcoin.InstanceID, error) {
+	id := inst.Spawn.Args.Search("credential")
+	if id == nil {
+		return nil, byzcoin.InstanceID{}, nil
+	}
+	buf, _, contractID, _, err := rst.GetValues(id)
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("getting credential: %v", err)
+	}
+	if contractID != ContractCredentialID {
+		return nil, byzcoin.InstanceID{},
+			xerrors.New("credential argument doesn't point to a credential")
+	}
+	var cred Credential
+	err = protobuf.DecodeWithConstructors(buf, &cred,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, xerrors.Errorf("decoding credential: %v", err)
+	}
+	return &cred, byzcoin.NewInstanceID(id), nil
+}
+
+// verifyDeviceRead checks a read signed by a device. The device must be
+// enrolled in the credential of the read and signed by the primary key for
+// this credential, and the primary key of the credential must satisfy the
+// spawn:calypsoRead rule of the write.
+func (c ContractWrite) verifyDeviceRead(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	cred, credID, err := readCredential(rst, inst)
+	if err != nil {
+		return err
+	}
+	if len(inst.SignerIdentities) != 1 || len(inst.Signatures) != 1 {
+		return xerrors.New("a device read must have exactly one signer")
+	}
+	signer := inst.SignerIdentities[0]
+	if signer.Ed25519 == nil {
+		return xerrors.Errorf("%s is not an enrolled device", signer)
+	}
+	d := cred.device(signer.Ed25519.Point)
+	if d == nil {
+		return xerrors.Errorf("%s is not an enrolled device", signer)
+	}
+	if err := cred.verifyDevice(credID, d); err != nil {
+		return xerrors.Errorf("device %s: %v", d.Name, err)
+	}
+	err = byzcoin.VerifySignerCounters(rst, inst.SignerCounter, inst.SignerIdentities)
+	if err != nil {
+		return xerrors.Errorf("signer counter: %v", err)
+	}
+	if err := signer.Verify(ctxHash, inst.Signatures[0]); err != nil {
+		return xerrors.Errorf("wrong signature: %v", err)
+	}
+
+	expr, getDarc, err := readRule(rst, inst.InstanceID)
+	if err != nil {
+		return err
+	}
+	primary := darc.NewIdentityEd25519(cred.Primary)
+	if err := darc.EvalExpr(expr, getDarc, primary.String()); err != nil {
+		return xerrors.Errorf("%s is not allowed to read: %v", primary, err)
+	}
+	return nil
+}
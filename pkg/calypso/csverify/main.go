@@ -0,0 +1,239 @@
+// csverify is a read-only verifier for calypso write instances. Given the
+// URL of any conode of a ByzCoin chain, the chain ID and a write ID, it
+// fetches the genesis block and a proof for the write, verifies the forward
+// links and their signatures, the proof of the encrypted key and the LTS the
+// write points to, and prints a verdict.
+//
+// It needs neither a conode nor any private key, so it can be used by
+// auditors who only know the ID of the chain they trust.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+var gitTag = "dev"
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "csverify"
+	cliApp.Usage = "Verify a calypso write instance without running a conode."
+	cliApp.ArgsUsage = "write-id"
+	cliApp.Version = gitTag
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+		cli.StringFlag{
+			Name:   "url",
+			EnvVar: "CS_URL",
+			Usage:  "websocket URL of a conode of the chain, e.g. https://conode.example.com",
+		},
+		cli.StringFlag{
+			Name:   "bc",
+			EnvVar: "CS_BC",
+			Usage:  "hex encoded ID of the ByzCoin chain",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+	cliApp.Action = verify
+
+	if err := cliApp.Run(os.Args); err != nil {
+		log.Fatalf("error: %+v", err)
+	}
+}
+
+func verify(c *cli.Context) error {
+	if c.String("url") == "" {
+		return xerrors.New("--url is required")
+	}
+	bcID, err := hex.DecodeString(c.String("bc"))
+	if err != nil || len(bcID) == 0 {
+		return xerrors.New("--bc must be the hex encoded ID of the chain")
+	}
+	writeID, err := hex.DecodeString(c.Args().First())
+	if err != nil || len(writeID) != len(byzcoin.InstanceID{}) {
+		return xerrors.New("please give the hex encoded write ID as argument")
+	}
+
+	v := newVerifier(c.String("url"), skipchain.SkipBlockID(bcID),
+		byzcoin.NewInstanceID(writeID))
+	v.run()
+	v.print(c.App.Writer)
+	if !v.ok() {
+		return xerrors.New("write instance could NOT be verified")
+	}
+	return nil
+}
+
+// check is the outcome of a single verification step.
+type check struct {
+	name   string
+	detail string
+	err    error
+}
+
+// verifier runs the verification steps in order and records their
+// outcome. A step is only run if all steps before it succeeded.
+type verifier struct {
+	url     string
+	bcID    skipchain.SkipBlockID
+	writeID byzcoin.InstanceID
+
+	checks  []check
+	genesis *skipchain.SkipBlock
+	cl      *byzcoin.Client
+	write   calypso.Write
+	darcID  darc.ID
+}
+
+func newVerifier(url string, bcID skipchain.SkipBlockID,
+	writeID byzcoin.InstanceID) *verifier {
+	return &verifier{url: url, bcID: bcID, writeID: writeID}
+}
+
+func (v *verifier) run() {
+	steps := []struct {
+		name string
+		f    func() (string, error)
+	}{
+		{"genesis block", v.checkGenesis},
+		{"write proof", v.checkWriteProof},
+		{"encrypted key", v.checkWrite},
+		{"long term secret", v.checkLTS},
+	}
+	for _, s := range steps {
+		detail, err := s.f()
+		v.checks = append(v.checks, check{s.name, detail, err})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (v *verifier) ok() bool {
+	for _, c := range v.checks {
+		if c.err != nil {
+			return false
+		}
+	}
+	return len(v.checks) > 0
+}
+
+// checkGenesis fetches the genesis block from the given URL. The block is
+// only trusted because its hash is the chain ID given by the user; the URL
+// itself is not trusted.
+func (v *verifier) checkGenesis() (string, error) {
+	si := &network.ServerIdentity{URL: v.url}
+	ro := &onet.Roster{List: []*network.ServerIdentity{si}}
+	sb, err := skipchain.NewClient().GetSingleBlock(ro, v.bcID)
+	if err != nil {
+		return "", xerrors.Errorf("couldn't fetch genesis block: %v", err)
+	}
+	if sb.Index != 0 || !sb.CalculateHash().Equal(v.bcID) {
+		return "", xerrors.New("returned block is not the genesis block of the chain")
+	}
+	if sb.Roster == nil || len(sb.Roster.List) == 0 {
+		return "", xerrors.New("genesis block has no roster")
+	}
+	v.genesis = sb
+	v.cl = byzcoin.NewClient(v.bcID, *sb.Roster)
+	v.cl.Genesis = sb
+	return fmt.Sprintf("%d nodes in the initial roster", len(sb.Roster.List)), nil
+}
+
+// checkWriteProof verifies the chain of forward links from the genesis
+// block to the latest block and the inclusion of the write instance.
+func (v *verifier) checkWriteProof() (string, error) {
+	pr, err := v.getProof(v.writeID, calypso.ContractWriteID, &v.write)
+	if err != nil {
+		return "", err
+	}
+	_, _, _, v.darcID, err = pr.KeyValue()
+	if err != nil {
+		return "", xerrors.Errorf("couldn't read proof: %v", err)
+	}
+	return fmt.Sprintf("included up to block %d, %d forward links verified",
+		pr.Latest.Index, len(pr.Links)-1), nil
+}
+
+// checkWrite verifies the proof that the writer correctly encrypted the key
+// and bound it to the darc of the instance.
+func (v *verifier) checkWrite() (string, error) {
+	if err := v.write.CheckProof(cothority.Suite, v.darcID); err != nil {
+		return "", xerrors.Errorf("proof of encrypted key is invalid: %v", err)
+	}
+	detail := fmt.Sprintf("bound to darc %x", []byte(v.darcID))
+	if v.write.Next != nil {
+		detail += fmt.Sprintf(", superseded by %x", v.write.Next.Slice())
+	}
+	return detail, nil
+}
+
+// checkLTS verifies that the LTS the write points to exists on the same
+// chain.
+func (v *verifier) checkLTS() (string, error) {
+	var info calypso.LtsInstanceInfo
+	if _, err := v.getProof(v.write.LTSID, calypso.ContractLongTermSecretID,
+		&info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("LTS %x held by %d nodes", v.write.LTSID.Slice(),
+		len(info.Roster.List)), nil
+}
+
+// getProof fetches a proof for the given instance, verifies it against the
+// genesis block and decodes the value of the instance.
+func (v *verifier) getProof(id byzcoin.InstanceID, cid string,
+	value interface{}) (*byzcoin.Proof, error) {
+	reply, err := v.cl.GetProof(id.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't fetch proof: %v", err)
+	}
+	pr := reply.Proof
+	if err := pr.VerifyFromBlock(v.genesis); err != nil {
+		return nil, xerrors.Errorf("proof is invalid: %v", err)
+	}
+	if !pr.InclusionProof.Match(id.Slice()) {
+		return nil, xerrors.New("instance does not exist")
+	}
+	if err := pr.VerifyAndDecode(cothority.Suite, cid, value); err != nil {
+		return nil, xerrors.Errorf("couldn't decode instance: %v", err)
+	}
+	return &pr, nil
+}
+
+func (v *verifier) print(w io.Writer) {
+	fmt.Fprintf(w, "Chain: %x\nWrite: %x\n\n", v.bcID, v.writeID.Slice())
+	for _, c := range v.checks {
+		if c.err != nil {
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", c.name, c.err)
+		} else {
+			fmt.Fprintf(w, "[ OK ] %s: %s\n", c.name, c.detail)
+		}
+	}
+	if v.ok() {
+		fmt.Fprintln(w, "\nVerdict: the write instance is VALID")
+	} else {
+		fmt.Fprintln(w, "\nVerdict: the write instance is INVALID")
+	}
+}
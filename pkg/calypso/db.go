@@ -3,12 +3,13 @@ package calypso
 import (
 	"sync"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	dkgprotocol "github.com/calypso-demo/filesharing/pkg/protocols/dkg/pedersen"
 	dkg "go.dedis.ch/kyber/v3/share/dkg/pedersen"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 )
 
@@ -18,24 +19,177 @@ const dbVersion = 1
 // than one structure.
 var storageKey = []byte("storage")
 
-// storage is used to save all elements of the DKG.
+// storage is used to save all elements of the DKG. Requests that only read
+// it take the read lock, so that they don't wait on each other. The entries
+// of the maps are replaced, but never modified once stored.
 type storage struct {
 	AuthorisedByzCoinIDs map[string]bool
+	// ByzCoinNamespaces maps the ByzCoinIDs to their namespace. ByzCoinIDs
+	// of the default namespace are not stored.
+	ByzCoinNamespaces map[string]string
+	Namespaces        map[string]*namespace
+	// Escrow holds the admins allowed to export the shares of this node.
+	Escrow *escrow `protobuf:"opt"`
+	// Revoked maps the identities revoked by RevokeIdentity to the time of
+	// their revocation, in Unix seconds.
+	Revoked map[string]int64
+	// ExternalRosters maps the ByzCoinIDs of the chains hosted by another
+	// cothority to the roster of this cothority, see AuthorizeExternal.
+	ExternalRosters map[string]*onet.Roster `protobuf:"opt"`
+	// VerifiedBlocks maps the hashes of the blocks whose forward links have
+	// been verified from the genesis block to their ByzCoinID, so that the
+	// proofs ending in these blocks only need their inclusion proof to be
+	// checked.
+	VerifiedBlocks map[string]string `protobuf:"opt"`
 
 	Shared  map[byzcoin.InstanceID]*dkgprotocol.SharedSecret
 	Polys   map[byzcoin.InstanceID]*pubPoly
 	Rosters map[byzcoin.InstanceID]*onet.Roster
 	Replies map[byzcoin.InstanceID]*CreateLTSReply
 	DKS     map[byzcoin.InstanceID]*dkg.DistKeyShare
+	// Holders maps the LTSs to the roster of their latest DKG, in which
+	// the position of a node is the index of its share.
+	Holders map[byzcoin.InstanceID]*onet.Roster `protobuf:"opt"`
+	// LTSNamespaces maps the LTSs to the namespace they have been created
+	// in. LTSs of the default namespace are not stored.
+	LTSNamespaces map[byzcoin.InstanceID]string `protobuf:"opt"`
+	// Weights maps the LTSs with weights to the number of shares of the
+	// nodes of their roster in Rosters.
+	Weights map[byzcoin.InstanceID]*shareWeights `protobuf:"opt"`
+
+	sync.RWMutex
+}
+
+// allocate makes sure that none of the maps of the storage is nil.
+func (st *storage) allocate() {
+	if len(st.Polys) == 0 {
+		st.Polys = make(map[byzcoin.InstanceID]*pubPoly)
+	}
+	if len(st.Shared) == 0 {
+		st.Shared = make(map[byzcoin.InstanceID]*dkgprotocol.SharedSecret)
+	}
+	if len(st.Rosters) == 0 {
+		st.Rosters = make(map[byzcoin.InstanceID]*onet.Roster)
+	}
+	if len(st.Replies) == 0 {
+		st.Replies = make(map[byzcoin.InstanceID]*CreateLTSReply)
+	}
+	if len(st.DKS) == 0 {
+		st.DKS = make(map[byzcoin.InstanceID]*dkg.DistKeyShare)
+	}
+	if len(st.AuthorisedByzCoinIDs) == 0 {
+		st.AuthorisedByzCoinIDs = make(map[string]bool)
+	}
+	if len(st.ByzCoinNamespaces) == 0 {
+		st.ByzCoinNamespaces = make(map[string]string)
+	}
+	if len(st.Namespaces) == 0 {
+		st.Namespaces = make(map[string]*namespace)
+	}
+	if len(st.Revoked) == 0 {
+		st.Revoked = make(map[string]int64)
+	}
+	if len(st.ExternalRosters) == 0 {
+		st.ExternalRosters = make(map[string]*onet.Roster)
+	}
+	if len(st.VerifiedBlocks) == 0 {
+		st.VerifiedBlocks = make(map[string]string)
+	}
+	if len(st.Holders) == 0 {
+		st.Holders = make(map[byzcoin.InstanceID]*onet.Roster)
+	}
+	if len(st.LTSNamespaces) == 0 {
+		st.LTSNamespaces = make(map[byzcoin.InstanceID]string)
+	}
+	if len(st.Weights) == 0 {
+		st.Weights = make(map[byzcoin.InstanceID]*shareWeights)
+	}
+}
 
-	sync.Mutex
+// forgetVerifiedBlocks removes the verified blocks of the chain, so that
+// they are verified again. It must be called with the lock held.
+func (st *storage) forgetVerifiedBlocks(bcID string) {
+	for hash, id := range st.VerifiedBlocks {
+		if id == bcID {
+			delete(st.VerifiedBlocks, hash)
+		}
+	}
+}
+
+// snapshot returns a copy of the storage that can be saved without holding
+// its lock. Only the maps are copied, as their entries are never modified.
+func (st *storage) snapshot() *storage {
+	st.RLock()
+	defer st.RUnlock()
+	c := &storage{
+		AuthorisedByzCoinIDs: make(map[string]bool, len(st.AuthorisedByzCoinIDs)),
+		ByzCoinNamespaces:    make(map[string]string, len(st.ByzCoinNamespaces)),
+		Namespaces:           make(map[string]*namespace, len(st.Namespaces)),
+		Escrow:               st.Escrow,
+		Revoked:              make(map[string]int64, len(st.Revoked)),
+		ExternalRosters:      make(map[string]*onet.Roster, len(st.ExternalRosters)),
+		VerifiedBlocks:       make(map[string]string, len(st.VerifiedBlocks)),
+		Shared:               make(map[byzcoin.InstanceID]*dkgprotocol.SharedSecret, len(st.Shared)),
+		Polys:                make(map[byzcoin.InstanceID]*pubPoly, len(st.Polys)),
+		Rosters:              make(map[byzcoin.InstanceID]*onet.Roster, len(st.Rosters)),
+		Replies:              make(map[byzcoin.InstanceID]*CreateLTSReply, len(st.Replies)),
+		DKS:                  make(map[byzcoin.InstanceID]*dkg.DistKeyShare, len(st.DKS)),
+		Holders:              make(map[byzcoin.InstanceID]*onet.Roster, len(st.Holders)),
+		LTSNamespaces:        make(map[byzcoin.InstanceID]string, len(st.LTSNamespaces)),
+		Weights:              make(map[byzcoin.InstanceID]*shareWeights, len(st.Weights)),
+	}
+	for k, v := range st.AuthorisedByzCoinIDs {
+		c.AuthorisedByzCoinIDs[k] = v
+	}
+	for k, v := range st.ByzCoinNamespaces {
+		c.ByzCoinNamespaces[k] = v
+	}
+	for k, v := range st.Namespaces {
+		c.Namespaces[k] = v
+	}
+	for k, v := range st.Revoked {
+		c.Revoked[k] = v
+	}
+	for k, v := range st.ExternalRosters {
+		c.ExternalRosters[k] = v
+	}
+	for k, v := range st.VerifiedBlocks {
+		c.VerifiedBlocks[k] = v
+	}
+	for k, v := range st.Shared {
+		c.Shared[k] = v
+	}
+	for k, v := range st.Polys {
+		c.Polys[k] = v
+	}
+	for k, v := range st.Rosters {
+		c.Rosters[k] = v
+	}
+	for k, v := range st.Replies {
+		c.Replies[k] = v
+	}
+	for k, v := range st.DKS {
+		c.DKS[k] = v
+	}
+	for k, v := range st.Holders {
+		c.Holders[k] = v
+	}
+	for k, v := range st.LTSNamespaces {
+		c.LTSNamespaces[k] = v
+	}
+	for k, v := range st.Weights {
+		c.Weights[k] = v
+	}
+	return c
 }
 
-// saves all data.
+// saves all data. The storage is copied under its read lock and encoded
+// without it, so that the requests don't wait on the db. saveLock makes sure
+// that an older copy never overwrites a newer one.
 func (s *Service) save() error {
-	s.storage.Lock()
-	defer s.storage.Unlock()
-	err := s.Save(storageKey, s.storage)
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	err := s.Save(storageKey, s.storage.snapshot())
 	if err != nil {
 		log.Error("Couldn't save data:", err)
 		return xerrors.Errorf("saving data: %v", err)
@@ -43,6 +197,65 @@ func (s *Service) save() error {
 	return nil
 }
 
+// verifiedJournalName is the name of the journal of the verified blocks.
+// As a block is verified for most decryptions, the new verified blocks are
+// appended to the journal, and only saved with the storage once the journal
+// holds compactAfter records.
+const verifiedJournalName = "verified-journal"
+
+// verifiedRecord is a block added to storage.VerifiedBlocks.
+type verifiedRecord struct {
+	Hash      []byte
+	ByzCoinID []byte
+}
+
+// journalVerifiedBlock appends the block to the journal of the verified
+// blocks, and compacts the journal if needed.
+func (s *Service) journalVerifiedBlock(hash, bcID []byte) error {
+	next, size, err := s.verifiedJournal.append(&verifiedRecord{Hash: hash,
+		ByzCoinID: bcID})
+	if err != nil {
+		return xerrors.Errorf("saving verified block: %v", err)
+	}
+	if size < compactAfter {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	return cothority.ErrorOrNil(s.verifiedJournal.truncate(next),
+		"compacting verified blocks")
+}
+
+// tryLoadVerifiedBlocks opens the journal of the verified blocks and adds
+// its blocks to the storage.
+func (s *Service) tryLoadVerifiedBlocks() error {
+	j, err := s.newJournal(verifiedJournalName)
+	if err != nil {
+		return xerrors.Errorf("loading verified blocks: %v", err)
+	}
+	s.verifiedJournal = j
+	return s.replayVerifiedBlocks()
+}
+
+// replayVerifiedBlocks adds the blocks of the journal to the storage.
+func (s *Service) replayVerifiedBlocks() error {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	err := s.verifiedJournal.replay(0, func(buf []byte) error {
+		var r verifiedRecord
+		if err := protobuf.Decode(buf, &r); err != nil {
+			return xerrors.Errorf("decoding verified block: %v", err)
+		}
+		if len(s.storage.VerifiedBlocks) >= maxVerifiedBlocks {
+			s.storage.VerifiedBlocks = make(map[string]string)
+		}
+		s.storage.VerifiedBlocks[string(r.Hash)] = string(r.ByzCoinID)
+		return nil
+	})
+	return cothority.ErrorOrNil(err, "replaying verified blocks")
+}
+
 // Tries to load the configuration and updates the data in the service
 // if it finds a valid config-file.
 func (s *Service) tryLoad() error {
@@ -52,26 +265,10 @@ func (s *Service) tryLoad() error {
 		return xerrors.Errorf("loading configuration: %v", err)
 	}
 
-	// Make sure we don't have any unallocated maps.
+	// Make sure we don't have any unallocated maps. As s.storage is
+	// replaced when loading, it is only read when returning.
 	defer func() {
-		if len(s.storage.Polys) == 0 {
-			s.storage.Polys = make(map[byzcoin.InstanceID]*pubPoly)
-		}
-		if len(s.storage.Shared) == 0 {
-			s.storage.Shared = make(map[byzcoin.InstanceID]*dkgprotocol.SharedSecret)
-		}
-		if len(s.storage.Rosters) == 0 {
-			s.storage.Rosters = make(map[byzcoin.InstanceID]*onet.Roster)
-		}
-		if len(s.storage.Replies) == 0 {
-			s.storage.Replies = make(map[byzcoin.InstanceID]*CreateLTSReply)
-		}
-		if len(s.storage.DKS) == 0 {
-			s.storage.DKS = make(map[byzcoin.InstanceID]*dkg.DistKeyShare)
-		}
-		if len(s.storage.AuthorisedByzCoinIDs) == 0 {
-			s.storage.AuthorisedByzCoinIDs = make(map[string]bool)
-		}
+		s.storage.allocate()
 	}()
 
 	// In the future, we'll make database upgrades below.
@@ -0,0 +1,93 @@
+package calypso
+
+import (
+	"crypto/sha256"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// Blocks, proofs and verification data are sent by other nodes and by
+// clients, so they can hold anything. The functions of this file decode them
+// and check the fields the service relies on, returning an error instead of
+// panicking on malformed input.
+
+// decode decodes buf into v. A panic of the decoder is returned as an error.
+func decode(buf []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = xerrors.Errorf("malformed data: %v", r)
+		}
+	}()
+	return protobuf.DecodeWithConstructors(buf, v,
+		network.DefaultConstructors(cothority.Suite))
+}
+
+// decodeRead decodes a read and checks that it has a key to re-encrypt to,
+// or a commitment to it.
+func decodeRead(buf []byte) (*Read, error) {
+	if len(buf) == 0 {
+		return nil, xerrors.New("empty read")
+	}
+	var rd Read
+	if err := decode(buf, &rd); err != nil {
+		return nil, xerrors.Errorf("decoding read: %v", err)
+	}
+	if rd.blinded() {
+		if rd.Xc != nil || len(rd.Commitment) != sha256.Size {
+			return nil, xerrors.New("invalid commitment of blinded read")
+		}
+	} else if rd.Xc == nil {
+		return nil, xerrors.New("read without reader key")
+	}
+	return &rd, nil
+}
+
+// decodeReadProof returns the read proven by the proof.
+func decodeReadProof(p *byzcoin.Proof) (*Read, error) {
+	_, buf, contractID, _, err := p.KeyValue()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid proof: %v", err)
+	}
+	if contractID != ContractReadID {
+		return nil, xerrors.New("proof doesn't point to read instance")
+	}
+	return decodeRead(buf)
+}
+
+// decodeVerificationData decodes the verification data of a re-encryption
+// and returns it together with the read it proves.
+func decodeVerificationData(buf *[]byte) (*vData, *Read, error) {
+	if buf == nil || len(*buf) == 0 {
+		return nil, nil, xerrors.New("missing verification data")
+	}
+	var vd vData
+	if err := decode(*buf, &vd); err != nil {
+		return nil, nil, xerrors.Errorf("decoding verification data: %v", err)
+	}
+	rd, err := decodeReadProof(&vd.Proof)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &vd, rd, nil
+}
+
+// decodeBlock returns the header and the body of a ByzCoin block.
+func decodeBlock(sb *skipchain.SkipBlock) (*byzcoin.DataHeader, *byzcoin.DataBody, error) {
+	if sb == nil || sb.SkipBlockFix == nil {
+		return nil, nil, xerrors.New("missing block")
+	}
+	var header byzcoin.DataHeader
+	if err := decode(sb.Data, &header); err != nil {
+		return nil, nil, xerrors.Errorf("decoding header: %v", err)
+	}
+	var body byzcoin.DataBody
+	if err := decode(sb.Payload, &body); err != nil {
+		return nil, nil, xerrors.Errorf("decoding body: %v", err)
+	}
+	return &header, &body, nil
+}
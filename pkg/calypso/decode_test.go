@@ -0,0 +1,104 @@
+package calypso
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/protobuf"
+)
+
+// mutations returns the corpus derived from a valid encoding: all its
+// prefixes, the encoding with every byte flipped in turn, and random
+// buffers not longer than the encoding.
+func mutations(rnd *rand.Rand, buf []byte) [][]byte {
+	var corpus [][]byte
+	for i := 0; i < len(buf); i++ {
+		corpus = append(corpus, buf[:i])
+		flipped := append([]byte{}, buf...)
+		flipped[i] ^= 0xff
+		corpus = append(corpus, flipped)
+	}
+	for i := 0; i < 100; i++ {
+		random := make([]byte, rnd.Intn(len(buf)+1))
+		rnd.Read(random)
+		corpus = append(corpus, random)
+	}
+	return corpus
+}
+
+func TestDecode_Corpus(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	signer := darc.NewSignerEd25519(nil, nil)
+
+	readBuf, err := protobuf.Encode(&Read{Write: byzcoin.NewInstanceID([]byte("write")),
+		Xc: signer.Ed25519.Point})
+	require.NoError(t, err)
+	rd, err := decodeRead(readBuf)
+	require.NoError(t, err)
+	require.True(t, rd.Xc.Equal(signer.Ed25519.Point))
+	for _, buf := range mutations(rnd, readBuf) {
+		decodeRead(buf)
+	}
+	noKey, err := protobuf.Encode(&Read{})
+	require.NoError(t, err)
+	_, err = decodeRead(noKey)
+	require.Error(t, err)
+
+	vdBuf, err := protobuf.Encode(&vData{Ephemeral: signer.Ed25519.Point})
+	require.NoError(t, err)
+	_, _, err = decodeVerificationData(&vdBuf)
+	require.Error(t, err)
+	_, _, err = decodeVerificationData(nil)
+	require.Error(t, err)
+	for _, buf := range mutations(rnd, vdBuf) {
+		decodeVerificationData(&buf)
+	}
+
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID([]byte("write")),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+			},
+			SignerCounter: []uint64{1},
+		})
+	require.NoError(t, ctx.FillSignersAndSignWith(signer))
+	header, err := protobuf.Encode(&byzcoin.DataHeader{Timestamp: 1})
+	require.NoError(t, err)
+	body, err := protobuf.Encode(&byzcoin.DataBody{TxResults: byzcoin.TxResults{
+		{ClientTransaction: ctx, Accepted: true}}})
+	require.NoError(t, err)
+	sb := skipchain.NewSkipBlock()
+	sb.Data = header
+	sb.Payload = body
+	_, dec, err := decodeBlock(sb)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dec.TxResults))
+	_, _, err = decodeBlock(&skipchain.SkipBlock{})
+	require.Error(t, err)
+
+	for _, buf := range mutations(rnd, body) {
+		sb.Payload = buf
+		_, dec, err := decodeBlock(sb)
+		if err != nil {
+			continue
+		}
+		for _, tx := range dec.TxResults {
+			for _, inst := range tx.ClientTransaction.Instructions {
+				if inst.GetType() == byzcoin.SpawnType {
+					decodeRead(inst.Spawn.Args.Search("read"))
+				}
+			}
+		}
+	}
+	sb.Payload = body
+	for _, buf := range mutations(rnd, header) {
+		sb.Data = buf
+		decodeBlock(sb)
+	}
+}
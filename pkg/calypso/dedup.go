@@ -0,0 +1,244 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/suites"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// EncryptFile encrypts every document under its own key, so the same file
+// uploaded twice is stored twice. EncryptFileDedup uses convergent
+// encryption instead: every chunk is encrypted under a key derived from its
+// hash and from a secret shared by the writers of a chain, so that
+// identical chunks give identical encrypted chunks, which are stored once in
+// a BlobStore under the hash of the encrypted chunk. Without the secret,
+// nobody can check whether a given file is stored.
+//
+// The document itself is a manifest listing the IDs and the keys of its
+// chunks. The manifest is encrypted like EncryptFile does, under the key of
+// the write, so only the readers of the document learn the keys of its
+// chunks.
+
+// ConvergentSecretLength is the length of the secret of a chain used to
+// derive the keys of the chunks.
+const ConvergentSecretLength = 32
+
+// NewConvergentSecret returns a new secret for EncryptFileDedup. It must be
+// shared by all writers whose documents are deduplicated together.
+func NewConvergentSecret() ([]byte, error) {
+	secret := make([]byte, ConvergentSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, xerrors.Errorf("creating secret: %v", err)
+	}
+	return secret, nil
+}
+
+// BlobStore stores encrypted chunks under their ID, which is the SHA-256 of
+// the encrypted chunk.
+type BlobStore interface {
+	// Has returns true if the chunk is stored.
+	Has(id []byte) (bool, error)
+	// Put stores the chunk.
+	Put(id, data []byte) error
+	// Get returns the chunk.
+	Get(id []byte) ([]byte, error)
+}
+
+// MemoryBlobStore is a BlobStore holding the chunks in memory.
+type MemoryBlobStore struct {
+	chunks map[string][]byte
+	sync.Mutex
+}
+
+// NewMemoryBlobStore returns an empty MemoryBlobStore.
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{chunks: make(map[string][]byte)}
+}
+
+// Has implements BlobStore.
+func (ms *MemoryBlobStore) Has(id []byte) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.chunks[hex.EncodeToString(id)]
+	return ok, nil
+}
+
+// Put implements BlobStore.
+func (ms *MemoryBlobStore) Put(id, data []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.chunks[hex.EncodeToString(id)] = append([]byte{}, data...)
+	return nil
+}
+
+// Get implements BlobStore.
+func (ms *MemoryBlobStore) Get(id []byte) ([]byte, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	data, ok := ms.chunks[hex.EncodeToString(id)]
+	if !ok {
+		return nil, xerrors.Errorf("unknown chunk %x", id)
+	}
+	return data, nil
+}
+
+// Len returns the number of chunks stored.
+func (ms *MemoryBlobStore) Len() int {
+	ms.Lock()
+	defer ms.Unlock()
+	return len(ms.chunks)
+}
+
+// dedupManifest lists the chunks of a deduplicated document.
+type dedupManifest struct {
+	Chunks []dedupChunk
+}
+
+// dedupChunk is the ID of a chunk in the BlobStore and its key.
+type dedupChunk struct {
+	ID  []byte
+	Key []byte
+}
+
+// chunkKey returns the convergent key of the chunk.
+func chunkKey(secret, chunk []byte) []byte {
+	hash := sha256.Sum256(chunk)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("calypso-dedup-chunk"))
+	mac.Write(hash[:])
+	return mac.Sum(nil)
+}
+
+// chunkAEAD returns the cipher of a chunk. As the key is only used for one
+// content, the nonce is always zero.
+func chunkAEAD(key []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("creating cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("creating cipher: %v", err)
+	}
+	return aead, make([]byte, aead.NonceSize()), nil
+}
+
+// EncryptFileDedup works like EncryptFile, but stores the encrypted chunks
+// of the document read from r in the store, skipping the chunks it already
+// holds, and only writes the encrypted manifest to w. The secret is the
+// one of the chain, as returned by NewConvergentSecret.
+func EncryptFileDedup(suite suites.Suite, ltsid byzcoin.InstanceID,
+	writeDarc darc.ID, X kyber.Point, secret []byte, r io.Reader,
+	store BlobStore, w io.Writer) (*Write, []byte, error) {
+	if len(secret) != ConvergentSecretLength {
+		return nil, nil, xerrors.New("wrong length of the convergent secret")
+	}
+	key := make([]byte, fileKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, xerrors.Errorf("creating key: %v", err)
+	}
+	write := NewWrite(suite, ltsid, writeDarc, X, key)
+	if write == nil {
+		return nil, nil, xerrors.New("key is too long for the suite")
+	}
+	var manifest dedupManifest
+	buf := make([]byte, fileChunkSize)
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, nil, xerrors.Errorf("reading document: %v", err)
+		}
+		if n > 0 {
+			chunk, err := storeChunk(secret, buf[:n], store)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("storing chunk %d: %v", index, err)
+			}
+			manifest.Chunks = append(manifest.Chunks, *chunk)
+		}
+		if last {
+			break
+		}
+	}
+	mBuf, err := protobuf.Encode(&manifest)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding manifest: %v", err)
+	}
+	write.DataRoot, err = sealChunks(key, bytes.NewReader(mBuf), w)
+	if err != nil {
+		return nil, nil, err
+	}
+	return write, key, nil
+}
+
+// storeChunk encrypts the chunk under its convergent key and stores it, if
+// the store doesn't hold it yet.
+func storeChunk(secret, pt []byte, store BlobStore) (*dedupChunk, error) {
+	key := chunkKey(secret, pt)
+	aead, nonce, err := chunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, nonce, pt, nil)
+	id := sha256.Sum256(ct)
+	ok, err := store.Has(id[:])
+	if err != nil {
+		return nil, xerrors.Errorf("looking up chunk: %v", err)
+	}
+	if !ok {
+		if err := store.Put(id[:], ct); err != nil {
+			return nil, xerrors.Errorf("putting chunk: %v", err)
+		}
+	}
+	return &dedupChunk{ID: id[:], Key: key}, nil
+}
+
+// DecryptFileDedup decrypts the manifest read from r with the symmetric key
+// of the write, and writes the chunks it lists, fetched from the store, to
+// w. Like for DecryptFile, w must be discarded if an error is returned.
+func DecryptFileDedup(wr *Write, key []byte, store BlobStore, r io.Reader,
+	w io.Writer) error {
+	var mBuf bytes.Buffer
+	if err := DecryptFile(wr, key, r, &mBuf); err != nil {
+		return xerrors.Errorf("decrypting manifest: %v", err)
+	}
+	var manifest dedupManifest
+	if err := protobuf.Decode(mBuf.Bytes(), &manifest); err != nil {
+		return xerrors.Errorf("decoding manifest: %v", err)
+	}
+	for i, chunk := range manifest.Chunks {
+		ct, err := store.Get(chunk.ID)
+		if err != nil {
+			return xerrors.Errorf("getting chunk %d: %v", i, err)
+		}
+		id := sha256.Sum256(ct)
+		if !bytes.Equal(id[:], chunk.ID) {
+			return xerrors.Errorf("chunk %d doesn't match its ID", i)
+		}
+		aead, nonce, err := chunkAEAD(chunk.Key)
+		if err != nil {
+			return err
+		}
+		pt, err := aead.Open(nil, nonce, ct, nil)
+		if err != nil {
+			return xerrors.Errorf("decrypting chunk %d: %v", i, err)
+		}
+		if _, err := w.Write(pt); err != nil {
+			return xerrors.Errorf("writing chunk %d: %v", i, err)
+		}
+	}
+	return nil
+}
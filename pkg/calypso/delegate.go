@@ -0,0 +1,185 @@
+package calypso
+
+import (
+	"crypto/sha256"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A reader can let another key decrypt the secret of its read without
+// involving the writer: it signs a Delegation to the key of the delegate,
+// which can in turn delegate to another key. Every delegation is recorded in
+// the read instance with the "delegate" invoke, signed by the key holding
+// the read, and the trustees re-encrypt the secret to the last delegate
+// recorded in the proof of the read, after checking every signature.
+// Revoking a key of the chain revokes all delegations made after it.
+
+// maxDelegations is the longest chain of delegations accepted.
+const maxDelegations = 8
+
+// delegationMessage returns the message signed by the key from to delegate
+// the read to the key to.
+func delegationMessage(readID byzcoin.InstanceID, from, to kyber.Point) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("calypso-delegation"))
+	h.Write(readID[:])
+	if _, err := from.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling key: %v", err)
+	}
+	if _, err := to.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling delegate: %v", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// NewDelegation returns the delegation of the read to the key of the
+// delegate, signed by from, which must be the private key of the reader or
+// of the last delegate of the chain.
+func NewDelegation(readID byzcoin.InstanceID, from kyber.Scalar, delegate kyber.Point) (Delegation, error) {
+	msg, err := delegationMessage(readID,
+		cothority.Suite.Point().Mul(from, nil), delegate)
+	if err != nil {
+		return Delegation{}, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, from, msg)
+	if err != nil {
+		return Delegation{}, xerrors.Errorf("signing delegation: %v", err)
+	}
+	return Delegation{Delegate: delegate, Signature: sig}, nil
+}
+
+// holder returns the key the secret of the read is re-encrypted to: the
+// last delegate recorded in the read, or the key of the reader.
+func (rd *Read) holder() kyber.Point {
+	if n := len(rd.Delegations); n > 0 {
+		return rd.Delegations[n-1].Delegate
+	}
+	return rd.Xc
+}
+
+// delegate checks the chain of delegations recorded in the read and sets
+// the key of the read to the last delegate. It returns the keys that
+// delegated the read, starting with the key of the reader.
+func (rd *Read) delegate(readID byzcoin.InstanceID) ([]kyber.Point, error) {
+	ds := rd.Delegations
+	if len(ds) == 0 {
+		return nil, nil
+	}
+	if len(ds) > maxDelegations {
+		return nil, xerrors.Errorf("more than %d delegations", maxDelegations)
+	}
+	if rd.Xc == nil {
+		return nil, xerrors.New("read without key")
+	}
+	var from []kyber.Point
+	for i, d := range ds {
+		if d.Delegate == nil {
+			return nil, xerrors.Errorf("delegation %d without delegate", i)
+		}
+		msg, err := delegationMessage(readID, rd.Xc, d.Delegate)
+		if err != nil {
+			return nil, err
+		}
+		if err := schnorr.Verify(cothority.Suite, rd.Xc, msg, d.Signature); err != nil {
+			return nil, xerrors.Errorf("verifying delegation %d: %v", i, err)
+		}
+		from = append(from, rd.Xc)
+		rd.Xc = d.Delegate
+	}
+	return from, nil
+}
+
+// delegateRead applies the delegations recorded in the read and makes sure
+// none of the keys that delegated it has been revoked.
+func (s *Service) delegateRead(bcID skipchain.SkipBlockID, rd *Read,
+	readID byzcoin.InstanceID) error {
+	from, err := rd.delegate(readID)
+	if err != nil {
+		return err
+	}
+	for _, key := range from {
+		if err := s.checkRevoked(bcID, key, rd, readID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyInstruction checks that a "delegate" invoke is signed by the key
+// holding the read, instead of the darc of the read, so that the writer
+// doesn't need to take part.
+func (c *ContractRead) VerifyInstruction(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	if inst.GetType() != byzcoin.InvokeType || inst.Invoke.Command != "delegate" {
+		return c.BasicContract.VerifyInstruction(rst, inst, ctxHash)
+	}
+	holder := c.Read.holder()
+	if holder == nil {
+		return xerrors.New("a blinded read cannot be delegated")
+	}
+	if len(inst.SignerIdentities) != 1 || len(inst.Signatures) != 1 {
+		return xerrors.New("a delegation must have exactly one signer")
+	}
+	signer := inst.SignerIdentities[0]
+	id := darc.NewIdentityEd25519(holder)
+	if !signer.Equal(&id) {
+		return xerrors.Errorf("%s doesn't hold the read", signer)
+	}
+	err := byzcoin.VerifySignerCounters(rst, inst.SignerCounter, inst.SignerIdentities)
+	if err != nil {
+		return xerrors.Errorf("signer counter: %v", err)
+	}
+	if err := signer.Verify(ctxHash, inst.Signatures[0]); err != nil {
+		return xerrors.Errorf("wrong signature: %v", err)
+	}
+	return nil
+}
+
+// Invoke records the delegation of the "delegation" argument in the read.
+// It must be signed by the key holding the read, and the delegate must not
+// have held it before.
+func (c *ContractRead) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	if inst.Invoke.Command != "delegate" {
+		return nil, nil, xerrors.New("can only delegate reads")
+	}
+	var d Delegation
+	err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("delegation"),
+		&d, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("passed delegation argument is invalid: %v", err)
+	}
+	if d.Delegate == nil {
+		return nil, nil, xerrors.New("delegation without delegate")
+	}
+	if c.Xc.Equal(d.Delegate) {
+		return nil, nil, xerrors.New("the delegate already holds the read")
+	}
+	for _, prev := range c.Delegations {
+		if prev.Delegate.Equal(d.Delegate) {
+			return nil, nil, xerrors.New("the delegate already holds the read")
+		}
+	}
+	rd := c.Read
+	rd.Delegations = append(append([]Delegation{}, c.Delegations...), d)
+	if _, err := rd.delegate(inst.InstanceID); err != nil {
+		return nil, nil, xerrors.Errorf("delegating read: %v", err)
+	}
+	c.Delegations = rd.Delegations
+	buf, err := protobuf.Encode(&c.Read)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding read: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractReadID, buf, darcID)}, coins, nil
+}
@@ -0,0 +1,299 @@
+package calypso
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"golang.org/x/xerrors"
+)
+
+// A Document hides the darcs, writes, reads and proofs behind a few calls:
+// Upload creates a darc for the document, with the owner as admin and the
+// readers in its spawn:calypsoRead rule, and stores the key of the
+// encrypted content in a write. Share and Revoke evolve the darc, and Fetch
+// spawns a read of the latest version and decrypts the content. The signer
+// counters are fetched from the chain before every transaction.
+
+// documentWait is the number of blocks the transactions of a Document wait
+// for.
+const documentWait = 10
+
+// Document is a document stored with calypso.
+type Document struct {
+	// ID is the write instance of the first version of the document. It is
+	// set by Upload.
+	ID byzcoin.InstanceID
+	// Darc controls who can update and read the document. It is created by
+	// Upload.
+	Darc *darc.Darc
+	// Label is the clear-text name of the document.
+	Label string
+	// Metadata is encrypted in the write, only the readers can see it.
+	Metadata *DocumentMetadata
+	// Readers are the identities allowed to read the document, in addition
+	// to the owner.
+	Readers []darc.Identity
+	// ReadWindow, if set, restricts the reads of the readers to the blocks
+	// with a time in the window, e.g. to office hours. The owner can always
+	// read.
+	ReadWindow *byzcoin.TimeWindow
+	// Policy is the policy of the write, see ReadPolicyVars.
+	Policy string
+	// Content is the document read by Upload.
+	Content io.Reader
+
+	client *Client
+}
+
+// NewDocument returns a document to be uploaded with this client.
+func (c *Client) NewDocument(content io.Reader, readers ...darc.Identity) *Document {
+	return &Document{Content: content, Readers: readers, client: c}
+}
+
+// OpenDocument returns the uploaded document with the given write instance,
+// darc and readers, to share, revoke or fetch it. The readers must be the
+// ones of the darc, as Share and Revoke replace them.
+func (c *Client) OpenDocument(id byzcoin.InstanceID, d *darc.Darc,
+	readers ...darc.Identity) *Document {
+	return &Document{ID: id, Darc: d, Readers: readers, client: c}
+}
+
+// Upload creates the darc of the document under the parent darc, which must
+// allow the owner to spawn darcs, encrypts the content for the LTS and
+// writes the encrypted content to out. The application stores it wherever
+// it wants, the chain only holds its hash and its key.
+func (doc *Document) Upload(lts *CreateLTSReply, parent darc.Darc,
+	owner darc.Signer, out io.Writer) error {
+	if doc.Content == nil {
+		return xerrors.New("document without content")
+	}
+	if doc.Darc != nil {
+		return xerrors.New("document has already been uploaded")
+	}
+	c := doc.client
+	id := owner.Identity()
+	d := darc.NewDarc(darc.InitRules([]darc.Identity{id}, []darc.Identity{id}),
+		[]byte("calypso document "+doc.Label))
+	for _, rule := range []string{"spawn:" + ContractWriteID,
+		"invoke:" + ContractWriteID + ".update"} {
+		if err := d.Rules.AddRule(darc.Action(rule),
+			expression.InitOrExpr(id.String())); err != nil {
+			return xerrors.Errorf("adding rule: %v", err)
+		}
+	}
+	if err := d.Rules.AddRule(darc.Action("spawn:"+ContractReadID),
+		doc.readRule(owner)); err != nil {
+		return xerrors.Errorf("adding rule: %v", err)
+	}
+	ctr, err := c.nextCounter(owner)
+	if err != nil {
+		return err
+	}
+	if _, err := c.SpawnDarc(owner, ctr, parent, *d, documentWait); err != nil {
+		return xerrors.Errorf("spawning darc: %v", err)
+	}
+
+	write, key, err := EncryptFile(cothority.Suite, lts.InstanceID,
+		d.GetBaseID(), lts.X, doc.Content, out)
+	if err != nil {
+		return xerrors.Errorf("encrypting document: %v", err)
+	}
+	write.Label = doc.Label
+	write.Policy = doc.Policy
+	if doc.Metadata != nil {
+		if err := write.SetMetadata(key, doc.Metadata); err != nil {
+			return err
+		}
+	}
+	if ctr, err = c.nextCounter(owner); err != nil {
+		return err
+	}
+	wr, err := c.AddWrite(write, owner, ctr, *d, documentWait)
+	if err != nil {
+		return xerrors.Errorf("adding write: %v", err)
+	}
+	doc.ID = wr.InstanceID
+	doc.Darc = d
+	return nil
+}
+
+// Share allows the reader to read all versions of the document.
+func (doc *Document) Share(owner darc.Signer, reader darc.Identity) error {
+	for _, r := range doc.Readers {
+		if r.Equal(&reader) {
+			return xerrors.New("already a reader")
+		}
+	}
+	readers := append(append([]darc.Identity{}, doc.Readers...), reader)
+	return doc.setReaders(owner, readers)
+}
+
+// Revoke refuses the reads of the reader from now on. The keys it already
+// decrypted cannot be taken back.
+func (doc *Document) Revoke(owner darc.Signer, reader darc.Identity) error {
+	var readers []darc.Identity
+	for _, r := range doc.Readers {
+		if !r.Equal(&reader) {
+			readers = append(readers, r)
+		}
+	}
+	if len(readers) == len(doc.Readers) {
+		return xerrors.New("not a reader")
+	}
+	return doc.setReaders(owner, readers)
+}
+
+// Fetch spawns a read of the latest version of the document, decrypts its
+// key and the encrypted content read from in, and writes the content to
+// out. It returns the metadata of the version, and must be discarded with
+// out if an error is returned.
+func (doc *Document) Fetch(reader darc.Signer, in io.Reader, out io.Writer) (*DocumentMetadata, error) {
+	c := doc.client
+	prWr, err := c.GetLatestVersion(doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := c.nextCounter(reader)
+	if err != nil {
+		return nil, err
+	}
+	re, err := c.AddRead(prWr, reader, ctr, documentWait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding read: %v", err)
+	}
+	prRe, err := c.WaitProof(re.InstanceID, time.Second, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("waiting for read: %v", err)
+	}
+	dkr := &DecryptKey{Read: *prRe, Write: *prWr}
+	if err := dkr.Sign(reader.Ed25519.Secret); err != nil {
+		return nil, err
+	}
+	dk, err := c.DecryptKey(dkr)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypting key: %v", err)
+	}
+	key, err := dk.RecoverKey(reader.Ed25519.Secret)
+	if err != nil {
+		return nil, xerrors.Errorf("recovering key: %v", err)
+	}
+	var write Write
+	if err := prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &write); err != nil {
+		return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+	}
+	md, err := write.GetMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := DecryptFile(&write, key, in, out); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// Versions returns the write instances of all versions of the document,
+// starting with the first one.
+func (doc *Document) Versions() ([]byzcoin.InstanceID, error) {
+	ids := []byzcoin.InstanceID{doc.ID}
+	for len(ids) < maxVersions {
+		resp, err := doc.client.bcClient.GetProofFromLatest(ids[len(ids)-1].Slice())
+		if err != nil {
+			return nil, xerrors.Errorf("getting proof: %v", err)
+		}
+		var write Write
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+		if err != nil {
+			return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+		}
+		if write.Next == nil {
+			return ids, nil
+		}
+		ids = append(ids, *write.Next)
+	}
+	return nil, xerrors.New("too many versions")
+}
+
+// readRule returns the spawn:calypsoRead rule of the darc, allowing the
+// owner and the readers, within the read window if there is one.
+func (doc *Document) readRule(owner darc.Signer) expression.Expr {
+	var readers []string
+	for _, r := range doc.Readers {
+		readers = append(readers, r.String())
+	}
+	id := owner.Identity().String()
+	if doc.ReadWindow == nil || len(readers) == 0 {
+		return expression.InitOrExpr(append([]string{id}, readers...)...)
+	}
+	// The attribute is not put last in the parentheses, as its token would
+	// take the closing parenthesis.
+	return expression.Expr(fmt.Sprintf("%s | (%s & (%s))", id,
+		doc.ReadWindow.Attr(), expression.InitOrExpr(readers...)))
+}
+
+// setReaders evolves the darc of the document with the new readers.
+func (doc *Document) setReaders(owner darc.Signer, readers []darc.Identity) error {
+	if doc.Darc == nil {
+		return xerrors.New("document has not been uploaded")
+	}
+	c := doc.client
+	prev := doc.Readers
+	doc.Readers = readers
+	d := doc.Darc.Copy()
+	err := func() error {
+		if err := d.EvolveFrom(doc.Darc); err != nil {
+			return xerrors.Errorf("evolving darc: %v", err)
+		}
+		err := d.Rules.UpdateRule(darc.Action("spawn:"+ContractReadID),
+			doc.readRule(owner))
+		if err != nil {
+			return xerrors.Errorf("updating rule: %v", err)
+		}
+		buf, err := d.ToProto()
+		if err != nil {
+			return xerrors.Errorf("encoding darc: %v", err)
+		}
+		ctr, err := c.nextCounter(owner)
+		if err != nil {
+			return err
+		}
+		ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+			byzcoin.Instruction{
+				InstanceID: byzcoin.NewInstanceID(doc.Darc.GetBaseID()),
+				Invoke: &byzcoin.Invoke{
+					ContractID: byzcoin.ContractDarcID,
+					Command:    "evolve",
+					Args:       byzcoin.Arguments{{Name: "darc", Value: buf}},
+				},
+				SignerCounter: []uint64{ctr},
+			},
+		)
+		if err := ctx.FillSignersAndSignWith(owner); err != nil {
+			return xerrors.Errorf("signing txn: %v", err)
+		}
+		_, err = c.bcClient.AddTransactionAndWait(ctx, documentWait)
+		return cothority.ErrorOrNil(err, "adding txn")
+	}()
+	if err != nil {
+		doc.Readers = prev
+		return err
+	}
+	doc.Darc = d
+	return nil
+}
+
+// nextCounter returns the next signer counter of the signer.
+func (c *Client) nextCounter(signer darc.Signer) (uint64, error) {
+	ctrs, err := c.bcClient.GetSignerCounters(signer.Identity().String())
+	if err != nil {
+		return 0, xerrors.Errorf("getting signer counter: %v", err)
+	}
+	if len(ctrs.Counters) != 1 {
+		return 0, xerrors.New("wrong number of signer counters")
+	}
+	return ctrs.Counters[0] + 1, nil
+}
@@ -0,0 +1,223 @@
+package calypso
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"golang.org/x/xerrors"
+)
+
+// maxDocumentsPerPage is the maximum number of writes returned by
+// ListDocuments.
+const maxDocumentsPerPage = 100
+
+// ListDocuments returns the metadata of the writes of a chain, so that a
+// client can show the documents without fetching every write-instance. Like
+// GetDocumentStats, the list is kept up-to-date from the blocks of the
+// followed chains, and only holds the writes of the blocks handled by this
+// node.
+func (s *Service) ListDocuments(req *ListDocuments) (*ListDocumentsReply, error) {
+	return s.stats.documents(req), nil
+}
+
+// documents returns the page of the writes matching the request.
+func (st *statistics) documents(req *ListDocuments) *ListDocumentsReply {
+	label := strings.ToLower(req.Label)
+	st.Lock()
+	var docs []DocumentInfo
+	for id, ds := range st.Documents {
+		if ds.Created == 0 || !bytes.Equal(ds.ByzCoinID, req.ByzCoinID) {
+			continue
+		}
+		if req.Writer != "" && req.Writer != ds.Writer {
+			continue
+		}
+		if label != "" && !strings.Contains(strings.ToLower(ds.Label), label) {
+			continue
+		}
+		if (req.Since != 0 && ds.Created < req.Since) ||
+			(req.Until != 0 && ds.Created > req.Until) {
+			continue
+		}
+		docs = append(docs, DocumentInfo{
+			WriteID:   id,
+			Writer:    ds.Writer,
+			Label:     ds.Label,
+			Size:      ds.Size,
+			Timestamp: ds.Created,
+			Readers:   len(ds.Readers),
+		})
+	}
+	st.Unlock()
+
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].Timestamp != docs[j].Timestamp {
+			return docs[i].Timestamp < docs[j].Timestamp
+		}
+		return bytes.Compare(docs[i].WriteID[:], docs[j].WriteID[:]) < 0
+	})
+	reply := &ListDocumentsReply{Total: len(docs)}
+	limit := req.Limit
+	if limit <= 0 || limit > maxDocumentsPerPage {
+		limit = maxDocumentsPerPage
+	}
+	if req.Offset < 0 || req.Offset >= len(docs) {
+		return reply
+	}
+	docs = docs[req.Offset:]
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	reply.Documents = docs
+	return reply
+}
+
+// FindByLabel returns the proofs of the writes of a chain whose label holds
+// all the words of req.Label, ignoring the case. The writes are looked up in
+// the label index of the statistics, and every write is checked against its
+// proof before it is returned, so that the writes whose label changed since
+// are left out. The client can check the proofs with VerifyWriteProof, and
+// doesn't need to trust the index for the writes it gets back.
+func (s *Service) FindByLabel(req *FindByLabel) (*FindByLabelReply, error) {
+	words := labelWords(req.Label)
+	if len(words) == 0 {
+		return nil, xerrors.New("empty label")
+	}
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxDocumentsPerPage {
+		limit = maxDocumentsPerPage
+	}
+	reply := &FindByLabelReply{}
+	for _, id := range s.stats.byLabel(req.ByzCoinID, words) {
+		if len(reply.Proofs) == limit {
+			break
+		}
+		resp, err := bc.GetProof(&byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			Key:     id.Slice(),
+			ID:      req.ByzCoinID,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("getting proof of write %x: %v", id[:], err)
+		}
+		if !resp.Proof.InclusionProof.Match(id.Slice()) {
+			continue
+		}
+		var write Write
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+		if err != nil || !labelMatches(write.Label, words) {
+			continue
+		}
+		reply.Proofs = append(reply.Proofs, resp.Proof)
+	}
+	return reply, nil
+}
+
+// labelWords returns the lower-case words of a label, which are the keys of
+// the label index.
+func labelWords(label string) []string {
+	return strings.Fields(strings.ToLower(label))
+}
+
+// labelMatches returns true if the label holds all the words.
+func labelMatches(label string, words []string) bool {
+	have := make(map[string]bool)
+	for _, w := range labelWords(label) {
+		have[w] = true
+	}
+	for _, w := range words {
+		if !have[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexLabel adds the write to the index of the words of its label. It must
+// be called with the lock held.
+func (st *statistics) indexLabel(writeID byzcoin.InstanceID, label string) {
+	if st.labels == nil {
+		st.labels = make(map[string]map[byzcoin.InstanceID]bool)
+	}
+	for _, w := range labelWords(label) {
+		if st.labels[w] == nil {
+			st.labels[w] = make(map[byzcoin.InstanceID]bool)
+		}
+		st.labels[w][writeID] = true
+	}
+}
+
+// unindexLabel removes the write from the index of the words of its label.
+// It must be called with the lock held.
+func (st *statistics) unindexLabel(writeID byzcoin.InstanceID, label string) {
+	for _, w := range labelWords(label) {
+		delete(st.labels[w], writeID)
+		if len(st.labels[w]) == 0 {
+			delete(st.labels, w)
+		}
+	}
+}
+
+// indexLabels rebuilds the label index from the documents.
+func (st *statistics) indexLabels() {
+	st.Lock()
+	defer st.Unlock()
+	st.labels = make(map[string]map[byzcoin.InstanceID]bool)
+	for id, ds := range st.Documents {
+		st.indexLabel(id, ds.Label)
+	}
+}
+
+// byLabel returns the writes of the chain whose label holds all the words,
+// sorted by creation time.
+func (st *statistics) byLabel(bcID skipchain.SkipBlockID, words []string) []byzcoin.InstanceID {
+	st.Lock()
+	defer st.Unlock()
+	var ids []byzcoin.InstanceID
+	for id := range st.labels[words[0]] {
+		ds := st.Documents[id]
+		if ds == nil || !bytes.Equal(ds.ByzCoinID, bcID) {
+			continue
+		}
+		all := true
+		for _, w := range words[1:] {
+			all = all && st.labels[w][id]
+		}
+		if all {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ci, cj := st.Documents[ids[i]].Created, st.Documents[ids[j]].Created
+		if ci != cj {
+			return ci < cj
+		}
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// instructionWrite returns the write spawned or updated by the instruction,
+// or nil if it cannot be decoded.
+func instructionWrite(inst byzcoin.Instruction) *Write {
+	var buf []byte
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		buf = inst.Spawn.Args.Search("write")
+	case byzcoin.InvokeType:
+		buf = inst.Invoke.Args.Search("write")
+	}
+	var w Write
+	if len(buf) == 0 || decode(buf, &w) != nil {
+		return nil
+	}
+	return &w
+}
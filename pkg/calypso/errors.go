@@ -0,0 +1,121 @@
+package calypso
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// The errors of the nodes are sent back as strings, and their wording
+// changes with every refactoring, so they cannot be shown to end users as
+// they are. The client maps the failures users can do something about to a
+// UserError, with a stable code, a hint and a key into the documentation.
+// The original error is kept, so that it can still be logged.
+
+// UserError is a failure that can be shown to an end user.
+type UserError struct {
+	// Code identifies the failure. It doesn't change between versions.
+	Code string
+	// Message describes the failure to the user.
+	Message string
+	// Hint tells the user how to fix the failure.
+	Hint string
+	// DocKey is the key of the failure in the documentation.
+	DocKey string
+	// Err is the error returned by the nodes.
+	Err error
+}
+
+// The failures mapped to a UserError. They can be compared with xerrors.Is,
+// which only looks at the code.
+var (
+	ErrThresholdNotMet = &UserError{
+		Code:    "threshold_not_met",
+		Message: "not enough nodes took part in the decryption",
+		Hint:    "some nodes of the LTS are down or refused the request, retry later",
+		DocKey:  "errors/threshold-not-met",
+	}
+	ErrStaleRoster = &UserError{
+		Code:    "stale_roster",
+		Message: "the roster of the client is out of date",
+		Hint:    "fetch the latest roster of the chain and of the LTS, then retry",
+		DocKey:  "errors/stale-roster",
+	}
+	ErrNotAuthorized = &UserError{
+		Code:    "not_authorized",
+		Message: "you are not allowed to read this document",
+		Hint:    "ask the owner of the document to give access to your key",
+		DocKey:  "errors/not-authorized",
+	}
+	ErrReadExpired = &UserError{
+		Code:    "read_expired",
+		Message: "the read of the document has expired",
+		Hint:    "read the document again to get a new read, then retry",
+		DocKey:  "errors/read-expired",
+	}
+	ErrChainUnknown = &UserError{
+		Code:    "chain_unknown",
+		Message: "the nodes don't serve this chain",
+		Hint:    "check the chain ID and namespace, or ask the admin to authorise the chain",
+		DocKey:  "errors/chain-unknown",
+	}
+)
+
+// userErrors maps parts of the errors of the nodes to the user errors. The
+// first match wins.
+var userErrors = []struct {
+	err      *UserError
+	patterns []string
+}{
+	{ErrChainUnknown, []string{"ByzCoin ID is not authorised", "unknown namespace",
+		"checking namespace"}},
+	{ErrStaleRoster, []string{"verifying proof from block", "getting single block",
+		"proof doesn't start at the genesis block", "getting LTS roster",
+		"checking roster"}},
+	{ErrThresholdNotMet, []string{"reencryption got refused",
+		"too many nodes failed", "didn't finish in time"}},
+	{ErrReadExpired, []string{"the read has expired"}},
+	{ErrNotAuthorized, []string{"evaluating darc", "is not allowed to read",
+		"the policy of the write refuses", "has been revoked"}},
+}
+
+func (e *UserError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+// Unwrap returns the error of the nodes.
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is a UserError with the same code.
+func (e *UserError) Is(target error) bool {
+	t, ok := target.(*UserError)
+	return ok && t.Code == e.Code
+}
+
+// ToUserError returns a UserError wrapping err if it is a known failure,
+// else err itself.
+func ToUserError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var ue *UserError
+	if xerrors.As(err, &ue) {
+		return err
+	}
+	for _, m := range userErrors {
+		for _, p := range m.patterns {
+			if strings.Contains(err.Error(), p) {
+				e := *m.err
+				e.Err = err
+				return &e
+			}
+		}
+	}
+	return err
+}
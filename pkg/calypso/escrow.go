@@ -0,0 +1,277 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/encrypt/ecies"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// escrow holds the admins that can ask this node to export its shares.
+type escrow struct {
+	Admins    []kyber.Point
+	Threshold int
+}
+
+// ConfigureEscrow sets the admins that must sign an ExportShares request.
+// The request is always signed by the private key of the node, even if
+// COTHORITY_ALLOW_INSECURE_ADMIN='true'.
+func (s *Service) ConfigureEscrow(req *ConfigureEscrow) (*ConfigureEscrowReply, error) {
+	if len(req.Admins) > 0 && (req.Threshold < 1 ||
+		req.Threshold > len(req.Admins)) {
+		return nil, xerrors.Errorf("threshold must be between 1 and %d",
+			len(req.Admins))
+	}
+	msg, err := escrowMessage(req.Admins, req.Threshold, req.Timestamp)
+	if err != nil {
+		return nil, xerrors.Errorf("creating message: %v", err)
+	}
+	if err := s.checkAdminSignature(msg, req.Timestamp, req.Signature); err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+
+	s.storage.Lock()
+	if len(req.Admins) == 0 {
+		s.storage.Escrow = nil
+	} else {
+		s.storage.Escrow = &escrow{Admins: req.Admins, Threshold: req.Threshold}
+	}
+	s.storage.Unlock()
+
+	if err := s.save(); err != nil {
+		return nil, xerrors.Errorf("saving data: %v", err)
+	}
+	log.Lvl1("Configured", len(req.Admins), "escrow admins")
+	return &ConfigureEscrowReply{}, nil
+}
+
+// ExportShares returns the share of the LTS of this node, encrypted under
+// the recovery key of the request. At least Threshold escrow admins must
+// have signed the request, and the export must be recorded in the LTS
+// instance, which must allow escrow exports.
+func (s *Service) ExportShares(req *ExportShares) (*ExportSharesReply, error) {
+	if req.RecoveryKey == nil {
+		return nil, xerrors.New("missing recovery key")
+	}
+	if math.Abs(time.Since(time.Unix(req.Timestamp, 0)).Seconds()) > 60 {
+		return nil, xerrors.New("signatures are too old")
+	}
+
+	s.storage.RLock()
+	conf := s.storage.Escrow
+	shared := s.storage.Shared[req.LTSID]
+	if shared != nil {
+		shared = shared.Clone()
+	}
+	s.storage.RUnlock()
+	if conf == nil {
+		return nil, xerrors.New("share export is not configured on this node")
+	}
+	if shared == nil {
+		return nil, xerrors.New("unknown LTS")
+	}
+	if err := s.checkUnweighted(req.LTSID); err != nil {
+		return nil, xerrors.Errorf("cannot export: %v", err)
+	}
+
+	msg, err := exportSharesMessage(req.LTSID, req.RecoveryKey, req.Timestamp)
+	if err != nil {
+		return nil, xerrors.Errorf("creating message: %v", err)
+	}
+	if len(req.Signatures) > len(conf.Admins) {
+		return nil, xerrors.New("more signatures than admins")
+	}
+	valid := 0
+	for i, sig := range req.Signatures {
+		if len(sig) == 0 {
+			continue
+		}
+		if err := schnorr.Verify(cothority.Suite, conf.Admins[i], msg, sig); err != nil {
+			return nil, xerrors.Errorf("signature of admin %d: %v", i, err)
+		}
+		valid++
+	}
+	if valid < conf.Threshold {
+		return nil, xerrors.Errorf("got %d signatures, need %d", valid,
+			conf.Threshold)
+	}
+	if err := s.verifyExportRecord(req); err != nil {
+		return nil, xerrors.Errorf("checking record of export: %v", err)
+	}
+
+	buf, err := shared.V.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling share: %v", err)
+	}
+	enc, err := ecies.Encrypt(cothority.Suite, req.RecoveryKey, buf, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("encrypting share: %v", err)
+	}
+	log.Lvlf1("Exported share of LTS %x to %s", req.LTSID[:], req.RecoveryKey)
+	return &ExportSharesReply{
+		Index:     shared.Index,
+		Encrypted: enc,
+		X:         shared.X,
+		Commits:   shared.Commits,
+	}, nil
+}
+
+// verifyExportRecord checks that the record of the request is a valid proof
+// of its LTS instance, and that this instance holds the recovery key in its
+// exports.
+func (s *Service) verifyExportRecord(req *ExportShares) error {
+	if req.Record == nil {
+		return xerrors.New("missing proof of the LTS instance")
+	}
+	return s.verifyExportProof(req.LTSID, req.RecoveryKey, req.Record)
+}
+
+// verifyExportProof checks that the proof is a valid proof of the LTS
+// instance, which allows escrow exports and has recorded the export of its
+// shares to key.
+func (s *Service) verifyExportProof(ltsID byzcoin.InstanceID, key kyber.Point,
+	proof *byzcoin.Proof) error {
+	if !proof.InclusionProof.Match(ltsID.Slice()) {
+		return xerrors.New("proof is not for the LTS of the request")
+	}
+	if err := s.verifyProof(proof); err != nil {
+		return xerrors.Errorf("verifying proof: %v", err)
+	}
+	var info LtsInstanceInfo
+	err := proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID,
+		&info)
+	if err != nil {
+		return xerrors.Errorf("didn't get an LTS instance: %v", err)
+	}
+	if !info.EscrowExport {
+		return xerrors.New("this LTS doesn't allow escrow exports")
+	}
+	for _, k := range info.Exports {
+		if k.Equal(key) {
+			return nil
+		}
+	}
+	return xerrors.New("export to this recovery key is not recorded")
+}
+
+// Sign adds the signature of the i-th escrow admin to the request.
+func (req *ExportShares) Sign(i int, priv kyber.Scalar) error {
+	msg, err := exportSharesMessage(req.LTSID, req.RecoveryKey, req.Timestamp)
+	if err != nil {
+		return xerrors.Errorf("creating message: %v", err)
+	}
+	sig, err := schnorr.Sign(cothority.Suite, priv, msg)
+	if err != nil {
+		return xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	for len(req.Signatures) <= i {
+		req.Signatures = append(req.Signatures, nil)
+	}
+	req.Signatures[i] = sig
+	return nil
+}
+
+// RecoverLTSSecret decrypts the shares exported by the nodes of an LTS using
+// the private key of the recovery key, verifies them against the public
+// polynomial of the LTS and returns the private key of the LTS. Documents
+// can then be decrypted using DecryptWithLTSSecret.
+func RecoverLTSSecret(replies []*ExportSharesReply, recovery kyber.Scalar) (kyber.Scalar, error) {
+	if len(replies) == 0 {
+		return nil, xerrors.New("no shares given")
+	}
+	X, commits := replies[0].X, replies[0].Commits
+	if len(commits) == 0 || len(commits) > MaxShares || !commits[0].Equal(X) {
+		return nil, xerrors.New("commits don't match the public key of the LTS")
+	}
+	poly := share.NewPubPoly(cothority.Suite, cothority.Suite.Point().Base(),
+		commits)
+	threshold := len(commits)
+
+	var shares []*share.PriShare
+	seen := make(map[int]bool)
+	for i, r := range replies {
+		if !r.X.Equal(X) {
+			return nil, xerrors.Errorf("share %d is from another LTS", i)
+		}
+		buf, err := ecies.Decrypt(cothority.Suite, recovery, r.Encrypted, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("decrypting share %d: %v", i, err)
+		}
+		v := cothority.Suite.Scalar()
+		if err := v.UnmarshalBinary(buf); err != nil {
+			return nil, xerrors.Errorf("share %d: %v", i, err)
+		}
+		pub := poly.Eval(r.Index)
+		if !cothority.Suite.Point().Mul(v, nil).Equal(pub.V) {
+			return nil, xerrors.Errorf("share %d doesn't match the polynomial", i)
+		}
+		if seen[r.Index] {
+			return nil, xerrors.Errorf("got share %d twice", r.Index)
+		}
+		seen[r.Index] = true
+		shares = append(shares, &share.PriShare{I: r.Index, V: v})
+	}
+	if len(shares) < threshold {
+		return nil, xerrors.Errorf("got %d shares, need %d", len(shares),
+			threshold)
+	}
+	x, err := share.RecoverSecret(cothority.Suite, shares, threshold, len(shares))
+	if err != nil {
+		return nil, xerrors.Errorf("recovering secret: %v", err)
+	}
+	if !cothority.Suite.Point().Mul(x, nil).Equal(X) {
+		return nil, xerrors.New("recovered secret doesn't match the LTS")
+	}
+	return x, nil
+}
+
+// DecryptWithLTSSecret returns the key stored in the write, using the
+// private key of the LTS recovered by RecoverLTSSecret.
+func DecryptWithLTSSecret(w *Write, x kyber.Scalar) ([]byte, error) {
+	xU := cothority.Suite.Point().Mul(x, w.U)
+	key, err := cothority.Suite.Point().Sub(w.C, xU).Data()
+	if err != nil {
+		return nil, xerrors.Errorf("extracting data from point: %v", err)
+	}
+	return key, nil
+}
+
+// escrowMessage returns the message to be signed for a ConfigureEscrow
+// request.
+func escrowMessage(admins []kyber.Point, threshold int, ts int64) ([]byte, error) {
+	msg := []byte("escrow:")
+	for _, a := range admins {
+		buf, err := a.MarshalBinary()
+		if err != nil {
+			return nil, xerrors.Errorf("marshalling admin: %v", err)
+		}
+		msg = append(msg, buf...)
+	}
+	msg = append(msg, make([]byte, 16)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-16:], uint64(threshold))
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg, nil
+}
+
+// exportSharesMessage returns the message to be signed by the escrow admins
+// for an ExportShares request.
+func exportSharesMessage(ltsID byzcoin.InstanceID, recovery kyber.Point,
+	ts int64) ([]byte, error) {
+	buf, err := recovery.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling recovery key: %v", err)
+	}
+	msg := append([]byte("export:"), ltsID[:]...)
+	msg = append(msg, buf...)
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg, nil
+}
@@ -0,0 +1,115 @@
+package calypso
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/policy"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"golang.org/x/xerrors"
+)
+
+// EstimateDecrypt returns what a decryption of the write would take, so
+// that a reader can decide whether to spawn a read instance. The estimation
+// is made by this node with its own statistics, so another node can give a
+// different answer.
+func (s *Service) EstimateDecrypt(req *EstimateDecrypt) (*EstimateDecryptReply, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	s.storage.RLock()
+	_, authorised := s.storage.AuthorisedByzCoinIDs[string(req.ByzCoinID)]
+	s.storage.RUnlock()
+	if !authorised {
+		return nil, xerrors.New("this ByzCoin ID is not authorised")
+	}
+	if err := s.checkNamespace(req.ByzCoinID, req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+
+	resp, err := bc.GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     req.WriteID.Slice(),
+		ID:      req.ByzCoinID,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof of write: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(req.WriteID.Slice()) {
+		return nil, xerrors.New("write instance doesn't exist")
+	}
+	var write Write
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding write: %v", err)
+	}
+
+	key, err := s.chooseKey(&write, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("choosing key: %v", err)
+	}
+	s.storage.RLock()
+	roster := s.storage.Rosters[key.LTSID]
+	s.storage.RUnlock()
+	if roster == nil {
+		return nil, xerrors.Errorf("don't know the LTSID '%v' stored in write",
+			key.LTSID)
+	}
+	shares, weights := s.ltsShares(key.LTSID, roster)
+	threshold := LTSThreshold(shares)
+	nodes := treeNodes(roster, threshold, weights)
+	tree, err := s.decryptionTree(roster, req.Strategy, nodes)
+	if err != nil {
+		return nil, xerrors.Errorf("choosing nodes: %v", err)
+	}
+
+	reply := &EstimateDecryptReply{
+		Cost:         write.Cost,
+		Participants: len(tree.Roster.List),
+		Threshold:    threshold,
+		Latency:      int64(s.expectedLatency(tree, nodes)),
+		QueueDepth:   bc.TxQueueDepth(req.ByzCoinID),
+		Decrypting:   int(atomic.LoadInt32(&s.decrypting)),
+		Quota:        -1,
+	}
+	if reply.Latency == 0 {
+		reply.Latency = s.stats.chainReply(req.ByzCoinID).DecryptLatency
+	}
+	if req.Reader != nil {
+		reply.Quota = s.keyLimiter.remaining(req.Reader.String(), time.Now())
+	}
+	reply.Refused, err = s.policyRefuses(req, &write)
+	if err != nil {
+		return nil, xerrors.Errorf("evaluating policy: %v", err)
+	}
+	reply.Refused = reply.Refused || write.Frozen
+	return reply, nil
+}
+
+// policyRefuses returns true if the policy of the write refuses all reads
+// at the time of the latest block. A policy that depends on the reader
+// cannot be evaluated without one, so it doesn't refuse.
+func (s *Service) policyRefuses(req *EstimateDecrypt, w *Write) (bool, error) {
+	if w.Policy == "" {
+		return false, nil
+	}
+	p, err := policy.Parse(w.Policy)
+	if err != nil {
+		return false, xerrors.Errorf("parsing policy: %v", err)
+	}
+	latest, err := s.getLatestBlock(req.ByzCoinID)
+	if err != nil {
+		return false, xerrors.Errorf("getting latest block: %v", err)
+	}
+	ts, err := s.blockTimestamp(req.ByzCoinID, latest.Index)
+	if err != nil {
+		return false, xerrors.Errorf("getting timestamp: %v", err)
+	}
+	ok, err := p.Evaluate(policy.Vars{
+		"time":  ts / int64(time.Second),
+		"block": int64(latest.Index),
+	})
+	return err == nil && !ok, nil
+}
@@ -0,0 +1,523 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// The types of events in the event log.
+const (
+	// EventWrite is logged when a write-instance is created.
+	EventWrite = "write"
+	// EventRead is logged when a read-instance is created.
+	EventRead = "read"
+	// EventDecrypt is logged when this node re-encrypts a key.
+	EventDecrypt = "decrypt"
+	// EventAccessGranted is logged when an identity is added to the
+	// spawn:calypsoRead rule of a darc.
+	EventAccessGranted = "access_granted"
+	// EventAccessRevoked is logged when an identity is removed from the
+	// spawn:calypsoRead rule of a darc.
+	EventAccessRevoked = "access_revoked"
+	// EventFrozen is logged when the reads of a write are suspended.
+	EventFrozen = "frozen"
+	// EventUnfrozen is logged when the reads of a write are restored.
+	EventUnfrozen = "unfrozen"
+	// EventHeld is logged when a legal hold is placed on a write.
+	EventHeld = "held"
+	// EventReleased is logged when the legal hold of a write is lifted.
+	EventReleased = "released"
+	// EventRetained is logged when the retention time of a write is
+	// extended.
+	EventRetained = "retained"
+	// EventBlame is logged when a node of an LTS sent a wrong share it
+	// signed.
+	EventBlame = "blame"
+	// EventMisbehavior is logged when a client reports a reply with wrong
+	// shares signed by a node.
+	EventMisbehavior = "misbehavior"
+)
+
+// maxEvents is the number of events kept by a node. Older events are
+// dropped, but the cursors of the remaining events don't change.
+const maxEvents = 10000
+
+// maxEventsPerPage is the maximum number of events returned by GetEvents.
+const maxEventsPerPage = 100
+
+// eventsKey is where the event log is stored in the db.
+var eventsKey = []byte("events")
+
+// eventsJournalName is the name of the journal of the new events.
+const eventsJournalName = "events-journal"
+
+func init() {
+	network.RegisterMessages(&eventLog{})
+}
+
+// eventLog holds the latest events seen by this node. Next is the cursor
+// of the next event to be added.
+//
+// As the cursors of the events follow each other, the event with a given
+// cursor is found directly in Events. The cursors of the events of every
+// write and of every identity are indexed, so that a filtered page only
+// looks at the matching events. The indexes are not stored, but rebuilt
+// when the log is loaded.
+//
+// The new events are kept in pending until they are appended to the journal,
+// and JournalNext is the first record of the journal that is not part of
+// the saved log.
+type eventLog struct {
+	Events      []Event
+	Next        uint64
+	JournalNext uint64 `protobuf:"opt"`
+	sync.Mutex
+	byWrite    map[byzcoin.InstanceID][]uint64
+	byIdentity map[string][]uint64
+	pending    []Event
+}
+
+// add appends the events to the log, setting their cursor.
+func (el *eventLog) add(events ...Event) {
+	el.Lock()
+	defer el.Unlock()
+	for _, e := range events {
+		e.Cursor = el.Next
+		el.Next++
+		el.Events = append(el.Events, e)
+		el.pending = append(el.pending, e)
+		el.index(e)
+	}
+	el.trim()
+}
+
+// trim drops the oldest events if there are more than maxEvents.
+func (el *eventLog) trim() {
+	if len(el.Events) > maxEvents {
+		drop := len(el.Events) - maxEvents
+		for _, e := range el.Events[:drop] {
+			el.unindex(e)
+		}
+		el.Events = append([]Event{}, el.Events[drop:]...)
+	}
+}
+
+// index adds the cursor of the event to the indexes.
+func (el *eventLog) index(e Event) {
+	if el.byWrite == nil {
+		el.byWrite = make(map[byzcoin.InstanceID][]uint64)
+		el.byIdentity = make(map[string][]uint64)
+	}
+	el.byWrite[e.WriteID] = append(el.byWrite[e.WriteID], e.Cursor)
+	if e.Identity != "" {
+		el.byIdentity[e.Identity] = append(el.byIdentity[e.Identity], e.Cursor)
+	}
+}
+
+// unindex removes the cursor of a dropped event from the indexes. As the
+// oldest events are dropped first, it is always the first of its lists.
+func (el *eventLog) unindex(e Event) {
+	if cursors := el.byWrite[e.WriteID]; len(cursors) > 1 {
+		el.byWrite[e.WriteID] = dropFirst(cursors)
+	} else {
+		delete(el.byWrite, e.WriteID)
+	}
+	if e.Identity == "" {
+		return
+	}
+	if cursors := el.byIdentity[e.Identity]; len(cursors) > 1 {
+		el.byIdentity[e.Identity] = dropFirst(cursors)
+	} else {
+		delete(el.byIdentity, e.Identity)
+	}
+}
+
+// dropFirst removes the first cursor of the list. The cursors are copied
+// once less than half of the backing array is used, so that the dropped
+// cursors are freed.
+func dropFirst(cursors []uint64) []uint64 {
+	cursors = cursors[1:]
+	if len(cursors) < cap(cursors)/2 {
+		cursors = append([]uint64(nil), cursors...)
+	}
+	return cursors
+}
+
+// reindex rebuilds the indexes from the events.
+func (el *eventLog) reindex() {
+	el.byWrite = nil
+	el.byIdentity = nil
+	for _, e := range el.Events {
+		el.index(e)
+	}
+}
+
+// candidates returns the cursors of the events that can match the request,
+// starting at its cursor. If the request doesn't filter on an indexed
+// field, it returns nil and false, and all events must be looked at.
+func (el *eventLog) candidates(req *GetEvents) ([]uint64, bool) {
+	var cursors []uint64
+	switch {
+	case req.WriteID != nil:
+		cursors = el.byWrite[*req.WriteID]
+	case req.Identity != "":
+		cursors = el.byIdentity[req.Identity]
+	default:
+		return nil, false
+	}
+	start := sort.Search(len(cursors), func(i int) bool {
+		return cursors[i] >= req.Cursor
+	})
+	return cursors[start:], true
+}
+
+// matches returns true if the event passes the filter of the request. If
+// chains is not nil, the event must also be from one of these chains.
+func (req *GetEvents) matches(e Event, chains map[string]bool) bool {
+	if chains != nil && !chains[string(e.ByzCoinID)] {
+		return false
+	}
+	if req.WriteID != nil && !req.WriteID.Equal(e.WriteID) {
+		return false
+	}
+	if req.Identity != "" && req.Identity != e.Identity {
+		return false
+	}
+	return len(req.ByzCoinID) == 0 || req.ByzCoinID.Equal(e.ByzCoinID)
+}
+
+// page returns up to limit events with a cursor of at least cursor, and
+// matching the filter of the request and the chains, if they are not nil.
+func (el *eventLog) page(req *GetEvents, chains map[string]bool) *GetEventsReply {
+	el.Lock()
+	defer el.Unlock()
+	limit := req.Limit
+	if limit <= 0 || limit > maxEventsPerPage {
+		limit = maxEventsPerPage
+	}
+	reply := &GetEventsReply{Next: req.Cursor}
+	if cursors, ok := el.candidates(req); ok {
+		for _, c := range cursors {
+			if len(reply.Events) == limit {
+				return reply
+			}
+			e := el.Events[c-el.Events[0].Cursor]
+			reply.Next = e.Cursor + 1
+			if req.matches(e, chains) {
+				reply.Events = append(reply.Events, e)
+			}
+		}
+		// All events up to the end of the log have been looked at.
+		if el.Next > reply.Next {
+			reply.Next = el.Next
+		}
+		return reply
+	}
+
+	start := sort.Search(len(el.Events), func(i int) bool {
+		return el.Events[i].Cursor >= req.Cursor
+	})
+	for _, e := range el.Events[start:] {
+		if len(reply.Events) == limit {
+			break
+		}
+		reply.Next = e.Cursor + 1
+		if req.matches(e, chains) {
+			reply.Events = append(reply.Events, e)
+		}
+	}
+	return reply
+}
+
+// addBlames logs the evidence against the nodes that sent a wrong share
+// for the LTS with the given ID.
+func (s *Service) addBlames(bcID skipchain.SkipBlockID, id byzcoin.InstanceID,
+	blames []protocol.Blame) {
+	if len(blames) == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	for i := range blames {
+		log.Warnf("AUDIT: node %s sent a wrong share for LTS %x",
+			blames[i].Trustee, id[:])
+		s.events.add(Event{
+			Type:       EventBlame,
+			Timestamp:  now,
+			ByzCoinID:  bcID,
+			BlockIndex: -1,
+			InstanceID: id,
+			Identity:   blames[i].Trustee.Public.String(),
+			Blame:      &blames[i],
+		})
+	}
+	if err := s.saveEvents(); err != nil {
+		log.Error(err)
+	}
+}
+
+// GetEvents returns the events seen by this node, starting at the given
+// cursor. To follow the log, the client passes the Next field of the reply
+// as the cursor of the following request.
+//
+// The identities of the readers, signers and darc rules are only returned
+// if the request is signed by the private key of the conode. Otherwise
+// they are left out, and only the events of nodes, i.e. blames and
+// misbehaviors, can be found by identity.
+//
+// If req.Proofs is set, the reply holds a proof for every write and read
+// event, which can be checked with GetEventsReply.Verify.
+func (s *Service) GetEvents(req *GetEvents) (*GetEventsReply, error) {
+	reply := s.events.page(req, s.namespaceChains(req.Namespace))
+	if len(req.Signature) == 0 || s.checkAdminSignature(
+		eventsMessage(req.Timestamp), req.Timestamp, req.Signature) != nil {
+		reply.Events = publicEvents(reply.Events, req.Identity != "")
+	}
+	if !req.Proofs {
+		return reply, nil
+	}
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	for _, e := range reply.Events {
+		if e.Type != EventWrite && e.Type != EventRead {
+			continue
+		}
+		resp, err := bc.GetProof(&byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			Key:     e.InstanceID.Slice(),
+			ID:      e.ByzCoinID,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("getting proof of event %d: %v",
+				e.Cursor, err)
+		}
+		reply.Proofs = append(reply.Proofs, EventProof{Cursor: e.Cursor,
+			Proof: resp.Proof})
+	}
+	return reply, nil
+}
+
+// publicEvents removes the identities of the events, except the keys of the
+// nodes in blames and misbehaviors. If byIdentity is set, the events have
+// been found by their identity, so the other events are dropped.
+func publicEvents(events []Event, byIdentity bool) []Event {
+	var public []Event
+	for _, e := range events {
+		if e.Type != EventBlame && e.Type != EventMisbehavior {
+			if byIdentity {
+				continue
+			}
+			e.Identity = ""
+		}
+		public = append(public, e)
+	}
+	return public
+}
+
+// eventsMessage returns the message to be signed for a GetEvents request
+// that asks for the identities.
+func eventsMessage(ts int64) []byte {
+	msg := append([]byte("events:"), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
+
+// Verify checks that every write and read event of the reply has a valid
+// proof starting at the given genesis block, and that the instance in the
+// proof matches the event. Events of other chains are refused.
+func (r *GetEventsReply) Verify(genesis *skipchain.SkipBlock) error {
+	proofs := make(map[uint64]*byzcoin.Proof)
+	for i := range r.Proofs {
+		proofs[r.Proofs[i].Cursor] = &r.Proofs[i].Proof
+	}
+	for _, e := range r.Events {
+		if !e.ByzCoinID.Equal(genesis.Hash) {
+			return xerrors.Errorf("event %d is from another chain", e.Cursor)
+		}
+		if e.Type != EventWrite && e.Type != EventRead {
+			continue
+		}
+		pr, ok := proofs[e.Cursor]
+		if !ok {
+			return xerrors.Errorf("missing proof for event %d", e.Cursor)
+		}
+		if err := verifyEventProof(e, pr, genesis); err != nil {
+			return xerrors.Errorf("event %d: %v", e.Cursor, err)
+		}
+	}
+	return nil
+}
+
+// verifyEventProof checks that pr proves the existence of the instance of
+// the write or read event e.
+func verifyEventProof(e Event, pr *byzcoin.Proof, genesis *skipchain.SkipBlock) error {
+	if err := pr.VerifyFromBlock(genesis); err != nil {
+		return xerrors.Errorf("invalid proof: %v", err)
+	}
+	if !pr.InclusionProof.Match(e.InstanceID.Slice()) {
+		return xerrors.New("instance doesn't exist")
+	}
+	if e.Type == EventWrite {
+		var wr Write
+		return cothority.ErrorOrNil(
+			pr.VerifyAndDecode(cothority.Suite, ContractWriteID, &wr),
+			"decoding write")
+	}
+	var rd Read
+	if err := pr.VerifyAndDecode(cothority.Suite, ContractReadID, &rd); err != nil {
+		return xerrors.Errorf("decoding read: %v", err)
+	}
+	if !rd.Write.Equal(e.WriteID) {
+		return xerrors.New("read is for another write")
+	}
+	return nil
+}
+
+// accessEvents returns the events for the identities added to or removed
+// from the spawn:calypsoRead rule by the evolution of a darc.
+func (s *Service) accessEvents(bcID skipchain.SkipBlockID, newD *darc.Darc) ([]Event, error) {
+	if newD.Version == 0 {
+		return nil, nil
+	}
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	resp, err := bc.GetInstanceVersion(&byzcoin.GetInstanceVersion{
+		SkipChainID: bcID,
+		InstanceID:  byzcoin.NewInstanceID(newD.GetBaseID()),
+		Version:     newD.Version - 1,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting previous darc: %v", err)
+	}
+	oldD, err := darc.NewFromProtobuf(resp.StateChange.Value)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding previous darc: %v", err)
+	}
+
+	action := darc.Action("spawn:" + ContractReadID)
+	before := ruleIdentities(oldD.Rules.Get(action))
+	after := ruleIdentities(newD.Rules.Get(action))
+	var events []Event
+	for id := range after {
+		if !before[id] {
+			events = append(events, Event{Type: EventAccessGranted, Identity: id})
+		}
+	}
+	for id := range before {
+		if !after[id] {
+			events = append(events, Event{Type: EventAccessRevoked, Identity: id})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+		return events[i].Identity < events[j].Identity
+	})
+	for i := range events {
+		events[i].InstanceID = byzcoin.NewInstanceID(newD.GetBaseID())
+	}
+	return events, nil
+}
+
+// ruleIdentities returns all identities found in the expression, without
+// resolving darcs.
+func ruleIdentities(expr expression.Expr) map[string]bool {
+	ids := make(map[string]bool)
+	if expr == nil {
+		return ids
+	}
+	Y := expression.InitParser(func(s string) bool {
+		ids[s] = true
+		return true
+	})
+	if _, err := expression.Evaluate(Y, expr); err != nil {
+		log.Lvl2("invalid expression in darc:", err)
+	}
+	return ids
+}
+
+// saveEvents appends the events added since the last call to the journal.
+// Once the journal is long enough, the whole log is saved and the journal
+// emptied.
+func (s *Service) saveEvents() error {
+	s.events.Lock()
+	defer s.events.Unlock()
+	records := make([]interface{}, len(s.events.pending))
+	for i := range s.events.pending {
+		records[i] = &s.events.pending[i]
+	}
+	next, size, err := s.eventsJournal.append(records...)
+	if err != nil {
+		log.Error("Couldn't save events:", err)
+		return xerrors.Errorf("saving events: %v", err)
+	}
+	s.events.pending = nil
+	if size < compactAfter {
+		return nil
+	}
+	s.events.JournalNext = next
+	if err := s.Save(eventsKey, s.events); err != nil {
+		log.Error("Couldn't save events:", err)
+		return xerrors.Errorf("saving events: %v", err)
+	}
+	return cothority.ErrorOrNil(s.eventsJournal.truncate(next),
+		"compacting events")
+}
+
+func (s *Service) tryLoadEvents() error {
+	s.events = &eventLog{}
+	j, err := s.newJournal(eventsJournalName)
+	if err != nil {
+		return xerrors.Errorf("loading events: %v", err)
+	}
+	s.eventsJournal = j
+	msg, err := s.Load(eventsKey)
+	if err != nil {
+		return xerrors.Errorf("loading events: %v", err)
+	}
+	el := &eventLog{}
+	if msg != nil {
+		var ok bool
+		el, ok = msg.(*eventLog)
+		if !ok {
+			return xerrors.New("events of wrong type")
+		}
+	}
+	// The events of a record can already be part of the log if the
+	// journal couldn't be emptied after saving it.
+	err = j.replay(el.JournalNext, func(buf []byte) error {
+		var e Event
+		if err := protobuf.Decode(buf, &e); err != nil {
+			return xerrors.Errorf("decoding event: %v", err)
+		}
+		if e.Cursor >= el.Next {
+			el.Events = append(el.Events, e)
+			el.Next = e.Cursor + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("replaying events: %v", err)
+	}
+	el.trim()
+	el.reindex()
+	s.events = el
+	return nil
+}
@@ -0,0 +1,223 @@
+package calypso
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// A reply with a share whose proof fails cannot be used, but it is signed by
+// the root of the re-encryption. The request, the reply and the positions of
+// the wrong shares are the evidence that the root returned them, which
+// anybody can check with Misbehavior.Verify. The root is blamed even if the
+// share came from another trustee, as it has to check the shares before it
+// signs the reply. The nodes of the LTS add the evidence sent with
+// ReportMisbehavior to their event log.
+
+// MisbehaviorError is returned by DecryptKey if the reply holds wrong
+// shares. The evidence can be sent to the nodes with ReportMisbehavior.
+type MisbehaviorError struct {
+	Evidence *Misbehavior
+	Err      error
+}
+
+func (e *MisbehaviorError) Error() string {
+	return fmt.Sprintf("node %s returned %d wrong shares: %v",
+		e.Evidence.Root, len(e.Evidence.Shares), e.Err)
+}
+
+// Unwrap returns the error of the verification.
+func (e *MisbehaviorError) Unwrap() error {
+	return e.Err
+}
+
+// NewMisbehavior returns the evidence that the reply of the root to the
+// request holds wrong shares. It returns an error if the reply is not
+// signed by the root, or if all its shares are valid.
+func NewMisbehavior(dkr *DecryptKey, reply *DecryptKeyReply,
+	root *network.ServerIdentity) (*Misbehavior, error) {
+	m := &Misbehavior{Root: root, Request: *dkr, Reply: *reply}
+	shares, err := m.wrongShares()
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, xerrors.New("all shares are valid")
+	}
+	m.Shares = shares
+	return m, nil
+}
+
+// Verify checks that the reply has been signed by the root for the
+// request, and that the proofs of the shares of the evidence fail. The
+// proofs of the request are not checked against the chain.
+func (m *Misbehavior) Verify() error {
+	if len(m.Shares) == 0 {
+		return xerrors.New("evidence without shares")
+	}
+	wrong, err := m.wrongShares()
+	if err != nil {
+		return err
+	}
+	isWrong := make(map[int]bool)
+	for _, i := range wrong {
+		isWrong[i] = true
+	}
+	for _, i := range m.Shares {
+		if !isWrong[i] {
+			return xerrors.Errorf("share %d is valid", i)
+		}
+	}
+	return nil
+}
+
+// wrongShares checks the signature of the reply and returns the positions
+// of the shares whose proof fails.
+func (m *Misbehavior) wrongShares() ([]int, error) {
+	if m.Root == nil {
+		return nil, xerrors.New("evidence without root")
+	}
+	r := &m.Reply
+	if err := r.VerifySignature(&m.Request, m.Root.Public); err != nil {
+		return nil, err
+	}
+	wk, err := decryptKeyWrite(&m.Request)
+	if err != nil {
+		return nil, err
+	}
+	xc, err := readerKey(&m.Request)
+	if err != nil {
+		return nil, err
+	}
+	if r.C == nil || !r.C.Equal(wk.C) {
+		return nil, xerrors.New("reply holds a different secret than the write")
+	}
+	if len(r.Uis) > MaxShares || len(r.Commits) > MaxShares {
+		return nil, xerrors.Errorf("more than %d shares or commits", MaxShares)
+	}
+	if len(r.Commits) == 0 || !r.Commits[0].Equal(r.X) {
+		return nil, xerrors.New("commits don't match the public key of the LTS")
+	}
+	poly := share.NewPubPoly(cothority.Suite, cothority.Suite.Point().Base(),
+		r.Commits)
+	var wrong []int
+	for i, ui := range r.Uis {
+		if ui == nil || ui.V == nil || i >= len(r.Proofs) ||
+			protocol.VerifyReencryption(poly, wk.U, xc, ui, &r.Proofs[i]) != nil {
+			wrong = append(wrong, i)
+		}
+	}
+	return wrong, nil
+}
+
+// ReportMisbehavior verifies the evidence and adds it to the event log. The
+// proofs of the request must come from an authorised chain, and, if this
+// node holds a share of the LTS, the root must be one of its nodes and the
+// commits of the reply must be the ones of the LTS.
+func (s *Service) ReportMisbehavior(req *ReportMisbehavior) (*ReportMisbehaviorReply, error) {
+	m := &req.Misbehavior
+	if err := m.Verify(); err != nil {
+		return nil, xerrors.Errorf("verifying evidence: %v", err)
+	}
+	if err := s.verifyProof(&m.Request.Read); err != nil {
+		return nil, xerrors.Errorf("verifying read proof: %v", err)
+	}
+	if err := s.verifyProof(&m.Request.Write); err != nil {
+		return nil, xerrors.Errorf("verifying write proof: %v", err)
+	}
+	wk, err := decryptKeyWrite(&m.Request)
+	if err != nil {
+		return nil, err
+	}
+	s.storage.RLock()
+	roster := s.storage.Rosters[wk.LTSID]
+	pp := s.storage.Polys[wk.LTSID]
+	err = func() error {
+		if roster != nil {
+			_, si := roster.Search(m.Root.ID)
+			if si == nil || !si.Public.Equal(m.Root.Public) {
+				return xerrors.New("root is not a node of the LTS")
+			}
+		}
+		if pp != nil {
+			if len(pp.Commits) != len(m.Reply.Commits) {
+				return xerrors.New("commits don't match the LTS")
+			}
+			for i, c := range pp.Commits {
+				if !c.Equal(m.Reply.Commits[i]) {
+					return xerrors.New("commits don't match the LTS")
+				}
+			}
+		}
+		return nil
+	}()
+	s.storage.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Warnf("AUDIT: node %s returned %d wrong shares for LTS %x",
+		m.Root, len(m.Shares), wk.LTSID[:])
+	s.events.add(Event{
+		Type:        EventMisbehavior,
+		Timestamp:   time.Now().UnixNano(),
+		ByzCoinID:   m.Request.Write.Latest.SkipChainID(),
+		BlockIndex:  -1,
+		InstanceID:  wk.LTSID,
+		WriteID:     byzcoin.NewInstanceID(m.Request.Write.InclusionProof.Key()),
+		Identity:    m.Root.Public.String(),
+		Misbehavior: m,
+	})
+	if err := s.saveEvents(); err != nil {
+		log.Error(err)
+	}
+	return &ReportMisbehaviorReply{}, nil
+}
+
+// ReportMisbehavior sends the evidence to all nodes of the LTS but the
+// accused root. It returns an error if no node accepted it.
+func (c *Client) ReportMisbehavior(m *Misbehavior) error {
+	wk, err := decryptKeyWrite(&m.Request)
+	if err != nil {
+		return err
+	}
+	roster, err := c.LTSRoster(wk.LTSID)
+	if err != nil {
+		return xerrors.Errorf("getting LTS roster: %v", err)
+	}
+	accepted := 0
+	for _, si := range roster.List {
+		if m.Root != nil && si.Equal(m.Root) {
+			continue
+		}
+		err = c.c.SendProtobuf(si, &ReportMisbehavior{Misbehavior: *m},
+			&ReportMisbehaviorReply{})
+		if err != nil {
+			log.Lvl2("node", si, "refused evidence:", err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return xerrors.Errorf("no node accepted the evidence: %v", err)
+	}
+	return nil
+}
+
+// replyError returns the error for a reply that failed verification,
+// holding the evidence against the root if the reply has wrong shares.
+func replyError(dkr *DecryptKey, reply *DecryptKeyReply,
+	root *network.ServerIdentity, err error) error {
+	m, mErr := NewMisbehavior(dkr, reply, root)
+	if mErr != nil {
+		return err
+	}
+	return &MisbehaviorError{Evidence: m, Err: err}
+}
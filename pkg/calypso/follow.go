@@ -0,0 +1,322 @@
+package calypso
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// followChain registers with the local ByzCoin service to receive all new
+// blocks of the given chain. Every new block wakes up followWorker, which
+// handles the blocks that have not been handled yet, so that the service can
+// keep its indexes up-to-date without scanning the chain. The chains hosted
+// by another cothority are polled by scheduleExternalPoll instead.
+// If the chain is already followed, nothing happens.
+func (s *Service) followChain(bcID skipchain.SkipBlockID) {
+	s.followingLock.Lock()
+	if s.following[string(bcID)] {
+		s.followingLock.Unlock()
+		return
+	}
+	s.following[string(bcID)] = true
+	s.followingLock.Unlock()
+	if s.externalRoster(bcID) != nil {
+		return
+	}
+
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		log.Error("couldn't get the byzcoin service")
+		return
+	}
+	blocks, stop, err := bc.StreamTransactions(&byzcoin.StreamingRequest{ID: bcID})
+	if err != nil {
+		log.Error("couldn't follow chain:", err)
+		return
+	}
+	// byzcoin sends the blocks while holding its locks, so they are only
+	// passed on to the worker, without waiting for it.
+	wake := make(chan struct{}, 1)
+	go s.followWorker(bcID, wake)
+	go func() {
+		defer close(wake)
+		// byzcoin releases the listener only once stop is closed: when
+		// this service closes, or when byzcoin shuts down and closes the
+		// channel of the blocks.
+		for {
+			select {
+			case _, ok := <-blocks:
+				if !ok {
+					close(stop)
+					return
+				}
+				select {
+				case wake <- struct{}{}:
+				default:
+					// The worker will handle this block
+					// with the pending ones.
+				}
+			case <-s.closing:
+				close(stop)
+				// byzcoin might be sending a block before it
+				// closes the channel.
+				for range blocks {
+				}
+				return
+			}
+		}
+	}()
+}
+
+// followWorker handles the blocks of the chain that have been added before,
+// or while the node was offline, and then the new ones every time it is
+// woken up. A block that fails is tried again the next time.
+func (s *Service) followWorker(bcID skipchain.SkipBlockID, wake chan struct{}) {
+	for {
+		if err := s.catchUp(bcID, -1); err != nil {
+			log.Error(s.ServerIdentity(), "while catching up:", err)
+		}
+		select {
+		case _, ok := <-wake:
+			if !ok {
+				return
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// catchUp handles all blocks of the chain, from the first one that has not
+// been handled yet up to, but excluding, the block at index upTo. A negative
+// upTo catches up to the latest block. The blocks are taken from the local
+// skipchain db, or fetched from the roster of the chain if this node doesn't
+// hold them, e.g. because it only recently joined.
+func (s *Service) catchUp(bcID skipchain.SkipBlockID, upTo int) error {
+	if upTo < 0 {
+		latest, err := s.getLatestBlock(bcID)
+		if err != nil {
+			return xerrors.Errorf("getting latest block: %v", err)
+		}
+		upTo = latest.Index + 1
+	}
+	for i := s.stats.nextBlock(bcID); i < upTo; i++ {
+		sb, err := s.getBlockByIndex(bcID, i)
+		if err != nil {
+			return xerrors.Errorf("getting block %d: %v", i, err)
+		}
+		if err := s.handleBlock(bcID, sb); err != nil {
+			return xerrors.Errorf("handling block %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// getLatestBlock returns the latest block of the chain, from the local
+// skipchain db if possible, else from the roster of the chain.
+func (s *Service) getLatestBlock(bcID skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
+	if sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service); ok {
+		if latest, err := sc.GetDB().GetLatestByID(bcID); err == nil {
+			return latest, nil
+		}
+	}
+	roster := s.chainRoster(bcID)
+	if roster == nil {
+		return nil, xerrors.New("don't know the roster of the chain")
+	}
+	reply, err := skipchain.NewClient().GetUpdateChain(roster, bcID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting update chain: %v", err)
+	}
+	if len(reply.Update) == 0 {
+		return nil, xerrors.New("got empty update chain")
+	}
+	return reply.Update[len(reply.Update)-1], nil
+}
+
+// getBlockByIndex returns the block of the chain at the given index, from the
+// local skipchain db if possible, else from the roster of the chain. Fetched
+// blocks are checked against the forward links from the genesis block.
+func (s *Service) getBlockByIndex(bcID skipchain.SkipBlockID, index int) (*skipchain.SkipBlock, error) {
+	if sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service); ok {
+		reply, err := sc.GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+			Genesis: bcID,
+			Index:   index,
+		})
+		if err == nil && reply.SkipBlock.Index == index {
+			return reply.SkipBlock, nil
+		}
+	}
+	roster := s.chainRoster(bcID)
+	if roster == nil {
+		return nil, xerrors.New("don't know the roster of the chain")
+	}
+	reply, err := skipchain.NewClient().GetSingleBlockByIndex(roster, bcID, index)
+	if err != nil {
+		return nil, xerrors.Errorf("fetching block from roster: %v", err)
+	}
+	genesis, err := s.fetchGenesisBlock(bcID, roster)
+	if err != nil {
+		return nil, xerrors.Errorf("fetching genesis block: %v", err)
+	}
+	if err := verifyBlockLinks(genesis, reply.SkipBlock, reply.Links); err != nil {
+		return nil, xerrors.Errorf("verifying block: %v", err)
+	}
+	return reply.SkipBlock, nil
+}
+
+// chainRoster returns the roster of the genesis block of the chain, if it is
+// known to this node, or the roster of the cothority hosting the chain.
+func (s *Service) chainRoster(bcID skipchain.SkipBlockID) *onet.Roster {
+	if roster := s.externalRoster(bcID); roster != nil {
+		return roster
+	}
+	if sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service); ok {
+		if sb := sc.GetDB().GetByID(bcID); sb != nil {
+			return sb.Roster
+		}
+	}
+	s.genesisBlocksLock.Lock()
+	defer s.genesisBlocksLock.Unlock()
+	if sb := s.genesisBlocks[string(bcID)]; sb != nil {
+		return sb.Roster
+	}
+	return nil
+}
+
+// handleBlock decodes the accepted transactions of the block and updates the
+// statistics and the event log for all calypso instructions found. Blocks
+// that have already been handled are ignored, and a block is only marked as
+// handled once it has been decoded and added to the statistics, so that it
+// is handled again if it fails.
+func (s *Service) handleBlock(bcID skipchain.SkipBlockID, sb *skipchain.SkipBlock) error {
+	s.handlingLock.Lock()
+	defer s.handlingLock.Unlock()
+	if sb.Index < s.stats.nextBlock(bcID) {
+		return nil
+	}
+	header, body, err := decodeBlock(sb)
+	if err != nil {
+		return err
+	}
+
+	var events []Event
+	writes, reads := 0, 0
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		for _, inst := range tx.ClientTransaction.Instructions {
+			evs, read, err := s.instructionEvents(bcID, inst)
+			if err != nil {
+				log.Lvl2("invalid instruction in accepted transaction:", err)
+				continue
+			}
+			if read != nil {
+				s.stats.addRead(read.Write, read.Xc, header.Timestamp)
+			}
+			for _, e := range evs {
+				switch e.Type {
+				case EventWrite:
+					writes++
+				case EventRead:
+					reads++
+				}
+				e.Timestamp = header.Timestamp
+				e.ByzCoinID = bcID
+				e.BlockIndex = sb.Index
+				if e.Identity == "" && len(inst.SignerIdentities) > 0 {
+					e.Identity = inst.SignerIdentities[0].String()
+				}
+				if e.Type == EventWrite {
+					s.stats.addWrite(bcID, e.WriteID, e.Identity,
+						instructionWrite(inst), header.Timestamp)
+				}
+				events = append(events, e)
+			}
+		}
+	}
+	s.stats.addBlock(bcID, header.Timestamp, writes, reads)
+	s.stats.markBlock(bcID, sb.Index)
+	if err := s.saveStats(); err != nil {
+		return xerrors.Errorf("saving statistics: %v", err)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	s.events.add(events...)
+	if err := s.saveEvents(); err != nil {
+		return xerrors.Errorf("saving events: %v", err)
+	}
+	// Only the leader of the block notifies the webhooks, so that every
+	// read is sent once.
+	if len(sb.Roster.List) > 0 && sb.Roster.List[0].Equal(s.ServerIdentity()) {
+		s.notifyWebhooks(events, sb.Hash)
+	}
+	return nil
+}
+
+// instructionEvents returns the events for the instruction. If it spawns a
+// read-instance, the read is returned, too.
+func (s *Service) instructionEvents(bcID skipchain.SkipBlockID,
+	inst byzcoin.Instruction) ([]Event, *Read, error) {
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		switch inst.Spawn.ContractID {
+		case ContractWriteID:
+			id, err := inst.DeriveIDArg("", "preID")
+			if err != nil {
+				return nil, nil, xerrors.Errorf("getting write ID: %v", err)
+			}
+			return []Event{{Type: EventWrite, InstanceID: id, WriteID: id}}, nil, nil
+		case ContractReadID:
+			rd, err := decodeRead(inst.Spawn.Args.Search("read"))
+			if err != nil {
+				return nil, nil, err
+			}
+			id, err := inst.DeriveIDArg("", "preID")
+			if err != nil {
+				return nil, nil, xerrors.Errorf("getting read ID: %v", err)
+			}
+			return []Event{{Type: EventRead, InstanceID: id, WriteID: rd.Write}}, rd, nil
+		}
+	case byzcoin.InvokeType:
+		if inst.Invoke.ContractID == ContractWriteID {
+			var typ string
+			switch inst.Invoke.Command {
+			case "update":
+				// Only an update creates a new write-instance.
+				id := inst.DeriveID("")
+				return []Event{{Type: EventWrite, InstanceID: id, WriteID: id}}, nil, nil
+			case "freeze":
+				typ = EventFrozen
+			case "unfreeze":
+				typ = EventUnfrozen
+			case "hold":
+				typ = EventHeld
+			case "release":
+				typ = EventReleased
+			case "retain":
+				typ = EventRetained
+			default:
+				return nil, nil, nil
+			}
+			return []Event{{Type: typ, InstanceID: inst.InstanceID,
+				WriteID: inst.InstanceID}}, nil, nil
+		}
+		if inst.Invoke.ContractID != byzcoin.ContractDarcID {
+			return nil, nil, nil
+		}
+		d, err := darc.NewFromProtobuf(inst.Invoke.Args.Search("darc"))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("decoding darc: %v", err)
+		}
+		events, err := s.accessEvents(bcID, d)
+		return events, nil, cothority.ErrorOrNil(err, "comparing darcs")
+	}
+	return nil, nil, nil
+}
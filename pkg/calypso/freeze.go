@@ -0,0 +1,55 @@
+package calypso
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"golang.org/x/xerrors"
+)
+
+// checkFrozen returns an error if the latest version of the write-instance
+// is frozen. The proof of the write given by the reader can be older than
+// the freeze, so the state is read from the local copy of the chain, or from
+// the cothority hosting the chain in light mode. Other nodes that don't hold
+// the chain rely on the verification done by the leader of the
+// re-encryption.
+func (s *Service) checkFrozen(bcID skipchain.SkipBlockID, writeID byzcoin.InstanceID) error {
+	var proof *byzcoin.Proof
+	if roster := s.externalRoster(bcID); roster != nil {
+		p, err := s.getExternalProof(bcID, roster, writeID)
+		if err != nil {
+			return xerrors.Errorf("getting proof of write: %v", err)
+		}
+		proof = p
+	} else {
+		sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+		if !ok || sc.GetDB().GetByID(bcID) == nil {
+			return nil
+		}
+		bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+		if !ok {
+			return xerrors.New("couldn't get the byzcoin service")
+		}
+		resp, err := bc.GetProof(&byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			Key:     writeID.Slice(),
+			ID:      bcID,
+		})
+		if err != nil {
+			return xerrors.Errorf("getting proof of write: %v", err)
+		}
+		proof = &resp.Proof
+	}
+	if !proof.InclusionProof.Match(writeID.Slice()) {
+		return xerrors.New("write instance doesn't exist anymore")
+	}
+	var write Write
+	err := proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+	if err != nil {
+		return xerrors.Errorf("decoding write: %v", err)
+	}
+	if write.Frozen {
+		return xerrors.Errorf("write is frozen: %s", write.FreezeReason)
+	}
+	return nil
+}
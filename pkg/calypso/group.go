@@ -0,0 +1,288 @@
+package calypso
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A reader group holds the public keys of its members in a group instance.
+// A write can list reader groups, and a read signed by a member of one of
+// them is accepted even if the darc of the write doesn't allow the member.
+// The membership is checked when the read is spawned, so adding a member to
+// a group gives access to all the documents already shared with it. The
+// read records the group and the member, and every decryption needs a recent
+// proof of the group in which the member is still listed, so that a removed
+// member cannot decrypt anything with the reads it spawned before.
+
+// maxGroupProofAge is the number of blocks the proof of a group can be
+// behind the latest block known by the node.
+const maxGroupProofAge = 5
+
+// ContractGroupID references a group contract system-wide.
+const ContractGroupID = "calypsoGroup"
+
+// contractGroup holds the members of a reader group. It is spawned with the
+// "group" argument, and invoked with "add" or "remove", taking the public
+// key of the member in the "key" argument. The darc of the group decides
+// who can add and remove members.
+type contractGroup struct {
+	byzcoin.BasicContract
+	Group
+}
+
+func contractGroupFromBytes(in []byte) (byzcoin.Contract, error) {
+	c := &contractGroup{}
+	err := protobuf.DecodeWithConstructors(in, &c.Group,
+		network.DefaultConstructors(cothority.Suite))
+	return c, cothority.ErrorOrNil(err, "couldn't unmarshal group")
+}
+
+func (c *contractGroup) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	var g Group
+	err = protobuf.DecodeWithConstructors(inst.Spawn.Args.Search("group"), &g,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("passed group argument is invalid: %v", err)
+	}
+	members := g.Members
+	g.Members = nil
+	for _, m := range members {
+		if err := g.add(m); err != nil {
+			return nil, nil, err
+		}
+	}
+	buf, err := protobuf.Encode(&g)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding group: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create,
+		inst.DeriveID(""), ContractGroupID, buf, darcID)}, coins, nil
+}
+
+func (c *contractGroup) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	key := cothority.Suite.Point()
+	if err := key.UnmarshalBinary(inst.Invoke.Args.Search("key")); err != nil {
+		return nil, nil, xerrors.Errorf("invalid key argument: %v", err)
+	}
+	switch inst.Invoke.Command {
+	case "add":
+		err = c.Group.add(key)
+	case "remove":
+		err = c.Group.remove(key)
+	default:
+		return nil, nil, xerrors.New("can only add or remove members")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := protobuf.Encode(&c.Group)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding group: %v", err)
+	}
+	log.Lvlf2("%s member %s of group %x", inst.Invoke.Command, key,
+		inst.InstanceID[:])
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractGroupID, buf, darcID)}, coins, nil
+}
+
+// add adds the key to the members of the group.
+func (g *Group) add(key kyber.Point) error {
+	if key == nil {
+		return xerrors.New("member without key")
+	}
+	if g.member(key) {
+		return xerrors.New("already a member")
+	}
+	g.Members = append(g.Members, key)
+	return nil
+}
+
+// remove removes the key from the members of the group.
+func (g *Group) remove(key kyber.Point) error {
+	for i, m := range g.Members {
+		if m.Equal(key) {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			return nil
+		}
+	}
+	return xerrors.New("not a member")
+}
+
+// member returns true if the key is a member of the group.
+func (g *Group) member(key kyber.Point) bool {
+	for _, m := range g.Members {
+		if m.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// readGroup returns the group stored in the instance.
+func readGroup(rst byzcoin.ReadOnlyStateTrie, id byzcoin.InstanceID) (*Group, error) {
+	buf, _, contractID, _, err := rst.GetValues(id.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting group %x: %v", id[:], err)
+	}
+	if contractID != ContractGroupID {
+		return nil, xerrors.Errorf("%x is not a group", id[:])
+	}
+	var g Group
+	err = protobuf.DecodeWithConstructors(buf, &g,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding group: %v", err)
+	}
+	return &g, nil
+}
+
+// verifyGroups checks that the reader groups of the write exist.
+func (wr *Write) verifyGroups(rst byzcoin.ReadOnlyStateTrie) error {
+	for _, id := range wr.Groups {
+		if _, err := readGroup(rst, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyGroupRead checks a read signed by a member of one of the reader
+// groups of the write.
+func (c ContractWrite) verifyGroupRead(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	if len(inst.SignerIdentities) != 1 || len(inst.Signatures) != 1 {
+		return xerrors.New("a group read must have exactly one signer")
+	}
+	signer := inst.SignerIdentities[0]
+	if signer.Ed25519 == nil {
+		return xerrors.New("group members must sign with an Ed25519 key")
+	}
+	group, err := c.Write.groupOf(rst, signer.Ed25519.Point)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return xerrors.Errorf("%s is not a member of the reader groups", signer)
+	}
+	err = byzcoin.VerifySignerCounters(rst, inst.SignerCounter, inst.SignerIdentities)
+	if err != nil {
+		return xerrors.Errorf("signer counter: %v", err)
+	}
+	if err := signer.Verify(ctxHash, inst.Signatures[0]); err != nil {
+		return xerrors.Errorf("wrong signature: %v", err)
+	}
+	log.Lvlf2("%s reads %x as member of group %x", signer,
+		inst.InstanceID[:], group[:])
+	return nil
+}
+
+// groupOf returns the first reader group of the write the key is a member
+// of, or nil if it isn't a member of any of them.
+func (wr *Write) groupOf(rst byzcoin.ReadOnlyStateTrie, key kyber.Point) (*byzcoin.InstanceID, error) {
+	for i, id := range wr.Groups {
+		g, err := readGroup(rst, id)
+		if err != nil {
+			return nil, err
+		}
+		if g.member(key) {
+			return &wr.Groups[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// setGroup records in the read the reader group its only signer is a
+// member of, if any. A read signed by a member is treated as a group read,
+// even if the darc of the write allows the member, too.
+func (wr *Write) setGroup(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, rd *Read) error {
+	if rd.Group != nil || rd.Member != nil {
+		return xerrors.New("the group of a read is set by the contract")
+	}
+	if len(wr.Groups) == 0 || len(inst.SignerIdentities) != 1 ||
+		inst.SignerIdentities[0].Ed25519 == nil {
+		return nil
+	}
+	member := inst.SignerIdentities[0].Ed25519.Point
+	group, err := wr.groupOf(rst, member)
+	if err != nil {
+		return err
+	}
+	if group != nil {
+		rd.Group = group
+		rd.Member = member
+	}
+	return nil
+}
+
+// checkGroupMember returns an error if the read has been accepted through a
+// reader group, and the proof of the group doesn't list the member anymore.
+// The proof must come from the chain of the read, and be at most
+// maxGroupProofAge blocks old.
+func (s *Service) checkGroupMember(read *Read, readProof, groupProof *byzcoin.Proof) error {
+	if read.Group == nil {
+		return nil
+	}
+	if groupProof == nil {
+		return xerrors.New("the read needs the proof of its reader group")
+	}
+	if !groupProof.InclusionProof.Match(read.Group.Slice()) {
+		return xerrors.New("the proof is not for the group of the read")
+	}
+	scID := readProof.Latest.SkipChainID()
+	if !groupProof.Latest.SkipChainID().Equal(scID) {
+		return xerrors.New("the group is on another chain than the read")
+	}
+	if err := s.verifyProof(groupProof); err != nil {
+		return xerrors.Errorf("verifying proof of group: %v", err)
+	}
+	latest, err := s.getLatestBlock(scID)
+	if err != nil {
+		return xerrors.Errorf("getting latest block: %v", err)
+	}
+	if groupProof.Latest.Index+maxGroupProofAge < latest.Index {
+		return xerrors.Errorf("the proof of the group is older than %d blocks",
+			maxGroupProofAge)
+	}
+	var g Group
+	if err := groupProof.VerifyAndDecode(cothority.Suite, ContractGroupID, &g); err != nil {
+		return xerrors.Errorf("decoding group: %v", err)
+	}
+	if !g.member(read.Member) {
+		return xerrors.Errorf("%s is not a member of group %x anymore",
+			read.Member, read.Group[:])
+	}
+	return nil
+}
+
+// addGroupProof adds the latest proof of the reader group of the read to
+// the request, if the read has been accepted through one.
+func (c *Client) addGroupProof(dkr *DecryptKey) error {
+	if dkr.Group != nil {
+		return nil
+	}
+	read, err := decodeReadProof(&dkr.Read)
+	if err != nil {
+		return xerrors.Errorf("decoding read: %v", err)
+	}
+	if read.Group == nil {
+		return nil
+	}
+	resp, err := c.bcClient.GetProof(read.Group.Slice())
+	if err != nil {
+		return xerrors.Errorf("getting proof of group: %v", err)
+	}
+	dkr.Group = &resp.Proof
+	return nil
+}
@@ -0,0 +1,63 @@
+package idp
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// Client is used to communicate with the adapter.
+type Client struct {
+	*onet.Client
+}
+
+// NewClient instantiates a new Client.
+func NewClient() *Client {
+	return &Client{Client: onet.NewClient(cothority.Suite, ServiceName)}
+}
+
+// Bind asks the adapter running on si to sign msg for the claim data of the
+// user authenticated by token.
+func (c *Client) Bind(si *network.ServerIdentity, typ, token, data string,
+	msg []byte) (*BindReply, error) {
+	reply := &BindReply{}
+	err := c.SendProtobuf(si, &Bind{
+		Type:  typ,
+		Token: token,
+		Data:  data,
+		Msg:   msg,
+	}, reply)
+	return reply, cothority.ErrorOrNil(err, "sending Bind message")
+}
+
+// PublicKey returns the public key the adapter running on si signs the
+// bindings with.
+func (c *Client) PublicKey(si *network.ServerIdentity) (kyber.Point, error) {
+	reply := &PublicKeyReply{}
+	err := c.SendProtobuf(si, &PublicKey{}, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending PublicKey message: %v", err)
+	}
+	return reply.Public, nil
+}
+
+// NewSigner returns a darc signer for the claim data of the user
+// authenticated by token. Every signature is requested from the adapter
+// running on si.
+func (c *Client) NewSigner(si *network.ServerIdentity, typ, token,
+	data string) (darc.Signer, error) {
+	pub, err := c.PublicKey(si)
+	if err != nil {
+		return darc.Signer{}, err
+	}
+	return darc.NewSignerProxy(data, pub, func(msg []byte) ([]byte, error) {
+		reply, err := c.Bind(si, typ, token, data, msg)
+		if err != nil {
+			return nil, err
+		}
+		return reply.Signature, nil
+	}), nil
+}
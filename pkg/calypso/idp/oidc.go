@@ -0,0 +1,129 @@
+package idp
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// OIDCValidator validates the ID tokens of an OpenID Connect provider. A
+// token must be signed with RS256 by one of the Keys, be issued by Issuer
+// for Audience, and not be expired. The claims of the user are its "email",
+// if "email_verified" is set, and its "groups".
+//
+// It is registered with RegisterValidator, usually under the type "oidc".
+type OIDCValidator struct {
+	Issuer   string
+	Audience string
+	// Keys are the public keys of the provider by key ID, as published in
+	// its JWKS document.
+	Keys map[string]*rsa.PublicKey
+	// Leeway is the clock skew allowed when checking the times of the
+	// token.
+	Leeway time.Duration
+}
+
+// oidcHeader is the header of a JWT.
+type oidcHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// oidcPayload holds the claims of an ID token used by the validator.
+type oidcPayload struct {
+	Iss           string          `json:"iss"`
+	Aud           json.RawMessage `json:"aud"`
+	Exp           int64           `json:"exp"`
+	Nbf           int64           `json:"nbf"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+	Groups        []string        `json:"groups"`
+}
+
+// Validate implements Validator.
+func (v *OIDCValidator) Validate(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, xerrors.New("token is not a JWT")
+	}
+	var header oidcHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, xerrors.Errorf("decoding header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, xerrors.Errorf("unsupported algorithm '%s'", header.Alg)
+	}
+	key, ok := v.Keys[header.Kid]
+	if !ok {
+		return nil, xerrors.Errorf("unknown key '%s'", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, xerrors.Errorf("decoding signature: %v", err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, xerrors.Errorf("verifying signature: %v", err)
+	}
+
+	var payload oidcPayload
+	if err := decodeSegment(parts[1], &payload); err != nil {
+		return nil, xerrors.Errorf("decoding payload: %v", err)
+	}
+	if payload.Iss != v.Issuer {
+		return nil, xerrors.Errorf("wrong issuer '%s'", payload.Iss)
+	}
+	if !payload.hasAudience(v.Audience) {
+		return nil, xerrors.New("token is not issued for this audience")
+	}
+	now := time.Now()
+	if payload.Exp == 0 || now.After(time.Unix(payload.Exp, 0).Add(v.Leeway)) {
+		return nil, xerrors.New("token has expired")
+	}
+	if payload.Nbf != 0 && now.Add(v.Leeway).Before(time.Unix(payload.Nbf, 0)) {
+		return nil, xerrors.New("token is not valid yet")
+	}
+
+	claims := &Claims{Groups: payload.Groups}
+	if payload.EmailVerified {
+		claims.Email = payload.Email
+	}
+	return claims, nil
+}
+
+// hasAudience returns true if the audience of the token, a string or a
+// list of strings, holds aud.
+func (p *oidcPayload) hasAudience(aud string) bool {
+	if aud == "" {
+		return false
+	}
+	var one string
+	if json.Unmarshal(p.Aud, &one) == nil {
+		return one == aud
+	}
+	var list []string
+	if json.Unmarshal(p.Aud, &list) != nil {
+		return false
+	}
+	for _, a := range list {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(seg string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,41 @@
+package idp
+
+import (
+	"go.dedis.ch/kyber/v3"
+)
+
+// PROTOSTART
+// package idp;
+//
+// option java_package = "ch.epfl.dedis.lib.proto";
+// option java_outer_classname = "IdentityProviderProto";
+
+// Bind asks the adapter to sign Msg on behalf of the user authenticated by
+// Token. Data must be one of the claims of the user, e.g.,
+// "email:alice@example.com" or "group:engineering".
+type Bind struct {
+	// Type is the name of the validator used for the token, e.g., "oidc".
+	Type string
+	// Token is the credential given by the identity provider.
+	Token string
+	// Data is the claim the signature is bound to.
+	Data string
+	// Msg is the message to sign, usually the hash of a ByzCoin
+	// transaction.
+	Msg []byte
+}
+
+// BindReply holds the signature of the adapter. It can be verified by the
+// darc identity "proxy:<public key of the adapter>:<Data>".
+type BindReply struct {
+	Signature []byte
+}
+
+// PublicKey asks the adapter for the public key it signs the bindings with.
+type PublicKey struct {
+}
+
+// PublicKeyReply holds the public key of the adapter.
+type PublicKeyReply struct {
+	Public kyber.Point
+}
@@ -0,0 +1,151 @@
+// Package idp implements an adapter between external identity providers,
+// like OIDC or SAML, and the proxy identities of darcs.
+//
+// A user authenticated by an identity provider sends its token together
+// with the message to sign to the adapter. If the token is valid, the
+// adapter signs the message for one of the claims of the user, for example
+// its email address. The signature can be verified by the darc identity
+// "proxy:<public key of the node>:email:alice@example.com", so that writers
+// can give access to their documents using email addresses or groups
+// instead of public keys.
+//
+// The adapter doesn't sign with the key of the node, but with a key derived
+// from it for this use only, see PublicKey. A binding can then not be taken
+// for a message signed by the node, and the reverse.
+package idp
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"sync"
+
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// ServiceName of the identity provider adapter.
+const ServiceName = "CalypsoIdentityProvider"
+
+var idpID onet.ServiceID
+
+var validators = struct {
+	sync.Mutex
+	m map[string]Validator
+}{m: make(map[string]Validator)}
+
+func init() {
+	var err error
+	idpID, err = onet.RegisterNewService(ServiceName, newService)
+	log.ErrFatal(err)
+}
+
+// RegisterValidator makes the adapter accept tokens of the given type,
+// verified by v. It should be called in an init().
+func RegisterValidator(typ string, v Validator) {
+	validators.Lock()
+	validators.m[typ] = v
+	validators.Unlock()
+}
+
+// Service signs messages on behalf of users authenticated by an identity
+// provider, using a key derived from the private key of the node.
+type Service struct {
+	*onet.ServiceProcessor
+	private kyber.Scalar
+	public  kyber.Point
+}
+
+// keyDomain separates the key of the adapter from the key of the node.
+const keyDomain = "calypso-idp-binding-key"
+
+// deriveKey returns the private key of the adapter for the private key of
+// the node.
+func deriveKey(node kyber.Scalar) (kyber.Scalar, error) {
+	buf, err := node.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshaling key: %v", err)
+	}
+	h := sha512.New()
+	h.Write([]byte(keyDomain))
+	h.Write(buf)
+	return cothority.Suite.Scalar().SetBytes(h.Sum(nil)), nil
+}
+
+// PublicKey returns the public key the adapter signs the bindings with.
+func (s *Service) PublicKey(req *PublicKey) (*PublicKeyReply, error) {
+	return &PublicKeyReply{Public: s.public}, nil
+}
+
+// Bind validates the token of the request and returns a signature on the
+// message bound to the requested claim.
+func (s *Service) Bind(req *Bind) (*BindReply, error) {
+	validators.Lock()
+	v, ok := validators.m[req.Type]
+	validators.Unlock()
+	if !ok {
+		return nil, xerrors.Errorf("unknown token type '%s'", req.Type)
+	}
+	claims, err := v.Validate(req.Token)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid token: %v", err)
+	}
+	found := false
+	for _, d := range claims.Data() {
+		if d == req.Data {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, xerrors.Errorf("the token doesn't allow to bind to '%s'", req.Data)
+	}
+
+	sig, err := schnorr.Sign(cothority.Suite, s.private,
+		bindingMessage(req.Data, req.Msg))
+	if err != nil {
+		return nil, xerrors.Errorf("signing: %v", err)
+	}
+	log.Lvlf2("%s: bound message to %s", s.ServerIdentity(), req.Data)
+	return &BindReply{Signature: sig}, nil
+}
+
+// Identity returns the darc identity of the users having the claim data,
+// as vouched for by the adapter with the public key pub, as returned by
+// PublicKey.
+func Identity(pub kyber.Point, data string) darc.Identity {
+	return darc.NewIdentityProxy(&darc.SignerProxy{Data: data, Public: pub})
+}
+
+// bindingMessage returns the message actually signed, as expected by
+// darc.IdentityProxy: H(len(data)|data|msg).
+func bindingMessage(data string, msg []byte) []byte {
+	h := sha256.New()
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	h.Write(b)
+	h.Write([]byte(data))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func newService(c *onet.Context) (onet.Service, error) {
+	s := &Service{
+		ServiceProcessor: onet.NewServiceProcessor(c),
+	}
+	var err error
+	s.private, err = deriveKey(s.ServerIdentity().GetPrivate())
+	if err != nil {
+		return nil, xerrors.Errorf("deriving key: %v", err)
+	}
+	s.public = cothority.Suite.Point().Mul(s.private, nil)
+	if err := s.RegisterHandlers(s.Bind, s.PublicKey); err != nil {
+		return nil, xerrors.New("couldn't register messages")
+	}
+	return s, nil
+}
@@ -0,0 +1,134 @@
+package idp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+type staticValidator map[string]*Claims
+
+func (v staticValidator) Validate(token string) (*Claims, error) {
+	c, ok := v[token]
+	if !ok {
+		return nil, xerrors.New("unknown token")
+	}
+	return c, nil
+}
+
+func TestService_Bind(t *testing.T) {
+	RegisterValidator("static", staticValidator{
+		"alice": {Email: "alice@example.com", Groups: []string{"engineering"}},
+	})
+	local := onet.NewLocalTest(cothority.Suite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(1, true)
+	si := roster.List[0]
+
+	cl := NewClient()
+	pub, err := cl.PublicKey(si)
+	require.NoError(t, err)
+	require.False(t, pub.Equal(si.Public))
+	msg := []byte("transaction hash")
+	for _, data := range []string{"email:alice@example.com", "group:engineering"} {
+		signer, err := cl.NewSigner(si, "static", "alice", data)
+		require.NoError(t, err)
+		sig, err := signer.Sign(msg)
+		require.NoError(t, err)
+		id := Identity(pub, data)
+		require.NoError(t, id.Verify(msg, sig))
+		require.Error(t, id.Verify([]byte("other message"), sig))
+		// The binding is not signed with the key of the node.
+		require.Error(t, Identity(si.Public, data).Verify(msg, sig))
+	}
+
+	_, err = cl.Bind(si, "static", "alice", "group:finance", msg)
+	require.Error(t, err)
+	_, err = cl.Bind(si, "static", "bob", "email:alice@example.com", msg)
+	require.Error(t, err)
+	_, err = cl.Bind(si, "oidc", "alice", "email:alice@example.com", msg)
+	require.Error(t, err)
+}
+
+func TestOIDCValidator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	v := &OIDCValidator{
+		Issuer:   "https://idp.example.com",
+		Audience: "calypso",
+		Keys:     map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+	}
+	sign := func(kid string, payload map[string]interface{}) string {
+		h, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+		require.NoError(t, err)
+		p, err := json.Marshal(payload)
+		require.NoError(t, err)
+		data := base64.RawURLEncoding.EncodeToString(h) + "." +
+			base64.RawURLEncoding.EncodeToString(p)
+		hash := sha256.Sum256([]byte(data))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+		return data + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	payload := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            v.Issuer,
+			"aud":            []string{"other", v.Audience},
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"groups":         []string{"engineering"},
+		}
+	}
+
+	claims, err := v.Validate(sign("k1", payload()))
+	require.NoError(t, err)
+	require.Equal(t, []string{"email:alice@example.com", "group:engineering"},
+		claims.Data())
+
+	p := payload()
+	p["email_verified"] = false
+	claims, err = v.Validate(sign("k1", p))
+	require.NoError(t, err)
+	require.Equal(t, []string{"group:engineering"}, claims.Data())
+
+	_, err = v.Validate(sign("k2", payload()))
+	require.Error(t, err)
+	for claim, value := range map[string]interface{}{
+		"iss": "https://evil.example.com",
+		"aud": "other",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+		"nbf": time.Now().Add(time.Hour).Unix(),
+	} {
+		p := payload()
+		p[claim] = value
+		_, err = v.Validate(sign("k1", p))
+		require.Error(t, err, claim)
+	}
+
+	// The payload cannot be changed after the signature.
+	token := strings.Split(sign("k1", payload()), ".")
+	p = payload()
+	p["groups"] = []string{"finance"}
+	buf, err := json.Marshal(p)
+	require.NoError(t, err)
+	token[1] = base64.RawURLEncoding.EncodeToString(buf)
+	_, err = v.Validate(strings.Join(token, "."))
+	require.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package idp
+
+import (
+	"go.dedis.ch/onet/v3/network"
+)
+
+func init() {
+	network.RegisterMessages(Bind{}, BindReply{}, PublicKey{}, PublicKeyReply{})
+}
+
+// Claims are the attributes of a user vouched for by an identity provider.
+type Claims struct {
+	Email  string
+	Groups []string
+}
+
+// Data returns the proxy data strings the user is allowed to bind to.
+func (c Claims) Data() []string {
+	var data []string
+	if c.Email != "" {
+		data = append(data, "email:"+c.Email)
+	}
+	for _, g := range c.Groups {
+		data = append(data, "group:"+g)
+	}
+	return data
+}
+
+// Validator verifies a token issued by an identity provider and returns
+// the claims of the authenticated user. Implementations for OIDC or SAML
+// must check the signature of the token, its issuer, its audience and its
+// expiry.
+type Validator interface {
+	Validate(token string) (*Claims, error)
+}
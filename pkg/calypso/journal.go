@@ -0,0 +1,138 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"go.dedis.ch/protobuf"
+	bbolt "go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+// The event log and the statistics change with every block of the followed
+// chains. Instead of saving them completely every time, their changes are
+// appended to a journal, and a snapshot is only saved once the journal
+// holds compactAfter records. When loading, the records that are newer than
+// the snapshot are applied to it.
+
+// compactAfter is the number of records of a journal after which a snapshot
+// is saved and the journal emptied.
+const compactAfter = 1000
+
+// journal is an append-only log of records, stored in its own bucket of the
+// db. The records are keyed by their sequence number.
+type journal struct {
+	db     *bbolt.DB
+	bucket []byte
+	// next is the sequence number of the next record.
+	next uint64
+	// size is the number of records in the journal.
+	size int
+	sync.Mutex
+}
+
+// newJournal opens the journal with the given name.
+func (s *Service) newJournal(name string) (*journal, error) {
+	db, bucket := s.GetAdditionalBucket([]byte(name))
+	j := &journal{db: db, bucket: bucket}
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return xerrors.New("missing bucket")
+		}
+		if k, _ := b.Cursor().Last(); k != nil {
+			j.next = binary.BigEndian.Uint64(k) + 1
+		}
+		j.size = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("opening journal %s: %v", name, err)
+	}
+	return j, nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// append adds the records to the journal in one transaction. It returns the
+// sequence number following the last record, and the number of records of
+// the journal.
+func (j *journal) append(records ...interface{}) (uint64, int, error) {
+	j.Lock()
+	defer j.Unlock()
+	if len(records) == 0 {
+		return j.next, j.size, nil
+	}
+	bufs := make([][]byte, len(records))
+	for i, r := range records {
+		buf, err := protobuf.Encode(r)
+		if err != nil {
+			return 0, 0, xerrors.Errorf("encoding record: %v", err)
+		}
+		bufs[i] = buf
+	}
+	err := j.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(j.bucket)
+		for i, buf := range bufs {
+			if err := b.Put(seqKey(j.next+uint64(i)), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("appending to journal: %v", err)
+	}
+	j.next += uint64(len(bufs))
+	j.size += len(bufs)
+	return j.next, j.size, nil
+}
+
+// replay calls f with the records whose sequence number is at least from,
+// in order.
+func (j *journal) replay(from uint64, f func(buf []byte) error) error {
+	return j.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(j.bucket).Cursor()
+		for k, v := c.Seek(seqKey(from)); k != nil; k, v = c.Next() {
+			if err := f(v); err != nil {
+				return xerrors.Errorf("record %d: %v",
+					binary.BigEndian.Uint64(k), err)
+			}
+		}
+		return nil
+	})
+}
+
+// truncate removes the records whose sequence number is below upTo, once
+// they are part of a snapshot.
+func (j *journal) truncate(upTo uint64) error {
+	j.Lock()
+	defer j.Unlock()
+	removed := 0
+	err := j.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(j.bucket)
+		// Deleting while iterating would skip keys.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil &&
+			binary.BigEndian.Uint64(k) < upTo; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("truncating journal: %v", err)
+	}
+	j.size -= removed
+	return nil
+}
@@ -0,0 +1,429 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"strings"
+
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/eddsa"
+	"golang.org/x/xerrors"
+)
+
+// The helpers in this file allow readers and writers to reuse Ed25519 keys
+// they already have, stored in one of the usual formats:
+//
+//   - PKCS#8 / PKIX PEM blocks, as written by `openssl genpkey -algorithm ed25519`
+//   - unencrypted OpenSSH private keys, as written by `ssh-keygen -t ed25519`
+//   - `ssh-ed25519 AAAA... comment` public key lines
+//   - JSON Web Keys of type OKP and curve Ed25519 (RFC 8037), with the
+//     base64url encoded public key in "x" and the seed in "d"
+//
+// A standard Ed25519 private key is a 32-byte seed. The scalar used by kyber
+// is derived from it by hashing and clamping: the first 32 bytes of
+// SHA-512(seed) have their 3 lowest bits and their highest bit cleared and
+// their second highest bit set, and are read as a little-endian integer.
+// kyber marshals this scalar reduced modulo the order of the group, also as
+// 32 little-endian bytes. So a seed can always be turned into a darc.Signer,
+// but a bare scalar cannot be turned back into a seed. This is why only
+// ed25519.PrivateKey values can be exported.
+
+const (
+	pemTypePrivate        = "PRIVATE KEY"
+	pemTypePublic         = "PUBLIC KEY"
+	pemTypeOpenSSHPrivate = "OPENSSH PRIVATE KEY"
+
+	sshKeyTypeEd25519 = "ssh-ed25519"
+	sshMagic          = "openssh-key-v1\x00"
+
+	jwkTypeOKP      = "OKP"
+	jwkCurveEd25519 = "Ed25519"
+)
+
+// jwk is an Ed25519 key in the JSON Web Key format of RFC 8037. D is only
+// set for private keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	D   string `json:"d,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// NewEd25519Key creates a new standard Ed25519 key that can be exported with
+// the Marshal* functions and used as a darc.Signer with NewSignerFromEd25519.
+func NewEd25519Key() (ed25519.PrivateKey, error) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generating key: %v", err)
+	}
+	return sk, nil
+}
+
+// NewSignerFromEd25519 returns a darc.Signer using the same key pair as the
+// given standard Ed25519 private key.
+func NewSignerFromEd25519(sk ed25519.PrivateKey) (darc.Signer, error) {
+	if len(sk) != ed25519.PrivateKeySize {
+		return darc.Signer{}, xerrors.New("wrong private key length")
+	}
+	ed := &eddsa.EdDSA{}
+	if err := ed.UnmarshalBinary(sk); err != nil {
+		return darc.Signer{}, xerrors.Errorf("converting private key: %v", err)
+	}
+	return darc.NewSignerEd25519(ed.Public, ed.Secret), nil
+}
+
+// ParseEd25519PrivateKey reads an Ed25519 private key from a PKCS#8 PEM
+// block, from an unencrypted OpenSSH private key file, or from a JSON Web
+// Key.
+func ParseEd25519PrivateKey(buf []byte) (ed25519.PrivateKey, error) {
+	if isJWK(buf) {
+		k, pub, err := parseJWK(buf)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing JWK: %v", err)
+		}
+		seed, err := base64.RawURLEncoding.DecodeString(k.D)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, xerrors.New("JWK doesn't hold an ed25519 private key")
+		}
+		sk := ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(sk[ed25519.SeedSize:], pub) {
+			return nil, xerrors.New("public key of JWK doesn't match")
+		}
+		return sk, nil
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, xerrors.New("no PEM block found")
+	}
+	switch block.Type {
+	case pemTypePrivate:
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing PKCS#8 key: %v", err)
+		}
+		sk, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, xerrors.New("not an ed25519 private key")
+		}
+		return sk, nil
+	case pemTypeOpenSSHPrivate:
+		return parseOpenSSHPrivateKey(block.Bytes)
+	default:
+		return nil, xerrors.Errorf("unknown PEM block type '%s'", block.Type)
+	}
+}
+
+// ParseSigner is a convenience function that reads an Ed25519 private key
+// with ParseEd25519PrivateKey and returns the corresponding darc.Signer.
+func ParseSigner(buf []byte) (darc.Signer, error) {
+	sk, err := ParseEd25519PrivateKey(buf)
+	if err != nil {
+		return darc.Signer{}, xerrors.Errorf("parsing private key: %v", err)
+	}
+	return NewSignerFromEd25519(sk)
+}
+
+// MarshalEd25519PrivateKeyPEM returns the private key as a PKCS#8 PEM block.
+func MarshalEd25519PrivateKeyPEM(sk ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling PKCS#8 key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePrivate, Bytes: der}), nil
+}
+
+// MarshalEd25519PrivateKeyOpenSSH returns the private key in the unencrypted
+// OpenSSH format, which can be used directly by ssh and ssh-keygen.
+func MarshalEd25519PrivateKeyOpenSSH(sk ed25519.PrivateKey, comment string) ([]byte, error) {
+	if len(sk) != ed25519.PrivateKeySize {
+		return nil, xerrors.New("wrong private key length")
+	}
+	pub := sk.Public().(ed25519.PublicKey)
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, xerrors.Errorf("reading check bytes: %v", err)
+	}
+	private := &bytes.Buffer{}
+	private.Write(check[:])
+	private.Write(check[:])
+	writeSSHString(private, []byte(sshKeyTypeEd25519))
+	writeSSHString(private, pub)
+	writeSSHString(private, sk)
+	writeSSHString(private, []byte(comment))
+	// The private section is padded with 1, 2, 3, ... to the cipher block
+	// size, which is 8 for the "none" cipher.
+	for i := byte(1); private.Len()%8 != 0; i++ {
+		private.WriteByte(i)
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(sshMagic)
+	writeSSHString(out, []byte("none"))
+	writeSSHString(out, []byte("none"))
+	writeSSHString(out, nil)
+	binary.Write(out, binary.BigEndian, uint32(1))
+	writeSSHString(out, marshalSSHPublicKey(pub))
+	writeSSHString(out, private.Bytes())
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypeOpenSSHPrivate,
+		Bytes: out.Bytes()}), nil
+}
+
+// ParsePublicKey reads an Ed25519 public key from a PKIX PEM block, from an
+// OpenSSH public key line, or from a JSON Web Key, and returns it as a
+// point that can be used as the Xc of a reader.
+func ParsePublicKey(buf []byte) (kyber.Point, error) {
+	var pub []byte
+	if isJWK(buf) {
+		var err error
+		if _, pub, err = parseJWK(buf); err != nil {
+			return nil, xerrors.Errorf("parsing JWK: %v", err)
+		}
+	} else if block, _ := pem.Decode(buf); block != nil {
+		if block.Type != pemTypePublic {
+			return nil, xerrors.Errorf("unknown PEM block type '%s'", block.Type)
+		}
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing PKIX key: %v", err)
+		}
+		edPub, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, xerrors.New("not an ed25519 public key")
+		}
+		pub = edPub
+	} else {
+		fields := strings.Fields(string(buf))
+		if len(fields) < 2 || fields[0] != sshKeyTypeEd25519 {
+			return nil, xerrors.New("neither a PEM block nor an ssh-ed25519 key")
+		}
+		wire, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, xerrors.Errorf("decoding ssh key: %v", err)
+		}
+		pub, err = parseSSHPublicKey(wire)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing ssh key: %v", err)
+		}
+	}
+
+	p := cothority.Suite.Point()
+	if err := p.UnmarshalBinary(pub); err != nil {
+		return nil, xerrors.Errorf("unmarshalling point: %v", err)
+	}
+	return p, nil
+}
+
+// MarshalPublicKeyPEM returns the point as a PKIX PEM block.
+func MarshalPublicKeyPEM(p kyber.Point) ([]byte, error) {
+	pub, err := pointToEd25519(p)
+	if err != nil {
+		return nil, xerrors.Errorf("converting point: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling PKIX key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePublic, Bytes: der}), nil
+}
+
+// MarshalPublicKeySSH returns the point as an OpenSSH public key line, as
+// found in authorized_keys files.
+func MarshalPublicKeySSH(p kyber.Point, comment string) ([]byte, error) {
+	pub, err := pointToEd25519(p)
+	if err != nil {
+		return nil, xerrors.Errorf("converting point: %v", err)
+	}
+	line := sshKeyTypeEd25519 + " " +
+		base64.StdEncoding.EncodeToString(marshalSSHPublicKey(pub))
+	if comment != "" {
+		line += " " + comment
+	}
+	return []byte(line + "\n"), nil
+}
+
+// MarshalEd25519PrivateKeyJWK returns the private key as a JSON Web Key
+// with the given key ID, which can be empty.
+func MarshalEd25519PrivateKeyJWK(sk ed25519.PrivateKey, kid string) ([]byte, error) {
+	if len(sk) != ed25519.PrivateKeySize {
+		return nil, xerrors.New("wrong private key length")
+	}
+	buf, err := json.Marshal(&jwk{
+		Kty: jwkTypeOKP,
+		Crv: jwkCurveEd25519,
+		X:   base64.RawURLEncoding.EncodeToString(sk[ed25519.SeedSize:]),
+		D:   base64.RawURLEncoding.EncodeToString(sk.Seed()),
+		Kid: kid,
+	})
+	return buf, cothority.ErrorOrNil(err, "marshalling JWK")
+}
+
+// MarshalPublicKeyJWK returns the point as a JSON Web Key with the given key
+// ID, which can be empty.
+func MarshalPublicKeyJWK(p kyber.Point, kid string) ([]byte, error) {
+	pub, err := pointToEd25519(p)
+	if err != nil {
+		return nil, xerrors.Errorf("converting point: %v", err)
+	}
+	buf, err := json.Marshal(&jwk{
+		Kty: jwkTypeOKP,
+		Crv: jwkCurveEd25519,
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+		Kid: kid,
+	})
+	return buf, cothority.ErrorOrNil(err, "marshalling JWK")
+}
+
+func isJWK(buf []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{"))
+}
+
+// parseJWK decodes an Ed25519 JSON Web Key and returns it together with its
+// public key.
+func parseJWK(buf []byte) (*jwk, ed25519.PublicKey, error) {
+	k := &jwk{}
+	if err := json.Unmarshal(buf, k); err != nil {
+		return nil, nil, xerrors.Errorf("decoding json: %v", err)
+	}
+	if k.Kty != jwkTypeOKP || k.Crv != jwkCurveEd25519 {
+		return nil, nil, xerrors.Errorf("unsupported key type '%s/%s'",
+			k.Kty, k.Crv)
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("decoding public key: %v", err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, nil, xerrors.New("wrong public key length")
+	}
+	return k, ed25519.PublicKey(pub), nil
+}
+
+func pointToEd25519(p kyber.Point) (ed25519.PublicKey, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling point: %v", err)
+	}
+	if len(buf) != ed25519.PublicKeySize {
+		return nil, xerrors.New("not an ed25519 point")
+	}
+	return ed25519.PublicKey(buf), nil
+}
+
+func parseOpenSSHPrivateKey(buf []byte) (ed25519.PrivateKey, error) {
+	if !bytes.HasPrefix(buf, []byte(sshMagic)) {
+		return nil, xerrors.New("invalid openssh key header")
+	}
+	r := bytes.NewReader(buf[len(sshMagic):])
+	cipher, err := readSSHString(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading cipher: %v", err)
+	}
+	kdf, err := readSSHString(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading kdf: %v", err)
+	}
+	if string(cipher) != "none" || string(kdf) != "none" {
+		return nil, xerrors.New("encrypted openssh keys are not supported")
+	}
+	if _, err = readSSHString(r); err != nil {
+		return nil, xerrors.Errorf("reading kdf options: %v", err)
+	}
+	var nbrKeys uint32
+	if err = binary.Read(r, binary.BigEndian, &nbrKeys); err != nil {
+		return nil, xerrors.Errorf("reading number of keys: %v", err)
+	}
+	if nbrKeys != 1 {
+		return nil, xerrors.New("only files with one key are supported")
+	}
+	if _, err = readSSHString(r); err != nil {
+		return nil, xerrors.Errorf("reading public key: %v", err)
+	}
+	private, err := readSSHString(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading private section: %v", err)
+	}
+
+	pr := bytes.NewReader(private)
+	var check1, check2 uint32
+	binary.Read(pr, binary.BigEndian, &check1)
+	if err = binary.Read(pr, binary.BigEndian, &check2); err != nil {
+		return nil, xerrors.Errorf("reading check bytes: %v", err)
+	}
+	if check1 != check2 {
+		return nil, xerrors.New("check bytes mismatch")
+	}
+	keyType, err := readSSHString(pr)
+	if err != nil {
+		return nil, xerrors.Errorf("reading key type: %v", err)
+	}
+	if string(keyType) != sshKeyTypeEd25519 {
+		return nil, xerrors.Errorf("unsupported key type '%s'", keyType)
+	}
+	pub, err := readSSHString(pr)
+	if err != nil {
+		return nil, xerrors.Errorf("reading public key: %v", err)
+	}
+	sk, err := readSSHString(pr)
+	if err != nil {
+		return nil, xerrors.Errorf("reading private key: %v", err)
+	}
+	if len(sk) != ed25519.PrivateKeySize || !bytes.Equal(sk[32:], pub) {
+		return nil, xerrors.New("invalid ed25519 private key")
+	}
+	return ed25519.PrivateKey(sk), nil
+}
+
+func marshalSSHPublicKey(pub ed25519.PublicKey) []byte {
+	buf := &bytes.Buffer{}
+	writeSSHString(buf, []byte(sshKeyTypeEd25519))
+	writeSSHString(buf, pub)
+	return buf.Bytes()
+}
+
+func parseSSHPublicKey(wire []byte) (ed25519.PublicKey, error) {
+	r := bytes.NewReader(wire)
+	keyType, err := readSSHString(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading key type: %v", err)
+	}
+	if string(keyType) != sshKeyTypeEd25519 {
+		return nil, xerrors.Errorf("unsupported key type '%s'", keyType)
+	}
+	pub, err := readSSHString(r)
+	if err != nil {
+		return nil, xerrors.Errorf("reading key: %v", err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, xerrors.New("wrong public key length")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+func writeSSHString(buf *bytes.Buffer, s []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.Write(s)
+}
+
+func readSSHString(r *bytes.Reader) ([]byte, error) {
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, xerrors.Errorf("reading length: %v", err)
+	}
+	if int(l) > r.Len() {
+		return nil, xerrors.New("string longer than remaining data")
+	}
+	s := make([]byte, l)
+	_, err := io.ReadFull(r, s)
+	return s, cothority.ErrorOrNil(err, "reading string")
+}
@@ -0,0 +1,106 @@
+package calypso
+
+import (
+	"crypto/sha512"
+	"testing"
+
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys_PrivatePEM(t *testing.T) {
+	sk, err := NewEd25519Key()
+	require.NoError(t, err)
+	signer, err := NewSignerFromEd25519(sk)
+	require.NoError(t, err)
+
+	buf, err := MarshalEd25519PrivateKeyPEM(sk)
+	require.NoError(t, err)
+	sk2, err := ParseEd25519PrivateKey(buf)
+	require.NoError(t, err)
+	require.Equal(t, sk, sk2)
+
+	signer2, err := ParseSigner(buf)
+	require.NoError(t, err)
+	require.True(t, signer.Ed25519.Point.Equal(signer2.Ed25519.Point))
+	require.True(t, signer.Ed25519.Secret.Equal(signer2.Ed25519.Secret))
+
+	// The darc signer must produce signatures that verify against the
+	// public key of the standard key.
+	msg := []byte("calypso")
+	sig, err := signer2.Sign(msg)
+	require.NoError(t, err)
+	require.NoError(t, signer.Identity().Verify(msg, sig))
+}
+
+func TestKeys_PrivateOpenSSH(t *testing.T) {
+	sk, err := NewEd25519Key()
+	require.NoError(t, err)
+
+	buf, err := MarshalEd25519PrivateKeyOpenSSH(sk, "reader@calypso")
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "OPENSSH PRIVATE KEY")
+	sk2, err := ParseEd25519PrivateKey(buf)
+	require.NoError(t, err)
+	require.Equal(t, sk, sk2)
+
+	_, err = ParseEd25519PrivateKey([]byte("not a key"))
+	require.Error(t, err)
+}
+
+func TestKeys_Public(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	pub := signer.Ed25519.Point
+
+	buf, err := MarshalPublicKeyPEM(pub)
+	require.NoError(t, err)
+	p, err := ParsePublicKey(buf)
+	require.NoError(t, err)
+	require.True(t, pub.Equal(p))
+
+	buf, err = MarshalPublicKeySSH(pub, "reader@calypso")
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "ssh-ed25519 ")
+	p, err = ParsePublicKey(buf)
+	require.NoError(t, err)
+	require.True(t, pub.Equal(p))
+
+	_, err = ParsePublicKey([]byte("ssh-rsa AAAA"))
+	require.Error(t, err)
+}
+
+func TestKeys_JWK(t *testing.T) {
+	sk, err := NewEd25519Key()
+	require.NoError(t, err)
+	signer, err := NewSignerFromEd25519(sk)
+	require.NoError(t, err)
+
+	buf, err := MarshalEd25519PrivateKeyJWK(sk, "reader")
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"crv":"Ed25519"`)
+	sk2, err := ParseEd25519PrivateKey(buf)
+	require.NoError(t, err)
+	require.Equal(t, sk, sk2)
+	p, err := ParsePublicKey(buf)
+	require.NoError(t, err)
+	require.True(t, signer.Ed25519.Point.Equal(p))
+
+	buf, err = MarshalPublicKeyJWK(signer.Ed25519.Point, "")
+	require.NoError(t, err)
+	require.NotContains(t, string(buf), `"d"`)
+	p, err = ParsePublicKey(buf)
+	require.NoError(t, err)
+	require.True(t, signer.Ed25519.Point.Equal(p))
+	_, err = ParseEd25519PrivateKey(buf)
+	require.Error(t, err)
+	_, err = ParsePublicKey([]byte(`{"kty":"EC","crv":"P-256","x":"AA"}`))
+	require.Error(t, err)
+
+	// The scalar of the signer is the clamped hash of the seed.
+	h := sha512.Sum512(sk.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	scalar := signer.Ed25519.Secret.Clone().SetBytes(h[:32])
+	require.True(t, scalar.Equal(signer.Ed25519.Secret))
+}
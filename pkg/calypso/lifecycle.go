@@ -0,0 +1,283 @@
+package calypso
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/policy"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// The states of a write-instance returned by GetWriteStatus.
+const (
+	// WritePending is the state of a write that is not in the chain: its
+	// transaction has not been included yet, or it has been refused.
+	WritePending = "pending"
+	// WriteCommitted is the state of a write that is stored in the chain,
+	// and whose readers didn't change since.
+	WriteCommitted = "committed"
+	// WriteReadersUpdated is the state of a write whose spawn:calypsoRead
+	// rule changed after it has been committed.
+	WriteReadersUpdated = "readers_updated"
+	// WriteRevoked is the state of a write whose darc doesn't have a
+	// spawn:calypsoRead rule anymore, so that nobody can read it.
+	WriteRevoked = "revoked"
+	// WriteExpired is the state of a write whose policy accepted reads
+	// when it was committed, but refuses all reads at the time of the
+	// latest block.
+	WriteExpired = "expired"
+	// WriteSuperseded is the state of a write that has been updated with a
+	// new version.
+	WriteSuperseded = "superseded"
+	// WriteDeleted is the state of a write whose instance has been removed.
+	WriteDeleted = "deleted"
+)
+
+// writeInput is an input of the state machine of the writes. The inputs are
+// derived from the state changes of the write-instance and of its darc.
+type writeInput int
+
+const (
+	inputCommit writeInput = iota
+	inputReadersChanged
+	inputReadersRemoved
+	inputUpdate
+	inputRemove
+	// inputExpire is only given after all other inputs, as it depends on
+	// the latest block.
+	inputExpire
+)
+
+// writeTransitions is the state machine of the writes. An input that is
+// missing for a state cannot happen in a valid chain.
+var writeTransitions = map[string]map[writeInput]string{
+	WritePending: {
+		inputCommit: WriteCommitted,
+	},
+	WriteCommitted: {
+		inputReadersChanged: WriteReadersUpdated,
+		inputReadersRemoved: WriteRevoked,
+		inputUpdate:         WriteSuperseded,
+		inputRemove:         WriteDeleted,
+		inputExpire:         WriteExpired,
+	},
+	WriteReadersUpdated: {
+		inputReadersChanged: WriteReadersUpdated,
+		inputReadersRemoved: WriteRevoked,
+		inputUpdate:         WriteSuperseded,
+		inputRemove:         WriteDeleted,
+		inputExpire:         WriteExpired,
+	},
+	WriteRevoked: {
+		inputReadersChanged: WriteReadersUpdated,
+		inputUpdate:         WriteSuperseded,
+		inputRemove:         WriteDeleted,
+	},
+	// The readers of a superseded write can still change, but the newer
+	// version is what matters to the clients.
+	WriteSuperseded: {
+		inputReadersChanged: WriteSuperseded,
+		inputReadersRemoved: WriteSuperseded,
+		inputRemove:         WriteDeleted,
+	},
+	WriteExpired: {},
+	WriteDeleted: {},
+}
+
+// nextWriteState returns the state following state for the given input.
+func nextWriteState(state string, in writeInput) (string, error) {
+	next, ok := writeTransitions[state][in]
+	if !ok {
+		return "", xerrors.Errorf("invalid input %d in state %s", in, state)
+	}
+	return next, nil
+}
+
+// blockInput is an input of the state machine found in the given block.
+type blockInput struct {
+	BlockIndex int
+	Input      writeInput
+}
+
+// GetWriteStatus returns the state of a write-instance in its lifecycle,
+// together with the blocks where its state changed. The states are derived
+// from the versions of the write-instance and of its darc stored by
+// ByzCoin, so all nodes holding the chain return the same answer.
+func (s *Service) GetWriteStatus(req *GetWriteStatus) (*GetWriteStatusReply, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	s.storage.RLock()
+	_, authorised := s.storage.AuthorisedByzCoinIDs[string(req.ByzCoinID)]
+	s.storage.RUnlock()
+	if !authorised {
+		return nil, xerrors.New("this ByzCoin ID is not authorised")
+	}
+	if err := s.checkNamespace(req.ByzCoinID, req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+
+	versions, err := bc.GetAllInstanceVersion(&byzcoin.GetAllInstanceVersion{
+		SkipChainID: req.ByzCoinID,
+		InstanceID:  req.WriteID,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting write versions: %v", err)
+	}
+	reply := &GetWriteStatusReply{State: WritePending}
+	if len(versions.StateChanges) == 0 {
+		return reply, nil
+	}
+	created := versions.StateChanges[0]
+	if created.StateChange.ContractID != ContractWriteID {
+		return nil, xerrors.New("instance is not a write instance")
+	}
+	var write Write
+	err = protobuf.DecodeWithConstructors(created.StateChange.Value, &write,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding write: %v", err)
+	}
+
+	var inputs []blockInput
+	for _, v := range versions.StateChanges {
+		switch v.StateChange.StateAction {
+		case byzcoin.Create:
+			inputs = append(inputs, blockInput{v.BlockIndex, inputCommit})
+		case byzcoin.Update:
+			var w Write
+			err := protobuf.DecodeWithConstructors(v.StateChange.Value, &w,
+				network.DefaultConstructors(cothority.Suite))
+			if err != nil {
+				return nil, xerrors.Errorf("decoding write: %v", err)
+			}
+			if w.Next != nil && reply.Next == nil {
+				reply.Next = w.Next
+				inputs = append(inputs, blockInput{v.BlockIndex, inputUpdate})
+			}
+			reply.Frozen = w.Frozen
+			reply.FreezeReason = w.FreezeReason
+			reply.Hold = w.Hold
+			reply.HoldReason = w.HoldReason
+		case byzcoin.Remove:
+			inputs = append(inputs, blockInput{v.BlockIndex, inputRemove})
+		}
+	}
+	readers, err := readerInputs(bc, req.ByzCoinID,
+		created.StateChange.DarcID, created.BlockIndex)
+	if err != nil {
+		return nil, xerrors.Errorf("getting changes of readers: %v", err)
+	}
+	inputs = append(inputs, readers...)
+	sort.SliceStable(inputs, func(i, j int) bool {
+		return inputs[i].BlockIndex < inputs[j].BlockIndex
+	})
+
+	latest, err := s.getLatestBlock(req.ByzCoinID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting latest block: %v", err)
+	}
+	expired, err := s.writeExpired(req.ByzCoinID, &write, created.BlockIndex,
+		latest.Index)
+	if err != nil {
+		return nil, xerrors.Errorf("checking expiry: %v", err)
+	}
+	if expired {
+		inputs = append(inputs, blockInput{latest.Index, inputExpire})
+	}
+
+	for _, in := range inputs {
+		next, err := nextWriteState(reply.State, in.Input)
+		if err != nil {
+			// An expiry after another state isn't an error, it just
+			// doesn't change the state.
+			if in.Input == inputExpire {
+				continue
+			}
+			return nil, xerrors.Errorf("block %d: %v", in.BlockIndex, err)
+		}
+		if next != reply.State {
+			reply.History = append(reply.History, WriteTransition{
+				BlockIndex: in.BlockIndex,
+				State:      next,
+			})
+		}
+		reply.State = next
+	}
+	return reply, nil
+}
+
+// readerInputs returns the changes of the spawn:calypsoRead rule of the
+// darc in the blocks after the given index.
+func readerInputs(bc *byzcoin.Service, bcID skipchain.SkipBlockID,
+	darcID darc.ID, after int) ([]blockInput, error) {
+	versions, err := bc.GetAllInstanceVersion(&byzcoin.GetAllInstanceVersion{
+		SkipChainID: bcID,
+		InstanceID:  byzcoin.NewInstanceID(darcID),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting darc versions: %v", err)
+	}
+	var inputs []blockInput
+	var prev expression.Expr
+	for _, v := range versions.StateChanges {
+		var rule expression.Expr
+		if v.StateChange.StateAction != byzcoin.Remove {
+			d, err := darc.NewFromProtobuf(v.StateChange.Value)
+			if err != nil {
+				return nil, xerrors.Errorf("decoding darc: %v", err)
+			}
+			rule = d.Rules.Get(darc.Action("spawn:" + ContractReadID))
+		}
+		if v.BlockIndex > after && !bytes.Equal(rule, prev) {
+			in := inputReadersChanged
+			if len(rule) == 0 {
+				in = inputReadersRemoved
+			}
+			inputs = append(inputs, blockInput{v.BlockIndex, in})
+		}
+		prev = rule
+	}
+	return inputs, nil
+}
+
+// writeExpired returns true if the policy of the write accepted reads at
+// the time of the block where it has been committed, but refuses all reads
+// at the time of the latest block. A policy that depends on the reader
+// never expires, as it cannot be evaluated without one.
+func (s *Service) writeExpired(bcID skipchain.SkipBlockID, w *Write,
+	committed, latest int) (bool, error) {
+	if w.Policy == "" {
+		return false, nil
+	}
+	p, err := policy.Parse(w.Policy)
+	if err != nil {
+		return false, xerrors.Errorf("parsing policy: %v", err)
+	}
+	accepts := func(index int) (bool, error) {
+		ts, err := s.blockTimestamp(bcID, index)
+		if err != nil {
+			return false, err
+		}
+		ok, err := p.Evaluate(policy.Vars{
+			"time":  ts / int64(time.Second),
+			"block": int64(index),
+		})
+		return ok || err != nil, nil
+	}
+	before, err := accepts(committed)
+	if err != nil || !before {
+		return false, err
+	}
+	now, err := accepts(latest)
+	return !now, err
+}
@@ -0,0 +1,111 @@
+package calypso
+
+import (
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// A chain can be authorised together with the roster of the cothority
+// hosting it, for nodes that only run the LTSs and don't hold the chain
+// (light mode). The node then takes the genesis block from this roster
+// instead of the roster of the proofs, polls the roster for new blocks every
+// ExternalPollInterval, and checks every block it fetches against the
+// forward links starting at the genesis block. The genesis block is cached,
+// and the blocks already handled are not fetched again.
+
+// externalRoster returns the roster of the cothority hosting the chain, or
+// nil if the chain is not hosted by another cothority.
+func (s *Service) externalRoster(bcID skipchain.SkipBlockID) *onet.Roster {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	return s.storage.ExternalRosters[string(bcID)]
+}
+
+// scheduleExternalPoll runs pollExternalChains every ExternalPollInterval.
+// The configuration is read again before every run, so that the interval
+// can be changed.
+func (s *Service) scheduleExternalPoll() {
+	interval := s.getConfig().externalPollInterval()
+	if interval == 0 {
+		// Check again later whether the polling has been enabled.
+		interval = time.Minute
+	}
+	s.schedule("externalPoll", interval, func() {
+		if s.getConfig().ExternalPollInterval > 0 {
+			s.pollExternalChains()
+		}
+		s.scheduleExternalPoll()
+	})
+}
+
+// pollExternalChains handles the new blocks of the chains hosted by another
+// cothority.
+func (s *Service) pollExternalChains() {
+	s.storage.RLock()
+	var ids []skipchain.SkipBlockID
+	for id := range s.storage.ExternalRosters {
+		ids = append(ids, skipchain.SkipBlockID(id))
+	}
+	s.storage.RUnlock()
+
+	for _, id := range ids {
+		if err := s.catchUp(id, -1); err != nil {
+			log.Warn(s.ServerIdentity(), "couldn't poll chain", id, err)
+		}
+	}
+}
+
+// verifyBlockLinks checks that the forward links lead from the genesis block
+// to sb, as returned by GetSingleBlockByIndex. The first link is the
+// synthetic link to the genesis block.
+func verifyBlockLinks(genesis, sb *skipchain.SkipBlock, links []*skipchain.ForwardLink) error {
+	if !sb.CalculateHash().Equal(sb.Hash) {
+		return xerrors.New("block doesn't match its hash")
+	}
+	if len(links) == 0 || !links[0].To.Equal(genesis.Hash) {
+		return xerrors.New("links don't start at the genesis block")
+	}
+	publics := genesis.Roster.ServicePublics(skipchain.ServiceName)
+	id := genesis.Hash
+	for _, l := range links[1:] {
+		if !l.From.Equal(id) {
+			return xerrors.New("links are not consecutive")
+		}
+		err := l.VerifyWithScheme(pairing.NewSuiteBn256(), publics, sb.SignatureScheme)
+		if err != nil {
+			return xerrors.Errorf("verifying link: %v", err)
+		}
+		id = l.To
+		if l.NewRoster != nil {
+			publics = l.NewRoster.ServicePublics(skipchain.ServiceName)
+		}
+	}
+	if !id.Equal(sb.Hash) {
+		return xerrors.New("links don't lead to the block")
+	}
+	return nil
+}
+
+// getExternalProof asks the cothority hosting the chain for a proof of the
+// instance, and checks it from the genesis block.
+func (s *Service) getExternalProof(bcID skipchain.SkipBlockID, roster *onet.Roster,
+	id byzcoin.InstanceID) (*byzcoin.Proof, error) {
+	genesis, err := s.fetchGenesisBlock(bcID, roster)
+	if err != nil {
+		return nil, xerrors.Errorf("fetching genesis block: %v", err)
+	}
+	resp, err := byzcoin.NewClient(bcID, *roster).GetProof(id.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	if err := resp.Proof.VerifyFromBlock(genesis); err != nil {
+		return nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	return &resp.Proof, nil
+}
@@ -0,0 +1,177 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// The Merkle tree over the encrypted chunks of a document follows RFC 6962:
+// a leaf is the SHA-256 of a zero byte and the encrypted chunk, a node the
+// SHA-256 of a one byte and its two children, and the left subtree of a
+// node holds the largest power of two of its leaves. Whoever stores the
+// encrypted document can return a single chunk with ReadChunk, together
+// with the path to the root, without knowing the key. The reader checks the
+// chunk against the root in the write with VerifyChunk, and decrypts it with
+// DecryptChunk, without fetching the rest of the document.
+
+const (
+	// chunkOverhead is the size of the GCM tag of an encrypted chunk.
+	chunkOverhead = 16
+	// encryptedChunkSize is the size of an encrypted chunk, except the last
+	// one which is always shorter.
+	encryptedChunkSize = fileChunkSize + chunkOverhead
+)
+
+// ChunkProof is the path from an encrypted chunk to the Merkle root of the
+// document.
+type ChunkProof struct {
+	// Index is the position of the chunk in the document.
+	Index int
+	// Count is the number of chunks of the document.
+	Count int
+	// Path holds the hashes of the siblings, starting at the leaf.
+	Path [][]byte
+}
+
+func merkleLeaf(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two smaller than n.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot returns the root of the tree with the given leaves.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return merkleLeaf(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the hashes of the siblings of the leaf at index,
+// starting at the leaf.
+func merklePath(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merklePath(leaves[:k], index), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(leaves[k:], index-k), merkleRoot(leaves[:k]))
+}
+
+// Verify checks that the encrypted chunk is in the tree with the given root.
+func (p *ChunkProof) Verify(root, chunk []byte) error {
+	if p.Index < 0 || p.Index >= p.Count {
+		return xerrors.New("index out of range")
+	}
+	if p.Index < p.Count-1 && len(chunk) != encryptedChunkSize ||
+		p.Index == p.Count-1 && len(chunk) >= encryptedChunkSize {
+		return xerrors.New("chunk has a wrong size")
+	}
+	fn, sn := p.Index, p.Count-1
+	r := merkleLeaf(chunk)
+	for _, sibling := range p.Path {
+		if sn == 0 {
+			return xerrors.New("path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(sibling, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return xerrors.New("chunk doesn't match the Merkle root")
+	}
+	return nil
+}
+
+// ReadChunk returns the encrypted chunk at index of the encrypted document
+// of the given size read from r, and its proof. It reads the whole document
+// to build the tree, but doesn't need the key.
+func ReadChunk(r io.ReaderAt, size int64, index int) ([]byte, *ChunkProof, error) {
+	count := int(size/encryptedChunkSize) + 1
+	if size%encryptedChunkSize < chunkOverhead {
+		return nil, nil, xerrors.New("document has a wrong size")
+	}
+	if index < 0 || index >= count {
+		return nil, nil, xerrors.Errorf("document has only %d chunks", count)
+	}
+	var chunk []byte
+	leaves := make([][]byte, count)
+	buf := make([]byte, encryptedChunkSize)
+	for i := range leaves {
+		n := encryptedChunkSize
+		if i == count-1 {
+			n = int(size % encryptedChunkSize)
+		}
+		_, err := r.ReadAt(buf[:n], int64(i)*encryptedChunkSize)
+		if err != nil && !(err == io.EOF && i == count-1) {
+			return nil, nil, xerrors.Errorf("reading chunk %d: %v", i, err)
+		}
+		leaves[i] = merkleLeaf(buf[:n])
+		if i == index {
+			chunk = append([]byte{}, buf[:n]...)
+		}
+	}
+	return chunk, &ChunkProof{Index: index, Count: count,
+		Path: merklePath(leaves, index)}, nil
+}
+
+// VerifyChunk checks that the encrypted chunk is part of the document of the
+// write.
+func (wr *Write) VerifyChunk(chunk []byte, proof *ChunkProof) error {
+	if len(wr.DataRoot) == 0 {
+		return xerrors.New("write has no Merkle root")
+	}
+	return proof.Verify(wr.DataRoot, chunk)
+}
+
+// DecryptChunk decrypts a single encrypted chunk with the symmetric key of
+// the write. The proof of the chunk gives its position, which is
+// authenticated by the decryption.
+func DecryptChunk(key, chunk []byte, proof *ChunkProof) ([]byte, error) {
+	aead, err := fileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	last := proof.Index == proof.Count-1
+	pt, err := aead.Open(nil, chunkNonce(aead, uint64(proof.Index), last),
+		chunk, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypting chunk %d: %v", proof.Index, err)
+	}
+	return pt, nil
+}
@@ -0,0 +1,83 @@
+package calypso
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A write can carry a clear-text label, so that the document can be found
+// with ListDocuments, and metadata like the filename, which is only visible
+// to the readers. The metadata is encrypted with AES-GCM under a key derived
+// from the symmetric key of the write, so a reader who decrypted the key can
+// also read the metadata.
+
+// maxLabelLength is the maximum length of the label of a write.
+const maxLabelLength = 256
+
+// metadataKey derives the AES key of the metadata from the symmetric key of
+// the write, so that the key is never used twice for different data.
+func metadataKey(key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("calypso-metadata"))
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// metadataAEAD returns the cipher of the metadata for the given key.
+func metadataAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(metadataKey(key))
+	if err != nil {
+		return nil, xerrors.Errorf("creating cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetMetadata encrypts the metadata under the symmetric key of the write,
+// which must be the key given to NewWrite.
+func (wr *Write) SetMetadata(key []byte, md *DocumentMetadata) error {
+	buf, err := protobuf.Encode(md)
+	if err != nil {
+		return xerrors.Errorf("encoding metadata: %v", err)
+	}
+	aead, err := metadataAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return xerrors.Errorf("creating nonce: %v", err)
+	}
+	wr.Metadata = aead.Seal(nonce, nonce, buf, nil)
+	return nil
+}
+
+// GetMetadata decrypts the metadata of the write with the symmetric key,
+// as returned by DecryptKeyReply.RecoverKey. It returns nil if the write has
+// no metadata.
+func (wr *Write) GetMetadata(key []byte) (*DocumentMetadata, error) {
+	if len(wr.Metadata) == 0 {
+		return nil, nil
+	}
+	aead, err := metadataAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wr.Metadata) < aead.NonceSize() {
+		return nil, xerrors.New("metadata is too short")
+	}
+	nonce, ct := wr.Metadata[:aead.NonceSize()], wr.Metadata[aead.NonceSize():]
+	buf, err := aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypting metadata: %v", err)
+	}
+	md := &DocumentMetadata{}
+	if err := protobuf.Decode(buf, md); err != nil {
+		return nil, xerrors.Errorf("decoding metadata: %v", err)
+	}
+	return md, nil
+}
@@ -0,0 +1,155 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// namespace holds the configuration of one namespace. The ByzCoinIDs of a
+// namespace are stored in storage.ByzCoinNamespaces.
+type namespace struct {
+	// Roster, if not nil, holds all nodes that are allowed in an LTS of
+	// this namespace.
+	Roster *onet.Roster `protobuf:"opt"`
+}
+
+// ConfigureNamespace creates a new namespace, or updates the roster of an
+// existing one. The default namespace, "", cannot be configured.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) ConfigureNamespace(req *ConfigureNamespace) (*ConfigureNamespaceReply, error) {
+	if req.Namespace == "" {
+		return nil, xerrors.New("cannot configure the default namespace")
+	}
+	err := s.verifyAdminSignature(namespaceMessage(req.Namespace, req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+
+	s.storage.Lock()
+	s.storage.Namespaces[req.Namespace] = &namespace{Roster: req.Roster}
+	s.storage.Unlock()
+
+	if err := s.save(); err != nil {
+		return nil, xerrors.Errorf("saving data: %v", err)
+	}
+	log.Lvl1("Configured namespace", req.Namespace)
+	return &ConfigureNamespaceReply{}, nil
+}
+
+// checkNamespace returns an error if the given ByzCoinID is not part of the
+// namespace ns.
+func (s *Service) checkNamespace(bcID skipchain.SkipBlockID, ns string) error {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	if s.storage.ByzCoinNamespaces[string(bcID)] != ns {
+		return xerrors.New("this ByzCoin ID is not part of the namespace")
+	}
+	return nil
+}
+
+// checkLTSNamespace returns an error if the LTS id has been created in
+// another namespace than the one of the ByzCoinID bcID, so that the LTS of
+// a namespace never re-encrypts the secrets of the chains of another one.
+func (s *Service) checkLTSNamespace(id byzcoin.InstanceID, bcID skipchain.SkipBlockID) error {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	if s.storage.LTSNamespaces[id] != s.storage.ByzCoinNamespaces[string(bcID)] {
+		return xerrors.New("the LTS is not part of the namespace of the ByzCoin ID")
+	}
+	return nil
+}
+
+// checkLTSConfig is called by the nodes taking part in the DKG or the
+// resharing of an LTS. It checks that the ByzCoinID of the proof is in
+// the namespace ns and that all nodes of the roster are allowed in it.
+func (s *Service) checkLTSConfig(bcID skipchain.SkipBlockID, ns string,
+	roster *onet.Roster) error {
+	if err := s.checkNamespace(bcID, ns); err != nil {
+		return err
+	}
+	return s.checkNamespaceRoster(ns, roster)
+}
+
+// setLTSNamespace stores the namespace of the LTS id. It must be called
+// with the lock held.
+func (st *storage) setLTSNamespace(id byzcoin.InstanceID, ns string) {
+	if ns == "" {
+		delete(st.LTSNamespaces, id)
+		return
+	}
+	st.LTSNamespaces[id] = ns
+}
+
+// namespaceChains returns the authorised ByzCoinIDs of the namespace ns.
+func (s *Service) namespaceChains(ns string) map[string]bool {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	chains := make(map[string]bool)
+	for id := range s.storage.AuthorisedByzCoinIDs {
+		if s.storage.ByzCoinNamespaces[id] == ns {
+			chains[id] = true
+		}
+	}
+	return chains
+}
+
+// checkNamespaceRoster returns an error if the namespace ns restricts the
+// nodes of its LTSs, and roster holds a node outside of this restriction.
+func (s *Service) checkNamespaceRoster(ns string, roster *onet.Roster) error {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	conf := s.storage.Namespaces[ns]
+	if conf == nil || conf.Roster == nil {
+		return nil
+	}
+	for _, si := range roster.List {
+		if i, _ := conf.Roster.Search(si.ID); i < 0 {
+			return xerrors.Errorf("node %s is not allowed in this namespace", si)
+		}
+	}
+	return nil
+}
+
+// verifyAdminSignature checks that msg has been signed by the private key
+// of this conode not more than a minute ago.
+func (s *Service) verifyAdminSignature(msg []byte, ts int64, sig []byte) error {
+	if allowInsecureAdmin {
+		return nil
+	}
+	return s.checkAdminSignature(msg, ts, sig)
+}
+
+// checkAdminSignature is verifyAdminSignature without the
+// COTHORITY_ALLOW_INSECURE_ADMIN bypass, for the requests that give access
+// to the secrets of the node.
+func (s *Service) checkAdminSignature(msg []byte, ts int64, sig []byte) error {
+	if len(sig) == 0 {
+		return xerrors.New("no signature provided")
+	}
+	if math.Abs(time.Now().Sub(time.Unix(ts, 0)).Seconds()) > 60 {
+		return xerrors.New("signature is too old")
+	}
+	return cothority.ErrorOrNil(
+		schnorr.Verify(cothority.Suite, s.ServerIdentity().Public, msg, sig),
+		"signature verification failed")
+}
+
+// namespaceMessage returns the message to be signed for a
+// ConfigureNamespace request.
+func namespaceMessage(ns string, ts int64) []byte {
+	msg := append([]byte("namespace:"+ns), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
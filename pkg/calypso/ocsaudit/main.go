@@ -0,0 +1,159 @@
+// ocsaudit exports a ByzCoin chain as JSON for third-party audits, and
+// verifies such an export offline.
+//
+// The export command fetches every block of the chain from a conode and
+// writes the canonical JSON of the blocks and their forward links. The
+// verify command only needs the export and the ID of the chain the auditor
+// trusts: it checks the hashes of the blocks, the back links, the
+// signatures of the forward links and the transactions of every block, so
+// auditors don't need to run a conode.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+var gitTag = "dev"
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "ocsaudit"
+	cliApp.Usage = "Export a chain as JSON and verify the export offline."
+	cliApp.Version = gitTag
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+		cli.StringFlag{
+			Name:   "bc",
+			EnvVar: "CS_BC",
+			Usage:  "hex encoded ID of the ByzCoin chain",
+		},
+	}
+	cliApp.Commands = []cli.Command{
+		{
+			Name:      "export",
+			Usage:     "fetch all blocks of the chain and write them as JSON",
+			ArgsUsage: "[file]",
+			Action:    export,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "url",
+					EnvVar: "CS_URL",
+					Usage:  "websocket URL of a conode of the chain, e.g. https://conode.example.com",
+				},
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "verify an export against the ID of the chain",
+			ArgsUsage: "file",
+			Action:    verify,
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+
+	if err := cliApp.Run(os.Args); err != nil {
+		log.Fatalf("error: %+v", err)
+	}
+}
+
+func chainID(c *cli.Context) (skipchain.SkipBlockID, error) {
+	bcID, err := hex.DecodeString(c.GlobalString("bc"))
+	if err != nil || len(bcID) == 0 {
+		return nil, xerrors.New("--bc must be the hex encoded ID of the chain")
+	}
+	return skipchain.SkipBlockID(bcID), nil
+}
+
+// export writes the export to the file given as argument, or to the
+// standard output.
+func export(c *cli.Context) error {
+	if c.String("url") == "" {
+		return xerrors.New("--url is required")
+	}
+	bcID, err := chainID(c)
+	if err != nil {
+		return err
+	}
+	si := &network.ServerIdentity{URL: c.String("url")}
+	ro := &onet.Roster{List: []*network.ServerIdentity{si}}
+	e, err := calypso.ExportChain(ro, bcID)
+	if err != nil {
+		return xerrors.Errorf("exporting chain: %v", err)
+	}
+	buf, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	if c.NArg() == 0 {
+		_, err = c.App.Writer.Write(buf)
+		return err
+	}
+	if err := ioutil.WriteFile(c.Args().First(), buf, 0644); err != nil {
+		return xerrors.Errorf("writing export: %v", err)
+	}
+	log.Infof("Exported %d blocks to %s", len(e.Blocks), c.Args().First())
+	return nil
+}
+
+// verify checks the export given as argument and prints a summary of the
+// chain.
+func verify(c *cli.Context) error {
+	bcID, err := chainID(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() != 1 {
+		return xerrors.New("please give the file of the export as argument")
+	}
+	buf, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return xerrors.Errorf("reading export: %v", err)
+	}
+	w := c.App.Writer
+	fmt.Fprintf(w, "Chain: %x\n\n", bcID)
+	_, blocks, err := calypso.VerifyChainExport(buf, bcID)
+	if err != nil {
+		fmt.Fprintf(w, "[FAIL] %v\n", err)
+		fmt.Fprintln(w, "\nVerdict: the export is INVALID")
+		return xerrors.New("export could NOT be verified")
+	}
+
+	changes := 0
+	for i, sb := range blocks {
+		if i > 0 && !sb.Roster.ID.Equal(blocks[i-1].Roster.ID) {
+			changes++
+		}
+	}
+	latest := blocks[len(blocks)-1]
+	fmt.Fprintf(w, "[ OK ] %d blocks, up to block %x\n", len(blocks), latest.Hash)
+	fmt.Fprintf(w, "[ OK ] %d roster changes, %d nodes in the latest roster\n",
+		changes, len(latest.Roster.List))
+	var header byzcoin.DataHeader
+	if err := protobuf.Decode(latest.Data, &header); err == nil {
+		fmt.Fprintf(w, "[ OK ] latest block created at %s\n",
+			time.Unix(0, header.Timestamp).UTC())
+	}
+	fmt.Fprintln(w, "\nVerdict: the export is VALID")
+	return nil
+}
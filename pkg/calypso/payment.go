@@ -0,0 +1,147 @@
+package calypso
+
+import (
+	"encoding/binary"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/byzcoin/contracts"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A write with a Cost can only be read after paying it with coins of the
+// coin contract: the read-instance must be spawned in the same transaction
+// as a "fetch" of the coins from the account of the reader, which passes
+// them to the spawn. The write contract refuses the read if the coins are
+// missing, and stores them in the Payee account of the write, if it has
+// one. As the decryption needs the proof of the read-instance, a key is
+// only decrypted for a paid read.
+
+// verifyPayee checks that the payee of the write is a coin account of the
+// coins of its cost.
+func (wr *Write) verifyPayee(rst byzcoin.ReadOnlyStateTrie) error {
+	if wr.Payee == nil {
+		return nil
+	}
+	if wr.Cost.Value == 0 {
+		return xerrors.New("a write with a payee needs a cost")
+	}
+	payee, _, err := readCoin(rst, *wr.Payee)
+	if err != nil {
+		return err
+	}
+	if !payee.Name.Equal(wr.Cost.Name) {
+		return xerrors.New("the payee doesn't hold the coins of the cost")
+	}
+	return nil
+}
+
+// payRead takes the cost of the write out of the coins passed to the spawn
+// of the read, and stores it in the payee account. It returns the state
+// change of the payee account, if the write has one, and the remaining
+// coins.
+func (wr *Write) payRead(rst byzcoin.ReadOnlyStateTrie, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	if wr.Cost.Value == 0 {
+		return nil, coins, nil
+	}
+	paid := false
+	for i, coin := range coins {
+		if coin.Name.Equal(wr.Cost.Name) {
+			if err := coin.SafeSub(wr.Cost.Value); err != nil {
+				return nil, nil, xerrors.Errorf("couldn't pay for read request: %v", err)
+			}
+			coins[i] = coin
+			paid = true
+			break
+		}
+	}
+	if !paid {
+		return nil, nil, xerrors.New("the read must be paid with a fetch of the coins")
+	}
+	if wr.Payee == nil {
+		return nil, coins, nil
+	}
+	payee, darcID, err := readCoin(rst, *wr.Payee)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := payee.SafeAdd(wr.Cost.Value); err != nil {
+		return nil, nil, xerrors.Errorf("paying the payee: %v", err)
+	}
+	buf, err := protobuf.Encode(payee)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding payee account: %v", err)
+	}
+	log.Lvlf2("paying %d to %x", wr.Cost.Value, wr.Payee[:])
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		*wr.Payee, contracts.ContractCoinID, buf, darcID)}, coins, nil
+}
+
+// readCoin returns the coin account stored in the instance and its darc.
+func readCoin(rst byzcoin.ReadOnlyStateTrie, id byzcoin.InstanceID) (*byzcoin.Coin, darc.ID, error) {
+	buf, _, contractID, darcID, err := rst.GetValues(id.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting coin account %x: %v", id[:], err)
+	}
+	if contractID != contracts.ContractCoinID {
+		return nil, nil, xerrors.Errorf("%x is not a coin account", id[:])
+	}
+	var coin byzcoin.Coin
+	if err := protobuf.Decode(buf, &coin); err != nil {
+		return nil, nil, xerrors.Errorf("decoding coin account: %v", err)
+	}
+	return &coin, darcID, nil
+}
+
+// AddPaidRead creates a read-instance of a write with a cost, paying the
+// cost from the coin account of the signer. The transaction fetches the
+// coins from the account, with the counter signerCtr, and spawns the read
+// with signerCtr+1, so the signer needs the invoke:coin.fetch rule of the
+// darc of the account.
+func (c *Client) AddPaidRead(proof *byzcoin.Proof, signer darc.Signer, signerCtr uint64,
+	account byzcoin.InstanceID, wait int) (*ReadReply, error) {
+	writeID := byzcoin.NewInstanceID(proof.InclusionProof.Key())
+	var write Write
+	if err := proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write); err != nil {
+		return nil, xerrors.Errorf("didn't get a write instance: %v", err)
+	}
+	readBuf, err := protobuf.Encode(&Read{Write: writeID, Xc: signer.Ed25519.Point})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding Read message: %v", err)
+	}
+	coins := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coins, write.Cost.Value)
+
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: account,
+			Invoke: &byzcoin.Invoke{
+				ContractID: contracts.ContractCoinID,
+				Command:    "fetch",
+				Args:       byzcoin.Arguments{{Name: "coins", Value: coins}},
+			},
+			SignerCounter: []uint64{signerCtr},
+		},
+		byzcoin.Instruction{
+			InstanceID: writeID,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+			},
+			SignerCounter: []uint64{signerCtr + 1},
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signer); err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+
+	reply := &ReadReply{InstanceID: ctx.Instructions[1].DeriveID("")}
+	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		return nil, ToUserError(xerrors.Errorf("adding txn: %v", err))
+	}
+	return reply, nil
+}
@@ -0,0 +1,388 @@
+// Package policy implements a small expression language that writers can
+// attach to a calypso write-instance. The expression is evaluated every time
+// a read-instance is spawned, and the read is refused if it evaluates to
+// false.
+//
+// An expression is made of comparisons between variables and literals,
+// combined with '&&', '||', '!' and parentheses:
+//
+//	time < 1700000000 && (reader == "ed25519:..." || counter <= 3)
+//
+// Literals are either 64-bit integers or double-quoted strings. Integers can
+// be compared using ==, !=, <, <=, > and >=, strings only using == and !=.
+// The language has no loops and no function calls, so the evaluation time
+// is bounded by the length of the expression, which is itself limited to
+// MaxLength.
+package policy
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/xerrors"
+)
+
+// MaxLength is the maximum length of an expression in bytes.
+const MaxLength = 1024
+
+// maxDepth is the maximum nesting of parentheses and negations.
+const maxDepth = 32
+
+// Vars holds the values of the variables available to an expression. The
+// values must be either int64 or string.
+type Vars map[string]interface{}
+
+// Policy is a parsed expression.
+type Policy struct {
+	root node
+}
+
+// Parse returns the policy described by src, or an error if src is not a
+// valid expression.
+func Parse(src string) (*Policy, error) {
+	if len(src) > MaxLength {
+		return nil, xerrors.Errorf("expression is longer than %d bytes", MaxLength)
+	}
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, xerrors.Errorf("tokenizing: %v", err)
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, xerrors.Errorf("unexpected '%s'", p.toks[p.pos].text)
+	}
+	return &Policy{root: root}, nil
+}
+
+// Evaluate returns whether the policy holds for the given variables. An
+// error is returned if a variable is unknown or if the types of a comparison
+// don't match.
+func (p *Policy) Evaluate(vars Vars) (bool, error) {
+	return p.root.eval(vars)
+}
+
+// Evaluate parses src and evaluates it with the given variables.
+func Evaluate(src string, vars Vars) (bool, error) {
+	p, err := Parse(src)
+	if err != nil {
+		return false, xerrors.Errorf("parsing: %v", err)
+	}
+	return p.Evaluate(vars)
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokInt
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!"}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, xerrors.New("unterminated string")
+			}
+			toks = append(toks, token{tokString, src[i+1 : i+1+end]})
+			i += end + 2
+		case c == '-' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(src) && unicode.IsDigit(rune(src[j])) {
+				j++
+			}
+			toks = append(toks, token{tokInt, src[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) ||
+				unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, src[i:j]})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, token{tokOp, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, xerrors.Errorf("unexpected character '%c'", c)
+			}
+		}
+	}
+	return toks, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.pos]
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if t := p.peek(); t != nil && t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr(depth int) (node, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (node, error) {
+	left, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") {
+		right, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot(depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, xerrors.New("expression is nested too deeply")
+	}
+	if p.acceptOp("!") {
+		n, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	t := p.peek()
+	if t == nil {
+		return nil, xerrors.New("unexpected end of expression")
+	}
+	if t.kind == tokLParen {
+		p.pos++
+		n, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.kind != tokRParen {
+			return nil, xerrors.New("missing ')'")
+		}
+		p.pos++
+		return n, nil
+	}
+	if t.kind == tokIdent && (t.text == "true" || t.text == "false") {
+		p.pos++
+		return constNode(t.text == "true"), nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t == nil || t.kind != tokOp {
+		return nil, xerrors.New("expected a comparison operator")
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, xerrors.Errorf("expected a comparison operator, got '%s'", t.text)
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return cmpNode{op: t.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	if t == nil {
+		return operand{}, xerrors.New("unexpected end of expression")
+	}
+	p.pos++
+	switch t.kind {
+	case tokIdent:
+		return operand{name: t.text}, nil
+	case tokInt:
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return operand{}, xerrors.Errorf("invalid integer '%s'", t.text)
+		}
+		return operand{value: i}, nil
+	case tokString:
+		return operand{value: t.text}, nil
+	}
+	return operand{}, xerrors.Errorf("unexpected '%s'", t.text)
+}
+
+type node interface {
+	eval(vars Vars) (bool, error)
+}
+
+type constNode bool
+
+func (n constNode) eval(Vars) (bool, error) {
+	return bool(n), nil
+}
+
+type notNode struct {
+	n node
+}
+
+func (n notNode) eval(vars Vars) (bool, error) {
+	v, err := n.n.eval(vars)
+	return !v, err
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(vars Vars) (bool, error) {
+	l, err := n.left.eval(vars)
+	if err != nil || !l {
+		return false, err
+	}
+	return n.right.eval(vars)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(vars Vars) (bool, error) {
+	l, err := n.left.eval(vars)
+	if err != nil || l {
+		return l, err
+	}
+	return n.right.eval(vars)
+}
+
+// operand is either a variable, if name is set, or a literal value.
+type operand struct {
+	name  string
+	value interface{}
+}
+
+func (o operand) resolve(vars Vars) (interface{}, error) {
+	if o.name == "" {
+		return o.value, nil
+	}
+	v, ok := vars[o.name]
+	if !ok {
+		return nil, xerrors.Errorf("unknown variable '%s'", o.name)
+	}
+	switch v.(type) {
+	case int64, string:
+		return v, nil
+	}
+	return nil, xerrors.Errorf("variable '%s' has an invalid type", o.name)
+}
+
+type cmpNode struct {
+	op          string
+	left, right operand
+}
+
+func (n cmpNode) eval(vars Vars) (bool, error) {
+	l, err := n.left.resolve(vars)
+	if err != nil {
+		return false, err
+	}
+	r, err := n.right.resolve(vars)
+	if err != nil {
+		return false, err
+	}
+	switch lv := l.(type) {
+	case int64:
+		rv, ok := r.(int64)
+		if !ok {
+			return false, xerrors.New("cannot compare an integer with a string")
+		}
+		switch n.op {
+		case "==":
+			return lv == rv, nil
+		case "!=":
+			return lv != rv, nil
+		case "<":
+			return lv < rv, nil
+		case "<=":
+			return lv <= rv, nil
+		case ">":
+			return lv > rv, nil
+		case ">=":
+			return lv >= rv, nil
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, xerrors.New("cannot compare a string with an integer")
+		}
+		switch n.op {
+		case "==":
+			return lv == rv, nil
+		case "!=":
+			return lv != rv, nil
+		}
+		return false, xerrors.Errorf("cannot use '%s' on strings", n.op)
+	}
+	return false, xerrors.Errorf("unknown operator '%s'", n.op)
+}
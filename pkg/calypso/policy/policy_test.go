@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	vars := Vars{
+		"time":    int64(1000),
+		"counter": int64(3),
+		"reader":  "ed25519:1234",
+	}
+	for expr, result := range map[string]bool{
+		"true":                                    true,
+		"!true":                                   false,
+		"time < 2000":                             true,
+		"time >= 2000":                            false,
+		"-1 < counter":                            true,
+		"reader == \"ed25519:1234\"":              true,
+		"reader != \"ed25519:1234\"":              false,
+		"time < 2000 && counter > 3":              false,
+		"time < 2000 && counter >= 3":             true,
+		"time > 2000 || counter == 3":             true,
+		"!(time > 2000 || counter == 3)":          false,
+		"(time > 2000 || counter == 3) && !false": true,
+	} {
+		res, err := Evaluate(expr, vars)
+		require.NoError(t, err, expr)
+		require.Equal(t, result, res, expr)
+	}
+}
+
+func TestEvaluate_Errors(t *testing.T) {
+	vars := Vars{
+		"time":   int64(1000),
+		"reader": "ed25519:1234",
+	}
+	for _, expr := range []string{
+		"",
+		"time",
+		"time <",
+		"time < 10 &&",
+		"(time < 10",
+		"time < 10)",
+		"time = 10",
+		"\"unterminated",
+		"unknown == 1",
+		"reader < \"a\"",
+		"reader == 1",
+		"time == \"a\"",
+		"99999999999999999999 > time",
+		strings.Repeat("(", maxDepth+2) + "true" + strings.Repeat(")", maxDepth+2),
+		strings.Repeat("true && ", MaxLength/8) + "true",
+	} {
+		_, err := Evaluate(expr, vars)
+		require.Error(t, err, expr)
+	}
+}
@@ -2,9 +2,13 @@ package calypso
 
 import (
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
+	"github.com/calypso-demo/filesharing/pkg/darc"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
 	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
 )
 
 // PROTOSTART
@@ -12,6 +16,7 @@ import (
 // package calypso;
 // import "byzcoin.proto";
 // import "onet.proto";
+// import "darc.proto";
 //
 // option java_package = "ch.epfl.dedis.lib.proto";
 // option java_outer_classname = "Calypso";
@@ -45,15 +50,212 @@ type Write struct {
 	ExtraData []byte `protobuf:"opt"`
 	// LTSID points to the identity of the lts group
 	LTSID byzcoin.InstanceID
-	// Cost reflects how many coins you'll have to pay for a read-request
+	// Cost reflects how many coins you'll have to pay for a read-request.
+	// The coins must be fetched in the transaction of the read, see
+	// AddPaidRead.
 	Cost byzcoin.Coin `protobuf:"opt"`
+	// Policy is an optional expression of the policy package that must
+	// hold for a read-request to be accepted. See ReadPolicyVars for the
+	// available variables.
+	Policy string `protobuf:"opt"`
+	// Previous is the write-instance superseded by this one, if it has been
+	// created by an update.
+	Previous *byzcoin.InstanceID `protobuf:"opt"`
+	// Next is the write-instance superseding this one. It is set by the
+	// contract when the write is updated.
+	Next *byzcoin.InstanceID `protobuf:"opt"`
+	// Alternatives holds the symmetric key encrypted for other LTSs, so
+	// that the document can be recovered by any of them. See AddLTS.
+	Alternatives []WriteKey `protobuf:"opt"`
+	// Suite is the name of the kyber suite used to encrypt the key. It is
+	// empty for writes created before the suite has been recorded, which
+	// use the suite of the LTSs.
+	Suite string `protobuf:"opt"`
+	// Frozen is set while the reads and decryptions of the write are
+	// suspended, see the "freeze" and "unfreeze" commands of ContractWrite.
+	Frozen bool `protobuf:"opt"`
+	// FreezeReason is the reason given when the write has been frozen.
+	FreezeReason string `protobuf:"opt"`
+	// Label is a clear-text name of the document, which can be searched
+	// with ListDocuments.
+	Label string `protobuf:"opt"`
+	// Metadata is the DocumentMetadata, encrypted under the symmetric key
+	// of the write. See SetMetadata.
+	Metadata []byte `protobuf:"opt"`
+	// DataHash is the SHA-256 of the encrypted document, if it is stored
+	// outside of the chain. It is only set by older writes, see DataRoot.
+	DataHash []byte `protobuf:"opt"`
+	// DataRoot is the Merkle root of the chunks of the encrypted document,
+	// if it is stored outside of the chain. It replaces DataHash for the
+	// writes created by EncryptFile, and allows checking single chunks with
+	// VerifyChunk.
+	DataRoot []byte `protobuf:"opt"`
+	// Groups are reader groups whose members can read the document, in
+	// addition to the identities allowed by the darc of the write. The
+	// members are looked up when the read is spawned.
+	Groups []byzcoin.InstanceID `protobuf:"opt"`
+	// Auditor, if set, must co-sign every read of the write, so that no
+	// secret can be decrypted without an approval of the auditor stored on
+	// the chain. It cannot be changed by an update.
+	Auditor kyber.Point `protobuf:"opt"`
+	// RetainUntil is the Unix time, in seconds, before which the write
+	// cannot be deleted. It can only be extended, see the "retain" command
+	// of ContractWrite.
+	RetainUntil int64 `protobuf:"opt"`
+	// Hold is set while the write is under legal hold and cannot be
+	// deleted, see the "hold" and "release" commands of ContractWrite.
+	Hold bool `protobuf:"opt"`
+	// HoldReason is the reason given when the hold has been placed.
+	HoldReason string `protobuf:"opt"`
+	// RSAKeys holds the symmetric key wrapped for readers with RSA keys,
+	// who can recover it without the LTS. See AddRSAReader.
+	RSAKeys []RSAKey `protobuf:"opt"`
+	// Payee is the coin account receiving the Cost of every read. If it is
+	// nil, the coins paid for a read are burnt.
+	Payee *byzcoin.InstanceID `protobuf:"opt"`
+	// X is the public key of the LTS the key has been encrypted for. The
+	// client checks the replies to DecryptKey against it, as they are
+	// assembled by a single node. It is nil for writes created before it
+	// has been recorded.
+	X kyber.Point `protobuf:"opt"`
+}
+
+// RSAKey is the symmetric key of a write wrapped with RSA-OAEP for one
+// reader.
+type RSAKey struct {
+	// KeyID is the SHA-256 of the PKIX encoding of the public key of the
+	// reader, see RSAKeyID.
+	KeyID []byte
+	// Key is the wrapped symmetric key.
+	Key []byte
+}
+
+// WriteReference is stored in a value instance to publish a write to
+// applications that only know the byzcoin contracts. See AddWriteWithValue.
+type WriteReference struct {
+	// WriteID is the latest version of the document.
+	WriteID  byzcoin.InstanceID
+	Previous *byzcoin.InstanceID `protobuf:"opt"`
+	Label    string              `protobuf:"opt"`
+	DataHash []byte              `protobuf:"opt"`
+	DataRoot []byte              `protobuf:"opt"`
+	// Metadata is the encrypted DocumentMetadata of the write.
+	Metadata []byte `protobuf:"opt"`
+}
+
+// DocumentMetadata describes the document of a write. It is stored
+// encrypted in the write, so only the readers can see it.
+type DocumentMetadata struct {
+	Filename string   `protobuf:"opt"`
+	MIMEType string   `protobuf:"opt"`
+	Tags     []string `protobuf:"opt"`
+	// Fields holds application-specific metadata.
+	Fields map[string]string `protobuf:"opt"`
+}
+
+// WriteKey is the symmetric key of a write encrypted for one LTS, with the
+// proof that it has been encrypted by somebody knowing the key. The fields
+// are the same as in Write.
+type WriteKey struct {
+	LTSID byzcoin.InstanceID
+	U     kyber.Point
+	Ubar  kyber.Point
+	E     kyber.Scalar
+	F     kyber.Scalar
+	C     kyber.Point
+	X     kyber.Point `protobuf:"opt"`
 }
 
 // Read is the data stored in a read instance. It has a pointer to the write
-// instance and the public key used to re-encrypt the secret to.
+// instance and the public key used to re-encrypt the secret to. A blinded
+// read holds a Commitment to the key instead, which is opened to the
+// trustees with a ReadOpening in the DecryptKey request.
 type Read struct {
-	Write byzcoin.InstanceID
-	Xc    kyber.Point
+	Write      byzcoin.InstanceID
+	Xc         kyber.Point `protobuf:"opt"`
+	Commitment []byte      `protobuf:"opt"`
+	// Group is the reader group of the write the read has been accepted
+	// through, and Member the key of the member who signed it. They are set
+	// by the write contract, and the membership is checked again for every
+	// decryption.
+	Group  *byzcoin.InstanceID `protobuf:"opt"`
+	Member kyber.Point         `protobuf:"opt"`
+	// BlockIndex and Timestamp are the index and the time, in Unix
+	// nanoseconds, of the block the read has been spawned in. They are set
+	// by the write contract, so that the trustees can refuse the expired
+	// reads, see ServiceConfig.ReadTTL.
+	BlockIndex int   `protobuf:"opt"`
+	Timestamp  int64 `protobuf:"opt"`
+	// Signers are the identities that signed the spawn of the read. They
+	// are set by the write contract, so that the trustees refuse the reads
+	// of a revoked identity, see RevokeIdentity.
+	Signers []string `protobuf:"opt"`
+	// Delegations is the chain of delegations of the read, recorded with
+	// the "delegate" invoke. The secret is re-encrypted to the last
+	// delegate.
+	Delegations []Delegation `protobuf:"opt"`
+}
+
+// ReadOpening reveals the key of a blinded read to the trustees. Signature
+// is the schnorr signature of the private key of Xc on the commitment, which
+// proves that the reader holds it.
+type ReadOpening struct {
+	Xc        kyber.Point
+	Blinding  []byte
+	Signature []byte
+}
+
+// Delegation lets the Delegate decrypt the secret of a read. Signature is
+// the schnorr signature on the delegation by the key of the reader, or of
+// the previous delegate. See NewDelegation and Client.DelegateRead.
+type Delegation struct {
+	Delegate  kyber.Point
+	Signature []byte
+}
+
+// Credential is the data stored in a credential instance. It holds the
+// device keys enrolled by a reader, each signed by the primary key of the
+// reader. A read signed by an enrolled device is accepted as if it was
+// signed by the primary key.
+type Credential struct {
+	Primary kyber.Point
+	Devices []Device `protobuf:"opt"`
+	// Revoked are the keys of the revoked devices, which cannot be enrolled
+	// again.
+	Revoked []kyber.Point `protobuf:"opt"`
+}
+
+// Device is a key of a reader used on one of its devices.
+type Device struct {
+	Name string
+	Key  kyber.Point
+	// Signature is the schnorr signature of the primary key on
+	// DeviceMessage.
+	Signature []byte
+}
+
+// Group is the data stored in a group instance: the public keys of the
+// members of a reader group. The members are added and removed by the
+// identities allowed by the darc of the group.
+type Group struct {
+	Members []kyber.Point `protobuf:"opt"`
+}
+
+// IdentityRegistry is the data stored in an identity registry instance: the
+// bindings of identifiers to public keys, each signed by the Authority.
+type IdentityRegistry struct {
+	Authority kyber.Point
+	Bindings  []IdentityBinding `protobuf:"opt"`
+}
+
+// IdentityBinding binds a human identifier, like an email address or an
+// LDAP DN, to the public key of a reader.
+type IdentityBinding struct {
+	Identifier string
+	Key        kyber.Point
+	// Signature is the schnorr signature of the authority of the registry
+	// on BindingMessage.
+	Signature []byte
 }
 
 // ***
@@ -78,17 +280,344 @@ type Authorize struct {
 	ByzCoinID skipchain.SkipBlockID
 	Timestamp int64  `protobuf:"opt"`
 	Signature []byte `protobuf:"opt"`
+	// Namespace puts the ByzCoinID in the given namespace, which must have
+	// been configured before. An empty namespace is the default one.
+	Namespace string `protobuf:"opt"`
+	// Roster is the roster of the cothority hosting the chain, for nodes
+	// that don't hold it (light mode). It is part of the signed message.
+	Roster *onet.Roster `protobuf:"opt"`
 }
 
 // AuthorizeReply is returned upon successful authorisation.
 type AuthorizeReply struct {
 }
 
+// ConfigureNamespace creates or updates a namespace on the conode. Every
+// ByzCoinID belongs to exactly one namespace, and requests for a ByzCoinID
+// are only accepted if they name its namespace. An LTS belongs to the
+// namespace it has been created in, and every node of the DKG and of the
+// re-encryption refuses to use it for the ByzCoinIDs of another namespace.
+// The statistics and events are filtered by namespace. To be accepted, the
+// namespace and the timestamp must be signed using the private key of the
+// conode.
+type ConfigureNamespace struct {
+	Namespace string
+	// Roster, if given, restricts the nodes that can be part of an LTS
+	// created in this namespace.
+	Roster    *onet.Roster `protobuf:"opt"`
+	Timestamp int64        `protobuf:"opt"`
+	Signature []byte       `protobuf:"opt"`
+}
+
+// ConfigureNamespaceReply is returned upon successful configuration.
+type ConfigureNamespaceReply struct {
+}
+
+// ConfigureEscrow sets the escrow admins of the conode. Threshold of the
+// Admins must sign an ExportShares request for it to be accepted. Like
+// Authorize, the request must be signed using the private key of the
+// conode. An empty list of Admins disables ExportShares.
+type ConfigureEscrow struct {
+	Admins    []kyber.Point
+	Threshold int
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// ConfigureEscrowReply is returned upon successful configuration.
+type ConfigureEscrowReply struct {
+}
+
+// ExportShares asks the conode to export its share of the LTS, encrypted
+// under RecoveryKey, so that the secret of the LTS can be recovered offline
+// if the cothority disappears. Signatures[i] is the signature of the i-th
+// escrow admin on the LTSID, RecoveryKey and Timestamp, and is empty if this
+// admin didn't sign. Record is the proof of the LTS instance, which must
+// allow escrow exports and hold RecoveryKey in its Exports.
+type ExportShares struct {
+	LTSID       byzcoin.InstanceID
+	RecoveryKey kyber.Point
+	Timestamp   int64
+	Signatures  [][]byte
+	Record      *byzcoin.Proof `protobuf:"opt"`
+}
+
+// ExportSharesReply holds the share of the conode encrypted under the
+// recovery key, and the public polynomial of the LTS to verify it.
+type ExportSharesReply struct {
+	// Index is the index of the share.
+	Index int
+	// Encrypted is the ECIES encryption of the marshalled share.
+	Encrypted []byte
+	// X is the aggregate public key of the LTS.
+	X kyber.Point
+	// Commits are the commitments of the public polynomial of the LTS.
+	Commits []kyber.Point
+}
+
+// ReloadConfig asks the conode to read its configuration file again. To be
+// accepted, the timestamp must be signed using the private key of the
+// conode.
+type ReloadConfig struct {
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// ReloadConfigReply holds the configuration now used by the conode.
+type ReloadConfigReply struct {
+	Config ServiceConfig
+}
+
+// ExportSnapshot asks the conode for a snapshot of its LTSs and authorised
+// chains, to move them to another machine. Like ReloadConfig, the request
+// must be signed using the private key of the conode.
+type ExportSnapshot struct {
+	// OperatorKey is the key the secrets of the snapshot are encrypted
+	// under.
+	OperatorKey kyber.Point
+	Timestamp   int64  `protobuf:"opt"`
+	Signature   []byte `protobuf:"opt"`
+	// Records are the proofs of the instances of every LTS held by the
+	// conode. Each LTS must allow escrow exports and have recorded the
+	// export to the OperatorKey, see Client.RecordExport.
+	Records []byzcoin.Proof `protobuf:"opt"`
+}
+
+// ExportSnapshotReply holds the snapshot of the conode.
+type ExportSnapshotReply struct {
+	Snapshot Snapshot
+}
+
+// Snapshot is a portable copy of the storage of a conode. As the shares of
+// the LTSs belong to the key of the conode, it can only be imported by a
+// conode using the same key.
+type Snapshot struct {
+	// Public is the public key of the conode.
+	Public kyber.Point
+	// Timestamp is the time of the snapshot, in nanoseconds.
+	Timestamp int64
+	// Storage is the encoded storage, without the secrets of the LTSs.
+	Storage []byte
+	// Secrets are the encoded secrets of the LTSs, encrypted using ECIES
+	// under the operator key when exported, and under the key of the
+	// conode when imported.
+	Secrets []byte
+}
+
+// ImportSnapshot replaces the storage of a conode without LTSs with a
+// snapshot, whose secrets have been encrypted under the key of the conode
+// with Snapshot.Seal. Like ReloadConfig, the request must be signed using
+// the private key of the conode.
+type ImportSnapshot struct {
+	Snapshot  Snapshot
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// ImportSnapshotReply is returned once the snapshot has been imported.
+type ImportSnapshotReply struct {
+	// LTSs is the number of LTSs imported.
+	LTSs int
+}
+
+// RevokeIdentity revokes a compromised reader key on a node. From then on,
+// the node refuses to re-encrypt a secret to this key, or for a read signed
+// by it. Like Authorize, the request must be signed by the private key
+// stored in private.toml.
+type RevokeIdentity struct {
+	Key       kyber.Point
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// RevokeIdentityReply lists what the revoked key had access to, according to
+// the event log of the node.
+type RevokeIdentityReply struct {
+	// Writes are the write-instances the key read, or was allowed to read.
+	Writes []byzcoin.InstanceID
+	// LTSs are the LTSs holding the keys of these writes, whose shares
+	// should be refreshed by a reshare.
+	LTSs []byzcoin.InstanceID
+}
+
+// RemoveNode tells a node that it is going to leave its rosters. To be
+// accepted, the timestamp must be signed using the private key of the
+// conode.
+type RemoveNode struct {
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// RemoveNodeReply lists the LTSs the node holds a share of, which must be
+// reshared to the other nodes before it leaves.
+type RemoveNodeReply struct {
+	LTSs []HeldLTS
+}
+
+// HeldLTS is an LTS held by a node.
+type HeldLTS struct {
+	ByzCoinID skipchain.SkipBlockID
+	LTSID     byzcoin.InstanceID
+}
+
+// Misbehavior is the evidence that a node returned wrong shares: the
+// request, the reply signed by the node, and the positions in Reply.Uis of
+// the shares whose proof fails. It is created by NewMisbehavior.
+type Misbehavior struct {
+	// Root is the node that ran the re-encryption and signed the reply.
+	Root *network.ServerIdentity
+	// Request is the request sent to the root.
+	Request DecryptKey
+	// Reply is the reply signed by the root.
+	Reply DecryptKeyReply
+	// Shares are the positions of the wrong shares in Reply.Uis.
+	Shares []int
+}
+
+// ReportMisbehavior sends the evidence of a misbehavior to a node, which
+// verifies it and adds it to its event log.
+type ReportMisbehavior struct {
+	Misbehavior Misbehavior
+}
+
+// ReportMisbehaviorReply is returned once the evidence has been logged.
+type ReportMisbehaviorReply struct {
+}
+
+// GetDigest asks a node for the digest of its chains and LTSs.
+type GetDigest struct {
+}
+
+// GetDigestReply holds the leaves of the digest of a node, sorted by key,
+// and the root of their Merkle tree.
+type GetDigestReply struct {
+	Root   []byte
+	Leaves []DigestLeaf
+}
+
+// DigestLeaf is one entry of the digest of a node.
+type DigestLeaf struct {
+	// Key is the ID of the chain or of the LTS, prefixed by "chain:" or
+	// "lts:".
+	Key string
+	// Index is the index of the latest block of a chain.
+	Index int `protobuf:"opt"`
+	// Hash is the hash of the latest block of a chain, or the hash of the
+	// public key, the polynomial and the roster of an LTS.
+	Hash []byte
+}
+
+// ReconcileShare tells a node of an LTS that the other nodes hold their
+// shares. If the node misses its share, it recovers it from them.
+type ReconcileShare struct {
+	// Proof is the proof of the LTS instance.
+	Proof byzcoin.Proof
+}
+
+// ReconcileShareReply tells whether the node had to recover its share.
+type ReconcileShareReply struct {
+	Recovered bool
+}
+
+// GetShareIndex asks a node for the index of its share of an LTS.
+type GetShareIndex struct {
+	LTSID byzcoin.InstanceID
+}
+
+// GetShareIndexReply holds the index of the share of the node.
+type GetShareIndexReply struct {
+	Index int
+	// Holders is the roster of the DKG, in which the position of a node
+	// is the index of its share.
+	Holders *onet.Roster `protobuf:"opt"`
+}
+
+// ShareContribution asks a node for its part of the share with the given
+// index, which is the sum of the parts of the helpers.
+type ShareContribution struct {
+	LTSID byzcoin.InstanceID
+	// Index is the index of the missing share.
+	Index int
+	// Helpers are the indexes of the shares of the helpers, and Publics
+	// their service keys.
+	Helpers []int
+	Publics []kyber.Point
+	// Requester is the service key of the node missing its share.
+	Requester kyber.Point
+}
+
+// ShareContributionReply holds the part of the node, encrypted for the
+// requester, and the commits of the polynomial of the LTS.
+type ShareContributionReply struct {
+	Contribution []byte
+	Commits      []kyber.Point
+	// Holders is the roster of the DKG, in which the position of a node
+	// is the index of its share.
+	Holders *onet.Roster `protobuf:"opt"`
+}
+
+// CheckConsistency asks the conode for the last report of the comparison of
+// its state with the other nodes. If Run is set, a new comparison is done.
+// To be accepted, Run and the timestamp must be signed using the private key
+// of the conode.
+type CheckConsistency struct {
+	Run       bool   `protobuf:"opt"`
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// CheckConsistencyReply holds the last report, which is nil if no check has
+// been done yet.
+type CheckConsistencyReply struct {
+	Report *ConsistencyReport `protobuf:"opt"`
+	// Repairs are the latest repairs of corrupted blocks of this node.
+	Repairs []BlockRepair `protobuf:"opt"`
+}
+
+// BlockRepair is a block of the local db that didn't match its hash, and
+// has been fetched again from the other nodes.
+type BlockRepair struct {
+	BlockID skipchain.SkipBlockID
+	// Timestamp is the end of the repair, in Unix nanoseconds.
+	Timestamp int64
+	// Repaired is false if no node could send the block.
+	Repaired bool
+	// Error is the reason of a failed repair.
+	Error string `protobuf:"opt"`
+}
+
+// ConsistencyReport is the result of the comparison of the state of a node
+// with the other nodes of its chains and LTSs.
+type ConsistencyReport struct {
+	// Timestamp is the time of the check, in Unix nanoseconds.
+	Timestamp int64
+	// Checked is the number of nodes that answered.
+	Checked int
+	// Unreachable are the nodes that didn't answer.
+	Unreachable []*network.ServerIdentity `protobuf:"opt"`
+	// Divergences are the entries that differ.
+	Divergences []Divergence `protobuf:"opt"`
+}
+
+// Divergence is an entry of the digest that differs between this node and
+// another node.
+type Divergence struct {
+	Node *network.ServerIdentity
+	Key  string
+	// Index is the block compared for a chain.
+	Index  int `protobuf:"opt"`
+	Local  []byte
+	Remote []byte
+}
+
 // CreateLTS is used to start a DKG and store the private keys in each node.
 // Prior to using this request, the Calypso roster must be recorded on the
 // ByzCoin blockchain in the instance specified by InstanceID.
 type CreateLTS struct {
-	Proof byzcoin.Proof
+	Proof     byzcoin.Proof
+	Namespace string `protobuf:"opt"`
+	// TraceID, if set, is logged by all nodes with every phase of the DKG.
+	TraceID string `protobuf:"opt"`
 }
 
 // CreateLTSReply is returned upon successfully setting up the distributed
@@ -104,7 +633,8 @@ type CreateLTSReply struct {
 // the Calypso roster must be updated on the ByzCoin blockchain in the instance
 // specified by InstanceID.
 type ReshareLTS struct {
-	Proof byzcoin.Proof
+	Proof     byzcoin.Proof
+	Namespace string `protobuf:"opt"`
 }
 
 // ReshareLTSReply is returned upon successful resharing. The LTSID and the
@@ -119,6 +649,32 @@ type DecryptKey struct {
 	Read byzcoin.Proof
 	// Write is the proof containing the write request.
 	Write byzcoin.Proof
+	// Namespace is the namespace of the ByzCoinID of the proofs.
+	Namespace string `protobuf:"opt"`
+	// TraceID, if set, is logged by all nodes with every phase of the
+	// re-encryption.
+	TraceID string `protobuf:"opt"`
+	// LTSID chooses the LTS to decrypt with if the write holds the key
+	// for several of them. If it is nil, the first LTS known by the node
+	// is used.
+	LTSID *byzcoin.InstanceID `protobuf:"opt"`
+	// Strategy is the name of the TreeStrategy choosing the nodes of the
+	// re-encryption. If it is empty, the strategy configured on the node
+	// is used.
+	Strategy string `protobuf:"opt"`
+	// Opening must be given if the read is blinded.
+	Opening *ReadOpening `protobuf:"opt"`
+	// Partial asks for the shares that have been collected if there are not
+	// enough of them for the threshold, instead of an error.
+	Partial bool `protobuf:"opt"`
+	// Timestamp, Nonce and Signature are set by Sign, so that the request
+	// cannot be sent again.
+	Timestamp int64  `protobuf:"opt"`
+	Nonce     []byte `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+	// Group is the proof of the reader group of the read, if it has been
+	// accepted through one. Client.DecryptKey fetches it if it is missing.
+	Group *byzcoin.Proof `protobuf:"opt"`
 }
 
 // DecryptKeyReply is returned if the service verified successfully that the
@@ -130,15 +686,443 @@ type DecryptKeyReply struct {
 	XhatEnc kyber.Point
 	// X is the aggregate public key of the LTS used.
 	X kyber.Point
+	// Uis are the re-encrypted shares XhatEnc has been recovered from.
+	Uis []*share.PubShare `protobuf:"opt"`
+	// Proofs holds, for every entry in Uis, the proof of the node that it
+	// correctly re-encrypted its share.
+	Proofs []protocol.ReencryptProof `protobuf:"opt"`
+	// Commits are the commitments of the public polynomial of the LTS. The
+	// first commitment is X.
+	Commits []kyber.Point `protobuf:"opt"`
+	// Partial is set if not enough shares have been collected. XhatEnc is
+	// nil, and Uis only holds the shares of the nodes that replied.
+	Partial bool `protobuf:"opt"`
+	// Failures lists the nodes that didn't contribute a share, and why.
+	Failures []NodeFailure `protobuf:"opt"`
+	// Signature is the schnorr signature of the node that ran the
+	// re-encryption on the request and the rest of the reply, using its
+	// conode key.
+	Signature []byte `protobuf:"opt"`
+}
+
+// NodeFailure is a node that didn't contribute to a re-encryption.
+type NodeFailure struct {
+	Node *network.ServerIdentity
+	// Reason is one of the Failure constants.
+	Reason string
+}
+
+// The reasons of a NodeFailure. FailureBadWrite means that the data of the
+// write or of the request is wrong, the others that the node failed.
+const (
+	FailureUnresponsive = "unresponsive"
+	FailureRefused      = "refused"
+	FailureInvalid      = "invalid"
+	FailureBadWrite     = "bad-write"
+)
+
+// DecryptKeys asks for the re-encryption of several secrets in one round.
+// All writes must use the same LTS, and at most MaxDecryptBatch requests can
+// be sent at once.
+type DecryptKeys struct {
+	Requests []DecryptKey
+	// TraceID, if set, is logged by all nodes with every phase of the
+	// re-encryption. The TraceIDs of the requests are ignored.
+	TraceID string `protobuf:"opt"`
+	// Strategy is used instead of the strategies of the requests, like
+	// TraceID.
+	Strategy string `protobuf:"opt"`
+	// Partial is used instead of Partial of the requests, like TraceID.
+	Partial bool `protobuf:"opt"`
+}
+
+// DecryptKeysReply holds one DecryptKeyReply per request, in the same order.
+type DecryptKeysReply struct {
+	Replies []DecryptKeyReply
 }
 
 // GetLTSReply asks for the shared public key of the corresponding LTSID
 type GetLTSReply struct {
 	// LTSID is the id of the LTS instance created.
 	LTSID byzcoin.InstanceID
+	// Namespace is the namespace of the ByzCoinID of the LTS.
+	Namespace string `protobuf:"opt"`
 }
 
 // LtsInstanceInfo is the information stored in an LTS instance.
 type LtsInstanceInfo struct {
 	Roster onet.Roster
+	// Weights, if set, is the number of shares of every node of the
+	// roster, in the same order, so that the organizations running the
+	// nodes can be trusted differently without running more nodes. The
+	// threshold of the LTS is then a number of shares, see Threshold. It
+	// is set when the LTS is created, and an LTS with weights cannot be
+	// reshared, only rotated.
+	Weights []int `protobuf:"opt"`
+	// EscrowExport allows the nodes to export their shares of the LTS with
+	// ExportShares, for deployments that must support lawful recovery. It
+	// is off by default, is set when the LTS is created and cannot be
+	// changed by a reshare.
+	EscrowExport bool `protobuf:"opt"`
+	// Exports are the recovery keys the shares may be exported to. They are
+	// added with the "export" command of the LTS contract, so that every
+	// export is recorded in the chain before it can happen.
+	Exports []kyber.Point `protobuf:"opt"`
+	// RSAWrapping allows the writes using this LTS to hold their key
+	// wrapped for readers with RSA keys, see AddRSAReader. It is off by
+	// default, is set when the LTS is created and cannot be changed by a
+	// reshare.
+	RSAWrapping bool `protobuf:"opt"`
+	// Epoch counts the key rotations: an LTS created by the "rotate"
+	// command has the epoch of its Previous LTS plus one. Every epoch has its own DKG,
+	// so its own key, and the nodes keep the shares of the earlier epochs.
+	Epoch int `protobuf:"opt"`
+	// Previous is the LTS of the preceding epoch.
+	Previous *byzcoin.InstanceID `protobuf:"opt"`
+	// Next is the LTS of the following epoch. Once it is set, new writes
+	// cannot use this LTS anymore.
+	Next *byzcoin.InstanceID `protobuf:"opt"`
+	// Reshares is the history of the reshares of this epoch, oldest first.
+	// It is kept by the contract and cannot be set by a spawn or a reshare.
+	Reshares []LtsReshare `protobuf:"opt"`
+}
+
+// LtsReshare records a reshare of an LTS: the roster holding the shares
+// before the reshare, and the block the new roster has been stored in.
+type LtsReshare struct {
+	Roster onet.Roster
+	// BlockIndex is the index of the block of the reshare.
+	BlockIndex int
+	// Timestamp is the time of the block, in Unix nanoseconds.
+	Timestamp int64 `protobuf:"opt"`
+}
+
+// GetDocumentStats asks for the read statistics of a write instance.
+type GetDocumentStats struct {
+	// WriteID is the instance ID of the write.
+	WriteID byzcoin.InstanceID
+	// Namespace is the namespace of the ByzCoinID of the write.
+	Namespace string `protobuf:"opt"`
+}
+
+// GetDocumentStatsReply holds the statistics of one write instance as seen
+// by the node answering the request. All timestamps are Unix timestamps in
+// nanoseconds, and are 0 if the event never happened.
+type GetDocumentStatsReply struct {
+	// Reads is the number of read instances spawned for this write.
+	Reads int
+	// Readers is the number of distinct public keys in these reads.
+	Readers int
+	// Decrypts is the number of DecryptKey requests answered by this node.
+	Decrypts int
+	// FirstRead is the timestamp of the block with the first read.
+	FirstRead int64
+	// LastRead is the timestamp of the block with the latest read.
+	LastRead int64
+	// LastDecrypt is the time of the latest DecryptKey request.
+	LastDecrypt int64
+}
+
+// ListDocuments asks for a page of the write-instances of a chain, sorted by
+// creation time.
+type ListDocuments struct {
+	ByzCoinID skipchain.SkipBlockID
+	// Writer, if given, only returns the writes signed by this identity.
+	Writer string `protobuf:"opt"`
+	// Since and Until, if given, only return the writes created in this
+	// interval, as Unix timestamps in nanoseconds.
+	Since int64 `protobuf:"opt"`
+	Until int64 `protobuf:"opt"`
+	// Label, if given, only returns the writes whose label contains it,
+	// ignoring the case.
+	Label string `protobuf:"opt"`
+	// Offset is the number of matching writes to skip.
+	Offset int `protobuf:"opt"`
+	// Limit is the maximum number of writes to return. If it is 0, a
+	// default is used.
+	Limit int `protobuf:"opt"`
+}
+
+// ListDocumentsReply holds a page of the writes matching the request.
+type ListDocumentsReply struct {
+	Documents []DocumentInfo
+	// Total is the number of matching writes, over all pages.
+	Total int
+}
+
+// FindByLabel asks for the writes of a chain whose label holds all the
+// words of Label, ignoring the case.
+type FindByLabel struct {
+	ByzCoinID skipchain.SkipBlockID
+	Label     string
+	// Limit is the maximum number of writes to return. If it is 0, a
+	// default is used.
+	Limit int `protobuf:"opt"`
+}
+
+// FindByLabelReply holds a proof of every write matching the request, oldest
+// first.
+type FindByLabelReply struct {
+	Proofs []byzcoin.Proof
+}
+
+// DocumentInfo is the metadata of a write-instance.
+type DocumentInfo struct {
+	WriteID byzcoin.InstanceID
+	// Writer is the identity that signed the write.
+	Writer string
+	// Label is the clear-text name of the write.
+	Label string `protobuf:"opt"`
+	// Size is the length of the data of the write.
+	Size int
+	// Timestamp is the time of the block of the write, in Unix
+	// nanoseconds.
+	Timestamp int64
+	// Readers is the number of distinct public keys in the reads.
+	Readers int
+}
+
+// GetChainStats asks for the daily statistics of a chain.
+type GetChainStats struct {
+	ByzCoinID skipchain.SkipBlockID
+}
+
+// GetChainStatsReply holds the statistics of a chain as seen by the node
+// answering the request.
+type GetChainStatsReply struct {
+	// Days are the statistics for every day with activity, sorted by day.
+	Days []DayStats
+	// Blocks is the total number of blocks seen.
+	Blocks int
+	// Decrypts is the total number of decryptions done by this node.
+	Decrypts int
+	// DecryptLatency is the average duration of a decryption, in
+	// nanoseconds.
+	DecryptLatency int64
+}
+
+// DayStats are the statistics of a chain for one day.
+type DayStats struct {
+	// Day is the start of the day as a Unix timestamp in nanoseconds.
+	Day      int64
+	Blocks   int
+	Writes   int
+	Reads    int
+	Decrypts int
+	// DecryptLatency is the average duration of a decryption during this
+	// day, in nanoseconds.
+	DecryptLatency int64
+}
+
+// Event is one entry of the event log of a node.
+type Event struct {
+	// Cursor is the position of the event in the log.
+	Cursor uint64
+	// Type is one of the Event* constants.
+	Type string
+	// Timestamp is the time of the block, or of the decryption, as a Unix
+	// timestamp in nanoseconds.
+	Timestamp int64
+	// ByzCoinID is the chain the event happened on.
+	ByzCoinID skipchain.SkipBlockID
+	// BlockIndex is the index of the block holding the event. It is -1
+	// for decryptions.
+	BlockIndex int
+	// InstanceID is the instance the event is about: the write, the read,
+	// or the darc whose rule changed.
+	InstanceID byzcoin.InstanceID
+	// WriteID is the write concerned by a read or a decryption.
+	WriteID byzcoin.InstanceID `protobuf:"opt"`
+	// Identity is the signer of the instruction, the public key the
+	// secret has been re-encrypted to, the identity added to or removed
+	// from a rule, or the public key of a blamed node.
+	Identity string `protobuf:"opt"`
+	// Blame is the evidence of a blame event. It can be checked with the
+	// commits of the LTS, which are in every DecryptKeyReply.
+	Blame *protocol.Blame `protobuf:"opt"`
+	// Misbehavior is the evidence of a misbehavior event, reported by a
+	// client. It can be checked with its Verify method.
+	Misbehavior *Misbehavior `protobuf:"opt"`
+}
+
+// GetEvents asks for a page of the event log of a node.
+type GetEvents struct {
+	// Cursor is the first event to return.
+	Cursor uint64
+	// Limit is the maximum number of events to return. If it is 0, a
+	// default is used.
+	Limit int `protobuf:"opt"`
+	// WriteID, if given, only returns the events of this write.
+	WriteID *byzcoin.InstanceID `protobuf:"opt"`
+	// ByzCoinID, if given, only returns the events of this chain.
+	ByzCoinID skipchain.SkipBlockID `protobuf:"opt"`
+	// Identity, if given, only returns the events of this identity, e.g.
+	// the decryptions for the public key of a reader.
+	Identity string `protobuf:"opt"`
+	// Proofs asks for a proof of every write and read event, so that the
+	// client doesn't have to trust the node.
+	Proofs bool `protobuf:"opt"`
+	// Namespace only returns the events of the ByzCoinIDs of this
+	// namespace.
+	Namespace string `protobuf:"opt"`
+	// Timestamp and Signature, if given, are signed by the private key of
+	// the conode to get the identities of the events.
+	Timestamp int64  `protobuf:"opt"`
+	Signature []byte `protobuf:"opt"`
+}
+
+// GetEventsReply holds a page of the event log.
+type GetEventsReply struct {
+	Events []Event
+	// Next is the cursor to use for the next page.
+	Next uint64
+	// Proofs holds the proofs of the write and read events, if they have
+	// been requested.
+	Proofs []EventProof `protobuf:"opt"`
+}
+
+// EventProof is the proof, starting at the genesis block, that the instance
+// of the event with the given cursor exists.
+type EventProof struct {
+	Cursor uint64
+	Proof  byzcoin.Proof
+}
+
+// QueryAccessAt asks who was allowed to read a write instance at a given
+// point in the history of the chain.
+type QueryAccessAt struct {
+	// ByzCoinID is the chain holding the write instance.
+	ByzCoinID skipchain.SkipBlockID
+	// WriteID is the instance ID of the write.
+	WriteID byzcoin.InstanceID
+	// BlockIndex is the index of the block at which the access is checked.
+	BlockIndex int
+	// Timestamp, if non-zero, is used instead of BlockIndex to select the
+	// last block created at or before this Unix time in nanoseconds.
+	Timestamp int64 `protobuf:"opt"`
+	// Identity, if given, is checked against the rule in Allowed.
+	Identity string `protobuf:"opt"`
+	// Namespace is the namespace of the ByzCoinID.
+	Namespace string `protobuf:"opt"`
+}
+
+// QueryAccessAtReply describes the access rules of a write instance as they
+// were at the given block.
+type QueryAccessAtReply struct {
+	// BlockIndex is the block used to evaluate the rules.
+	BlockIndex int
+	// Exists is false if the write instance was created after BlockIndex.
+	Exists bool
+	// Darc is the version of the darc of the write valid at BlockIndex.
+	Darc darc.Darc
+	// Rule is the expression of the spawn:calypsoRead rule.
+	Rule string
+	// Readers are all identities found in the rule, with darcs replaced by
+	// the identities of their sign rule.
+	Readers []string
+	// Allowed is true if Identity satisfied the rule.
+	Allowed bool
+}
+
+// GetWriteStatus asks for the state of a write instance in its lifecycle.
+type GetWriteStatus struct {
+	// ByzCoinID is the chain holding the write instance.
+	ByzCoinID skipchain.SkipBlockID
+	// WriteID is the instance ID of the write.
+	WriteID byzcoin.InstanceID
+	// Namespace is the namespace of the ByzCoinID.
+	Namespace string `protobuf:"opt"`
+}
+
+// GetWriteStatusReply holds the state of a write instance and how it got
+// there.
+type GetWriteStatusReply struct {
+	// State is one of the Write* states.
+	State string
+	// History holds the changes of state, starting with the commit of the
+	// write. It is empty for a pending write.
+	History []WriteTransition `protobuf:"opt"`
+	// Next is the write superseding this one, if it has been updated.
+	Next *byzcoin.InstanceID `protobuf:"opt"`
+	// Frozen is true if the reads of the write are suspended, whatever its
+	// state.
+	Frozen bool `protobuf:"opt"`
+	// FreezeReason is the reason given when the write has been frozen.
+	FreezeReason string `protobuf:"opt"`
+	// Hold is true if the write is under legal hold.
+	Hold bool `protobuf:"opt"`
+	// HoldReason is the reason given when the hold has been placed.
+	HoldReason string `protobuf:"opt"`
+}
+
+// WriteTransition is a change of the state of a write instance.
+type WriteTransition struct {
+	// BlockIndex is the block where the state changed.
+	BlockIndex int
+	// State is the new state.
+	State string
+}
+
+// EstimateDecrypt asks a node what a decryption of a write would take,
+// before the reader spawns a read instance.
+type EstimateDecrypt struct {
+	// ByzCoinID is the chain holding the write instance.
+	ByzCoinID skipchain.SkipBlockID
+	// WriteID is the instance ID of the write.
+	WriteID byzcoin.InstanceID
+	// Reader is the public key the secret would be re-encrypted to. If it
+	// is given, the remaining quota of the reader is returned.
+	Reader kyber.Point `protobuf:"opt"`
+	// Strategy is the tree strategy of the decryption.
+	Strategy string `protobuf:"opt"`
+	// Namespace is the namespace of the ByzCoinID.
+	Namespace string `protobuf:"opt"`
+}
+
+// EstimateDecryptReply is the estimation of a decryption by the node that
+// answered. It can change until the reader sends the request.
+type EstimateDecryptReply struct {
+	// Cost is the price of the read instance, paid by its spawner.
+	Cost byzcoin.Coin
+	// Refused is true if the policy of the write refuses all reads at the
+	// time of the latest block.
+	Refused bool
+	// Participants is the number of nodes asked for their share, including
+	// the node answering.
+	Participants int
+	// Threshold is the number of shares needed.
+	Threshold int
+	// Latency is the expected duration of the re-encryption in
+	// nanoseconds, or 0 if this node has no measurement yet.
+	Latency int64
+	// QueueDepth is the number of transactions waiting to be included in
+	// a block of the chain on this node, before the read instance.
+	QueueDepth int
+	// Decrypting is the number of decryptions currently done by this node.
+	Decrypting int
+	// Quota is the number of decryptions the reader can still ask for
+	// before being rate limited, or -1 if there is no limit.
+	Quota int
+}
+
+// AddTokenWrite asks a node of the chain to add the transaction of
+// AddWriteWithToken. The transaction must only spawn a write-instance whose
+// ID is derived from the "preID" argument.
+type AddTokenWrite struct {
+	Request byzcoin.AddTxRequest
+	// Namespace is the namespace of the ByzCoinID.
+	Namespace string `protobuf:"opt"`
+}
+
+// AddTokenWriteReply is the reply of the node to AddTokenWrite.
+type AddTokenWriteReply struct {
+	// Response is the reply of byzcoin to the transaction. For a duplicate,
+	// it only holds the proof of the existing write-instance, starting at
+	// the ProofFrom block of the request.
+	Response byzcoin.AddTxResponse
+	// WriteID is the ID of the write-instance of the token.
+	WriteID byzcoin.InstanceID
+	// Duplicate is true if the write-instance of the token already existed,
+	// in which case the transaction has not been added.
+	Duplicate bool
 }
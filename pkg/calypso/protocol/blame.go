@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// Every node signs its replies with its conode key. If the share of a reply
+// fails verification, the root keeps the signed reply as a Blame: anybody
+// knowing the public polynomial of the LTS can check that the node sent a
+// wrong share, and the root cannot blame a node for a share it didn't send.
+
+// Blame is the evidence that a node sent a wrong share.
+type Blame struct {
+	// Trustee is the node that signed the reply.
+	Trustee *network.ServerIdentity
+	// Request holds the points of the request, without its verification
+	// data.
+	Request Reencrypt
+	// Reply is the signed reply of the node.
+	Reply ReencryptReply
+}
+
+// Verify returns nil if the reply has been signed by the trustee and its
+// share doesn't match the public polynomial of the LTS.
+func (b *Blame) Verify(poly *share.PubPoly) error {
+	if b.Trustee == nil || b.Request.U == nil || b.Request.Xc == nil {
+		return xerrors.New("incomplete blame")
+	}
+	msg, err := replyMessage(&b.Request, &b.Reply)
+	if err != nil {
+		return err
+	}
+	err = schnorr.Verify(cothority.Suite, b.Trustee.Public, msg,
+		b.Reply.Signature)
+	if err != nil {
+		return xerrors.Errorf("verifying signature of trustee: %v", err)
+	}
+	err = VerifyReencryption(poly, b.Request.U, b.Request.Xc, b.Reply.Ui,
+		&ReencryptProof{Ei: b.Reply.Ei, Fi: b.Reply.Fi})
+	if err == nil {
+		return xerrors.New("the share is valid")
+	}
+	return nil
+}
+
+// replyMessage returns the message signed by a node for its reply to the
+// request.
+func replyMessage(rc *Reencrypt, r *ReencryptReply) ([]byte, error) {
+	if r.Ui == nil || r.Ui.V == nil || r.Ei == nil || r.Fi == nil {
+		return nil, xerrors.New("missing share or proof")
+	}
+	h := sha256.New()
+	h.Write([]byte("calypso-reencrypt-reply"))
+	for _, p := range []interface {
+		MarshalBinary() ([]byte, error)
+	}{rc.U, rc.Xc, r.Ui.V, r.Ei, r.Fi} {
+		buf, err := p.MarshalBinary()
+		if err != nil {
+			return nil, xerrors.Errorf("marshalling reply: %v", err)
+		}
+		h.Write(buf)
+	}
+	index := make([]byte, 8)
+	binary.LittleEndian.PutUint64(index, uint64(r.Ui.I))
+	h.Write(index)
+	return h.Sum(nil), nil
+}
+
+// signReply signs the reply to the request with the conode key of the node.
+func (o *OCS) signReply(rc *Reencrypt, r *ReencryptReply) {
+	msg, err := replyMessage(rc, r)
+	if err == nil {
+		r.Signature, err = schnorr.Sign(cothority.Suite, o.Private(), msg)
+	}
+	if err != nil {
+		log.Error(o.ServerIdentity(), "couldn't sign reply:", err)
+	}
+}
+
+// blame returns the evidence that the node sent a wrong share, or nil if
+// none of its wrong shares is signed.
+func (o *OCS) blame(si *network.ServerIdentity, rs []ReencryptReply) *Blame {
+	if len(rs) == 0 || len(rs)%len(o.requests) != 0 {
+		return nil
+	}
+	w := len(rs) / len(o.requests)
+	for k := range rs {
+		j := k / w
+		b := &Blame{
+			Trustee: si,
+			Request: Reencrypt{U: o.requests[j].U, Xc: o.requests[j].Xc},
+			Reply:   rs[k],
+		}
+		if b.Verify(o.Poly) == nil {
+			return b
+		}
+	}
+	return nil
+}
@@ -3,10 +3,17 @@ package protocol
 /*
 The onchain-protocol implements the key-reencryption described in Lefteris'
 paper-draft about onchain-secrets (called BlockMage).
+
+The tree can have any depth. An interior node passes the request on to its
+children, and sends its own shares together with the shares of its subtree
+to its parent, so that the root of a big roster doesn't have to talk to all
+nodes itself.
 */
 
 import (
 	"crypto/sha256"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +23,7 @@ import (
 	"go.dedis.ch/kyber/v3/share"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
 	"golang.org/x/xerrors"
 )
 
@@ -23,6 +31,22 @@ func init() {
 	onet.GlobalProtocolRegister(NameOCS, NewOCS)
 }
 
+// DefaultNodeTimeout is how long the root waits for the reply of a node
+// before asking it again.
+const DefaultNodeTimeout = 10 * time.Second
+
+// DefaultMaxRetries is how many times the root asks a node again before
+// considering it unresponsive.
+const DefaultMaxRetries = 2
+
+// DefaultTimeout is how long the root waits for enough shares before giving
+// up.
+const DefaultTimeout = time.Minute
+
+// MaxBatchSize is the maximum number of requests in a batch. Nodes refuse
+// bigger batches, so that a root cannot make them do unbounded work.
+const MaxBatchSize = 64
+
 // OCS is only used to re-encrypt a public point. Before calling `Start`,
 // DKG and U must be initialized by the caller.
 type OCS struct {
@@ -31,7 +55,7 @@ type OCS struct {
 	Poly      *share.PubPoly            // Represents all public keys
 	U         kyber.Point               // U is the encrypted secret
 	Xc        kyber.Point               // The client's public key
-	Threshold int                       // How many replies are needed to re-create the secret
+	Threshold int                       // How many shares are needed to re-create the secret
 	// VerificationData is given to the VerifyRequest and has to hold everything
 	// needed to verify the request is valid.
 	VerificationData []byte
@@ -39,14 +63,110 @@ type OCS struct {
 	// Can be set by the service to decide whether or not to
 	// do the reencryption
 	Verify VerifyRequest
+	// Check is used instead of Verify if it is set, so that the root learns
+	// why a node refused.
+	Check CheckRequest
 	// Reencrypted receives a 'true'-value when the protocol finished successfully,
 	// or 'false' if not enough shares have been collected.
 	Reencrypted chan bool
 	Uis         []*share.PubShare // re-encrypted shares
+	// Proofs holds the proof of correct re-encryption for each entry in
+	// Uis, so that they can be passed on to the client.
+	Proofs []*ReencryptProof
+	// Batch can be set instead of U, Xc and VerificationData to re-encrypt
+	// several secrets in one round. A node refuses the whole batch if it
+	// refuses one of the requests.
+	Batch []*Reencrypt
+	// BatchUis and BatchProofs hold the re-encrypted shares and their proofs
+	// for every request in Batch. For a single request, they hold Uis and
+	// Proofs as their only entry.
+	BatchUis    [][]*share.PubShare
+	BatchProofs [][]*ReencryptProof
+	// NodeTimeout is how long the root waits for a node before sending it
+	// the request again. A value of 0 disables the re-requests.
+	NodeTimeout time.Duration
+	// MaxRetries is how many times a node is asked again before it is
+	// marked as unresponsive.
+	MaxRetries int
+	// Timeout is how long the root waits for enough shares before it marks
+	// the nodes that didn't reply as unresponsive and gives up.
+	Timeout time.Duration
+	// Report is filled in by the root before Reencrypted receives its
+	// value and names the nodes that didn't contribute a valid share.
+	Report FailureReport
+	// Blames holds the evidence against the nodes in Report.Invalid that
+	// signed their wrong share.
+	Blames []Blame
+	// TraceID, if set, is logged with every phase of the protocol.
+	TraceID string
+	// Shares is the number of shares of the LTS. It must be set if the
+	// tree holds only some of the nodes of the LTS, else the shares of the
+	// nodes of the tree are counted.
+	Shares int
+	// Weights is the number of shares of the nodes holding more than one
+	// share of the LTS. It is only used by the root, to count the shares
+	// of the replies against the Threshold.
+	Weights map[network.ServerIdentityID]int
 	// private fields
-	replies  []ReencryptReply
+	replies  [][]ReencryptReply
+	repliers []*network.ServerIdentity
 	timeout  *time.Timer
+	retry    *time.Timer
+	requests []*Reencrypt
+	rc       interface{}
+	pending  map[network.ServerIdentityID]int
 	doneOnce sync.Once
+	mut      sync.Mutex
+	started  time.Time
+	// replyTimes is how long every node took to reply.
+	replyTimes map[network.ServerIdentityID]time.Duration
+	finished   bool
+	// collected is the number of shares sent by the nodes that replied.
+	collected int
+	// The shares of the subtree collected by an interior node, and the
+	// children it is still waiting for.
+	subtree     []SubtreeShare
+	waiting     map[network.ServerIdentityID]bool
+	forwarded   bool
+	subtreeSent bool
+	collect     *time.Timer
+}
+
+// FailureReport lists the nodes that didn't contribute to a re-encryption.
+type FailureReport struct {
+	// Unresponsive nodes didn't reply, even after being asked again.
+	Unresponsive []*network.ServerIdentity
+	// Refused nodes replied, but refused to re-encrypt.
+	Refused []*network.ServerIdentity
+	// Invalid nodes replied with a share that failed verification.
+	Invalid []*network.ServerIdentity
+	// BadWrite nodes refused because the point to re-encrypt doesn't
+	// match a correct write.
+	BadWrite []*network.ServerIdentity
+}
+
+// Empty returns true if no node failed.
+func (fr FailureReport) Empty() bool {
+	return len(fr.Unresponsive)+len(fr.Refused)+len(fr.Invalid)+
+		len(fr.BadWrite) == 0
+}
+
+// String returns a human readable list of the failed nodes.
+func (fr FailureReport) String() string {
+	var out []string
+	for _, l := range []struct {
+		name  string
+		nodes []*network.ServerIdentity
+	}{{"unresponsive", fr.Unresponsive}, {"refused", fr.Refused},
+		{"invalid", fr.Invalid}, {"bad write", fr.BadWrite}} {
+		if len(l.nodes) > 0 {
+			out = append(out, fmt.Sprintf("%s: %v", l.name, l.nodes))
+		}
+	}
+	if len(out) == 0 {
+		return "no failures"
+	}
+	return strings.Join(out, "; ")
 }
 
 // NewOCS initialises the structure for use in one round
@@ -55,9 +175,15 @@ func NewOCS(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		TreeNodeInstance: n,
 		Reencrypted:      make(chan bool, 1),
 		Threshold:        len(n.Roster().List) - (len(n.Roster().List)-1)/3,
+		NodeTimeout:      DefaultNodeTimeout,
+		MaxRetries:       DefaultMaxRetries,
+		Timeout:          DefaultTimeout,
+		pending:          make(map[network.ServerIdentityID]int),
+		replyTimes:       make(map[network.ServerIdentityID]time.Duration),
 	}
 
-	err := o.RegisterHandlers(o.reencrypt, o.reencryptReply)
+	err := o.RegisterHandlers(o.reencrypt, o.reencryptReply,
+		o.reencryptBatch, o.reencryptBatchReply, o.reencryptSubtreeReply)
 	if err != nil {
 		return nil, xerrors.Errorf("registring handlers: %v", err)
 	}
@@ -67,32 +193,65 @@ func NewOCS(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 // Start asks all children to reply with a shared reencryption
 func (o *OCS) Start() error {
 	log.Lvl3("Starting Protocol")
+	cothority.LogTrace(o.TraceID, o.ServerIdentity(), "ocs_start", nil)
 	if o.Shared == nil {
 		o.finish(false)
 		return xerrors.New("please initialize Shared first")
 	}
-	if o.U == nil {
+	requests := o.Batch
+	if len(requests) > MaxBatchSize {
 		o.finish(false)
-		return xerrors.New("please initialize U first")
-	}
-	rc := &Reencrypt{
-		U:  o.U,
-		Xc: o.Xc,
+		return xerrors.Errorf("batch bigger than %d requests", MaxBatchSize)
 	}
-	if len(o.VerificationData) > 0 {
-		rc.VerificationData = &o.VerificationData
+	var msg interface{}
+	if len(requests) > 0 {
+		batch := &ReencryptBatch{}
+		for _, rc := range requests {
+			batch.Requests = append(batch.Requests, *rc)
+		}
+		msg = batch
+	} else {
+		if o.U == nil {
+			o.finish(false)
+			return xerrors.New("please initialize U first")
+		}
+		rc := &Reencrypt{
+			U:  o.U,
+			Xc: o.Xc,
+		}
+		if len(o.VerificationData) > 0 {
+			rc.VerificationData = &o.VerificationData
+		}
+		requests = []*Reencrypt{rc}
+		msg = rc
 	}
-	if o.Verify != nil {
-		if !o.Verify(rc) {
+	for _, rc := range requests {
+		if o.refusal(rc) != 0 {
 			o.finish(false)
 			return xerrors.New("refused to reencrypt")
 		}
 	}
-	o.timeout = time.AfterFunc(1*time.Minute, func() {
+	o.mut.Lock()
+	o.requests = requests
+	o.rc = msg
+	o.started = time.Now()
+	for _, tn := range o.List() {
+		if !tn.IsRoot() {
+			o.pending[tn.ServerIdentity.ID] = 0
+		}
+	}
+	o.mut.Unlock()
+	o.timeout = time.AfterFunc(o.Timeout, func() {
 		log.Lvl1("OCS protocol timeout")
+		o.mut.Lock()
+		o.markUnresponsive()
+		o.mut.Unlock()
 		o.finish(false)
 	})
-	errs := o.Broadcast(rc)
+	if o.NodeTimeout > 0 {
+		o.retry = time.AfterFunc(o.NodeTimeout, o.reRequest)
+	}
+	errs := o.Broadcast(msg)
 	if len(errs) > (len(o.Roster().List)-1)/3 {
 		log.Errorf("Some nodes failed with error(s) %v", errs)
 		return xerrors.New("too many nodes failed in broadcast")
@@ -100,82 +259,453 @@ func (o *OCS) Start() error {
 	return nil
 }
 
+// reRequest sends the request again to all children that didn't reply yet.
+// Children that have been asked MaxRetries times, plus once per level of
+// their subtree, are marked as unresponsive together with the nodes of their
+// subtree that didn't reply. If not enough nodes are left to reach the
+// threshold, the protocol fails.
+func (o *OCS) reRequest() {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if len(o.pending) == 0 {
+		return
+	}
+	var unresponsive []network.ServerIdentityID
+	for _, c := range o.Children() {
+		retries, ok := o.pending[c.ServerIdentity.ID]
+		if !ok {
+			continue
+		}
+		if retries >= o.MaxRetries+height(c) {
+			for _, tn := range subtreeNodes(c) {
+				if _, ok := o.pending[tn.ServerIdentity.ID]; ok {
+					unresponsive = append(unresponsive, tn.ServerIdentity.ID)
+					o.Report.Unresponsive = append(o.Report.Unresponsive,
+						tn.ServerIdentity)
+				}
+			}
+			continue
+		}
+		log.Lvl2(o.ServerIdentity(), "asking again", c.ServerIdentity)
+		o.pending[c.ServerIdentity.ID] = retries + 1
+		if err := o.SendTo(c, o.rc); err != nil {
+			log.Lvl2("couldn't send request again:", err)
+		}
+	}
+	for _, id := range unresponsive {
+		delete(o.pending, id)
+	}
+	if o.failed() {
+		log.Lvl2(o.ServerIdentity(), "couldn't get enough shares:", o.Report)
+		go o.finish(false)
+		return
+	}
+	if len(o.pending) > 0 {
+		o.retry = time.AfterFunc(o.NodeTimeout, o.reRequest)
+	}
+}
+
+// failed returns true if the nodes that failed hold too many shares to
+// reach the threshold. It must be called with o.mut held.
+func (o *OCS) failed() bool {
+	failures := 0
+	for _, l := range [][]*network.ServerIdentity{o.Report.Unresponsive,
+		o.Report.Refused, o.Report.Invalid, o.Report.BadWrite} {
+		for _, si := range l {
+			failures += o.weight(si)
+		}
+	}
+	total := 0
+	for _, si := range o.Roster().List {
+		total += o.weight(si)
+	}
+	return failures > total-o.Threshold
+}
+
+// weight returns the number of shares of the node.
+func (o *OCS) weight(si *network.ServerIdentity) int {
+	if w, ok := o.Weights[si.ID]; ok {
+		return w
+	}
+	return 1
+}
+
+// markUnresponsive adds all nodes still pending to the report. It must be
+// called with o.mut held.
+func (o *OCS) markUnresponsive() {
+	for _, tn := range o.List() {
+		if _, ok := o.pending[tn.ServerIdentity.ID]; ok {
+			o.Report.Unresponsive = append(o.Report.Unresponsive, tn.ServerIdentity)
+			delete(o.pending, tn.ServerIdentity.ID)
+		}
+	}
+}
+
 // Reencrypt is received by every node to give his part of
 // the share
 func (o *OCS) reencrypt(r structReencrypt) error {
 	log.Lvl3(o.Name() + ": starting reencrypt")
+	requests := []Reencrypt{r.Reencrypt}
+	if !o.IsLeaf() {
+		return o.forward(&r.Reencrypt, requests)
+	}
+	defer o.Done()
+
+	replies, refusal := o.shareReplies(requests)
+	if len(replies) == 0 {
+		return cothority.ErrorOrNil(
+			o.SendToParent(&ReencryptReply{Refusal: refusal}),
+			"sending ReencryptReply to parent")
+	}
+	if len(replies) > 1 {
+		// A node holding several shares sends them like for a batch.
+		return cothority.ErrorOrNil(
+			o.SendToParent(&ReencryptBatchReply{Replies: replies}),
+			"sending ReencryptBatchReply to parent")
+	}
+	return cothority.ErrorOrNil(
+		o.SendToParent(&replies[0]),
+		"sending ReencryptReply to parent",
+	)
+}
+
+// reencryptBatch is received by every node to give its part of the share
+// for all requests of the batch.
+func (o *OCS) reencryptBatch(r structReencryptBatch) error {
+	log.Lvl3(o.Name() + ": starting batch reencrypt")
+	if len(r.Requests) > MaxBatchSize {
+		defer o.Done()
+		log.Lvl2(o.ServerIdentity(), "refused batch of", len(r.Requests),
+			"requests")
+		return cothority.ErrorOrNil(o.SendToParent(
+			&ReencryptBatchReply{Refusal: RefusedDenied}),
+			"sending ReencryptBatchReply to parent")
+	}
+	if !o.IsLeaf() {
+		return o.forward(&r.ReencryptBatch, r.Requests)
+	}
 	defer o.Done()
 
-	ui := o.getUI(r.U, r.Xc)
+	reply := &ReencryptBatchReply{}
+	reply.Replies, reply.Refusal = o.shareReplies(r.Requests)
+	return cothority.ErrorOrNil(o.SendToParent(reply),
+		"sending ReencryptBatchReply to parent")
+}
 
-	if o.Verify != nil {
-		if !o.Verify(&r.Reencrypt) {
+// shareReplies returns the shares of this node for all requests, all shares
+// of the first request first, or nil and the reason if it refuses one of
+// them.
+func (o *OCS) shareReplies(requests []Reencrypt) ([]ReencryptReply, Refusal) {
+	var replies []ReencryptReply
+	for i := range requests {
+		if !requests[i].complete() {
+			log.Lvl2(o.ServerIdentity(), "got an incomplete request")
+			return nil, RefusedBadWrite
+		}
+		if refusal := o.refusal(&requests[i]); refusal != 0 {
 			log.Lvl2(o.ServerIdentity(), "refused to reencrypt")
-			return cothority.ErrorOrNil(o.SendToParent(&ReencryptReply{}),
-				"sending ReencryptReply to parent")
+			cothority.LogTrace(o.TraceID, o.ServerIdentity(), "ocs_reencrypt",
+				xerrors.New("refused"))
+			return nil, refusal
 		}
+		replies = append(replies, o.getReplies(&requests[i])...)
 	}
+	cothority.LogTrace(o.TraceID, o.ServerIdentity(), "ocs_reencrypt", nil)
+	return replies, 0
+}
 
-	// Calculating proofs
-	si := cothority.Suite.Scalar().Pick(o.Suite().RandomStream())
-	uiHat := cothority.Suite.Point().Mul(si, cothority.Suite.Point().Add(r.U, r.Xc))
-	hiHat := cothority.Suite.Point().Mul(si, nil)
-	hash := sha256.New()
-	ui.V.MarshalTo(hash)
-	uiHat.MarshalTo(hash)
-	hiHat.MarshalTo(hash)
-	ei := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
+// refusal returns why the node refuses the request, or 0 if it allows it.
+func (o *OCS) refusal(rc *Reencrypt) Refusal {
+	if o.Check != nil {
+		return o.Check(rc)
+	}
+	if o.Verify != nil && !o.Verify(rc) {
+		return RefusedDenied
+	}
+	return 0
+}
 
-	return cothority.ErrorOrNil(
-		o.SendToParent(&ReencryptReply{
+// forward is called on an interior node of the tree. It passes the request
+// on to the children and adds its own shares to the shares of the subtree,
+// which are sent to the parent once all children replied, or once the
+// children had the time to collect the shares of their own subtrees. A
+// request sent again by the parent is ignored.
+func (o *OCS) forward(msg interface{}, requests []Reencrypt) error {
+	o.mut.Lock()
+	if o.forwarded {
+		o.mut.Unlock()
+		return nil
+	}
+	o.forwarded = true
+	o.mut.Unlock()
+
+	own := SubtreeShare{Index: o.TreeNode().RosterIndex}
+	own.Replies, own.Refusal = o.shareReplies(requests)
+	o.mut.Lock()
+	o.subtree = []SubtreeShare{own}
+	o.waiting = make(map[network.ServerIdentityID]bool)
+	for _, c := range o.Children() {
+		o.waiting[c.ServerIdentity.ID] = true
+	}
+	o.collect = time.AfterFunc(o.subtreeTimeout(), o.sendSubtree)
+	o.mut.Unlock()
+
+	if errs := o.SendToChildrenInParallel(msg); len(errs) > 0 {
+		log.Lvl2(o.ServerIdentity(), "couldn't forward request:", errs)
+	}
+	return nil
+}
+
+// subtreeTimeout is how long an interior node waits for its children: one
+// NodeTimeout per level of its subtree.
+func (o *OCS) subtreeTimeout() time.Duration {
+	timeout := o.NodeTimeout
+	if timeout == 0 {
+		timeout = DefaultNodeTimeout
+	}
+	return timeout * time.Duration(height(o.TreeNode()))
+}
+
+// collectSubtree adds the shares sent by a child of an interior node. Shares
+// of nodes outside of the subtree of the child are dropped.
+func (o *OCS) collectSubtree(child *onet.TreeNode, shares []SubtreeShare) error {
+	o.mut.Lock()
+	if !o.waiting[child.ServerIdentity.ID] {
+		o.mut.Unlock()
+		return nil
+	}
+	delete(o.waiting, child.ServerIdentity.ID)
+	for _, sh := range shares {
+		if inSubtree(child, sh.Index) {
+			o.subtree = append(o.subtree, sh)
+		}
+	}
+	done := len(o.waiting) == 0
+	o.mut.Unlock()
+	if done {
+		o.sendSubtree()
+	}
+	return nil
+}
+
+// sendSubtree sends the shares of the subtree to the parent. The nodes of
+// the children that didn't reply are marked as unresponsive.
+func (o *OCS) sendSubtree() {
+	o.mut.Lock()
+	if o.subtreeSent {
+		o.mut.Unlock()
+		return
+	}
+	o.subtreeSent = true
+	if o.collect != nil {
+		o.collect.Stop()
+	}
+	for _, c := range o.Children() {
+		if !o.waiting[c.ServerIdentity.ID] {
+			continue
+		}
+		for _, tn := range subtreeNodes(c) {
+			o.subtree = append(o.subtree, SubtreeShare{Index: tn.RosterIndex,
+				Unresponsive: true})
+		}
+	}
+	reply := &ReencryptSubtreeReply{Shares: o.subtree}
+	o.mut.Unlock()
+	if err := o.SendToParent(reply); err != nil {
+		log.Lvl2(o.ServerIdentity(), "couldn't send shares of subtree:", err)
+	}
+	o.Done()
+}
+
+// subtreeNodes returns tn and all nodes below it.
+func subtreeNodes(tn *onet.TreeNode) []*onet.TreeNode {
+	nodes := []*onet.TreeNode{tn}
+	for _, c := range tn.Children {
+		nodes = append(nodes, subtreeNodes(c)...)
+	}
+	return nodes
+}
+
+// inSubtree returns true if the node with the given roster index is tn or
+// below it.
+func inSubtree(tn *onet.TreeNode, index int) bool {
+	for _, n := range subtreeNodes(tn) {
+		if n.RosterIndex == index {
+			return true
+		}
+	}
+	return false
+}
+
+// height returns the number of levels below tn, 0 for a leaf.
+func height(tn *onet.TreeNode) int {
+	h := 0
+	for _, c := range tn.Children {
+		if ch := height(c) + 1; ch > h {
+			h = ch
+		}
+	}
+	return h
+}
+
+// ReplyTimes returns how long every node that replied took to do so,
+// measured from the start of the protocol.
+func (o *OCS) ReplyTimes() map[network.ServerIdentityID]time.Duration {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	times := make(map[network.ServerIdentityID]time.Duration)
+	for id, d := range o.replyTimes {
+		times[id] = d
+	}
+	return times
+}
+
+// shares returns the number of shares of the LTS.
+func (o *OCS) shares() int {
+	if o.Shares > 0 {
+		return o.Shares
+	}
+	shares := 0
+	for _, tn := range o.List() {
+		shares += o.weight(tn.ServerIdentity)
+	}
+	return shares
+}
+
+// complete returns true if the request holds the points needed to
+// re-encrypt. The root can send anything, so they must be checked before
+// use.
+func (rc *Reencrypt) complete() bool {
+	return rc.U != nil && rc.Xc != nil
+}
+
+// getReplies returns every share of this node and the proof of its
+// correctness.
+func (o *OCS) getReplies(rc *Reencrypt) []ReencryptReply {
+	var replies []ReencryptReply
+	for _, priv := range o.Shared.Shares() {
+		ui := reencryptShare(priv, rc.U, rc.Xc)
+		proof := reencryptionProof(priv, ui, rc.U, rc.Xc)
+		reply := ReencryptReply{
 			Ui: ui,
-			Ei: ei,
-			Fi: cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, o.Shared.V)),
-		}),
-		"sending ReencryptReply to parent",
-	)
+			Ei: proof.Ei,
+			Fi: proof.Fi,
+		}
+		o.signReply(rc, &reply)
+		replies = append(replies, reply)
+	}
+	return replies
 }
 
 // reencryptReply is the root-node waiting for all replies and generating
 // the reencryption key.
 func (o *OCS) reencryptReply(rr structReencryptReply) error {
-	if rr.ReencryptReply.Ui == nil {
-		log.Lvl2("Node", rr.ServerIdentity, "refused to reply")
+	var replies []ReencryptReply
+	if rr.ReencryptReply.Ui != nil {
+		replies = []ReencryptReply{rr.ReencryptReply}
+	}
+	if !o.IsRoot() {
+		return o.collectSubtree(rr.TreeNode, []SubtreeShare{{
+			Index: rr.TreeNode.RosterIndex, Replies: replies,
+			Refusal: rr.Refusal}})
+	}
+	return o.handleReplies(rr.ServerIdentity, replies, rr.Refusal)
+}
+
+// reencryptBatchReply is the root-node waiting for all replies to a batch.
+func (o *OCS) reencryptBatchReply(rr structReencryptBatchReply) error {
+	if !o.IsRoot() {
+		return o.collectSubtree(rr.TreeNode, []SubtreeShare{{
+			Index: rr.TreeNode.RosterIndex, Replies: rr.Replies,
+			Refusal: rr.Refusal}})
+	}
+	return o.handleReplies(rr.ServerIdentity, rr.Replies, rr.Refusal)
+}
+
+// reencryptSubtreeReply handles the shares of the subtree of a child, which
+// are passed on by an interior node, or handled one node after the other by
+// the root.
+func (o *OCS) reencryptSubtreeReply(rr structReencryptSubtreeReply) error {
+	if !o.IsRoot() {
+		return o.collectSubtree(rr.TreeNode, rr.Shares)
+	}
+	for _, sh := range rr.Shares {
+		if !inSubtree(rr.TreeNode, sh.Index) {
+			continue
+		}
+		si := o.Roster().List[sh.Index]
+		if sh.Unresponsive {
+			o.handleUnresponsive(si)
+			continue
+		}
+		if err := o.handleReplies(si, sh.Replies, sh.Refusal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUnresponsive marks a node of a subtree that didn't reply in time.
+func (o *OCS) handleUnresponsive(si *network.ServerIdentity) {
+	o.mut.Lock()
+	if _, ok := o.pending[si.ID]; !ok {
+		o.mut.Unlock()
+		return
+	}
+	delete(o.pending, si.ID)
+	o.Report.Unresponsive = append(o.Report.Unresponsive, si)
+	failed := o.failed()
+	o.mut.Unlock()
+	if failed {
+		log.Lvl2(si, "couldn't get enough shares")
+		o.finish(false)
+	}
+}
+
+// handleReplies stores the shares of one node and generates the
+// reencryption keys once enough nodes replied. An empty list of replies
+// means that the node refused to reencrypt, for the given reason.
+func (o *OCS) handleReplies(si *network.ServerIdentity, replies []ReencryptReply,
+	refusal Refusal) error {
+	o.mut.Lock()
+	if _, ok := o.pending[si.ID]; !ok || o.finished {
+		// Either a duplicate reply to a re-request, a node that has
+		// already been marked as unresponsive, or a reply after the end
+		// of the protocol.
+		o.mut.Unlock()
+		log.Lvl2("Ignoring late or duplicate reply from", si)
+		return nil
+	}
+	delete(o.pending, si.ID)
+	o.replyTimes[si.ID] = time.Since(o.started)
+	cothority.LogTrace(o.TraceID, si, "ocs_reply", nil)
+	if len(replies) == 0 {
+		log.Lvl2("Node", si, "refused to reply")
 		o.Failures++
-		if o.Failures > len(o.Roster().List)-o.Threshold {
-			log.Lvl2(rr.ServerIdentity, "couldn't get enough shares")
+		if refusal == RefusedBadWrite {
+			o.Report.BadWrite = append(o.Report.BadWrite, si)
+		} else {
+			o.Report.Refused = append(o.Report.Refused, si)
+		}
+		failed := o.failed()
+		o.mut.Unlock()
+		if failed {
+			log.Lvl2(si, "couldn't get enough shares")
 			o.finish(false)
 		}
 		return nil
 	}
-	o.replies = append(o.replies, rr.ReencryptReply)
-
-	// minus one to exclude the root
-	if len(o.replies) >= int(o.Threshold-1) {
-		o.Uis = make([]*share.PubShare, len(o.List()))
-		o.Uis[0] = o.getUI(o.U, o.Xc)
-
-		for _, r := range o.replies {
-			// Verify proofs
-			ufi := cothority.Suite.Point().Mul(r.Fi, cothority.Suite.Point().Add(o.U, o.Xc))
-			uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), r.Ui.V)
-			uiHat := cothority.Suite.Point().Add(ufi, uiei)
-
-			gfi := cothority.Suite.Point().Mul(r.Fi, nil)
-			gxi := o.Poly.Eval(r.Ui.I).V
-			hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), gxi)
-			hiHat := cothority.Suite.Point().Add(gfi, hiei)
-			hash := sha256.New()
-			r.Ui.V.MarshalTo(hash)
-			uiHat.MarshalTo(hash)
-			hiHat.MarshalTo(hash)
-			e := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
-			if e.Equal(r.Ei) {
-				o.Uis[r.Ui.I] = r.Ui
-			} else {
-				log.Lvl1("Received invalid share from node", r.Ui.I)
-			}
-		}
+	o.replies = append(o.replies, replies)
+	o.repliers = append(o.repliers, si)
+	o.collected += o.weight(si)
+
+	// the root adds its own shares
+	enough := o.collected+len(o.Shared.Shares()) >= o.Threshold
+	if enough {
+		o.collectShares()
+	}
+	o.mut.Unlock()
+	if enough {
 		o.finish(true)
 	}
 
@@ -189,20 +719,170 @@ func (o *OCS) reencryptReply(rr structReencryptReply) error {
 	return nil
 }
 
-func (o *OCS) getUI(U, Xc kyber.Point) *share.PubShare {
-	v := cothority.Suite.Point().Mul(o.Shared.V, U)
-	v.Add(v, cothority.Suite.Point().Mul(o.Shared.V, Xc))
+// collectShares fills in BatchUis and BatchProofs with the shares of the
+// root and the valid shares of the nodes that replied. Nodes with invalid
+// shares are added to the report. It must be called with o.mut held.
+func (o *OCS) collectShares() {
+	o.BatchUis = make([][]*share.PubShare, len(o.requests))
+	o.BatchProofs = make([][]*ReencryptProof, len(o.requests))
+	for j, rc := range o.requests {
+		o.BatchUis[j] = make([]*share.PubShare, o.shares())
+		o.BatchProofs[j] = make([]*ReencryptProof, o.shares())
+		for _, reply := range o.getReplies(rc) {
+			o.BatchUis[j][reply.Ui.I] = reply.Ui
+			o.BatchProofs[j][reply.Ui.I] = &ReencryptProof{Ei: reply.Ei,
+				Fi: reply.Fi}
+		}
+	}
+
+	for i, rs := range o.replies {
+		if err := o.verifyReplies(o.repliers[i], rs); err != nil {
+			log.Lvl1("Received invalid share from node", o.repliers[i],
+				":", err)
+			o.Report.Invalid = appendNode(o.Report.Invalid, o.repliers[i])
+			if b := o.blame(o.repliers[i], rs); b != nil {
+				o.Blames = append(o.Blames, *b)
+			}
+			continue
+		}
+		w := len(rs) / len(o.requests)
+		for k, r := range rs {
+			o.BatchUis[k/w][r.Ui.I] = r.Ui
+			o.BatchProofs[k/w][r.Ui.I] = &ReencryptProof{Ei: r.Ei, Fi: r.Fi}
+		}
+	}
+	if len(o.Batch) == 0 {
+		o.Uis = o.BatchUis[0]
+		o.Proofs = o.BatchProofs[0]
+	}
+}
+
+// PartialShares returns the valid shares and their proofs collected by the
+// root, for every request. It can be used once Reencrypted received false,
+// to get the shares of the nodes that replied in time.
+func (o *OCS) PartialShares() ([][]*share.PubShare, [][]*ReencryptProof) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.BatchUis == nil && len(o.requests) > 0 {
+		o.collectShares()
+	}
+	return o.BatchUis, o.BatchProofs
+}
+
+// verifyReplies checks that the node sent one correct share for every
+// request and every share it holds, with the same indexes for all requests.
+func (o *OCS) verifyReplies(si *network.ServerIdentity, rs []ReencryptReply) error {
+	w := o.weight(si)
+	if len(rs) != len(o.requests)*w {
+		return xerrors.Errorf("got %d shares for %d requests", len(rs),
+			len(o.requests))
+	}
+	seen := make(map[int]bool)
+	for k, r := range rs {
+		j := k / w
+		proof := &ReencryptProof{Ei: r.Ei, Fi: r.Fi}
+		err := VerifyReencryption(o.Poly, o.requests[j].U, o.requests[j].Xc,
+			r.Ui, proof)
+		if err != nil {
+			return xerrors.Errorf("request %d: %v", j, err)
+		}
+		if r.Ui.I != rs[k%w].Ui.I || r.Ui.I < 0 || r.Ui.I >= o.shares() {
+			return xerrors.Errorf("wrong index %d", r.Ui.I)
+		}
+		if j == 0 {
+			if seen[r.Ui.I] {
+				return xerrors.Errorf("got share %d twice", r.Ui.I)
+			}
+			seen[r.Ui.I] = true
+		}
+	}
+	return nil
+}
+
+// appendNode adds the node to the list if it's not already in there.
+func appendNode(list []*network.ServerIdentity, si *network.ServerIdentity) []*network.ServerIdentity {
+	for _, n := range list {
+		if n.Equal(si) {
+			return list
+		}
+	}
+	return append(list, si)
+}
+
+// reencryptShare returns the share of U re-encrypted to Xc.
+func reencryptShare(priv *share.PriShare, U, Xc kyber.Point) *share.PubShare {
+	v := cothority.Suite.Point().Mul(priv.V, U)
+	v.Add(v, cothority.Suite.Point().Mul(priv.V, Xc))
 	return &share.PubShare{
-		I: o.Shared.Index,
+		I: priv.I,
 		V: v,
 	}
 }
 
+// reencryptionProof returns the proof that ui has been calculated using
+// the private share priv.
+func reencryptionProof(priv *share.PriShare, ui *share.PubShare, U, Xc kyber.Point) *ReencryptProof {
+	si := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	uiHat := cothority.Suite.Point().Mul(si, cothority.Suite.Point().Add(U, Xc))
+	hiHat := cothority.Suite.Point().Mul(si, nil)
+	ei := proofChallenge(ui.V, uiHat, hiHat)
+	return &ReencryptProof{
+		Ei: ei,
+		Fi: cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, priv.V)),
+	}
+}
+
+// VerifyReencryption checks that the share ui has been correctly
+// re-encrypted from U to Xc by the node holding the private share committed
+// to in poly. It can be used by the client to make sure that no node sent a
+// wrong share.
+func VerifyReencryption(poly *share.PubPoly, U, Xc kyber.Point,
+	ui *share.PubShare, proof *ReencryptProof) error {
+	if ui == nil || ui.V == nil || proof == nil || proof.Ei == nil ||
+		proof.Fi == nil {
+		return xerrors.New("missing share or proof")
+	}
+	ufi := cothority.Suite.Point().Mul(proof.Fi, cothority.Suite.Point().Add(U, Xc))
+	uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(proof.Ei), ui.V)
+	uiHat := cothority.Suite.Point().Add(ufi, uiei)
+
+	gfi := cothority.Suite.Point().Mul(proof.Fi, nil)
+	gxi := poly.Eval(ui.I).V
+	hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(proof.Ei), gxi)
+	hiHat := cothority.Suite.Point().Add(gfi, hiei)
+	if !proofChallenge(ui.V, uiHat, hiHat).Equal(proof.Ei) {
+		return xerrors.Errorf("invalid proof for share %d", ui.I)
+	}
+	return nil
+}
+
+func proofChallenge(ui, uiHat, hiHat kyber.Point) kyber.Scalar {
+	hash := sha256.New()
+	ui.MarshalTo(hash)
+	uiHat.MarshalTo(hash)
+	hiHat.MarshalTo(hash)
+	return cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
+}
+
 func (o *OCS) finish(result bool) {
-	o.timeout.Stop()
+	if o.timeout != nil {
+		o.timeout.Stop()
+	}
+	o.mut.Lock()
+	if o.retry != nil {
+		o.retry.Stop()
+	}
+	o.finished = true
+	report := o.Report.String()
+	o.mut.Unlock()
 	select {
 	case o.Reencrypted <- result:
 		// suceeded
+		var err error
+		if !result {
+			err = xerrors.New(report)
+		}
+		cothority.LogTrace(o.TraceID, o.ServerIdentity(), "ocs_finished", err)
 	default:
 		// would have blocked because some other call to finish()
 		// beat us.
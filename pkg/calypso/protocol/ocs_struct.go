@@ -15,7 +15,8 @@ import (
 const NameOCS = "OCS"
 
 func init() {
-	network.RegisterMessages(&Reencrypt{}, &ReencryptReply{})
+	network.RegisterMessages(&Reencrypt{}, &ReencryptReply{},
+		&ReencryptBatch{}, &ReencryptBatchReply{}, &ReencryptSubtreeReply{})
 }
 
 // VerifyRequest is a callback-function that can be set by a service.
@@ -24,6 +25,21 @@ func init() {
 // allow reencryption.
 type VerifyRequest func(rc *Reencrypt) bool
 
+// Refusal tells the root why a node refused to re-encrypt.
+type Refusal int
+
+const (
+	// RefusedDenied is sent if the node doesn't allow the request.
+	RefusedDenied Refusal = iota + 1
+	// RefusedBadWrite is sent if the point to re-encrypt doesn't match a
+	// correct write, so the data of the writer or the client is wrong.
+	RefusedBadWrite
+)
+
+// CheckRequest can be set by a service instead of VerifyRequest. It returns
+// why the node refuses the request, or 0 if it allows it.
+type CheckRequest func(rc *Reencrypt) Refusal
+
 // Reencrypt asks for a re-encryption share from a node
 type Reencrypt struct {
 	// U is the point from the write-request
@@ -45,9 +61,74 @@ type ReencryptReply struct {
 	Ui *share.PubShare
 	Ei kyber.Scalar
 	Fi kyber.Scalar
+	// Refusal is set if the node refused to re-encrypt.
+	Refusal Refusal `protobuf:"opt"`
+	// Signature is the schnorr signature of the node on the reply and the
+	// points of the request, using its conode key.
+	Signature []byte `protobuf:"opt"`
+}
+
+// ReencryptProof is the discrete-log-equality proof of a node that its share
+// Ui has been computed using the same private share that is committed to in
+// the public polynomial of the LTS.
+type ReencryptProof struct {
+	Ei kyber.Scalar
+	Fi kyber.Scalar
 }
 
 type structReencryptReply struct {
 	*onet.TreeNode
 	ReencryptReply
 }
+
+// ReencryptBatch asks for the re-encryption shares of several requests in
+// one round.
+type ReencryptBatch struct {
+	Requests []Reencrypt
+}
+
+type structReencryptBatch struct {
+	*onet.TreeNode
+	ReencryptBatch
+}
+
+// ReencryptBatchReply returns the shares of the node for every request of a
+// ReencryptBatch, all shares of the first request first. A node holding
+// several shares also sends them in a ReencryptBatchReply for a single
+// Reencrypt. If the node refuses any of the requests, Replies is empty.
+type ReencryptBatchReply struct {
+	Replies []ReencryptReply
+	// Refusal is set if the node refused the batch.
+	Refusal Refusal `protobuf:"opt"`
+}
+
+type structReencryptBatchReply struct {
+	*onet.TreeNode
+	ReencryptBatchReply
+}
+
+// SubtreeShare is the reply of one node, passed on to the root by the
+// interior nodes of the tree.
+type SubtreeShare struct {
+	// Index is the index of the node in the roster of the tree.
+	Index int
+	// Replies holds the shares of the node for every request, or nothing
+	// if the node refused.
+	Replies []ReencryptReply
+	// Unresponsive is true if the node didn't reply in time.
+	Unresponsive bool
+	// Refusal is set if the node refused.
+	Refusal Refusal `protobuf:"opt"`
+}
+
+// ReencryptSubtreeReply is sent by an interior node of the tree with its own
+// shares and the shares of its subtree, so that every node only gets replies
+// from its children.
+type ReencryptSubtreeReply struct {
+	Shares []SubtreeShare
+}
+
+type structReencryptSubtreeReply struct {
+	*onet.TreeNode
+	ReencryptSubtreeReply
+}
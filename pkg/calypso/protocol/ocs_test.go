@@ -4,17 +4,19 @@ import (
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/require"
 	"github.com/calypso-demo/filesharing/pkg/protocols"
 	dkgprotocol "github.com/calypso-demo/filesharing/pkg/protocols/dkg/pedersen"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/share"
 	dkg "go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/kyber/v3/util/random"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
 	"golang.org/x/xerrors"
 )
 
@@ -52,6 +54,134 @@ func TestRefuse(t *testing.T) {
 	ocs(t, 3, 2, 32, 0, true)
 }
 
+// Tests that the root asks unresponsive nodes again and reports them if
+// they never reply.
+func TestUnresponsive(t *testing.T) {
+	nbrNodes := 4
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, nbrNodes)
+	require.NoError(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, _, err = dkgprotocol.NewSharedSecret(dkgs[i])
+		require.NoError(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.NoError(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("key"))
+
+	paused := servers[nbrNodes-1]
+	paused.Pause()
+	pi, err := services[0].(*testService).createOCS(tree, nbrNodes)
+	require.NoError(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = key.NewKeyPair(cothority.Suite).Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.NodeTimeout = 100 * time.Millisecond
+	protocol.MaxRetries = 1
+	require.NoError(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	require.Equal(t, 1, len(protocol.Report.Unresponsive))
+	require.True(t, protocol.Report.Unresponsive[0].Equal(paused.ServerIdentity))
+	require.Contains(t, protocol.Report.String(), "unresponsive")
+}
+
+// Tests that interior nodes of a deeper tree aggregate the shares of their
+// subtree, even if one of the nodes below them doesn't reply.
+func TestOCSTree(t *testing.T) {
+	nbrNodes := 7
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, 2, true)
+	require.Equal(t, 2, height(tree.Root))
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, 4)
+	require.NoError(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, _, err = dkgprotocol.NewSharedSecret(dkgs[i])
+		require.NoError(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.NoError(t, err)
+	k := []byte("key")
+	U, Cs := EncodeKey(tSuite, dks.Public(), k)
+	xc := key.NewKeyPair(cothority.Suite)
+
+	leaf := tree.Root.Children[0].Children[0]
+	paused := local.Servers[leaf.ServerIdentity.ID]
+	paused.Pause()
+	pi, err := services[0].(*testService).createOCS(tree, 4)
+	require.NoError(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.NodeTimeout = 100 * time.Millisecond
+	protocol.MaxRetries = 1
+	require.NoError(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.True(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+
+	XhatEnc, err := share.RecoverCommit(suite, protocol.Uis, 4, nbrNodes)
+	require.NoError(t, err)
+	keyHat, err := DecodeKey(suite, dks.Public(), Cs, XhatEnc, xc.Private)
+	require.NoError(t, err)
+	require.Equal(t, k, keyHat)
+}
+
+// Tests that a wrong share signed by a node can be blamed on it, but not a
+// correct share or a share it didn't sign.
+func TestBlame(t *testing.T) {
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), 3, 2)
+	require.NoError(t, err)
+	dks, err := dkgs[1].DistKeyShare()
+	require.NoError(t, err)
+	poly := share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("key"))
+	rc := &Reencrypt{U: U, Xc: key.NewKeyPair(cothority.Suite).Public}
+
+	trustee := key.NewKeyPair(cothority.Suite)
+	sign := func(r *ReencryptReply) {
+		msg, err := replyMessage(rc, r)
+		require.NoError(t, err)
+		r.Signature, err = schnorr.Sign(cothority.Suite, trustee.Private, msg)
+		require.NoError(t, err)
+	}
+	priv := dks.PriShare()
+	ui := reencryptShare(priv, rc.U, rc.Xc)
+	proof := reencryptionProof(priv, ui, rc.U, rc.Xc)
+	b := Blame{
+		Trustee: network.NewServerIdentity(trustee.Public,
+			network.NewLocalAddress("trustee")),
+		Request: *rc,
+		Reply:   ReencryptReply{Ui: ui, Ei: proof.Ei, Fi: proof.Fi},
+	}
+	sign(&b.Reply)
+	require.Error(t, b.Verify(poly))
+
+	b.Reply.Ui = &share.PubShare{I: ui.I,
+		V: suite.Point().Add(ui.V, suite.Point().Base())}
+	require.Error(t, b.Verify(poly))
+	sign(&b.Reply)
+	require.NoError(t, b.Verify(poly))
+}
+
 func TestOCSKeyLengths(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Testing all keylengths takes some time...")
@@ -129,6 +259,12 @@ func ocs(t *testing.T, nbrNodes, threshold, keylen, fail int, refuse bool) {
 	}
 
 	require.NotNil(t, protocol.Uis)
+	for i, ui := range protocol.Uis {
+		if ui != nil {
+			require.NoError(t, VerifyReencryption(protocol.Poly, U, xc.Public,
+				ui, protocol.Proofs[i]))
+		}
+	}
 	XhatEnc, err = share.RecoverCommit(suite, protocol.Uis, threshold, nbrNodes)
 	require.Nil(t, err, "Reencryption failed")
 
@@ -0,0 +1,180 @@
+package calypso
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"golang.org/x/xerrors"
+)
+
+// ErrorRateLimited is returned if a client sends more requests than allowed
+// by the rate limits of the service. As errors are sent as text to the
+// client, use IsRateLimited to check for it.
+var ErrorRateLimited = xerrors.New("rate limit exceeded")
+
+// IsRateLimited returns true if the error has been caused by a rate limit of
+// the service.
+func IsRateLimited(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrorRateLimited.Error())
+}
+
+// RateLimit configures a token bucket. Every request takes one token, and
+// Rate tokens are added every second, up to Burst tokens. A Rate of 0
+// disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimitPaths are the client requests limited per IP address. The writes
+// and reads are ByzCoin transactions, limited by limitTransaction.
+var rateLimitPaths = map[string]bool{
+	"DecryptKey":  true,
+	"DecryptKeys": true,
+}
+
+// tokenBucket holds the tokens of one client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client. Full buckets are removed
+// regularly, so that the memory used only depends on the number of active
+// clients.
+type rateLimiter struct {
+	limit     RateLimit
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	sync.Mutex
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// setLimit changes the limit and drops all buckets.
+func (rl *rateLimiter) setLimit(limit RateLimit) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.limit = limit
+	rl.buckets = make(map[string]*tokenBucket)
+}
+
+// allow takes one token from the bucket of the client and returns false if
+// the bucket is empty.
+func (rl *rateLimiter) allow(client string, now time.Time) bool {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.limit.Rate <= 0 {
+		return true
+	}
+	rl.prune(now)
+	b := rl.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(rl.limit.Burst), last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.limit.Rate
+	if b.tokens > float64(rl.limit.Burst) {
+		b.tokens = float64(rl.limit.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// remaining returns the number of requests the client can still send at
+// the given time, or -1 if there is no limit.
+func (rl *rateLimiter) remaining(client string, now time.Time) int {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.limit.Rate <= 0 {
+		return -1
+	}
+	b := rl.buckets[client]
+	if b == nil {
+		return rl.limit.Burst
+	}
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.limit.Rate
+	if tokens > float64(rl.limit.Burst) {
+		tokens = float64(rl.limit.Burst)
+	}
+	return int(tokens)
+}
+
+// prune removes all buckets that are full again. It must be called with the
+// lock held.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+	for client, b := range rl.buckets {
+		tokens := b.tokens + now.Sub(b.last).Seconds()*rl.limit.Rate
+		if tokens >= float64(rl.limit.Burst) {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// SetRateLimits sets the limits for the decryption requests sent to this
+// node, per IP address of the client and per public key of the reader. The
+// writes and reads spawned by the transactions sent to the ByzCoin service of
+// this node take from the same buckets, see limitTransaction. The limits are
+// not stored and must be set again after a restart, except if they come from
+// the file in ConfigEnv.
+func (s *Service) SetRateLimits(perIP, perKey RateLimit) error {
+	conf := s.getConfig()
+	conf.RateLimitPerIP = perIP
+	conf.RateLimitPerKey = perKey
+	return s.SetConfig(conf)
+}
+
+// limitTransaction is called by the ByzCoin service with the transactions
+// sent to this node. Every write and read spawned by the transaction takes a
+// token from the bucket of the IP address of the client, and from the
+// buckets of the keys of its signers, so that a client cannot fill the
+// chain with them.
+func (s *Service) limitTransaction(req *http.Request, tx byzcoin.ClientTransaction) error {
+	now := time.Now()
+	for _, inst := range tx.Instructions {
+		if inst.Spawn == nil || (inst.Spawn.ContractID != ContractWriteID &&
+			inst.Spawn.ContractID != ContractReadID) {
+			continue
+		}
+		h, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return xerrors.Errorf("splitting host port: %v", err)
+		}
+		if !s.ipLimiter.allow(h, now) {
+			return ErrorRateLimited
+		}
+		for _, id := range inst.SignerIdentities {
+			if !s.keyLimiter.allow(signerKey(id), now) {
+				return ErrorRateLimited
+			}
+		}
+	}
+	return nil
+}
+
+// signerKey returns the name of the bucket of the signer. An Ed25519 signer
+// shares the bucket of the decryption requests for its key.
+func signerKey(id darc.Identity) string {
+	if id.Ed25519 != nil {
+		return id.Ed25519.Point.String()
+	}
+	return id.String()
+}
@@ -0,0 +1,106 @@
+package calypso
+
+import (
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"golang.org/x/xerrors"
+)
+
+// A read-instance can be decrypted again and again, so the ID and the proof
+// of a stolen read stay useful to the thief. The trustees limit this with
+// the ReadTTL and the ReadTTLBlocks of their configuration: once a read is
+// older than the limits, counted from the block it has been spawned in, its
+// decryption is refused, and the reader has to spawn a new read, which
+// checks its access again.
+//
+// The block of a read is recorded in the read-instance by the write
+// contract. For reads spawned before it was recorded, the block is looked up
+// in the versions of the read-instance, so the node has to hold the chain to
+// decrypt them once a limit is set.
+
+// setBlock records the block the read is spawned in.
+func (rd *Read) setBlock(rst byzcoin.ReadOnlyStateTrie) {
+	rd.BlockIndex = rst.GetIndex()
+	rd.Timestamp = 0
+	if tr, ok := rst.(byzcoin.TimeReader); ok {
+		rd.Timestamp = tr.GetCurrentBlockTimestamp()
+	}
+}
+
+// checkReadExpiry returns an error if the read is older than the ReadTTL or
+// the ReadTTLBlocks of the configuration. The age in blocks is counted up to
+// the latest block verified by the node, and not up to the latest block of
+// the proof, which is chosen by the client.
+func (s *Service) checkReadExpiry(read *Read, proof *byzcoin.Proof) error {
+	conf := s.getConfig()
+	if conf.ReadTTL == 0 && conf.ReadTTLBlocks == 0 {
+		return nil
+	}
+	bcID := proof.Latest.SkipChainID()
+	index, ts := read.BlockIndex, read.Timestamp
+	if index == 0 {
+		var err error
+		index, ts, err = s.readBlock(bcID, byzcoin.NewInstanceID(proof.InclusionProof.Key()))
+		if err != nil {
+			return xerrors.Errorf("the read has expired: its block is unknown: %v", err)
+		}
+	}
+	if conf.ReadTTL > 0 && time.Since(time.Unix(0, ts)) > conf.readTTL() {
+		return xerrors.Errorf("the read has expired: it is older than %v",
+			conf.readTTL())
+	}
+	if conf.ReadTTLBlocks > 0 {
+		latest, err := s.latestVerifiedIndex(bcID)
+		if err != nil {
+			return xerrors.Errorf("getting latest block: %v", err)
+		}
+		if latest-index > conf.ReadTTLBlocks {
+			return xerrors.Errorf("the read has expired: it is older than %d blocks",
+				conf.ReadTTLBlocks)
+		}
+	}
+	return nil
+}
+
+// readBlock returns the index and the timestamp of the block the read has
+// been spawned in, from the first version of the read-instance.
+func (s *Service) readBlock(bcID skipchain.SkipBlockID, readID byzcoin.InstanceID) (int, int64, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return 0, 0, xerrors.New("couldn't get the byzcoin service")
+	}
+	versions, err := bc.GetAllInstanceVersion(&byzcoin.GetAllInstanceVersion{
+		SkipChainID: bcID,
+		InstanceID:  readID,
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting read versions: %v", err)
+	}
+	if len(versions.StateChanges) == 0 {
+		return 0, 0, xerrors.New("the read is not on the chain")
+	}
+	index := versions.StateChanges[0].BlockIndex
+	ts, err := s.blockTimestamp(bcID, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	return index, ts, nil
+}
+
+// latestVerifiedIndex returns the index of the latest block of the chain.
+// If the node doesn't hold the chain, the latest block is fetched from the
+// roster of the chain and checked against the forward links from the genesis
+// block.
+func (s *Service) latestVerifiedIndex(bcID skipchain.SkipBlockID) (int, error) {
+	latest, err := s.getLatestBlock(bcID)
+	if err != nil {
+		return 0, err
+	}
+	sb, err := s.getBlockByIndex(bcID, latest.Index)
+	if err != nil {
+		return 0, xerrors.Errorf("verifying latest block: %v", err)
+	}
+	return sb.Index, nil
+}
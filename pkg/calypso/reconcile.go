@@ -0,0 +1,461 @@
+package calypso
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	dkgprotocol "github.com/calypso-demo/filesharing/pkg/protocols/dkg/pedersen"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/encrypt/ecies"
+	"go.dedis.ch/kyber/v3/share"
+	dkg "go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// The nodes of an LTS store their share once the DKG is done. If this fails
+// on a node, it doesn't know the LTS, so it refuses every re-encryption and
+// it cannot deal in a resharing either, which needs all old nodes. As the
+// node doesn't know what it misses, the nodes holding a share regularly
+// send the proof of the LTS to the other nodes of its roster. A node that
+// misses the share recovers it from a threshold of helpers: every helper
+// sends its share multiplied by its Lagrange coefficient at the index of
+// the missing share, so that the sum of the parts is the missing share.
+// The parts are masked with values that cancel out in the sum, derived from
+// a Diffie-Hellman key of every pair of helpers, so the requester learns
+// nothing but its own share.
+//
+// The index of the share of a node is its position in the roster of the
+// DKG, which every node records. The requester gets this roster from the
+// other nodes together with their index, and they must all agree on it, so
+// the requester finds its index even if some nodes are offline. A helper
+// only contributes to the share of the node at the requested index, so a
+// node of the roster can only get its own share.
+
+// shareRepairLabel is hashed with the keys of the masks.
+const shareRepairLabel = "calypso-share-repair"
+
+// scheduleShareCheck runs checkShares every ShareCheckInterval.
+func (s *Service) scheduleShareCheck() {
+	interval := s.getConfig().shareCheckInterval()
+	if interval == 0 {
+		// Check again later whether the check has been enabled.
+		interval = time.Minute
+	}
+	s.schedule("shareCheck", interval, func() {
+		if s.getConfig().ShareCheckInterval > 0 {
+			s.checkShares()
+		}
+		s.scheduleShareCheck()
+	})
+}
+
+// checkShares sends the proof of every LTS of this node to the other nodes
+// of its roster, so that they recover their share if they miss it. LTSs of
+// chains this node doesn't hold are skipped.
+func (s *Service) checkShares() {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return
+	}
+	type lts struct {
+		bcID   []byte
+		roster *onet.Roster
+	}
+	ltss := make(map[byzcoin.InstanceID]lts)
+	s.storage.RLock()
+	for id := range s.storage.Shared {
+		reply, roster := s.storage.Replies[id], s.storage.Rosters[id]
+		if reply != nil && roster != nil {
+			ltss[id] = lts{reply.ByzCoinID, roster}
+		}
+	}
+	s.storage.RUnlock()
+
+	cl := onet.NewClient(cothority.Suite, ServiceName)
+	for id, l := range ltss {
+		resp, err := bc.GetProof(&byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			Key:     id.Slice(),
+			ID:      l.bcID,
+		})
+		if err != nil || !resp.Proof.InclusionProof.Match(id.Slice()) {
+			log.Lvl2(s.ServerIdentity(), "no proof for LTS", id, err)
+			continue
+		}
+		for _, si := range l.roster.List {
+			if si.Equal(s.ServerIdentity()) {
+				continue
+			}
+			reply := &ReconcileShareReply{}
+			err := cl.SendProtobuf(si, &ReconcileShare{Proof: resp.Proof}, reply)
+			if err != nil {
+				log.Lvl2(s.ServerIdentity(), "couldn't check share of", si, err)
+				continue
+			}
+			if reply.Recovered {
+				log.Lvlf1("%v: %v recovered its share of LTS %x",
+					s.ServerIdentity(), si, id[:])
+			}
+		}
+	}
+}
+
+// ReconcileShare recovers the share of the LTS of the proof if this node
+// misses it. Nothing is done if the node holds the share or isn't part of
+// the roster of the LTS.
+func (s *Service) ReconcileShare(req *ReconcileShare) (*ReconcileShareReply, error) {
+	if err := s.verifyProof(&req.Proof); err != nil {
+		return nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	_, _, cid, _, err := req.Proof.KeyValue()
+	if err != nil {
+		return nil, xerrors.Errorf("getting value of proof: %v", err)
+	}
+	if cid != ContractLongTermSecretID {
+		return nil, xerrors.New("proof is not for an LTS")
+	}
+	info, id, err := s.getLtsInfo(&req.Proof)
+	if err != nil {
+		return nil, xerrors.Errorf("get roster: %v", err)
+	}
+	if len(info.Weights) > 0 {
+		return nil, xerrors.New("cannot recover the shares of an LTS with weights")
+	}
+	roster := &info.Roster
+	if i, _ := roster.Search(s.ServerIdentity().ID); i < 0 {
+		return nil, xerrors.New("this node is not in the roster of the LTS")
+	}
+
+	s.reconcilingLock.Lock()
+	if s.reconciling[id] {
+		s.reconcilingLock.Unlock()
+		return &ReconcileShareReply{}, nil
+	}
+	s.reconciling[id] = true
+	s.reconcilingLock.Unlock()
+	defer func() {
+		s.reconcilingLock.Lock()
+		delete(s.reconciling, id)
+		s.reconcilingLock.Unlock()
+	}()
+
+	s.storage.RLock()
+	_, ok := s.storage.Shared[id]
+	s.storage.RUnlock()
+	if ok {
+		return &ReconcileShareReply{}, nil
+	}
+
+	log.Warnf("%v misses its share of LTS %x, recovering it",
+		s.ServerIdentity(), id[:])
+	shared, holders, err := s.recoverShare(id, roster)
+	if err != nil {
+		return nil, xerrors.Errorf("recovering share: %v", err)
+	}
+	s.storage.Lock()
+	s.storage.Shared[id] = shared
+	s.storage.DKS[id] = &dkg.DistKeyShare{
+		Commits: shared.Commits,
+		Share:   &share.PriShare{I: shared.Index, V: shared.V},
+	}
+	s.storage.Polys[id] = &pubPoly{s.Suite().Point().Base(), shared.Commits}
+	s.storage.Rosters[id] = roster
+	s.storage.Holders[id] = holders
+	s.storage.Replies[id] = &CreateLTSReply{
+		ByzCoinID:  req.Proof.Latest.SkipChainID(),
+		InstanceID: id,
+		X:          shared.X,
+	}
+	s.storage.setLTSNamespace(id,
+		s.storage.ByzCoinNamespaces[string(req.Proof.Latest.SkipChainID())])
+	s.storage.Unlock()
+	if err := s.save(); err != nil {
+		return nil, xerrors.Errorf("saving share: %v", err)
+	}
+	log.Lvlf1("%v recovered share %d of LTS %x", s.ServerIdentity(),
+		shared.Index, id[:])
+	return &ReconcileShareReply{Recovered: true}, nil
+}
+
+// recoverShare finds the index of the missing share of this node in the
+// roster of the DKG and sums the parts of a threshold of randomly chosen
+// helpers. It also returns the roster of the DKG, on which the helpers must
+// agree.
+func (s *Service) recoverShare(id byzcoin.InstanceID,
+	roster *onet.Roster) (*dkgprotocol.SharedSecret, *onet.Roster, error) {
+	cl := onet.NewClient(cothority.Suite, ServiceName)
+	n := len(roster.List)
+	var helpers []*network.ServerIdentity
+	var indexes []int
+	var holders *onet.Roster
+	for _, si := range roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		reply := &GetShareIndexReply{}
+		if err := cl.SendProtobuf(si, &GetShareIndex{LTSID: id}, reply); err != nil {
+			log.Lvl2(s.ServerIdentity(), "no share index from", si, err)
+			continue
+		}
+		if holders == nil {
+			if reply.Holders == nil || len(reply.Holders.List) != n {
+				return nil, nil, xerrors.Errorf("%v has invalid holders", si)
+			}
+			holders = reply.Holders
+		} else if !sameHolders(holders, reply.Holders) {
+			return nil, nil, xerrors.Errorf("%v has other holders", si)
+		}
+		if reply.Index < 0 || reply.Index >= n ||
+			!holders.List[reply.Index].Equal(si) {
+			return nil, nil, xerrors.Errorf("%v claims invalid index %d", si,
+				reply.Index)
+		}
+		helpers = append(helpers, si)
+		indexes = append(indexes, reply.Index)
+	}
+	if holders == nil {
+		return nil, nil, xerrors.New("no node sent the holders of the shares")
+	}
+	index := -1
+	for i, si := range holders.List {
+		if si.Equal(s.ServerIdentity()) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, nil, xerrors.New("this node doesn't hold a share in the DKG")
+	}
+	t := LTSThreshold(n)
+	if len(helpers) < t {
+		return nil, nil, xerrors.Errorf("only %d nodes hold a share, need %d",
+			len(helpers), t)
+	}
+
+	req := &ShareContribution{
+		LTSID:     id,
+		Index:     index,
+		Requester: s.getKeyPair().Public,
+	}
+	chosen := rand.Perm(len(helpers))[:t]
+	for _, c := range chosen {
+		req.Helpers = append(req.Helpers, indexes[c])
+		req.Publics = append(req.Publics,
+			helpers[c].ServicePublic(ServiceName))
+	}
+	v := cothority.Suite.Scalar().Zero()
+	var commits []kyber.Point
+	for _, c := range chosen {
+		reply := &ShareContributionReply{}
+		if err := cl.SendProtobuf(helpers[c], req, reply); err != nil {
+			return nil, nil, xerrors.Errorf("getting contribution of %v: %v",
+				helpers[c], err)
+		}
+		if commits == nil {
+			commits = reply.Commits
+		} else if !sameCommits(commits, reply.Commits) {
+			return nil, nil, xerrors.Errorf("%v has other commits", helpers[c])
+		}
+		if !sameHolders(holders, reply.Holders) {
+			return nil, nil, xerrors.Errorf("%v has other holders", helpers[c])
+		}
+		buf, err := ecies.Decrypt(cothority.Suite, s.getKeyPair().Private,
+			reply.Contribution, nil)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("decrypting contribution of %v: %v",
+				helpers[c], err)
+		}
+		part := cothority.Suite.Scalar()
+		if err := part.UnmarshalBinary(buf); err != nil {
+			return nil, nil, xerrors.Errorf("contribution of %v: %v", helpers[c], err)
+		}
+		v.Add(v, part)
+	}
+	if len(commits) == 0 {
+		return nil, nil, xerrors.New("got no commits")
+	}
+	poly := share.NewPubPoly(cothority.Suite, cothority.Suite.Point().Base(),
+		commits)
+	if !poly.Check(&share.PriShare{I: index, V: v}) {
+		return nil, nil, xerrors.New("recovered share doesn't match the polynomial")
+	}
+	return &dkgprotocol.SharedSecret{
+		Index:   index,
+		V:       v,
+		X:       commits[0],
+		Commits: commits,
+	}, holders, nil
+}
+
+// GetShareIndex returns the index of the share of this node and the roster
+// of the DKG. Both are public information, so no signature is needed.
+func (s *Service) GetShareIndex(req *GetShareIndex) (*GetShareIndexReply, error) {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	shared, ok := s.storage.Shared[req.LTSID]
+	if !ok {
+		return nil, xerrors.Errorf("didn't find LTSID %v", req.LTSID)
+	}
+	if s.storage.Weights[req.LTSID] != nil {
+		return nil, xerrors.New("the LTS has weights")
+	}
+	holders := s.storage.Holders[req.LTSID]
+	if holders == nil {
+		return nil, xerrors.Errorf("the holders of the shares of LTSID %v are unknown",
+			req.LTSID)
+	}
+	return &GetShareIndexReply{Index: shared.Index, Holders: holders}, nil
+}
+
+// ShareContribution returns the masked part of this node of the missing
+// share, encrypted for the requester. The requester must be the node of the
+// requested index in the roster of the DKG.
+func (s *Service) ShareContribution(req *ShareContribution) (*ShareContributionReply, error) {
+	s.storage.RLock()
+	shared, ok := s.storage.Shared[req.LTSID]
+	holders := s.storage.Holders[req.LTSID]
+	if ok {
+		shared = shared.Clone()
+	}
+	s.storage.RUnlock()
+	if !ok {
+		return nil, xerrors.Errorf("didn't find LTSID %v", req.LTSID)
+	}
+	if holders == nil {
+		return nil, xerrors.Errorf("the holders of the shares of LTSID %v are unknown",
+			req.LTSID)
+	}
+	if err := s.checkUnweighted(req.LTSID); err != nil {
+		return nil, err
+	}
+	kp := s.getKeyPair()
+	pos, err := verifyContribution(req, holders, shared, kp.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := cothority.Suite
+	x := func(i int) kyber.Scalar {
+		return suite.Scalar().SetInt64(int64(i) + 1)
+	}
+	num, den := suite.Scalar().One(), suite.Scalar().One()
+	part := suite.Scalar().Zero()
+	for k, hk := range req.Helpers {
+		if k == pos {
+			continue
+		}
+		num.Mul(num, suite.Scalar().Sub(x(req.Index), x(hk)))
+		den.Mul(den, suite.Scalar().Sub(x(shared.Index), x(hk)))
+
+		mask := suite.Scalar().Pick(suite.XOF(contributionSeed(req,
+			suite.Point().Mul(kp.Private, req.Publics[k]))))
+		if shared.Index < hk {
+			part.Add(part, mask)
+		} else {
+			part.Sub(part, mask)
+		}
+	}
+	lambda := suite.Scalar().Div(num, den)
+	part.Add(part, suite.Scalar().Mul(lambda, shared.V))
+
+	buf, err := part.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling contribution: %v", err)
+	}
+	enc, err := ecies.Encrypt(suite, req.Requester, buf, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("encrypting contribution: %v", err)
+	}
+	log.Lvlf2("%v contributes to share %d of LTS %x", s.ServerIdentity(),
+		req.Index, req.LTSID[:])
+	return &ShareContributionReply{Contribution: enc,
+		Commits: shared.Commits, Holders: holders}, nil
+}
+
+// verifyContribution checks the request against the holders of the shares
+// of the LTS and returns the position of this node in the helpers.
+func verifyContribution(req *ShareContribution, holders *onet.Roster,
+	shared *dkgprotocol.SharedSecret, public kyber.Point) (int, error) {
+	n := len(holders.List)
+	if req.Index < 0 || req.Index >= n {
+		return -1, xerrors.New("index out of range")
+	}
+	if len(req.Helpers) != LTSThreshold(n) ||
+		len(req.Publics) != len(req.Helpers) {
+		return -1, xerrors.Errorf("need %d helpers", LTSThreshold(n))
+	}
+	holder := func(i int) kyber.Point {
+		return holders.List[i].ServicePublic(ServiceName)
+	}
+	if req.Requester == nil || !holder(req.Index).Equal(req.Requester) {
+		return -1, xerrors.Errorf("requester doesn't hold share %d", req.Index)
+	}
+	if !holder(shared.Index).Equal(public) {
+		return -1, xerrors.New("this node doesn't hold its share in the DKG")
+	}
+	pos := -1
+	seen := make(map[int]bool)
+	for k, hk := range req.Helpers {
+		if hk < 0 || hk >= n || hk == req.Index || seen[hk] {
+			return -1, xerrors.Errorf("invalid helper index %d", hk)
+		}
+		seen[hk] = true
+		if p := req.Publics[k]; p == nil || !holder(hk).Equal(p) {
+			return -1, xerrors.Errorf("invalid helper key %d", k)
+		}
+		if hk == shared.Index {
+			pos = k
+		}
+	}
+	if pos < 0 {
+		return -1, xerrors.New("this node is not a helper")
+	}
+	return pos, nil
+}
+
+func sameCommits(a, b []kyber.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameHolders(a, b *onet.Roster) bool {
+	if a == nil || b == nil || len(a.List) != len(b.List) {
+		return false
+	}
+	for i := range a.List {
+		if !a.List[i].Equal(b.List[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// contributionSeed returns the seed of the mask shared by two helpers,
+// given their Diffie-Hellman key.
+func contributionSeed(req *ShareContribution, dh kyber.Point) []byte {
+	h := sha256.New()
+	h.Write([]byte(shareRepairLabel))
+	dh.MarshalTo(h)
+	h.Write(req.LTSID[:])
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(req.Index))
+	h.Write(buf)
+	for _, hk := range req.Helpers {
+		binary.LittleEndian.PutUint64(buf, uint64(hk))
+		h.Write(buf)
+	}
+	return h.Sum(nil)
+}
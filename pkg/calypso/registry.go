@@ -0,0 +1,304 @@
+package calypso
+
+import (
+	"crypto/sha256"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A writer knows its readers by their email address or their LDAP DN, not
+// by their public key. An identity registry binds such identifiers to public
+// keys: every binding is signed by the authority of the registry, e.g. the
+// identity provider of an organisation, whose key is stored in the registry
+// when it is spawned. The darc of the registry decides who can submit the
+// bindings, but only the bindings signed by the authority are accepted, so
+// the writers only need to trust the authority. A writer looks up the key of
+// an identifier with LookupIdentity, or shares a document with
+// Document.ShareWithIdentity.
+
+// ContractRegistryID references an identity registry contract system-wide.
+const ContractRegistryID = "calypsoRegistry"
+
+// maxIdentifierLength is the longest identifier that can be bound.
+const maxIdentifierLength = 256
+
+// contractRegistry holds the bindings of an identity registry. It is
+// spawned with the public key of the authority in the "authority" argument,
+// and invoked with "bind", taking a binding signed by the authority in the
+// "binding" argument, or "unbind", taking an identifier in the "identifier"
+// argument. Binding an identifier again replaces its key.
+type contractRegistry struct {
+	byzcoin.BasicContract
+	IdentityRegistry
+}
+
+func contractRegistryFromBytes(in []byte) (byzcoin.Contract, error) {
+	c := &contractRegistry{}
+	err := protobuf.DecodeWithConstructors(in, &c.IdentityRegistry,
+		network.DefaultConstructors(cothority.Suite))
+	return c, cothority.ErrorOrNil(err, "couldn't unmarshal identity registry")
+}
+
+func (c *contractRegistry) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	authority := cothority.Suite.Point()
+	if err := authority.UnmarshalBinary(inst.Spawn.Args.Search("authority")); err != nil {
+		return nil, nil, xerrors.Errorf("invalid authority argument: %v", err)
+	}
+	buf, err := protobuf.Encode(&IdentityRegistry{Authority: authority})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding registry: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Create,
+		inst.DeriveID(""), ContractRegistryID, buf, darcID)}, coins, nil
+}
+
+func (c *contractRegistry) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting values: %v", err)
+	}
+	switch inst.Invoke.Command {
+	case "bind":
+		var b IdentityBinding
+		err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("binding"),
+			&b, network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, xerrors.Errorf("passed binding argument is invalid: %v", err)
+		}
+		if err := c.IdentityRegistry.bind(b); err != nil {
+			return nil, nil, xerrors.Errorf("binding %s: %v", b.Identifier, err)
+		}
+		log.Lvlf2("Bound %s to %s in %x", b.Identifier, b.Key, inst.InstanceID[:])
+	case "unbind":
+		identifier := string(inst.Invoke.Args.Search("identifier"))
+		if err := c.IdentityRegistry.unbind(identifier); err != nil {
+			return nil, nil, xerrors.Errorf("unbinding %s: %v", identifier, err)
+		}
+	default:
+		return nil, nil, xerrors.New("can only bind or unbind identifiers")
+	}
+	buf, err := protobuf.Encode(&c.IdentityRegistry)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding registry: %v", err)
+	}
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractRegistryID, buf, darcID)}, coins, nil
+}
+
+// bind adds the binding after checking its signature by the authority. An
+// existing binding of the identifier is replaced.
+func (reg *IdentityRegistry) bind(b IdentityBinding) error {
+	if b.Identifier == "" || len(b.Identifier) > maxIdentifierLength {
+		return xerrors.Errorf("identifier must have between 1 and %d bytes",
+			maxIdentifierLength)
+	}
+	if b.Key == nil {
+		return xerrors.New("binding without key")
+	}
+	if err := reg.verify(b); err != nil {
+		return err
+	}
+	for i := range reg.Bindings {
+		if reg.Bindings[i].Identifier == b.Identifier {
+			reg.Bindings[i] = b
+			return nil
+		}
+	}
+	reg.Bindings = append(reg.Bindings, b)
+	return nil
+}
+
+// unbind removes the binding of the identifier.
+func (reg *IdentityRegistry) unbind(identifier string) error {
+	for i, b := range reg.Bindings {
+		if b.Identifier == identifier {
+			reg.Bindings = append(reg.Bindings[:i], reg.Bindings[i+1:]...)
+			return nil
+		}
+	}
+	return xerrors.New("identifier is not bound")
+}
+
+// verify checks that the binding has been signed by the authority of the
+// registry.
+func (reg *IdentityRegistry) verify(b IdentityBinding) error {
+	msg, err := BindingMessage(reg.Authority, b.Identifier, b.Key)
+	if err != nil {
+		return err
+	}
+	err = schnorr.Verify(cothority.Suite, reg.Authority, msg, b.Signature)
+	return cothority.ErrorOrNil(err, "wrong signature of authority")
+}
+
+// Lookup returns the key bound to the identifier, after checking the
+// signature of the authority.
+func (reg *IdentityRegistry) Lookup(identifier string) (kyber.Point, error) {
+	for _, b := range reg.Bindings {
+		if b.Identifier != identifier {
+			continue
+		}
+		if err := reg.verify(b); err != nil {
+			return nil, xerrors.Errorf("binding of %s: %v", identifier, err)
+		}
+		return b.Key, nil
+	}
+	return nil, xerrors.Errorf("%s is not bound", identifier)
+}
+
+// BindingMessage returns the message the authority signs to bind the
+// identifier to the key.
+func BindingMessage(authority kyber.Point, identifier string, key kyber.Point) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("calypso-binding"))
+	if _, err := authority.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling authority: %v", err)
+	}
+	if _, err := key.MarshalTo(h); err != nil {
+		return nil, xerrors.Errorf("marshalling key: %v", err)
+	}
+	h.Write([]byte(identifier))
+	return h.Sum(nil), nil
+}
+
+// NewIdentityBinding returns a binding of the identifier to the key,
+// signed by the authority.
+func NewIdentityBinding(authority darc.Signer, identifier string, key kyber.Point) (IdentityBinding, error) {
+	msg, err := BindingMessage(authority.Ed25519.Point, identifier, key)
+	if err != nil {
+		return IdentityBinding{}, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, authority.Ed25519.Secret, msg)
+	if err != nil {
+		return IdentityBinding{}, xerrors.Errorf("signing binding: %v", err)
+	}
+	return IdentityBinding{Identifier: identifier, Key: key, Signature: sig}, nil
+}
+
+// SpawnRegistry creates an identity registry whose bindings must be signed
+// by the authority. The signers need the spawn:calypsoRegistry rule of the
+// darc, which also controls who can bind and unbind identifiers.
+func (c *Client) SpawnRegistry(darcID darc.ID, authority kyber.Point,
+	signers []darc.Signer, counters []uint64, wait int) (byzcoin.InstanceID, error) {
+	buf, err := authority.MarshalBinary()
+	if err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("marshalling authority: %v", err)
+	}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(darcID),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractRegistryID,
+				Args:       byzcoin.Arguments{{Name: "authority", Value: buf}},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("signing txn: %v", err)
+	}
+	if _, err := c.bcClient.AddTransactionAndWait(ctx, wait); err != nil {
+		return byzcoin.InstanceID{}, xerrors.Errorf("adding txn: %v", err)
+	}
+	return ctx.Instructions[0].DeriveID(""), nil
+}
+
+// BindIdentity stores the binding in the registry. It must be signed by the
+// authority of the registry, see NewIdentityBinding. The signers need the
+// invoke:calypsoRegistry.bind rule of the darc of the registry.
+func (c *Client) BindIdentity(regID byzcoin.InstanceID, binding IdentityBinding,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	buf, err := protobuf.Encode(&binding)
+	if err != nil {
+		return xerrors.Errorf("encoding binding: %v", err)
+	}
+	return c.invokeRegistry(regID, "bind", byzcoin.Arguments{{Name: "binding",
+		Value: buf}}, signers, counters, wait)
+}
+
+// UnbindIdentity removes the binding of the identifier from the registry.
+// The documents already shared with its key are not changed. The signers
+// need the invoke:calypsoRegistry.unbind rule of the darc of the registry.
+func (c *Client) UnbindIdentity(regID byzcoin.InstanceID, identifier string,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeRegistry(regID, "unbind", byzcoin.Arguments{{Name: "identifier",
+		Value: []byte(identifier)}}, signers, counters, wait)
+}
+
+func (c *Client) invokeRegistry(regID byzcoin.InstanceID, cmd string,
+	args byzcoin.Arguments, signers []darc.Signer, counters []uint64, wait int) error {
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: regID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractRegistryID,
+				Command:    cmd,
+				Args:       args,
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err := c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
+
+// GetRegistry returns the identity registry stored in the instance, after
+// verifying its proof from the genesis block.
+func (c *Client) GetRegistry(regID byzcoin.InstanceID) (*IdentityRegistry, error) {
+	resp, err := c.bcClient.GetProof(regID.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(regID.Slice()) {
+		return nil, xerrors.New("registry doesn't exist")
+	}
+	genesis, err := c.genesis()
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Proof.VerifyFromBlock(genesis); err != nil {
+		return nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	var reg IdentityRegistry
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractRegistryID, &reg)
+	if err != nil {
+		return nil, xerrors.Errorf("didn't get a registry: %v", err)
+	}
+	return &reg, nil
+}
+
+// LookupIdentity returns the key bound to the identifier in the registry.
+// The binding is checked against the authority, which the caller can
+// compare with the authority it trusts using GetRegistry.
+func (c *Client) LookupIdentity(regID byzcoin.InstanceID, identifier string) (kyber.Point, error) {
+	reg, err := c.GetRegistry(regID)
+	if err != nil {
+		return nil, err
+	}
+	return reg.Lookup(identifier)
+}
+
+// ShareWithIdentity allows the reader bound to the identifier in the
+// registry to read all versions of the document.
+func (doc *Document) ShareWithIdentity(owner darc.Signer, regID byzcoin.InstanceID,
+	identifier string) error {
+	key, err := doc.client.LookupIdentity(regID, identifier)
+	if err != nil {
+		return xerrors.Errorf("looking up %s: %v", identifier, err)
+	}
+	return doc.Share(owner, darc.NewIdentityEd25519(key))
+}
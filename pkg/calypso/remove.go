@@ -0,0 +1,240 @@
+package calypso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A node leaving the cothority must not take its shares with it: an LTS of
+// n nodes with one node gone can still decrypt, but it cannot be reshared
+// anymore, as a resharing needs all old nodes. So before the node leaves,
+// RemoveNode asks it for the LTSs it holds, reshares each of them to the
+// other nodes of its roster, and then removes the node from the roster of
+// the chain with an update of its config.
+
+// RemoveNode returns the LTSs this node holds a share of. Like
+// ReloadConfig, the request must be signed using the private key of the
+// conode.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) RemoveNode(req *RemoveNode) (*RemoveNodeReply, error) {
+	err := s.verifyAdminSignature(removeNodeMessage(req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+	reply := &RemoveNodeReply{}
+	s.storage.RLock()
+	for id := range s.storage.Shared {
+		if r := s.storage.Replies[id]; r != nil {
+			reply.LTSs = append(reply.LTSs, HeldLTS{ByzCoinID: r.ByzCoinID,
+				LTSID: id})
+		}
+	}
+	s.storage.RUnlock()
+	sort.Slice(reply.LTSs, func(i, j int) bool {
+		return bytes.Compare(reply.LTSs[i].LTSID[:], reply.LTSs[j].LTSID[:]) < 0
+	})
+	log.Warnf("AUDIT: %v is being removed, it holds %d LTSs",
+		s.ServerIdentity(), len(reply.LTSs))
+	return reply, nil
+}
+
+// removeNodeMessage returns the message to be signed for a RemoveNode
+// request.
+func removeNodeMessage(ts int64) []byte {
+	msg := append([]byte("remove:"), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
+
+// RemoveNode removes the node from the chain of the client: every LTS of the
+// chain the node holds a share of is reshared to the other nodes of its
+// roster, then the node is removed from the roster of the chain in a new
+// block. The signers need the invoke:longTermSecret.reshare and the
+// invoke:config.update_config rules. The counters are used for the first
+// transaction and incremented for every following one.
+//
+// This is a tool for the operator of the node only: the request to the node
+// is signed using the private key of the conode, so who must hold it, as
+// with the server identity read from its private.toml.
+//
+// Nothing is changed if an LTS would be left with less than its threshold
+// of nodes. It returns the LTSs that have been reshared, also on error: if
+// the resharing of an LTS fails, the other LTSs are still reshared, but the
+// node is not removed from the chain, and the error lists the failed LTSs.
+func (c *Client) RemoveNode(who *network.ServerIdentity, signers []darc.Signer,
+	counters []uint64) ([]byzcoin.InstanceID, error) {
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, who.GetPrivate(),
+		removeNodeMessage(ts))
+	if err != nil {
+		return nil, xerrors.Errorf("creating schnorr signature: %v", err)
+	}
+	reply := &RemoveNodeReply{}
+	err = c.c.SendProtobuf(who, &RemoveNode{Timestamp: ts, Signature: sig},
+		reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending RemoveNode message: %v", err)
+	}
+
+	type reshare struct {
+		id     byzcoin.InstanceID
+		info   *LtsInstanceInfo
+		roster *onet.Roster
+	}
+	var reshares []reshare
+	for _, lts := range reply.LTSs {
+		if !lts.ByzCoinID.Equal(c.bcClient.ID) {
+			log.Lvlf2("skipping LTS %x of another chain", lts.LTSID[:])
+			continue
+		}
+		resp, err := c.bcClient.GetProofFromLatest(lts.LTSID.Slice())
+		if err != nil {
+			return nil, xerrors.Errorf("getting proof: %v", err)
+		}
+		var info LtsInstanceInfo
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractLongTermSecretID, &info)
+		if err != nil {
+			return nil, xerrors.Errorf("didn't get an LTS instance: %v", err)
+		}
+		roster := rosterWithout(&info.Roster, who)
+		if len(roster.List) == len(info.Roster.List) {
+			continue
+		}
+		// Same rule as the reshare command of the contract, so that no
+		// transaction is sent if one of the LTSs can't be reshared.
+		n := len(info.Roster.List)
+		if overlap := intersectRosters(&info.Roster, roster); overlap < LTSThreshold(n) {
+			return nil, xerrors.Errorf("LTS %x would be left with %d nodes, "+
+				"its threshold is %d", lts.LTSID[:], overlap, LTSThreshold(n))
+		}
+		reshares = append(reshares, reshare{lts.LTSID, &info, roster})
+	}
+
+	// A failed resharing doesn't stop the other ones, but the node is only
+	// removed from the chain once all its LTSs have been reshared.
+	ctrs := append([]uint64{}, counters...)
+	var reshared []byzcoin.InstanceID
+	var failed []string
+	for _, r := range reshares {
+		if err := c.reshareLTS(r.id, r.info, r.roster, signers, ctrs); err != nil {
+			failed = append(failed, fmt.Sprintf("%x: %v", r.id[:], err))
+			// The transaction may or may not have been accepted, so the
+			// counters are fetched again.
+			for i, signer := range signers {
+				if ctrs[i], err = c.nextCounter(signer); err != nil {
+					return reshared, xerrors.Errorf("couldn't reshare LTSs %s: %v",
+						strings.Join(failed, ", "), err)
+				}
+			}
+			continue
+		}
+		reshared = append(reshared, r.id)
+		for i := range ctrs {
+			ctrs[i]++
+		}
+	}
+	if len(failed) > 0 {
+		return reshared, xerrors.Errorf("couldn't reshare LTSs %s, the node "+
+			"is kept in the roster of the chain", strings.Join(failed, ", "))
+	}
+
+	config, err := c.bcClient.GetChainConfig()
+	if err != nil {
+		return reshared, xerrors.Errorf("getting chain config: %v", err)
+	}
+	roster := rosterWithout(&config.Roster, who)
+	if len(roster.List) == len(config.Roster.List) {
+		return reshared, nil
+	}
+	config.Roster = *roster
+	buf, err := protobuf.Encode(config)
+	if err != nil {
+		return reshared, xerrors.Errorf("encoding config: %v", err)
+	}
+	tx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.ConfigInstanceID,
+			Invoke: &byzcoin.Invoke{
+				ContractID: byzcoin.ContractConfigID,
+				Command:    "update_config",
+				Args:       byzcoin.Arguments{{Name: "config", Value: buf}},
+			},
+			SignerCounter: ctrs,
+		},
+	)
+	if err := tx.FillSignersAndSignWith(signers...); err != nil {
+		return reshared, xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err = c.bcClient.AddTransactionAndWait(tx, 10)
+	return reshared, cothority.ErrorOrNil(err, "updating roster of chain")
+}
+
+// reshareLTS stores the new roster of the LTS with the "reshare" command,
+// then asks the first node of the new roster to run the resharing.
+func (c *Client) reshareLTS(id byzcoin.InstanceID, cur *LtsInstanceInfo,
+	roster *onet.Roster, signers []darc.Signer, counters []uint64) error {
+	info := *cur
+	info.Roster = *roster
+	buf, err := protobuf.Encode(&info)
+	if err != nil {
+		return xerrors.Errorf("encoding roster: %v", err)
+	}
+	tx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: id,
+			Invoke: &byzcoin.Invoke{
+				ContractID: ContractLongTermSecretID,
+				Command:    "reshare",
+				Args:       byzcoin.Arguments{{Name: "lts_instance_info", Value: buf}},
+			},
+			SignerCounter: counters,
+		},
+	)
+	if err := tx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	atr, err := c.bcClient.AddTransactionAndWait(tx, 10)
+	if err != nil {
+		return xerrors.Errorf("adding transaction: %v", err)
+	}
+	resp, err := c.bcClient.GetProofAfter(id.Slice(), true, &atr.Proof.Latest)
+	if err != nil {
+		return xerrors.Errorf("getting txn proof: %v", err)
+	}
+	err = c.c.SendProtobuf(roster.List[0], &ReshareLTS{
+		Proof:     resp.Proof,
+		Namespace: c.namespace,
+	}, &ReshareLTSReply{})
+	return cothority.ErrorOrNil(err, "send ReshareLTS message")
+}
+
+// rosterWithout returns the roster without the given node.
+func rosterWithout(roster *onet.Roster, si *network.ServerIdentity) *onet.Roster {
+	var list []*network.ServerIdentity
+	for _, n := range roster.List {
+		if !n.Equal(si) {
+			list = append(list, n)
+		}
+	}
+	if len(list) == 0 {
+		return &onet.Roster{}
+	}
+	return onet.NewRoster(list)
+}
@@ -0,0 +1,186 @@
+package calypso
+
+import (
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// If the propagation of a new block fails, some nodes of the chain never
+// store it. As every node checks that the read of a re-encryption is in a
+// block of its local db, these nodes would refuse to take part in some
+// decryptions, depending on which nodes are chosen. So missing blocks are
+// fetched from the other nodes when a re-encryption references them, and a
+// regular sweep asks the other nodes for blocks after the latest local one.
+//
+// A stored block that doesn't match its hash anymore, for example after a
+// disk error, is handled like a missing block by the skipchain db, so it is
+// neither served nor propagated. The db tells the service about it, which
+// fetches the block again from the nodes of its chains.
+
+// maxRepairs is the number of repairs of corrupted blocks that are kept for
+// CheckConsistency.
+const maxRepairs = 100
+
+// ensureBlock makes sure that the block with the given ID is stored in the
+// local skipchain db, fetching it and the blocks before it from the roster
+// if it is missing.
+func (s *Service) ensureBlock(roster *onet.Roster, id skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the skipchain service")
+	}
+	if sb := sc.GetDB().GetByID(id); sb != nil {
+		return sb, nil
+	}
+	log.Lvl2(s.ServerIdentity(), "fetching missing block", id)
+	if err := sc.SyncChain(roster, id); err != nil {
+		return nil, xerrors.Errorf("syncing chain: %v", err)
+	}
+	sb := sc.GetDB().GetByID(id)
+	if sb == nil {
+		return nil, xerrors.New("block is not known by the roster")
+	}
+	return sb, nil
+}
+
+// verifyReadBlock checks that the proof of the read instance comes from a
+// block of the local copy of the chain. A missing block is fetched from the
+// roster of the latest local block, never from the roster given by the
+// proof. The proof must have been verified by verifyProof before, which is
+// the only check done by the nodes that don't hold the chain.
+func (s *Service) verifyReadBlock(proof *byzcoin.Proof) error {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return xerrors.New("couldn't get the skipchain service")
+	}
+	latest, err := sc.GetDB().GetLatestByID(proof.Latest.SkipChainID())
+	if err != nil {
+		// This node doesn't hold the chain.
+		return nil
+	}
+	sb, err := s.ensureBlock(latest.Roster, proof.Latest.Hash)
+	if err != nil {
+		return xerrors.Errorf("getting block of proof: %v", err)
+	}
+	return proof.VerifyInclusionProof(sb)
+}
+
+// scheduleRepair runs repairChains every RepairInterval. The configuration
+// is read again before every run, so that the interval can be changed.
+func (s *Service) scheduleRepair() {
+	interval := s.getConfig().repairInterval()
+	if interval == 0 {
+		// Check again later whether the repair has been enabled.
+		interval = time.Minute
+	}
+	s.schedule("repair", interval, func() {
+		if s.getConfig().RepairInterval > 0 {
+			s.repairChains()
+		}
+		s.scheduleRepair()
+	})
+}
+
+// repairChains asks the nodes of all authorised chains held by this node for
+// the blocks after the latest local one. This also updates the forward link
+// of the latest local block if the next block has been missed.
+func (s *Service) repairChains() {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return
+	}
+	s.storage.RLock()
+	var ids []skipchain.SkipBlockID
+	for id := range s.storage.AuthorisedByzCoinIDs {
+		ids = append(ids, skipchain.SkipBlockID(id))
+	}
+	s.storage.RUnlock()
+
+	for _, id := range ids {
+		latest, err := sc.GetDB().GetLatestByID(id)
+		if err != nil {
+			// This node doesn't hold the chain.
+			continue
+		}
+		if err := sc.SyncChain(latest.Roster, latest.Hash); err != nil {
+			log.Warn(s.ServerIdentity(), "couldn't repair chain", id, err)
+			continue
+		}
+		if newest, err := sc.GetDB().GetLatestByID(id); err == nil &&
+			newest.Index > latest.Index {
+			log.Lvlf1("%v repaired chain %x up to block %d", s.ServerIdentity(),
+				[]byte(id), newest.Index)
+		}
+	}
+}
+
+// repairCorrupted is called by the skipchain db when a block doesn't match
+// its hash. It fetches the block in the background, as the db might be
+// locked by the caller.
+func (s *Service) repairCorrupted(id skipchain.SkipBlockID) {
+	s.repairsLock.Lock()
+	if s.repairing[string(id)] {
+		s.repairsLock.Unlock()
+		return
+	}
+	s.repairing[string(id)] = true
+	s.repairsLock.Unlock()
+
+	go func() {
+		err := s.repairBlock(id)
+		repair := BlockRepair{BlockID: id, Timestamp: time.Now().UnixNano(),
+			Repaired: err == nil}
+		if err != nil {
+			repair.Error = err.Error()
+			log.Error(s.ServerIdentity(), "couldn't repair block", id, err)
+		} else {
+			log.Warn(s.ServerIdentity(), "repaired corrupted block", id)
+		}
+		s.repairsLock.Lock()
+		delete(s.repairing, string(id))
+		s.repairs = append(s.repairs, repair)
+		if len(s.repairs) > maxRepairs {
+			s.repairs = s.repairs[len(s.repairs)-maxRepairs:]
+		}
+		s.repairsLock.Unlock()
+	}()
+}
+
+// repairBlock asks the nodes of the authorised chains held by this node for
+// the block, until one of them sends a copy matching its hash.
+func (s *Service) repairBlock(id skipchain.SkipBlockID) error {
+	sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service)
+	if !ok {
+		return xerrors.New("couldn't get the skipchain service")
+	}
+	s.storage.RLock()
+	var ids []skipchain.SkipBlockID
+	for bcID := range s.storage.AuthorisedByzCoinIDs {
+		ids = append(ids, skipchain.SkipBlockID(bcID))
+	}
+	s.storage.RUnlock()
+
+	err := xerrors.New("this node doesn't hold any chain")
+	for _, bcID := range ids {
+		latest, lerr := sc.GetDB().GetLatestByID(bcID)
+		if lerr != nil {
+			continue
+		}
+		if err = sc.RepairBlock(latest.Roster, id); err == nil {
+			return nil
+		}
+	}
+	return xerrors.Errorf("fetching block: %v", err)
+}
+
+// blockRepairs returns a copy of the latest repairs.
+func (s *Service) blockRepairs() []BlockRepair {
+	s.repairsLock.Lock()
+	defer s.repairsLock.Unlock()
+	return append([]BlockRepair{}, s.repairs...)
+}
@@ -0,0 +1,141 @@
+package calypso
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"golang.org/x/xerrors"
+)
+
+// A DecryptKey request only holds proofs that are public, so anyone who
+// sees one can send it again. A signed request holds a timestamp and a
+// random nonce, signed by the key the secret is re-encrypted to. The root
+// and the trustees refuse requests older than the DecryptRequestAge of
+// their configuration, and remember the nonces of the requests they
+// accepted until then. The root refuses a nonce it has already seen, and a
+// trustee refuses a nonce it has already seen from another root: a root
+// asks the same trustees again when it widens its tree.
+
+// decryptNonceLength is the length of the nonce of a signed request.
+const decryptNonceLength = 16
+
+// decryptRequestMessage returns the message signed by the reader for the
+// request of the read.
+func decryptRequestMessage(readID byzcoin.InstanceID, timestamp int64, nonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("calypso-decrypt-request"))
+	h.Write(readID[:])
+	binary.Write(h, binary.LittleEndian, timestamp)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// Sign adds a timestamp and a nonce to the request and signs it with the
+// private key the secret is re-encrypted to: the key of the read, or of the
+// last delegate. The request must be signed again before it is sent again.
+func (dkr *DecryptKey) Sign(xc kyber.Scalar) error {
+	dkr.Timestamp = time.Now().Unix()
+	dkr.Nonce = make([]byte, decryptNonceLength)
+	if _, err := rand.Read(dkr.Nonce); err != nil {
+		return xerrors.Errorf("creating nonce: %v", err)
+	}
+	msg := decryptRequestMessage(
+		byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()), dkr.Timestamp,
+		dkr.Nonce)
+	sig, err := schnorr.Sign(cothority.Suite, xc, msg)
+	if err != nil {
+		return xerrors.Errorf("signing request: %v", err)
+	}
+	dkr.Signature = sig
+	return nil
+}
+
+// seenNonce is the root that used a nonce, and when the nonce can be
+// forgotten.
+type seenNonce struct {
+	root   string
+	expiry time.Time
+}
+
+// nonceCache holds the nonces of the signed requests that are not too old
+// yet.
+type nonceCache struct {
+	nonces    map[string]seenNonce
+	lastPrune time.Time
+	sync.Mutex
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]seenNonce)}
+}
+
+// add records the nonce as used by the root until expiry. It returns false
+// if the nonce has already been used by another root or, if again is false,
+// by any root.
+func (nc *nonceCache) add(nonce []byte, root string, expiry, now time.Time,
+	again bool) bool {
+	nc.Lock()
+	defer nc.Unlock()
+	nc.prune(now)
+	key := hex.EncodeToString(nonce)
+	if seen, ok := nc.nonces[key]; ok && now.Before(seen.expiry) {
+		if !again || seen.root != root {
+			return false
+		}
+	}
+	nc.nonces[key] = seenNonce{root: root, expiry: expiry}
+	return true
+}
+
+// prune removes the expired nonces. It must be called with the lock held.
+func (nc *nonceCache) prune(now time.Time) {
+	if now.Sub(nc.lastPrune) < time.Minute {
+		return
+	}
+	nc.lastPrune = now
+	for key, seen := range nc.nonces {
+		if !now.Before(seen.expiry) {
+			delete(nc.nonces, key)
+		}
+	}
+}
+
+// checkFresh verifies the signature and the age of a request for the read,
+// to be re-encrypted to xc, and records its nonce for the root. Unsigned
+// requests are refused, except if the configuration allows them.
+func (s *Service) checkFresh(readID byzcoin.InstanceID, xc kyber.Point,
+	timestamp int64, nonce, sig []byte, root string, again bool) error {
+	conf := s.getConfig()
+	if len(sig) == 0 {
+		if !conf.AllowUnsignedDecrypt {
+			return xerrors.New("request must be signed by the reader")
+		}
+		return nil
+	}
+	if len(nonce) != decryptNonceLength {
+		return xerrors.New("wrong nonce length")
+	}
+	now := time.Now()
+	ts := time.Unix(timestamp, 0)
+	if ts.Before(now.Add(-conf.decryptRequestAge())) ||
+		ts.After(now.Add(conf.decryptRequestAge())) {
+		return xerrors.New("request is too old or from the future")
+	}
+	msg := decryptRequestMessage(readID, timestamp, nonce)
+	if err := schnorr.Verify(cothority.Suite, xc, msg, sig); err != nil {
+		return xerrors.Errorf("verifying request signature: %v", err)
+	}
+	if !s.nonces.add(nonce, root, ts.Add(conf.decryptRequestAge()), now,
+		again) {
+		return xerrors.New("request has already been sent")
+	}
+	return nil
+}
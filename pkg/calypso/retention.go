@@ -0,0 +1,131 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A write-instance can be deleted with a byzcoin Delete instruction, if the
+// darc of the write allows delete:calypsoWrite. The retention of the write
+// keeps it from being deleted: RetainUntil is set by the writer and can be
+// extended with the "retain" command, which takes the new time in the
+// "until" argument. The "hold" command places a legal hold on the write,
+// with an optional "reason" argument, and "release" lifts it. The commands
+// are transactions signed by the identities allowed by the darc of the
+// write, so the chain records who placed and lifted every hold.
+//
+// A write under hold can still be read and updated, the held version is
+// kept.
+
+// RetentionArgument returns the "until" argument of the "retain" command.
+func RetentionArgument(until time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(until.Unix()))
+	return buf
+}
+
+// invokeRetention places or lifts a legal hold, or extends the retention
+// of the write.
+func (c ContractWrite) invokeRetention(inst byzcoin.Instruction,
+	darcID darc.ID, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	switch inst.Invoke.Command {
+	case "hold":
+		if c.Write.Hold {
+			return nil, nil, xerrors.New("write is already under legal hold")
+		}
+		c.Write.Hold = true
+		c.Write.HoldReason = string(inst.Invoke.Args.Search("reason"))
+	case "release":
+		if !c.Write.Hold {
+			return nil, nil, xerrors.New("write is not under legal hold")
+		}
+		c.Write.Hold = false
+		c.Write.HoldReason = ""
+	case "retain":
+		buf := inst.Invoke.Args.Search("until")
+		if len(buf) != 8 {
+			return nil, nil, xerrors.New("need an 'until' argument of 8 bytes")
+		}
+		until := int64(binary.LittleEndian.Uint64(buf))
+		if until <= c.Write.RetainUntil {
+			return nil, nil, xerrors.New("the retention can only be extended")
+		}
+		c.Write.RetainUntil = until
+	}
+	buf, err := protobuf.Encode(&c.Write)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("encoding write: %v", err)
+	}
+	log.Warnf("AUDIT: %s of write %x: %s", inst.Invoke.Command,
+		inst.InstanceID[:], c.Write.HoldReason)
+	return byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Update,
+		inst.InstanceID, ContractWriteID, buf, darcID)}, coins, nil
+}
+
+// Delete removes the write-instance, except if it is under legal hold, or
+// if its retention has not expired at the time of the block.
+func (c ContractWrite) Delete(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	if c.Write.Hold {
+		return nil, nil, xerrors.Errorf("write is under legal hold: %s",
+			c.Write.HoldReason)
+	}
+	if c.Write.RetainUntil > 0 {
+		tr, ok := rst.(byzcoin.TimeReader)
+		if !ok || tr.GetCurrentBlockTimestamp()/int64(time.Second) <
+			c.Write.RetainUntil {
+			return nil, nil, xerrors.Errorf("write must be retained until %s",
+				time.Unix(c.Write.RetainUntil, 0).UTC())
+		}
+	}
+	return c.BasicContract.Delete(rst, inst, coins)
+}
+
+// HoldWrite places a legal hold on the write-instance, so that it cannot be
+// deleted until ReleaseWrite is called. The signers need the
+// invoke:calypsoWrite.hold rule of the darc of the write.
+func (c *Client) HoldWrite(writeID byzcoin.InstanceID, reason string,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeWrite(writeID, "hold", byzcoin.Arguments{{Name: "reason",
+		Value: []byte(reason)}}, signers, counters, wait)
+}
+
+// ReleaseWrite lifts the legal hold of the write-instance. The signers need
+// the invoke:calypsoWrite.release rule of the darc of the write.
+func (c *Client) ReleaseWrite(writeID byzcoin.InstanceID,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeWrite(writeID, "release", nil, signers, counters, wait)
+}
+
+// RetainWrite keeps the write-instance from being deleted before the given
+// time. The signers need the invoke:calypsoWrite.retain rule of the darc
+// of the write.
+func (c *Client) RetainWrite(writeID byzcoin.InstanceID, until time.Time,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	return c.invokeWrite(writeID, "retain", byzcoin.Arguments{{Name: "until",
+		Value: RetentionArgument(until)}}, signers, counters, wait)
+}
+
+// DeleteWrite deletes the write-instance. The signers need the
+// delete:calypsoWrite rule of the darc of the write.
+func (c *Client) DeleteWrite(writeID byzcoin.InstanceID,
+	signers []darc.Signer, counters []uint64, wait int) error {
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID:    writeID,
+			Delete:        &byzcoin.Delete{ContractID: ContractWriteID},
+			SignerCounter: counters,
+		},
+	)
+	if err := ctx.FillSignersAndSignWith(signers...); err != nil {
+		return xerrors.Errorf("signing txn: %v", err)
+	}
+	_, err := c.bcClient.AddTransactionAndWait(ctx, wait)
+	return cothority.ErrorOrNil(err, "adding txn")
+}
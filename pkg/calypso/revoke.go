@@ -0,0 +1,270 @@
+package calypso
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// RevokeIdentity is the emergency answer to a compromised reader key. The
+// darcs giving access to the key can only be changed by their owners, which
+// takes time, so the node refuses right away to re-encrypt any secret to
+// the key, or for a read signed by it. As every node of an LTS checks the
+// re-encryption, the key cannot decrypt anything anymore once it is revoked
+// on enough nodes.
+//
+// The reply lists the writes the key read or had access to, found with the
+// identity index of the event log, and the LTSs of these writes, whose
+// shares should be refreshed.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) RevokeIdentity(req *RevokeIdentity) (*RevokeIdentityReply, error) {
+	if req.Key == nil {
+		return nil, xerrors.New("missing key")
+	}
+	key, err := req.Key.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling key: %v", err)
+	}
+	err = s.verifyAdminSignature(revokeMessage(key, req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+
+	ids := keyIdentities(req.Key)
+	s.storage.Lock()
+	for _, id := range ids {
+		if _, ok := s.storage.Revoked[id]; !ok {
+			s.storage.Revoked[id] = time.Now().Unix()
+		}
+	}
+	s.storage.Unlock()
+	if err := s.save(); err != nil {
+		return nil, xerrors.Errorf("saving data: %v", err)
+	}
+	log.Warnf("AUDIT: %v revoked the key %s", s.ServerIdentity(), req.Key)
+
+	reply, err := s.revokedAccess(ids)
+	if err != nil {
+		return nil, xerrors.Errorf("collecting access of key: %v", err)
+	}
+	return reply, nil
+}
+
+// revokedAccess returns the writes the identities read, or had access to
+// through a darc, and the LTSs of these writes.
+func (s *Service) revokedAccess(ids []string) (*RevokeIdentityReply, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	direct, darcs, candidates := s.events.access(ids)
+	reply := &RevokeIdentityReply{}
+	ltss := make(map[byzcoin.InstanceID]bool)
+	for _, e := range candidates {
+		resp, err := bc.GetProof(&byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			Key:     e.WriteID.Slice(),
+			ID:      e.ByzCoinID,
+		})
+		if err != nil {
+			log.Lvlf2("getting proof of write %x: %v", e.WriteID[:], err)
+			continue
+		}
+		if !resp.Proof.InclusionProof.Match(e.WriteID.Slice()) {
+			continue
+		}
+		_, _, _, darcID, err := resp.Proof.KeyValue()
+		if err != nil {
+			return nil, xerrors.Errorf("reading proof: %v", err)
+		}
+		if !direct[e.WriteID] && !darcs[byzcoin.NewInstanceID(darcID)] {
+			continue
+		}
+		var write Write
+		err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding write: %v", err)
+		}
+		reply.Writes = append(reply.Writes, e.WriteID)
+		for _, id := range write.LTSIDs() {
+			if !ltss[id] {
+				ltss[id] = true
+				reply.LTSs = append(reply.LTSs, id)
+			}
+		}
+	}
+	sort.Slice(reply.LTSs, func(i, j int) bool {
+		return reply.LTSs[i].String() < reply.LTSs[j].String()
+	})
+	return reply, nil
+}
+
+// access looks up the events of the identities. It returns the writes they
+// read or decrypted, the darcs giving them access, and one event per write
+// that can be concerned: the writes they read, and, if they got access
+// through a darc, all the writes of the log.
+func (el *eventLog) access(ids []string) (direct, darcs map[byzcoin.InstanceID]bool,
+	candidates []Event) {
+	el.Lock()
+	defer el.Unlock()
+	direct = make(map[byzcoin.InstanceID]bool)
+	darcs = make(map[byzcoin.InstanceID]bool)
+	seen := make(map[byzcoin.InstanceID]bool)
+	for _, id := range ids {
+		for _, c := range el.byIdentity[id] {
+			e := el.Events[c-el.Events[0].Cursor]
+			switch e.Type {
+			case EventRead, EventDecrypt:
+				direct[e.WriteID] = true
+				if !seen[e.WriteID] {
+					seen[e.WriteID] = true
+					candidates = append(candidates, e)
+				}
+			case EventAccessGranted:
+				darcs[e.InstanceID] = true
+			}
+		}
+	}
+	if len(darcs) == 0 {
+		return
+	}
+	for _, e := range el.Events {
+		if e.Type == EventWrite && !seen[e.WriteID] {
+			seen[e.WriteID] = true
+			candidates = append(candidates, e)
+		}
+	}
+	return
+}
+
+// readerOf returns the identity that signed the read of the write, if the
+// event log still holds it.
+func (el *eventLog) readerOf(writeID, readID byzcoin.InstanceID) string {
+	el.Lock()
+	defer el.Unlock()
+	for _, c := range el.byWrite[writeID] {
+		e := el.Events[c-el.Events[0].Cursor]
+		if e.Type == EventRead && e.InstanceID.Equal(readID) {
+			return e.Identity
+		}
+	}
+	return ""
+}
+
+// setSigners records the identities that signed the read, so that the
+// trustees don't depend on their event log to refuse the reads of a revoked
+// signer.
+func (rd *Read) setSigners(inst byzcoin.Instruction) {
+	rd.Signers = nil
+	for _, id := range inst.SignerIdentities {
+		rd.Signers = append(rd.Signers, id.String())
+	}
+}
+
+// checkRevoked returns an error if the key the secret is re-encrypted to, or
+// a signer of the read, has been revoked. For the reads spawned before their
+// signers were recorded, the signer is looked up in the event log, or in the
+// instruction that spawned the read if the event log dropped it.
+func (s *Service) checkRevoked(bcID skipchain.SkipBlockID, xc kyber.Point,
+	read *Read, readID byzcoin.InstanceID) error {
+	s.storage.RLock()
+	revoked := len(s.storage.Revoked) > 0
+	for _, id := range keyIdentities(xc) {
+		if _, ok := s.storage.Revoked[id]; ok {
+			s.storage.RUnlock()
+			return xerrors.Errorf("key %s has been revoked", xc)
+		}
+	}
+	s.storage.RUnlock()
+	if !revoked {
+		return nil
+	}
+	signers := read.Signers
+	if len(signers) == 0 {
+		if reader := s.events.readerOf(read.Write, readID); reader != "" {
+			signers = []string{reader}
+		} else {
+			var err error
+			signers, err = s.readSigners(bcID, readID)
+			if err != nil {
+				return xerrors.Errorf("the signer of the read is unknown: %v", err)
+			}
+		}
+	}
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	for _, signer := range signers {
+		if _, ok := s.storage.Revoked[signer]; ok {
+			return xerrors.Errorf("reader %s has been revoked", signer)
+		}
+	}
+	return nil
+}
+
+// readSigners returns the identities that signed the read, taken from the
+// instruction that spawned it.
+func (s *Service) readSigners(bcID skipchain.SkipBlockID, readID byzcoin.InstanceID) ([]string, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	created, err := bc.GetInstanceVersion(&byzcoin.GetInstanceVersion{
+		SkipChainID: bcID,
+		InstanceID:  readID,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting first version of read: %v", err)
+	}
+	sb, err := s.getBlockByIndex(bcID, created.BlockIndex)
+	if err != nil {
+		return nil, xerrors.Errorf("getting block %d: %v", created.BlockIndex, err)
+	}
+	_, body, err := decodeBlock(sb)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		for _, inst := range tx.ClientTransaction.Instructions {
+			if inst.GetType() != byzcoin.SpawnType ||
+				inst.Spawn.ContractID != ContractReadID {
+				continue
+			}
+			if id, err := inst.DeriveIDArg("", "preID"); err == nil && id.Equal(readID) {
+				var rd Read
+				rd.setSigners(inst)
+				return rd.Signers, nil
+			}
+		}
+	}
+	return nil, xerrors.Errorf("block %d doesn't spawn the read", created.BlockIndex)
+}
+
+// keyIdentities returns the ways a key is written in the event log: as the
+// identity of a signer or of a rule, and as the key a secret is re-encrypted
+// to.
+func keyIdentities(key kyber.Point) []string {
+	return []string{darc.NewIdentityEd25519(key).String(), key.String()}
+}
+
+// revokeMessage returns the message to be signed for a RevokeIdentity
+// request.
+func revokeMessage(key []byte, ts int64) []byte {
+	msg := append([]byte("revoke:"), key...)
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
@@ -0,0 +1,120 @@
+package calypso
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/anon"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// RingProof is stored in the "ring" argument of an anonymous read. Instead
+// of signing the read with a key from the darc of the write, the reader
+// proves with a ring signature that it holds the private key of one of the
+// members of Ring, without revealing which one. The instruction itself is
+// signed by a fresh key that is used only once.
+type RingProof struct {
+	// Ring are the public keys the reader hides among. Every one of them
+	// must be allowed to spawn a read on its own.
+	Ring []kyber.Point
+	// Signature is the ring signature on RingMessage.
+	Signature []byte
+}
+
+// RingMessage returns the message signed by the ring signature of an
+// anonymous read. It binds the signature to the read and to the one-time
+// key signing the instruction.
+func RingMessage(writeID byzcoin.InstanceID, readBuf []byte, signer darc.Identity) []byte {
+	h := sha256.New()
+	h.Write(writeID[:])
+	h.Write(readBuf)
+	h.Write([]byte(signer.String()))
+	return h.Sum(nil)
+}
+
+// verifyRingRead checks an anonymous read. The one-time key must have
+// signed the instruction, and the ring signature must be valid for a ring
+// of which every member satisfies the spawn:calypsoRead rule of the write.
+func (c ContractWrite) verifyRingRead(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte) error {
+	var proof RingProof
+	err := protobuf.DecodeWithConstructors(inst.Spawn.Args.Search("ring"), &proof,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return xerrors.Errorf("decoding ring proof: %v", err)
+	}
+	if len(proof.Ring) == 0 {
+		return xerrors.New("empty ring")
+	}
+
+	if len(inst.SignerIdentities) != 1 || len(inst.Signatures) != 1 {
+		return xerrors.New("an anonymous read must have exactly one signer")
+	}
+	err = byzcoin.VerifySignerCounters(rst, inst.SignerCounter, inst.SignerIdentities)
+	if err != nil {
+		return xerrors.Errorf("signer counter: %v", err)
+	}
+	if err := inst.SignerIdentities[0].Verify(ctxHash, inst.Signatures[0]); err != nil {
+		return xerrors.Errorf("wrong signature: %v", err)
+	}
+
+	expr, getDarc, err := readRule(rst, inst.InstanceID)
+	if err != nil {
+		return err
+	}
+	for _, p := range proof.Ring {
+		id := darc.NewIdentityEd25519(p)
+		if err := darc.EvalExpr(expr, getDarc, id.String()); err != nil {
+			return xerrors.Errorf("%s is not allowed to read: %v", id, err)
+		}
+	}
+
+	msg := RingMessage(inst.InstanceID, inst.Spawn.Args.Search("read"),
+		inst.SignerIdentities[0])
+	_, err = anon.Verify(cothority.Suite, msg, anon.Set(proof.Ring), nil, proof.Signature)
+	return cothority.ErrorOrNil(err, "verifying ring signature")
+}
+
+// readRule returns the spawn:calypsoRead rule of the darc of the write, and
+// a function to look up the darcs the rule refers to.
+func readRule(rst byzcoin.ReadOnlyStateTrie, writeID byzcoin.InstanceID) (expression.Expr, darc.GetDarc, error) {
+	_, _, _, darcID, err := rst.GetValues(writeID.Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("getting write instance: %v", err)
+	}
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("loading darc: %v", err)
+	}
+	expr := d.Rules.Get(darc.Action("spawn:" + ContractReadID))
+	if expr == nil {
+		return nil, nil, xerrors.New("darc has no spawn:calypsoRead rule")
+	}
+	return expr, trieGetDarc(rst), nil
+}
+
+// trieGetDarc returns a function looking up the darcs a rule refers to in
+// the state trie.
+func trieGetDarc(rst byzcoin.ReadOnlyStateTrie) darc.GetDarc {
+	return func(id string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(id, "darc:") {
+			return nil
+		}
+		darcID, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+}
@@ -0,0 +1,127 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+
+	"golang.org/x/xerrors"
+)
+
+// Some readers only have RSA keys, issued by the PKI of their organisation.
+// The writer can wrap the symmetric key of the write for them with
+// RSA-OAEP and SHA-256, and store the wrapped keys in the write, so that
+// they can recover the key without the LTS. The darc of the write, its
+// freezes and its revocations don't apply to these readers, and the nodes
+// cannot check that the wrapped key is the one encrypted for the LTS. So
+// the LTSs of the write must allow it with RSAWrapping, which is set when
+// the LTS is created, and a write with an auditor or a policy cannot hold
+// wrapped keys, as neither could be enforced.
+
+const (
+	// rsaOAEPLabel is the label of the RSA-OAEP encryption of the keys.
+	rsaOAEPLabel = "calypso-rsa-key"
+	// minRSABits is the minimum size of the keys of the RSA readers.
+	minRSABits = 2048
+	// maxRSABits is the maximum size of the keys of the RSA readers.
+	maxRSABits = 8192
+	// maxRSAKeys is the maximum number of RSA readers of a write.
+	maxRSAKeys = 32
+)
+
+// RSAKeyID returns the ID of the public key of an RSA reader, which is the
+// SHA-256 of its PKIX encoding.
+func RSAKeyID(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding public key: %v", err)
+	}
+	id := sha256.Sum256(der)
+	return id[:], nil
+}
+
+// AddRSAReader wraps the symmetric key of the write for the reader with the
+// given RSA public key. It must be called before the write is sent, and
+// all LTSs of the write must allow RSA wrapping.
+func (wr *Write) AddRSAReader(pub *rsa.PublicKey, key []byte) error {
+	if pub.N.BitLen() < minRSABits || pub.N.BitLen() > maxRSABits {
+		return xerrors.Errorf("RSA keys must have between %d and %d bits",
+			minRSABits, maxRSABits)
+	}
+	id, err := RSAKeyID(pub)
+	if err != nil {
+		return err
+	}
+	if _, err := wr.rsaKey(id); err == nil {
+		return xerrors.New("the key is already wrapped for this reader")
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key,
+		[]byte(rsaOAEPLabel))
+	if err != nil {
+		return xerrors.Errorf("wrapping key: %v", err)
+	}
+	wr.RSAKeys = append(wr.RSAKeys, RSAKey{KeyID: id, Key: wrapped})
+	return nil
+}
+
+// RecoverKeyRSA unwraps the symmetric key of the write with the private key
+// of an RSA reader.
+func (wr *Write) RecoverKeyRSA(sk *rsa.PrivateKey) ([]byte, error) {
+	id, err := RSAKeyID(&sk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	rk, err := wr.rsaKey(id)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, sk, rk.Key,
+		[]byte(rsaOAEPLabel))
+	if err != nil {
+		return nil, xerrors.Errorf("unwrapping key: %v", err)
+	}
+	return key, nil
+}
+
+// rsaKey returns the key wrapped for the reader with the given key ID.
+func (wr *Write) rsaKey(id []byte) (*RSAKey, error) {
+	for i := range wr.RSAKeys {
+		if bytes.Equal(wr.RSAKeys[i].KeyID, id) {
+			return &wr.RSAKeys[i], nil
+		}
+	}
+	return nil, xerrors.New("key is not wrapped for this reader")
+}
+
+// verifyRSAKeys checks the wrapped keys of a new write. The LTSs are
+// checked by verifyLTSs.
+func (wr *Write) verifyRSAKeys() error {
+	if len(wr.RSAKeys) == 0 {
+		return nil
+	}
+	if wr.Auditor != nil {
+		return xerrors.New("a write with an auditor cannot wrap its key")
+	}
+	if wr.Policy != "" {
+		return xerrors.New("a write with a policy cannot wrap its key")
+	}
+	if len(wr.RSAKeys) > maxRSAKeys {
+		return xerrors.Errorf("more than %d RSA readers", maxRSAKeys)
+	}
+	seen := make(map[string]bool)
+	for i, rk := range wr.RSAKeys {
+		if len(rk.KeyID) != sha256.Size {
+			return xerrors.Errorf("key ID %d has a wrong length", i)
+		}
+		if seen[string(rk.KeyID)] {
+			return xerrors.Errorf("key %d is wrapped twice for the same reader", i)
+		}
+		seen[string(rk.KeyID)] = true
+		if len(rk.Key) < minRSABits/8 || len(rk.Key) > maxRSABits/8 {
+			return xerrors.Errorf("wrapped key %d has a wrong length", i)
+		}
+	}
+	return nil
+}
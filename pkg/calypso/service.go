@@ -28,27 +28,28 @@
 package calypso
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"golang.org/x/xerrors"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
 	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	dkgprotocol "github.com/calypso-demo/filesharing/pkg/protocols/dkg/pedersen"
 	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/share"
 	dkg "go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
@@ -62,11 +63,16 @@ var calypsoID onet.ServiceID
 // ServiceName of the secret-management part of Calypso.
 const ServiceName = "Calypso"
 
-// dkgTimeout is how long the system waits for the DKG to finish
-const propagationTimeout = 20 * time.Second
-
 const calypsoReshareProto = "calypso_reshare_proto"
 
+// DefaultMaxRequestSize is the maximum size of a marshalled client request.
+// Bigger requests are rejected before they are decoded.
+const DefaultMaxRequestSize = 4 << 20
+
+// MaxDecryptBatch is the maximum number of keys that can be re-encrypted
+// with one DecryptKeys request.
+const MaxDecryptBatch = protocol.MaxBatchSize
+
 var allowInsecureAdmin = false
 
 // Allows one to register custom MakeAttrInterpreters for the read request
@@ -112,17 +118,88 @@ func init() {
 	if err != nil {
 		log.ErrFatal(err)
 	}
+	err = byzcoin.RegisterGlobalContract(ContractCredentialID, contractCredentialFromBytes)
+	if err != nil {
+		log.ErrFatal(err)
+	}
+	err = byzcoin.RegisterGlobalContract(ContractGroupID, contractGroupFromBytes)
+	if err != nil {
+		log.ErrFatal(err)
+	}
+	err = byzcoin.RegisterGlobalContract(ContractRegistryID, contractRegistryFromBytes)
+	if err != nil {
+		log.ErrFatal(err)
+	}
+	// The read rules can be restricted to a window of block times, see
+	// byzcoin.TimeWindow.
+	AddReadAttrInterpreter("time", func(c ContractWrite,
+		rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) func(string) error {
+		return c.MakeAttrInterpreters(rst, inst)["time"]
+	})
 }
 
 // Service is our calypso-service. It stores all created LTSs.
 type Service struct {
 	*onet.ServiceProcessor
-	storage *storage
+	storage  *storage
+	saveLock sync.Mutex
 	// Genesis blocks are stored here instead of the usual skipchain DB as we
 	// don't want to override authorized skipchains or related security. The
 	// blocks are only used to insure that proofs start with the expected roster.
 	genesisBlocks     map[string]*skipchain.SkipBlock
 	genesisBlocksLock sync.Mutex
+	// stats holds the per-document statistics, which are updated from the
+	// blocks of all followed chains.
+	stats         *statistics
+	events        *eventLog
+	statsJournal  *journal
+	eventsJournal *journal
+	// verifiedJournal holds the blocks added to storage.VerifiedBlocks
+	// since it has been saved.
+	verifiedJournal *journal
+	following       map[string]bool
+	followingLock   sync.Mutex
+	// handlingLock makes sure that a block is handled only once.
+	handlingLock sync.Mutex
+	// ipLimiter and keyLimiter limit the decryption requests per IP
+	// address and per public key of the reader.
+	ipLimiter  *rateLimiter
+	keyLimiter *rateLimiter
+	// nonces holds the nonces of the recent signed decryption requests.
+	nonces *nonceCache
+	// trees holds the statistics used to choose the nodes of the
+	// re-encryptions.
+	trees *treeStats
+	// decrypting is the number of decryptions in progress.
+	decrypting int32
+	// config holds the settings that can be reloaded from configFile.
+	config     ServiceConfig
+	configFile string
+	configLock sync.Mutex
+	// consistency is the report of the last consistency check.
+	consistency     *ConsistencyReport
+	consistencyLock sync.Mutex
+	// repairs are the latest repairs of corrupted blocks, and repairing
+	// the blocks being repaired.
+	repairs     []BlockRepair
+	repairing   map[string]bool
+	repairsLock sync.Mutex
+	// reconciling holds the LTSs whose share is being recovered.
+	reconciling     map[byzcoin.InstanceID]bool
+	reconcilingLock sync.Mutex
+	// tokenWrites holds the write-instances of the tokens being added,
+	// with the channel closed once they are done.
+	tokenWrites     map[byzcoin.InstanceID]chan struct{}
+	tokenWritesLock sync.Mutex
+	// webhooks sends the notifications of reads and decryptions.
+	webhooks *webhookQueue
+	// closing is closed by TestClose to stop the go-routines of the
+	// service.
+	closing   chan struct{}
+	closeOnce sync.Once
+	// timers are the timers of the tasks run regularly, see schedule.
+	timers     map[string]*time.Timer
+	timersLock sync.Mutex
 	// for use by testing only
 	afterReshare func()
 }
@@ -140,6 +217,17 @@ type vData struct {
 	Proof     byzcoin.Proof
 	Ephemeral kyber.Point
 	Signature *darc.Signature
+	// Opening is the opening of a blinded read.
+	Opening *ReadOpening `protobuf:"opt"`
+	// Write is the proof of the write, so that the nodes can check the
+	// point they re-encrypt.
+	Write *byzcoin.Proof `protobuf:"opt"`
+	// Timestamp, Nonce and RequestSig come from a signed request.
+	Timestamp  int64  `protobuf:"opt"`
+	Nonce      []byte `protobuf:"opt"`
+	RequestSig []byte `protobuf:"opt"`
+	// Group is the proof of the reader group of the read.
+	Group *byzcoin.Proof `protobuf:"opt"`
 }
 
 // AddReadAttrInterpreter adds a new AttrInterpreters that will be evaluated
@@ -153,8 +241,17 @@ func AddReadAttrInterpreter(name string, interpreter func(c ContractWrite,
 
 // ProcessClientRequest implements onet.Service. We override the version
 // we normally get from embeddeding onet.ServiceProcessor in order to
-// hook it and get a look at the http.Request.
+// hook it and get a look at the http.Request, to reject requests that are
+// too big before decoding them, and to check the client certificates.
 func (s *Service) ProcessClientRequest(req *http.Request, path string, buf []byte) ([]byte, *onet.StreamingTunnel, error) {
+	maxSize := s.getConfig().maxRequestSize(path)
+	if len(buf) > maxSize {
+		return nil, nil, xerrors.Errorf("request of %d bytes is bigger than %d bytes",
+			len(buf), maxSize)
+	}
+	if err := s.checkClientTLS(req, path, buf); err != nil {
+		return nil, nil, xerrors.Errorf("checking TLS: %v", err)
+	}
 
 	if !allowInsecureAdmin && path == "Authorise" {
 		h, _, err := net.SplitHostPort(req.RemoteAddr)
@@ -168,6 +265,15 @@ func (s *Service) ProcessClientRequest(req *http.Request, path string, buf []byt
 			return nil, nil, xerrors.New("authorise is only allowed on loopback")
 		}
 	}
+	if rateLimitPaths[path] {
+		h, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("splitting host port: %v", err)
+		}
+		if !s.ipLimiter.allow(h, time.Now()) {
+			return nil, nil, ErrorRateLimited
+		}
+	}
 	return s.ServiceProcessor.ProcessClientRequest(req, path, buf)
 }
 
@@ -187,12 +293,14 @@ func (s *Service) Authorise(req *Authorise) (*AuthoriseReply, error) {
 		return nil, xerrors.New("ByzCoinID already authorised")
 	}
 	s.storage.AuthorisedByzCoinIDs[bcID] = true
+	s.storage.forgetVerifiedBlocks(bcID)
 	s.storage.Unlock()
 
 	err := s.save()
 	if err != nil {
 		return nil, xerrors.Errorf("saving data: %v", err)
 	}
+	s.followChain(req.ByzCoinID)
 	log.Lvl1("Stored ByzCoinID")
 	return &AuthoriseReply{}, err
 }
@@ -209,23 +317,20 @@ func (s *Service) Authorize(req *Authorize) (*AuthorizeReply, error) {
 		return nil, xerrors.New("empty ByzCoin ID")
 	}
 
-	if !allowInsecureAdmin {
-		if len(req.Signature) == 0 {
-			return nil, xerrors.New("no signature provided")
-		}
-		if math.Abs(time.Now().Sub(time.Unix(req.Timestamp, 0)).Seconds()) > 60 {
-			return nil, xerrors.New("signature is too old")
-		}
-		msg := append(req.ByzCoinID, make([]byte, 8)...)
-		binary.LittleEndian.PutUint64(msg[32:], uint64(req.Timestamp))
-		err := schnorr.Verify(cothority.Suite, s.ServerIdentity().Public, msg, req.Signature)
-		if err != nil {
-			return nil, xerrors.Errorf("signature verification failed: %v", err)
-		}
+	msg := authorizeMessage(req.ByzCoinID, req.Roster, req.Namespace, req.Timestamp)
+	if err := s.verifyAdminSignature(msg, req.Timestamp, req.Signature); err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+	if req.Roster != nil && len(req.Roster.List) == 0 {
+		return nil, xerrors.New("empty roster")
 	}
 
 	s.storage.Lock()
 	bcID := string(req.ByzCoinID)
+	if _, ok := s.storage.Namespaces[req.Namespace]; !ok && req.Namespace != "" {
+		s.storage.Unlock()
+		return nil, xerrors.New("unknown namespace")
+	}
 	if _, ok := s.storage.AuthorisedByzCoinIDs[bcID]; ok {
 		s.storage.Unlock()
 		// This error string is tested against in
@@ -235,16 +340,47 @@ func (s *Service) Authorize(req *Authorize) (*AuthorizeReply, error) {
 		return nil, xerrors.New("ByzCoinID already authorised")
 	}
 	s.storage.AuthorisedByzCoinIDs[bcID] = true
+	s.storage.forgetVerifiedBlocks(bcID)
+	if req.Namespace != "" {
+		s.storage.ByzCoinNamespaces[bcID] = req.Namespace
+	}
+	if req.Roster != nil {
+		s.storage.ExternalRosters[bcID] = req.Roster
+	}
 	s.storage.Unlock()
 
 	err := s.save()
 	if err != nil {
 		return nil, xerrors.Errorf("saving data: %v", err)
 	}
+	s.followChain(req.ByzCoinID)
 	log.Lvl1("Stored ByzCoinID")
 	return &AuthorizeReply{}, nil
 }
 
+// authorizeMessage returns the message to be signed for an Authorize
+// request. The roster and the namespace are only part of it if they are
+// given, so that the signatures of the other requests don't change.
+func authorizeMessage(bcID skipchain.SkipBlockID, roster *onet.Roster, ns string,
+	ts int64) []byte {
+	msg := append(append([]byte{}, bcID...), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(bcID):], uint64(ts))
+	if roster != nil {
+		h := sha256.New()
+		for _, si := range roster.List {
+			h.Write([]byte(si.Address))
+			if buf, err := si.Public.MarshalBinary(); err == nil {
+				h.Write(buf)
+			}
+		}
+		msg = append(msg, h.Sum(nil)...)
+	}
+	if ns != "" {
+		msg = append(msg, []byte("namespace:"+ns)...)
+	}
+	return msg
+}
+
 // CreateLTS takes as input a roster with a list of all nodes that should
 // participate in the DKG. Every node will store its private key and wait for
 // decryption requests. The LTSID should be the InstanceID.
@@ -252,11 +388,18 @@ func (s *Service) CreateLTS(req *CreateLTS) (reply *CreateLTSReply, err error) {
 	if err := s.verifyProof(&req.Proof); err != nil {
 		return nil, xerrors.Errorf("verifying proof: %v", err)
 	}
+	if err := s.checkNamespace(req.Proof.Latest.SkipChainID(), req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
 
-	roster, instID, err := s.getLtsRoster(&req.Proof)
+	info, instID, err := s.getLtsInfo(&req.Proof)
 	if err != nil {
 		return nil, xerrors.Errorf("get roster: %v", err)
 	}
+	roster := &info.Roster
+	if err := s.checkNamespaceRoster(req.Namespace, roster); err != nil {
+		return nil, xerrors.Errorf("checking roster: %v", err)
+	}
 
 	// NOTE: the roster stored in ByzCoin must have myself.
 	tree := roster.GenerateNaryTreeWithRoot(len(roster.List), s.ServerIdentity())
@@ -264,8 +407,11 @@ func (s *Service) CreateLTS(req *CreateLTS) (reply *CreateLTSReply, err error) {
 		log.Error("cannot create tree with roster", roster.List)
 		return nil, xerrors.New("error while generating tree")
 	}
+	cothority.LogTrace(req.TraceID, s.ServerIdentity(), "create_lts_request", nil)
 	cfg := newLtsConfig{
 		req.Proof,
+		req.TraceID,
+		req.Namespace,
 	}
 	cfgBuf, err := protobuf.Encode(&cfg)
 	if err != nil {
@@ -277,6 +423,12 @@ func (s *Service) CreateLTS(req *CreateLTS) (reply *CreateLTSReply, err error) {
 	}
 	setupDKG := pi.(*dkgprotocol.Setup)
 	setupDKG.Wait = true
+	setupDKG.TraceID = req.TraceID
+	setupDKG.Threshold = uint32(info.Threshold())
+	setupDKG.Weights, err = info.weightsOf(tree.Roster)
+	if err != nil {
+		return nil, xerrors.Errorf("getting weights: %v", err)
+	}
 	err = setupDKG.SetConfig(&onet.GenericConfig{Data: cfgBuf})
 	if err != nil {
 		return nil, xerrors.Errorf("set dkg config: %v", err)
@@ -305,13 +457,19 @@ func (s *Service) CreateLTS(req *CreateLTS) (reply *CreateLTSReply, err error) {
 		s.storage.Rosters[instID] = roster
 		s.storage.Replies[instID] = reply
 		s.storage.DKS[instID] = dks
+		s.storage.Holders[instID] = setupDKG.Roster()
+		s.storage.setLTSNamespace(instID, req.Namespace)
+		s.storage.setWeights(instID, info.Weights)
 		s.storage.Unlock()
 		err = s.save()
 		if err != nil {
 			return nil, xerrors.Errorf("save dkg state: %v", err)
 		}
 		log.Lvlf2("%v Created LTS with ID: %v, pk %v", s.ServerIdentity(), instID, reply.X)
-	case <-time.After(propagationTimeout):
+		cothority.LogTrace(req.TraceID, s.ServerIdentity(), "create_lts_done", nil)
+	case <-time.After(s.getConfig().propagationTimeout()):
+		cothority.LogTrace(req.TraceID, s.ServerIdentity(), "create_lts_done",
+			xerrors.New("timeout"))
 		return nil, xerrors.New("new-dkg didn't finish in time")
 	}
 	return
@@ -329,11 +487,23 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 	if err := s.verifyProof(&req.Proof); err != nil {
 		return nil, xerrors.Errorf("verifying proof: %v", err)
 	}
+	if err := s.checkNamespace(req.Proof.Latest.SkipChainID(), req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+	if err := s.checkNamespaceRoster(req.Namespace, roster); err != nil {
+		return nil, xerrors.Errorf("checking roster: %v", err)
+	}
+	if err := s.checkLTSNamespace(id, req.Proof.Latest.SkipChainID()); err != nil {
+		return nil, xerrors.Errorf("checking namespace of LTS: %v", err)
+	}
+	if err := s.checkUnweighted(id); err != nil {
+		return nil, xerrors.Errorf("cannot reshare: %v", err)
+	}
 
 	// Initialise the protocol
 	setupDKG, err := func() (*dkgprotocol.Setup, error) {
-		s.storage.Lock()
-		defer s.storage.Unlock()
+		s.storage.RLock()
+		defer s.storage.RUnlock()
 
 		// Check that we know the shared secret, otherwise don't do re-sharing
 		if s.storage.Shared[id] == nil || s.storage.DKS[id] == nil {
@@ -346,8 +516,9 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 			Proof: req.Proof,
 			// We pass the public coefficients out with the protocol,
 			// because new nodes will need it for their dkg.Config.PublicCoeffs.
-			Commits:  s.storage.DKS[id].Commits,
-			OldNodes: s.storage.Rosters[id].Publics(),
+			Commits:   s.storage.DKS[id].Commits,
+			OldNodes:  s.storage.Rosters[id].Publics(),
+			Namespace: req.Namespace,
 		}
 		cfgBuf, err := protobuf.Encode(&cfg)
 		if err != nil {
@@ -376,8 +547,8 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 			OldNodes:     s.storage.Rosters[id].Publics(),
 			NewNodes:     roster.Publics(),
 			Share:        s.storage.DKS[id],
-			Threshold:    n - (n-1)/3,
-			OldThreshold: oldn - (oldn-1)/3,
+			Threshold:    LTSThreshold(n),
+			OldThreshold: LTSThreshold(oldn),
 		}
 		setupDKG.NewDKG = func() (*dkg.DistKeyGenerator, error) {
 			d, err := dkg.NewDistKeyHandler(c)
@@ -417,6 +588,7 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 		s.storage.Polys[id] = &pubPoly{s.Suite().Point().Base(), dks.Commits}
 		s.storage.Rosters[id] = roster
 		s.storage.DKS[id] = dks
+		s.storage.Holders[id] = roster
 		s.storage.Unlock()
 		err = s.save()
 		if err != nil {
@@ -425,7 +597,7 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 		if s.afterReshare != nil {
 			s.afterReshare()
 		}
-	case <-time.After(propagationTimeout):
+	case <-time.After(s.getConfig().propagationTimeout()):
 		return nil, xerrors.New("resharing-dkg didn't finish in time")
 	}
 
@@ -436,22 +608,70 @@ func (s *Service) ReshareLTS(req *ReshareLTS) (*ReshareLTSReply, error) {
 
 func (s *Service) verifyProof(proof *byzcoin.Proof) error {
 	scID := proof.Latest.SkipChainID()
-	s.storage.Lock()
-	defer s.storage.Unlock()
-	if _, ok := s.storage.AuthorisedByzCoinIDs[string(scID)]; !ok {
+	s.storage.RLock()
+	_, ok := s.storage.AuthorisedByzCoinIDs[string(scID)]
+	s.storage.RUnlock()
+	if !ok {
 		return xerrors.New("this ByzCoin ID is not authorised")
 	}
 
+	if s.blockVerified(scID, &proof.Latest) {
+		return cothority.ErrorOrNil(proof.VerifyInclusionProof(&proof.Latest),
+			"verifying inclusion proof")
+	}
+
 	sb, err := s.fetchGenesisBlock(scID, proof.Links[0].NewRoster)
 	if err != nil {
 		return xerrors.Errorf("fetching genesis block: %v", err)
 	}
 
-	return cothority.ErrorOrNil(proof.VerifyFromBlock(sb),
-		"verifying proof from block")
+	if err := proof.VerifyFromBlock(sb); err != nil {
+		return xerrors.Errorf("verifying proof from block: %v", err)
+	}
+	s.addVerifiedBlock(scID, &proof.Latest)
+	return nil
+}
+
+// maxVerifiedBlocks is the number of verified blocks kept in the storage.
+// Once it is reached, the cache is emptied.
+const maxVerifiedBlocks = 1024
+
+// blockVerified returns true if the forward links up to the block have
+// already been verified. The hash of the block is calculated again, so a
+// block with a wrong hash is not taken for a verified one.
+func (s *Service) blockVerified(scID skipchain.SkipBlockID, sb *skipchain.SkipBlock) bool {
+	hash := sb.CalculateHash()
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	id, ok := s.storage.VerifiedBlocks[string(hash)]
+	return ok && id == string(scID)
+}
+
+// addVerifiedBlock stores that the forward links up to the block have been
+// verified. The block is appended to the journal of the verified blocks,
+// instead of saving the whole storage.
+func (s *Service) addVerifiedBlock(scID skipchain.SkipBlockID, sb *skipchain.SkipBlock) {
+	hash := string(sb.CalculateHash())
+	s.storage.Lock()
+	if _, ok := s.storage.VerifiedBlocks[hash]; ok {
+		s.storage.Unlock()
+		return
+	}
+	if len(s.storage.VerifiedBlocks) >= maxVerifiedBlocks {
+		s.storage.VerifiedBlocks = make(map[string]string)
+	}
+	s.storage.VerifiedBlocks[hash] = string(scID)
+	s.storage.Unlock()
+	if err := s.journalVerifiedBlock([]byte(hash), scID); err != nil {
+		log.Error(err)
+	}
 }
 
 func (s *Service) fetchGenesisBlock(scID skipchain.SkipBlockID, roster *onet.Roster) (*skipchain.SkipBlock, error) {
+	// In light mode, only the cothority hosting the chain is asked.
+	if external := s.externalRoster(scID); external != nil {
+		roster = external
+	}
 	s.genesisBlocksLock.Lock()
 	defer s.genesisBlocksLock.Unlock()
 	sb := s.genesisBlocks[string(scID)]
@@ -464,6 +684,9 @@ func (s *Service) fetchGenesisBlock(scID skipchain.SkipBlockID, roster *onet.Ros
 	if err != nil {
 		return nil, xerrors.Errorf("getting single block: %v", err)
 	}
+	if !sb.CalculateHash().Equal(scID) {
+		return nil, xerrors.New("genesis block doesn't match its ID")
+	}
 
 	// Genesis block can be reused later on.
 	s.genesisBlocks[string(scID)] = sb
@@ -472,6 +695,15 @@ func (s *Service) fetchGenesisBlock(scID skipchain.SkipBlockID, roster *onet.Ros
 }
 
 func (s *Service) getLtsRoster(proof *byzcoin.Proof) (*onet.Roster, byzcoin.InstanceID, error) {
+	info, id, err := s.getLtsInfo(proof)
+	if err != nil {
+		return nil, byzcoin.InstanceID{}, err
+	}
+	return &info.Roster, id, nil
+}
+
+// getLtsInfo returns the information of the LTS instance of the proof.
+func (s *Service) getLtsInfo(proof *byzcoin.Proof) (*LtsInstanceInfo, byzcoin.InstanceID, error) {
 	instanceID, buf, _, _, err := proof.KeyValue()
 	if err != nil {
 		return nil, byzcoin.InstanceID{},
@@ -484,7 +716,7 @@ func (s *Service) getLtsRoster(proof *byzcoin.Proof) (*onet.Roster, byzcoin.Inst
 		return nil, byzcoin.InstanceID{},
 			xerrors.Errorf("decoding roster: %v", err)
 	}
-	return &info.Roster, byzcoin.NewInstanceID(instanceID), nil
+	return &info, byzcoin.NewInstanceID(instanceID), nil
 }
 
 // DecryptKey takes as an input a Read- and a Write-proof. Proofs contain
@@ -494,79 +726,353 @@ func (s *Service) getLtsRoster(proof *byzcoin.Proof) (*onet.Roster, byzcoin.Inst
 // requests match and then re-encrypts the secret to the public key given
 // in the Read-instance.
 func (s *Service) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error) {
-	reply = &DecryptKeyReply{}
 	log.Lvl2(s.ServerIdentity(), "Re-encrypt the key to the public key of the reader")
+	replies, err := s.decryptKeys([]*DecryptKey{dkr}, dkr.Strategy,
+		dkr.TraceID, dkr.Partial)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
 
-	var read Read
-	if err := dkr.Read.VerifyAndDecode(cothority.Suite, ContractReadID, &read); err != nil {
-		return nil, xerrors.New("didn't get a read instance: " + err.Error())
+// DecryptKeys works like DecryptKey for several pairs of Read- and
+// Write-proofs, but re-encrypts all secrets in one round of the
+// ocs-protocol. All writes must use the same LTS.
+func (s *Service) DecryptKeys(req *DecryptKeys) (*DecryptKeysReply, error) {
+	log.Lvl2(s.ServerIdentity(), "Re-encrypt", len(req.Requests),
+		"keys to the public keys of the readers")
+	if len(req.Requests) == 0 {
+		return nil, xerrors.New("no requests given")
+	}
+	if len(req.Requests) > MaxDecryptBatch {
+		return nil, xerrors.Errorf("cannot decrypt more than %d keys at once",
+			MaxDecryptBatch)
+	}
+	dkrs := make([]*DecryptKey, len(req.Requests))
+	for i := range req.Requests {
+		dkrs[i] = &req.Requests[i]
+	}
+	replies, err := s.decryptKeys(dkrs, req.Strategy, req.TraceID,
+		req.Partial)
+	if err != nil {
+		return nil, err
+	}
+	reply := &DecryptKeysReply{}
+	for _, r := range replies {
+		reply.Replies = append(reply.Replies, *r)
+	}
+	return reply, nil
+}
+
+// verifyDecryptKey checks that the read and the write of the request match
+// and come from an authorized ByzCoin instance.
+func (s *Service) verifyDecryptKey(dkr *DecryptKey) (*Read, *Write, error) {
+	read, err := decodeReadProof(&dkr.Read)
+	if err != nil {
+		return nil, nil, xerrors.New("didn't get a read instance: " + err.Error())
+	}
+	if err := read.open(dkr.Opening); err != nil {
+		return nil, nil, xerrors.Errorf("opening blinded read: %v", err)
+	}
+	err = s.delegateRead(dkr.Read.Latest.SkipChainID(), read,
+		byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("delegating read: %v", err)
 	}
 
 	var write Write
 	if err := dkr.Write.VerifyAndDecode(cothority.Suite, ContractWriteID, &write); err != nil {
-		return nil, xerrors.New("didn't get a write instance: " + err.Error())
+		return nil, nil, xerrors.New("didn't get a write instance: " + err.Error())
 	}
 	if !read.Write.Equal(byzcoin.NewInstanceID(dkr.Write.InclusionProof.Key())) {
-		return nil, xerrors.New("read doesn't point to passed write")
+		return nil, nil, xerrors.New("read doesn't point to passed write")
 	}
-	s.storage.Lock()
-	id := write.LTSID
-	roster := s.storage.Rosters[id]
-	if roster == nil {
-		s.storage.Unlock()
-		return nil,
-			xerrors.Errorf("don't know the LTSID '%v' stored in write", id)
+	if _, err := write.GetSuite(); err != nil {
+		return nil, nil, xerrors.Errorf("checking suite of write: %v", err)
 	}
-	s.storage.Unlock()
 
-	if err = s.verifyProof(&dkr.Read); err != nil {
-		return nil, xerrors.Errorf(
+	if err := s.verifyProof(&dkr.Read); err != nil {
+		return nil, nil, xerrors.Errorf(
 			"read proof cannot be verified to come from scID: %v",
 			err)
 	}
-	if err = s.verifyProof(&dkr.Write); err != nil {
-		return nil, xerrors.Errorf(
+	if err := s.checkNamespace(dkr.Read.Latest.SkipChainID(), dkr.Namespace); err != nil {
+		return nil, nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+	if err := s.checkNamespace(dkr.Write.Latest.SkipChainID(), dkr.Namespace); err != nil {
+		return nil, nil, xerrors.Errorf("checking namespace of write: %v", err)
+	}
+	if err := s.verifyProof(&dkr.Write); err != nil {
+		return nil, nil, xerrors.Errorf(
 			"write proof cannot be verified to come from scID: %v",
 			err)
 	}
+	return read, &write, nil
+}
 
-	// Start ocs-protocol to re-encrypt the file's symmetric key under the
-	// reader's public key.
-	nodes := len(roster.List)
-	threshold := nodes - (nodes-1)/3
-	tree := roster.GenerateNaryTreeWithRoot(nodes, s.ServerIdentity())
-	pi, err := s.CreateProtocol(protocol.NameOCS, tree)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to create ocs-protocol: %v", err)
+// chooseKey returns the encryption of the key of the write for the given
+// LTS, or, if ltsid is nil, for the first LTS this node holds a share of.
+func (s *Service) chooseKey(write *Write, ltsid *byzcoin.InstanceID) (*WriteKey, error) {
+	if ltsid != nil {
+		return write.Key(*ltsid)
 	}
-	ocsProto := pi.(*protocol.OCS)
-	ocsProto.U = write.U
-	verificationData := &vData{
-		Proof: dkr.Read,
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	for _, id := range write.LTSIDs() {
+		if s.storage.Rosters[id] != nil {
+			return write.Key(id)
+		}
 	}
-	ocsProto.Xc = read.Xc
-	log.Lvlf2("%v Public key is: %s", s.ServerIdentity(), ocsProto.Xc)
-	ocsProto.VerificationData, err = protobuf.Encode(verificationData)
-	if err != nil {
+	return write.Key(write.LTSID)
+}
+
+// decryptKeys verifies all requests and re-encrypts their secrets in one
+// run of the ocs-protocol, so the tree is only set up once. The nodes of the
+// tree are chosen by the strategy with the given name. The traceID is passed
+// on to all nodes of the protocol. If partial is true and not enough shares
+// can be collected before the DecryptTimeout, the collected shares are
+// returned in partial replies instead of an error.
+func (s *Service) decryptKeys(dkrs []*DecryptKey, strategy, traceID string,
+	partial bool) (replies []*DecryptKeyReply, err error) {
+	start := time.Now()
+	atomic.AddInt32(&s.decrypting, int32(len(dkrs)))
+	defer atomic.AddInt32(&s.decrypting, -int32(len(dkrs)))
+	cothority.LogTrace(traceID, s.ServerIdentity(), "decrypt_request", nil)
+	defer func() {
+		cothority.LogTrace(traceID, s.ServerIdentity(), "decrypt_done", err)
+	}()
+	reads := make([]*Read, len(dkrs))
+	keys := make([]*WriteKey, len(dkrs))
+	for i, dkr := range dkrs {
+		read, write, err := s.verifyDecryptKey(dkr)
+		if err == nil {
+			err = s.checkRevoked(dkr.Read.Latest.SkipChainID(), read.Xc, read,
+				byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()))
+		}
+		if err == nil {
+			err = s.checkFrozen(dkr.Write.Latest.SkipChainID(), read.Write)
+		}
+		if err == nil {
+			err = s.checkGroupMember(read, &dkr.Read, dkr.Group)
+		}
+		if err == nil {
+			err = s.checkReadExpiry(read, &dkr.Read)
+		}
+		if err == nil {
+			err = s.checkFresh(byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()),
+				read.Xc, dkr.Timestamp, dkr.Nonce, dkr.Signature,
+				s.ServerIdentity().ID.String(), false)
+		}
+		if err == nil {
+			keys[i], err = s.chooseKey(write, dkr.LTSID)
+		}
+		if err == nil {
+			err = s.checkLTSNamespace(keys[i].LTSID, dkr.Read.Latest.SkipChainID())
+		}
+		if err != nil {
+			if len(dkrs) > 1 {
+				return nil, xerrors.Errorf("request %d: %v", i, err)
+			}
+			return nil, err
+		}
+		if i > 0 && !keys[i].LTSID.Equal(keys[0].LTSID) {
+			return nil, xerrors.New("all writes must use the same LTS")
+		}
+		if !s.keyLimiter.allow(read.Xc.String(), start) {
+			return nil, ErrorRateLimited
+		}
+		reads[i] = read
+	}
+
+	s.storage.RLock()
+	id := keys[0].LTSID
+	roster := s.storage.Rosters[id]
+	if roster == nil {
+		s.storage.RUnlock()
 		return nil,
-			xerrors.Errorf("couldn't marshal verification data: %v", err)
+			xerrors.Errorf("don't know the LTSID '%v' stored in write", id)
+	}
+	s.storage.RUnlock()
+	cothority.LogTrace(traceID, s.ServerIdentity(), "decrypt_verified", nil)
+
+	// Start ocs-protocol to re-encrypt the file's symmetric key under the
+	// reader's public key.
+	nodes := len(roster.List)
+	shares, weights := s.ltsShares(id, roster)
+	threshold := LTSThreshold(shares)
+	asked := treeNodes(roster, threshold, weights)
+	var requests []*protocol.Reencrypt
+	for i, dkr := range dkrs {
+		verificationData, err := protobuf.Encode(&vData{
+			Proof:      dkr.Read,
+			Opening:    dkr.Opening,
+			Write:      &dkr.Write,
+			Timestamp:  dkr.Timestamp,
+			Nonce:      dkr.Nonce,
+			RequestSig: dkr.Signature,
+			Group:      dkr.Group,
+		})
+		if err != nil {
+			return nil,
+				xerrors.Errorf("couldn't marshal verification data: %v", err)
+		}
+		log.Lvlf2("%v Public key is: %s", s.ServerIdentity(), reads[i].Xc)
+		requests = append(requests, &protocol.Reencrypt{
+			U:                keys[i].U,
+			Xc:               reads[i].Xc,
+			VerificationData: &verificationData,
+		})
 	}
 
 	// Make sure everything used from the s.Storage structure is copied, so
 	// there will be no races.
-	s.storage.Lock()
-	ocsProto.Shared = s.storage.Shared[id]
+	s.storage.RLock()
+	shared := s.storage.Shared[id]
 	pp := s.storage.Polys[id]
-	reply.X = s.storage.Shared[id].X.Clone()
+	X := shared.X.Clone()
 	var commits []kyber.Point
 	for _, c := range pp.Commits {
 		commits = append(commits, c.Clone())
 	}
-	ocsProto.Poly = share.NewPubPoly(s.Suite(), pp.B.Clone(), commits)
-	s.storage.Unlock()
+	poly := share.NewPubPoly(s.Suite(), pp.B.Clone(), commits)
+	s.storage.RUnlock()
+
+	tree, err := s.decryptionTree(roster, strategy, asked)
+	if err != nil {
+		return nil, xerrors.Errorf("choosing nodes: %v", err)
+	}
+	var ocsProto *protocol.OCS
+	var failures []NodeFailure
+	var reencryptErr error
+	deadline := start.Add(s.getConfig().decryptTimeout())
+	failed := make(map[network.ServerIdentityID]bool)
+	for {
+		ocsProto, reencryptErr = s.reencrypt(tree, id, requests, shared, poly,
+			shares, threshold, weights, time.Until(deadline), traceID)
+		if ocsProto != nil {
+			failures = appendFailures(failures, ocsProto.Report)
+			s.addBlames(dkrs[0].Read.Latest.SkipChainID(), id,
+				ocsProto.Blames)
+		}
+		if reencryptErr == nil {
+			break
+		}
+		if len(tree.Roster.List) == nodes || ocsProto == nil ||
+			!time.Now().Before(deadline) {
+			if partial && ocsProto != nil {
+				break
+			}
+			return nil, reencryptErr
+		}
+		report := ocsProto.Report
+		for _, list := range [][]*network.ServerIdentity{report.Unresponsive,
+			report.Refused, report.Invalid, report.BadWrite} {
+			for _, si := range list {
+				failed[si.ID] = true
+			}
+		}
+		tree = s.widenTree(roster, tree, strategy, asked, failed)
+		log.Lvlf2("%v asking %d nodes after: %v", s.ServerIdentity(),
+			len(tree.Roster.List), reencryptErr)
+	}
+
+	batchUis, batchProofs := ocsProto.BatchUis, ocsProto.BatchProofs
+	if reencryptErr != nil {
+		log.Lvl2(s.ServerIdentity(), "returning partial shares:", reencryptErr)
+		batchUis, batchProofs = ocsProto.PartialShares()
+	}
+	replies = make([]*DecryptKeyReply, len(dkrs))
+	for i := range dkrs {
+		reply := &DecryptKeyReply{X: X, C: keys[i].C, Commits: commits,
+			Partial: reencryptErr != nil, Failures: failures}
+		if !reply.Partial {
+			reply.XhatEnc, err = share.RecoverCommit(cothority.Suite,
+				batchUis[i], threshold, shares)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to recover commit: %v", err)
+			}
+		}
+		if i < len(batchUis) {
+			for j, ui := range batchUis[i] {
+				if ui == nil {
+					continue
+				}
+				reply.Uis = append(reply.Uis, ui)
+				reply.Proofs = append(reply.Proofs, *batchProofs[i][j])
+			}
+		}
+		if err := s.signDecryptKeyReply(dkrs[i], reply); err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	if reencryptErr != nil {
+		return replies, nil
+	}
+
+	now := time.Now()
+	decrypts := make([]Event, len(dkrs))
+	for i, dkr := range dkrs {
+		s.stats.addDecrypt(dkr.Read.Latest.SkipChainID(), reads[i].Write,
+			start, now)
+		decrypts[i] = Event{
+			Type:       EventDecrypt,
+			Timestamp:  now.UnixNano(),
+			ByzCoinID:  dkr.Read.Latest.SkipChainID(),
+			BlockIndex: -1,
+			InstanceID: byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()),
+			WriteID:    reads[i].Write,
+			Identity:   reads[i].identity(),
+		}
+	}
+	s.events.add(decrypts...)
+	if err := s.saveStats(); err != nil {
+		log.Error(err)
+	}
+	if err := s.saveEvents(); err != nil {
+		log.Error(err)
+	}
+	s.notifyWebhooks(decrypts, nil)
+	log.Lvl3("Successfully reencrypted the key")
+	return replies, nil
+}
+
+// reencrypt runs the ocs-protocol on the tree for the LTS with the given
+// ID, and returns it once enough shares have been collected. The weights
+// are the number of shares of the nodes holding more than one. The statistics
+// of the nodes are updated with the reply times. If the protocol ran but
+// didn't collect enough shares before the timeout, it is returned together
+// with the error, so that its report can be used.
+func (s *Service) reencrypt(tree *onet.Tree, id byzcoin.InstanceID,
+	requests []*protocol.Reencrypt, shared *dkgprotocol.SharedSecret,
+	poly *share.PubPoly, shares, threshold int,
+	weights map[network.ServerIdentityID]int, timeout time.Duration,
+	traceID string) (*protocol.OCS, error) {
+	pi, err := s.CreateProtocol(protocol.NameOCS, tree)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create ocs-protocol: %v", err)
+	}
+	ocsProto := pi.(*protocol.OCS)
+	ocsProto.TraceID = traceID
+	ocsProto.Threshold = threshold
+	ocsProto.Shares = shares
+	ocsProto.Weights = weights
+	if len(requests) == 1 {
+		ocsProto.U = requests[0].U
+		ocsProto.Xc = requests[0].Xc
+		ocsProto.VerificationData = *requests[0].VerificationData
+	} else {
+		ocsProto.Batch = requests
+	}
+	ocsProto.Shared = shared
+	ocsProto.Poly = poly
+	ocsProto.Timeout = timeout
 
 	log.Lvl3("Starting reencryption protocol")
-	err = ocsProto.SetConfig(&onet.GenericConfig{Data: id.Slice()})
+	// The trace ID is appended to the LTSID, so that nodes not tracing
+	// requests can still read the config.
+	err = ocsProto.SetConfig(&onet.GenericConfig{
+		Data: append(id.Slice(), []byte(traceID)...)})
 	if err != nil {
 		return nil,
 			xerrors.Errorf("failed to set config for ocs-protocol: %v", err)
@@ -575,29 +1081,74 @@ func (s *Service) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error
 	if err != nil {
 		return nil, xerrors.Errorf("failed to start ocs-protocol: %v", err)
 	}
-	if !<-ocsProto.Reencrypted {
-		return nil, xerrors.New("reencryption got refused")
+	ok := <-ocsProto.Reencrypted
+	var children []*network.ServerIdentity
+	for _, si := range tree.Roster.List {
+		if !si.Equal(s.ServerIdentity()) {
+			children = append(children, si)
+		}
+	}
+	s.trees.update(children, ocsProto.ReplyTimes(),
+		ocsProto.Report.Unresponsive)
+	if !ok {
+		return ocsProto, xerrors.Errorf("reencryption got refused: %s",
+			ocsProto.Report)
 	}
 	log.Lvl3("Reencryption protocol is done.")
-	reply.XhatEnc, err = share.RecoverCommit(cothority.Suite, ocsProto.Uis,
-		threshold, nodes)
+	return ocsProto, nil
+}
+
+// signDecryptKeyReply signs the reply to the request with the conode key of
+// the node.
+func (s *Service) signDecryptKeyReply(dkr *DecryptKey, reply *DecryptKeyReply) error {
+	msg, err := decryptKeyReplyMessage(dkr, reply)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to recover commit: %v", err)
+		return err
 	}
-	reply.C = write.C
-	log.Lvl3("Successfully reencrypted the key")
-	return
+	reply.Signature, err = schnorr.Sign(cothority.Suite,
+		s.ServerIdentity().GetPrivate(), msg)
+	if err != nil {
+		return xerrors.Errorf("signing reply: %v", err)
+	}
+	return nil
+}
+
+// appendFailures adds the nodes of the report to the failures, once per
+// node.
+func appendFailures(failures []NodeFailure, report protocol.FailureReport) []NodeFailure {
+	seen := make(map[network.ServerIdentityID]bool)
+	for _, f := range failures {
+		seen[f.Node.ID] = true
+	}
+	for _, l := range []struct {
+		reason string
+		nodes  []*network.ServerIdentity
+	}{{FailureUnresponsive, report.Unresponsive},
+		{FailureRefused, report.Refused}, {FailureInvalid, report.Invalid},
+		{FailureBadWrite, report.BadWrite}} {
+		for _, si := range l.nodes {
+			if !seen[si.ID] {
+				seen[si.ID] = true
+				failures = append(failures, NodeFailure{Node: si,
+					Reason: l.reason})
+			}
+		}
+	}
+	return failures
 }
 
 // GetLTSReply returns the CreateLTSReply message of a previous LTS.
 func (s *Service) GetLTSReply(req *GetLTSReply) (*CreateLTSReply, error) {
 	log.Lvlf2("Getting LTS Reply for ID: %v", req.LTSID)
-	s.storage.Lock()
-	defer s.storage.Unlock()
+	s.storage.RLock()
+	defer s.storage.RUnlock()
 	reply, ok := s.storage.Replies[req.LTSID]
 	if !ok {
 		return nil, xerrors.Errorf("didn't find this LTS: %v", req.LTSID)
 	}
+	if s.storage.ByzCoinNamespaces[string(reply.ByzCoinID)] != req.Namespace {
+		return nil, xerrors.Errorf("didn't find this LTS: %v", req.LTSID)
+	}
 	return &CreateLTSReply{
 		ByzCoinID:  append([]byte{}, reply.ByzCoinID...),
 		InstanceID: reply.InstanceID,
@@ -624,11 +1175,18 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		if err := s.verifyProof(&cfg.Proof); err != nil {
 			return nil, xerrors.Errorf("verifying proof: %v", err)
 		}
-		inst, _, _, _, err := cfg.KeyValue()
+		err := s.checkLTSConfig(cfg.Latest.SkipChainID(), cfg.Namespace, tn.Roster())
+		if err != nil {
+			return nil, xerrors.Errorf("checking namespace: %v", err)
+		}
+		info, instID, err := s.getLtsInfo(&cfg.Proof)
+		if err != nil {
+			return nil, xerrors.Errorf("getting LTS info from proof: %v", err)
+		}
+		weights, err := info.weightsOf(tn.Roster())
 		if err != nil {
-			return nil, xerrors.Errorf("getting key value from proof: %v", err)
+			return nil, xerrors.Errorf("getting weights: %v", err)
 		}
-		instID := byzcoin.NewInstanceID(inst)
 
 		pi, err := dkgprotocol.NewSetup(tn)
 		if err != nil {
@@ -636,6 +1194,9 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}
 		setupDKG := pi.(*dkgprotocol.Setup)
 		setupDKG.KeyPair = s.getKeyPair()
+		setupDKG.TraceID = cfg.TraceID
+		setupDKG.Threshold = uint32(info.Threshold())
+		setupDKG.Weights = weights
 
 		go func(bcID skipchain.SkipBlockID, id byzcoin.InstanceID) {
 			<-setupDKG.Finished
@@ -655,6 +1216,9 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 			s.storage.DKS[id] = dks
 			s.storage.Replies[id] = reply
 			s.storage.Rosters[id] = tn.Roster()
+			s.storage.Holders[id] = tn.Roster()
+			s.storage.setLTSNamespace(id, cfg.Namespace)
+			s.storage.setWeights(id, weights)
 			s.storage.Unlock()
 			err = s.save()
 			if err != nil {
@@ -673,6 +1237,22 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}
 
 		_, id, err := s.getLtsRoster(&cfg.Proof)
+		if err != nil {
+			return nil, xerrors.Errorf("getting roster: %v", err)
+		}
+		err = s.checkLTSConfig(cfg.Latest.SkipChainID(), cfg.Namespace, tn.Roster())
+		if err != nil {
+			return nil, xerrors.Errorf("checking namespace: %v", err)
+		}
+		if pointInList(s.getKeyPair().Public, cfg.OldNodes) {
+			err = s.checkLTSNamespace(id, cfg.Latest.SkipChainID())
+			if err != nil {
+				return nil, xerrors.Errorf("checking namespace of LTS: %v", err)
+			}
+		}
+		if err := s.checkUnweighted(id); err != nil {
+			return nil, xerrors.Errorf("cannot reshare: %v", err)
+		}
 
 		// Set up the protocol
 		pi, err := dkgprotocol.NewSetup(tn)
@@ -682,7 +1262,7 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		setupDKG := pi.(*dkgprotocol.Setup)
 		setupDKG.KeyPair = s.getKeyPair()
 
-		s.storage.Lock()
+		s.storage.RLock()
 		oldn := len(cfg.OldNodes)
 		n := len(tn.Roster().List)
 		c := &dkg.Config{
@@ -690,10 +1270,9 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 			Longterm:     setupDKG.KeyPair.Private,
 			NewNodes:     tn.Roster().Publics(),
 			OldNodes:     cfg.OldNodes,
-			Threshold:    n - (n-1)/3,
-			OldThreshold: oldn - (oldn-1)/3,
+			Threshold:    LTSThreshold(n),
+			OldThreshold: LTSThreshold(oldn),
 		}
-		s.storage.Unlock()
 
 		// Set Share and PublicCoeffs according to if we are an old node or a new one.
 		inOld := pointInList(setupDKG.KeyPair.Public, cfg.OldNodes)
@@ -702,6 +1281,7 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		} else {
 			c.PublicCoeffs = cfg.Commits
 		}
+		s.storage.RUnlock()
 
 		setupDKG.NewDKG = func() (*dkg.DistKeyGenerator, error) {
 			d, err := dkg.NewDistKeyHandler(c)
@@ -737,6 +1317,8 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 			}
 			s.storage.Shared[id] = shared
 			s.storage.DKS[id] = dks
+			s.storage.Holders[id] = tn.Roster()
+			s.storage.setLTSNamespace(id, cfg.Namespace)
 			s.storage.Unlock()
 			err = s.save()
 			if err != nil {
@@ -748,11 +1330,14 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}(id)
 		return setupDKG, nil
 	case protocol.NameOCS:
-		id := byzcoin.NewInstanceID(conf.Data)
-		s.storage.Lock()
+		if len(conf.Data) < len(byzcoin.InstanceID{}) {
+			return nil, xerrors.New("config too short for an LTSID")
+		}
+		id := byzcoin.NewInstanceID(conf.Data[:len(byzcoin.InstanceID{})])
+		s.storage.RLock()
 		shared, ok := s.storage.Shared[id]
 		shared = shared.Clone()
-		s.storage.Unlock()
+		s.storage.RUnlock()
 		if !ok {
 			return nil, fmt.Errorf("didn't find LTSID %v", id)
 		}
@@ -762,7 +1347,10 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}
 		ocs := pi.(*protocol.OCS)
 		ocs.Shared = shared
-		ocs.Verify = s.verifyReencryption
+		ocs.Check = func(rc *protocol.Reencrypt) protocol.Refusal {
+			return s.checkReencryption(id, tn.Root().ServerIdentity.ID, rc)
+		}
+		ocs.TraceID = string(conf.Data[len(byzcoin.InstanceID{}):])
 		return ocs, nil
 	}
 	return nil, nil
@@ -777,39 +1365,146 @@ func pointInList(p1 kyber.Point, l []kyber.Point) bool {
 	return false
 }
 
-// verifyReencryption checks that the read and the write instances match.
-func (s *Service) verifyReencryption(rc *protocol.Reencrypt) bool {
+// checkReencryption checks that the read and the write instances match, and
+// that the point to re-encrypt is the one of a correct write for the LTS.
+func (s *Service) checkReencryption(id byzcoin.InstanceID,
+	root network.ServerIdentityID, rc *protocol.Reencrypt) protocol.Refusal {
+	var vd *vData
 	err := func() error {
-		var verificationData vData
-		err := protobuf.DecodeWithConstructors(*rc.VerificationData, &verificationData, network.DefaultConstructors(cothority.Suite))
+		verificationData, r, err := decodeVerificationData(rc.VerificationData)
 		if err != nil {
-			return xerrors.Errorf("decoding verification data: %v", err)
+			return err
 		}
-		_, v0, contractID, _, err := verificationData.Proof.KeyValue()
-		if err != nil {
-			return xerrors.Errorf("proof cannot return values: %v", err)
+		if verificationData.Ephemeral != nil {
+			return xerrors.New("ephemeral keys not supported yet")
 		}
-		if contractID != ContractReadID {
-			return xerrors.New("proof doesn't point to read instance")
+		if err := s.verifyProof(&verificationData.Proof); err != nil {
+			return xerrors.Errorf("verifying proof of read: %v", err)
 		}
-		var r Read
-		err = protobuf.DecodeWithConstructors(v0, &r, network.DefaultConstructors(cothority.Suite))
+		err = s.checkLTSNamespace(id, verificationData.Proof.Latest.SkipChainID())
 		if err != nil {
-			return xerrors.Errorf("couldn't decode read data: %v", err)
+			return err
 		}
-		if verificationData.Ephemeral != nil {
-			return xerrors.New("ephemeral keys not supported yet")
+		if err := r.open(verificationData.Opening); err != nil {
+			return xerrors.Errorf("opening blinded read: %v", err)
 		}
-		if !r.Xc.Equal(rc.Xc) {
+		err = s.delegateRead(verificationData.Proof.Latest.SkipChainID(), r,
+			byzcoin.NewInstanceID(verificationData.Proof.InclusionProof.Key()))
+		if err != nil {
+			return xerrors.Errorf("delegating read: %v", err)
+		}
+		if rc.Xc == nil || !r.Xc.Equal(rc.Xc) {
 			return xerrors.New("wrong reader")
 		}
+		err = s.checkRevoked(verificationData.Proof.Latest.SkipChainID(), r.Xc, r,
+			byzcoin.NewInstanceID(verificationData.Proof.InclusionProof.Key()))
+		if err != nil {
+			return err
+		}
+		err = s.checkFrozen(verificationData.Proof.Latest.SkipChainID(), r.Write)
+		if err != nil {
+			return err
+		}
+		err = s.checkGroupMember(r, &verificationData.Proof, verificationData.Group)
+		if err != nil {
+			return err
+		}
+		if err := s.checkReadExpiry(r, &verificationData.Proof); err != nil {
+			return err
+		}
+		if err := s.verifyReadBlock(&verificationData.Proof); err != nil {
+			return xerrors.Errorf("verifying block of read: %v", err)
+		}
+		err = s.checkFresh(
+			byzcoin.NewInstanceID(verificationData.Proof.InclusionProof.Key()),
+			r.Xc, verificationData.Timestamp, verificationData.Nonce,
+			verificationData.RequestSig, root.String(), true)
+		if err != nil {
+			return xerrors.Errorf("checking request: %v", err)
+		}
+		vd = verificationData
 		return nil
 	}()
 	if err != nil {
 		log.Lvl2(s.ServerIdentity(), "wrong reencryption:", err)
-		return false
+		return protocol.RefusedDenied
+	}
+	if err := s.checkWrite(id, rc, vd); err != nil {
+		log.Lvl2(s.ServerIdentity(), "bad write:", err)
+		return protocol.RefusedBadWrite
 	}
-	return true
+	return 0
+}
+
+// checkWrite verifies the proof of the write in the verification data, and
+// that the point to re-encrypt is the key of the write for the LTS, with a
+// correct proof of encryption.
+func (s *Service) checkWrite(id byzcoin.InstanceID, rc *protocol.Reencrypt, vd *vData) error {
+	if vd.Write == nil {
+		return xerrors.New("missing proof of the write")
+	}
+	r, err := decodeReadProof(&vd.Proof)
+	if err != nil {
+		return err
+	}
+	if !r.Write.Equal(byzcoin.NewInstanceID(vd.Write.InclusionProof.Key())) {
+		return xerrors.New("read doesn't point to the write")
+	}
+	if err := s.verifyProof(vd.Write); err != nil {
+		return xerrors.Errorf("verifying proof of write: %v", err)
+	}
+	if err := s.checkLTSNamespace(id, vd.Write.Latest.SkipChainID()); err != nil {
+		return err
+	}
+	var write Write
+	err = vd.Write.VerifyAndDecode(cothority.Suite, ContractWriteID, &write)
+	if err != nil {
+		return xerrors.Errorf("didn't get a write instance: %v", err)
+	}
+	suite, err := write.GetSuite()
+	if err != nil {
+		return xerrors.Errorf("checking suite of write: %v", err)
+	}
+	_, _, _, darcID, err := vd.Write.KeyValue()
+	if err != nil {
+		return xerrors.Errorf("getting darc of write: %v", err)
+	}
+	wk, err := write.Key(id)
+	if err != nil {
+		return err
+	}
+	if !wk.U.Equal(rc.U) {
+		return xerrors.New("point doesn't match the write")
+	}
+	return cothority.ErrorOrNil(wk.CheckProof(suite, darcID),
+		"checking proof of write")
+}
+
+// TestClose stops the go-routines of the service: the streams of the followed
+// chains, the scheduled tasks and the configuration watcher. It is called by
+// onet when the servers of a test are closed.
+func (s *Service) TestClose() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	s.timersLock.Lock()
+	defer s.timersLock.Unlock()
+	for _, t := range s.timers {
+		t.Stop()
+	}
+}
+
+// schedule runs f once after the interval, unless the service is closed
+// before. The timer replaces the previous one with the same name.
+func (s *Service) schedule(name string, interval time.Duration, f func()) {
+	s.timersLock.Lock()
+	defer s.timersLock.Unlock()
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+	s.timers[name] = time.AfterFunc(interval, f)
 }
 
 // newService receives the context that holds information about the node it's
@@ -819,14 +1514,66 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		genesisBlocks:    make(map[string]*skipchain.SkipBlock),
+		following:        make(map[string]bool),
+		repairing:        make(map[string]bool),
+		reconciling:      make(map[byzcoin.InstanceID]bool),
+		tokenWrites:      make(map[byzcoin.InstanceID]chan struct{}),
+		webhooks:         newWebhookQueue(),
+		closing:          make(chan struct{}),
+		timers:           make(map[string]*time.Timer),
+		ipLimiter:        newRateLimiter(RateLimit{}),
+		keyLimiter:       newRateLimiter(RateLimit{}),
+		nonces:           newNonceCache(),
+		trees:            newTreeStats(),
+		config:           DefaultServiceConfig(),
+		configFile:       os.Getenv(ConfigEnv),
 	}
 	if err := s.RegisterHandlers(s.CreateLTS, s.ReshareLTS, s.DecryptKey,
-		s.GetLTSReply, s.Authorise, s.Authorize); err != nil {
+		s.DecryptKeys, s.GetLTSReply, s.Authorise, s.Authorize, s.ConfigureNamespace, s.ConfigureEscrow,
+		s.ExportShares, s.ReloadConfig,
+		s.GetDocumentStats, s.ListDocuments, s.FindByLabel, s.GetChainStats, s.QueryAccessAt,
+		s.GetEvents, s.GetWriteStatus, s.GetDigest,
+		s.CheckConsistency, s.EstimateDecrypt, s.ExportSnapshot,
+		s.ImportSnapshot, s.RevokeIdentity, s.ReportMisbehavior,
+		s.ReconcileShare, s.GetShareIndex, s.ShareContribution,
+		s.RemoveNode, s.AddTokenWrite); err != nil {
 		return nil, xerrors.New("couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, xerrors.Errorf("loading configuration: %v", err)
 	}
+	if err := s.tryLoadVerifiedBlocks(); err != nil {
+		log.Error(err)
+		return nil, xerrors.Errorf("loading verified blocks: %v", err)
+	}
+	if err := s.tryLoadStats(); err != nil {
+		log.Error(err)
+		return nil, xerrors.Errorf("loading statistics: %v", err)
+	}
+	if err := s.tryLoadEvents(); err != nil {
+		log.Error(err)
+		return nil, xerrors.Errorf("loading events: %v", err)
+	}
+	if s.configFile != "" {
+		if err := s.reloadConfig(); err != nil {
+			log.Error(err)
+			return nil, xerrors.Errorf("loading configuration: %v", err)
+		}
+		s.watchConfig()
+	}
+	for bcID := range s.storage.AuthorisedByzCoinIDs {
+		s.followChain(skipchain.SkipBlockID(bcID))
+	}
+	if sc, ok := s.Service(skipchain.ServiceName).(*skipchain.Service); ok {
+		sc.RegisterCorruptedBlockCallback(s.repairCorrupted)
+	}
+	if bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service); ok {
+		bc.RegisterTransactionCallback(s.limitTransaction)
+	}
+	s.scheduleRepair()
+	s.scheduleConsistencyCheck()
+	s.scheduleExternalPoll()
+	s.scheduleShareCheck()
 	return s, nil
 }
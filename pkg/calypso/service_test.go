@@ -1,22 +1,37 @@
 package calypso
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"golang.org/x/xerrors"
 
-	"github.com/stretchr/testify/require"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso/protocol"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
+	bbolt "go.etcd.io/bbolt"
 )
 
 func TestMain(m *testing.M) {
@@ -41,6 +56,40 @@ func TestService_CreateLTS(t *testing.T) {
 	}
 }
 
+// TestNewLtsInstanceInfo makes sure that only rosters where every node gets
+// its own share are accepted.
+func TestNewLtsInstanceInfo(t *testing.T) {
+	var list []*network.ServerIdentity
+	for i := 0; i < 4; i++ {
+		kp := key.NewKeyPair(cothority.Suite)
+		list = append(list, network.NewServerIdentity(kp.Public,
+			network.NewAddress(network.TLS, fmt.Sprintf("127.0.0.1:%d", 2000+2*i))))
+	}
+	info, err := NewLtsInstanceInfo(onet.NewRoster(list))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(info.Roster.List))
+	require.Equal(t, 3, LTSThreshold(len(info.Roster.List)))
+
+	_, err = NewLtsInstanceInfo(&onet.Roster{})
+	require.Error(t, err)
+	_, err = NewLtsInstanceInfo(&onet.Roster{List: append(list, list[0])})
+	require.Error(t, err)
+	noKey := *list[1]
+	noKey.Public = nil
+	_, err = NewLtsInstanceInfo(&onet.Roster{List: []*network.ServerIdentity{
+		list[0], &noKey}})
+	require.Error(t, err)
+
+	info, err = NewWeightedLtsInstanceInfo(onet.NewRoster(list), []int{3, 1, 1, 1})
+	require.NoError(t, err)
+	require.Equal(t, 6, info.Shares())
+	require.Equal(t, 5, info.Threshold())
+	_, err = NewWeightedLtsInstanceInfo(onet.NewRoster(list), []int{3, 1, 1})
+	require.Error(t, err)
+	_, err = NewWeightedLtsInstanceInfo(onet.NewRoster(list), []int{3, 0, 1, 1})
+	require.Error(t, err)
+}
+
 // Try to change the roster to a new roster that is disjoint, which
 // should result in an error.
 func TestService_ReshareLTS_Different(t *testing.T) {
@@ -54,7 +103,7 @@ func TestService_ReshareLTS_Different(t *testing.T) {
 	// The current DKG is on List[0:nodes], and this new roster will
 	// be on List[nodes:], thus entirely disjoint.
 	otherRoster := onet.NewRoster(s.allRoster.List[nodes:])
-	ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{*otherRoster})
+	ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{Roster: *otherRoster})
 	require.NoError(t, err)
 
 	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
@@ -92,7 +141,7 @@ func TestService_ReshareLTS_Same(t *testing.T) {
 			require.NotNil(t, s.ltsReply.X)
 			sec1 := s.reconstructKey(t)
 
-			ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{*s.ltsRoster})
+			ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{Roster: *s.ltsRoster})
 			require.NoError(t, err)
 
 			ctx, err := s.cl.CreateTransaction(byzcoin.Instruction{
@@ -160,7 +209,7 @@ func TestService_ReshareLTS_OneMore(t *testing.T) {
 			// Create a new roster that has one more node than
 			// before
 			s.ltsRoster = onet.NewRoster(s.allRoster.List[:nodes+1])
-			ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{*s.ltsRoster})
+			ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{Roster: *s.ltsRoster})
 			require.NoError(t, err)
 
 			ctx, err := s.cl.CreateTransaction(byzcoin.Instruction{
@@ -217,6 +266,37 @@ func TestContract_Write(t *testing.T) {
 
 	pr := s.addWriteAndWait(t, []byte("secret key"))
 	require.Nil(t, pr.Verify(s.gbReply.Skipblock.Hash))
+
+	// The key cannot be encrypted for an LTS that is not on the chain.
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	write := NewWrite(cothority.Suite, byzcoin.NewInstanceID([]byte("outsiders")),
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+	_, err = NewClient(s.cl).AddWrite(write, s.signer, ctr.Counters[0]+1,
+		*s.gDarc, 10)
+	require.Error(t, err)
+}
+
+// TestContract_WriteSuite makes sure that the suite is recorded in the
+// write, and that a write with an unknown suite is refused.
+func TestContract_WriteSuite(t *testing.T) {
+	ltsid := byzcoin.NewInstanceID([]byte("lts"))
+	darcID := darc.ID(make([]byte, 32))
+	X := cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	write := NewWrite(cothority.Suite, ltsid, darcID, X, []byte("secret key"))
+	require.Equal(t, cothority.Suite.String(), write.Suite)
+	require.NoError(t, write.verifyNew(darcID))
+
+	// Writes from before the suite was recorded use the default suite.
+	write.Suite = ""
+	suite, err := write.GetSuite()
+	require.NoError(t, err)
+	require.Equal(t, cothority.Suite.String(), suite.String())
+
+	write.Suite = "unknown"
+	require.Error(t, write.verifyNew(darcID))
+	require.Error(t, write.AddLTS(cothority.Suite,
+		byzcoin.NewInstanceID([]byte("other")), darcID, X, []byte("secret key")))
 }
 
 // TestContract_Write_Benchmark makes many write requests transactions and logs
@@ -269,6 +349,40 @@ func TestContract_Read(t *testing.T) {
 	require.Nil(t, pr.Verify(s.gbReply.Skipblock.Hash))
 }
 
+// TestContract_Read_Policy checks that the policy of a write is evaluated
+// when spawning a read.
+func TestContract_Read_Policy(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	cl := NewClient(s.cl)
+	addWrite := func(policy string) *byzcoin.Proof {
+		write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+			s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+		write.Policy = policy
+		ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+		require.NoError(t, err)
+		reply, err := cl.AddWrite(write, s.signer, ctr.Counters[0]+1, *s.gDarc, 10)
+		if err != nil {
+			return nil
+		}
+		return s.waitInstID(t, reply.InstanceID)
+	}
+
+	require.Nil(t, addWrite("counter >"))
+
+	prWr := addWrite("counter > 1000")
+	require.NotNil(t, prWr)
+	_, err := s.addReadAs(t, s.signer, prWr, s.signer.Ed25519.Point)
+	require.Error(t, err)
+
+	prWr = addWrite(fmt.Sprintf("reader == \"%s\" && time > 0 && block > 0",
+		s.signer.Identity()))
+	require.NotNil(t, prWr)
+	_, err = s.addReadAs(t, s.signer, prWr, s.signer.Ed25519.Point)
+	require.NoError(t, err)
+}
+
 // TestService_DecryptKey is an end-to-end test that logs two write and read
 // requests and make sure that we can decrypt the secret afterwards.
 func TestService_DecryptKey(t *testing.T) {
@@ -282,19 +396,19 @@ func TestService_DecryptKey(t *testing.T) {
 	prWr2 := s.addWriteAndWait(t, key2)
 	prRe2 := s.addReadAndWait(t, prWr2, s.signer.Ed25519.Point)
 
-	_, err := s.services[0].DecryptKey(&DecryptKey{Read: *prRe1, Write: *prWr2})
+	_, err := s.services[0].DecryptKey(signed(t, prRe1, prWr2, s.signer.Ed25519.Secret))
 	require.NotNil(t, err)
-	_, err = s.services[0].DecryptKey(&DecryptKey{Read: *prRe2, Write: *prWr1})
+	_, err = s.services[0].DecryptKey(signed(t, prRe2, prWr1, s.signer.Ed25519.Secret))
 	require.NotNil(t, err)
 
-	dk1, err := s.services[0].DecryptKey(&DecryptKey{Read: *prRe1, Write: *prWr1})
+	dk1, err := s.services[0].DecryptKey(signed(t, prRe1, prWr1, s.signer.Ed25519.Secret))
 	require.NoError(t, err)
 	require.True(t, dk1.X.Equal(s.ltsReply.X))
 	keyCopy1, err := dk1.RecoverKey(s.signer.Ed25519.Secret)
 	require.NoError(t, err)
 	require.Equal(t, key1, keyCopy1)
 
-	dk2, err := s.services[0].DecryptKey(&DecryptKey{Read: *prRe2, Write: *prWr2})
+	dk2, err := s.services[0].DecryptKey(signed(t, prRe2, prWr2, s.signer.Ed25519.Secret))
 	require.NoError(t, err)
 	require.True(t, dk2.X.Equal(s.ltsReply.X))
 	keyCopy2, err := dk2.RecoverKey(s.signer.Ed25519.Secret)
@@ -302,190 +416,2266 @@ func TestService_DecryptKey(t *testing.T) {
 	require.Equal(t, key2, keyCopy2)
 }
 
-// TestService_DecryptEphemeralKey requests a read to a different key than the
-// readers.
-func TestService_DecryptEphemeralKey(t *testing.T) {
-	s := newTS(t, 5)
+// TestService_WeightedLTS creates an LTS in which the first node holds three
+// of the six shares, so that two other nodes are enough to reach the
+// threshold of five shares with it, but one is not.
+func TestService_WeightedLTS(t *testing.T) {
+	s := newTSWithWeights(t, 4, 0, []int{3, 1, 1, 1})
 	defer s.closeAll(t)
 
-	ephemeral := key.NewKeyPair(cothority.Suite)
-
-	key1 := []byte("secret key 1")
-	prWr1 := s.addWriteAndWait(t, key1)
-	prRe1 := s.addReadAndWait(t, prWr1, ephemeral.Public)
+	id := s.ltsReply.InstanceID
+	for i, extra := range []int{2, 0, 0, 0} {
+		s.services[i].storage.RLock()
+		require.Len(t, s.services[i].storage.Shared[id].Extra, extra)
+		s.services[i].storage.RUnlock()
+	}
 
-	dk1, err := s.services[0].DecryptKey(&DecryptKey{Read: *prRe1, Write: *prWr1})
+	key := []byte("weighted key")
+	prWr := s.addWriteAndWait(t, key)
+	var write Write
+	require.NoError(t, prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &write))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dk, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
 	require.NoError(t, err)
-	require.True(t, dk1.X.Equal(s.ltsReply.X))
+	require.Len(t, dk.Commits, 5)
+	require.NoError(t, dk.Verify(s.ltsReply.X, 5, write.U, s.signer.Ed25519.Point))
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
 
-	keyCopy1, err := dk1.RecoverKey(ephemeral.Private)
+	// The nodes of another namespace refuse to re-encrypt: with two of
+	// them, the four shares left are not enough.
+	setNamespace := func(ns string, svcs ...*Service) {
+		for _, svc := range svcs {
+			svc.storage.Lock()
+			svc.storage.setLTSNamespace(id, ns)
+			svc.storage.Unlock()
+		}
+	}
+	setNamespace("tenant", s.services[2:]...)
+	prRe = s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+
+	setNamespace("", s.services[2])
+	prRe = s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dk, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
 	require.NoError(t, err)
-	require.Equal(t, key1, keyCopy1)
+	keyCopy, err = dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
 }
 
-type ts struct {
-	local      *onet.LocalTest
-	servers    []*onet.Server
-	services   []*Service
-	allRoster  *onet.Roster
-	ltsRoster  *onet.Roster
-	byzRoster  *onet.Roster
-	ltsReply   *CreateLTSReply
-	signer     darc.Signer
-	cl         *byzcoin.Client
-	gbReply    *byzcoin.CreateGenesisBlockResponse
-	genesisMsg *byzcoin.CreateGenesisBlock
-	gDarc      *darc.Darc
+// TestService_VerifiedBlocks makes sure that the verified blocks are kept in
+// the journal and that a tampered block is verified again.
+func TestService_VerifiedBlocks(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	srv := s.services[0]
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err := srv.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	scID := s.gbReply.Skipblock.SkipChainID()
+	require.True(t, srv.blockVerified(scID, &prRe.Latest))
+	srv.storage.Lock()
+	srv.storage.VerifiedBlocks = make(map[string]string)
+	srv.storage.Unlock()
+	require.False(t, srv.blockVerified(scID, &prRe.Latest))
+	require.NoError(t, srv.replayVerifiedBlocks())
+	require.True(t, srv.blockVerified(scID, &prRe.Latest))
+	require.NoError(t, srv.verifyProof(prRe))
+
+	tampered := *prRe
+	tampered.Latest = *prRe.Latest.Copy()
+	tampered.Latest.Index++
+	require.False(t, srv.blockVerified(scID, &tampered.Latest))
+	require.Error(t, srv.verifyProof(&tampered))
 }
 
-func (s *ts) addRead(t *testing.T, write *byzcoin.Proof, Xc kyber.Point, ctr uint64) byzcoin.InstanceID {
-	var readBuf []byte
-	read := &Read{
-		Write: byzcoin.NewInstanceID(write.InclusionProof.Key()),
-		Xc:    Xc,
-	}
-	var err error
-	readBuf, err = protobuf.Encode(read)
+// TestService_DelegatedRead re-encrypts the secret to the last key of a
+// chain of delegations recorded in the read.
+func TestService_DelegatedRead(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	key1 := []byte("secret key 1")
+	prWr := s.addWriteAndWait(t, key1)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	readID := byzcoin.NewInstanceID(prRe.InclusionProof.Key())
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
 	require.NoError(t, err)
-	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
-		byzcoin.Instruction{
-			InstanceID: byzcoin.NewInstanceID(write.InclusionProof.Key()),
-			Spawn: &byzcoin.Spawn{
-				ContractID: ContractReadID,
-				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
-			},
-			SignerCounter: []uint64{ctr},
+
+	bob := darc.NewSignerEd25519(nil, nil)
+	carol := darc.NewSignerEd25519(nil, nil)
+	// Delegations cannot be set when spawning the read.
+	d, err := NewDelegation(readID, s.signer.Ed25519.Secret, bob.Ed25519.Point)
+	require.NoError(t, err)
+	readBuf, err := protobuf.Encode(&Read{
+		Write:       byzcoin.NewInstanceID(prWr.InclusionProof.Key()),
+		Xc:          s.signer.Ed25519.Point,
+		Delegations: []Delegation{d},
+	})
+	require.NoError(t, err)
+	ctx, err := s.cl.CreateTransaction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(prWr.InclusionProof.Key()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractReadID,
+			Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
 		},
-	)
-	require.Nil(t, ctx.FillSignersAndSignWith(s.signer))
-	_, err = s.cl.AddTransaction(ctx)
+		SignerCounter: []uint64{ctr.Counters[0] + 1},
+	})
 	require.NoError(t, err)
-	return ctx.Instructions[0].DeriveID("")
-}
+	require.NoError(t, ctx.FillSignersAndSignWith(s.signer))
+	_, err = s.cl.AddTransactionAndWait(ctx, 10)
+	require.Error(t, err)
 
-func (s *ts) addReadAndWait(t *testing.T, write *byzcoin.Proof, Xc kyber.Point) *byzcoin.Proof {
-	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	// Only the key holding the read can delegate it.
+	err = calypsoClient.DelegateRead(readID, bob, 1, carol.Ed25519.Point, 10)
+	require.Error(t, err)
+	require.NoError(t, calypsoClient.DelegateRead(readID, s.signer,
+		ctr.Counters[0]+1, bob.Ed25519.Point, 10))
+	err = calypsoClient.DelegateRead(readID, s.signer, ctr.Counters[0]+2,
+		carol.Ed25519.Point, 10)
+	require.Error(t, err)
+	// A key cannot hold the read twice.
+	err = calypsoClient.DelegateRead(readID, bob, 1, s.signer.Ed25519.Point, 10)
+	require.Error(t, err)
+	require.NoError(t, calypsoClient.DelegateRead(readID, bob, 1,
+		carol.Ed25519.Point, 10))
+
+	prDel, err := calypsoClient.WaitProof(readID, time.Second, nil)
 	require.NoError(t, err)
-	instID := s.addRead(t, write, Xc, ctr.Counters[0]+1)
-	return s.waitInstID(t, instID)
+	rd, err := decodeReadProof(prDel)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rd.Delegations))
+	dk, err := calypsoClient.DecryptKey(signed(t, prDel, prWr, carol.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(carol.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+	keyCopy, _ = dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NotEqual(t, key1, keyCopy)
 }
 
-func newTS(t *testing.T, nodes int) ts {
-	return newTSWithExtras(t, nodes, 0)
-}
+// TestService_SignedDecryptKey makes sure a signed request can only be sent
+// once, and only while it is fresh, and that unsigned requests are refused
+// unless the configuration allows them.
+func TestService_SignedDecryptKey(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
 
-// newTSWithExtras initially the byzRoster and ltsRoster are the same, the extras are
-// there so that we can change the ltsRoster later to be something different.
-func newTSWithExtras(t *testing.T, nodes int, extras int) ts {
-	allowInsecureAdmin = true
-	s := ts{}
-	s.local = onet.NewLocalTestT(cothority.Suite, t)
+	key1 := []byte("secret key 1")
+	prWr := s.addWriteAndWait(t, key1)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
 
-	// Create the service
-	s.servers, s.allRoster, _ = s.local.GenTree(nodes+extras, true)
-	services := s.local.GetServices(s.servers, calypsoID)
-	for _, ser := range services {
-		s.services = append(s.services, ser.(*Service))
-	}
-	s.byzRoster = onet.NewRoster(s.allRoster.List[:nodes])
-	s.ltsRoster = onet.NewRoster(s.allRoster.List[:nodes])
+	_, err := s.services[0].DecryptKey(&DecryptKey{Read: *prRe, Write: *prWr})
+	require.Error(t, err)
 
-	// Create the skipchain
-	s.signer = darc.NewSignerEd25519(nil, nil)
-	s.createGenesis(t)
+	// Only the reader can sign the request.
+	dkr := &DecryptKey{Read: *prRe, Write: *prWr}
+	require.NoError(t, dkr.Sign(cothority.Suite.Scalar().Pick(
+		cothority.Suite.RandomStream())))
+	_, err = s.services[0].DecryptKey(dkr)
+	require.Error(t, err)
 
-	// Create LTS instance
-	ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{*s.ltsRoster})
+	require.NoError(t, dkr.Sign(s.signer.Ed25519.Secret))
+	dk, err := s.services[0].DecryptKey(dkr)
 	require.NoError(t, err)
-	inst := byzcoin.Instruction{
-		InstanceID: byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
-		Spawn: &byzcoin.Spawn{
-			ContractID: ContractLongTermSecretID,
-			Args: []byzcoin.Argument{
-				{
-					Name:  "lts_instance_info",
-					Value: ltsInstInfoBuf,
-				},
-			},
-		},
-		SignerCounter: []uint64{1},
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+
+	// The same request is refused by the root, and by the trustees if it
+	// is sent through another root.
+	_, err = s.services[0].DecryptKey(dkr)
+	require.Error(t, err)
+	_, err = s.services[1].DecryptKey(dkr)
+	require.Error(t, err)
+	// Stripping the signature doesn't help either.
+	stripped := &DecryptKey{Read: dkr.Read, Write: dkr.Write}
+	_, err = s.services[0].DecryptKey(stripped)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "must be signed")
+	_, err = s.services[1].DecryptKey(stripped)
+	require.Error(t, err)
+
+	// Changing the timestamp breaks the signature, and old requests are
+	// refused.
+	require.NoError(t, dkr.Sign(s.signer.Ed25519.Secret))
+	dkr.Timestamp--
+	_, err = s.services[1].DecryptKey(dkr)
+	require.Error(t, err)
+	conf := s.services[1].getConfig()
+	dkr.Timestamp -= int64(conf.DecryptRequestAge)
+	dkr.Signature, err = schnorr.Sign(cothority.Suite, s.signer.Ed25519.Secret,
+		decryptRequestMessage(byzcoin.NewInstanceID(prRe.InclusionProof.Key()),
+			dkr.Timestamp, dkr.Nonce))
+	require.NoError(t, err)
+	_, err = s.services[1].DecryptKey(dkr)
+	require.Error(t, err)
+
+	// The clients that don't sign their requests yet are accepted if the
+	// configuration allows them.
+	conf.AllowUnsignedDecrypt = true
+	for _, srv := range s.services {
+		require.NoError(t, srv.SetConfig(conf))
 	}
-	tx, err := s.cl.CreateTransaction(inst)
+	dk, err = s.services[0].DecryptKey(stripped)
 	require.NoError(t, err)
-	require.NoError(t, tx.FillSignersAndSignWith(s.signer))
-	_, err = s.cl.AddTransactionAndWait(tx, 4)
+	keyCopy, err = dk.RecoverKey(s.signer.Ed25519.Secret)
 	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy)
+}
 
-	// Get the proof
-	proof, err := s.cl.WaitProof(tx.Instructions[0].DeriveID(""), s.genesisMsg.BlockInterval, nil)
+// TestService_ReadExpiry makes sure that the reads older than the TTLs of
+// the configuration cannot be decrypted anymore.
+func TestService_ReadExpiry(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	read, err := decodeReadProof(prRe)
 	require.NoError(t, err)
+	require.True(t, read.BlockIndex > 0)
+	require.True(t, read.Timestamp > 0)
 
-	// Start DKG
-	s.ltsReply, err = s.services[0].CreateLTS(&CreateLTS{
-		Proof: *proof,
-	})
+	conf := s.services[0].getConfig()
+	conf.ReadTTLBlocks = -1
+	require.Error(t, s.services[0].SetConfig(conf))
+	conf.ReadTTLBlocks = 2
+	conf.ReadTTL = 3600
+	for _, svc := range s.services {
+		require.NoError(t, svc.SetConfig(conf))
+	}
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
 	require.NoError(t, err)
 
-	reply2 := CreateLTSReply{
-		ByzCoinID:  s.gbReply.Skipblock.SkipChainID(),
-		InstanceID: tx.Instructions[0].DeriveID(""),
-		X:          s.ltsReply.X,
+	// The block of a read without one is looked up on the chain.
+	old := *read
+	old.BlockIndex, old.Timestamp = 0, 0
+	require.NoError(t, s.services[0].checkReadExpiry(&old, prRe))
+
+	// The read expires once enough blocks have been added, even if its
+	// proof is older.
+	for i := 0; i < 3; i++ {
+		s.addWriteAndWait(t, []byte("another key"))
 	}
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the read has expired")
 
-	require.True(t, s.ltsReply.InstanceID.Equal(reply2.InstanceID))
-	return s
+	// A new read can be decrypted, until its time is over.
+	prRe = s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err = NewClient(s.cl).DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	conf.ReadTTLBlocks = 0
+	conf.ReadTTL = 1
+	for _, svc := range s.services {
+		require.NoError(t, svc.SetConfig(conf))
+	}
+	time.Sleep(time.Second)
+	_, err = NewClient(s.cl).DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.True(t, xerrors.Is(err, ErrReadExpired))
 }
 
-func (s *ts) createGenesis(t *testing.T) {
-	var err error
-	s.genesisMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, s.byzRoster,
-		[]string{"spawn:" + ContractWriteID,
-			"spawn:" + ContractReadID,
-			"spawn:" + ContractLongTermSecretID,
-			"invoke:" + ContractLongTermSecretID + ".reshare"},
-		s.signer.Identity())
+// TestService_ClientTLS makes sure that, if the configuration requires it,
+// only decryption requests sent with the client certificate of the reader
+// are accepted.
+func TestService_ClientTLS(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	sk, err := NewEd25519Key()
+	require.NoError(t, err)
+	reader, err := NewSignerFromEd25519(sk)
+	require.NoError(t, err)
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, reader.Ed25519.Point)
+	buf, err := protobuf.Encode(&DecryptKey{Read: *prRe, Write: *prWr})
 	require.NoError(t, err)
-	s.gDarc = &s.genesisMsg.GenesisDarc
-	s.genesisMsg.BlockInterval = time.Second
 
-	s.cl, s.gbReply, err = byzcoin.NewLedger(s.genesisMsg, false)
+	cert, err := NewClientCertificate(sk)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	other, err := NewEd25519Key()
+	require.NoError(t, err)
+	otherCert, err := NewClientCertificate(other)
+	require.NoError(t, err)
+	otherLeaf, err := x509.ParseCertificate(otherCert.Certificate[0])
 	require.NoError(t, err)
 
-	for _, svc := range s.services {
-		req := &Authorize{ByzCoinID: s.cl.ID}
-		_, err = svc.Authorize(req)
-		require.NoError(t, err)
+	plain := &http.Request{RemoteAddr: "127.0.0.1:2000"}
+	withCert := func(c *x509.Certificate) *http.Request {
+		return &http.Request{RemoteAddr: "127.0.0.1:2000",
+			TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c}}}
 	}
-}
+	srv := s.services[0]
+	require.NoError(t, srv.checkClientTLS(plain, "DecryptKey", buf))
 
-func (s *ts) afterReshare(f func()) {
-	for _, sv := range s.services {
-		sv.afterReshare = f
+	conf := srv.getConfig()
+	conf.RequireClientTLS = true
+	require.NoError(t, srv.SetConfig(conf))
+	require.Error(t, srv.checkClientTLS(plain, "DecryptKey", buf))
+	require.Error(t, srv.checkClientTLS(plain, "GetLTSReply", nil))
+	require.Error(t, srv.checkClientTLS(&http.Request{TLS: &tls.ConnectionState{}},
+		"GetLTSReply", nil))
+	require.NoError(t, srv.checkClientTLS(withCert(otherLeaf), "GetLTSReply", nil))
+	require.Error(t, srv.checkClientTLS(withCert(otherLeaf), "DecryptKey", buf))
+	require.NoError(t, srv.checkClientTLS(withCert(leaf), "DecryptKey", buf))
+
+	batch, err := protobuf.Encode(&DecryptKeys{
+		Requests: []DecryptKey{{Read: *prRe, Write: *prWr}}})
+	require.NoError(t, err)
+	require.NoError(t, srv.checkClientTLS(withCert(leaf), "DecryptKeys", batch))
+	require.Error(t, srv.checkClientTLS(withCert(otherLeaf), "DecryptKeys", batch))
+
+	// Over a real TLS connection set up like the websocket of the conode,
+	// only the reader with its certificate gets the secret.
+	web := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reply, _, err := srv.ProcessClientRequest(req, "DecryptKey", body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			w.Write(reply)
+		}))
+	web.TLS = &tls.Config{}
+	RequestClientCertificates(web.TLS)
+	web.StartTLS()
+	defer web.Close()
+	post := func(certs []tls.Certificate) (int, []byte) {
+		tr := web.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = certs
+		body, err := protobuf.Encode(signed(t, prRe, prWr, reader.Ed25519.Secret))
+		require.NoError(t, err)
+		resp, err := (&http.Client{Transport: tr}).Post(web.URL,
+			"application/octet-stream", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		reply, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, reply
 	}
+	code, reply := post(nil)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Contains(t, string(reply), "client certificate")
+	code, reply = post([]tls.Certificate{otherCert})
+	require.Equal(t, http.StatusForbidden, code)
+	require.Contains(t, string(reply), "not the owner")
+	code, reply = post([]tls.Certificate{cert})
+	require.Equal(t, http.StatusOK, code, string(reply))
+	var dkr DecryptKeyReply
+	require.NoError(t, protobuf.DecodeWithConstructors(reply, &dkr,
+		network.DefaultConstructors(cothority.Suite)))
+	secret, err := dkr.RecoverKey(reader.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret key"), secret)
+
+	// The client of the reader sends the same certificate.
+	cl := NewClient(s.cl)
+	require.NoError(t, cl.UseClientCertificate(sk, nil))
+	require.Len(t, cl.c.TLSClientConfig.Certificates, 1)
+	clientLeaf, err := x509.ParseCertificate(
+		cl.c.TLSClientConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, sk.Public(), clientLeaf.PublicKey)
 }
 
-func (s *ts) waitInstID(t *testing.T, instID byzcoin.InstanceID) *byzcoin.Proof {
-	var err error
-	var pr *byzcoin.Proof
-	for i := 0; i < 10; i++ {
-		pr, err = s.cl.WaitProof(instID, s.genesisMsg.BlockInterval, nil)
-		if err == nil {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+// TestService_DecryptKeyStrategy re-encrypts with only some of the nodes of
+// the LTS, chosen by the tree strategies.
+func TestService_DecryptKeyStrategy(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	key := []byte("secret key")
+	prWr := s.addWriteAndWait(t, key)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+	dkr.Strategy = "unknown"
+	_, err := s.services[0].DecryptKey(dkr)
+	require.Error(t, err)
+
+	strategies := []string{StrategyThreshold, StrategyLatency, StrategyBalanced,
+		StrategyFull}
+	for _, name := range strategies {
+		dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+		dkr.Strategy = name
+		dk, err := s.services[0].DecryptKey(dkr)
+		require.NoError(t, err)
+		keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, key, keyCopy)
 	}
-	if err != nil {
-		require.Fail(t, "didn't find proof")
+	// The three subsets asked two of the three other nodes, the full tree
+	// all of them.
+	stats := s.services[0].trees.get()
+	uses := 0
+	for _, u := range stats.Uses {
+		uses += u
 	}
-	return pr
-}
+	require.Equal(t, 3*2+3, uses)
+	require.Equal(t, 3, len(stats.Latency))
 
-func (s *ts) addWriteAndWait(t *testing.T, key []byte) *byzcoin.Proof {
-	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	// A node that failed is replaced by the node that hasn't been asked, and
+	// once there is none left, all nodes are asked.
+	srv := s.services[0]
+	tree, err := srv.decryptionTree(s.ltsRoster, StrategyThreshold, 3)
 	require.NoError(t, err)
+	require.Equal(t, 3, len(tree.Roster.List))
+	failed := map[network.ServerIdentityID]bool{tree.Roster.List[1].ID: true}
+	widened := srv.widenTree(s.ltsRoster, tree, StrategyThreshold, 3, failed)
+	require.Equal(t, 3, len(widened.Roster.List))
+	i, _ := widened.Roster.Search(tree.Roster.List[1].ID)
+	require.Equal(t, -1, i)
+	i, _ = widened.Roster.Search(tree.Roster.List[2].ID)
+	require.NotEqual(t, -1, i)
+	failed[tree.Roster.List[2].ID] = true
+	widened = srv.widenTree(s.ltsRoster, widened, StrategyThreshold, 3, failed)
+	require.Equal(t, 4, len(widened.Roster.List))
 
-	instID := s.addWrite(t, key, ctr.Counters[0]+1)
-	return s.waitInstID(t, instID)
+	require.Error(t, RegisterTreeStrategy(StrategyFull, nil))
+	require.NoError(t, RegisterTreeStrategy("root-only", TreeStrategyFunc(
+		func([]*network.ServerIdentity, int, NodeStats) []*network.ServerIdentity {
+			return nil
+		})))
+	dkr = signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+	dkr.Strategy = "root-only"
+	_, err = s.services[0].DecryptKey(dkr)
+	require.Error(t, err)
+}
+
+// TestService_DecryptKeys re-encrypts two keys in one round.
+func TestService_DecryptKeys(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	key1 := []byte("secret key 1")
+	prWr1 := s.addWriteAndWait(t, key1)
+	prRe1 := s.addReadAndWait(t, prWr1, s.signer.Ed25519.Point)
+	key2 := []byte("secret key 2")
+	prWr2 := s.addWriteAndWait(t, key2)
+	prRe2 := s.addReadAndWait(t, prWr2, s.signer.Ed25519.Point)
+
+	_, err := s.services[0].DecryptKeys(&DecryptKeys{})
+	require.Error(t, err)
+	_, err = s.services[0].DecryptKeys(&DecryptKeys{
+		Requests: make([]DecryptKey, MaxDecryptBatch+1)})
+	require.Error(t, err)
+	sec := s.signer.Ed25519.Secret
+	_, err = s.services[0].DecryptKeys(&DecryptKeys{Requests: []DecryptKey{
+		*signed(t, prRe1, prWr1, sec), *signed(t, prRe1, prWr2, sec)}})
+	require.Error(t, err)
+
+	dks, err := s.services[0].DecryptKeys(&DecryptKeys{Requests: []DecryptKey{
+		*signed(t, prRe1, prWr1, sec), *signed(t, prRe2, prWr2, sec)}})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dks.Replies))
+	for i, k := range [][]byte{key1, key2} {
+		keyCopy, err := dks.Replies[i].RecoverKey(s.signer.Ed25519.Secret)
+		require.NoError(t, err)
+		require.Equal(t, k, keyCopy)
+	}
+}
+
+// TestService_RateLimit checks that the decryption requests of a reader are
+// limited.
+func TestService_RateLimit(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	require.NoError(t, s.services[0].SetRateLimits(RateLimit{},
+		RateLimit{Rate: 0.01, Burst: 1}))
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.True(t, IsRateLimited(err))
+
+	rl := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+	now := time.Now()
+	require.True(t, rl.allow("client", now))
+	require.True(t, rl.allow("client", now))
+	require.False(t, rl.allow("client", now))
+	require.True(t, rl.allow("other", now))
+	require.True(t, rl.allow("client", now.Add(time.Second)))
+}
+
+// TestService_RateLimitTransactions checks that the writes and reads sent to
+// the ByzCoin service of a node are limited per IP address and per signer.
+func TestService_RateLimitTransactions(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	bc := s.servers[0].Service(byzcoin.ServiceName).(*byzcoin.Service)
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := ctr.Counters[0]
+	writeTx := func() []byte {
+		next++
+		write := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+			s.gDarc.GetBaseID(), s.ltsReply.X, []byte("secret key"))
+		writeBuf, err := protobuf.Encode(write)
+		require.NoError(t, err)
+		ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+			byzcoin.Instruction{
+				InstanceID: byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
+				Spawn: &byzcoin.Spawn{
+					ContractID: ContractWriteID,
+					Args:       byzcoin.Arguments{{Name: "write", Value: writeBuf}},
+				},
+				SignerCounter: []uint64{next},
+			},
+		)
+		require.NoError(t, ctx.FillSignersAndSignWith(s.signer))
+		buf, err := protobuf.Encode(&byzcoin.AddTxRequest{
+			Version:     byzcoin.CurrentVersion,
+			SkipchainID: s.cl.ID,
+			Transaction: ctx,
+		})
+		require.NoError(t, err)
+		return buf
+	}
+	send := func(ip string, buf []byte) error {
+		req := &http.Request{RemoteAddr: ip + ":2000"}
+		_, _, err := bc.ProcessClientRequest(req, "AddTxRequest", buf)
+		return err
+	}
+
+	require.NoError(t, s.services[0].SetRateLimits(RateLimit{Rate: 0.01, Burst: 1},
+		RateLimit{}))
+	require.NoError(t, send("10.0.0.1", writeTx()))
+	tx := writeTx()
+	require.True(t, IsRateLimited(send("10.0.0.1", tx)))
+	require.NoError(t, send("10.0.0.2", tx))
+
+	// The signer shares its bucket with the decryption requests for its key.
+	require.NoError(t, s.services[0].SetRateLimits(RateLimit{},
+		RateLimit{Rate: 0.01, Burst: 1}))
+	require.Equal(t, s.signer.Ed25519.Point.String(), signerKey(s.signer.Identity()))
+	require.NoError(t, send("10.0.0.3", writeTx()))
+	require.True(t, IsRateLimited(send("10.0.0.4", writeTx())))
+
+	// Other transactions are not limited.
+	req := &http.Request{RemoteAddr: "10.0.0.3:2000"}
+	other := byzcoin.ClientTransaction{Instructions: byzcoin.Instructions{{
+		InstanceID:       byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
+		Invoke:           &byzcoin.Invoke{ContractID: "value", Command: "update"},
+		SignerIdentities: []darc.Identity{s.signer.Identity()},
+	}}}
+	require.NoError(t, s.services[0].limitTransaction(req, other))
+	require.NoError(t, s.services[0].limitTransaction(req, other))
+}
+
+// TestService_EstimateDecrypt checks the estimation of a decryption before
+// and after a first decryption.
+func TestService_EstimateDecrypt(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	bcID := s.gbReply.Skipblock.SkipChainID()
+	srv := s.services[0]
+	est, err := srv.EstimateDecrypt(&EstimateDecrypt{ByzCoinID: bcID,
+		WriteID: writeID, Reader: s.signer.Ed25519.Point})
+	require.NoError(t, err)
+	require.Equal(t, 4, est.Participants)
+	require.Equal(t, 3, est.Threshold)
+	require.Equal(t, int64(0), est.Latency)
+	require.Equal(t, -1, est.Quota)
+	require.False(t, est.Refused)
+
+	require.NoError(t, srv.SetRateLimits(RateLimit{},
+		RateLimit{Rate: 0.01, Burst: 2}))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err = srv.DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	est, err = srv.EstimateDecrypt(&EstimateDecrypt{ByzCoinID: bcID,
+		WriteID: writeID, Reader: s.signer.Ed25519.Point,
+		Strategy: StrategyThreshold})
+	require.NoError(t, err)
+	require.Equal(t, 3, est.Participants)
+	require.True(t, est.Latency > 0)
+	require.Equal(t, 1, est.Quota)
+	require.Equal(t, 0, est.Decrypting)
+
+	_, err = srv.EstimateDecrypt(&EstimateDecrypt{ByzCoinID: bcID,
+		WriteID: byzcoin.NewInstanceID([]byte("unknown"))})
+	require.Error(t, err)
+}
+
+// TestService_RequestSize checks that too big requests are rejected before
+// being decoded.
+func TestService_RequestSize(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	req := &http.Request{RemoteAddr: "127.0.0.1:2000"}
+	_, _, err := s.services[0].ProcessClientRequest(req, "DecryptKey",
+		make([]byte, DefaultMaxRequestSize+1))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bigger than")
+	_, _, err = s.services[0].ProcessClientRequest(req, "DecryptKeys",
+		make([]byte, DefaultMaxRequestSize+1))
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "bigger than")
+}
+
+// TestService_ReloadConfig changes the configuration of a running node.
+func TestService_ReloadConfig(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	_, err := s.services[0].ReloadConfig(&ReloadConfig{})
+	require.Error(t, err)
+
+	f, err := ioutil.TempFile("", "calypso")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("MaxRequestSize = 1000\n[RateLimitPerIP]\nRate = 1.0\nBurst = 1\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s.services[0].configFile = f.Name()
+
+	reply, err := s.services[0].ReloadConfig(&ReloadConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 1000, reply.Config.MaxRequestSize)
+	require.Equal(t, DefaultMaxBatchRequestSize, reply.Config.MaxBatchRequestSize)
+	require.Equal(t, 20, reply.Config.PropagationTimeout)
+
+	req := &http.Request{RemoteAddr: "127.0.0.1:2000"}
+	_, _, err = s.services[0].ProcessClientRequest(req, "GetEvents",
+		make([]byte, 1001))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bigger than")
+	_, _, err = s.services[0].ProcessClientRequest(req, "DecryptKey", nil)
+	require.False(t, IsRateLimited(err))
+	_, _, err = s.services[0].ProcessClientRequest(req, "DecryptKey", nil)
+	require.True(t, IsRateLimited(err))
+
+	// An invalid file keeps the old configuration.
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("MaxRequestSize = -1"), 0600))
+	_, err = s.services[0].ReloadConfig(&ReloadConfig{})
+	require.Error(t, err)
+	require.Equal(t, 1000, s.services[0].getConfig().MaxRequestSize)
+}
+
+// TestService_DecryptKeyProofs makes sure the reader can verify the
+// re-encrypted shares and detects a wrong share.
+func TestService_DecryptKeyProofs(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	var write Write
+	require.NoError(t, prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &write))
+
+	threshold := LTSThreshold(len(s.ltsRoster.List))
+	require.True(t, write.X.Equal(s.ltsReply.X))
+
+	dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+	dk, err := s.services[0].DecryptKey(dkr)
+	require.NoError(t, err)
+	require.NoError(t, dk.Verify(write.X, threshold, write.U, s.signer.Ed25519.Point))
+	require.Error(t, dk.Verify(write.X, threshold, write.U, cothority.Suite.Point().Pick(
+		cothority.Suite.RandomStream())))
+	// The key and the threshold of the LTS are not taken from the reply.
+	other := cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	require.Error(t, dk.Verify(other, threshold, write.U, s.signer.Ed25519.Point))
+	require.Error(t, dk.Verify(write.X, threshold+1, write.U, s.signer.Ed25519.Point))
+
+	// The reply is signed by the node for this request.
+	root := s.services[0].ServerIdentity().Public
+	require.NoError(t, dk.VerifySignature(dkr, root))
+	require.Error(t, dk.VerifySignature(dkr, s.services[1].ServerIdentity().Public))
+	require.Error(t, dk.VerifySignature(&DecryptKey{Read: *prRe, Write: *prWr,
+		Strategy: StrategyFull}, root))
+	sig := dk.Signature
+	dk.Signature = nil
+	require.Error(t, dk.VerifySignature(dkr, root))
+	dk.Signature = sig
+
+	recovered, report, err := dk.RecoverKeyVerified(write.X, threshold, write.U, s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret key"), recovered)
+	require.Equal(t, 0, len(report.Invalid)+len(report.Duplicate))
+
+	dk.Uis[1].V = cothority.Suite.Point().Add(dk.Uis[1].V,
+		cothority.Suite.Point().Base())
+	require.Error(t, dk.Verify(write.X, threshold, write.U, s.signer.Ed25519.Point))
+
+	// The bad share is left out, and the key is recovered if enough shares
+	// are left.
+	recovered, report, err = dk.RecoverKeyVerified(write.X, threshold, write.U, s.signer.Ed25519.Secret)
+	require.Equal(t, []int{dk.Uis[1].I}, report.Invalid)
+	require.Equal(t, []*network.ServerIdentity{s.ltsRoster.List[dk.Uis[1].I]},
+		report.Trustees(s.ltsRoster))
+	if len(dk.Uis) > len(dk.Commits) {
+		require.NoError(t, err)
+		require.Equal(t, []byte("secret key"), recovered)
+	} else {
+		require.Error(t, err)
+	}
+}
+
+// TestService_CheckReencryption makes sure the nodes refuse to re-encrypt a
+// point that doesn't match the write, and say so.
+func TestService_CheckReencryption(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	var write Write
+	require.NoError(t, prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &write))
+
+	check := func(U kyber.Point, vd *vData) protocol.Refusal {
+		buf, err := protobuf.Encode(vd)
+		require.NoError(t, err)
+		return s.services[1].checkReencryption(s.ltsReply.InstanceID,
+			s.services[0].ServerIdentity().ID, &protocol.Reencrypt{U: U, Xc: s.signer.Ed25519.Point,
+				VerificationData: &buf})
+	}
+	require.Equal(t, protocol.Refusal(0),
+		check(write.U, &vData{Proof: *prRe, Write: prWr}))
+	require.Equal(t, protocol.RefusedBadWrite,
+		check(cothority.Suite.Point().Pick(cothority.Suite.RandomStream()),
+			&vData{Proof: *prRe, Write: prWr}))
+	require.Equal(t, protocol.RefusedBadWrite,
+		check(write.U, &vData{Proof: *prRe}))
+	require.Equal(t, protocol.RefusedDenied,
+		check(write.U, &vData{Proof: *prWr, Write: prWr}))
+}
+
+// TestService_ReportMisbehavior makes sure a reply with a wrong share is
+// evidence against the root that signed it, and that the other nodes log it.
+func TestService_ReportMisbehavior(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+	root := s.services[0].ServerIdentity()
+	dk, err := s.services[0].DecryptKey(dkr)
+	require.NoError(t, err)
+	_, err = NewMisbehavior(dkr, dk, root)
+	require.Error(t, err)
+
+	// The root changes a share and signs the reply.
+	dk.Uis[1].V = cothority.Suite.Point().Add(dk.Uis[1].V,
+		cothority.Suite.Point().Base())
+	require.NoError(t, s.services[0].signDecryptKeyReply(dkr, dk))
+	_, err = NewMisbehavior(dkr, dk, s.services[1].ServerIdentity())
+	require.Error(t, err)
+	m, err := NewMisbehavior(dkr, dk, root)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, m.Shares)
+	require.NoError(t, m.Verify())
+	m.Shares = []int{0}
+	require.Error(t, m.Verify())
+	m.Shares = []int{1}
+
+	_, err = s.services[1].ReportMisbehavior(&ReportMisbehavior{Misbehavior: *m})
+	require.NoError(t, err)
+	events, err := s.services[1].GetEvents(&GetEvents{
+		Identity: root.Public.String()})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events.Events))
+	require.Equal(t, EventMisbehavior, events.Events[0].Type)
+	require.NoError(t, events.Events[0].Misbehavior.Verify())
+}
+
+// TestService_DecryptKeyPartial makes sure the service gives up after the
+// DecryptTimeout and returns the shares it got if the request asks for them.
+func TestService_DecryptKeyPartial(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	var write Write
+	require.NoError(t, prWr.VerifyAndDecode(cothority.Suite, ContractWriteID, &write))
+	threshold := LTSThreshold(len(s.ltsRoster.List))
+
+	conf := s.services[0].getConfig()
+	conf.DecryptTimeout = 1
+	require.NoError(t, s.services[0].SetConfig(conf))
+	for _, srv := range s.servers[2:4] {
+		srv.Pause()
+	}
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+
+	dkr := signed(t, prRe, prWr, s.signer.Ed25519.Secret)
+	dkr.Partial = true
+	dk, err := s.services[0].DecryptKey(dkr)
+	require.NoError(t, err)
+	require.True(t, dk.Partial)
+	require.Nil(t, dk.XhatEnc)
+	require.Equal(t, 2, len(dk.Uis))
+	require.Equal(t, 2, len(dk.Failures))
+	for _, f := range dk.Failures {
+		require.Equal(t, "unresponsive", f.Reason)
+	}
+	require.NoError(t, dk.verifyShares(write.X, threshold, write.U, s.signer.Ed25519.Point))
+	require.Error(t, dk.Verify(write.X, threshold, write.U, s.signer.Ed25519.Point))
+	for _, srv := range s.servers[2:4] {
+		srv.Unpause()
+	}
+}
+
+// TestService_DecryptEphemeralKey requests a read to a different key than the
+// readers.
+func TestService_DecryptEphemeralKey(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	ephemeral := key.NewKeyPair(cothority.Suite)
+
+	key1 := []byte("secret key 1")
+	prWr1 := s.addWriteAndWait(t, key1)
+	prRe1 := s.addReadAndWait(t, prWr1, ephemeral.Public)
+
+	dk1, err := s.services[0].DecryptKey(signed(t, prRe1, prWr1, ephemeral.Private))
+	require.NoError(t, err)
+	require.True(t, dk1.X.Equal(s.ltsReply.X))
+
+	keyCopy1, err := dk1.RecoverKey(ephemeral.Private)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy1)
+}
+
+// TestService_GetDocumentStats checks that reads and decryptions are counted
+// while the blocks are added.
+func TestService_GetDocumentStats(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	s.waitForBlocks(t, s.services[0])
+	stats, err := s.services[0].GetDocumentStats(&GetDocumentStats{WriteID: writeID})
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Reads)
+	require.Equal(t, 1, stats.Readers)
+	require.Equal(t, 1, stats.Decrypts)
+	require.NotEqual(t, int64(0), stats.FirstRead)
+	require.True(t, stats.LastRead >= stats.FirstRead)
+	require.NotEqual(t, int64(0), stats.LastDecrypt)
+
+	stats, err = s.services[0].GetDocumentStats(&GetDocumentStats{})
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Reads)
+}
+
+func TestService_ListDocuments(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr1 := s.addWriteAndWait(t, []byte("secret key 1"))
+	prWr2 := s.addWriteAndWait(t, []byte("secret key 2"))
+	s.addReadAndWait(t, prWr1, s.signer.Ed25519.Point)
+	writeIDs := []byzcoin.InstanceID{
+		byzcoin.NewInstanceID(prWr1.InclusionProof.Key()),
+		byzcoin.NewInstanceID(prWr2.InclusionProof.Key()),
+	}
+
+	s.waitForBlocks(t, s.services[0])
+	req := &ListDocuments{ByzCoinID: s.gbReply.Skipblock.Hash}
+	reply, err := s.services[0].ListDocuments(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, reply.Total)
+	for i, doc := range reply.Documents {
+		require.True(t, doc.WriteID.Equal(writeIDs[i]))
+		require.Equal(t, s.signer.Identity().String(), doc.Writer)
+		require.NotEqual(t, int64(0), doc.Timestamp)
+	}
+	require.Equal(t, 1, reply.Documents[0].Readers)
+	require.Equal(t, 0, reply.Documents[1].Readers)
+
+	reply, err = s.services[0].ListDocuments(&ListDocuments{
+		ByzCoinID: req.ByzCoinID, Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 2, reply.Total)
+	require.Equal(t, 1, len(reply.Documents))
+	require.True(t, reply.Documents[0].WriteID.Equal(writeIDs[1]))
+
+	reply, err = s.services[0].ListDocuments(&ListDocuments{
+		ByzCoinID: req.ByzCoinID, Writer: "ed25519:unknown"})
+	require.NoError(t, err)
+	require.Equal(t, 0, reply.Total)
+	reply, err = s.services[0].ListDocuments(&ListDocuments{})
+	require.NoError(t, err)
+	require.Empty(t, reply.Documents)
+}
+
+func TestService_GetChainStats(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	s.waitForBlocks(t, s.services[0])
+	bcID := s.gbReply.Skipblock.SkipChainID()
+	stats, err := s.services[0].GetChainStats(&GetChainStats{ByzCoinID: bcID})
+	require.NoError(t, err)
+	var writes, reads int
+	for _, day := range stats.Days {
+		writes += day.Writes
+		reads += day.Reads
+	}
+	require.Equal(t, 1, writes)
+	require.Equal(t, 1, reads)
+	require.Equal(t, 1, stats.Decrypts)
+	require.True(t, stats.Blocks >= 2)
+	require.True(t, stats.DecryptLatency > 0)
+
+	stats, err = s.services[0].GetChainStats(&GetChainStats{ByzCoinID: []byte("unknown")})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(stats.Days))
+}
+
+// TestService_RetentionEvents makes sure the legal holds and the retention
+// of a write are logged with their own events, and are not counted as new
+// writes.
+func TestService_RetentionEvents(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	signers := []darc.Signer{s.signer}
+	require.NoError(t, calypsoClient.HoldWrite(writeID, "audit", signers,
+		[]uint64{ctr.Counters[0] + 1}, 10))
+	require.NoError(t, calypsoClient.RetainWrite(writeID,
+		time.Now().Add(time.Hour), signers, []uint64{ctr.Counters[0] + 2}, 10))
+	require.NoError(t, calypsoClient.ReleaseWrite(writeID, signers,
+		[]uint64{ctr.Counters[0] + 3}, 10))
+
+	s.waitForBlocks(t, s.services[0])
+	events, err := s.services[0].GetEvents(&GetEvents{})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(events.Events))
+	for i, typ := range []string{EventWrite, EventHeld, EventRetained,
+		EventReleased} {
+		require.Equal(t, typ, events.Events[i].Type)
+		require.True(t, events.Events[i].WriteID.Equal(writeID))
+	}
+
+	stats, err := s.services[0].GetChainStats(&GetChainStats{
+		ByzCoinID: s.gbReply.Skipblock.SkipChainID()})
+	require.NoError(t, err)
+	writes := 0
+	for _, day := range stats.Days {
+		writes += day.Writes
+	}
+	require.Equal(t, 1, writes)
+}
+
+// TestService_CatchUp checks that a node which doesn't hold the chain fetches
+// the missed blocks from the roster of the chain.
+func TestService_CatchUp(t *testing.T) {
+	s := newTSWithExtras(t, 5, 1)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	extra := s.services[5]
+	bcID := s.gbReply.Skipblock.SkipChainID()
+	stats, err := extra.GetDocumentStats(&GetDocumentStats{WriteID: writeID})
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Reads)
+
+	// Verifying a proof makes the node learn the roster of the chain.
+	require.NoError(t, extra.verifyProof(prWr))
+	require.NoError(t, extra.catchUp(bcID, -1))
+	stats, err = extra.GetDocumentStats(&GetDocumentStats{WriteID: writeID})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Reads)
+	next := extra.stats.nextBlock(bcID)
+	require.True(t, next > 0)
+
+	// A second catch-up doesn't count the blocks twice.
+	require.NoError(t, extra.catchUp(bcID, -1))
+	stats, err = extra.GetDocumentStats(&GetDocumentStats{WriteID: writeID})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Reads)
+}
+
+// TestService_RepairBlock checks that a node which missed the block of a read
+// fetches it when verifying a re-encryption, instead of refusing it.
+func TestService_RepairBlock(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	key := []byte("secret key")
+	prWr := s.addWriteAndWait(t, key)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	db := s.services[1].Service(skipchain.ServiceName).(*skipchain.Service).GetDB()
+	require.NoError(t, db.RemoveBlock(prRe.Latest.Hash))
+	require.Nil(t, db.GetByID(prRe.Latest.Hash))
+
+	require.NoError(t, s.services[1].verifyReadBlock(prRe))
+	require.NotNil(t, db.GetByID(prRe.Latest.Hash))
+
+	dk, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy, err := dk.RecoverKey(s.signer.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key, keyCopy)
+}
+
+// TestService_Schedule checks that no task is run or scheduled once the
+// service is closed.
+func TestService_Schedule(t *testing.T) {
+	s := &Service{closing: make(chan struct{}),
+		timers: make(map[string]*time.Timer)}
+	ran := make(chan bool, 2)
+	s.schedule("repair", 100*time.Millisecond, func() { ran <- true })
+	require.Equal(t, 1, len(s.timers))
+	s.TestClose()
+	s.schedule("consistency", 0, func() { ran <- true })
+	require.Equal(t, 1, len(s.timers))
+	select {
+	case <-ran:
+		t.Fatal("a task ran after the service was closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestService_RepairCorruptedBlock checks that a block which doesn't match
+// its hash anymore is not served, and is fetched again from the other nodes.
+func TestService_RepairCorruptedBlock(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	id := prRe.Latest.Hash
+
+	db := s.services[1].Service(skipchain.ServiceName).(*skipchain.Service).GetDB()
+	sb := db.GetByID(id)
+	require.NotNil(t, sb)
+	sb.Data = append(sb.Data, 0)
+	buf, err := network.Marshal(sb)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bbolt.Bucket) error {
+			if b.Get(id) == nil {
+				return nil
+			}
+			return b.Put(id, buf)
+		})
+	}))
+
+	require.Nil(t, db.GetByID(id))
+	for i := 0; i < 50 && db.GetByID(id) == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	repaired := db.GetByID(id)
+	require.NotNil(t, repaired)
+	require.Equal(t, prRe.Latest.Data, repaired.Data)
+
+	reply, err := s.services[1].CheckConsistency(&CheckConsistency{})
+	require.NoError(t, err)
+	require.NotEmpty(t, reply.Repairs)
+	require.True(t, reply.Repairs[0].BlockID.Equal(id))
+	require.True(t, reply.Repairs[0].Repaired)
+}
+
+// TestService_Save checks that the storage is saved from a copy, which isn't
+// changed by later updates.
+func TestService_Save(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	srv := s.services[0]
+	id := s.ltsReply.InstanceID
+	snap := srv.storage.snapshot()
+	srv.storage.Lock()
+	shared := srv.storage.Shared[id]
+	delete(srv.storage.Shared, id)
+	srv.storage.Unlock()
+	require.NotNil(t, snap.Shared[id])
+
+	// The saved storage still holds the LTS until the next save.
+	msg, err := srv.Load(storageKey)
+	require.NoError(t, err)
+	require.NotNil(t, msg.(*storage).Shared[id])
+	require.NoError(t, srv.save())
+	msg, err = srv.Load(storageKey)
+	require.NoError(t, err)
+	require.Nil(t, msg.(*storage).Shared[id])
+
+	srv.storage.Lock()
+	srv.storage.Shared[id] = shared
+	srv.storage.Unlock()
+	require.NoError(t, srv.save())
+}
+
+// TestService_CheckConsistency makes sure that a node whose LTS differs from
+// the other nodes is reported.
+func TestService_CheckConsistency(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	reply, err := s.services[0].CheckConsistency(&CheckConsistency{})
+	require.NoError(t, err)
+	require.Nil(t, reply.Report)
+
+	reply, err = s.services[0].CheckConsistency(&CheckConsistency{Run: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, reply.Report.Checked)
+	require.Empty(t, reply.Report.Unreachable)
+	require.Empty(t, reply.Report.Divergences)
+
+	id := s.ltsReply.InstanceID
+	storage := s.services[1].storage
+	storage.Lock()
+	tampered := *storage.Shared[id]
+	tampered.X = cothority.Suite.Point().Pick(cothority.Suite.RandomStream())
+	storage.Shared[id] = &tampered
+	storage.Unlock()
+
+	reply, err = s.services[0].CheckConsistency(&CheckConsistency{Run: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, reply.Report.Checked)
+	require.Equal(t, 1, len(reply.Report.Divergences))
+	div := reply.Report.Divergences[0]
+	require.True(t, div.Node.Equal(s.services[1].ServerIdentity()))
+	require.Equal(t, digestLTS+hex.EncodeToString(id[:]), div.Key)
+	require.NotEqual(t, div.Local, div.Remote)
+
+	// The last report is kept.
+	reply, err = s.services[0].CheckConsistency(&CheckConsistency{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(reply.Report.Divergences))
+}
+
+// TestService_Snapshot checks that a snapshot restores the LTS on a node
+// that lost its storage, and that it cannot be imported on another node.
+func TestService_Snapshot(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	cl := NewClient(s.cl)
+	si := s.services[0].ServerIdentity()
+	operator := darc.NewSignerEd25519(nil, nil)
+	// The default LTS doesn't allow exports.
+	_, err := cl.ExportSnapshot(si, operator.Ed25519.Point, nil)
+	require.Error(t, err)
+	storage := s.services[0].storage
+	storage.Lock()
+	for id := range storage.Shared {
+		delete(storage.Shared, id)
+		delete(storage.DKS, id)
+	}
+	storage.Unlock()
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	s.ltsReply, err = cl.CreateLTSWithEscrow(s.ltsRoster, s.gDarc.GetBaseID(),
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	_, err = cl.ExportSnapshot(si, operator.Ed25519.Point, nil)
+	require.Error(t, err)
+
+	// Once the export is recorded, the snapshot is exported.
+	ctr, err = s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	record, err := cl.RecordExport(s.ltsReply.InstanceID, operator.Ed25519.Point,
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	// Even with insecure admin requests, the request must be signed.
+	_, err = s.services[0].ExportSnapshot(&ExportSnapshot{
+		OperatorKey: operator.Ed25519.Point, Timestamp: time.Now().Unix(),
+		Records: []byzcoin.Proof{*record}})
+	require.Error(t, err)
+	exp, err := cl.ExportSnapshot(si, operator.Ed25519.Point,
+		[]byzcoin.Proof{*record})
+	require.NoError(t, err)
+	buf, err := protobuf.Encode(exp)
+	require.NoError(t, err)
+
+	sn := &Snapshot{}
+	require.NoError(t, protobuf.DecodeWithConstructors(buf, sn,
+		network.DefaultConstructors(cothority.Suite)))
+	require.NoError(t, sn.Seal(operator.Ed25519.Secret,
+		s.services[0].ServerIdentity()))
+	_, err = s.services[0].ImportSnapshot(&ImportSnapshot{Snapshot: *sn})
+	require.Error(t, err)
+
+	storage.Lock()
+	for id := range storage.Shared {
+		delete(storage.Shared, id)
+		delete(storage.DKS, id)
+	}
+	storage.Unlock()
+	imp, err := s.services[0].ImportSnapshot(&ImportSnapshot{Snapshot: *sn})
+	require.NoError(t, err)
+	require.Equal(t, 1, imp.LTSs)
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	// The secrets are sealed to the key of the first node.
+	storage = s.services[1].storage
+	storage.Lock()
+	for id := range storage.Shared {
+		delete(storage.Shared, id)
+	}
+	storage.Unlock()
+	_, err = s.services[1].ImportSnapshot(&ImportSnapshot{Snapshot: *sn})
+	require.Error(t, err)
+}
+
+// TestService_ReconcileShare checks that a node that lost its share
+// recovers it from the other nodes of the LTS.
+func TestService_ReconcileShare(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	id := s.ltsReply.InstanceID
+	storage := s.services[1].storage
+	storage.Lock()
+	shared := storage.Shared[id].Clone()
+	delete(storage.Shared, id)
+	delete(storage.DKS, id)
+	delete(storage.Polys, id)
+	delete(storage.Rosters, id)
+	delete(storage.Replies, id)
+	delete(storage.Holders, id)
+	storage.Unlock()
+	_, err := s.services[1].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+
+	// Another node of the roster cannot get the missing share.
+	s.services[2].storage.RLock()
+	holders := s.services[2].storage.Holders[id]
+	s.services[2].storage.RUnlock()
+	require.NotNil(t, holders)
+	steal := &ShareContribution{
+		LTSID:     id,
+		Index:     shared.Index,
+		Requester: s.services[3].getKeyPair().Public,
+	}
+	for i, si := range holders.List {
+		if i != shared.Index {
+			steal.Helpers = append(steal.Helpers, i)
+			steal.Publics = append(steal.Publics, si.ServicePublic(ServiceName))
+		}
+	}
+	_, err = s.services[2].ShareContribution(steal)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't hold share")
+
+	s.services[0].checkShares()
+	storage.Lock()
+	recovered := storage.Shared[id]
+	storage.Unlock()
+	require.NotNil(t, recovered)
+	require.Equal(t, shared.Index, recovered.Index)
+	require.True(t, shared.V.Equal(recovered.V))
+	require.True(t, shared.X.Equal(recovered.X))
+	require.True(t, sameHolders(holders, storage.Holders[id]))
+	_, err = s.services[1].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	// Requests that don't name a threshold of helpers are refused.
+	reply, err := s.services[2].ShareContribution(&ShareContribution{
+		LTSID:     id,
+		Index:     shared.Index,
+		Helpers:   []int{},
+		Requester: s.services[3].getKeyPair().Public,
+	})
+	require.Error(t, err)
+	require.Nil(t, reply)
+}
+
+// TestService_ReconcileShareNodeDown checks that a node recovers its share
+// while another node of the LTS is offline.
+func TestService_ReconcileShareNodeDown(t *testing.T) {
+	s := newTS(t, 7)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+
+	id := s.ltsReply.InstanceID
+	storage := s.services[1].storage
+	storage.Lock()
+	shared := storage.Shared[id].Clone()
+	delete(storage.Shared, id)
+	delete(storage.Holders, id)
+	storage.Unlock()
+	require.NoError(t, s.servers[6].Close())
+
+	s.services[0].checkShares()
+	storage.Lock()
+	recovered := storage.Shared[id]
+	storage.Unlock()
+	require.NotNil(t, recovered)
+	require.Equal(t, shared.Index, recovered.Index)
+	require.True(t, shared.V.Equal(recovered.V))
+	_, err := s.services[1].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+}
+
+// TestService_RevokeIdentity checks that a revoked key cannot decrypt
+// anymore, neither as the key of a read nor as the signer of a read, and
+// that the reply lists the writes it read.
+func TestService_RevokeIdentity(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	other := key.NewKeyPair(cothority.Suite)
+	prOther := s.addReadAndWait(t, prWr, other.Public)
+	s.waitForBlocks(t, s.services[0])
+
+	reply, err := s.services[0].RevokeIdentity(&RevokeIdentity{
+		Key: s.signer.Ed25519.Point})
+	require.NoError(t, err)
+	require.Equal(t, []byzcoin.InstanceID{writeID}, reply.Writes)
+	require.Equal(t, []byzcoin.InstanceID{s.ltsReply.InstanceID}, reply.LTSs)
+
+	// The read to another key is refused, as it is signed by the revoked
+	// key.
+	_, err = s.services[0].DecryptKey(signed(t, prOther, prWr, other.Private))
+	require.Error(t, err)
+	// The other nodes refuse to re-encrypt to the revoked key.
+	for _, srv := range s.services[1:] {
+		_, err = srv.RevokeIdentity(&RevokeIdentity{Key: s.signer.Ed25519.Point})
+		require.NoError(t, err)
+	}
+	s.services[0].storage.Lock()
+	s.services[0].storage.Revoked = map[string]int64{}
+	s.services[0].storage.Unlock()
+	_, err = s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+
+	// A new read to a fresh key, signed by the revoked key, is refused
+	// right after its spawn, even if the nodes didn't log it.
+	fresh := key.NewKeyPair(cothority.Suite)
+	prFresh := s.addReadAndWait(t, prWr, fresh.Public)
+	for _, srv := range s.services {
+		srv.events.Lock()
+		srv.events.Events, srv.events.byWrite, srv.events.byIdentity = nil, nil, nil
+		srv.events.Unlock()
+	}
+	_, err = s.services[1].DecryptKey(signed(t, prFresh, prWr, fresh.Private))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has been revoked")
+	// The trustees refuse it too if the root doesn't.
+	_, err = s.services[0].DecryptKey(signed(t, prFresh, prWr, fresh.Private))
+	require.Error(t, err)
+}
+
+// TestService_RevokeTrimmedEvents checks that the signer of a read that
+// doesn't record it is found in the chain once the event log dropped the
+// read.
+func TestService_RevokeTrimmedEvents(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	readID := byzcoin.NewInstanceID(prRe.InclusionProof.Key())
+	bcID := prRe.Latest.SkipChainID()
+	srv := s.services[0]
+	rd, err := decodeReadProof(prRe)
+	require.NoError(t, err)
+	s.waitForBlocks(t, srv)
+
+	// Reads spawned before the signers were recorded don't hold them.
+	rd.Signers = nil
+	events := make([]Event, maxEvents)
+	for i := range events {
+		events[i] = Event{Type: EventDecrypt}
+	}
+	srv.events.add(events...)
+	require.Equal(t, "", srv.events.readerOf(rd.Write, readID))
+
+	other := key.NewKeyPair(cothority.Suite)
+	_, err = srv.RevokeIdentity(&RevokeIdentity{Key: other.Public})
+	require.NoError(t, err)
+	require.NoError(t, srv.checkRevoked(bcID, rd.Xc, rd, readID))
+	_, err = srv.RevokeIdentity(&RevokeIdentity{Key: s.signer.Ed25519.Point})
+	require.NoError(t, err)
+	rd.Xc = key.NewKeyPair(cothority.Suite).Public
+	err = srv.checkRevoked(bcID, rd.Xc, rd, readID)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reader "+s.signer.Identity().String())
+}
+
+// TestService_GetEvents checks that the event log holds the calypso
+// instructions and the changes of the read rules, and that it can be read
+// page by page.
+func TestService_GetEvents(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	waitEvents := func(n int) *GetEventsReply {
+		s.waitForBlocks(t, s.services[0])
+		events, err := s.services[0].GetEvents(&GetEvents{})
+		require.NoError(t, err)
+		require.Equal(t, n, len(events.Events))
+		return events
+	}
+	waitEvents(2)
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	other := darc.NewSignerEd25519(nil, nil)
+	s.evolveReadRule(t, expression.InitOrExpr(s.signer.Identity().String(),
+		other.Identity().String()))
+
+	events := waitEvents(4)
+	require.Equal(t, uint64(4), events.Next)
+	require.Equal(t, EventWrite, events.Events[0].Type)
+	require.Equal(t, EventRead, events.Events[1].Type)
+	require.Equal(t, EventDecrypt, events.Events[2].Type)
+	require.Equal(t, EventAccessGranted, events.Events[3].Type)
+	// The identities are only given to the operator of the node.
+	require.Equal(t, "", events.Events[3].Identity)
+	page, err := NewClient(s.cl).GetIdentityEvents(s.services[0].ServerIdentity(),
+		0, 0, other.Identity().String())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page.Events))
+	require.Equal(t, other.Identity().String(), page.Events[0].Identity)
+	page, err = s.services[0].GetEvents(&GetEvents{
+		Identity: other.Identity().String()})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(page.Events))
+
+	page, err = s.services[0].GetEvents(&GetEvents{Cursor: 1, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page.Events))
+	require.Equal(t, uint64(3), page.Next)
+	require.Equal(t, EventRead, page.Events[0].Type)
+
+	page, err = s.services[0].GetEvents(&GetEvents{WriteID: &writeID})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(page.Events))
+	page, err = s.services[0].GetEvents(&GetEvents{Cursor: 4})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(page.Events))
+	require.Equal(t, uint64(4), page.Next)
+	page, err = s.services[0].GetEvents(&GetEvents{ByzCoinID: []byte("other")})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(page.Events))
+
+	// The reads and writes can be verified against the genesis block.
+	genesis := s.gbReply.Skipblock
+	page, err = s.services[0].GetEvents(&GetEvents{Proofs: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page.Proofs))
+	require.NoError(t, page.Verify(genesis))
+	page.Proofs = page.Proofs[:1]
+	require.Error(t, page.Verify(genesis))
+	page, err = s.services[0].GetEvents(&GetEvents{Proofs: true})
+	require.NoError(t, err)
+	page.Events[1].WriteID = page.Events[1].InstanceID
+	require.Error(t, page.Verify(genesis))
+
+	verified, err := NewClient(s.cl).GetVerifiedEvents(0, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(verified.Events))
+}
+
+// TestService_Webhooks makes sure that the reads and decryptions are sent
+// once, signed, to the webhooks.
+func TestService_Webhooks(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	received := make(chan *WebhookNotification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var node kyber.Point
+		for _, svc := range s.services {
+			pub := svc.ServerIdentity().ServicePublic(ServiceName)
+			if pub.String() == r.Header.Get(WebhookNodeHeader) {
+				node = pub
+			}
+		}
+		require.NotNil(t, node)
+		n, err := VerifyWebhook(body, r.Header.Get(WebhookSignatureHeader), node)
+		require.NoError(t, err)
+		_, err = VerifyWebhook(append(body, ' '),
+			r.Header.Get(WebhookSignatureHeader), node)
+		require.Error(t, err)
+		received <- n
+	}))
+	defer srv.Close()
+
+	conf := s.services[0].getConfig()
+	conf.Webhooks = []Webhook{{URL: "ftp://example.com"}}
+	require.Error(t, s.services[0].SetConfig(conf))
+	conf.Webhooks = []Webhook{{URL: srv.URL, Events: []string{EventWrite}}}
+	require.Error(t, s.services[0].SetConfig(conf))
+	conf.Webhooks = []Webhook{{URL: srv.URL}}
+	for _, svc := range s.services {
+		require.NoError(t, svc.SetConfig(conf))
+	}
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	readID := byzcoin.NewInstanceID(prRe.InclusionProof.Key())
+	wait := func() *WebhookNotification {
+		select {
+		case n := <-received:
+			return n
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "no notification received")
+		}
+		return nil
+	}
+	n := wait()
+	require.Equal(t, EventRead, n.Type)
+	require.Equal(t, hex.EncodeToString(writeID[:]), n.DocumentID)
+	require.Equal(t, hex.EncodeToString(readID[:]), n.ReadID)
+	require.Equal(t, s.signer.Identity().String(), n.Reader)
+	require.NotEqual(t, "", n.BlockHash)
+
+	_, err := s.services[0].DecryptKey(signed(t, prRe, prWr, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+	n = wait()
+	require.Equal(t, EventDecrypt, n.Type)
+	require.Equal(t, hex.EncodeToString(writeID[:]), n.DocumentID)
+	require.Equal(t, -1, n.BlockIndex)
+	require.Equal(t, "", n.BlockHash)
+
+	// Only the leader sends the read.
+	select {
+	case n := <-received:
+		require.Fail(t, "unexpected notification", n.Type)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+// TestEventLog_Index makes sure that the filtered pages found with the
+// indexes are the same as the ones found by looking at all events.
+func TestEventLog_Index(t *testing.T) {
+	el := &eventLog{}
+	writes := []byzcoin.InstanceID{byzcoin.NewInstanceID([]byte("w0")),
+		byzcoin.NewInstanceID([]byte("w1")), byzcoin.NewInstanceID([]byte("w2"))}
+	for i := 0; i < maxEvents+10; i++ {
+		el.add(Event{Type: EventRead, WriteID: writes[i%3],
+			Identity: fmt.Sprintf("reader%d", i%7)})
+	}
+	require.Equal(t, maxEvents, len(el.Events))
+
+	// scan returns the page by looking at all events.
+	scan := func(req *GetEvents) *GetEventsReply {
+		reply := &GetEventsReply{Next: req.Cursor}
+		for _, e := range el.Events {
+			if e.Cursor < req.Cursor {
+				continue
+			}
+			if len(reply.Events) == req.Limit {
+				return reply
+			}
+			reply.Next = e.Cursor + 1
+			if req.matches(e, nil) {
+				reply.Events = append(reply.Events, e)
+			}
+		}
+		if len(el.Events) > 0 && el.Next > reply.Next {
+			reply.Next = el.Next
+		}
+		return reply
+	}
+	check := func() {
+		for _, req := range []*GetEvents{
+			{Cursor: 0, Limit: 50, WriteID: &writes[1]},
+			{Cursor: 9990, Limit: 50, WriteID: &writes[2]},
+			{Cursor: 5000, Limit: 100, Identity: "reader3"},
+			{Cursor: 10005, Limit: 20, Identity: "reader4", WriteID: &writes[0]},
+			{Cursor: 20000, Limit: 10, Identity: "reader1"},
+		} {
+			require.Equal(t, scan(req), el.page(req, nil))
+		}
+		require.Empty(t, el.page(&GetEvents{Identity: "unknown"}, nil).Events)
+	}
+	check()
+	require.Equal(t, uint64(10), el.byWrite[writes[1]][0])
+	// The cursors of the dropped events are freed.
+	for _, cursors := range el.byWrite {
+		require.True(t, cap(cursors) <= 2*len(cursors)+1)
+	}
+
+	// The indexes are rebuilt when the log is loaded.
+	el.byWrite, el.byIdentity = nil, nil
+	el.reindex()
+	check()
+}
+
+// TestService_Journal checks that the events and the statistics are
+// restored from the journal, before and after it has been compacted.
+func TestService_Journal(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	srv := s.services[0]
+	writeID := byzcoin.NewInstanceID([]byte("write"))
+	bcID := skipchain.SkipBlockID("chain")
+	srv.stats.addRead(writeID, nil, 1)
+	srv.stats.addBlock(bcID, 1, 0, 1)
+	require.NoError(t, srv.saveStats())
+	srv.stats.addRead(writeID, nil, 2)
+	require.NoError(t, srv.saveStats())
+
+	add := func(n int) {
+		events := make([]Event, n)
+		for i := range events {
+			events[i] = Event{Type: EventDecrypt, WriteID: writeID}
+		}
+		srv.events.add(events...)
+		require.NoError(t, srv.saveEvents())
+	}
+	add(10)
+	require.NoError(t, srv.tryLoadEvents())
+	require.NoError(t, srv.tryLoadStats())
+	require.Equal(t, 2, srv.stats.reply(writeID, nil).Reads)
+	require.Equal(t, 1, srv.stats.chainReply(bcID).Blocks)
+	require.Equal(t, 10, len(srv.events.page(&GetEvents{WriteID: &writeID}, nil).Events))
+
+	// Once the journal is compacted, only the newer events are in it.
+	for i := 0; i < compactAfter/100; i++ {
+		add(100)
+	}
+	require.True(t, srv.eventsJournal.size < compactAfter)
+	add(5)
+	next := srv.events.Next
+	require.NoError(t, srv.tryLoadEvents())
+	require.Equal(t, next, srv.events.Next)
+	require.Equal(t, 5, srv.eventsJournal.size)
+	page := srv.events.page(&GetEvents{Cursor: next - 5, WriteID: &writeID}, nil)
+	require.Equal(t, 5, len(page.Events))
+}
+
+// TestService_QueryAccessAt checks that the readers of a write can be
+// queried in the past.
+func TestService_QueryAccessAt(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	id := s.signer.Identity().String()
+
+	reply, err := s.services[0].QueryAccessAt(&QueryAccessAt{
+		ByzCoinID:  s.cl.ID,
+		WriteID:    writeID,
+		BlockIndex: prWr.Latest.Index,
+		Identity:   id,
+	})
+	require.NoError(t, err)
+	require.True(t, reply.Exists)
+	require.True(t, reply.Allowed)
+	require.Contains(t, reply.Readers, id)
+
+	// In the genesis block the write didn't exist yet.
+	reply, err = s.services[0].QueryAccessAt(&QueryAccessAt{
+		ByzCoinID: s.cl.ID,
+		WriteID:   writeID,
+		Identity:  id,
+	})
+	require.NoError(t, err)
+	require.False(t, reply.Exists)
+	require.False(t, reply.Allowed)
+
+	// Using the time instead of the index.
+	reply, err = s.services[0].QueryAccessAt(&QueryAccessAt{
+		ByzCoinID: s.cl.ID,
+		WriteID:   writeID,
+		Timestamp: time.Now().UnixNano(),
+	})
+	require.NoError(t, err)
+	require.True(t, reply.Exists)
+	require.True(t, reply.BlockIndex >= prWr.Latest.Index)
+}
+
+type ts struct {
+	local      *onet.LocalTest
+	servers    []*onet.Server
+	services   []*Service
+	allRoster  *onet.Roster
+	ltsRoster  *onet.Roster
+	byzRoster  *onet.Roster
+	ltsReply   *CreateLTSReply
+	signer     darc.Signer
+	cl         *byzcoin.Client
+	gbReply    *byzcoin.CreateGenesisBlockResponse
+	genesisMsg *byzcoin.CreateGenesisBlock
+	gDarc      *darc.Darc
+}
+
+// TestService_GetWriteStatus follows writes through their lifecycle.
+func TestService_GetWriteStatus(t *testing.T) {
+	s := newTS(t, 4)
+	defer s.closeAll(t)
+	calypsoClient := NewClient(s.cl)
+	status := func(id byzcoin.InstanceID) *GetWriteStatusReply {
+		reply, err := s.services[0].GetWriteStatus(&GetWriteStatus{
+			ByzCoinID: s.cl.ID,
+			WriteID:   id,
+		})
+		require.NoError(t, err)
+		return reply
+	}
+	unknown := byzcoin.NewInstanceID([]byte("unknown"))
+	require.Equal(t, WritePending, status(unknown).State)
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	reply, err := calypsoClient.GetWriteStatus(writeID)
+	require.NoError(t, err)
+	require.Equal(t, WriteCommitted, reply.State)
+	require.Equal(t, 1, len(reply.History))
+	require.Equal(t, prWr.Latest.Index, reply.History[0].BlockIndex)
+
+	other := darc.NewSignerEd25519(nil, nil)
+	s.evolveReadRule(t, expression.InitOrExpr(s.signer.Identity().String(),
+		other.Identity().String()))
+	require.Equal(t, WriteReadersUpdated, status(writeID).State)
+	s.evolveReadRule(t, nil)
+	require.Equal(t, WriteRevoked, status(writeID).State)
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	next := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("new key"))
+	wr, err := calypsoClient.UpdateWrite(writeID, next, s.signer,
+		ctr.Counters[0]+1, 10)
+	require.NoError(t, err)
+	reply = status(writeID)
+	require.Equal(t, WriteSuperseded, reply.State)
+	require.True(t, reply.Next.Equal(wr.InstanceID))
+	var states []string
+	for _, tr := range reply.History {
+		states = append(states, tr.State)
+	}
+	require.Equal(t, []string{WriteCommitted, WriteReadersUpdated,
+		WriteRevoked, WriteSuperseded}, states)
+	require.Equal(t, WriteCommitted, status(wr.InstanceID).State)
+
+	// A write whose policy only accepts reads in the next blocks expires.
+	latest, err := s.services[0].getLatestBlock(s.cl.ID)
+	require.NoError(t, err)
+	limit := latest.Index + 3
+	expiring := NewWrite(cothority.Suite, s.ltsReply.InstanceID,
+		s.gDarc.GetBaseID(), s.ltsReply.X, []byte("expiring key"))
+	expiring.Policy = fmt.Sprintf("block < %d", limit)
+	ctr, err = s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	wr, err = calypsoClient.AddWrite(expiring, s.signer, ctr.Counters[0]+1,
+		*s.gDarc, 10)
+	require.NoError(t, err)
+	require.Equal(t, WriteCommitted, status(wr.InstanceID).State)
+	for latest.Index < limit {
+		s.addWriteAndWait(t, []byte("another key"))
+		latest, err = s.services[0].getLatestBlock(s.cl.ID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, WriteExpired, status(wr.InstanceID).State)
+}
+
+// TestService_Namespace checks that requests are only accepted in the
+// namespace of their ByzCoinID.
+func TestService_Namespace(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	_, err := s.services[0].Authorize(&Authorize{ByzCoinID: []byte("other chain"),
+		Namespace: "tenant"})
+	require.Error(t, err)
+	for _, svc := range s.services {
+		_, err = svc.ConfigureNamespace(&ConfigureNamespace{Namespace: "tenant"})
+		require.NoError(t, err)
+	}
+	_, err = s.services[0].ConfigureNamespace(&ConfigureNamespace{})
+	require.Error(t, err)
+
+	// The chain of the test is in the default namespace.
+	_, err = s.services[0].GetLTSReply(&GetLTSReply{LTSID: s.ltsReply.InstanceID})
+	require.NoError(t, err)
+	_, err = s.services[0].GetLTSReply(&GetLTSReply{LTSID: s.ltsReply.InstanceID,
+		Namespace: "tenant"})
+	require.Error(t, err)
+
+	key1 := []byte("secret key 1")
+	prWr1 := s.addWriteAndWait(t, key1)
+	prRe1 := s.addReadAndWait(t, prWr1, s.signer.Ed25519.Point)
+	dkr := signed(t, prRe1, prWr1, s.signer.Ed25519.Secret)
+	dkr.Namespace = "tenant"
+	_, err = s.services[0].DecryptKey(dkr)
+	require.Error(t, err)
+	_, err = s.services[0].DecryptKey(signed(t, prRe1, prWr1, s.signer.Ed25519.Secret))
+	require.NoError(t, err)
+
+	// The statistics and events of the chain are not visible in another
+	// namespace.
+	writeID1 := byzcoin.NewInstanceID(prWr1.InclusionProof.Key())
+	events, err := s.services[0].GetEvents(&GetEvents{WriteID: &writeID1})
+	require.NoError(t, err)
+	require.NotEmpty(t, events.Events)
+	events, err = s.services[0].GetEvents(&GetEvents{WriteID: &writeID1,
+		Namespace: "tenant"})
+	require.NoError(t, err)
+	require.Empty(t, events.Events)
+	stats, err := s.services[0].GetDocumentStats(&GetDocumentStats{WriteID: writeID1,
+		Namespace: "tenant"})
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Decrypts)
+	require.NotEqual(t, authorizeMessage(s.gbReply.Skipblock.Hash, nil, "", 0),
+		authorizeMessage(s.gbReply.Skipblock.Hash, nil, "tenant", 0))
+
+	// The trustees refuse to re-encrypt with an LTS of another namespace,
+	// even if the root accepts the request.
+	for _, svc := range s.services[1:] {
+		svc.storage.Lock()
+		svc.storage.setLTSNamespace(s.ltsReply.InstanceID, "tenant")
+		svc.storage.Unlock()
+	}
+	prRe2 := s.addReadAndWait(t, prWr1, s.signer.Ed25519.Point)
+	_, err = s.services[0].DecryptKey(signed(t, prRe2, prWr1, s.signer.Ed25519.Secret))
+	require.Error(t, err)
+	require.Error(t, s.services[1].checkLTSNamespace(s.ltsReply.InstanceID,
+		s.gbReply.Skipblock.SkipChainID()))
+	for _, svc := range s.services[1:] {
+		svc.storage.Lock()
+		svc.storage.setLTSNamespace(s.ltsReply.InstanceID, "")
+		svc.storage.Unlock()
+	}
+
+	// Only nodes of the namespace roster can be used.
+	require.NoError(t, s.services[0].checkNamespaceRoster("tenant", s.ltsRoster))
+	for _, svc := range s.services {
+		_, err = svc.ConfigureNamespace(&ConfigureNamespace{Namespace: "tenant",
+			Roster: onet.NewRoster(s.ltsRoster.List[1:])})
+		require.NoError(t, err)
+	}
+	require.Error(t, s.services[0].checkNamespaceRoster("tenant", s.ltsRoster))
+	require.NoError(t, s.services[0].checkNamespaceRoster("tenant",
+		onet.NewRoster(s.ltsRoster.List[2:])))
+}
+
+// TestService_LightMode follows a chain from a node that isn't part of the
+// cothority hosting it.
+func TestService_LightMode(t *testing.T) {
+	s := newTSWithExtras(t, 4, 1)
+	defer s.closeAll(t)
+
+	light := s.services[4]
+	bcID := s.gbReply.Skipblock.SkipChainID()
+	light.storage.Lock()
+	delete(light.storage.AuthorisedByzCoinIDs, string(bcID))
+	light.storage.Unlock()
+	_, err := light.Authorize(&Authorize{ByzCoinID: bcID, Roster: &onet.Roster{}})
+	require.Error(t, err)
+	_, err = light.Authorize(&Authorize{ByzCoinID: bcID, Roster: s.byzRoster})
+	require.NoError(t, err)
+	require.NotEqual(t, authorizeMessage(bcID, nil, "", 0),
+		authorizeMessage(bcID, s.byzRoster, "", 0))
+
+	prWr := s.addWriteAndWait(t, []byte("secret key"))
+	writeID := byzcoin.NewInstanceID(prWr.InclusionProof.Key())
+	require.NoError(t, light.verifyProof(prWr))
+	light.pollExternalChains()
+	docs := light.stats.documents(&ListDocuments{ByzCoinID: bcID})
+	require.Equal(t, 1, docs.Total)
+	require.NoError(t, light.checkFrozen(bcID, writeID))
+
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	require.NoError(t, NewClient(s.cl).FreezeWrite(writeID, "investigation",
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1}, 10))
+	require.Error(t, light.checkFrozen(bcID, writeID))
+}
+
+// TestService_ExportShares exports the shares of all nodes to a recovery key
+// and recovers a document offline.
+func TestService_ExportShares(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	recovery := key.NewKeyPair(cothority.Suite)
+	req := &ExportShares{
+		LTSID:       s.ltsReply.InstanceID,
+		RecoveryKey: recovery.Public,
+		Timestamp:   time.Now().Unix(),
+	}
+	_, err := s.services[0].ExportShares(req)
+	require.Error(t, err)
+
+	admins := []*key.Pair{key.NewKeyPair(cothority.Suite),
+		key.NewKeyPair(cothority.Suite), key.NewKeyPair(cothority.Suite)}
+	pubs := []kyber.Point{admins[0].Public, admins[1].Public, admins[2].Public}
+	cl := NewClient(s.cl)
+	require.Error(t, cl.ConfigureEscrow(s.services[0].ServerIdentity(), pubs, 4))
+	// The configuration must be signed, even with insecure admin requests.
+	_, err = s.services[0].ConfigureEscrow(&ConfigureEscrow{Admins: pubs,
+		Threshold: 2, Timestamp: time.Now().Unix()})
+	require.Error(t, err)
+	for _, svc := range s.services {
+		require.NoError(t, cl.ConfigureEscrow(svc.ServerIdentity(), pubs, 2))
+	}
+
+	// One signature is not enough, and a wrong one is refused.
+	require.NoError(t, req.Sign(0, admins[0].Private))
+	_, err = s.services[0].ExportShares(req)
+	require.Error(t, err)
+	require.NoError(t, req.Sign(2, admins[1].Private))
+	_, err = s.services[0].ExportShares(req)
+	require.Error(t, err)
+	require.NoError(t, req.Sign(2, admins[2].Private))
+
+	// The default LTS doesn't allow exports, even if they are signed.
+	_, err = s.services[0].ExportShares(req)
+	require.Error(t, err)
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	_, err = cl.RecordExport(s.ltsReply.InstanceID, recovery.Public,
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.Error(t, err)
+
+	ctr, err = s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	s.ltsReply, err = cl.CreateLTSWithEscrow(s.ltsRoster, s.gDarc.GetBaseID(),
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+	req.LTSID = s.ltsReply.InstanceID
+	req.Timestamp = time.Now().Unix()
+	for i := 0; i < 3; i += 2 {
+		require.NoError(t, req.Sign(i, admins[i].Private))
+	}
+	_, err = s.services[0].ExportShares(req)
+	require.Error(t, err)
+
+	// Once the export is recorded, the nodes export their shares.
+	ctr, err = s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	req.Record, err = cl.RecordExport(s.ltsReply.InstanceID, recovery.Public,
+		[]darc.Signer{s.signer}, []uint64{ctr.Counters[0] + 1})
+	require.NoError(t, err)
+
+	var replies []*ExportSharesReply
+	for _, svc := range s.services {
+		reply, err := svc.ExportShares(req)
+		require.NoError(t, err)
+		replies = append(replies, reply)
+	}
+	_, err = RecoverLTSSecret(replies[:1], recovery.Private)
+	require.Error(t, err)
+	_, err = RecoverLTSSecret(replies, admins[0].Private)
+	require.Error(t, err)
+	x, err := RecoverLTSSecret(replies, recovery.Private)
+	require.NoError(t, err)
+	require.True(t, x.Equal(s.reconstructKey(t)))
+
+	docKey := []byte("secret key")
+	write := NewWrite(cothority.Suite, s.ltsReply.InstanceID, s.gDarc.GetBaseID(),
+		s.ltsReply.X, docKey)
+	recovered, err := DecryptWithLTSSecret(write, x)
+	require.NoError(t, err)
+	require.Equal(t, docKey, recovered)
+}
+
+// TestService_RecoveryAgent makes sure that the recovery agents named by the
+// genesis darc can read all documents, even if they are not part of their
+// darcs.
+func TestService_RecoveryAgent(t *testing.T) {
+	s := newTS(t, 5)
+	defer s.closeAll(t)
+
+	key1 := []byte("secret key 1")
+	prWr1 := s.addWriteAndWait(t, key1)
+
+	// Without the rule, the agent is not allowed to read.
+	agent := darc.NewSignerEd25519(nil, nil)
+	_, err := s.addReadAs(t, agent, prWr1, agent.Ed25519.Point)
+	require.Error(t, err)
+
+	// The rule can only be added by evolving the genesis darc.
+	s.evolveDarc(t, func(d *darc.Darc) {
+		require.NoError(t, AddRecoveryRule(d, agent.Identity()))
+	})
+
+	// Somebody else is still not allowed to read.
+	other := darc.NewSignerEd25519(nil, nil)
+	_, err = s.addReadAs(t, other, prWr1, other.Ed25519.Point)
+	require.Error(t, err)
+
+	// But the agent is, and can decrypt the document.
+	prRe1, err := s.addReadAs(t, agent, prWr1, agent.Ed25519.Point)
+	require.NoError(t, err)
+	dk1, err := s.services[0].DecryptKey(signed(t, prRe1, prWr1, agent.Ed25519.Secret))
+	require.NoError(t, err)
+	keyCopy1, err := dk1.RecoverKey(agent.Ed25519.Secret)
+	require.NoError(t, err)
+	require.Equal(t, key1, keyCopy1)
+}
+
+// addReadAs spawns a read-instance signed by the given signer and waits for
+// it to be included.
+func (s *ts) addReadAs(t *testing.T, signer darc.Signer, write *byzcoin.Proof, Xc kyber.Point) (*byzcoin.Proof, error) {
+	ctr, err := s.cl.GetSignerCounters(signer.Identity().String())
+	require.NoError(t, err)
+	readBuf, err := protobuf.Encode(&Read{
+		Write: byzcoin.NewInstanceID(write.InclusionProof.Key()),
+		Xc:    Xc,
+	})
+	require.NoError(t, err)
+	ctx, err := s.cl.CreateTransaction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(write.InclusionProof.Key()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractReadID,
+			Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+		},
+		SignerCounter: []uint64{ctr.Counters[0] + 1},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ctx.FillSignersAndSignWith(signer))
+	if _, err := s.cl.AddTransactionAndWait(ctx, 10); err != nil {
+		return nil, err
+	}
+	return s.waitInstID(t, ctx.Instructions[0].DeriveID("")), nil
+}
+
+func (s *ts) addRead(t *testing.T, write *byzcoin.Proof, Xc kyber.Point, ctr uint64) byzcoin.InstanceID {
+	var readBuf []byte
+	read := &Read{
+		Write: byzcoin.NewInstanceID(write.InclusionProof.Key()),
+		Xc:    Xc,
+	}
+	var err error
+	readBuf, err = protobuf.Encode(read)
+	require.NoError(t, err)
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(write.InclusionProof.Key()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractReadID,
+				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+			},
+			SignerCounter: []uint64{ctr},
+		},
+	)
+	require.Nil(t, ctx.FillSignersAndSignWith(s.signer))
+	_, err = s.cl.AddTransaction(ctx)
+	require.NoError(t, err)
+	return ctx.Instructions[0].DeriveID("")
+}
+
+// waitForBlocks waits until the service handled the latest block of the
+// chain, as the blocks are passed asynchronously to the service.
+func (s *ts) waitForBlocks(t *testing.T, srv *Service) {
+	resp, err := s.cl.GetProofFromLatest(byzcoin.ConfigInstanceID.Slice())
+	require.NoError(t, err)
+	latest := resp.Proof.Latest
+	for i := 0; i < 10; i++ {
+		srv.handlingLock.Lock()
+		next := srv.stats.nextBlock(latest.SkipChainID())
+		srv.handlingLock.Unlock()
+		if next > latest.Index {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%v didn't handle block %d", srv.ServerIdentity(), latest.Index)
+}
+
+// signed returns the request for the read and the write, signed with the
+// private key the secret is re-encrypted to.
+func signed(t *testing.T, read, write *byzcoin.Proof, xc kyber.Scalar) *DecryptKey {
+	dkr := &DecryptKey{Read: *read, Write: *write}
+	require.NoError(t, dkr.Sign(xc))
+	return dkr
+}
+
+func (s *ts) addReadAndWait(t *testing.T, write *byzcoin.Proof, Xc kyber.Point) *byzcoin.Proof {
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	instID := s.addRead(t, write, Xc, ctr.Counters[0]+1)
+	return s.waitInstID(t, instID)
+}
+
+func newTS(t *testing.T, nodes int) ts {
+	return newTSWithExtras(t, nodes, 0)
+}
+
+// newTSWithExtras initially the byzRoster and ltsRoster are the same, the extras are
+// there so that we can change the ltsRoster later to be something different.
+func newTSWithExtras(t *testing.T, nodes int, extras int) ts {
+	return newTSWithWeights(t, nodes, extras, nil)
+}
+
+// newTSWithWeights works like newTSWithExtras, but the node i of the LTS
+// gets weights[i] shares if weights is set.
+func newTSWithWeights(t *testing.T, nodes int, extras int, weights []int) ts {
+	allowInsecureAdmin = true
+	s := ts{}
+	s.local = onet.NewLocalTestT(cothority.Suite, t)
+
+	// Create the service
+	s.servers, s.allRoster, _ = s.local.GenTree(nodes+extras, true)
+	services := s.local.GetServices(s.servers, calypsoID)
+	for _, ser := range services {
+		s.services = append(s.services, ser.(*Service))
+	}
+	s.byzRoster = onet.NewRoster(s.allRoster.List[:nodes])
+	s.ltsRoster = onet.NewRoster(s.allRoster.List[:nodes])
+
+	// Create the skipchain
+	s.signer = darc.NewSignerEd25519(nil, nil)
+	s.createGenesis(t)
+
+	// Create LTS instance
+	ltsInstInfoBuf, err := protobuf.Encode(&LtsInstanceInfo{Roster: *s.ltsRoster,
+		Weights: weights})
+	require.NoError(t, err)
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractLongTermSecretID,
+			Args: []byzcoin.Argument{
+				{
+					Name:  "lts_instance_info",
+					Value: ltsInstInfoBuf,
+				},
+			},
+		},
+		SignerCounter: []uint64{1},
+	}
+	tx, err := s.cl.CreateTransaction(inst)
+	require.NoError(t, err)
+	require.NoError(t, tx.FillSignersAndSignWith(s.signer))
+	_, err = s.cl.AddTransactionAndWait(tx, 4)
+	require.NoError(t, err)
+
+	// Get the proof
+	proof, err := s.cl.WaitProof(tx.Instructions[0].DeriveID(""), s.genesisMsg.BlockInterval, nil)
+	require.NoError(t, err)
+
+	// Start DKG
+	s.ltsReply, err = s.services[0].CreateLTS(&CreateLTS{
+		Proof: *proof,
+	})
+	require.NoError(t, err)
+
+	reply2 := CreateLTSReply{
+		ByzCoinID:  s.gbReply.Skipblock.SkipChainID(),
+		InstanceID: tx.Instructions[0].DeriveID(""),
+		X:          s.ltsReply.X,
+	}
+
+	require.True(t, s.ltsReply.InstanceID.Equal(reply2.InstanceID))
+	return s
+}
+
+func (s *ts) createGenesis(t *testing.T) {
+	var err error
+	s.genesisMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, s.byzRoster,
+		[]string{"spawn:" + ContractWriteID,
+			"spawn:" + ContractReadID,
+			"spawn:" + ContractLongTermSecretID,
+			"invoke:" + ContractWriteID + ".update",
+			"invoke:" + ContractWriteID + ".freeze",
+			"invoke:" + ContractWriteID + ".unfreeze",
+			"invoke:" + ContractWriteID + ".hold",
+			"invoke:" + ContractWriteID + ".release",
+			"invoke:" + ContractWriteID + ".retain",
+			"delete:" + ContractWriteID,
+			"invoke:" + ContractLongTermSecretID + ".reshare",
+			"invoke:" + ContractLongTermSecretID + ".export",
+			"invoke:" + ContractLongTermSecretID + ".rotate"},
+		s.signer.Identity())
+	require.NoError(t, err)
+	s.gDarc = &s.genesisMsg.GenesisDarc
+	s.genesisMsg.BlockInterval = time.Second
+
+	s.cl, s.gbReply, err = byzcoin.NewLedger(s.genesisMsg, false)
+	require.NoError(t, err)
+
+	for _, svc := range s.services {
+		req := &Authorize{ByzCoinID: s.cl.ID}
+		_, err = svc.Authorize(req)
+		require.NoError(t, err)
+	}
+}
+
+func (s *ts) afterReshare(f func()) {
+	for _, sv := range s.services {
+		sv.afterReshare = f
+	}
+}
+
+func (s *ts) waitInstID(t *testing.T, instID byzcoin.InstanceID) *byzcoin.Proof {
+	var err error
+	var pr *byzcoin.Proof
+	for i := 0; i < 10; i++ {
+		pr, err = s.cl.WaitProof(instID, s.genesisMsg.BlockInterval, nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		require.Fail(t, "didn't find proof")
+	}
+	return pr
+}
+
+func (s *ts) addWriteAndWait(t *testing.T, key []byte) *byzcoin.Proof {
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+
+	instID := s.addWrite(t, key, ctr.Counters[0]+1)
+	return s.waitInstID(t, instID)
 }
 
 func (s *ts) addWrite(t *testing.T, key []byte, ctr uint64) byzcoin.InstanceID {
@@ -509,6 +2699,43 @@ func (s *ts) addWrite(t *testing.T, key []byte, ctr uint64) byzcoin.InstanceID {
 	return ctx.Instructions[0].DeriveID("")
 }
 
+// evolveReadRule evolves the genesis darc with the given spawn:calypsoRead
+// rule. A nil rule removes it.
+func (s *ts) evolveReadRule(t *testing.T, rule expression.Expr) {
+	s.evolveDarc(t, func(d *darc.Darc) {
+		if rule == nil {
+			require.NoError(t, d.Rules.DeleteRules("spawn:"+ContractReadID))
+		} else {
+			require.NoError(t, d.Rules.UpdateRule("spawn:"+ContractReadID, rule))
+		}
+	})
+}
+
+// evolveDarc evolves the genesis darc with the rules changed by f.
+func (s *ts) evolveDarc(t *testing.T, f func(d *darc.Darc)) {
+	d2 := s.gDarc.Copy()
+	require.NoError(t, d2.EvolveFrom(s.gDarc))
+	f(d2)
+	d2Buf, err := d2.ToProto()
+	require.NoError(t, err)
+	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
+	require.NoError(t, err)
+	ctx, err := s.cl.CreateTransaction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(s.gDarc.GetBaseID()),
+		Invoke: &byzcoin.Invoke{
+			ContractID: byzcoin.ContractDarcID,
+			Command:    "evolve",
+			Args:       byzcoin.Arguments{{Name: "darc", Value: d2Buf}},
+		},
+		SignerCounter: []uint64{ctr.Counters[0] + 1},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ctx.FillSignersAndSignWith(s.signer))
+	_, err = s.cl.AddTransactionAndWait(ctx, 10)
+	require.NoError(t, err)
+	s.gDarc = d2
+}
+
 func (s *ts) closeAll(t *testing.T) {
 	require.Nil(t, s.cl.Close())
 	s.local.CloseAll()
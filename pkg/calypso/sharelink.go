@@ -0,0 +1,172 @@
+package calypso
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/encrypt/ecies"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A share link holds everything a reader needs to find a document: the URL
+// or address of a conode of the chain, the ID of the chain and the ID of the
+// write instance. It can also hold a bearer key, which is the private key of
+// an identity allowed to read the document, encrypted to the public key of
+// the recipient. The link is the protobuf encoding of ShareLink, base64url
+// encoded and prefixed with ShareLinkPrefix.
+//
+// The conode is not trusted: the genesis block fetched from it must have the
+// ID of the chain as hash.
+
+// ShareLinkPrefix starts all share links.
+const ShareLinkPrefix = "calypso:"
+
+// ShareLink is the decoded content of a share link.
+type ShareLink struct {
+	// URL is the websocket URL of a conode of the chain.
+	URL string `protobuf:"opt"`
+	// Address is the address of the conode, used if it has no URL.
+	Address network.Address `protobuf:"opt"`
+	// ByzCoinID is the ID of the chain.
+	ByzCoinID skipchain.SkipBlockID
+	// WriteID is the ID of the write instance of the document.
+	WriteID byzcoin.InstanceID
+	// BearerKey is the private key of a reader, ECIES encrypted to the
+	// public key of the recipient.
+	BearerKey []byte `protobuf:"opt"`
+}
+
+// String returns the share link.
+func (sl *ShareLink) String() string {
+	buf, err := protobuf.Encode(sl)
+	if err != nil {
+		return ""
+	}
+	return ShareLinkPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseShareLink decodes a share link.
+func ParseShareLink(link string) (*ShareLink, error) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, ShareLinkPrefix) {
+		return nil, xerrors.New("not a share link")
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimPrefix(link, ShareLinkPrefix))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding share link: %v", err)
+	}
+	sl := &ShareLink{}
+	if err := protobuf.Decode(buf, sl); err != nil {
+		return nil, xerrors.Errorf("decoding share link: %v", err)
+	}
+	if (sl.URL == "" && sl.Address == "") || len(sl.ByzCoinID) == 0 {
+		return nil, xerrors.New("share link without conode or chain")
+	}
+	return sl, nil
+}
+
+// Signer decrypts the bearer key of the link with the private key of the
+// recipient and returns the signer to use for the read request.
+func (sl *ShareLink) Signer(private kyber.Scalar) (*darc.Signer, error) {
+	if len(sl.BearerKey) == 0 {
+		return nil, xerrors.New("share link without bearer key")
+	}
+	buf, err := ecies.Decrypt(cothority.Suite, private, sl.BearerKey, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypting bearer key: %v", err)
+	}
+	secret := cothority.Suite.Scalar()
+	if err := secret.UnmarshalBinary(buf); err != nil {
+		return nil, xerrors.Errorf("decoding bearer key: %v", err)
+	}
+	signer := darc.NewSignerEd25519(
+		cothority.Suite.Point().Mul(secret, nil), secret)
+	return &signer, nil
+}
+
+// NewClient fetches the genesis block of the chain from the conode of the
+// link and returns a client for the chain.
+func (sl *ShareLink) NewClient() (*Client, error) {
+	si := &network.ServerIdentity{URL: sl.URL, Address: sl.Address}
+	ro := &onet.Roster{List: []*network.ServerIdentity{si}}
+	sb, err := skipchain.NewClient().GetSingleBlock(ro, sl.ByzCoinID)
+	if err != nil {
+		return nil, xerrors.Errorf("fetching genesis block: %v", err)
+	}
+	if sb.Index != 0 || !sb.CalculateHash().Equal(sl.ByzCoinID) {
+		return nil, xerrors.New("returned block is not the genesis block of the chain")
+	}
+	if sb.Roster == nil || len(sb.Roster.List) == 0 {
+		return nil, xerrors.New("genesis block has no roster")
+	}
+	cl := byzcoin.NewClient(sl.ByzCoinID, *sb.Roster)
+	cl.Genesis = sb
+	return NewClient(cl), nil
+}
+
+// CreateShareLink returns a share link to the document of the write
+// instance. If bearer is not nil, its private key is encrypted to the
+// recipient and added to the link, so that the recipient can read the
+// document with it.
+func (c *Client) CreateShareLink(writeID byzcoin.InstanceID,
+	bearer *darc.Signer, recipient kyber.Point) (string, error) {
+	if len(c.bcClient.Roster.List) == 0 {
+		return "", xerrors.New("empty roster")
+	}
+	sl := &ShareLink{ByzCoinID: c.bcClient.ID, WriteID: writeID}
+	sl.URL, sl.Address = c.linkConode()
+	if bearer != nil {
+		if bearer.Ed25519 == nil || bearer.Ed25519.Secret == nil {
+			return "", xerrors.New("bearer key must be an Ed25519 private key")
+		}
+		if recipient == nil {
+			return "", xerrors.New("a bearer key needs a recipient")
+		}
+		buf, err := bearer.Ed25519.Secret.MarshalBinary()
+		if err != nil {
+			return "", xerrors.Errorf("encoding bearer key: %v", err)
+		}
+		sl.BearerKey, err = ecies.Encrypt(cothority.Suite, recipient, buf, nil)
+		if err != nil {
+			return "", xerrors.Errorf("encrypting bearer key: %v", err)
+		}
+	}
+	link := sl.String()
+	if link == "" {
+		return "", xerrors.New("couldn't encode share link")
+	}
+	return link, nil
+}
+
+// ParseShareLink decodes a share link and makes sure it points to the chain
+// of the client.
+func (c *Client) ParseShareLink(link string) (*ShareLink, error) {
+	sl, err := ParseShareLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if !sl.ByzCoinID.Equal(c.bcClient.ID) {
+		return nil, xerrors.New("share link is for another chain")
+	}
+	return sl, nil
+}
+
+// linkConode returns the URL of the first conode of the roster that has
+// one, or else the address of the first conode.
+func (c *Client) linkConode() (string, network.Address) {
+	for _, si := range c.bcClient.Roster.List {
+		if si.URL != "" {
+			return si.URL, ""
+		}
+	}
+	return "", c.bcClient.Roster.List[0].Address
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/calypso"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/simul/monitor"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * Defines the simulation of the onchain-secrets service: every round
+ * creates a new LTS with a DKG, then writes a secret, reads it, and asks
+ * the LTS to re-encrypt it. The rounds can run in parallel, each on its own
+ * chain.
+ */
+
+func init() {
+	onet.SimulationRegister("CalypsoOCS", NewSimulationService)
+}
+
+// SimulationService holds the BFTree simulation and the parameters of the
+// ByzCoin ledger. Parallel is the number of rounds run at the same time.
+type SimulationService struct {
+	onet.SimulationBFTree
+	BlockInterval string
+	Parallel      int
+}
+
+// NewSimulationService returns the new simulation, where all fields are
+// initialised using the config-file
+func NewSimulationService(config string) (onet.Simulation, error) {
+	es := &SimulationService{}
+	_, err := toml.Decode(config, es)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding config: %v", err)
+	}
+	return es, nil
+}
+
+// Setup creates the tree used for that simulation
+func (s *SimulationService) Setup(dir string, hosts []string) (
+	*onet.SimulationConfig, error) {
+	sc := &onet.SimulationConfig{}
+	s.CreateRoster(sc, hosts, 2000)
+	err := s.CreateTree(sc)
+	if err != nil {
+		return nil, xerrors.Errorf("creating tree: %v", err)
+	}
+	return sc, nil
+}
+
+// Node can be used to initialize each node before it will be run
+// by the server. Here we call the 'Node'-method of the
+// SimulationBFTree structure which will load the roster- and the
+// tree-structure to speed up the first round.
+func (s *SimulationService) Node(config *onet.SimulationConfig) error {
+	index, _ := config.Roster.Search(config.Server.ServerIdentity.ID)
+	if index < 0 {
+		log.Fatal("Didn't find this node in roster")
+	}
+	log.Lvl3("Initializing node-index", index)
+	return s.SimulationBFTree.Node(config)
+}
+
+// Run is used on the destination machines and runs a number of
+// rounds. If Parallel is more than 1, that many rounds run at the same
+// time, each on its own chain, to measure the throughput of the cothority
+// instead of the latency of a single client.
+func (s *SimulationService) Run(config *onet.SimulationConfig) error {
+	size := config.Tree.Size()
+	log.Lvl2("Size is:", size, "rounds:", s.Rounds, "parallel:", s.Parallel)
+
+	blockInterval, err := time.ParseDuration(s.BlockInterval)
+	if err != nil {
+		return xerrors.Errorf("parsing block interval: %v", err)
+	}
+	if s.Parallel <= 1 {
+		c, err := newChain(config.Roster, blockInterval)
+		if err != nil {
+			return xerrors.Errorf("creating chain: %v", err)
+		}
+		for round := 0; round < s.Rounds; round++ {
+			log.Lvl1("Starting round", round)
+			roundM := monitor.NewTimeMeasure("round")
+			if err := c.round(config.Roster); err != nil {
+				return xerrors.Errorf("round %d: %v", round, err)
+			}
+			roundM.Record()
+		}
+		return nil
+	}
+
+	for round := 0; round < s.Rounds; round += s.Parallel {
+		n := s.Parallel
+		if round+n > s.Rounds {
+			n = s.Rounds - round
+		}
+		chains := make([]*chain, n)
+		for i := range chains {
+			chains[i], err = newChain(config.Roster, blockInterval)
+			if err != nil {
+				return xerrors.Errorf("creating chain: %v", err)
+			}
+		}
+
+		log.Lvl1("Starting rounds", round, "to", round+n-1)
+		parallel := monitor.NewTimeMeasure("parallel")
+		start := time.Now()
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range chains {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				roundM := monitor.NewTimeMeasure("round")
+				errs[i] = chains[i].round(config.Roster)
+				roundM.Record()
+			}(i)
+		}
+		wg.Wait()
+		parallel.Record()
+		monitor.RecordSingleMeasure("throughput",
+			float64(n)/time.Since(start).Seconds())
+		for i, err := range errs {
+			if err != nil {
+				return xerrors.Errorf("round %d: %v", round+i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// chain is a ByzCoin ledger used by the rounds of one client.
+type chain struct {
+	cl            *calypso.Client
+	signer        darc.Signer
+	gDarc         darc.Darc
+	ctr           uint64
+	blockInterval time.Duration
+}
+
+// newChain creates a new ledger on the roster and authorizes it on all
+// nodes.
+func newChain(roster *onet.Roster, blockInterval time.Duration) (*chain, error) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion,
+		roster, []string{"spawn:" + calypso.ContractLongTermSecretID,
+			"spawn:" + calypso.ContractWriteID,
+			"spawn:" + calypso.ContractReadID}, signer.Identity())
+	if err != nil {
+		return nil, xerrors.Errorf("creating genesis message: %v", err)
+	}
+	msg.BlockInterval = blockInterval
+
+	bc, _, err := byzcoin.NewLedger(msg, false)
+	if err != nil {
+		return nil, xerrors.Errorf("creating ledger: %v", err)
+	}
+	cl := calypso.NewClient(bc)
+	for _, who := range roster.List {
+		if err := cl.Authorize(who, bc.ID); err != nil {
+			return nil, xerrors.Errorf("authorizing chain: %v", err)
+		}
+	}
+	return &chain{cl: cl, signer: signer, gDarc: msg.GenesisDarc, ctr: 1,
+		blockInterval: blockInterval}, nil
+}
+
+// round creates a new LTS with a DKG, then writes a secret, reads it, and
+// asks the LTS to re-encrypt it.
+func (c *chain) round(roster *onet.Roster) error {
+	cl, signer, gDarc := c.cl, c.signer, c.gDarc
+
+	dkg := monitor.NewTimeMeasure("dkg")
+	lts, err := cl.CreateLTS(roster, gDarc.GetBaseID(),
+		[]darc.Signer{signer}, []uint64{c.ctr})
+	if err != nil {
+		return xerrors.Errorf("creating LTS: %v", err)
+	}
+	c.ctr++
+	dkg.Record()
+
+	write := monitor.NewTimeMeasure("write")
+	key := []byte("symmetric key")
+	w := calypso.NewWrite(cothority.Suite, lts.InstanceID,
+		gDarc.GetBaseID(), lts.X, key)
+	wr, err := cl.AddWrite(w, signer, c.ctr, gDarc, 10)
+	if err != nil {
+		return xerrors.Errorf("adding write: %v", err)
+	}
+	c.ctr++
+	prWr, err := cl.WaitProof(wr.InstanceID, c.blockInterval, nil)
+	if err != nil {
+		return xerrors.Errorf("waiting for write proof: %v", err)
+	}
+	write.Record()
+
+	read := monitor.NewTimeMeasure("read")
+	re, err := cl.AddRead(prWr, signer, c.ctr, 10)
+	if err != nil {
+		return xerrors.Errorf("adding read: %v", err)
+	}
+	c.ctr++
+	prRe, err := cl.WaitProof(re.InstanceID, c.blockInterval, nil)
+	if err != nil {
+		return xerrors.Errorf("waiting for read proof: %v", err)
+	}
+	read.Record()
+
+	decrypt := monitor.NewTimeMeasure("decrypt")
+	dkr := &calypso.DecryptKey{Read: *prRe, Write: *prWr}
+	if err := dkr.Sign(signer.Ed25519.Secret); err != nil {
+		return xerrors.Errorf("signing request: %v", err)
+	}
+	dk, err := cl.DecryptKey(dkr)
+	if err != nil {
+		return xerrors.Errorf("decrypting key: %v", err)
+	}
+	decrypt.Record()
+
+	keyCopy, err := dk.RecoverKey(signer.Ed25519.Secret)
+	if err != nil {
+		return xerrors.Errorf("recovering key: %v", err)
+	}
+	if string(keyCopy) != string(key) {
+		return xerrors.New("recovered wrong key")
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package calypso
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	dkgprotocol "github.com/calypso-demo/filesharing/pkg/protocols/dkg/pedersen"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/encrypt/ecies"
+	dkg "go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A snapshot holds what a conode needs to take part in its LTSs again after
+// moving to another machine: the storage of the service, including the
+// shares of the LTSs. The shares never leave the conode in clear: they are
+// encrypted under a key of the operator when exported, and the operator
+// encrypts them under the key of the conode importing them. The events and
+// statistics are not part of a snapshot, as they are rebuilt from the
+// followed chains.
+
+// snapshotSecrets are the secret parts of the storage.
+type snapshotSecrets struct {
+	Shared map[byzcoin.InstanceID]*dkgprotocol.SharedSecret
+	DKS    map[byzcoin.InstanceID]*dkg.DistKeyShare
+}
+
+// ExportSnapshot returns a snapshot of the storage, with the shares of the
+// LTSs encrypted under the operator key of the request. Every LTS of the
+// conode must have recorded the export to the operator key, like for
+// ExportShares. As the snapshot holds secrets, the signature is verified
+// even if COTHORITY_ALLOW_INSECURE_ADMIN='true'.
+func (s *Service) ExportSnapshot(req *ExportSnapshot) (*ExportSnapshotReply, error) {
+	if req.OperatorKey == nil {
+		return nil, xerrors.New("missing operator key")
+	}
+	key, err := req.OperatorKey.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshalling operator key: %v", err)
+	}
+	err = s.checkAdminSignature(snapshotMessage("export", key, req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+
+	st := s.storage.snapshot()
+	for id := range st.Shared {
+		if err := s.verifyExportRecords(id, req); err != nil {
+			return nil, xerrors.Errorf("checking record of export of LTS %v: %v",
+				id, err)
+		}
+	}
+	ltss := len(st.Shared)
+	secrets, err := protobuf.Encode(&snapshotSecrets{Shared: st.Shared,
+		DKS: st.DKS})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding secrets: %v", err)
+	}
+	st.Shared = nil
+	st.DKS = nil
+	buf, err := protobuf.Encode(st)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding storage: %v", err)
+	}
+	enc, err := ecies.Encrypt(cothority.Suite, req.OperatorKey, secrets, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("encrypting secrets: %v", err)
+	}
+	log.Lvlf1("%v exported a snapshot with %d LTSs", s.ServerIdentity(), ltss)
+	return &ExportSnapshotReply{Snapshot: Snapshot{
+		Public:    s.ServerIdentity().Public,
+		Timestamp: time.Now().UnixNano(),
+		Storage:   buf,
+		Secrets:   enc,
+	}}, nil
+}
+
+// verifyExportRecords checks that the records of the request hold a proof
+// of the LTS allowing the export to the operator key.
+func (s *Service) verifyExportRecords(ltsID byzcoin.InstanceID, req *ExportSnapshot) error {
+	for i := range req.Records {
+		if req.Records[i].InclusionProof.Match(ltsID.Slice()) {
+			return s.verifyExportProof(ltsID, req.OperatorKey, &req.Records[i])
+		}
+	}
+	return xerrors.New("missing proof of the LTS instance")
+}
+
+// ImportSnapshot replaces the storage with the snapshot of the request. The
+// snapshot must come from a conode with the same key, and this conode must
+// not hold any LTS yet, so that no share is overwritten.
+//
+// If COTHORITY_ALLOW_INSECURE_ADMIN='true', the signature verification is
+// skipped.
+func (s *Service) ImportSnapshot(req *ImportSnapshot) (*ImportSnapshotReply, error) {
+	sn := &req.Snapshot
+	digest, err := sn.Hash()
+	if err != nil {
+		return nil, xerrors.Errorf("hashing snapshot: %v", err)
+	}
+	err = s.verifyAdminSignature(snapshotMessage("import", digest, req.Timestamp),
+		req.Timestamp, req.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying request: %v", err)
+	}
+	if sn.Public == nil || !sn.Public.Equal(s.ServerIdentity().Public) {
+		return nil, xerrors.New("snapshot is from a conode with another key")
+	}
+	s.storage.RLock()
+	ltss := len(s.storage.Shared)
+	s.storage.RUnlock()
+	if ltss > 0 {
+		return nil, xerrors.New("this conode already holds LTSs")
+	}
+
+	buf, err := ecies.Decrypt(cothority.Suite, s.getKeyPair().Private,
+		sn.Secrets, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decrypting secrets: %v", err)
+	}
+	var secrets snapshotSecrets
+	err = protobuf.DecodeWithConstructors(buf, &secrets,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding secrets: %v", err)
+	}
+	st := &storage{}
+	err = protobuf.DecodeWithConstructors(sn.Storage, st,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, xerrors.Errorf("decoding storage: %v", err)
+	}
+	st.Shared = secrets.Shared
+	st.DKS = secrets.DKS
+	st.allocate()
+	for id := range st.Shared {
+		if st.DKS[id] == nil || st.Polys[id] == nil || st.Rosters[id] == nil {
+			return nil, xerrors.Errorf("snapshot misses parts of LTS %v", id)
+		}
+	}
+
+	s.storage.Lock()
+	s.storage.AuthorisedByzCoinIDs = st.AuthorisedByzCoinIDs
+	s.storage.ByzCoinNamespaces = st.ByzCoinNamespaces
+	s.storage.Namespaces = st.Namespaces
+	s.storage.Escrow = st.Escrow
+	s.storage.Revoked = st.Revoked
+	s.storage.ExternalRosters = st.ExternalRosters
+	// The blocks verified by the other node are verified again.
+	s.storage.VerifiedBlocks = make(map[string]string)
+	s.storage.Shared = st.Shared
+	s.storage.Polys = st.Polys
+	s.storage.Rosters = st.Rosters
+	s.storage.Replies = st.Replies
+	s.storage.DKS = st.DKS
+	s.storage.LTSNamespaces = st.LTSNamespaces
+	s.storage.Weights = st.Weights
+	s.storage.Unlock()
+	if err := s.save(); err != nil {
+		return nil, xerrors.Errorf("saving data: %v", err)
+	}
+	for bcID := range st.AuthorisedByzCoinIDs {
+		s.followChain(skipchain.SkipBlockID(bcID))
+	}
+	log.Lvlf1("%v imported a snapshot with %d LTSs", s.ServerIdentity(),
+		len(st.Shared))
+	return &ImportSnapshotReply{LTSs: len(st.Shared)}, nil
+}
+
+// Seal encrypts the secrets of an exported snapshot under the key of the
+// conode that will import it, using the private key of the operator.
+func (sn *Snapshot) Seal(operator kyber.Scalar, to *network.ServerIdentity) error {
+	buf, err := ecies.Decrypt(cothority.Suite, operator, sn.Secrets, nil)
+	if err != nil {
+		return xerrors.Errorf("decrypting secrets: %v", err)
+	}
+	enc, err := ecies.Encrypt(cothority.Suite, to.ServicePublic(ServiceName),
+		buf, nil)
+	if err != nil {
+		return xerrors.Errorf("encrypting secrets: %v", err)
+	}
+	sn.Secrets = enc
+	return nil
+}
+
+// Hash returns the hash of the snapshot, which is signed when importing it.
+func (sn *Snapshot) Hash() ([]byte, error) {
+	h := sha256.New()
+	if sn.Public != nil {
+		if _, err := sn.Public.MarshalTo(h); err != nil {
+			return nil, xerrors.Errorf("hashing public key: %v", err)
+		}
+	}
+	for _, v := range []uint64{uint64(sn.Timestamp), uint64(len(sn.Storage))} {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, v)
+		h.Write(buf)
+	}
+	h.Write(sn.Storage)
+	h.Write(sn.Secrets)
+	return h.Sum(nil), nil
+}
+
+// snapshotMessage returns the message to be signed for an ExportSnapshot or
+// an ImportSnapshot request.
+func snapshotMessage(action string, data []byte, ts int64) []byte {
+	msg := append([]byte("snapshot:"+action+":"), data...)
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(ts))
+	return msg
+}
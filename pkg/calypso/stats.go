@@ -0,0 +1,388 @@
+package calypso
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/calypso-demo/filesharing/pkg/protocols/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// statsKey is where the document statistics are stored in the db. They are
+// kept apart from the storage, as they change with every read.
+var statsKey = []byte("stats")
+
+// statsJournalName is the name of the journal of the changed statistics.
+const statsJournalName = "stats-journal"
+
+func init() {
+	network.RegisterMessages(&statistics{})
+}
+
+// statistics holds the per-document counters. They are updated incrementally
+// whenever a block with read-instances is added to a followed chain, or
+// when this node answers a DecryptKey request.
+type statistics struct {
+	Documents map[byzcoin.InstanceID]*documentStats
+	// Chains holds the daily statistics of every followed chain, indexed
+	// by the ByzCoinID.
+	Chains map[string]*chainStats
+	// JournalNext is the first record of the journal that is not part of
+	// the saved statistics.
+	JournalNext uint64 `protobuf:"opt"`
+	sync.Mutex
+	// The documents and chains that changed since they have been appended
+	// to the journal.
+	dirtyDocs   map[byzcoin.InstanceID]bool
+	dirtyChains map[string]bool
+	// labels indexes the writes by the lower-case words of their label.
+	// It is rebuilt from the documents when the statistics are loaded.
+	labels map[string]map[byzcoin.InstanceID]bool
+}
+
+// statsRecord is a record of the journal of the statistics, holding the new
+// value of a document or of a chain.
+type statsRecord struct {
+	WriteID   byzcoin.InstanceID
+	Document  *documentStats `protobuf:"opt"`
+	ByzCoinID []byte         `protobuf:"opt"`
+	Chain     *chainStats    `protobuf:"opt"`
+}
+
+// documentStats are the counters for one write-instance.
+type documentStats struct {
+	Reads       int
+	Decrypts    int
+	Readers     map[string]bool
+	FirstRead   int64
+	LastRead    int64
+	LastDecrypt int64
+	// The metadata of the write, set when the block of its creation is
+	// handled.
+	ByzCoinID []byte `protobuf:"opt"`
+	Writer    string `protobuf:"opt"`
+	Size      int    `protobuf:"opt"`
+	Created   int64  `protobuf:"opt"`
+	Label     string `protobuf:"opt"`
+}
+
+// chainStats holds the statistics of one chain, bucketed by day.
+type chainStats struct {
+	Days map[int64]*dayStats
+	// NextBlock is the index of the first block of the chain that has not
+	// been handled yet.
+	NextBlock int
+}
+
+// dayStats are the counters of one chain for one day.
+type dayStats struct {
+	Blocks   int
+	Writes   int
+	Reads    int
+	Decrypts int
+	// DecryptLatency is the sum of the durations of all decryptions of the
+	// day, in nanoseconds.
+	DecryptLatency int64
+}
+
+// day is the length of a bucket of the chain statistics.
+const day = int64(24 * time.Hour)
+
+func newStatistics() *statistics {
+	return &statistics{
+		Documents: make(map[byzcoin.InstanceID]*documentStats),
+		Chains:    make(map[string]*chainStats),
+		labels:    make(map[string]map[byzcoin.InstanceID]bool),
+	}
+}
+
+// getChain returns the statistics of the chain, creating them if necessary,
+// and marks them as changed. It must be called with the lock held.
+func (st *statistics) getChain(bcID skipchain.SkipBlockID) *chainStats {
+	cs := st.Chains[string(bcID)]
+	if cs == nil {
+		cs = &chainStats{}
+		st.Chains[string(bcID)] = cs
+	}
+	if st.dirtyChains == nil {
+		st.dirtyChains = make(map[string]bool)
+	}
+	st.dirtyChains[string(bcID)] = true
+	return cs
+}
+
+// getDay returns the statistics of the chain for the day of the timestamp,
+// creating them if necessary. It must be called with the lock held.
+func (st *statistics) getDay(bcID skipchain.SkipBlockID, ts int64) *dayStats {
+	cs := st.getChain(bcID)
+	if cs.Days == nil {
+		cs.Days = make(map[int64]*dayStats)
+	}
+	start := ts - ts%day
+	ds := cs.Days[start]
+	if ds == nil {
+		ds = &dayStats{}
+		cs.Days[start] = ds
+	}
+	return ds
+}
+
+// nextBlock returns the index of the first block of the chain that has not
+// been handled yet.
+func (st *statistics) nextBlock(bcID skipchain.SkipBlockID) int {
+	st.Lock()
+	defer st.Unlock()
+	return st.getChain(bcID).NextBlock
+}
+
+// markBlock records that the block with the given index is handled. It
+// returns false if the block has already been handled before.
+func (st *statistics) markBlock(bcID skipchain.SkipBlockID, index int) bool {
+	st.Lock()
+	defer st.Unlock()
+	cs := st.getChain(bcID)
+	if index < cs.NextBlock {
+		return false
+	}
+	cs.NextBlock = index + 1
+	return true
+}
+
+// addBlock counts a block of the chain with the given number of writes and
+// reads, and the timestamp of the block in nanoseconds.
+func (st *statistics) addBlock(bcID skipchain.SkipBlockID, ts int64, writes, reads int) {
+	st.Lock()
+	defer st.Unlock()
+	ds := st.getDay(bcID, ts)
+	ds.Blocks++
+	ds.Writes += writes
+	ds.Reads += reads
+}
+
+// get returns the stats of the document, creating them if necessary, and
+// marks them as changed. It must be called with the lock held.
+func (st *statistics) get(writeID byzcoin.InstanceID) *documentStats {
+	ds := st.Documents[writeID]
+	if ds == nil {
+		ds = &documentStats{Readers: make(map[string]bool)}
+		st.Documents[writeID] = ds
+	}
+	if ds.Readers == nil {
+		ds.Readers = make(map[string]bool)
+	}
+	if st.dirtyDocs == nil {
+		st.dirtyDocs = make(map[byzcoin.InstanceID]bool)
+	}
+	st.dirtyDocs[writeID] = true
+	return ds
+}
+
+// addRead counts a read-instance for the given write, with the timestamp
+// of the block in nanoseconds.
+func (st *statistics) addRead(writeID byzcoin.InstanceID, xc kyber.Point, ts int64) {
+	st.Lock()
+	defer st.Unlock()
+	ds := st.get(writeID)
+	ds.Reads++
+	if xc != nil {
+		ds.Readers[xc.String()] = true
+	}
+	if ds.FirstRead == 0 || ts < ds.FirstRead {
+		ds.FirstRead = ts
+	}
+	if ts > ds.LastRead {
+		ds.LastRead = ts
+	}
+}
+
+// addWrite records the metadata of a new write-instance, created in a block
+// with the given timestamp in nanoseconds.
+func (st *statistics) addWrite(bcID skipchain.SkipBlockID, writeID byzcoin.InstanceID,
+	writer string, w *Write, ts int64) {
+	st.Lock()
+	defer st.Unlock()
+	ds := st.get(writeID)
+	ds.ByzCoinID = bcID
+	ds.Writer = writer
+	ds.Created = ts
+	if w != nil {
+		ds.Size = len(w.Data)
+		st.unindexLabel(writeID, ds.Label)
+		ds.Label = w.Label
+		st.indexLabel(writeID, ds.Label)
+	}
+}
+
+// addDecrypt counts a successful DecryptKey request for the given write,
+// which started at start and ended at now.
+func (st *statistics) addDecrypt(bcID skipchain.SkipBlockID, writeID byzcoin.InstanceID,
+	start, now time.Time) {
+	st.Lock()
+	defer st.Unlock()
+	ds := st.get(writeID)
+	ds.Decrypts++
+	ds.LastDecrypt = now.UnixNano()
+
+	daily := st.getDay(bcID, now.UnixNano())
+	daily.Decrypts++
+	daily.DecryptLatency += int64(now.Sub(start))
+}
+
+// chainReply returns the daily statistics of the given chain, sorted by
+// day.
+func (st *statistics) chainReply(bcID skipchain.SkipBlockID) *GetChainStatsReply {
+	st.Lock()
+	defer st.Unlock()
+	reply := &GetChainStatsReply{}
+	cs, ok := st.Chains[string(bcID)]
+	if !ok {
+		return reply
+	}
+	var latency int64
+	for start, ds := range cs.Days {
+		d := DayStats{
+			Day:      start,
+			Blocks:   ds.Blocks,
+			Writes:   ds.Writes,
+			Reads:    ds.Reads,
+			Decrypts: ds.Decrypts,
+		}
+		if ds.Decrypts > 0 {
+			d.DecryptLatency = ds.DecryptLatency / int64(ds.Decrypts)
+		}
+		reply.Days = append(reply.Days, d)
+		reply.Blocks += ds.Blocks
+		reply.Decrypts += ds.Decrypts
+		latency += ds.DecryptLatency
+	}
+	sort.Slice(reply.Days, func(i, j int) bool {
+		return reply.Days[i].Day < reply.Days[j].Day
+	})
+	if reply.Decrypts > 0 {
+		reply.DecryptLatency = latency / int64(reply.Decrypts)
+	}
+	return reply
+}
+
+// reply returns a copy of the statistics of the given document. If chains
+// is not nil, the document must be from one of these chains.
+func (st *statistics) reply(writeID byzcoin.InstanceID,
+	chains map[string]bool) *GetDocumentStatsReply {
+	st.Lock()
+	defer st.Unlock()
+	ds, ok := st.Documents[writeID]
+	if !ok || chains != nil && !chains[string(ds.ByzCoinID)] {
+		return &GetDocumentStatsReply{}
+	}
+	return &GetDocumentStatsReply{
+		Reads:       ds.Reads,
+		Readers:     len(ds.Readers),
+		Decrypts:    ds.Decrypts,
+		FirstRead:   ds.FirstRead,
+		LastRead:    ds.LastRead,
+		LastDecrypt: ds.LastDecrypt,
+	}
+}
+
+// GetDocumentStats returns the read and decrypt statistics of a write
+// instance, as seen by this node. The counters are kept up-to-date while the
+// blocks are added to the chain, so this call doesn't depend on the length
+// of the chain. The writes of chains outside of the namespace of the request
+// are reported as unknown.
+func (s *Service) GetDocumentStats(req *GetDocumentStats) (*GetDocumentStatsReply, error) {
+	return s.stats.reply(req.WriteID, s.namespaceChains(req.Namespace)), nil
+}
+
+// GetChainStats returns the number of blocks, writes, reads and decryptions
+// of a chain for every day, as seen by this node. Like GetDocumentStats, the
+// statistics are updated incrementally.
+func (s *Service) GetChainStats(req *GetChainStats) (*GetChainStatsReply, error) {
+	return s.stats.chainReply(req.ByzCoinID), nil
+}
+
+// saveStats appends the documents and chains that changed since the last
+// call to the journal. Like the event log, the statistics are only saved
+// completely once the journal is long enough.
+func (s *Service) saveStats() error {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	var records []interface{}
+	for id := range s.stats.dirtyDocs {
+		records = append(records, &statsRecord{WriteID: id,
+			Document: s.stats.Documents[id]})
+	}
+	for id := range s.stats.dirtyChains {
+		records = append(records, &statsRecord{ByzCoinID: []byte(id),
+			Chain: s.stats.Chains[id]})
+	}
+	next, size, err := s.statsJournal.append(records...)
+	if err != nil {
+		log.Error("Couldn't save statistics:", err)
+		return xerrors.Errorf("saving statistics: %v", err)
+	}
+	s.stats.dirtyDocs = nil
+	s.stats.dirtyChains = nil
+	if size < compactAfter {
+		return nil
+	}
+	s.stats.JournalNext = next
+	if err := s.Save(statsKey, s.stats); err != nil {
+		log.Error("Couldn't save statistics:", err)
+		return xerrors.Errorf("saving statistics: %v", err)
+	}
+	return cothority.ErrorOrNil(s.statsJournal.truncate(next),
+		"compacting statistics")
+}
+
+func (s *Service) tryLoadStats() error {
+	s.stats = newStatistics()
+	j, err := s.newJournal(statsJournalName)
+	if err != nil {
+		return xerrors.Errorf("loading statistics: %v", err)
+	}
+	s.statsJournal = j
+	msg, err := s.Load(statsKey)
+	if err != nil {
+		return xerrors.Errorf("loading statistics: %v", err)
+	}
+	st := newStatistics()
+	if msg != nil {
+		var ok bool
+		st, ok = msg.(*statistics)
+		if !ok {
+			return xerrors.New("statistics of wrong type")
+		}
+	}
+	if st.Documents == nil {
+		st.Documents = make(map[byzcoin.InstanceID]*documentStats)
+	}
+	if st.Chains == nil {
+		st.Chains = make(map[string]*chainStats)
+	}
+	err = j.replay(st.JournalNext, func(buf []byte) error {
+		var r statsRecord
+		if err := protobuf.Decode(buf, &r); err != nil {
+			return xerrors.Errorf("decoding statistics: %v", err)
+		}
+		if r.Document != nil {
+			st.Documents[r.WriteID] = r.Document
+		}
+		if r.Chain != nil {
+			st.Chains[string(r.ByzCoinID)] = r.Chain
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("replaying statistics: %v", err)
+	}
+	st.indexLabels()
+	s.stats = st
+	return nil
+}
@@ -0,0 +1,319 @@
+package calypso
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// By default, every node of the LTS takes part in a re-encryption, although
+// only a threshold of shares is needed. A TreeStrategy chooses a subset of
+// the nodes instead, so that the load is spread over big LTSs, or that slow
+// nodes are avoided. The node contacted by the client is always the root of
+// the tree. If a re-encryption with a subset fails, the nodes that failed
+// are replaced by other nodes, and only once there are not enough of them
+// are all nodes asked.
+
+// Names of the built-in tree strategies.
+const (
+	// StrategyFull asks all nodes of the LTS.
+	StrategyFull = "full"
+	// StrategyThreshold asks a random subset of just enough nodes.
+	StrategyThreshold = "threshold"
+	// StrategyLatency asks the nodes that replied the fastest before.
+	StrategyLatency = "latency"
+	// StrategyBalanced asks the nodes that took part in the fewest
+	// re-encryptions of this node.
+	StrategyBalanced = "balanced"
+)
+
+// unresponsiveLatency is the latency given to a node that didn't reply.
+const unresponsiveLatency = time.Minute
+
+// NodeStats are the statistics of the nodes of the LTSs, as measured by the
+// root of the re-encryptions.
+type NodeStats struct {
+	// Latency is the average time a node took to reply. It is missing for
+	// nodes that never took part in a re-encryption.
+	Latency map[network.ServerIdentityID]time.Duration
+	// Uses is the number of re-encryptions a node took part in.
+	Uses map[network.ServerIdentityID]int
+}
+
+// TreeStrategy chooses the nodes taking part in a re-encryption.
+type TreeStrategy interface {
+	// Children returns the nodes to ask for their share, chosen from the
+	// candidates, which hold all nodes of the LTS except the root. As the
+	// root has a share too, at least threshold-1 nodes must be returned.
+	Children(candidates []*network.ServerIdentity, threshold int,
+		stats NodeStats) []*network.ServerIdentity
+}
+
+// TreeStrategyFunc is a function implementing TreeStrategy.
+type TreeStrategyFunc func(candidates []*network.ServerIdentity, threshold int,
+	stats NodeStats) []*network.ServerIdentity
+
+// Children calls f.
+func (f TreeStrategyFunc) Children(candidates []*network.ServerIdentity,
+	threshold int, stats NodeStats) []*network.ServerIdentity {
+	return f(candidates, threshold, stats)
+}
+
+var treeStrategies = map[string]TreeStrategy{
+	StrategyFull: TreeStrategyFunc(func(candidates []*network.ServerIdentity,
+		threshold int, stats NodeStats) []*network.ServerIdentity {
+		return candidates
+	}),
+	StrategyThreshold: TreeStrategyFunc(func(candidates []*network.ServerIdentity,
+		threshold int, stats NodeStats) []*network.ServerIdentity {
+		var children []*network.ServerIdentity
+		for _, i := range rand.Perm(len(candidates))[:threshold-1] {
+			children = append(children, candidates[i])
+		}
+		return children
+	}),
+	StrategyLatency: TreeStrategyFunc(func(candidates []*network.ServerIdentity,
+		threshold int, stats NodeStats) []*network.ServerIdentity {
+		return fewest(candidates, threshold-1, func(si *network.ServerIdentity) int64 {
+			return int64(stats.Latency[si.ID])
+		})
+	}),
+	StrategyBalanced: TreeStrategyFunc(func(candidates []*network.ServerIdentity,
+		threshold int, stats NodeStats) []*network.ServerIdentity {
+		return fewest(candidates, threshold-1, func(si *network.ServerIdentity) int64 {
+			return int64(stats.Uses[si.ID])
+		})
+	}),
+}
+var treeStrategiesLock sync.Mutex
+
+// RegisterTreeStrategy adds a strategy that can be chosen by its name in
+// DecryptKey.Strategy or in the ServiceConfig. It must be registered on the
+// nodes, not on the clients.
+func RegisterTreeStrategy(name string, strategy TreeStrategy) error {
+	treeStrategiesLock.Lock()
+	defer treeStrategiesLock.Unlock()
+	if _, ok := treeStrategies[name]; ok || name == "" {
+		return xerrors.Errorf("strategy '%s' is already registered", name)
+	}
+	treeStrategies[name] = strategy
+	return nil
+}
+
+func getTreeStrategy(name string) (TreeStrategy, error) {
+	treeStrategiesLock.Lock()
+	defer treeStrategiesLock.Unlock()
+	strategy, ok := treeStrategies[name]
+	if !ok {
+		return nil, xerrors.Errorf("unknown strategy '%s'", name)
+	}
+	return strategy, nil
+}
+
+// fewest returns the n candidates with the lowest value. Candidates with the
+// same value are chosen randomly, so that they share the load.
+func fewest(candidates []*network.ServerIdentity, n int,
+	value func(*network.ServerIdentity) int64) []*network.ServerIdentity {
+	sorted := make([]*network.ServerIdentity, len(candidates))
+	for i, j := range rand.Perm(len(candidates)) {
+		sorted[i] = candidates[j]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return value(sorted[i]) < value(sorted[j])
+	})
+	return sorted[:n]
+}
+
+// treeStats holds the NodeStats of this node.
+type treeStats struct {
+	sync.Mutex
+	stats NodeStats
+}
+
+func newTreeStats() *treeStats {
+	return &treeStats{stats: NodeStats{
+		Latency: make(map[network.ServerIdentityID]time.Duration),
+		Uses:    make(map[network.ServerIdentityID]int),
+	}}
+}
+
+// get returns a copy of the statistics.
+func (ts *treeStats) get() NodeStats {
+	ts.Lock()
+	defer ts.Unlock()
+	stats := NodeStats{
+		Latency: make(map[network.ServerIdentityID]time.Duration),
+		Uses:    make(map[network.ServerIdentityID]int),
+	}
+	for id, l := range ts.stats.Latency {
+		stats.Latency[id] = l
+	}
+	for id, u := range ts.stats.Uses {
+		stats.Uses[id] = u
+	}
+	return stats
+}
+
+// update adds a re-encryption with the given children. The latency of a
+// node is a moving average of its reply times, where unresponsive nodes
+// count with unresponsiveLatency. Nodes whose reply wasn't needed don't
+// change their latency.
+func (ts *treeStats) update(children []*network.ServerIdentity,
+	times map[network.ServerIdentityID]time.Duration,
+	unresponsive []*network.ServerIdentity) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, si := range unresponsive {
+		times[si.ID] = unresponsiveLatency
+	}
+	for _, si := range children {
+		ts.stats.Uses[si.ID]++
+		d, ok := times[si.ID]
+		if !ok {
+			continue
+		}
+		if old, ok := ts.stats.Latency[si.ID]; ok {
+			d = (3*old + d) / 4
+		}
+		ts.stats.Latency[si.ID] = d
+	}
+}
+
+// decryptionTree returns the tree of a re-encryption by the LTS with the
+// given roster, rooted at this node. If name is empty, the strategy of the
+// configuration is used.
+func (s *Service) decryptionTree(roster *onet.Roster, name string,
+	threshold int) (*onet.Tree, error) {
+	name, strategy, err := s.treeStrategy(name)
+	if err != nil {
+		return nil, err
+	}
+	root := s.ServerIdentity()
+	var candidates []*network.ServerIdentity
+	for _, si := range roster.List {
+		if !si.Equal(root) {
+			candidates = append(candidates, si)
+		}
+	}
+	if len(candidates) == len(roster.List) {
+		return nil, xerrors.New("this node is not part of the LTS")
+	}
+	if threshold-1 > len(candidates) {
+		return nil, xerrors.New("not enough nodes for the threshold")
+	}
+
+	children := strategy.Children(candidates, threshold, s.trees.get())
+	if len(children) < threshold-1 {
+		return nil, xerrors.Errorf("strategy '%s' chose %d nodes, need %d",
+			name, len(children), threshold-1)
+	}
+	return s.treeWith(roster, name, nil, children)
+}
+
+// widenTree returns the tree of the next re-encryption after one on tree
+// failed. The failed nodes are replaced by nodes of the roster that haven't
+// failed yet, chosen by the strategy, so that only as many nodes as needed
+// are added. If there are not enough such nodes, all nodes of the roster
+// are asked.
+func (s *Service) widenTree(roster *onet.Roster, tree *onet.Tree, name string,
+	threshold int, failed map[network.ServerIdentityID]bool) *onet.Tree {
+	full := roster.GenerateNaryTreeWithRoot(
+		s.getConfig().treeFanout(len(roster.List)), s.ServerIdentity())
+	name, strategy, err := s.treeStrategy(name)
+	if err != nil {
+		return full
+	}
+	var kept []*network.ServerIdentity
+	for _, si := range tree.Roster.List {
+		if !si.Equal(s.ServerIdentity()) && !failed[si.ID] {
+			kept = append(kept, si)
+		}
+	}
+	var candidates []*network.ServerIdentity
+	for _, si := range roster.List {
+		if i, _ := tree.Roster.Search(si.ID); i < 0 && !failed[si.ID] {
+			candidates = append(candidates, si)
+		}
+	}
+	missing := threshold - 1 - len(kept)
+	if missing <= 0 || missing > len(candidates) {
+		return full
+	}
+	children := strategy.Children(candidates, missing+1, s.trees.get())
+	if len(children) < missing {
+		return full
+	}
+	widened, err := s.treeWith(roster, name, kept, children)
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "asking all nodes:", err)
+		return full
+	}
+	return widened
+}
+
+// treeStrategy returns the strategy with the given name, or the one of the
+// configuration if name is empty, together with its name.
+func (s *Service) treeStrategy(name string) (string, TreeStrategy, error) {
+	if name == "" {
+		name = s.getConfig().TreeStrategy
+	}
+	if name == "" {
+		name = StrategyFull
+	}
+	strategy, err := getTreeStrategy(name)
+	return name, strategy, err
+}
+
+// treeWith returns a tree rooted at this node, with the nodes of kept and
+// the children chosen by the strategy with the given name. All of them must
+// be distinct nodes of the roster.
+func (s *Service) treeWith(roster *onet.Roster, name string, kept,
+	children []*network.ServerIdentity) (*onet.Tree, error) {
+	root := s.ServerIdentity()
+	list := append([]*network.ServerIdentity{root}, kept...)
+	seen := map[network.ServerIdentityID]bool{}
+	for _, si := range list {
+		seen[si.ID] = true
+	}
+	for _, si := range children {
+		if i, _ := roster.Search(si.ID); i < 0 || seen[si.ID] {
+			return nil, xerrors.Errorf("strategy '%s' chose an invalid node %s",
+				name, si)
+		}
+		seen[si.ID] = true
+		list = append(list, si)
+	}
+	return onet.NewRoster(list).GenerateNaryTreeWithRoot(
+		s.getConfig().treeFanout(len(list)), root), nil
+}
+
+// expectedLatency returns the time until enough children of the tree
+// replied for the threshold, according to their statistics. It returns 0 if
+// one of the children never took part in a re-encryption.
+func (s *Service) expectedLatency(tree *onet.Tree, threshold int) time.Duration {
+	stats := s.trees.get()
+	var latencies []time.Duration
+	for _, si := range tree.Roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		l, ok := stats.Latency[si.ID]
+		if !ok {
+			return 0
+		}
+		latencies = append(latencies, l)
+	}
+	if len(latencies) == 0 || threshold < 2 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return latencies[threshold-2]
+}
@@ -0,0 +1,158 @@
+package calypso
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/darc"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/suites"
+	"golang.org/x/xerrors"
+)
+
+// Documents too big to be held in memory, or in the chain, are encrypted
+// with EncryptFile and stored elsewhere, only the write holding the key goes
+// to the chain. The document is cut in chunks of fileChunkSize bytes, and
+// every chunk is encrypted with AES-GCM under a key derived from the
+// symmetric key of the write. The nonce of a chunk is its index, with a flag
+// for the last chunk, so that chunks cannot be reordered, and the document
+// cannot be truncated. The root of a Merkle tree over the encrypted chunks
+// is stored in the write, so that a reader can check that the copy it
+// decrypted is the one of the write, or check single chunks, see merkle.go.
+// Writes created before hold the SHA-256 of the encrypted document instead.
+
+// fileChunkSize is the size of the chunks of a document, before encryption.
+const fileChunkSize = 64 * 1024
+
+// fileKeyLength is the length of the symmetric key created by EncryptFile.
+const fileKeyLength = 24
+
+// fileAEAD returns the cipher of the chunks for the given symmetric key.
+func fileAEAD(key []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("calypso-file"))
+	h.Write(key)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, xerrors.Errorf("creating cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given index.
+func chunkNonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptFile encrypts the document read from r under a new symmetric key,
+// and writes the encrypted document to w. It returns the write holding the
+// key encrypted for the LTS and the Merkle root of the encrypted document,
+// as NewWrite, and the symmetric key, which can be given to SetMetadata.
+func EncryptFile(suite suites.Suite, ltsid byzcoin.InstanceID, writeDarc darc.ID,
+	X kyber.Point, r io.Reader, w io.Writer) (*Write, []byte, error) {
+	key := make([]byte, fileKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, xerrors.Errorf("creating key: %v", err)
+	}
+	write := NewWrite(suite, ltsid, writeDarc, X, key)
+	if write == nil {
+		return nil, nil, xerrors.New("key is too long for the suite")
+	}
+	root, err := sealChunks(key, r, w)
+	if err != nil {
+		return nil, nil, err
+	}
+	write.DataRoot = root
+	return write, key, nil
+}
+
+// sealChunks encrypts the chunks read from r with the symmetric key and
+// writes them to w. It returns the Merkle root of the encrypted chunks.
+func sealChunks(key []byte, r io.Reader, w io.Writer) ([]byte, error) {
+	aead, err := fileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	var leaves [][]byte
+	buf := make([]byte, fileChunkSize, fileChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, xerrors.Errorf("reading document: %v", err)
+		}
+		ct := aead.Seal(buf[:0], chunkNonce(aead, index, last), buf[:n], nil)
+		if _, err := w.Write(ct); err != nil {
+			return nil, xerrors.Errorf("writing chunk %d: %v", index, err)
+		}
+		leaves = append(leaves, merkleLeaf(ct))
+		if last {
+			break
+		}
+		buf = buf[:fileChunkSize]
+	}
+	return merkleRoot(leaves), nil
+}
+
+// DecryptFile decrypts the document read from r with the symmetric key of
+// the write, as returned by DecryptKeyReply.RecoverKey, and writes it to w.
+// Every chunk is authenticated before it is written, but the Merkle root of
+// the encrypted document can only be checked at the end, so w must be
+// discarded if an error is returned.
+func DecryptFile(wr *Write, key []byte, r io.Reader, w io.Writer) error {
+	hash, root, err := openChunks(key, r, w)
+	if err != nil {
+		return err
+	}
+	if len(wr.DataRoot) > 0 && !bytes.Equal(root, wr.DataRoot) {
+		return xerrors.New("document doesn't match the Merkle root of the write")
+	}
+	if len(wr.DataHash) > 0 && !bytes.Equal(hash, wr.DataHash) {
+		return xerrors.New("document doesn't match the hash of the write")
+	}
+	return nil
+}
+
+// openChunks decrypts the chunks read from r with the symmetric key and
+// writes them to w. It returns the SHA-256 and the Merkle root of the
+// encrypted chunks.
+func openChunks(key []byte, r io.Reader, w io.Writer) ([]byte, []byte, error) {
+	aead, err := fileAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var leaves [][]byte
+	h := sha256.New()
+	in := io.TeeReader(r, h)
+	buf := make([]byte, fileChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, nil, xerrors.Errorf("reading document: %v", err)
+		}
+		leaves = append(leaves, merkleLeaf(buf[:n]))
+		pt, err := aead.Open(buf[:0], chunkNonce(aead, index, last), buf[:n], nil)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("decrypting chunk %d: %v", index, err)
+		}
+		if _, err := w.Write(pt); err != nil {
+			return nil, nil, xerrors.Errorf("writing chunk %d: %v", index, err)
+		}
+		if last {
+			break
+		}
+	}
+	return h.Sum(nil), merkleRoot(leaves), nil
+}
@@ -6,16 +6,36 @@ import (
 
 	"github.com/calypso-demo/filesharing/pkg/byzcoin"
 	"github.com/calypso-demo/filesharing/pkg/darc"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/kyber/v3/xof/keccak"
 	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
 )
 
 func init() {
 	network.RegisterMessages(CreateLTS{}, CreateLTSReply{},
 		Authorize{}, AuthorizeReply{},
-		DecryptKey{}, DecryptKeyReply{})
+		ConfigureNamespace{}, ConfigureNamespaceReply{},
+		ConfigureEscrow{}, ConfigureEscrowReply{},
+		ExportShares{}, ExportSharesReply{},
+		ReloadConfig{}, ReloadConfigReply{},
+		DecryptKey{}, DecryptKeyReply{},
+		DecryptKeys{}, DecryptKeysReply{},
+		GetDocumentStats{}, GetDocumentStatsReply{},
+		ListDocuments{}, ListDocumentsReply{},
+		FindByLabel{}, FindByLabelReply{},
+		GetChainStats{}, GetChainStatsReply{},
+		GetEvents{}, GetEventsReply{},
+		QueryAccessAt{}, QueryAccessAtReply{},
+		GetWriteStatus{}, GetWriteStatusReply{},
+		GetDigest{}, GetDigestReply{},
+		CheckConsistency{}, CheckConsistencyReply{},
+		EstimateDecrypt{}, EstimateDecryptReply{},
+		ExportSnapshot{}, ExportSnapshotReply{},
+		ImportSnapshot{}, ImportSnapshotReply{},
+		RevokeIdentity{}, RevokeIdentityReply{})
 }
 
 type suite interface {
@@ -23,6 +43,28 @@ type suite interface {
 	kyber.XOFFactory
 }
 
+// writeSuites are the suites a write can be encrypted with. As the key is
+// re-encrypted with the shares of the DKG, only the suite of the LTSs is
+// supported for now. A new suite has to be added here once the LTSs can be
+// created with it, so that older writes can still be decrypted.
+var writeSuites = map[string]suites.Suite{
+	cothority.Suite.String(): cothority.Suite,
+}
+
+// GetSuite returns the suite the key of the write is encrypted with, or an
+// error if this suite is not supported. Writes that don't record their suite
+// have been created with cothority.Suite.
+func (wr *Write) GetSuite() (suites.Suite, error) {
+	if wr.Suite == "" {
+		return cothority.Suite, nil
+	}
+	s, ok := writeSuites[wr.Suite]
+	if !ok {
+		return nil, xerrors.Errorf("unsupported suite %s", wr.Suite)
+	}
+	return s, nil
+}
+
 // NewWrite is used by the writer to ByzCoin to encode his symmetric key
 // under the collective public key created by the DKG.
 //
@@ -32,77 +74,161 @@ type suite interface {
 //   - writeDarc - the id of the darc where this write will be stored
 //   - X - the aggregate public key of the DKG
 //   - key - the symmetric key for the document - it will be encrypted in this
-//   method
+//     method
 //
 // Output:
 //   - write - structure containing the encrypted key U, C and the NIZKP of
-//   it containing the reader-darc. If it is nil then we failed to embed the
-//   key because it is too long to represent the key using a point.
+//     it containing the reader-darc. If it is nil then we failed to embed the
+//     key because it is too long to represent the key using a point.
 func NewWrite(suite suites.Suite, ltsid byzcoin.InstanceID, writeDarc darc.ID, X kyber.Point, key []byte) *Write {
-	wr := &Write{LTSID: ltsid}
-	r := suite.Scalar().Pick(suite.RandomStream())
-	C := suite.Point().Mul(r, X)
-	wr.U = suite.Point().Mul(r, nil)
+	wk := newWriteKey(suite, ltsid, writeDarc, X, key)
+	if wk == nil {
+		return nil
+	}
+	return &Write{LTSID: ltsid, U: wk.U, Ubar: wk.Ubar, E: wk.E, F: wk.F,
+		C: wk.C, Suite: suite.String(), X: wk.X}
+}
 
-	// Create proof
+// AddLTS encrypts the same symmetric key for another LTS, so that the
+// document can still be recovered if one of the LTSs is retired. The reader
+// chooses the LTS with DecryptKey.LTSID.
+//
+// The nodes can only check that every encryption has been done by somebody
+// knowing the key, not that all encryptions hold the same key.
+func (wr *Write) AddLTS(suite suites.Suite, ltsid byzcoin.InstanceID,
+	writeDarc darc.ID, X kyber.Point, key []byte) error {
+	if _, err := wr.Key(ltsid); err == nil {
+		return xerrors.New("the key is already encrypted for this LTS")
+	}
+	if ws, err := wr.GetSuite(); err != nil || ws.String() != suite.String() {
+		return xerrors.New("all LTSs must use the suite of the write")
+	}
+	wk := newWriteKey(suite, ltsid, writeDarc, X, key)
+	if wk == nil {
+		return xerrors.New("key is too long")
+	}
+	wr.Alternatives = append(wr.Alternatives, *wk)
+	return nil
+}
+
+// Key returns the encryption of the symmetric key for the given LTS.
+func (wr *Write) Key(ltsid byzcoin.InstanceID) (*WriteKey, error) {
+	if wr.LTSID.Equal(ltsid) {
+		return &WriteKey{LTSID: wr.LTSID, U: wr.U, Ubar: wr.Ubar, E: wr.E,
+			F: wr.F, C: wr.C, X: wr.X}, nil
+	}
+	for i := range wr.Alternatives {
+		if wr.Alternatives[i].LTSID.Equal(ltsid) {
+			return &wr.Alternatives[i], nil
+		}
+	}
+	return nil, xerrors.Errorf("key is not encrypted for LTS %x", ltsid[:])
+}
+
+// LTSIDs returns the IDs of all LTSs the key is encrypted for, starting
+// with LTSID.
+func (wr *Write) LTSIDs() []byzcoin.InstanceID {
+	ids := []byzcoin.InstanceID{wr.LTSID}
+	for _, wk := range wr.Alternatives {
+		ids = append(ids, wk.LTSID)
+	}
+	return ids
+}
+
+// CheckProof verifies that the write-request has actually been created with
+// somebody having access to the secret key. The encryptions for the other
+// LTSs are checked, too.
+func (wr *Write) CheckProof(suite suite, writeID darc.ID) error {
+	wk, _ := wr.Key(wr.LTSID)
+	if err := wk.CheckProof(suite, writeID); err != nil {
+		return err
+	}
+	ids := wr.LTSIDs()
+	for i := range ids {
+		for j := range ids[:i] {
+			if ids[i].Equal(ids[j]) {
+				return xerrors.New("the key is encrypted twice for the same LTS")
+			}
+		}
+	}
+	for i := range wr.Alternatives {
+		if err := wr.Alternatives[i].CheckProof(suite, writeID); err != nil {
+			return xerrors.Errorf("alternative %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// newWriteKey encrypts key for the LTS and creates the proof binding it to
+// writeDarc. It returns nil if the key is too long to be embedded in a
+// point.
+func newWriteKey(suite suites.Suite, ltsid byzcoin.InstanceID, writeDarc darc.ID, X kyber.Point, key []byte) *WriteKey {
 	if len(key) > suite.Point().EmbedLen() {
 		return nil
 	}
-	kp := suite.Point().Embed(key, suite.RandomStream())
-	wr.C = suite.Point().Add(C, kp)
+	wk := &WriteKey{LTSID: ltsid, X: X}
+	rand := suite.RandomStream()
+	r := suite.Scalar().Pick(rand)
+	wk.U = suite.Point().Mul(r, nil)
+	wk.C = suite.Point().Embed(key, rand)
+	wk.C.Add(wk.C, suite.Point().Mul(r, X))
 
+	// Create proof
 	gBar := suite.Point().Embed(ltsid.Slice(), keccak.New(ltsid.Slice()))
-	wr.Ubar = suite.Point().Mul(r, gBar)
-	s := suite.Scalar().Pick(suite.RandomStream())
+	wk.Ubar = suite.Point().Mul(r, gBar)
+	s := suite.Scalar().Pick(rand)
 	w := suite.Point().Mul(s, nil)
 	wBar := suite.Point().Mul(s, gBar)
 	hash := sha256.New()
-	wr.C.MarshalTo(hash)
-	wr.U.MarshalTo(hash)
-	wr.Ubar.MarshalTo(hash)
+	wk.C.MarshalTo(hash)
+	wk.U.MarshalTo(hash)
+	wk.Ubar.MarshalTo(hash)
 	w.MarshalTo(hash)
 	wBar.MarshalTo(hash)
 	hash.Write(writeDarc)
-	wr.E = suite.Scalar().SetBytes(hash.Sum(nil))
-	wr.F = suite.Scalar().Add(s, suite.Scalar().Mul(wr.E, r))
-	return wr
+	wk.E = suite.Scalar().SetBytes(hash.Sum(nil))
+	wk.F = suite.Scalar().Add(s, suite.Scalar().Mul(wk.E, r))
+	return wk
 }
 
-// CheckProof verifies that the write-request has actually been created with
-// somebody having access to the secret key.
-func (wr *Write) CheckProof(suite suite, writeID darc.ID) error {
-	gf := suite.Point().Mul(wr.F, nil)
-	ue := suite.Point().Mul(suite.Scalar().Neg(wr.E), wr.U)
+// CheckProof verifies that the key has been encrypted by somebody knowing
+// it, and that the proof is bound to the given darc.
+func (wk *WriteKey) CheckProof(suite suite, writeID darc.ID) error {
+	gf := suite.Point().Mul(wk.F, nil)
+	ue := suite.Point().Mul(suite.Scalar().Neg(wk.E), wk.U)
 	w := suite.Point().Add(gf, ue)
 
-	gBar := suite.Point().Embed(wr.LTSID.Slice(), keccak.New(wr.LTSID.Slice()))
-	gfBar := suite.Point().Mul(wr.F, gBar)
-	ueBar := suite.Point().Mul(suite.Scalar().Neg(wr.E), wr.Ubar)
+	gBar := suite.Point().Embed(wk.LTSID.Slice(), keccak.New(wk.LTSID.Slice()))
+	gfBar := suite.Point().Mul(wk.F, gBar)
+	ueBar := suite.Point().Mul(suite.Scalar().Neg(wk.E), wk.Ubar)
 	wBar := suite.Point().Add(gfBar, ueBar)
 
 	hash := sha256.New()
-	wr.C.MarshalTo(hash)
-	wr.U.MarshalTo(hash)
-	wr.Ubar.MarshalTo(hash)
+	wk.C.MarshalTo(hash)
+	wk.U.MarshalTo(hash)
+	wk.Ubar.MarshalTo(hash)
 	w.MarshalTo(hash)
 	wBar.MarshalTo(hash)
 	hash.Write(writeID)
 
 	e := suite.Scalar().SetBytes(hash.Sum(nil))
-	if e.Equal(wr.E) {
+	if e.Equal(wk.E) {
 		return nil
 	}
 
 	return fmt.Errorf("recreated proof is not equal to stored proof:\n"+
-		"%s\n%s", e.String(), wr.E.String())
+		"%s\n%s", e.String(), wk.E.String())
 }
 
 type newLtsConfig struct {
 	byzcoin.Proof
+	TraceID   string `protobuf:"opt"`
+	Namespace string `protobuf:"opt"`
 }
 
 type reshareLtsConfig struct {
 	byzcoin.Proof
-	Commits  []kyber.Point
-	OldNodes []kyber.Point
+	Commits   []kyber.Point
+	OldNodes  []kyber.Point
+	Namespace string `protobuf:"opt"`
 }
@@ -0,0 +1,173 @@
+package calypso
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// If RequireClientTLS is set in the configuration, the client requests to
+// this service must come over a TLS connection with an Ed25519 client
+// certificate, so that the re-encrypted shares are never sent in clear. The
+// websocket of the conode must be set up with TLS, and RequestClientCertificates
+// makes it ask the clients for their certificates, which they set with
+// Client.UseClientCertificate. A decryption request is only accepted if the
+// key the secret is re-encrypted to is the key of one of the client
+// certificates.
+//
+// The writes and reads are transactions sent to the ByzCoin service, which
+// doesn't check the certificates: they hold the secret encrypted to the LTS
+// and the public key of the reader, so they don't need to be hidden. As the
+// websocket of a conode with TLS doesn't accept any connection in clear,
+// they are still sent over TLS.
+
+// clientCertificateValidity is how long the certificates returned by
+// NewClientCertificate are valid.
+const clientCertificateValidity = 365 * 24 * time.Hour
+
+// NewClientCertificate returns a self-signed client certificate for the
+// standard Ed25519 key, to be set in the tls.Config of the connection to
+// the conode. The key must be the one of the reader, as given by
+// NewSignerFromEd25519.
+func NewClientCertificate(sk ed25519.PrivateKey) (tls.Certificate, error) {
+	if len(sk) != ed25519.PrivateKeySize {
+		return tls.Certificate{}, xerrors.New("wrong private key length")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, xerrors.Errorf("creating serial: %v", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "calypso reader"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(clientCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, sk.Public(), sk)
+	if err != nil {
+		return tls.Certificate{}, xerrors.Errorf("creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: sk}, nil
+}
+
+// RequestClientCertificates sets the TLS configuration of the websocket of
+// the conode to ask the clients for their certificates. They are not
+// required during the handshake, so that the clients of the other services
+// can connect without them, but a client sending one must prove it holds its
+// key. It must be called before the conode is started.
+func RequestClientCertificates(conf *tls.Config) {
+	conf.ClientAuth = tls.RequestClientCert
+}
+
+// UseClientCertificate makes the client connect to the conodes over TLS, with
+// a client certificate for the Ed25519 key of the reader, as needed when
+// RequireClientTLS is set. roots are the certificates of the conodes, or nil
+// to use the ones of the system.
+func (c *Client) UseClientCertificate(sk ed25519.PrivateKey, roots *x509.CertPool) error {
+	cert, err := NewClientCertificate(sk)
+	if err != nil {
+		return err
+	}
+	c.c.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+	}
+	return nil
+}
+
+// certificateKeys returns the Ed25519 keys of the client certificates of
+// the request.
+func certificateKeys(req *http.Request) []kyber.Point {
+	if req.TLS == nil {
+		return nil
+	}
+	var keys []kyber.Point
+	for _, cert := range req.TLS.PeerCertificates {
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			continue
+		}
+		p := cothority.Suite.Point()
+		if err := p.UnmarshalBinary(pub); err == nil {
+			keys = append(keys, p)
+		}
+	}
+	return keys
+}
+
+// checkClientTLS refuses the request if the configuration requires TLS with
+// client certificates and the request doesn't have them, or if it is a
+// decryption request for another key than the one of the certificates.
+func (s *Service) checkClientTLS(req *http.Request, path string, buf []byte) error {
+	if !s.getConfig().RequireClientTLS {
+		return nil
+	}
+	if req.TLS == nil {
+		return xerrors.New("requests must be sent over TLS")
+	}
+	keys := certificateKeys(req)
+	if len(keys) == 0 {
+		return xerrors.New("requests need an Ed25519 client certificate")
+	}
+	var dkrs []DecryptKey
+	switch path {
+	case "DecryptKey":
+		var dkr DecryptKey
+		err := protobuf.DecodeWithConstructors(buf, &dkr,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return xerrors.Errorf("decoding request: %v", err)
+		}
+		dkrs = []DecryptKey{dkr}
+	case "DecryptKeys":
+		var batch DecryptKeys
+		err := protobuf.DecodeWithConstructors(buf, &batch,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return xerrors.Errorf("decoding request: %v", err)
+		}
+		dkrs = batch.Requests
+	}
+	for i := range dkrs {
+		xc, err := readerKey(&dkrs[i])
+		if err != nil {
+			return err
+		}
+		if !pointInList(xc, keys) {
+			return xerrors.New("reader is not the owner of the client certificate")
+		}
+	}
+	return nil
+}
+
+// readerKey returns the key the secret of the request is re-encrypted to.
+// The proofs are only checked later by the handler.
+func readerKey(dkr *DecryptKey) (kyber.Point, error) {
+	read, err := decodeReadProof(&dkr.Read)
+	if err != nil {
+		return nil, xerrors.Errorf("didn't get a read instance: %v", err)
+	}
+	if err := read.open(dkr.Opening); err != nil {
+		return nil, xerrors.Errorf("opening blinded read: %v", err)
+	}
+	_, err = read.delegate(byzcoin.NewInstanceID(dkr.Read.InclusionProof.Key()))
+	if err != nil {
+		return nil, xerrors.Errorf("delegating read: %v", err)
+	}
+	return read.Xc, nil
+}
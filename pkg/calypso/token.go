@@ -0,0 +1,110 @@
+package calypso
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"golang.org/x/xerrors"
+)
+
+// A write added with an idempotency token has an ID derived from the token,
+// see AddWriteWithToken. The node adding the transaction checks whether the
+// write-instance of the token already exists, and then returns its proof
+// instead of adding the transaction again. Concurrent requests for the same
+// token are handled one after the other, so that only the first one adds
+// the transaction.
+
+// AddTokenWrite adds the transaction spawning the write-instance of a token,
+// unless the write-instance already exists.
+func (s *Service) AddTokenWrite(req *AddTokenWrite) (*AddTokenWriteReply, error) {
+	bc, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, xerrors.New("couldn't get the byzcoin service")
+	}
+	bcID := req.Request.SkipchainID
+	s.storage.RLock()
+	_, authorised := s.storage.AuthorisedByzCoinIDs[string(bcID)]
+	s.storage.RUnlock()
+	if !authorised {
+		return nil, xerrors.New("this ByzCoin ID is not authorised")
+	}
+	if err := s.checkNamespace(bcID, req.Namespace); err != nil {
+		return nil, xerrors.Errorf("checking namespace: %v", err)
+	}
+
+	insts := req.Request.Transaction.Instructions
+	if len(insts) != 1 || insts[0].Spawn == nil ||
+		insts[0].Spawn.ContractID != ContractWriteID ||
+		insts[0].Spawn.Args.Search("preID") == nil {
+		return nil, xerrors.New("transaction must only spawn a write with a preID")
+	}
+	writeID, err := insts[0].DeriveIDArg("", "preID")
+	if err != nil {
+		return nil, xerrors.Errorf("deriving instance ID: %v", err)
+	}
+
+	done := s.startTokenWrite(writeID)
+	defer done()
+	if reply, err := s.existingTokenWrite(bc, &req.Request, writeID); reply != nil || err != nil {
+		return reply, err
+	}
+	req.Request.ProofKey = writeID.Slice()
+	resp, err := bc.AddTransaction(&req.Request)
+	if err != nil || resp.Error != "" {
+		// The write might have been added through another node.
+		if reply, _ := s.existingTokenWrite(bc, &req.Request, writeID); reply != nil {
+			return reply, nil
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("adding transaction: %v", err)
+		}
+	}
+	return &AddTokenWriteReply{Response: *resp, WriteID: writeID}, nil
+}
+
+// startTokenWrite waits until no other request is adding the write-instance,
+// and returns the function to call once the request is done.
+func (s *Service) startTokenWrite(id byzcoin.InstanceID) func() {
+	for {
+		s.tokenWritesLock.Lock()
+		wait, busy := s.tokenWrites[id]
+		if !busy {
+			done := make(chan struct{})
+			s.tokenWrites[id] = done
+			s.tokenWritesLock.Unlock()
+			return func() {
+				s.tokenWritesLock.Lock()
+				delete(s.tokenWrites, id)
+				s.tokenWritesLock.Unlock()
+				close(done)
+			}
+		}
+		s.tokenWritesLock.Unlock()
+		<-wait
+	}
+}
+
+// existingTokenWrite returns the reply for a duplicate if the write-instance
+// already exists, or nil.
+func (s *Service) existingTokenWrite(bc *byzcoin.Service, req *byzcoin.AddTxRequest,
+	writeID byzcoin.InstanceID) (*AddTokenWriteReply, error) {
+	from := req.ProofFrom
+	if from == nil {
+		from = req.SkipchainID
+	}
+	resp, err := bc.GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     writeID.Slice(),
+		ID:      from,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting proof of write: %v", err)
+	}
+	if !resp.Proof.InclusionProof.Match(writeID.Slice()) {
+		return nil, nil
+	}
+	return &AddTokenWriteReply{
+		Response: byzcoin.AddTxResponse{Version: byzcoin.CurrentVersion,
+			Proof: &resp.Proof},
+		WriteID:   writeID,
+		Duplicate: true,
+	}, nil
+}
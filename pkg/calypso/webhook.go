@@ -0,0 +1,231 @@
+package calypso
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// Writers can be told about the reads and the decryptions of their
+// documents without polling the event log: the node POSTs a JSON
+// WebhookNotification to the URLs in the Webhooks of its configuration.
+// The reads are sent by the leader of the block holding them, so that every
+// read is sent once, and the decryptions by the node that ran them. The
+// body is signed with the service key of the node, and the receiver checks
+// it with VerifyWebhook.
+//
+// The notifications are sent in the background. If a URL cannot be
+// reached, it is tried again a few times, and the notification is dropped
+// if the queue is full.
+
+const (
+	// WebhookSignatureHeader holds the hex encoded Schnorr signature of the
+	// body of a notification.
+	WebhookSignatureHeader = "X-Calypso-Signature"
+	// WebhookNodeHeader holds the service key of the node sending a
+	// notification.
+	WebhookNodeHeader = "X-Calypso-Node"
+	// webhookQueueSize is the number of notifications waiting to be sent.
+	webhookQueueSize = 1000
+	// webhookAttempts is how often a notification is sent before giving up.
+	webhookAttempts = 3
+	// webhookTimeout is how long a receiver has to answer.
+	webhookTimeout = 10 * time.Second
+)
+
+// Webhook is a URL notified of the events of the node.
+type Webhook struct {
+	// URL receives the notifications. It must be an http or https URL.
+	URL string
+	// Events are the types of events sent, EventRead or EventDecrypt. If
+	// it is empty, both are sent.
+	Events []string
+}
+
+func (wh Webhook) verify() error {
+	u, err := url.Parse(wh.URL)
+	if err != nil {
+		return xerrors.Errorf("parsing URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return xerrors.New("URL must be an http or https URL")
+	}
+	for _, e := range wh.Events {
+		if e != EventRead && e != EventDecrypt {
+			return xerrors.Errorf("cannot send %s events", e)
+		}
+	}
+	return nil
+}
+
+// wants returns true if the events of the given type are sent to the URL.
+func (wh Webhook) wants(typ string) bool {
+	if typ != EventRead && typ != EventDecrypt {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookNotification is the body of a notification. IDs and hashes are
+// hex encoded.
+type WebhookNotification struct {
+	// Type is EventRead or EventDecrypt.
+	Type string `json:"type"`
+	// DocumentID is the ID of the write-instance.
+	DocumentID string `json:"document_id"`
+	// ReadID is the ID of the read-instance.
+	ReadID string `json:"read_id"`
+	// Reader is the identity of the reader of a read, or the key the
+	// document has been re-encrypted to.
+	Reader string `json:"reader"`
+	// ByzCoinID is the chain of the document.
+	ByzCoinID string `json:"byzcoin_id"`
+	// BlockIndex and BlockHash are the block holding a read. BlockIndex is
+	// -1 for decryptions.
+	BlockIndex int    `json:"block_index"`
+	BlockHash  string `json:"block_hash,omitempty"`
+	// Timestamp is the time of the block, or of the decryption, in Unix
+	// nanoseconds.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// VerifyWebhook checks the signature of the body of a notification, as
+// given in the WebhookSignatureHeader, against the service key of the
+// node, and returns the notification.
+func VerifyWebhook(body []byte, signature string, node kyber.Point) (*WebhookNotification, error) {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding signature: %v", err)
+	}
+	if err := schnorr.Verify(cothority.Suite, node, body, sig); err != nil {
+		return nil, xerrors.Errorf("verifying signature: %v", err)
+	}
+	n := &WebhookNotification{}
+	if err := json.Unmarshal(body, n); err != nil {
+		return nil, xerrors.Errorf("decoding notification: %v", err)
+	}
+	return n, nil
+}
+
+// webhookDelivery is a signed notification to be sent to a URL.
+type webhookDelivery struct {
+	url  string
+	body []byte
+	sig  string
+	node string
+}
+
+// webhookQueue sends the notifications one after the other.
+type webhookQueue struct {
+	deliveries chan webhookDelivery
+	client     *http.Client
+}
+
+func newWebhookQueue() *webhookQueue {
+	q := &webhookQueue{
+		deliveries: make(chan webhookDelivery, webhookQueueSize),
+		client:     &http.Client{Timeout: webhookTimeout},
+	}
+	go q.run()
+	return q
+}
+
+func (q *webhookQueue) run() {
+	for d := range q.deliveries {
+		for i := 0; i < webhookAttempts; i++ {
+			if i > 0 {
+				time.Sleep(time.Second << uint(i-1))
+			}
+			err := q.send(d)
+			if err == nil {
+				break
+			}
+			log.Lvl2("couldn't send notification to", d.url, err)
+		}
+	}
+}
+
+func (q *webhookQueue) send(d webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return xerrors.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, d.sig)
+	req.Header.Set(WebhookNodeHeader, d.node)
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return xerrors.Errorf("sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return xerrors.Errorf("receiver returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyWebhooks queues a signed notification of every read and decryption
+// in events for the webhooks wanting it. blockHash is the hash of the block
+// holding the reads.
+func (s *Service) notifyWebhooks(events []Event, blockHash []byte) {
+	hooks := s.getConfig().Webhooks
+	if len(hooks) == 0 {
+		return
+	}
+	kp := s.getKeyPair()
+	for _, e := range events {
+		if e.Type != EventRead && e.Type != EventDecrypt {
+			continue
+		}
+		n := WebhookNotification{
+			Type:       e.Type,
+			DocumentID: hex.EncodeToString(e.WriteID[:]),
+			ReadID:     hex.EncodeToString(e.InstanceID[:]),
+			Reader:     e.Identity,
+			ByzCoinID:  hex.EncodeToString(e.ByzCoinID),
+			BlockIndex: e.BlockIndex,
+			BlockHash:  hex.EncodeToString(blockHash),
+			Timestamp:  e.Timestamp,
+		}
+		body, err := json.Marshal(n)
+		if err != nil {
+			log.Error("encoding notification:", err)
+			continue
+		}
+		sig, err := schnorr.Sign(cothority.Suite, kp.Private, body)
+		if err != nil {
+			log.Error("signing notification:", err)
+			continue
+		}
+		for _, wh := range hooks {
+			if !wh.wants(e.Type) {
+				continue
+			}
+			select {
+			case s.webhooks.deliveries <- webhookDelivery{url: wh.URL,
+				body: body, sig: hex.EncodeToString(sig),
+				node: kp.Public.String()}:
+			default:
+				log.Warn(s.ServerIdentity(), "webhook queue is full, dropping",
+					e.Type, "notification for", wh.URL)
+			}
+		}
+	}
+}
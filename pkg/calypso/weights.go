@@ -0,0 +1,94 @@
+package calypso
+
+import (
+	"github.com/calypso-demo/filesharing/pkg/byzcoin"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// An LTS with weights gives several shares to some nodes, see
+// LtsInstanceInfo.Weights. The DKG gives every node as many shares as its
+// weight, and a node sends all its re-encrypted shares in the OCS protocol,
+// so that the threshold is a threshold of shares. The shares of a weighted
+// LTS cannot be reshared, exported or recovered from the other nodes, as
+// these work with one share per node.
+
+// shareWeights holds the number of shares of every node of a weighted LTS,
+// in the order of storage.Rosters.
+type shareWeights struct {
+	Weights []int
+}
+
+// weightsOf returns the weights of the nodes of the roster, which must hold
+// the nodes of the LTS in any order, or nil if the LTS has no weights.
+func (info *LtsInstanceInfo) weightsOf(roster *onet.Roster) ([]int, error) {
+	if len(info.Weights) == 0 {
+		return nil, nil
+	}
+	if len(roster.List) != len(info.Roster.List) {
+		return nil, xerrors.New("the roster doesn't hold the nodes of the LTS")
+	}
+	weights := make([]int, len(roster.List))
+	for i, si := range roster.List {
+		j, _ := info.Roster.Search(si.ID)
+		if j < 0 || j >= len(info.Weights) {
+			return nil, xerrors.Errorf("%v is not a node of the LTS", si)
+		}
+		weights[i] = info.Weights[j]
+	}
+	return weights, nil
+}
+
+// setWeights stores the weights of the LTS, in the order of its roster in
+// storage.Rosters. It must be called with the lock held.
+func (st *storage) setWeights(id byzcoin.InstanceID, weights []int) {
+	if len(weights) == 0 {
+		delete(st.Weights, id)
+		return
+	}
+	st.Weights[id] = &shareWeights{Weights: weights}
+}
+
+// ltsShares returns the number of shares of the LTS with the given roster
+// and the number of shares of the nodes holding more than one, or nil if
+// the LTS has no weights.
+func (s *Service) ltsShares(id byzcoin.InstanceID,
+	roster *onet.Roster) (int, map[network.ServerIdentityID]int) {
+	s.storage.RLock()
+	sw := s.storage.Weights[id]
+	s.storage.RUnlock()
+	if sw == nil || len(sw.Weights) != len(roster.List) {
+		return len(roster.List), nil
+	}
+	shares := 0
+	weights := make(map[network.ServerIdentityID]int)
+	for i, w := range sw.Weights {
+		shares += w
+		if w > 1 {
+			weights[roster.List[i].ID] = w
+		}
+	}
+	return shares, weights
+}
+
+// treeNodes returns how many nodes of the roster a re-encryption asks: a
+// threshold of them, or all of them if the LTS has weights, as the
+// strategies choose nodes, not shares.
+func treeNodes(roster *onet.Roster, threshold int,
+	weights map[network.ServerIdentityID]int) int {
+	if weights != nil {
+		return len(roster.List)
+	}
+	return threshold
+}
+
+// checkUnweighted returns an error if the LTS has weights.
+func (s *Service) checkUnweighted(id byzcoin.InstanceID) error {
+	s.storage.RLock()
+	defer s.storage.RUnlock()
+	if s.storage.Weights[id] != nil {
+		return xerrors.New("the LTS has weights")
+	}
+	return nil
+}
@@ -32,7 +32,10 @@ package darc
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
@@ -49,8 +52,8 @@ import (
 
 	"golang.org/x/xerrors"
 
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/sign/eddsa"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
@@ -801,6 +804,9 @@ func (s Signer) Sign(msg []byte) ([]byte, error) {
 func (s Signer) GetPrivate() (kyber.Scalar, error) {
 	switch s.Type() {
 	case 1:
+		if s.Ed25519.Secret == nil {
+			return nil, errors.New("signer lacks a private key")
+		}
 		return s.Ed25519.Secret, nil
 	case 0, 2, 3:
 		return nil, errors.New("signer lacks a private key")
@@ -1186,8 +1192,32 @@ func NewSignerEd25519(public kyber.Point, private kyber.Scalar) Signer {
 	}}
 }
 
+// NewSignerEd25519FromCrypto initializes a new SignerEd25519 signer whose
+// private key is only accessible through the given crypto.Signer. This
+// allows to use keys stored in an HSM, a TPM or the keychain of the OS. The
+// public key of cs must be an ed25519.PublicKey, and the signatures it
+// returns must follow RFC 8032, as they are verified as schnorr signatures.
+func NewSignerEd25519FromCrypto(cs crypto.Signer) (Signer, error) {
+	pub, ok := cs.Public().(ed25519.PublicKey)
+	if !ok {
+		return Signer{}, errors.New("public key is not an ed25519 key")
+	}
+	point := cothority.Suite.Point()
+	if err := point.UnmarshalBinary(pub); err != nil {
+		return Signer{}, fmt.Errorf("invalid public key: %v", err)
+	}
+	return Signer{Ed25519: &SignerEd25519{
+		Point:  point,
+		signer: cs,
+	}}, nil
+}
+
 // Sign creates a schnorr signautre on the message.
 func (eds SignerEd25519) Sign(msg []byte) ([]byte, error) {
+	if eds.signer != nil {
+		// Ed25519 signs the message itself, so no hash is given.
+		return eds.signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
 	return schnorr.Sign(cothority.Suite, eds.Secret, msg)
 }
 
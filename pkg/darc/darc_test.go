@@ -1,14 +1,18 @@
 package darc
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net/url"
 	"strings"
 	"testing"
 
-	"github.com/stretchr/testify/require"
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRules(t *testing.T) {
@@ -572,6 +576,33 @@ func localEvolution(newDarc *Darc, oldDarc *Darc, signers ...Signer) error {
 	return nil
 }
 
+func TestSigner_Crypto(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	signer, err := NewSignerEd25519FromCrypto(sk)
+	require.NoError(t, err)
+	_, err = signer.GetPrivate()
+	require.Error(t, err)
+
+	msg := []byte("document")
+	sig, err := signer.Sign(msg)
+	require.NoError(t, err)
+	id := signer.Identity()
+	require.NoError(t, id.Verify(msg, sig))
+	require.Error(t, id.Verify([]byte("other document"), sig))
+
+	d := NewDarc(InitRules([]Identity{id}, []Identity{id}), []byte("crypto"))
+	d2 := d.Copy()
+	require.NoError(t, d2.EvolveFrom(d))
+	_, _, err = d2.MakeEvolveRequest(signer)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = NewSignerEd25519FromCrypto(ecKey)
+	require.Error(t, err)
+}
+
 func TestParseIdentity(t *testing.T) {
 	_, err := ParseIdentity("")
 	require.Error(t, err)
@@ -1,6 +1,8 @@
 package darc
 
 import (
+	"crypto"
+
 	"github.com/calypso-demo/filesharing/pkg/darc/expression"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/network"
@@ -122,6 +124,9 @@ type Signer struct {
 type SignerEd25519 struct {
 	Point  kyber.Point
 	Secret kyber.Scalar
+	// signer is used instead of Secret if the private key is not available,
+	// e.g., because it is stored in an HSM.
+	signer crypto.Signer
 }
 
 // SignerX509EC holds a public and private keys necessary to sign Darcs,
@@ -0,0 +1,298 @@
+// Package deploy generates everything needed to run a filesharing
+// cothority: the private and public configuration of every conode, the
+// group file for the clients, and manifests for docker-compose and
+// kubernetes.
+//
+// All nodes listen on the same ports inside their container and are
+// reachable under their name, e.g. conode1, by the other nodes. The
+// websocket port of every node is published on the host, so that clients
+// outside of the docker network can use the URL given in the group file.
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// The files created by Generate in the output directory.
+const (
+	// GroupFile holds the public configuration of all nodes. It is used by
+	// the clients and to create a ByzCoin ledger.
+	GroupFile = "public.toml"
+	// ComposeFile is the docker-compose manifest.
+	ComposeFile = "docker-compose.yml"
+	// KubernetesFile is the kubernetes manifest.
+	KubernetesFile = "kubernetes.yml"
+	// PrivateFile is the name of the private configuration, stored in
+	// one directory per node.
+	PrivateFile = "private.toml"
+)
+
+// Config describes the cothority to generate.
+type Config struct {
+	// Nodes is the number of conodes.
+	Nodes int
+	// Name is the prefix of the names of the conodes, which are numbered
+	// from 1.
+	Name string
+	// Port is the port the conodes listen on, Port+1 being the websocket
+	// port.
+	Port int
+	// PublicHost and PublicPort are used to create the URL of the
+	// websocket of every node, the i-th node using PublicPort+2*i.
+	PublicHost string
+	PublicPort int
+	// Image is the docker image running the conode binary.
+	Image string
+	// Debug is the debug level of the conodes.
+	Debug int
+	// InsecureAdmin allows the admin requests of the calypso service from
+	// outside of the container. It must only be used for tests.
+	InsecureAdmin bool
+}
+
+// DefaultConfig returns a configuration for a cothority of n nodes that
+// are published on localhost, like the one of docker/byzcoin.
+func DefaultConfig(n int) Config {
+	return Config{
+		Nodes:      n,
+		Name:       "conode",
+		Port:       7770,
+		PublicHost: "localhost",
+		PublicPort: 7770,
+		Image:      "filesharing/byzcoin:latest",
+		Debug:      2,
+	}
+}
+
+// node is one conode of the cothority, as used by the templates.
+type node struct {
+	Name       string
+	Port       int
+	PublicPort int
+	Private    string
+}
+
+// Generate creates a new cothority described by conf in the directory dir.
+// New keys are created for every node and existing files are overwritten.
+func Generate(conf Config, dir string) error {
+	if conf.Nodes < 1 {
+		return xerrors.New("need at least one node")
+	}
+	if conf.Name == "" || conf.Image == "" {
+		return xerrors.New("missing name or image")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return xerrors.Errorf("creating directory: %v", err)
+	}
+
+	var nodes []node
+	var servers []*app.ServerToml
+	for i := 0; i < conf.Nodes; i++ {
+		n, server, err := newNode(conf, i, dir)
+		if err != nil {
+			return xerrors.Errorf("node %d: %v", i+1, err)
+		}
+		nodes = append(nodes, n)
+		servers = append(servers, server)
+	}
+
+	err := app.NewGroupToml(servers...).Save(filepath.Join(dir, GroupFile))
+	if err != nil {
+		return xerrors.Errorf("saving group file: %v", err)
+	}
+	data := struct {
+		Config
+		Nodes []node
+	}{conf, nodes}
+	if err := writeTemplate(composeTemplate, data, filepath.Join(dir, ComposeFile)); err != nil {
+		return xerrors.Errorf("writing docker-compose file: %v", err)
+	}
+	if err := writeTemplate(kubernetesTemplate, data, filepath.Join(dir, KubernetesFile)); err != nil {
+		return xerrors.Errorf("writing kubernetes file: %v", err)
+	}
+	return nil
+}
+
+// newNode creates the keys of the i-th node and saves its configuration in
+// its own directory.
+func newNode(conf Config, i int, dir string) (node, *app.ServerToml, error) {
+	n := node{
+		Name:       fmt.Sprintf("%s%d", conf.Name, i+1),
+		Port:       conf.Port,
+		PublicPort: conf.PublicPort + 2*i,
+	}
+	kp := key.NewKeyPair(cothority.Suite)
+	pub, err := encoding.PointToStringHex(cothority.Suite, kp.Public)
+	if err != nil {
+		return n, nil, xerrors.Errorf("encoding public key: %v", err)
+	}
+	priv, err := encoding.ScalarToStringHex(cothority.Suite, kp.Private)
+	if err != nil {
+		return n, nil, xerrors.Errorf("encoding private key: %v", err)
+	}
+
+	cc := &app.CothorityConfig{
+		Suite:   cothority.Suite.String(),
+		Public:  pub,
+		Private: priv,
+		Address: network.NewAddress(network.TLS,
+			net.JoinHostPort(n.Name, strconv.Itoa(conf.Port))),
+		ListenAddress: net.JoinHostPort("0.0.0.0", strconv.Itoa(conf.Port)),
+		Description:   n.Name,
+		Services:      app.GenerateServiceKeyPairs(),
+	}
+	if conf.PublicHost != "" {
+		cc.URL = "http://" + net.JoinHostPort(conf.PublicHost,
+			strconv.Itoa(n.PublicPort+1))
+	}
+
+	nodeDir := filepath.Join(dir, n.Name)
+	if err := os.MkdirAll(nodeDir, 0700); err != nil {
+		return n, nil, xerrors.Errorf("creating directory: %v", err)
+	}
+	privFile := filepath.Join(nodeDir, PrivateFile)
+	if err := cc.Save(privFile); err != nil {
+		return n, nil, xerrors.Errorf("saving private configuration: %v", err)
+	}
+	buf, err := ioutil.ReadFile(privFile)
+	if err != nil {
+		return n, nil, xerrors.Errorf("reading private configuration: %v", err)
+	}
+	n.Private = string(buf)
+
+	server := app.NewServerToml(cothority.Suite, kp.Public, cc.Address,
+		cc.Description, cc.Services)
+	server.URL = cc.URL
+	err = app.NewGroupToml(server).Save(filepath.Join(nodeDir, GroupFile))
+	if err != nil {
+		return n, nil, xerrors.Errorf("saving public configuration: %v", err)
+	}
+	return n, server, nil
+}
+
+func writeTemplate(tmpl *template.Template, data interface{}, file string) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return xerrors.Errorf("executing template: %v", err)
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0600)
+}
+
+var funcs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n"+pad, -1)
+	},
+}
+
+var composeTemplate = template.Must(template.New("compose").Funcs(funcs).Parse(
+	`version: "3.0"
+
+services:
+{{- range .Nodes}}
+  {{.Name}}:
+    image: {{$.Image}}
+    hostname: {{.Name}}
+    command: ./conode -d {{$.Debug}} -c /root/conode/private.toml server
+    ports:
+      - "{{.PublicPort}}:{{.Port}}"
+      - "{{add .PublicPort 1}}:{{add .Port 1}}"
+    volumes:
+      - ./{{.Name}}:/root/conode
+    environment:
+      - CONODE_SERVICE_PATH=/root/conode
+{{- if $.InsecureAdmin}}
+      - COTHORITY_ALLOW_INSECURE_ADMIN=true
+{{- end}}
+{{- end}}
+`))
+
+var kubernetesTemplate = template.Must(template.New("kubernetes").Funcs(funcs).Parse(
+	`{{- range .Nodes}}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}
+stringData:
+  private.toml: |
+{{indent 4 .Private}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+spec:
+  selector:
+    app: {{.Name}}
+  ports:
+    - name: conode
+      port: {{.Port}}
+    - name: websocket
+      port: {{add .Port 1}}
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{.Name}}
+spec:
+  serviceName: {{.Name}}
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app: {{.Name}}
+    spec:
+      containers:
+        - name: conode
+          image: {{$.Image}}
+          command: ["./conode", "-d", "{{$.Debug}}", "-c", "/root/conode/private.toml", "server"]
+          env:
+            - name: CONODE_SERVICE_PATH
+              value: /root/data
+{{- if $.InsecureAdmin}}
+            - name: COTHORITY_ALLOW_INSECURE_ADMIN
+              value: "true"
+{{- end}}
+          ports:
+            - containerPort: {{.Port}}
+            - containerPort: {{add .Port 1}}
+          volumeMounts:
+            - name: config
+              mountPath: /root/conode/private.toml
+              subPath: private.toml
+            - name: data
+              mountPath: /root/data
+      volumes:
+        - name: config
+          secret:
+            secretName: {{.Name}}
+  volumeClaimTemplates:
+    - metadata:
+        name: data
+      spec:
+        accessModes: ["ReadWriteOnce"]
+        resources:
+          requests:
+            storage: 1Gi
+{{- end}}
+`))
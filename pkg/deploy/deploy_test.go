@@ -0,0 +1,49 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/onet/v3/app"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Error(t, Generate(DefaultConfig(0), dir))
+
+	conf := DefaultConfig(4)
+	conf.InsecureAdmin = true
+	require.NoError(t, Generate(conf, dir))
+
+	f, err := os.Open(filepath.Join(dir, GroupFile))
+	require.NoError(t, err)
+	defer f.Close()
+	group, err := app.ReadGroupDescToml(f)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(group.Roster.List))
+	require.Equal(t, "tls://conode1:7770", group.Roster.List[0].Address.String())
+	require.Equal(t, "http://localhost:7777", group.Roster.List[3].URL)
+
+	for i := 1; i <= 4; i++ {
+		_, err = app.LoadCothority(filepath.Join(dir, "conode"+strconv.Itoa(i),
+			PrivateFile))
+		require.NoError(t, err)
+	}
+
+	compose, err := ioutil.ReadFile(filepath.Join(dir, ComposeFile))
+	require.NoError(t, err)
+	require.True(t, strings.Contains(string(compose), `"7776:7770"`))
+	require.True(t, strings.Contains(string(compose), "COTHORITY_ALLOW_INSECURE_ADMIN"))
+
+	k8s, err := ioutil.ReadFile(filepath.Join(dir, KubernetesFile))
+	require.NoError(t, err)
+	require.Equal(t, 4, strings.Count(string(k8s), "kind: StatefulSet"))
+}
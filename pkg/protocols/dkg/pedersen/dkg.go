@@ -33,9 +33,22 @@ type Setup struct {
 	// KeyPair must be set by the caller, if this is a new DKG, then simply
 	// generate a new KeyPair.
 	KeyPair *key.Pair
+	// TraceID, if set, is logged with every phase of the protocol.
+	TraceID string
+	// Weights, if set, is the number of shares of every node, in the order
+	// of the roster of the tree. A node with more than one share runs the
+	// DKG once per share, with a new key pair for every additional share,
+	// and the shares of the nodes follow each other. It must be set by
+	// every node, together with a Threshold of shares, and cannot be used
+	// with NewDKG.
+	Weights []int
 
 	nodes   []*onet.TreeNode
 	publics []kyber.Point
+	// extra holds the DKGs of the additional shares of this node and
+	// extraKeys their key pairs.
+	extra     []*dkgpedersen.DistKeyGenerator
+	extraKeys []*key.Pair
 
 	structStartDeal chan structStartDeal
 	structDeal      chan structDeal
@@ -76,9 +89,21 @@ func CustomSetup(n *onet.TreeNodeInstance, suite vss.Suite, keypair *key.Pair) (
 }
 
 // SharedSecret returns the necessary information for doing shared
-// encryption and decryption.
+// encryption and decryption. The additional shares of a node with a weight
+// are returned in the Extra field.
 func (o *Setup) SharedSecret() (*SharedSecret, *dkgpedersen.DistKeyShare, error) {
-	return NewSharedSecret(o.DKG)
+	shared, dks, err := NewSharedSecret(o.DKG)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, gen := range o.extra {
+		extra, err := gen.DistKeyShare()
+		if err != nil {
+			return nil, nil, err
+		}
+		shared.Extra = append(shared.Extra, extra.Share)
+	}
+	return shared, dks, nil
 }
 
 // NewSharedSecret takes an initialized DistKeyGenerator and returns the
@@ -102,6 +127,7 @@ func NewSharedSecret(gen *dkgpedersen.DistKeyGenerator) (*SharedSecret, *dkgpede
 // Start sends the Announce-message to all children
 func (o *Setup) Start() error {
 	log.Lvl3("Starting Protocol")
+	cothority.LogTrace(o.TraceID, o.ServerIdentity(), "dkg_start", nil)
 	// 1a - root asks children to send their public key
 	errs := o.Broadcast(&Init{Wait: o.Wait})
 	if len(errs) != 0 {
@@ -115,19 +141,25 @@ func (o *Setup) Dispatch() error {
 	defer o.Done()
 	err := o.allStartDeal(<-o.structStartDeal)
 	if err != nil {
+		cothority.LogTrace(o.TraceID, o.ServerIdentity(), "dkg_deal", err)
 		return err
 	}
+	cothority.LogTrace(o.TraceID, o.ServerIdentity(), "dkg_deal", nil)
 	// TODO: "This will fail as soon as we start doing things with threshold.
 	//  " - nicolas
-	for i := 0; i < o.DKG.ExpectedDeals(); i++ {
+	deals := 0
+	for _, gen := range o.generators() {
+		deals += gen.ExpectedDeals()
+	}
+	for i := 0; i < deals; i++ {
 		err := o.allDeal(<-o.structDeal)
 		if err != nil {
 			return err
 		}
 	}
-	for !o.DKG.Certified() {
+	for !o.certified() {
 		err := o.allResponse(<-o.structResponse)
-		if err != nil && err.Error() != "vss: already existing response from same origin" {
+		if err != nil {
 			return err
 		}
 	}
@@ -142,10 +174,13 @@ func (o *Setup) Dispatch() error {
 		}
 	}
 
-	if !o.DKG.Certified() {
+	if !o.certified() {
+		cothority.LogTrace(o.TraceID, o.ServerIdentity(), "dkg_finished",
+			errors.New("not certified"))
 		return errors.New("not certified")
 	}
 
+	cothority.LogTrace(o.TraceID, o.ServerIdentity(), "dkg_finished", nil)
 	o.Finished <- true
 	return nil
 }
@@ -161,18 +196,31 @@ func (o *Setup) childInit(i structInit) error {
 			Private: o.Private(),
 		}
 	}
-	return o.SendToParent(&InitReply{Public: o.KeyPair.Public})
+	return o.SendToParent(&InitReply{Public: o.KeyPair.Public,
+		Extra: o.extraPublics()})
 }
 
 // Root-node messages
 func (o *Setup) rootStartDeal(replies []structInitReply) error {
+	if o.Weights != nil {
+		if len(o.Weights) != len(o.nodes) {
+			return errors.New("need one weight per node")
+		}
+		o.publics = make([]kyber.Point, o.shares())
+	}
 	o.publics[0] = o.KeyPair.Public
+	copy(o.publics[1:], o.extraPublics())
 	for _, r := range replies {
 		index, _ := o.Roster().Search(r.ServerIdentity.ID)
 		if index < 0 {
 			return errors.New("unknown serverIdentity")
 		}
-		o.publics[index] = r.Public
+		if len(r.Extra) != o.weight(index)-1 {
+			return fmt.Errorf("%s sent %d keys for a weight of %d",
+				r.ServerIdentity, len(r.Extra)+1, o.weight(index))
+		}
+		o.publics[o.offset(index)] = r.Public
+		copy(o.publics[o.offset(index)+1:], r.Extra)
 	}
 	return o.fullBroadcast(&StartDeal{
 		Publics:   o.publics,
@@ -183,6 +231,12 @@ func (o *Setup) rootStartDeal(replies []structInitReply) error {
 // Messages for both
 func (o *Setup) allStartDeal(ssd structStartDeal) error {
 	var err error
+	if o.Weights != nil {
+		err = o.checkWeighted(ssd)
+		if err != nil {
+			return err
+		}
+	}
 	if o.NewDKG == nil {
 		o.DKG, err = dkgpedersen.NewDistKeyGenerator(o.suite, o.KeyPair.Private,
 			ssd.Publics, int(ssd.Threshold))
@@ -192,21 +246,70 @@ func (o *Setup) allStartDeal(ssd structStartDeal) error {
 	if err != nil {
 		return err
 	}
-	o.publics = ssd.Publics
-	deals, err := o.DKG.Deals()
-	if err != nil {
-		return err
+	for _, kp := range o.extraKeys {
+		gen, err := dkgpedersen.NewDistKeyGenerator(o.suite, kp.Private,
+			ssd.Publics, int(ssd.Threshold))
+		if err != nil {
+			return err
+		}
+		o.extra = append(o.extra, gen)
 	}
-	for i, d := range deals {
-		if err := o.SendTo(o.nodes[i], &Deal{d}); err != nil {
+	o.publics = ssd.Publics
+	for _, gen := range o.generators() {
+		deals, err := gen.Deals()
+		if err != nil {
 			return err
 		}
+		for i, d := range deals {
+			owner := o.owner(i)
+			if owner < 0 {
+				return fmt.Errorf("no node holds share %d", i)
+			}
+			if err := o.SendTo(o.nodes[owner], &Deal{Deal: d, To: i}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkWeighted makes sure that the root started a DKG with the weights and
+// the threshold of this node, and with its keys for all its shares.
+func (o *Setup) checkWeighted(ssd structStartDeal) error {
+	if o.NewDKG != nil {
+		return errors.New("cannot reshare with weights")
+	}
+	if len(o.Weights) != len(o.nodes) {
+		return errors.New("need one weight per node")
+	}
+	if len(ssd.Publics) != o.shares() ||
+		int(ssd.Threshold) != int(o.Threshold) {
+		return errors.New("got other weights or another threshold")
+	}
+	index, _ := o.Roster().Search(o.ServerIdentity().ID)
+	if index < 0 {
+		return errors.New("not in the roster")
+	}
+	keys := append([]kyber.Point{o.KeyPair.Public}, o.extraPublics()...)
+	for i, k := range keys {
+		if !ssd.Publics[o.offset(index)+i].Equal(k) {
+			return fmt.Errorf("got another key for share %d",
+				o.offset(index)+i)
+		}
 	}
 	return nil
 }
 
 func (o *Setup) allDeal(sd structDeal) error {
-	resp, err := o.DKG.ProcessDeal(sd.Deal.Deal)
+	gen := o.DKG
+	if o.Weights != nil {
+		gen = o.generator(sd.Deal.To)
+		if gen == nil {
+			return fmt.Errorf("got a deal for share %d of another node",
+				sd.Deal.To)
+		}
+	}
+	resp, err := gen.ProcessDeal(sd.Deal.Deal)
 	if err != nil {
 		log.Error(o.Name(), err)
 		return err
@@ -214,18 +317,106 @@ func (o *Setup) allDeal(sd structDeal) error {
 	return o.fullBroadcast(&Response{resp})
 }
 
+// allResponse passes the response to the DKGs of all shares of this node.
+// The DKG that sent the response already knows it.
 func (o *Setup) allResponse(resp structResponse) error {
 	log.Lvl3(o.Name(), resp.ServerIdentity)
-	just, err := o.DKG.ProcessResponse(resp.Response.Response)
-	if err != nil {
-		return err
-	}
-	if just != nil {
-		log.Warn(o.Name(), "Got a justification: ", just)
+	for _, gen := range o.generators() {
+		just, err := gen.ProcessResponse(resp.Response.Response)
+		if err != nil {
+			if err.Error() == "vss: already existing response from same origin" {
+				continue
+			}
+			return err
+		}
+		if just != nil {
+			log.Warn(o.Name(), "Got a justification: ", just)
+		}
 	}
 	return nil
 }
 
+// generators returns the DKGs of all shares of this node.
+func (o *Setup) generators() []*dkgpedersen.DistKeyGenerator {
+	return append([]*dkgpedersen.DistKeyGenerator{o.DKG}, o.extra...)
+}
+
+// certified returns true once the DKGs of all shares of this node are
+// certified.
+func (o *Setup) certified() bool {
+	for _, gen := range o.generators() {
+		if !gen.Certified() {
+			return false
+		}
+	}
+	return true
+}
+
+// generator returns the DKG of this node for the share with the given
+// index, or nil if the share is held by another node.
+func (o *Setup) generator(share int) *dkgpedersen.DistKeyGenerator {
+	index, _ := o.Roster().Search(o.ServerIdentity().ID)
+	if index < 0 || o.owner(share) != index {
+		return nil
+	}
+	return o.generators()[share-o.offset(index)]
+}
+
+// weight returns the number of shares of the node with the given index in
+// the roster.
+func (o *Setup) weight(index int) int {
+	if index >= len(o.Weights) {
+		return 1
+	}
+	return o.Weights[index]
+}
+
+// offset returns the index of the first share of the node with the given
+// index in the roster.
+func (o *Setup) offset(index int) int {
+	offset := 0
+	for i := 0; i < index; i++ {
+		offset += o.weight(i)
+	}
+	return offset
+}
+
+// shares returns the number of shares of all nodes.
+func (o *Setup) shares() int {
+	return o.offset(len(o.nodes))
+}
+
+// owner returns the index in the roster of the node holding the share, or
+// -1 if there is no such share.
+func (o *Setup) owner(share int) int {
+	if share < 0 {
+		return -1
+	}
+	for i := range o.nodes {
+		if share < o.offset(i)+o.weight(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// extraPublics returns the public keys of the additional shares of this
+// node, creating their key pairs the first time.
+func (o *Setup) extraPublics() []kyber.Point {
+	index, _ := o.Roster().Search(o.ServerIdentity().ID)
+	if index < 0 {
+		return nil
+	}
+	for len(o.extraKeys) < o.weight(index)-1 {
+		o.extraKeys = append(o.extraKeys, key.NewKeyPair(o.suite))
+	}
+	var publics []kyber.Point
+	for _, kp := range o.extraKeys {
+		publics = append(publics, kp.Public)
+	}
+	return publics
+}
+
 // Convenience functions
 func (o *Setup) fullBroadcast(msg interface{}) error {
 	errs := o.Multicast(msg, o.nodes...)
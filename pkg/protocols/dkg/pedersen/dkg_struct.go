@@ -2,6 +2,7 @@ package pedersen
 
 import (
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/network"
 
@@ -21,6 +22,9 @@ type SharedSecret struct {
 	V       kyber.Scalar
 	X       kyber.Point
 	Commits []kyber.Point
+	// Extra holds the additional shares of a node with a weight of more
+	// than one.
+	Extra []*share.PriShare `protobuf:"opt"`
 }
 
 // Clone makes a clone of the shared secret.
@@ -29,14 +33,25 @@ func (ss *SharedSecret) Clone() *SharedSecret {
 	for i := range ss.Commits {
 		commits[i] = ss.Commits[i].Clone()
 	}
+	var extra []*share.PriShare
+	for _, sh := range ss.Extra {
+		extra = append(extra, &share.PriShare{I: sh.I, V: sh.V.Clone()})
+	}
 	return &SharedSecret{
 		Index:   ss.Index,
 		V:       ss.V.Clone(),
 		X:       ss.X.Clone(),
 		Commits: commits,
+		Extra:   extra,
 	}
 }
 
+// Shares returns all private shares of the node, starting with the one of
+// Index.
+func (ss *SharedSecret) Shares() []*share.PriShare {
+	return append([]*share.PriShare{{I: ss.Index, V: ss.V}}, ss.Extra...)
+}
+
 // Init asks all nodes to set up a private/public key pair. It is sent to
 // all nodes from the root-node. If Wait is true, at the end of the setup
 // an additional message is sent to wait for all nodes to be set up.
@@ -52,6 +67,9 @@ type structInit struct {
 // InitReply returns the public key of that node.
 type InitReply struct {
 	Public kyber.Point
+	// Extra are the public keys of the additional shares of the node, if
+	// its weight is more than one.
+	Extra []kyber.Point `protobuf:"opt"`
 }
 
 type structInitReply struct {
@@ -73,6 +91,9 @@ type structStartDeal struct {
 // Deal sends the deals for the shared secret.
 type Deal struct {
 	Deal *dkgpedersen.Deal
+	// To is the index of the share the deal is for. It is only used if
+	// the nodes have weights.
+	To int `protobuf:"opt"`
 }
 
 type structDeal struct {
@@ -1,12 +1,14 @@
 package pedersen
 
 import (
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/require"
 	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3/pairing/bn256"
+	"go.dedis.ch/kyber/v3/share"
 	vss "go.dedis.ch/kyber/v3/share/vss/pedersen"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
@@ -87,3 +89,64 @@ func setupCustomDKG(t *testing.T, nbrNodes int) {
 		t.Fatal("Didn't finish in time")
 	}
 }
+
+// TestSetupWeightedDKG gives three shares to the root, and checks that it
+// can recover the secret with the share of a single other node.
+func TestSetupWeightedDKG(t *testing.T) {
+	local := onet.NewLocalTest(cothority.Suite)
+	defer local.CloseAll()
+	srvs, _, tree := local.GenBigTree(3, 3, 3, true)
+	weights := []int{3, 1, 1}
+
+	var name = "weighted_dkg"
+	var mut sync.Mutex
+	var setups []*Setup
+	for _, srv := range srvs {
+		_, err := srv.ProtocolRegister(name, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+			pi, err := NewSetup(n)
+			if err != nil {
+				return nil, err
+			}
+			setup := pi.(*Setup)
+			setup.Weights = weights
+			setup.Threshold = 4
+			mut.Lock()
+			setups = append(setups, setup)
+			mut.Unlock()
+			return setup, nil
+		})
+		require.NoError(t, err)
+	}
+
+	pi, err := local.CreateProtocol(name, tree)
+	require.NoError(t, err)
+	protocol := pi.(*Setup)
+	protocol.Wait = true
+	protocol.KeyPair = key.NewKeyPair(cothority.Suite)
+	require.NoError(t, pi.Start())
+	select {
+	case <-protocol.Finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+
+	shared, _, err := protocol.SharedSecret()
+	require.NoError(t, err)
+	require.Len(t, shared.Extra, 2)
+	mut.Lock()
+	other := setups[len(setups)-1]
+	mut.Unlock()
+	otherShared, _, err := other.SharedSecret()
+	require.NoError(t, err)
+	require.Len(t, otherShared.Extra, 0)
+
+	// The three shares of the root are not enough, the share of another
+	// node gives the secret.
+	shares := shared.Shares()
+	_, err = share.RecoverSecret(cothority.Suite, shares, 4, 5)
+	require.Error(t, err)
+	secret, err := share.RecoverSecret(cothority.Suite,
+		append(shares, otherShared.Shares()...), 4, 5)
+	require.NoError(t, err)
+	require.True(t, cothority.Suite.Point().Mul(secret, nil).Equal(shared.X))
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math/rand"
+	"time"
 
 	"github.com/calypso-demo/filesharing/pkg/protocols"
 	status "github.com/calypso-demo/filesharing/pkg/protocols/status"
@@ -48,17 +50,17 @@ func (c *Client) DontContact(si *network.ServerIdentity) {
 
 // StoreSkipBlockSignature asks the cothority to store the new skipblock, and
 // eventually attach it after the target skipblock.
-//  - target is a skipblock, and the new skipblock is going to be added after
-//    it, not necessarily immediately after it.  The caller should use the
-//    genesis skipblock as the target. But for backward compatibility, any
-//    skipblock can be used.  If ro and d are nil, a new skipchain will be
-//    created with target as the genesis-block.
-//  - ro is the new roster for that block. If ro is nil, the previous roster
-//    will be used.
-//  - d is the data for the new block. It can be nil. If it is not of type
-//    []byte, it will be marshalled using `network.Marshal`.
-//  - priv is the private key that will be used to sign the skipblock. If priv
-//    is nil, the skipblock will not be signed.
+//   - target is a skipblock, and the new skipblock is going to be added after
+//     it, not necessarily immediately after it.  The caller should use the
+//     genesis skipblock as the target. But for backward compatibility, any
+//     skipblock can be used.  If ro and d are nil, a new skipchain will be
+//     created with target as the genesis-block.
+//   - ro is the new roster for that block. If ro is nil, the previous roster
+//     will be used.
+//   - d is the data for the new block. It can be nil. If it is not of type
+//     []byte, it will be marshalled using `network.Marshal`.
+//   - priv is the private key that will be used to sign the skipblock. If priv
+//     is nil, the skipblock will not be signed.
 func (c *Client) StoreSkipBlockSignature(target *SkipBlock, ro *onet.Roster, d network.Message, priv kyber.Scalar) (reply *StoreSkipBlockReply, err error) {
 	log.Lvlf3("%#v", target)
 	var newBlock *SkipBlock
@@ -95,7 +97,7 @@ func (c *Client) StoreSkipBlockSignature(target *SkipBlock, ro *onet.Roster, d n
 		}
 		sig = &signature
 	}
-	err = c.SendProtobuf(host, &StoreSkipBlock{TargetSkipChainID: targetID, NewBlock: newBlock,
+	err = c.sendStoreSkipBlock(host, &StoreSkipBlock{TargetSkipChainID: targetID, NewBlock: newBlock,
 		Signature: sig}, reply)
 	if err != nil {
 		return nil, err
@@ -115,31 +117,62 @@ func (c *Client) StoreSkipBlockSignature(target *SkipBlock, ro *onet.Roster, d n
 	return reply, nil
 }
 
+// The backoff of sendStoreSkipBlock while another block is added to the
+// chain.
+const (
+	blockRetryFirst   = 50 * time.Millisecond
+	blockRetryMax     = 2 * time.Second
+	blockRetryTimeout = time.Minute
+)
+
+// sendStoreSkipBlock sends the request to the host, and retries it with a
+// jittered exponential backoff as long as the host answers that another
+// block is in progress.
+func (c *Client) sendStoreSkipBlock(host *network.ServerIdentity, req *StoreSkipBlock,
+	reply *StoreSkipBlockReply) error {
+	start := time.Now()
+	delay := blockRetryFirst
+	for {
+		err := c.SendProtobuf(host, req, reply)
+		if !IsBlockInProgress(err) || time.Since(start) > blockRetryTimeout {
+			return err
+		}
+		// The jitter keeps the clients waiting on the same block from
+		// retrying all at once.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Lvlf3("block in progress on %s, retrying in %v", host, wait)
+		time.Sleep(wait)
+		if delay *= 2; delay > blockRetryMax {
+			delay = blockRetryMax
+		}
+	}
+}
+
 // StoreSkipBlock asks the cothority to store the new skipblock, and eventually
 // attach it after the target skipblock.
-//  - target is a skipblock, where new skipblock is going to be added after it,
-//    but not necessarily immediately after it.  The caller should use the
-//    genesis skipblock as the target. But for backward compatibility, any
-//    skipblock can be used.  If ro and d are nil, a new skipchain will be
-//    created with target as the genesis-block.
-//  - ro is the new roster for that block. If ro is nil, the previous roster
-//    will be used.
-//  - d is the data for the new block. It can be nil. If it is not of type
-//    []byte, it will be marshalled using `network.Marshal`.
+//   - target is a skipblock, where new skipblock is going to be added after it,
+//     but not necessarily immediately after it.  The caller should use the
+//     genesis skipblock as the target. But for backward compatibility, any
+//     skipblock can be used.  If ro and d are nil, a new skipchain will be
+//     created with target as the genesis-block.
+//   - ro is the new roster for that block. If ro is nil, the previous roster
+//     will be used.
+//   - d is the data for the new block. It can be nil. If it is not of type
+//     []byte, it will be marshalled using `network.Marshal`.
 func (c *Client) StoreSkipBlock(target *SkipBlock, ro *onet.Roster, d network.Message) (reply *StoreSkipBlockReply, err error) {
 	return c.StoreSkipBlockSignature(target, ro, d, nil)
 }
 
 // CreateGenesisSignature is a convenience function to create a new SkipChain with the
 // given parameters.
-//  - ro is the responsible roster
-//  - baseH is the base-height - the distance between two non-height-1 skipblocks
-//  - maxH is the maximum height, which must be <= baseH
-//  - ver is a slice of verifications to apply to that block
-//  - data can be nil or any data that will be network.Marshaled to the
-//    skipblock, except if the data is of type []byte, in which case it will be
-//    stored as-is on the skipchain.
-//  - priv is a private key that is allowed to sign for new skipblocks
+//   - ro is the responsible roster
+//   - baseH is the base-height - the distance between two non-height-1 skipblocks
+//   - maxH is the maximum height, which must be <= baseH
+//   - ver is a slice of verifications to apply to that block
+//   - data can be nil or any data that will be network.Marshaled to the
+//     skipblock, except if the data is of type []byte, in which case it will be
+//     stored as-is on the skipchain.
+//   - priv is a private key that is allowed to sign for new skipblocks
 //
 // This function returns the created skipblock or nil and an error.
 func (c *Client) CreateGenesisSignature(ro *onet.Roster, baseH, maxH int, ver []VerifierID,
@@ -214,14 +247,14 @@ func compareGenesisBlocks(prop *SkipBlock, ret *SkipBlock) error {
 
 // CreateGenesis is a convenience function to create a new SkipChain with the
 // given parameters.
-//  - ro is the responsible roster
-//  - baseH is the base-height - the distance between two non-height-1 skipblocks
-//  - maxH is the maximum height, which must be <= baseH
-//  - ver is a slice of verifications to apply to that block
-//  - data can be nil or any data that will be network.Marshaled to the skipblock,
-//    except if the data is of type []byte, in which case it will be stored
-//    as-is on the skipchain.
-//  - parent is the responsible parent-block, can be 'nil'
+//   - ro is the responsible roster
+//   - baseH is the base-height - the distance between two non-height-1 skipblocks
+//   - maxH is the maximum height, which must be <= baseH
+//   - ver is a slice of verifications to apply to that block
+//   - data can be nil or any data that will be network.Marshaled to the skipblock,
+//     except if the data is of type []byte, in which case it will be stored
+//     as-is on the skipchain.
+//   - parent is the responsible parent-block, can be 'nil'
 //
 // This function returns the created skipblock or nil and an error.
 func (c *Client) CreateGenesis(ro *onet.Roster, baseH, maxH int, ver []VerifierID,
@@ -386,6 +419,37 @@ func (c *Client) GetAllSkipChainIDs(si *network.ServerIdentity) (reply *GetAllSk
 	return
 }
 
+// GetSkipChains returns a page of the skipchains known to that conode that
+// match the filters of the request.
+func (c *Client) GetSkipChains(si *network.ServerIdentity, req *GetSkipChains) (reply *GetSkipChainsReply,
+	err error) {
+	reply = &GetSkipChainsReply{}
+	err = c.SendProtobuf(si, req, reply)
+	return
+}
+
+// ForEachSkipChain calls f with the latest block of every skipchain known to
+// that conode that matches the filters of the request, fetching them one page
+// at a time. It stops at the first error returned by f.
+func (c *Client) ForEachSkipChain(si *network.ServerIdentity, req GetSkipChains,
+	f func(latest *SkipBlock) error) error {
+	for {
+		reply, err := c.GetSkipChains(si, &req)
+		if err != nil {
+			return err
+		}
+		for _, sb := range reply.Latest {
+			if err := f(sb); err != nil {
+				return err
+			}
+		}
+		if reply.Next == nil {
+			return nil
+		}
+		req.After = reply.Next
+	}
+}
+
 // GetSingleBlock searches for a block with the given ID and returns that block,
 // or an error if that block is not found.
 func (c *Client) GetSingleBlock(roster *onet.Roster, id SkipBlockID) (*SkipBlock, error) {
@@ -6,9 +6,10 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/stretchr/testify/require"
 	"github.com/calypso-demo/filesharing/pkg/protocols"
+	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
@@ -223,6 +224,33 @@ func TestClient_StoreSkipBlock(t *testing.T) {
 	require.NoError(t, c.Close())
 }
 
+// TestClient_StoreSkipBlockInProgress checks that the service refuses a block
+// while another one is in progress, and that the client retries it.
+func TestClient_StoreSkipBlockInProgress(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, ro, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+	service := l.GetServices(servers, skipchainSID)[0].(*Service)
+
+	c := newTestClient(l)
+	genesis, err := c.CreateGenesis(ro, 1, 1, VerificationNone, nil)
+	require.NoError(t, err)
+
+	service.chains.lock(genesis.Hash)
+	_, err = service.StoreSkipBlock(&StoreSkipBlock{TargetSkipChainID: genesis.Hash,
+		NewBlock: genesis.Copy()})
+	require.Equal(t, ErrorBlockInProgress, err)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		service.chains.unlock(genesis.Hash)
+	}()
+	reply, err := c.StoreSkipBlock(genesis, nil, []byte{1})
+	require.NoError(t, err)
+	require.Equal(t, 1, reply.Latest.Index)
+	require.NoError(t, c.Close())
+}
+
 func TestClient_StoreSkipBlockCorrupted(t *testing.T) {
 	nbrHosts := 3
 	l := onet.NewTCPTest(cothority.Suite)
@@ -309,6 +337,57 @@ func TestClient_GetAllSkipChainIDs(t *testing.T) {
 	}
 }
 
+func TestClient_GetSkipChains(t *testing.T) {
+	nbrHosts := 3
+	l := onet.NewTCPTest(cothority.Suite)
+	_, ro, _ := l.GenTree(nbrHosts, true)
+	defer l.CloseAll()
+
+	c := newTestClient(l)
+	ro2 := onet.NewRoster(ro.List[:2])
+	var genesis []*SkipBlock
+	for i := 0; i < 3; i++ {
+		sb, err := c.CreateGenesis(ro2, 1, 1, VerificationNone, nil)
+		require.NoError(t, err)
+		genesis = append(genesis, sb)
+	}
+	_, err := c.StoreSkipBlock(genesis[0], ro2, nil)
+	require.NoError(t, err)
+
+	reply, err := c.GetSkipChains(ro.List[0], &GetSkipChains{Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(reply.Latest))
+	require.NotNil(t, reply.Next)
+	reply, err = c.GetSkipChains(ro.List[0], &GetSkipChains{After: reply.Next})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(reply.Latest))
+	require.Nil(t, reply.Next)
+
+	n := 0
+	err = c.ForEachSkipChain(ro.List[0], GetSkipChains{Limit: 1},
+		func(*SkipBlock) error {
+			n++
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	reply, err = c.GetSkipChains(ro.List[0], &GetSkipChains{MinBlocks: 2})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(reply.Latest))
+	require.True(t, reply.Latest[0].SkipChainID().Equal(genesis[0].Hash))
+	require.Equal(t, 1, reply.Latest[0].Index)
+
+	reply, err = c.GetSkipChains(ro.List[0], &GetSkipChains{
+		RosterContains: ro.List[2].Public})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(reply.Latest))
+	reply, err = c.GetSkipChains(ro.List[0], &GetSkipChains{
+		RosterContains: ro.List[1].Public})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(reply.Latest))
+}
+
 func TestClient_GetSingleBlock(t *testing.T) {
 	nbrHosts := 1
 	l := onet.NewTCPTest(cothority.Suite)
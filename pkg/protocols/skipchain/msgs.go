@@ -24,6 +24,8 @@ func init() {
 		&GetAllSkipchainsReply{},
 		&GetAllSkipChainIDs{},
 		&GetAllSkipChainIDsReply{},
+		&GetSkipChains{},
+		&GetSkipChainsReply{},
 		// Create link with client
 		&CreateLinkPrivate{},
 		// Unlink a client
@@ -141,6 +143,35 @@ type GetAllSkipChainIDsReply struct {
 	IDs []SkipBlockID
 }
 
+// MaxSkipChainsPerPage is the maximum number of skipchains returned by
+// GetSkipChains.
+const MaxSkipChainsPerPage = 100
+
+// GetSkipChains asks for the skipchains matching the filters, one page at a
+// time. The chains are sorted by ID, so that a page can start after the last
+// chain of the previous one.
+type GetSkipChains struct {
+	// After is the ID of the last chain of the previous page, or nil for the
+	// first page.
+	After SkipBlockID `protobuf:"opt"`
+	// Limit is the maximum number of chains of the page. If it is 0 or
+	// bigger than MaxSkipChainsPerPage, MaxSkipChainsPerPage is used.
+	Limit int `protobuf:"opt"`
+	// RosterContains, if not nil, only keeps the chains whose latest roster
+	// holds this public key.
+	RosterContains kyber.Point `protobuf:"opt"`
+	// MinBlocks only keeps the chains with at least this number of blocks.
+	MinBlocks int `protobuf:"opt"`
+}
+
+// GetSkipChainsReply holds the latest blocks of the chains of the page.
+type GetSkipChainsReply struct {
+	Latest []*SkipBlock
+	// Next is the After of the request for the next page, or nil if this
+	// is the last page.
+	Next SkipBlockID `protobuf:"opt"`
+}
+
 // Internal calls
 
 // PropagateGenesis sends the genesis block of a newly created SkipChain to all members of
@@ -325,18 +356,19 @@ type SettingAuthentication struct {
 // AddFollow adds a skipchain to follow. The Signature is on the SkipchainID concatenated
 // with the Follow as a byte and the Conode.
 // The Follow is one of the following:
-//   * FollowID will store this skipchain-id and only allow evolution of
-//   this skipchain. This implies NewChainNone.
-//   * FollowType asks all stored skipchains if it knows that skipchain. All
-//   PolicyNewChain are allowed.
-//   * FollowLookup takes a ip:port where the skipchain can be found. All
-//   PolicyNewChain are allowed.
+//   - FollowID will store this skipchain-id and only allow evolution of
+//     this skipchain. This implies NewChainNone.
+//   - FollowType asks all stored skipchains if it knows that skipchain. All
+//     PolicyNewChain are allowed.
+//   - FollowLookup takes a ip:port where the skipchain can be found. All
+//     PolicyNewChain are allowed.
+//
 // The NewChain-policy is ignored for FollowID, but for the other policies
 // it is defined as follows:
-//   * NewChainNone doesn't allow any new chains from any node from this skipchain.
-//   * NewChainAnyNode allows new chains if any node from this skipchain is present.
-//   * NewChainStrictNodes allows new chains only one or more nodes from this skipchain
-//   are present in the new chain.
+//   - NewChainNone doesn't allow any new chains from any node from this skipchain.
+//   - NewChainAnyNode allows new chains if any node from this skipchain is present.
+//   - NewChainStrictNodes allows new chains only one or more nodes from this skipchain
+//     are present in the new chain.
 type AddFollow struct {
 	SkipchainID SkipBlockID
 	Follow      FollowType
@@ -17,7 +17,9 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -63,6 +65,8 @@ type Service struct {
 	propagateForwardLink    messaging.PropagationFunc
 	propagateProof          messaging.PropagationFunc
 	verifiers               map[VerifierID]SkipBlockVerifier
+	policies                map[string]SkipBlockVerifier
+	policiesMutex           sync.Mutex
 	storageMutex            sync.Mutex
 	Storage                 *Storage
 	bftTimeout              time.Duration
@@ -84,20 +88,35 @@ type chainLocker struct {
 	// the key type is string because []byte is not allowed
 	// in Go maps as keys.
 	chains map[string]*sync.Mutex
+	// users counts, per chain, the lock held and the locks waited on.
+	users map[string]int
 	// a count of how many locks are currently held
 	locks int
 }
 
 var errTimeout = errors.New("timeout waiting to lock chain")
 
+// ErrorBlockInProgress is returned by StoreSkipBlock when another block is
+// being added to the same chain. Instead of holding the request until the
+// other block is done, the client is expected to retry later.
+var ErrorBlockInProgress = errors.New("a block is in progress on this chain")
+
+// IsBlockInProgress returns true if the error, which may have been received
+// from a remote node, is ErrorBlockInProgress.
+func IsBlockInProgress(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrorBlockInProgress.Error())
+}
+
 func (cl *chainLocker) lock(chain SkipBlockID) {
 	cl.Lock()
 	// Lazy initializtion.
 	if cl.chains == nil {
 		cl.chains = make(map[string]*sync.Mutex)
+		cl.users = make(map[string]int)
 	}
 
 	cl.locks++
+	cl.users[string(chain)]++
 	if l, ok := cl.chains[string(chain)]; ok {
 		cl.Unlock()
 		l.Lock()
@@ -111,6 +130,30 @@ func (cl *chainLocker) lock(chain SkipBlockID) {
 	return
 }
 
+// tryLock locks the chain only if nobody holds or waits on its lock, and
+// returns whether it did.
+func (cl *chainLocker) tryLock(chain SkipBlockID) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.chains == nil {
+		cl.chains = make(map[string]*sync.Mutex)
+		cl.users = make(map[string]int)
+	}
+	if cl.users[string(chain)] > 0 {
+		return false
+	}
+	l, ok := cl.chains[string(chain)]
+	if !ok {
+		l = new(sync.Mutex)
+		cl.chains[string(chain)] = l
+	}
+	// As nobody uses the lock, this doesn't block.
+	l.Lock()
+	cl.locks++
+	cl.users[string(chain)]++
+	return true
+}
+
 func (cl *chainLocker) unlock(chain SkipBlockID) {
 	key := string(chain)
 	cl.Lock()
@@ -118,6 +161,7 @@ func (cl *chainLocker) unlock(chain SkipBlockID) {
 	if l != nil {
 		l.Unlock()
 		cl.locks--
+		cl.users[key]--
 	}
 	// It is not possible to delete the entry from the map in a non-racy way.
 	// Consider 3 goroutines. #1 has the lock and is here unlocking. #2 is
@@ -168,6 +212,9 @@ type Storage struct {
 //
 // If TargetSkipChainID is an empty slice, the service will create a new
 // skipchain and store the given block as genesis-block.
+//
+// If another block is being added to the chain, ErrorBlockInProgress is
+// returned instead of waiting for it, and the client should retry.
 func (s *Service) StoreSkipBlock(psbd *StoreSkipBlock) (*StoreSkipBlockReply, error) {
 	if len(s.Storage.Clients) > 0 {
 		if psbd.Signature == nil {
@@ -179,7 +226,7 @@ func (s *Service) StoreSkipBlock(psbd *StoreSkipBlock) (*StoreSkipBlockReply, er
 				"wrong signature for this skipchain")
 		}
 	}
-	return s.StoreSkipBlockInternal(psbd)
+	return s.storeSkipBlock(psbd, false)
 }
 
 // StoreSkipBlockInternal bypasses the authentification performed in StoreSkipBlock.
@@ -187,7 +234,14 @@ func (s *Service) StoreSkipBlock(psbd *StoreSkipBlock) (*StoreSkipBlockReply, er
 // same host as the Skipchain one. If the Skipchain service is linked to a client,
 // its behavior is to reject any new foreign resquests, even it it comes from a local
 // service, like Byzcoin.
+// Unlike StoreSkipBlock, it waits for a block in progress on the same chain.
 func (s *Service) StoreSkipBlockInternal(psbd *StoreSkipBlock) (*StoreSkipBlockReply, error) {
+	return s.storeSkipBlock(psbd, true)
+}
+
+// storeSkipBlock adds the block. If wait is false and another block is being
+// added to the chain, it returns ErrorBlockInProgress.
+func (s *Service) storeSkipBlock(psbd *StoreSkipBlock, wait bool) (*StoreSkipBlockReply, error) {
 	err := s.incrementWorking()
 	if err != nil {
 		return nil, err
@@ -227,6 +281,12 @@ func (s *Service) StoreSkipBlockInternal(psbd *StoreSkipBlock) (*StoreSkipBlockR
 		if err != nil {
 			return nil, err
 		}
+		// Refuse chains whose blocks could never be verified.
+		for _, ver := range prop.VerifierIDs {
+			if _, ok := s.verifiers[ver]; !ok {
+				return nil, fmt.Errorf("unknown verification %s", ver)
+			}
+		}
 
 		// Propagate only the genesis block and let conodes ask for
 		// missing data
@@ -275,7 +335,11 @@ func (s *Service) StoreSkipBlockInternal(psbd *StoreSkipBlock) (*StoreSkipBlockR
 
 		// From now on we have everything we need and lock the adding of new blocks
 		// from this leader to this skipchain.
-		s.chains.lock(scID)
+		if wait {
+			s.chains.lock(scID)
+		} else if !s.chains.tryLock(scID) {
+			return nil, ErrorBlockInProgress
+		}
 		defer s.chains.unlock(scID)
 
 		var err error
@@ -555,7 +619,33 @@ func (s *Service) RegisterStoreSkipblockCallback(f func(SkipBlockID) error) {
 	s.db.callback = f
 }
 
-// SyncChain communicates with conodes in the Roster via getBlocks
+// RegisterCorruptedBlockCallback sets a callback function in SkipBlockDB,
+// which is called when a block of the db doesn't match its hash. The block
+// is then handled as missing, and RepairBlock can fetch it again.
+func (s *Service) RegisterCorruptedBlockCallback(f func(SkipBlockID)) {
+	s.db.corrupted = f
+}
+
+// RepairBlock fetches the block with the given ID from the nodes of the
+// roster and replaces the corrupted copy in the db. As the ID is the hash of
+// the block, the fetched block is checked against it and any node of the
+// roster can be asked.
+func (s *Service) RepairBlock(roster *onet.Roster, id SkipBlockID) error {
+	blocks, err := s.getBlocks(roster, id, 1)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return errors.New("didn't find the block")
+	}
+	sb := blocks[0]
+	if !sb.Hash.Equal(id) || !sb.CalculateHash().Equal(id) {
+		return errors.New("got a block that doesn't match its hash")
+	}
+	_, err = s.db.StoreBlocks([]*SkipBlock{sb})
+	return err
+}
+
 // in order traverse the chain and save the blocks locally. It starts with
 // the given 'latest' skipblockid and fetches all blocks up to the latest block.
 // In case there is no link in the database to store the 'latest' skipblock,
@@ -759,6 +849,60 @@ func (s *Service) GetAllSkipChainIDs(id *GetAllSkipChainIDs) (*GetAllSkipChainID
 	return reply, nil
 }
 
+// GetSkipChains returns the latest blocks of a page of the skipchains
+// matching the filters of the request. Only the IDs of the chains are loaded
+// at once, so it can be used on nodes holding many chains.
+func (s *Service) GetSkipChains(req *GetSkipChains) (*GetSkipChainsReply, error) {
+	ids, err := s.db.getSkipChainIDs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i], ids[j]) < 0
+	})
+	limit := req.Limit
+	if limit <= 0 || limit > MaxSkipChainsPerPage {
+		limit = MaxSkipChainsPerPage
+	}
+
+	reply := &GetSkipChainsReply{}
+	for _, id := range ids {
+		if req.After != nil && bytes.Compare(id, req.After) <= 0 {
+			continue
+		}
+		latest, err := s.db.GetLatestByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if latest.Index+1 < req.MinBlocks {
+			continue
+		}
+		if req.RosterContains != nil && !rosterHasPublic(latest.Roster, req.RosterContains) {
+			continue
+		}
+		if len(reply.Latest) == limit {
+			reply.Next = reply.Latest[limit-1].SkipChainID()
+			break
+		}
+		reply.Latest = append(reply.Latest, latest)
+	}
+	return reply, nil
+}
+
+// rosterHasPublic returns true if one of the nodes of the roster has the
+// given public key.
+func rosterHasPublic(roster *onet.Roster, pub kyber.Point) bool {
+	if roster == nil {
+		return false
+	}
+	for _, si := range roster.List {
+		if si.Public.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateLinkPrivate checks if the given public key is signed with our private
 // key and stores it in the list of allowed clients if it is true.
 func (s *Service) CreateLinkPrivate(link *CreateLinkPrivate) (*EmptyReply, error) {
@@ -1688,6 +1832,14 @@ func (s *Service) registerVerification(v VerifierID, f SkipBlockVerifier) error
 	return nil
 }
 
+// registerPolicy stores the policy of the skipchain, which is called by
+// VerifyExternal.
+func (s *Service) registerPolicy(scID SkipBlockID, f SkipBlockVerifier) {
+	s.policiesMutex.Lock()
+	defer s.policiesMutex.Unlock()
+	s.policies[string(scID)] = f
+}
+
 // verifyBlock makes sure the basic parameters of a block are correct and returns
 // an error if something fails.
 func (s *Service) verifyBlock(sb *SkipBlock) error {
@@ -1883,6 +2035,7 @@ func newSkipchainService(c *onet.Context) (onet.Service, error) {
 		db:               NewSkipBlockDB(db, bucket),
 		Storage:          &Storage{},
 		verifiers:        map[VerifierID]SkipBlockVerifier{},
+		policies:         map[string]SkipBlockVerifier{},
 		propTimeout:      defaultPropagateTimeout,
 		closing:          make(chan bool),
 		blockBuffer:      newSkipBlockBuffer(),
@@ -1893,7 +2046,7 @@ func newSkipchainService(c *onet.Context) (onet.Service, error) {
 	}
 	log.ErrFatal(s.RegisterHandlers(s.StoreSkipBlock, s.GetUpdateChain,
 		s.GetSingleBlock, s.GetSingleBlockByIndex, s.GetAllSkipchains,
-		s.GetAllSkipChainIDs, s.OptimizeProof,
+		s.GetAllSkipChainIDs, s.GetSkipChains, s.OptimizeProof,
 		s.CreateLinkPrivate, s.Unlink, s.AddFollow, s.ListFollow,
 		s.DelFollow, s.Listlink, s.ForwardLinkHandler))
 	s.ServiceProcessor.RegisterStatusReporter("Skipblock", s.db)
@@ -1903,6 +2056,9 @@ func newSkipchainService(c *onet.Context) (onet.Service, error) {
 	if err := s.registerVerification(VerifyBase, s.verifyFuncBase); err != nil {
 		return nil, err
 	}
+	if err := s.registerVerification(VerifyExternal, s.verifyFuncExternal); err != nil {
+		return nil, err
+	}
 
 	var err error
 	s.propagateGenesis, err = messaging.NewPropagationFunc(c, "SkipchainPropagate", s.propagateGenesisHandler, -1)
@@ -9,9 +9,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/calypso-demo/filesharing/pkg/protocols"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/kyber/v3/util/key"
@@ -422,6 +422,53 @@ func TestService_RegisterVerification(t *testing.T) {
 	require.Equal(t, 3, len(ServiceVerifierChan))
 }
 
+// TestService_VerificationPolicies hosts chains with different trust models
+// on the same nodes.
+func TestService_VerificationPolicies(t *testing.T) {
+	local := onet.NewLocalTest(cothority.Suite)
+	defer waitPropagationFinished(t, local)
+	defer local.CloseAll()
+	hosts, el, s1 := makeHELS(local, 3)
+
+	_, err := PolicyVerifiers("unknown")
+	require.Error(t, err)
+	external, err := PolicyVerifiers("external")
+	require.NoError(t, err)
+	standard, err := PolicyVerifiers("standard")
+	require.NoError(t, err)
+
+	_, err = makeGenesisRosterArgs(s1, el, nil,
+		[]VerifierID{VerifierID(uuid.NewV1())}, 1, 1)
+	require.Error(t, err)
+
+	addBlock := func(root *SkipBlock) error {
+		next := root.Copy()
+		next.BackLinkIDs = []SkipBlockID{root.Hash}
+		_, err := s1.StoreSkipBlock(&StoreSkipBlock{TargetSkipChainID: root.Hash,
+			NewBlock: next})
+		return err
+	}
+	accepting, err := makeGenesisRosterArgs(s1, el, nil, external, 1, 1)
+	require.NoError(t, err)
+	refusing, err := makeGenesisRosterArgs(s1, el, nil, external, 1, 1)
+	require.NoError(t, err)
+	unregistered, err := makeGenesisRosterArgs(s1, el, nil, external, 1, 1)
+	require.NoError(t, err)
+	plain, err := makeGenesisRosterArgs(s1, el, nil, standard, 1, 1)
+	require.NoError(t, err)
+	for _, h := range hosts {
+		require.NoError(t, RegisterPolicy(h, accepting.Hash,
+			func([]byte, *SkipBlock) bool { return true }))
+		require.NoError(t, RegisterPolicy(h, refusing.Hash,
+			func([]byte, *SkipBlock) bool { return false }))
+	}
+
+	require.NoError(t, addBlock(accepting))
+	require.Error(t, addBlock(refusing))
+	require.Error(t, addBlock(unregistered))
+	require.NoError(t, addBlock(plain))
+}
+
 func TestService_StoreSkipBlock2(t *testing.T) {
 	nbrHosts := 3
 	local := onet.NewLocalTest(cothority.Suite)
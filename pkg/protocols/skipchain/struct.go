@@ -30,6 +30,10 @@ import (
 // doesn't respect the consistency of the chain.
 var ErrorInconsistentForwardLink = errors.New("found inconsistent forward-link")
 
+// ErrorBlockCorrupted is returned when a block of the db doesn't match its
+// hash anymore.
+var ErrorBlockCorrupted = errors.New("stored block doesn't match its hash")
+
 // How long to wait before a timeout is generated in the propagation. It is not
 // set to a constant because we'd like to change it in the test.
 var defaultPropagateTimeout = 15 * time.Second
@@ -97,8 +101,8 @@ func (vids VerifierIDs) Equal(others []VerifierID) bool {
 // accepted or not. This function is used during a BFTCosi round, but wrapped
 // around so it accepts a block.
 //
-//   newID is the hash of the new block that will be signed
-//   newSB is the new block
+//	newID is the hash of the new block that will be signed
+//	newSB is the new block
 type SkipBlockVerifier func(newID []byte, newSB *SkipBlock) bool
 
 // PolicyNewChain defines how new chains from a followed chain are treated.
@@ -235,11 +239,26 @@ func RegisterVerification(s GetService, v VerifierID, f SkipBlockVerifier) error
 	return scs.(*Service).registerVerification(v, f)
 }
 
+// RegisterPolicy sets the function called by VerifyExternal for the blocks
+// of the given skipchain. It must be registered on every node of the roster.
+func RegisterPolicy(s GetService, scID SkipBlockID, f SkipBlockVerifier) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	scs.(*Service).registerPolicy(scID, f)
+	return nil
+}
+
 var (
 	// VerifyBase checks that the base-parameters are correct, i.e.,
 	// the links are correctly set up, the height-parameters and the
 	// verification didn't change.
 	VerifyBase = VerifierID(uuid.NewV5(uuid.NamespaceURL, "Base"))
+	// VerifyExternal calls the policy registered with RegisterPolicy for
+	// the skipchain of the block. The blocks of a skipchain without a
+	// policy are refused.
+	VerifyExternal = VerifierID(uuid.NewV5(uuid.NamespaceURL, "External"))
 )
 
 // VerificationStandard makes sure that all links are correct and that the
@@ -251,6 +270,29 @@ var VerificationStandard = []VerifierID{VerifyBase}
 // block to be appended.
 var VerificationNone = []VerifierID{}
 
+// VerificationPolicies are the trust models a skipchain can be created with,
+// by name. The verifications are stored in the genesis block and cannot
+// change afterwards, so a node can host skipchains with different models:
+//   - standard checks the links and the basic parameters of the blocks
+//   - signature only relies on the collective signature of the roster
+//   - external adds the policy registered with RegisterPolicy to the
+//     standard checks
+var VerificationPolicies = map[string][]VerifierID{
+	"standard":  VerificationStandard,
+	"signature": VerificationNone,
+	"external":  {VerifyBase, VerifyExternal},
+}
+
+// PolicyVerifiers returns the verifications of the trust model with the given
+// name, to be passed to CreateGenesis.
+func PolicyVerifiers(name string) ([]VerifierID, error) {
+	ver, ok := VerificationPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown verification policy %q", name)
+	}
+	return ver, nil
+}
+
 // SkipBlockFix represents the fixed part of a SkipBlock that will be hashed
 // and signed.
 type SkipBlockFix struct {
@@ -743,6 +785,7 @@ type SkipBlockDB struct {
 	latestBlocks map[string]SkipBlockID
 	latestMutex  sync.Mutex
 	callback     func(SkipBlockID) error
+	corrupted    func(SkipBlockID)
 }
 
 // NewSkipBlockDB returns an initialized SkipBlockDB structure.
@@ -789,7 +832,12 @@ func (db *SkipBlockDB) GetByID(sbID SkipBlockID) *SkipBlock {
 	})
 
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getting block %x: %v", []byte(sbID), err)
+		// A corrupted block is handled like a missing one, and the
+		// callback can fetch it again.
+		if err == ErrorBlockCorrupted && db.corrupted != nil {
+			db.corrupted(sbID)
+		}
 	}
 	return result
 }
@@ -802,6 +850,10 @@ func (db *SkipBlockDB) StoreBlocks(blocks []*SkipBlock) ([]SkipBlockID, error) {
 		for i, sb := range blocks {
 			log.Lvlf2("Storing skipblock %d / %x", sb.Index, sb.Hash)
 			sbOld, err := db.getFromTx(tx, sb.Hash)
+			if err == ErrorBlockCorrupted && sb.CalculateHash().Equal(sb.Hash) {
+				log.Warnf("Replacing corrupted skipblock %x", sb.Hash)
+				sbOld, err = nil, nil
+			}
 			if err != nil {
 				return errors.New("failed to get skipblock with error: " + err.Error())
 			}
@@ -1286,7 +1338,8 @@ func (db *SkipBlockDB) storeToTx(tx *bbolt.Tx, sb *SkipBlock) error {
 
 // getFromTx returns the skipblock identified by sbID.
 // nil is returned if the key does not exist.
-// An error is thrown if marshalling fails.
+// ErrorBlockCorrupted is returned if the stored block cannot be unmarshalled
+// or doesn't hash to sbID.
 // The caller must ensure that this function is called from within a valid transaction.
 func (db *SkipBlockDB) getFromTx(tx *bbolt.Tx, sbID SkipBlockID) (*SkipBlock, error) {
 	if sbID == nil {
@@ -1304,10 +1357,14 @@ func (db *SkipBlockDB) getFromTx(tx *bbolt.Tx, sbID SkipBlockID) (*SkipBlock, er
 	copy(buf, val)
 	_, sbMsg, err := network.Unmarshal(buf, suite)
 	if err != nil {
-		return nil, err
+		return nil, ErrorBlockCorrupted
+	}
+	sb, ok := sbMsg.(*SkipBlock)
+	if !ok || sb.SkipBlockFix == nil || !sb.CalculateHash().Equal(sbID) {
+		return nil, ErrorBlockCorrupted
 	}
 
-	return sbMsg.(*SkipBlock).Copy(), nil
+	return sb.Copy(), nil
 }
 
 // getAll returns all the data in the database as a map
@@ -1372,6 +1429,29 @@ func (db *SkipBlockDB) getAllSkipchains() (map[string]*SkipBlock, error) {
 	return gen, nil
 }
 
+// getSkipChainIDs returns the IDs of the genesis blocks in the database.
+// Unlike getAllSkipchains, only the IDs are kept in memory.
+func (db *SkipBlockDB) getSkipChainIDs() ([]SkipBlockID, error) {
+	var ids []SkipBlockID
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(db.bucketName))
+		return b.ForEach(func(k, v []byte) error {
+			_, sbMsg, err := network.Unmarshal(v, suite)
+			if err != nil {
+				return err
+			}
+			if sb, ok := sbMsg.(*SkipBlock); ok && sb.Index == 0 {
+				ids = append(ids, sb.Hash)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 // skipBlockBuffer will cache a proposed block when the conode has
 // verified it and it will later store it in the DB after the protocol
 // has succeeded.
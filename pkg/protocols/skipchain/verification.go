@@ -43,3 +43,16 @@ func (s *Service) verifyFuncBase(newID []byte, newSB *SkipBlock) bool {
 	log.Lvl4("No verification - accepted")
 	return true
 }
+
+// verifyFuncExternal calls the policy registered for the skipchain of the
+// block.
+func (s *Service) verifyFuncExternal(newID []byte, newSB *SkipBlock) bool {
+	s.policiesMutex.Lock()
+	f, ok := s.policies[string(newSB.SkipChainID())]
+	s.policiesMutex.Unlock()
+	if !ok {
+		log.Lvlf2("No policy for skipchain %x", newSB.SkipChainID())
+		return false
+	}
+	return f(newID, newSB)
+}
@@ -0,0 +1,55 @@
+package cothority
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+)
+
+// TraceEvent is logged as one line of JSON at every phase of a traced
+// request, so that a single request can be followed across all nodes by
+// searching the logs for its ID.
+type TraceEvent struct {
+	TraceID string `json:"trace_id"`
+	Node    string `json:"node,omitempty"`
+	Phase   string `json:"phase"`
+	// Time is the Unix timestamp of the event in nanoseconds.
+	Time  int64  `json:"time"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewTraceID returns a new random ID to trace a request.
+func NewTraceID() string {
+	buf := make([]byte, 8)
+	random.Bytes(buf, random.New())
+	return hex.EncodeToString(buf)
+}
+
+// LogTrace logs a TraceEvent for the given phase at level 2. Nothing is
+// logged if traceID is empty. The node can be nil for events on the client.
+func LogTrace(traceID string, node *network.ServerIdentity, phase string, err error) {
+	if traceID == "" {
+		return
+	}
+	ev := TraceEvent{
+		TraceID: traceID,
+		Phase:   phase,
+		Time:    time.Now().UnixNano(),
+	}
+	if node != nil {
+		ev.Node = node.Address.String()
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("couldn't marshal trace event:", err)
+		return
+	}
+	log.Lvl2(string(buf))
+}
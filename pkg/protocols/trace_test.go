@@ -0,0 +1,26 @@
+package cothority
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test that trace IDs are random and that the events can be decoded.
+func TestTrace_NewTraceID(t *testing.T) {
+	id := NewTraceID()
+	require.Equal(t, 16, len(id))
+	require.NotEqual(t, id, NewTraceID())
+
+	buf, err := json.Marshal(TraceEvent{TraceID: id, Phase: "test"})
+	require.NoError(t, err)
+	var ev TraceEvent
+	require.NoError(t, json.Unmarshal(buf, &ev))
+	require.Equal(t, id, ev.TraceID)
+	require.NotContains(t, string(buf), "error")
+
+	// Must not panic without a node or a trace ID.
+	LogTrace(id, nil, "test", nil)
+	LogTrace("", nil, "test", nil)
+}
@@ -54,6 +54,7 @@ export class Calypso {
         const xhatenc = await this.lts.reencryptKey(
             wrProof,
             rdProof,
+            kp.priv,
         );
 
         const key = await xhatenc.decrypt(kp.priv);
@@ -220,6 +220,7 @@ export class CalypsoReadInstance extends Instance {
         const xhatenc = await ocs.reencryptKey(
             await this.rpc.getProof(this.read.write),
             await this.rpc.getProof(this.id),
+            priv,
         );
         return xhatenc.decrypt(priv);
     }
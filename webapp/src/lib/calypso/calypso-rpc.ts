@@ -1,4 +1,6 @@
-import { Point, PointFactory, Scalar } from "@dedis/kyber";
+import { curve, Point, PointFactory, Scalar, sign } from "@dedis/kyber";
+import { createHash, randomBytes } from "crypto-browserify";
+import Long from "long";
 import { Message, Properties } from "protobufjs/light";
 import { Argument, ClientTransaction, InstanceID, Instruction, Proof } from "../byzcoin";
 import ByzCoinRPC from "../byzcoin/byzcoin-rpc";
@@ -8,6 +10,9 @@ import { RosterWSConnection } from "../network";
 import { registerMessage } from "../protobuf";
 import { DecodeKey, OnChainSecretInstance } from "./calypso-instance";
 
+const ed25519 = curve.newCurve("edwards25519");
+const {schnorr} = sign;
+
 /**
  * OnChainSecretRPC is used to contact the OnChainSecret service of the cothority.
  * With it you can set up a new long-term onchain-secret, give it a policy to accept
@@ -77,10 +82,12 @@ export class OnChainSecretRPC {
 
     // reencryptKey takes as input Read- and Write- Proofs. It verifies that
     // the read/write requests match and then re-encrypts the secret
-    // given the public key information of the reader.
-    async reencryptKey(write: Proof, read: Proof): Promise<DecryptKeyReply> {
+    // given the public key information of the reader. The request is signed
+    // with the private key of the reader, as the conodes refuse unsigned
+    // requests.
+    async reencryptKey(write: Proof, read: Proof, priv: Scalar): Promise<DecryptKeyReply> {
         const sock = new WebSocketConnection(this.list[0].getWebSocketAddress(), OnChainSecretRPC.serviceID);
-        return sock.send(new DecryptKey({read, write}), DecryptKeyReply);
+        return sock.send(DecryptKey.signed(read, write, priv), DecryptKeyReply);
     }
 }
 
@@ -208,8 +215,35 @@ export class DecryptKey extends Message<DecryptKey> {
         registerMessage("DecryptKey", DecryptKey);
     }
 
+    /**
+     * signed returns a request holding a timestamp and a random nonce, signed
+     * with the private key the secret is re-encrypted to, so that it cannot
+     * be sent again.
+     *
+     * @param read the proof of the read instance
+     * @param write the proof of the write instance
+     * @param priv the private key of the reader
+     */
+    static signed(read: Proof, write: Proof, priv: Scalar): DecryptKey {
+        const timestamp = Long.fromNumber(Math.floor(Date.now() / 1000));
+        const nonce = randomBytes(16);
+        const ts = Buffer.alloc(8);
+        ts.writeUInt32LE(timestamp.getLowBitsUnsigned(), 0);
+        ts.writeUInt32LE(timestamp.getHighBitsUnsigned(), 4);
+        const h = createHash("sha256");
+        h.update(Buffer.from("calypso-decrypt-request"));
+        h.update(read.key);
+        h.update(ts);
+        h.update(nonce);
+        const signature = schnorr.sign(ed25519, priv, h.digest());
+        return new DecryptKey({read, write, timestamp, nonce, signature});
+    }
+
     readonly read: Proof;
     readonly write: Proof;
+    readonly timestamp: Long;
+    readonly nonce: Buffer;
+    readonly signature: Buffer;
 
     constructor(props?: Properties<DecryptKey>) {
         super(props);
@@ -254,6 +288,7 @@ export class LtsInstanceInfo extends Message<LtsInstanceInfo> {
     }
 
     readonly roster: Roster;
+    readonly weights: number[];
 
     constructor(props?: Properties<LtsInstanceInfo>) {
         super(props);
@@ -176,7 +176,7 @@ export default class RoPaSciInstance extends Instance {
         await this.update();
         if (this.isCalypso()) {
             const dreply = await lts.reencryptKey(await this.rpc.getProof(this.struct.calypsoWrite),
-                await this.rpc.getProof(this.struct.calypsoRead));
+                await this.rpc.getProof(this.struct.calypsoRead), priv);
             const preHash = await dreply.decrypt(priv);
             this.firstMove = preHash[0];
             this.fillUp = Buffer.allocUnsafe(31);